@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
+	"os"
+	"os/signal"
 
 	"github.com/apache/arrow/go/arrow/array"
 	"github.com/kris-gaudel/tinylake/internal/arrowengine"
@@ -11,15 +14,25 @@ import (
 )
 
 func main() {
+	// Run a .sql script when one is given, e.g. go run ./cmd/coordinator queries.sql.
+	// Scripts load their own data with COPY ... FROM.
+	if len(os.Args) > 1 {
+		if err := runScript(os.Args[1]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// The CSV is read in batches, so the file never has to fit in memory
 	filePath := "data/sample.csv"
-	record, err := arrowengine.LoadCSVToArrowTable(filePath)
+	input, err := arrowengine.OpenCSV(filePath, arrowengine.PricesSchema, 1024)
 	if err != nil {
-		log.Fatalf("Failed to load CSV: %v", err)
+		log.Fatalf("Failed to open CSV: %v", err)
 	}
+	defer input.Release()
 
-	fmt.Println("Loaded Arrow Table successfully!")
-	fmt.Println("Schema:", record.Schema())
-	fmt.Println("Record count:", record.NumRows())
+	fmt.Println("Opened CSV successfully!")
+	fmt.Println("Schema:", input.Schema())
 
 	// Test query
 	// queryStr := "SELECT Date, Close FROM prices WHERE Close > 8000.2 AND Close < 9000.2"
@@ -34,22 +47,67 @@ func main() {
 	// queryStr := "SELECT Date, COUNT(*) FROM prices GROUP BY Date"
 	queryStr := "SELECT Date, AVG((High + Low) / 2) FROM prices GROUP BY Date"
 	parser := queryparser.NewParser(queryStr)
-	query := parser.Parse()
+	query, err := parser.Parse()
+	if err != nil {
+		log.Fatalf("failed to parse query:\n%s", queryparser.FormatError(queryStr, err))
+	}
 
 	fmt.Println("Parsed Query:", query.String())
 
-	// Execute the query
-	result, err := engine.ExecuteQuery(query, record)
+	// Execute the query a batch at a time
+	result, err := engine.ExecuteStream(query, input)
 	if err != nil {
-		log.Fatalf("query execution failed: %v", err)
+		log.Fatalf("query execution failed:\n%s", queryparser.FormatError(queryStr, err))
 	}
 	defer result.Release()
 
+	var numRows int64
+	for result.Next() {
+		// Pretty-print each result batch
+		printRecord(result.Record())
+		numRows += result.Record().NumRows()
+	}
+	if err := result.Err(); err != nil {
+		log.Fatalf("query execution failed:\n%s", queryparser.FormatError(queryStr, err))
+	}
+
 	fmt.Println("Query executed successfully.")
+	fmt.Println("Number of rows in result:", numRows)
+}
 
-	// Pretty-print Result
-	printRecord(result)
-	fmt.Println("Number of rows in result:", result.NumRows())
+// runScript parses every statement in a .sql file and runs them in order
+// against an initially empty catalog.
+func runScript(path string) error {
+	script, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read script: %w", err)
+	}
+	stmts, err := queryparser.NewParser(string(script)).ParseScript()
+	if err != nil {
+		return fmt.Errorf("failed to parse script:\n%s", queryparser.FormatError(string(script), err))
+	}
+
+	catalog := engine.NewMemoryCatalog()
+	defer catalog.Release()
+	session := engine.NewSession(catalog)
+	defer session.Close()
+
+	// Ctrl-C cancels the running statement, which ends the script
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	for i, stmt := range stmts {
+		fmt.Println("Running:", stmt.String())
+		result, err := session.ExecuteContext(ctx, stmt)
+		if err != nil {
+			return fmt.Errorf("statement %d:\n%s", i+1, queryparser.FormatError(string(script), err))
+		}
+		if result != nil {
+			printRecord(result)
+			result.Release()
+		}
+	}
+	return nil
 }
 
 // Utility function to pretty-print an Arrow Record
@@ -70,8 +128,17 @@ func printRecord(rec array.Record) {
 					fmt.Printf("%-20s", col.Value(row))
 				case *array.Float64:
 					fmt.Printf("%-20.2f", col.Value(row))
+				case *array.Int64:
+					fmt.Printf("%-20d", col.Value(row))
+				case *array.Boolean:
+					fmt.Printf("%-20t", col.Value(row))
 				default:
-					fmt.Printf("%-20v", "unsupported")
+					// Dates, timestamps and nested values such as lists and structs
+					text, err := engine.FormatValue(col, row)
+					if err != nil {
+						text = "unsupported"
+					}
+					fmt.Printf("%-20s", text)
 				}
 			} else {
 				fmt.Printf("%-20s", "NULL")
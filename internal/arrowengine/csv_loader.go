@@ -1,14 +1,29 @@
 package arrowengine
 
 import (
+	"encoding/csv"
 	"fmt"
 	"os"
+	"strconv"
+	"sync/atomic"
 
 	"github.com/apache/arrow/go/arrow"
 	"github.com/apache/arrow/go/arrow/array"
 	arrowcsv "github.com/apache/arrow/go/arrow/csv"
+	"github.com/apache/arrow/go/arrow/memory"
 )
 
+// PricesSchema is the schema of data/sample.csv.
+var PricesSchema = arrow.NewSchema([]arrow.Field{
+	{Name: "Date", Type: arrow.BinaryTypes.String, Nullable: true},
+	{Name: "Open", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
+	{Name: "High", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
+	{Name: "Low", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
+	{Name: "Close", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
+	{Name: "Volume", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
+	{Name: "Market Cap", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
+}, nil)
+
 func LoadCSVToArrowTable(filePath string) (array.Record, error) {
 	f, err := os.Open(filePath)
 	if err != nil {
@@ -16,17 +31,7 @@ func LoadCSVToArrowTable(filePath string) (array.Record, error) {
 	}
 	defer f.Close()
 
-	schema := arrow.NewSchema([]arrow.Field{
-		{Name: "Date", Type: arrow.BinaryTypes.String, Nullable: true},
-		{Name: "Open", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
-		{Name: "High", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
-		{Name: "Low", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
-		{Name: "Close", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
-		{Name: "Volume", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
-		{Name: "Market Cap", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
-	}, nil)
-
-	reader := arrowcsv.NewReader(f, schema, arrowcsv.WithHeader(true), arrowcsv.WithChunk(-1))
+	reader := arrowcsv.NewReader(f, PricesSchema, arrowcsv.WithHeader(true), arrowcsv.WithChunk(-1))
 	defer reader.Release()
 
 	ok := reader.Next()
@@ -43,3 +48,196 @@ func LoadCSVToArrowTable(filePath string) (array.Record, error) {
 
 	return rec, nil
 }
+
+// CSVReader reads a CSV file a batch of rows at a time. Releasing it closes
+// the file.
+type CSVReader struct {
+	*arrowcsv.Reader
+	refs int64
+	file *os.File
+}
+
+// OpenCSV opens a CSV file with a header row for reading as records of at most
+// batchSize rows with the given schema, so the file never has to fit in memory.
+func OpenCSV(filePath string, schema *arrow.Schema, batchSize int) (*CSVReader, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	reader := arrowcsv.NewReader(f, schema, arrowcsv.WithHeader(true), arrowcsv.WithChunk(batchSize))
+	return &CSVReader{Reader: reader, refs: 1, file: f}, nil
+}
+
+func (r *CSVReader) Retain() {
+	atomic.AddInt64(&r.refs, 1)
+}
+
+func (r *CSVReader) Release() {
+	if atomic.AddInt64(&r.refs, -1) == 0 {
+		r.Reader.Release()
+		r.file.Close()
+	}
+}
+
+// CSVOptions describe the layout of a CSV file.
+type CSVOptions struct {
+	// Header is whether the first row holds the column names.
+	Header bool
+	// Delimiter separates the fields of a row; zero means a comma.
+	Delimiter rune
+}
+
+// DefaultCSVOptions are comma separated fields with a header row.
+var DefaultCSVOptions = CSVOptions{Header: true, Delimiter: ','}
+
+func (o CSVOptions) comma() rune {
+	if o.Delimiter == 0 {
+		return ','
+	}
+	return o.Delimiter
+}
+
+// LoadCSV reads a CSV file into a record, inferring each column's type from
+// its values: Int64 or Float64 when every value is numeric, Boolean when every
+// value is true or false, and String otherwise. Empty fields are NULL. Without
+// a header row the columns are named column0, column1, and so on.
+func LoadCSV(filePath string, opts CSVOptions) (array.Record, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.Comma = opts.comma()
+	rows, err := r.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CSV: %w", err)
+	}
+	var header []string
+	switch {
+	case opts.Header && len(rows) == 0:
+		return nil, fmt.Errorf("CSV file %s has no header row", filePath)
+	case opts.Header:
+		header, rows = rows[0], rows[1:]
+	case len(rows) == 0:
+		return nil, fmt.Errorf("CSV file %s has no rows", filePath)
+	default:
+		header = make([]string, len(rows[0]))
+		for i := range header {
+			header[i] = fmt.Sprintf("column%d", i)
+		}
+	}
+
+	fields := make([]arrow.Field, len(header))
+	for i, name := range header {
+		fields[i] = arrow.Field{Name: name, Type: inferCSVType(rows, i), Nullable: true}
+	}
+	schema := arrow.NewSchema(fields, nil)
+
+	b := array.NewRecordBuilder(memory.NewGoAllocator(), schema)
+	defer b.Release()
+	for _, row := range rows {
+		for i, f := range fields {
+			appendCSVValue(b.Field(i), f.Type, row[i])
+		}
+	}
+	return b.NewRecord(), nil
+}
+
+func inferCSVType(rows [][]string, col int) arrow.DataType {
+	isInt, isFloat, isBool, seen := true, true, true, false
+	for _, row := range rows {
+		v := row[col]
+		if v == "" {
+			continue
+		}
+		seen = true
+		if _, err := strconv.ParseInt(v, 10, 64); err != nil {
+			isInt = false
+		}
+		if _, err := strconv.ParseFloat(v, 64); err != nil {
+			isFloat = false
+		}
+		if _, err := strconv.ParseBool(v); err != nil || isZeroOrOne(v) {
+			isBool = false
+		}
+	}
+	switch {
+	case !seen:
+		return arrow.BinaryTypes.String
+	case isInt:
+		return arrow.PrimitiveTypes.Int64
+	case isFloat:
+		return arrow.PrimitiveTypes.Float64
+	case isBool:
+		return arrow.FixedWidthTypes.Boolean
+	default:
+		return arrow.BinaryTypes.String
+	}
+}
+
+// isZeroOrOne reports whether v is 0 or 1, which ParseBool accepts but which
+// should be read as numbers.
+func isZeroOrOne(v string) bool {
+	return v == "0" || v == "1"
+}
+
+func appendCSVValue(b array.Builder, dt arrow.DataType, v string) {
+	if v == "" {
+		b.AppendNull()
+		return
+	}
+	switch dt.ID() {
+	case arrow.INT64:
+		i, _ := strconv.ParseInt(v, 10, 64)
+		b.(*array.Int64Builder).Append(i)
+	case arrow.FLOAT64:
+		f, _ := strconv.ParseFloat(v, 64)
+		b.(*array.Float64Builder).Append(f)
+	case arrow.BOOL:
+		t, _ := strconv.ParseBool(v)
+		b.(*array.BooleanBuilder).Append(t)
+	default:
+		b.(*array.StringBuilder).Append(v)
+	}
+}
+
+// WriteCSV writes rec to a CSV file, replacing the file if it exists. NULLs
+// are written as empty fields. Its columns must be of types the CSV writer
+// handles, booleans, numbers and strings; the file is left as it was when one
+// is not.
+func WriteCSV(filePath string, rec array.Record, opts CSVOptions) error {
+	for i, field := range rec.Schema().Fields() {
+		if !csvWritable(field.Type) {
+			return fmt.Errorf("cannot write column %d (%s) of type %v to CSV", i, field.Name, field.Type)
+		}
+	}
+	f, err := os.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+
+	w := arrowcsv.NewWriter(f, rec.Schema(), arrowcsv.WithHeader(opts.Header),
+		arrowcsv.WithComma(opts.comma()), arrowcsv.WithNullWriter(""))
+	if err := w.Write(rec); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write CSV: %w", err)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write CSV: %w", err)
+	}
+	return f.Close()
+}
+
+// csvWritable reports whether the CSV writer handles columns of type dt.
+func csvWritable(dt arrow.DataType) bool {
+	switch dt.ID() {
+	case arrow.BOOL, arrow.INT8, arrow.INT16, arrow.INT32, arrow.INT64,
+		arrow.UINT8, arrow.UINT16, arrow.UINT32, arrow.UINT64,
+		arrow.FLOAT32, arrow.FLOAT64, arrow.STRING:
+		return true
+	}
+	return false
+}
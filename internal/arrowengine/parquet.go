@@ -0,0 +1,153 @@
+package arrowengine
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/ipc"
+	"github.com/apache/arrow/go/arrow/memory"
+	arrow12 "github.com/apache/arrow/go/v12/arrow"
+	array12 "github.com/apache/arrow/go/v12/arrow/array"
+	ipc12 "github.com/apache/arrow/go/v12/arrow/ipc"
+	memory12 "github.com/apache/arrow/go/v12/arrow/memory"
+	"github.com/apache/arrow/go/v12/parquet"
+	"github.com/apache/arrow/go/v12/parquet/pqarrow"
+)
+
+// The Parquet reader and writer come with a newer Arrow library than the
+// engine's. Records cross between the two in the Arrow IPC stream format,
+// which both read and write.
+
+// WriteParquet writes rec to a Parquet file, replacing the file if it exists.
+// The Arrow schema is stored with the data, so LoadParquet gives back the same
+// column types. The file is left as it was when a column's type has no Parquet
+// equivalent.
+func WriteParquet(filePath string, rec array.Record) error {
+	converted, err := toArrow12(rec)
+	if err != nil {
+		return err
+	}
+	defer converted.Release()
+
+	props := parquet.NewWriterProperties()
+	arrowProps := pqarrow.NewArrowWriterProperties(pqarrow.WithStoreSchema())
+	if _, err := pqarrow.ToParquet(converted.Schema(), props, arrowProps); err != nil {
+		return fmt.Errorf("cannot write to Parquet: %w", err)
+	}
+
+	f, err := os.Create(filePath)
+	if err != nil {
+		return fmt.Errorf("failed to create file: %w", err)
+	}
+	w, err := pqarrow.NewFileWriter(converted.Schema(), f, props, arrowProps)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write Parquet: %w", err)
+	}
+	if err := w.Write(converted); err != nil {
+		w.Close()
+		return fmt.Errorf("failed to write Parquet: %w", err)
+	}
+	// Closing the writer closes the file
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to write Parquet: %w", err)
+	}
+	return nil
+}
+
+// LoadParquet reads a Parquet file into a record.
+func LoadParquet(filePath string) (array.Record, error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+
+	pool := memory12.NewGoAllocator()
+	table, err := pqarrow.ReadTable(context.Background(), f, parquet.NewReaderProperties(pool), pqarrow.ArrowReadProperties{}, pool)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Parquet: %w", err)
+	}
+	defer table.Release()
+
+	// The reader gives each column in chunks; the engine wants one record
+	cols := make([]arrow12.Array, table.NumCols())
+	defer func() {
+		for _, c := range cols {
+			if c != nil {
+				c.Release()
+			}
+		}
+	}()
+	for i := range cols {
+		col := table.Column(i)
+		if chunks := col.Data().Chunks(); len(chunks) > 0 {
+			if cols[i], err = array12.Concatenate(chunks, pool); err != nil {
+				return nil, fmt.Errorf("failed to read Parquet: %w", err)
+			}
+		} else {
+			cols[i] = array12.MakeArrayOfNull(pool, col.DataType(), 0)
+		}
+	}
+	// Drop the Parquet field ids the reader adds to each column's metadata
+	fields := make([]arrow12.Field, len(cols))
+	for i, f := range table.Schema().Fields() {
+		fields[i] = arrow12.Field{Name: f.Name, Type: f.Type, Nullable: f.Nullable}
+	}
+	rec := array12.NewRecord(arrow12.NewSchema(fields, nil), cols, table.NumRows())
+	defer rec.Release()
+	return fromArrow12(rec)
+}
+
+// toArrow12 copies rec into a record of the newer Arrow library.
+func toArrow12(rec array.Record) (arrow12.Record, error) {
+	var buf bytes.Buffer
+	w := ipc.NewWriter(&buf, ipc.WithSchema(rec.Schema()))
+	if err := w.Write(rec); err != nil {
+		w.Close()
+		return nil, fmt.Errorf("cannot convert record: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("cannot convert record: %w", err)
+	}
+
+	r, err := ipc12.NewReader(&buf)
+	if err != nil {
+		return nil, fmt.Errorf("cannot convert record: %w", err)
+	}
+	defer r.Release()
+	if !r.Next() {
+		return nil, fmt.Errorf("cannot convert record: %v", r.Err())
+	}
+	out := r.Record()
+	out.Retain()
+	return out, nil
+}
+
+// fromArrow12 copies rec into a record of the engine's Arrow library.
+func fromArrow12(rec arrow12.Record) (array.Record, error) {
+	var buf bytes.Buffer
+	w := ipc12.NewWriter(&buf, ipc12.WithSchema(rec.Schema()))
+	if err := w.Write(rec); err != nil {
+		w.Close()
+		return nil, fmt.Errorf("cannot convert record: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("cannot convert record: %w", err)
+	}
+
+	r, err := ipc.NewReader(&buf, ipc.WithAllocator(memory.NewGoAllocator()))
+	if err != nil {
+		return nil, fmt.Errorf("cannot convert record: %w", err)
+	}
+	defer r.Release()
+	if !r.Next() {
+		return nil, fmt.Errorf("cannot convert record: %v", r.Err())
+	}
+	out := r.Record()
+	out.Retain()
+	return out, nil
+}
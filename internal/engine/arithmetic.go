@@ -0,0 +1,125 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+var (
+	errDivisionByZero  = errors.New("division by zero")
+	errIntegerOverflow = errors.New("integer overflow")
+)
+
+// arithmeticError names the expression e in err, if err is an error of
+// evaluating it rather than of its operands, which name their own.
+func arithmeticError(err error, e queryparser.Expression) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%w in %s", err, queryparser.FormatExpr(e))
+}
+
+// nullDivisors replaces every divisor d in q, of / and MOD, with NULLIF(d, 0),
+// so that dividing by zero gives NULL instead of failing, as
+// division_by_zero = null has it.
+func nullDivisors(q *queryparser.Query) *queryparser.Query {
+	return queryparser.TransformQuery(q, nullDivisor)
+}
+
+// nullDivisorsIn is nullDivisors for a single expression.
+func nullDivisorsIn(expr queryparser.Expression) queryparser.Expression {
+	if expr == nil {
+		return nil
+	}
+	return queryparser.Transform(expr, nullDivisor)
+}
+
+// nullDivisorsInStatement is nullDivisors for the expressions of INSERT,
+// UPDATE, DELETE and MERGE, which are evaluated outside any query. Other
+// statements are returned unchanged.
+func nullDivisorsInStatement(stmt queryparser.Statement) queryparser.Statement {
+	switch st := stmt.(type) {
+	case *queryparser.InsertStmt:
+		out := *st
+		out.Rows = make([][]queryparser.Expression, len(st.Rows))
+		for i, row := range st.Rows {
+			out.Rows[i] = make([]queryparser.Expression, len(row))
+			for j, expr := range row {
+				out.Rows[i][j] = nullDivisorsIn(expr)
+			}
+		}
+		if st.OnConflict != nil {
+			out.OnConflict = &queryparser.OnConflict{Columns: st.OnConflict.Columns, Set: nullDivisorsInAssignments(st.OnConflict.Set)}
+		}
+		return &out
+	case *queryparser.UpdateStmt:
+		out := *st
+		out.Set = nullDivisorsInAssignments(st.Set)
+		out.Where = nullDivisorsIn(st.Where)
+		return &out
+	case *queryparser.DeleteStmt:
+		out := *st
+		out.Where = nullDivisorsIn(st.Where)
+		return &out
+	case *queryparser.MergeStmt:
+		out := *st
+		out.On = nullDivisorsIn(st.On)
+		out.Clauses = make([]queryparser.MergeClause, len(st.Clauses))
+		for i, c := range st.Clauses {
+			c.Cond = nullDivisorsIn(c.Cond)
+			c.Set = nullDivisorsInAssignments(c.Set)
+			values := make([]queryparser.Expression, len(c.Values))
+			for j, v := range c.Values {
+				values[j] = nullDivisorsIn(v)
+			}
+			c.Values = values
+			out.Clauses[i] = c
+		}
+		return &out
+	default:
+		return stmt
+	}
+}
+
+func nullDivisorsInAssignments(set []queryparser.Assignment) []queryparser.Assignment {
+	out := make([]queryparser.Assignment, len(set))
+	for i, a := range set {
+		out[i] = queryparser.Assignment{Column: a.Column, Value: nullDivisorsIn(a.Value)}
+	}
+	return out
+}
+
+func nullDivisor(expr queryparser.Expression) queryparser.Expression {
+	switch e := expr.(type) {
+	case *queryparser.BinaryExpr:
+		if e.Op == "/" && !isNullDivisor(e.Right) {
+			return &queryparser.BinaryExpr{Left: e.Left, Op: e.Op, Right: nullIfZero(e.Right)}
+		}
+	case *queryparser.FuncCall:
+		if strings.EqualFold(e.Name, "MOD") && len(e.Args) == 2 && !isNullDivisor(e.Args[1]) {
+			call := *e
+			call.Args = []queryparser.Expression{e.Args[0], nullIfZero(e.Args[1])}
+			return &call
+		}
+	}
+	return expr
+}
+
+func nullIfZero(expr queryparser.Expression) queryparser.Expression {
+	return &queryparser.FuncCall{Name: "NULLIF", Args: []queryparser.Expression{expr, &queryparser.Literal{Value: "0", Kind: queryparser.LiteralNumber}}}
+}
+
+// isNullDivisor reports whether expr is a divisor nullDivisor has already
+// replaced, as the subqueries of a query it has rewritten are run on their
+// own.
+func isNullDivisor(expr queryparser.Expression) bool {
+	fc, ok := expr.(*queryparser.FuncCall)
+	if !ok || fc.Name != "NULLIF" || len(fc.Args) != 2 {
+		return false
+	}
+	lit, ok := fc.Args[1].(*queryparser.Literal)
+	return ok && lit.Kind == queryparser.LiteralNumber && lit.Value == "0"
+}
@@ -0,0 +1,975 @@
+package engine
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/memory"
+
+	"github.com/kris-gaudel/tinylake/internal/planner"
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// unknownType is the type of an expression whose type is only known once it
+// runs, such as NULL or a column of a view.
+var unknownType arrow.DataType = arrow.Null
+
+// planTypes are the types of the columns each SELECT list of a plan produces.
+type planTypes map[*planner.Project][]arrow.DataType
+
+// binder checks a plan before any of it runs. It resolves every column
+// reference against the schemas of the tables the plan reads and infers the
+// type of every expression, rejecting unknown columns and functions and
+// arguments of the wrong type, such as the AVG of a string column. Views are
+// checked when they run, so the columns read from them are not.
+type binder struct {
+	tables map[string]array.Record
+	ec     *execContext
+	ctes   []boundCTE
+	outer  *scope // the scope of the query the plan being bound is nested in
+	types  planTypes
+}
+
+// boundCTE is the output of a CTE in scope.
+type boundCTE struct {
+	name  string
+	scope *scope
+}
+
+// scope holds the columns an expression may reference. An open scope has
+// columns the binder cannot name, so a reference that matches none of its
+// known columns is not an error but of unknown type.
+type scope struct {
+	schema *arrow.Schema
+	open   bool
+	outer  *scope // the scope of the enclosing query, for correlated subqueries
+}
+
+// bindPlan binds plan against tables and returns the types of its SELECT lists.
+func bindPlan(plan planner.Node, tables map[string]array.Record, ec *execContext) (planTypes, error) {
+	b := &binder{tables: tables, ec: ec, types: planTypes{}}
+	if _, err := b.bind(plan); err != nil {
+		return nil, err
+	}
+	return b.types, nil
+}
+
+// bind returns the output columns of n.
+func (b *binder) bind(n planner.Node) (*scope, error) {
+	switch n := n.(type) {
+	case *planner.Scan:
+		qualifier := n.Alias
+		if qualifier == "" {
+			qualifier = n.Table
+		}
+		if cte, ok := b.cte(n.Table); ok {
+			return b.newScope(qualifyFields(cte.schema.Fields(), qualifier), n.Columns, qualifier, cte.open)
+		}
+		if rec, ok := findTable(b.tables, n.Table); ok {
+			return b.newScope(qualifyFields(rec.Schema().Fields(), qualifier), n.Columns, qualifier, false)
+		}
+		if _, _, ok := findView(b.ec.views, n.Table); ok {
+			return b.newScope(nil, nil, qualifier, true)
+		}
+		return nil, fmt.Errorf("table %s not found", n.Table)
+	case *planner.Derived:
+		sc, err := b.bind(n.Input)
+		if err != nil {
+			return nil, err
+		}
+		return b.newScope(qualifyFields(sc.schema.Fields(), n.Alias), n.Columns, n.Alias, sc.open)
+	case *planner.Pivot:
+		return b.bindPivot(n)
+	case *planner.Unnest:
+		return b.bindUnnest(n)
+	case *planner.Values:
+		return b.bindValues(n)
+	case *planner.Join:
+		left, err := b.bind(n.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := b.bind(n.Right)
+		if err != nil {
+			return nil, err
+		}
+		fields := append(append([]arrow.Field{}, left.schema.Fields()...), right.schema.Fields()...)
+		sc := &scope{schema: arrow.NewSchema(fields, nil), open: left.open || right.open, outer: b.outer}
+		return sc, b.checkCondition(n.On, sc, "JOIN condition")
+	case *planner.Filter:
+		sc, err := b.bind(n.Input)
+		if err != nil {
+			return nil, err
+		}
+		return sc, b.checkCondition(n.Condition, sc, "WHERE clause")
+	case *planner.Project:
+		return b.bindSelect(n)
+	case *planner.Sort:
+		sc, err := b.bind(n.Input)
+		if err != nil {
+			return nil, err
+		}
+		orderBy, err := resolveOrderBy(n.OrderBy, outputColumns(sc.schema), nil)
+		if err != nil {
+			return nil, err
+		}
+		return sc, b.bindOrderBy(orderBy, sc)
+	case *planner.Distinct:
+		return b.bind(n.Input)
+	case *planner.SetOp:
+		left, err := b.bind(n.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := b.bind(n.Right)
+		if err != nil {
+			return nil, err
+		}
+		// Columns keep their type when both sides agree on it
+		fields := append([]arrow.Field{}, left.schema.Fields()...)
+		for i := range fields {
+			if i >= len(right.schema.Fields()) || !arrow.TypeEqual(fields[i].Type, right.schema.Field(i).Type) {
+				fields[i].Type = unknownType
+			}
+		}
+		return &scope{schema: arrow.NewSchema(fields, nil), open: left.open || right.open, outer: b.outer}, nil
+	case *planner.With:
+		defer func(ctes []boundCTE) { b.ctes = ctes }(b.ctes)
+		for _, cte := range n.CTEs {
+			sc, err := b.bind(cte.Plan)
+			if err != nil {
+				return nil, fmt.Errorf("WITH %s: %w", cte.Name, err)
+			}
+			b.ctes = append(b.ctes, boundCTE{name: cte.Name, scope: sc})
+		}
+		return b.bind(n.Input)
+	default:
+		return nil, fmt.Errorf("unsupported plan node %T", n)
+	}
+}
+
+// cte returns the innermost CTE in scope called name.
+func (b *binder) cte(name string) (*scope, bool) {
+	for i := len(b.ctes) - 1; i >= 0; i-- {
+		if strings.EqualFold(b.ctes[i].name, name) {
+			return b.ctes[i].scope, true
+		}
+	}
+	return nil, false
+}
+
+// newScope returns the scope of a table with the given fields, the leading
+// ones renamed to the column aliases.
+func (b *binder) newScope(fields []arrow.Field, columns []string, table string, open bool) (*scope, error) {
+	if len(columns) > len(fields) {
+		if !open {
+			return nil, fmt.Errorf("table %s has %d columns but %d column aliases were given", table, len(fields), len(columns))
+		}
+		for i := len(fields); i < len(columns); i++ {
+			fields = append(fields, arrow.Field{Type: unknownType, Nullable: true, Metadata: arrow.NewMetadata([]string{tableQualifierKey}, []string{table})})
+		}
+	}
+	for i, name := range columns {
+		fields[i].Name = name
+	}
+	return &scope{schema: arrow.NewSchema(fields, nil), open: open, outer: b.outer}, nil
+}
+
+// bindValues types the columns of a VALUES list as executeValues does.
+func (b *binder) bindValues(n *planner.Values) (*scope, error) {
+	empty := &scope{schema: arrow.NewSchema(nil, nil), outer: b.outer}
+	width := len(n.Rows[0])
+	fields := make([]arrow.Field, width)
+	for i := range fields {
+		fields[i] = arrow.Field{Name: fmt.Sprintf("col%d", i), Type: unknownType, Nullable: true}
+	}
+	for r, row := range n.Rows {
+		if len(row) != width {
+			return nil, fmt.Errorf("VALUES row %d has %d values but row 1 has %d", r+1, len(row), width)
+		}
+		for i, expr := range row {
+			dt, err := b.typeOf(expr, empty)
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case fields[i].Type == unknownType:
+				fields[i].Type = dt
+			case maybeNumeric(dt) && maybeNumeric(fields[i].Type) && !arrow.TypeEqual(dt, fields[i].Type):
+				fields[i].Type = arrow.PrimitiveTypes.Float64
+			}
+		}
+	}
+	return &scope{schema: arrow.NewSchema(fields, nil), outer: b.outer}, nil
+}
+
+// bindPivot types the columns a PIVOT or UNPIVOT makes as pivotOp does.
+func (b *binder) bindPivot(n *planner.Pivot) (*scope, error) {
+	sc, err := b.bind(n.Input)
+	if err != nil {
+		return nil, err
+	}
+	if sc.open {
+		return b.newScope(nil, n.Columns, n.Alias, true)
+	}
+	c, fields := n.Clause, sc.schema.Fields()
+
+	var out []arrow.Field
+	if c.Unpivot {
+		keep, _, dt, err := unpivotLayout(sc.schema, c)
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range keep {
+			out = append(out, fields[k])
+		}
+		out = append(out,
+			arrow.Field{Name: c.For, Type: arrow.BinaryTypes.String},
+			arrow.Field{Name: c.Value, Type: dt, Nullable: true})
+		return b.newScope(qualifyFields(out, n.Alias), n.Columns, n.Alias, false)
+	}
+
+	keys, _, err := pivotKeys(sc.schema, c)
+	if err != nil {
+		return nil, err
+	}
+	for _, k := range keys {
+		out = append(out, fields[k])
+	}
+	empty := &scope{schema: arrow.NewSchema(nil, nil), outer: b.outer}
+	for _, v := range c.In {
+		if _, err := b.typeOf(v, empty); err != nil {
+			return nil, err
+		}
+	}
+	types := make([]arrow.DataType, len(c.Aggregates))
+	for i, agg := range c.Aggregates {
+		if types[i], err = b.typeOf(agg, sc); err != nil {
+			return nil, err
+		}
+	}
+	for i, name := range pivotColumnNames(c) {
+		out = append(out, arrow.Field{Name: name, Type: types[i%len(types)], Nullable: true})
+	}
+	return b.newScope(qualifyFields(out, n.Alias), n.Columns, n.Alias, false)
+}
+
+// bindUnnest types the columns of an UNNEST as unnestOp makes them: the
+// columns of its input, if it has one, then those of the elements, typed by
+// the lists.
+func (b *binder) bindUnnest(n *planner.Unnest) (*scope, error) {
+	input := &scope{schema: arrow.NewSchema(nil, nil), outer: b.outer}
+	if n.Input != nil {
+		var err error
+		if input, err = b.bind(n.Input); err != nil {
+			return nil, err
+		}
+	}
+	names := unnestNames(n.Clause, n.Alias, n.Columns)
+	fields := make([]arrow.Field, 0, len(names))
+	for i, arg := range n.Clause.Args {
+		if hasAggregate(arg) {
+			return nil, fmt.Errorf("UNNEST cannot read aggregates")
+		}
+		dt, err := b.typeOf(arg, input)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case dt.ID() == arrow.LIST:
+			dt = dt.(*arrow.ListType).Elem()
+		case dt != unknownType:
+			return nil, fmt.Errorf("UNNEST expects a list, got %s", typeName(dt))
+		}
+		fields = append(fields, arrow.Field{Name: names[i], Type: dt, Nullable: true})
+	}
+	if n.Clause.Ordinality {
+		fields = append(fields, arrow.Field{Name: names[len(names)-1], Type: arrow.PrimitiveTypes.Int64, Nullable: true})
+	}
+	qualifier := unnestQualifier(n.Alias)
+	elems, err := b.newScope(qualifyFields(fields, qualifier), n.Columns, qualifier, false)
+	if err != nil {
+		return nil, err
+	}
+	all := append(append([]arrow.Field{}, input.schema.Fields()...), elems.schema.Fields()...)
+	sc := &scope{schema: arrow.NewSchema(all, nil), open: input.open, outer: b.outer}
+	return sc, b.checkCondition(n.On, sc, "JOIN condition")
+}
+
+// bindSelect binds a SELECT list and the clauses evaluated with it, and names
+// and types its output columns as the executor will.
+func (b *binder) bindSelect(p *planner.Project) (*scope, error) {
+	q, input := selectClauses(p)
+	sc, err := b.bind(input)
+	if err != nil {
+		return nil, err
+	}
+	if sc.open && planner.HasStar(q.Projections) {
+		if err := b.bindClauses(q, q.Projections, sc); err != nil {
+			return nil, err
+		}
+		return &scope{schema: arrow.NewSchema(nil, nil), open: true, outer: b.outer}, nil
+	}
+
+	expanded, err := expandStars(q.Projections, sc.schema)
+	if err != nil {
+		return nil, err
+	}
+	projections, aliases := splitAliases(expanded)
+	groupBy, err := resolveGroupBy(q.GroupBy, projections, aliases, sc.schema)
+	if err != nil {
+		return nil, err
+	}
+	grouped := len(groupBy) > 0
+	if q.Having != nil && !grouped {
+		return nil, fmt.Errorf("HAVING requires GROUP BY")
+	}
+	orderBy, err := resolveOrderBy(q.OrderBy, projections, aliases)
+	if err != nil {
+		return nil, err
+	}
+	bound := *q
+	bound.GroupBy, bound.OrderBy = groupBy, orderBy
+	if err := b.bindClauses(&bound, projections, sc); err != nil {
+		return nil, err
+	}
+
+	aggregated := false
+	for _, expr := range projections {
+		aggregated = aggregated || !grouped && hasAggregate(expr)
+	}
+	fields := make([]arrow.Field, len(projections))
+	types := make([]arrow.DataType, len(projections))
+	for i, expr := range projections {
+		if aggregated {
+			if col := ungroupedColumn(expr); col != nil {
+				return nil, queryparser.ErrorAt(col.Pos, "column %s must appear in the GROUP BY clause or be used in an aggregate function", col.Name)
+			}
+		}
+		dt, err := b.typeOf(expr, sc)
+		if err != nil {
+			return nil, err
+		}
+		types[i] = dt
+		fields[i] = arrow.Field{Name: fmt.Sprintf("expr_%d", i), Type: dt, Nullable: true}
+		switch e := expr.(type) {
+		case *queryparser.ColumnRef:
+			switch {
+			case grouped:
+				fields[i].Name = e.Name
+			case !aggregated:
+				if idx, err := findField(sc.schema, e); err == nil && idx != -1 {
+					fields[i] = sc.schema.Field(idx)
+				} else {
+					// A column of an open scope the binder cannot name
+					fields[i].Name = e.Name
+				}
+			}
+		case *queryparser.FieldExpr:
+			fields[i].Name = e.Field
+		case *queryparser.FuncCall:
+			if grouped && planner.IsAggregate(e) {
+				fields[i].Name = strings.ToUpper(e.Name)
+			}
+		}
+		if aliases[i] != "" {
+			fields[i].Name = aliases[i]
+		}
+	}
+	b.types[p] = types
+	return &scope{schema: arrow.NewSchema(fields, nil), open: sc.open, outer: b.outer}, nil
+}
+
+// bindClauses binds the projections of a query and its WHERE, GROUP BY, HAVING
+// and ORDER BY clauses against the scope of its FROM clause.
+func (b *binder) bindClauses(q *queryparser.Query, projections []queryparser.Expression, sc *scope) error {
+	if err := b.checkCondition(q.Where, sc, "WHERE clause"); err != nil {
+		return err
+	}
+	for _, expr := range q.GroupBy {
+		if _, err := b.typeOf(expr, sc); err != nil {
+			return err
+		}
+	}
+	if q.Having != nil {
+		if _, err := b.conditionType(q.Having, sc, "HAVING clause"); err != nil {
+			return err
+		}
+	}
+	for _, expr := range projections {
+		if _, ok := expr.(*queryparser.StarExpr); ok {
+			continue
+		}
+		if _, err := b.typeOf(expr, sc); err != nil {
+			return err
+		}
+	}
+	return b.bindOrderBy(q.OrderBy, sc)
+}
+
+// bindOrderBy binds ORDER BY keys, whose positions in the SELECT list have been
+// resolved. A number in the ORDER BY of a window is a constant.
+func (b *binder) bindOrderBy(items []queryparser.OrderByItem, sc *scope) error {
+	for _, item := range items {
+		if lit, ok := item.Expr.(*queryparser.Literal); ok && lit.Kind == queryparser.LiteralNumber {
+			continue
+		}
+		if _, err := b.typeOf(item.Expr, sc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkCondition binds a row filter, which may not contain aggregates and
+// must be a boolean.
+func (b *binder) checkCondition(cond queryparser.Expression, sc *scope, clause string) error {
+	if cond == nil {
+		return nil
+	}
+	var agg *queryparser.FuncCall
+	queryparser.Inspect(cond, func(e queryparser.Expression) bool {
+		if fc, ok := e.(*queryparser.FuncCall); ok && planner.IsAggregate(fc) && agg == nil {
+			agg = fc
+		}
+		_, isWindow := e.(*queryparser.WindowExpr)
+		return !isWindow
+	})
+	if agg != nil {
+		return queryparser.ErrorAt(agg.Pos, "aggregate function %s is not allowed here", agg.Name)
+	}
+	_, err := b.conditionType(cond, sc, clause)
+	return err
+}
+
+func (b *binder) conditionType(cond queryparser.Expression, sc *scope, clause string) (arrow.DataType, error) {
+	dt, err := b.typeOf(cond, sc)
+	if err != nil {
+		return nil, err
+	}
+	if !isType(dt, arrow.FixedWidthTypes.Boolean) {
+		return nil, fmt.Errorf("%s must evaluate to boolean, got %s", clause, typeName(dt))
+	}
+	return dt, nil
+}
+
+// compareTypes binds expr and the values it is compared with, as by IN and
+// BETWEEN, checking that each may be compared with it.
+func (b *binder) compareTypes(expr queryparser.Expression, values []queryparser.Expression, sc *scope) error {
+	dt, err := b.typeOf(expr, sc)
+	if err != nil {
+		return err
+	}
+	for _, v := range values {
+		vt, err := b.typeOf(v, sc)
+		if err != nil {
+			return err
+		}
+		if !comparableTypes(dt, vt) {
+			return fmt.Errorf("cannot compare %s with %s", typeName(dt), typeName(vt))
+		}
+	}
+	return nil
+}
+
+// typeOf binds expr and returns its type.
+func (b *binder) typeOf(expr queryparser.Expression, sc *scope) (arrow.DataType, error) {
+	switch e := expr.(type) {
+	case nil:
+		return unknownType, nil
+	case *queryparser.ColumnRef:
+		return b.columnType(e, sc)
+	case *queryparser.Literal:
+		return literalType(e), nil
+	case *queryparser.Parameter:
+		return nil, unboundParameter(e)
+	case *queryparser.AliasExpr:
+		return b.typeOf(e.Expr, sc)
+	case *queryparser.BinaryExpr:
+		left, err := b.typeOf(e.Left, sc)
+		if err != nil {
+			return nil, err
+		}
+		right, err := b.typeOf(e.Right, sc)
+		if err != nil {
+			return nil, err
+		}
+		return binaryType(e.Op, left, right)
+	case *queryparser.UnaryExpr:
+		dt, err := b.typeOf(e.Expr, sc)
+		if err != nil {
+			return nil, err
+		}
+		if e.Op == "NOT" {
+			return arrow.FixedWidthTypes.Boolean, nil
+		}
+		if dt.ID() == arrow.STRING || dt.ID() == arrow.BOOL {
+			return nil, fmt.Errorf("operator %s does not apply to %s", e.Op, typeName(dt))
+		}
+		return dt, nil
+	case *queryparser.IsNullExpr:
+		if _, err := b.typeOf(e.Expr, sc); err != nil {
+			return nil, err
+		}
+		return arrow.FixedWidthTypes.Boolean, nil
+	case *queryparser.BetweenExpr:
+		if err := b.compareTypes(e.Expr, []queryparser.Expression{e.Low, e.High}, sc); err != nil {
+			return nil, err
+		}
+		return arrow.FixedWidthTypes.Boolean, nil
+	case *queryparser.LikeExpr:
+		for _, operand := range []queryparser.Expression{e.Expr, e.Pattern} {
+			dt, err := b.typeOf(operand, sc)
+			if err != nil {
+				return nil, err
+			}
+			if !isType(dt, arrow.BinaryTypes.String) {
+				return nil, fmt.Errorf("LIKE expects strings, got %s", typeName(dt))
+			}
+		}
+		return arrow.FixedWidthTypes.Boolean, nil
+	case *queryparser.InExpr:
+		if err := b.compareTypes(e.Expr, e.Values, sc); err != nil {
+			return nil, err
+		}
+		if e.Subquery != nil {
+			out, err := b.bindSubquery(e.Subquery, sc)
+			if err != nil {
+				return nil, err
+			}
+			dt, err := b.typeOf(e.Expr, sc)
+			if err != nil {
+				return nil, err
+			}
+			if fields := out.schema.Fields(); len(fields) == 1 && !comparableTypes(dt, fields[0].Type) {
+				return nil, fmt.Errorf("cannot compare %s with %s", typeName(dt), typeName(fields[0].Type))
+			}
+		}
+		return arrow.FixedWidthTypes.Boolean, nil
+	case *queryparser.ExistsExpr:
+		if _, err := b.bindSubquery(e.Subquery, sc); err != nil {
+			return nil, err
+		}
+		return arrow.FixedWidthTypes.Boolean, nil
+	case *queryparser.SubqueryExpr:
+		out, err := b.bindSubquery(e.Subquery, sc)
+		if err != nil {
+			return nil, err
+		}
+		if len(out.schema.Fields()) != 1 {
+			return unknownType, nil
+		}
+		return out.schema.Field(0).Type, nil
+	case *queryparser.CastExpr:
+		if _, err := b.typeOf(e.Expr, sc); err != nil {
+			return nil, err
+		}
+		return castType(e.Type)
+	case *queryparser.FieldExpr:
+		dt, err := b.typeOf(e.Expr, sc)
+		if err != nil {
+			return nil, err
+		}
+		return fieldType(dt, e)
+	case *queryparser.IndexExpr:
+		dt, err := b.typeOf(e.Expr, sc)
+		if err != nil {
+			return nil, err
+		}
+		index, err := b.typeOf(e.Index, sc)
+		if err != nil {
+			return nil, err
+		}
+		if !isType(evalType(index), arrow.PrimitiveTypes.Int64) {
+			return nil, queryparser.ErrorAt(e.Pos, "list index must be an integer, got %s", typeName(index))
+		}
+		switch dt.ID() {
+		case arrow.LIST:
+			return dt.(*arrow.ListType).Elem(), nil
+		case unknownType.ID():
+			return unknownType, nil
+		}
+		return nil, queryparser.ErrorAt(e.Pos, "list index expects a list, got %s", typeName(dt))
+	case *queryparser.FuncCall:
+		return b.funcType(e, sc)
+	case *queryparser.WindowExpr:
+		for _, key := range e.PartitionBy {
+			if _, err := b.typeOf(key, sc); err != nil {
+				return nil, err
+			}
+		}
+		if err := b.bindOrderBy(e.OrderBy, sc); err != nil {
+			return nil, err
+		}
+		return b.windowType(e.Func, sc)
+	default:
+		return unknownType, nil
+	}
+}
+
+// columnType resolves ref in sc, or in the scopes of the queries sc is nested
+// in, and returns the type of the column.
+func (b *binder) columnType(ref *queryparser.ColumnRef, sc *scope) (arrow.DataType, error) {
+	for s := sc; s != nil; s = s.outer {
+		idx, err := findField(s.schema, ref)
+		if err != nil {
+			return nil, queryparser.ErrorAt(ref.Pos, "%v", err)
+		}
+		if idx != -1 {
+			return s.schema.Field(idx).Type, nil
+		}
+		if f := structFieldRef(s.schema, ref); f != nil {
+			return b.typeOf(f, s)
+		}
+		if s.open {
+			return unknownType, nil
+		}
+	}
+	_, err := resolveField(sc.schema, ref)
+	return nil, err
+}
+
+// fieldType is the type of the field of a struct of type dt that e reads.
+func fieldType(dt arrow.DataType, e *queryparser.FieldExpr) (arrow.DataType, error) {
+	if dt == unknownType {
+		return unknownType, nil
+	}
+	st, ok := dt.(*arrow.StructType)
+	if !ok {
+		return nil, queryparser.ErrorAt(e.Pos, "field access expects a struct, got %s", typeName(dt))
+	}
+	for _, f := range st.Fields() {
+		if f.Name == e.Field {
+			return f.Type, nil
+		}
+	}
+	if !e.Quoted {
+		for _, f := range st.Fields() {
+			if strings.EqualFold(f.Name, e.Field) {
+				return f.Type, nil
+			}
+		}
+	}
+	return nil, queryparser.ErrorAt(e.Pos, "struct has no field %s", e.Field)
+}
+
+// bindSubquery binds a subquery nested in an expression evaluated in sc.
+func (b *binder) bindSubquery(q *queryparser.Query, sc *scope) (*scope, error) {
+	defer func(outer *scope) { b.outer = outer }(b.outer)
+	b.outer = sc
+	return b.bind(planner.Build(q))
+}
+
+// funcType binds a function call. Aggregates other than COUNT,
+// APPROX_COUNT_DISTINCT, STRING_AGG, ARRAY_AGG, TOP_K and those that pick the
+// value of one row or the one given most often take numbers and return a
+// number, which for SUM, MIN and MAX is of the type of the numbers. MIN and
+// MAX also take strings, dates and timestamps, returning one of them.
+func (b *binder) funcType(fc *queryparser.FuncCall, sc *scope) (arrow.DataType, error) {
+	args := make([]arrow.DataType, len(fc.Args))
+	for i, arg := range fc.Args {
+		if _, ok := arg.(*queryparser.StarExpr); ok {
+			args[i] = unknownType
+			continue
+		}
+		dt, err := b.typeOf(arg, sc)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = dt
+	}
+
+	if planner.IsAggregate(fc) {
+		switch strings.ToUpper(fc.Name) {
+		case "APPROX_COUNT_DISTINCT":
+			return arrow.PrimitiveTypes.Int64, nil
+		case "STRING_AGG":
+			return arrow.BinaryTypes.String, nil
+		case "ARRAY_AGG", "TOP_K":
+			return listOfType(args[0]), nil
+		case "FIRST", "LAST", "ANY_VALUE", "ARG_MAX", "ARG_MIN", "MODE":
+			if args[0].ID() == arrow.DECIMAL128 {
+				return unknownType, nil
+			}
+			return evalType(args[0]), nil
+		}
+		name := strings.ToUpper(fc.Name)
+		switch {
+		case name == "MIN" || name == "MAX":
+			if !maybeNumeric(args[0]) && !isOrderedType(evalType(args[0])) {
+				return nil, queryparser.ErrorAt(fc.Pos, "%s expects a number, string, date or timestamp, got %s", fc.Name, typeName(args[0]))
+			}
+		case name != "COUNT" && len(args) > 0 && !maybeNumeric(args[0]):
+			return nil, queryparser.ErrorAt(fc.Pos, "%s expects a number, got %s", fc.Name, typeName(args[0]))
+		}
+		switch {
+		case name == "COUNT":
+			return arrow.PrimitiveTypes.Int64, nil
+		case args[0].ID() == arrow.DECIMAL128:
+			// Decimals are aggregated exactly, to a scale decided by the values
+			return unknownType, nil
+		case name == "SUM" || name == "MIN" || name == "MAX":
+			return evalType(args[0]), nil
+		}
+		return arrow.PrimitiveTypes.Float64, nil
+	}
+	if strings.EqualFold(fc.Name, "UNNEST") {
+		return nil, queryparser.ErrorAt(fc.Pos, "UNNEST must be a table in FROM or JOIN, or of one list in a SELECT list")
+	}
+	fn, err := lookupFunction(fc)
+	if err != nil {
+		return nil, err
+	}
+	if fn.typ == nil {
+		return unknownType, nil
+	}
+	dt, err := fn.typ(args)
+	if err != nil {
+		return nil, queryparser.ErrorAt(fc.Pos, "%s %v", fc.Name, err)
+	}
+	return dt, nil
+}
+
+// listOfType is the type of a list of values of type dt, unknown when dt is,
+// or when it is a decimal, whose scale is decided by the values.
+func listOfType(dt arrow.DataType) arrow.DataType {
+	if dt == unknownType || dt.ID() == arrow.DECIMAL128 {
+		return unknownType
+	}
+	return arrow.ListOf(evalType(dt))
+}
+
+// windowType binds the function a window expression computes. Ranks are
+// integers, LAG and LEAD give values of their argument's type, and an
+// aggregate over a window is of the type it is over a group.
+func (b *binder) windowType(fc *queryparser.FuncCall, sc *scope) (arrow.DataType, error) {
+	if planner.IsAggregate(fc) {
+		return b.funcType(fc, sc)
+	}
+	args := make([]arrow.DataType, len(fc.Args))
+	for i, arg := range fc.Args {
+		dt, err := b.typeOf(arg, sc)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = dt
+	}
+	switch strings.ToUpper(fc.Name) {
+	case "ROW_NUMBER", "RANK", "DENSE_RANK":
+		return arrow.PrimitiveTypes.Int64, nil
+	case "LAG", "LEAD":
+		// The default given for rows without one may be of another type
+		if len(args) == 0 || args[0].ID() == arrow.DECIMAL128 || (len(args) > 2 && !isType(args[2], args[0])) {
+			return unknownType, nil
+		}
+		return evalType(args[0]), nil
+	}
+	return unknownType, nil
+}
+
+// literalType is the type of the value a literal evaluates to.
+func literalType(lit *queryparser.Literal) arrow.DataType {
+	switch lit.Kind {
+	case queryparser.LiteralString:
+		return arrow.BinaryTypes.String
+	case queryparser.LiteralDate:
+		return arrow.FixedWidthTypes.Date32
+	case queryparser.LiteralTimestamp:
+		return arrow.FixedWidthTypes.Timestamp_us
+	case queryparser.LiteralBool:
+		return arrow.FixedWidthTypes.Boolean
+	case queryparser.LiteralNumber:
+		if _, err := strconv.ParseInt(lit.Value, 10, 64); err == nil {
+			return arrow.PrimitiveTypes.Int64
+		}
+		if _, err := strconv.ParseFloat(lit.Value, 64); err == nil {
+			return arrow.PrimitiveTypes.Float64
+		}
+		return arrow.BinaryTypes.String
+	default:
+		// NULL, and intervals, which only exist while a query runs
+		return unknownType
+	}
+}
+
+// binaryType is the type of applying op to operands of the given types.
+// Arithmetic takes numbers, or dates and timestamps for + and -, and is
+// integer arithmetic when both operands are integers. Comparisons take
+// operands comparableTypes accepts, and AND and OR booleans.
+func binaryType(op string, left, right arrow.DataType) (arrow.DataType, error) {
+	switch op {
+	case "+", "-", "*", "/":
+	case "AND", "OR":
+		for _, dt := range []arrow.DataType{left, right} {
+			if !isType(dt, arrow.FixedWidthTypes.Boolean) {
+				return nil, fmt.Errorf("operator %s expects booleans, got %s", op, typeName(dt))
+			}
+		}
+		return arrow.FixedWidthTypes.Boolean, nil
+	default:
+		if !comparableTypes(left, right) {
+			return nil, fmt.Errorf("cannot compare %s with %s", typeName(left), typeName(right))
+		}
+		return arrow.FixedWidthTypes.Boolean, nil
+	}
+	for _, dt := range []arrow.DataType{left, right} {
+		if dt.ID() == arrow.STRING || dt.ID() == arrow.BOOL {
+			return nil, fmt.Errorf("operator %s does not apply to %s and %s", op, typeName(left), typeName(right))
+		}
+	}
+	left, right = evalType(left), evalType(right)
+	switch {
+	case left == unknownType || right == unknownType:
+		return unknownType, nil
+	case isTemporalType(left) || isTemporalType(right):
+		if op != "+" && op != "-" {
+			return nil, fmt.Errorf("operator %s does not apply to %s and %s", op, typeName(left), typeName(right))
+		}
+		switch {
+		case left.ID() == arrow.DATE32 && right.ID() == arrow.INT64,
+			left.ID() == arrow.INT64 && right.ID() == arrow.DATE32 && op == "+":
+			return arrow.FixedWidthTypes.Date32, nil
+		case left.ID() == arrow.DATE32 && right.ID() == arrow.DATE32 && op == "-":
+			return arrow.PrimitiveTypes.Int64, nil
+		}
+		return unknownType, nil
+	case left.ID() == arrow.INT64 && right.ID() == arrow.INT64:
+		return arrow.PrimitiveTypes.Int64, nil
+	case left.ID() == arrow.DECIMAL128 || right.ID() == arrow.DECIMAL128:
+		// The scale of the result depends on the operator and operands
+		return unknownType, nil
+	default:
+		return arrow.PrimitiveTypes.Float64, nil
+	}
+}
+
+// comparableTypes reports whether values of the two types may be compared,
+// as comparableOperands has them: numbers with numbers, dates and timestamps
+// with each other or with strings that spell them, lists and structs whose
+// elements and fields compare, and otherwise values of the same type.
+func comparableTypes(left, right arrow.DataType) bool {
+	left, right = evalType(left), evalType(right)
+	switch {
+	case left == unknownType || right == unknownType:
+		return true
+	case isNumericType(left) || isNumericType(right):
+		return isNumericType(left) && isNumericType(right)
+	case isTemporalType(left) || isTemporalType(right):
+		return (isTemporalType(left) || left.ID() == arrow.STRING) && (isTemporalType(right) || right.ID() == arrow.STRING)
+	case left.ID() != right.ID():
+		return false
+	case left.ID() == arrow.LIST:
+		return comparableTypes(left.(*arrow.ListType).Elem(), right.(*arrow.ListType).Elem())
+	case left.ID() == arrow.STRUCT:
+		lf, rf := left.(*arrow.StructType).Fields(), right.(*arrow.StructType).Fields()
+		if len(lf) != len(rf) {
+			return false
+		}
+		for i := range lf {
+			if !strings.EqualFold(lf[i].Name, rf[i].Name) || !comparableTypes(lf[i].Type, rf[i].Type) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// evalType is the type of the values expressions compute with for a column of
+// type dt: integers are widened to int64, floats to float64 and dates to days.
+// A uint64 may not fit an int64 and is left as it is.
+func evalType(dt arrow.DataType) arrow.DataType {
+	switch dt.ID() {
+	case arrow.INT8, arrow.INT16, arrow.INT32, arrow.UINT8, arrow.UINT16, arrow.UINT32:
+		return arrow.PrimitiveTypes.Int64
+	case arrow.FLOAT32:
+		return arrow.PrimitiveTypes.Float64
+	case arrow.DATE64:
+		return arrow.FixedWidthTypes.Date32
+	default:
+		return dt
+	}
+}
+
+// isType reports whether dt is want, or unknown and so possibly want.
+func isType(dt, want arrow.DataType) bool {
+	return dt == unknownType || arrow.TypeEqual(dt, want)
+}
+
+// maybeNumeric reports whether dt is a number type, or unknown.
+func maybeNumeric(dt arrow.DataType) bool {
+	return dt == unknownType || isNumericType(dt)
+}
+
+func isTemporalType(dt arrow.DataType) bool {
+	return dt.ID() == arrow.DATE32 || dt.ID() == arrow.TIMESTAMP
+}
+
+// isOrderedType reports whether values of dt other than numbers have an
+// order MIN and MAX go by: strings in byte order, and dates and timestamps
+// in time.
+func isOrderedType(dt arrow.DataType) bool {
+	return dt.ID() == arrow.STRING || isTemporalType(dt)
+}
+
+// typeName is the SQL name of dt, as CAST spells it.
+func typeName(dt arrow.DataType) string {
+	switch dt.ID() {
+	case arrow.INT64:
+		return "BIGINT"
+	case arrow.FLOAT64:
+		return "DOUBLE"
+	case arrow.STRING:
+		return "VARCHAR"
+	case arrow.BOOL:
+		return "BOOLEAN"
+	case arrow.DATE32:
+		return "DATE"
+	case arrow.TIMESTAMP:
+		return "TIMESTAMP"
+	case arrow.LIST:
+		return typeName(dt.(*arrow.ListType).Elem()) + "[]"
+	case arrow.STRUCT:
+		fields := make([]string, len(dt.(*arrow.StructType).Fields()))
+		for i, f := range dt.(*arrow.StructType).Fields() {
+			fields[i] = f.Name + " " + typeName(f.Type)
+		}
+		return "STRUCT(" + strings.Join(fields, ", ") + ")"
+	default:
+		return strings.ToUpper(dt.Name())
+	}
+}
+
+// typeNullColumns gives the columns of rec that hold nothing but NULLs the
+// types the binder inferred for them, in place of the type guessed from no
+// values.
+func typeNullColumns(rec array.Record, types []arrow.DataType, pool memory.Allocator) (array.Record, error) {
+	fields := append([]arrow.Field{}, rec.Schema().Fields()...)
+	cols := append([]array.Interface{}, rec.Columns()...)
+	var built []array.Interface
+	defer func() {
+		for _, arr := range built {
+			arr.Release()
+		}
+	}()
+	for i, dt := range types {
+		if i >= len(cols) || dt == unknownType || arrow.TypeEqual(dt, fields[i].Type) || cols[i].NullN() != cols[i].Len() {
+			continue
+		}
+		arr, err := buildArray(pool, dt, make([]interface{}, cols[i].Len()))
+		if err != nil {
+			return nil, err
+		}
+		built = append(built, arr)
+		cols[i] = arr
+		fields[i].Type, fields[i].Nullable = dt, true
+	}
+	if len(built) == 0 {
+		return rec, nil
+	}
+	defer rec.Release()
+	md := rec.Schema().Metadata()
+	return array.NewRecord(arrow.NewSchema(fields, &md), cols, rec.NumRows()), nil
+}
@@ -0,0 +1,223 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow/go/arrow"
+)
+
+// castType maps a SQL type name onto the Arrow type its values are stored as.
+// The evaluator works on 64-bit values, so every approximate numeric type
+// becomes Float64 and every integer type Int64: TINYINT, SMALLINT and INT are
+// range-checked aliases of BIGINT, whose values castTo checks fit the narrower
+// type but whose result columns are Int64 all the same. DECIMAL and NUMERIC
+// keep their precision and scale.
+func castType(name string) (arrow.DataType, error) {
+	switch typeBase(name) {
+	case "TINYINT", "SMALLINT", "INT", "INTEGER", "BIGINT", "INT2", "INT4", "INT8":
+		return arrow.PrimitiveTypes.Int64, nil
+	case "REAL", "FLOAT", "FLOAT4", "FLOAT8", "DOUBLE", "DOUBLE PRECISION":
+		return arrow.PrimitiveTypes.Float64, nil
+	case "DECIMAL", "NUMERIC":
+		return decimalTypeOf(name)
+	case "VARCHAR", "CHAR", "TEXT", "STRING":
+		return arrow.BinaryTypes.String, nil
+	case "BOOLEAN", "BOOL":
+		return arrow.FixedWidthTypes.Boolean, nil
+	case "DATE":
+		return arrow.FixedWidthTypes.Date32, nil
+	case "TIMESTAMP", "DATETIME":
+		return arrow.FixedWidthTypes.Timestamp_us, nil
+	default:
+		return nil, fmt.Errorf("unsupported type in CAST: %s", name)
+	}
+}
+
+// typeBase is the upper-cased name of a SQL type without its parameters.
+func typeBase(name string) string {
+	if i := strings.IndexByte(name, '('); i != -1 {
+		name = name[:i] // VARCHAR(10), DECIMAL(10, 2)
+	}
+	return strings.ToUpper(name)
+}
+
+// integerRange is the range of the SQL integer type name, if it is narrower
+// than the Int64 its values are stored as.
+func integerRange(name string) (lo, hi int64, ok bool) {
+	switch typeBase(name) {
+	case "TINYINT":
+		return math.MinInt8, math.MaxInt8, true
+	case "SMALLINT", "INT2":
+		return math.MinInt16, math.MaxInt16, true
+	case "INT", "INTEGER", "INT4":
+		return math.MinInt32, math.MaxInt32, true
+	}
+	return 0, 0, false
+}
+
+// castTo converts an evaluated value to dt, the type castType maps the SQL
+// type name onto. An integer out of the range of name is an error, as it
+// would be were the narrower types stored as such.
+func castTo(v interface{}, name string, dt arrow.DataType) (interface{}, error) {
+	val, err := castValue(v, dt)
+	if err != nil {
+		return nil, err
+	}
+	if lo, hi, ok := integerRange(name); ok && val != nil {
+		if i := val.(int64); i < lo || i > hi {
+			return nil, fmt.Errorf("cannot cast %v to %s: out of range", v, typeBase(name))
+		}
+	}
+	return val, nil
+}
+
+// castValue converts an evaluated value to dt. NULL stays NULL; values that
+// cannot be represented in dt are an error. A number with a fractional part
+// cast to an integer is truncated toward zero, so 1.5 becomes 1 and -1.5
+// becomes -1.
+func castValue(v interface{}, dt arrow.DataType) (interface{}, error) {
+	if v == nil {
+		return nil, nil
+	}
+
+	switch dt.ID() {
+	case arrow.INT64:
+		switch x := v.(type) {
+		case int64:
+			return x, nil
+		case float64:
+			if math.IsNaN(x) || x >= math.MaxInt64 || x < math.MinInt64 {
+				return nil, fmt.Errorf("cannot cast %v to %v: out of range", x, dt)
+			}
+			return int64(x), nil
+		case decimal:
+			i := x.integer(0).rescale(0).unscaled
+			if !i.IsInt64() {
+				return nil, fmt.Errorf("cannot cast %v to %v: out of range", x, dt)
+			}
+			return i.Int64(), nil
+		case bool:
+			if x {
+				return int64(1), nil
+			}
+			return int64(0), nil
+		case string:
+			i, err := strconv.ParseInt(strings.TrimSpace(x), 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("cannot cast %q to %v", x, dt)
+			}
+			return i, nil
+		}
+	case arrow.FLOAT64:
+		switch x := v.(type) {
+		case int64:
+			return float64(x), nil
+		case float64:
+			return x, nil
+		case decimal:
+			return x.float(), nil
+		case bool:
+			if x {
+				return 1.0, nil
+			}
+			return 0.0, nil
+		case string:
+			f, err := strconv.ParseFloat(strings.TrimSpace(x), 64)
+			if err != nil {
+				return nil, fmt.Errorf("cannot cast %q to %v", x, dt)
+			}
+			return f, nil
+		}
+	case arrow.STRING:
+		switch x := v.(type) {
+		case string:
+			return x, nil
+		case int64:
+			return strconv.FormatInt(x, 10), nil
+		case float64:
+			return strconv.FormatFloat(x, 'f', -1, 64), nil
+		case bool:
+			return strconv.FormatBool(x), nil
+		case decimal:
+			return x.String(), nil
+		case date:
+			return x.String(), nil
+		case time.Time:
+			return x.Format("2006-01-02 15:04:05.999999999"), nil
+		case interval:
+			return x.String(), nil
+		case list:
+			return x.String(), nil
+		case structValue:
+			return x.String(), nil
+		}
+	case arrow.BOOL:
+		switch x := v.(type) {
+		case bool:
+			return x, nil
+		case int64:
+			return x != 0, nil
+		case float64:
+			return x != 0, nil
+		case decimal:
+			return x.unscaled.Sign() != 0, nil
+		case string:
+			switch strings.ToLower(strings.TrimSpace(x)) {
+			case "true", "t", "yes", "y", "1":
+				return true, nil
+			case "false", "f", "no", "n", "0":
+				return false, nil
+			}
+			return nil, fmt.Errorf("cannot cast %q to %v", x, dt)
+		}
+	case arrow.DATE32:
+		switch x := v.(type) {
+		case date:
+			return x, nil
+		case time.Time:
+			return dateOf(x), nil
+		case string:
+			return parseDate(x)
+		}
+	case arrow.DECIMAL128:
+		return castDecimal(v, dt.(*arrow.Decimal128Type))
+	case arrow.TIMESTAMP:
+		switch x := v.(type) {
+		case time.Time:
+			return x, nil
+		case date:
+			return x.time(), nil
+		case string:
+			return parseTimestamp(x)
+		}
+	case arrow.LIST:
+		if x, ok := v.(list); ok {
+			out := make(list, len(x))
+			for i, elem := range x {
+				var err error
+				if out[i], err = castValue(elem, dt.(*arrow.ListType).Elem()); err != nil {
+					return nil, err
+				}
+			}
+			return out, nil
+		}
+	case arrow.STRUCT:
+		fields := dt.(*arrow.StructType).Fields()
+		if x, ok := v.(structValue); ok && len(x.names) == len(fields) {
+			out := structValue{names: make([]string, len(fields)), values: make([]interface{}, len(fields))}
+			for i, f := range fields {
+				var err error
+				if out.values[i], err = castValue(x.values[i], f.Type); err != nil {
+					return nil, err
+				}
+				out.names[i] = f.Name
+			}
+			return out, nil
+		}
+	}
+	return nil, fmt.Errorf("cannot cast %T to %v", v, dt)
+}
@@ -0,0 +1,346 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// MemoryCatalog is a set of named in-memory tables that statements read and
+// write, along with named views. Writes replace a table's record with a new
+// version, so records handed out earlier stay valid. It is safe for concurrent
+// use. The catalog keeps a zone map of each column of its tables, built the
+// first time a filter asks for it and dropped along with the table's record,
+// and likewise a dictionary of each low-cardinality string column for GROUP BY
+// and joins.
+type MemoryCatalog struct {
+	mu      sync.RWMutex
+	tables  map[string]array.Record
+	views   map[string]*queryparser.Query
+	version uint64 // changes whenever a table or view is added or removed, or a table's schema changes
+
+	zonesMu sync.Mutex                            // guards zones and dicts
+	zones   map[array.Interface]zoneMap           // nil until built, for every column of tables
+	dicts   map[array.Interface]*stringDictionary // nil until built, for every string column of tables
+}
+
+// noDictionary marks the string columns with too many distinct values for a
+// dictionary.
+var noDictionary = &stringDictionary{}
+
+func NewMemoryCatalog() *MemoryCatalog {
+	return &MemoryCatalog{
+		tables: map[string]array.Record{},
+		views:  map[string]*queryparser.Query{},
+		zones:  map[array.Interface]zoneMap{},
+		dicts:  map[array.Interface]*stringDictionary{},
+	}
+}
+
+// Register adds rec under name, replacing and releasing any table already
+// registered under that name regardless of case. The catalog retains rec.
+func (c *MemoryCatalog) Register(name string, rec array.Record) {
+	rec.Retain()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key, old, ok := c.lookup(name); ok {
+		c.remove(key, old)
+	}
+	c.put(name, rec)
+	c.version++
+}
+
+// Create adds rec under name, failing if a table with that name already
+// exists. The catalog retains rec.
+func (c *MemoryCatalog) Create(name string, rec array.Record) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, _, ok := c.lookup(name); ok {
+		return fmt.Errorf("table %s already exists", name)
+	}
+	if _, _, ok := c.lookupView(name); ok {
+		return fmt.Errorf("view %s already exists", name)
+	}
+	rec.Retain()
+	c.put(name, rec)
+	c.version++
+	return nil
+}
+
+// Table returns the table registered under name, matching case-insensitively
+// when there is no exact match. The caller must release the returned record.
+func (c *MemoryCatalog) Table(name string) (array.Record, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, rec, ok := c.lookup(name)
+	if !ok {
+		return nil, fmt.Errorf("table %s not found", name)
+	}
+	rec.Retain()
+	return rec, nil
+}
+
+// hasTable reports whether a table called name is registered.
+func (c *MemoryCatalog) hasTable(name string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	_, _, ok := c.lookup(name)
+	return ok
+}
+
+// Names returns the names of the registered tables and views in sorted order.
+func (c *MemoryCatalog) Names() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	names := make([]string, 0, len(c.tables)+len(c.views))
+	for name := range c.tables {
+		names = append(names, name)
+	}
+	for name := range c.views {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Drop removes the table named name and releases its record. A missing table
+// is an error unless ifExists is set.
+func (c *MemoryCatalog) Drop(name string, ifExists bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, rec, ok := c.lookup(name)
+	if !ok {
+		if _, _, isView := c.lookupView(name); isView {
+			return fmt.Errorf("%s is a view, not a table", name)
+		}
+		if ifExists {
+			return nil
+		}
+		return fmt.Errorf("table %s not found", name)
+	}
+	c.remove(key, rec)
+	c.version++
+	return nil
+}
+
+// CreateView adds a view named name defined by query. It fails if a table or
+// view with that name already exists, unless replace is set and the existing
+// one is a view.
+func (c *MemoryCatalog) CreateView(name string, query *queryparser.Query, replace bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, _, ok := c.lookup(name); ok {
+		return fmt.Errorf("table %s already exists", name)
+	}
+	if key, _, ok := c.lookupView(name); ok {
+		if !replace {
+			return fmt.Errorf("view %s already exists", name)
+		}
+		delete(c.views, key)
+	}
+	c.views[name] = query
+	c.version++
+	return nil
+}
+
+// DropView removes the view named name. A missing view is an error unless
+// ifExists is set.
+func (c *MemoryCatalog) DropView(name string, ifExists bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, _, ok := c.lookupView(name)
+	if !ok {
+		if _, _, isTable := c.lookup(name); isTable {
+			return fmt.Errorf("%s is a table, not a view", name)
+		}
+		if ifExists {
+			return nil
+		}
+		return fmt.Errorf("view %s not found", name)
+	}
+	delete(c.views, key)
+	c.version++
+	return nil
+}
+
+// Views returns the defining query of every view, keyed by view name.
+func (c *MemoryCatalog) Views() map[string]*queryparser.Query {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.viewsLocked()
+}
+
+func (c *MemoryCatalog) viewsLocked() map[string]*queryparser.Query {
+	views := make(map[string]*queryparser.Query, len(c.views))
+	for name, q := range c.views {
+		views[name] = q
+	}
+	return views
+}
+
+// Snapshot returns every registered table. The records are retained; release
+// them with releaseTables when done.
+func (c *MemoryCatalog) Snapshot() map[string]array.Record {
+	tables, _, _ := c.snapshot()
+	return tables
+}
+
+// Tables returns the tables called names as they all were at one moment, so
+// that writes to them made meanwhile are seen in all of them or in none. The
+// records are retained; release them with releaseTables when done.
+func (c *MemoryCatalog) Tables(names []string) (map[string]array.Record, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	tables := make(map[string]array.Record, len(names))
+	for _, name := range names {
+		if _, ok := findTable(tables, name); ok {
+			continue
+		}
+		_, rec, ok := c.lookup(name)
+		if !ok {
+			releaseTables(tables)
+			return nil, fmt.Errorf("table %s not found", name)
+		}
+		rec.Retain()
+		tables[name] = rec
+	}
+	return tables, nil
+}
+
+// snapshot is Snapshot, also returning the views and the version of the
+// catalog's schema, all as they were when the tables were taken.
+func (c *MemoryCatalog) snapshot() (map[string]array.Record, map[string]*queryparser.Query, uint64) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	tables := make(map[string]array.Record, len(c.tables))
+	for name, rec := range c.tables {
+		rec.Retain()
+		tables[name] = rec
+	}
+	return tables, c.viewsLocked(), c.version
+}
+
+// Update replaces the table registered under name with the record fn builds
+// from it. The catalog is locked while fn runs, so concurrent writes to a
+// table apply one after another.
+func (c *MemoryCatalog) Update(name string, fn func(array.Record) (array.Record, error)) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key, old, ok := c.lookup(name)
+	if !ok {
+		return fmt.Errorf("table %s not found", name)
+	}
+	rec, err := fn(old)
+	if err != nil {
+		return err
+	}
+	if !rec.Schema().Equal(old.Schema()) {
+		c.version++
+	}
+	c.remove(key, old)
+	c.put(key, rec)
+	return nil
+}
+
+// Release releases every table in the catalog and empties it.
+func (c *MemoryCatalog) Release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.views = map[string]*queryparser.Query{}
+	for name, rec := range c.tables {
+		c.remove(name, rec)
+	}
+	c.version++
+}
+
+// put registers rec, which the catalog has retained, under key.
+func (c *MemoryCatalog) put(key string, rec array.Record) {
+	c.tables[key] = rec
+	c.zonesMu.Lock()
+	defer c.zonesMu.Unlock()
+	for _, col := range rec.Columns() {
+		c.zones[col] = nil
+		if col.DataType().ID() == arrow.STRING {
+			c.dicts[col] = nil
+		}
+	}
+}
+
+// remove drops the table registered under key, whose record is rec, and
+// releases it.
+func (c *MemoryCatalog) remove(key string, rec array.Record) {
+	delete(c.tables, key)
+	c.zonesMu.Lock()
+	for _, col := range rec.Columns() {
+		delete(c.zones, col)
+		delete(c.dicts, col)
+	}
+	c.zonesMu.Unlock()
+	rec.Release()
+}
+
+// zoneMap returns the zone map of arr, building it on first use, or false
+// when arr is not a column of one of the catalog's tables.
+func (c *MemoryCatalog) zoneMap(arr array.Interface) (zoneMap, bool) {
+	c.zonesMu.Lock()
+	defer c.zonesMu.Unlock()
+	zones, ok := c.zones[arr]
+	if ok && zones == nil {
+		zones = buildZoneMap(arr)
+		c.zones[arr] = zones
+	}
+	return zones, ok
+}
+
+// dictionary returns the dictionary of arr, building it on first use, or false
+// when arr is not a string column of one of the catalog's tables or has too
+// many distinct values for one.
+func (c *MemoryCatalog) dictionary(arr array.Interface) (*stringDictionary, bool) {
+	c.zonesMu.Lock()
+	defer c.zonesMu.Unlock()
+	dict, ok := c.dicts[arr]
+	if ok && dict == nil {
+		if dict = buildStringDictionary(arr); dict == nil {
+			dict = noDictionary
+		}
+		c.dicts[arr] = dict
+	}
+	return dict, ok && dict != noDictionary
+}
+
+func (c *MemoryCatalog) lookup(name string) (string, array.Record, bool) {
+	if rec, ok := c.tables[name]; ok {
+		return name, rec, true
+	}
+	for key, rec := range c.tables {
+		if strings.EqualFold(key, name) {
+			return key, rec, true
+		}
+	}
+	return "", nil, false
+}
+
+func (c *MemoryCatalog) lookupView(name string) (string, *queryparser.Query, bool) {
+	if q, ok := c.views[name]; ok {
+		return name, q, true
+	}
+	for key, q := range c.views {
+		if strings.EqualFold(key, name) {
+			return key, q, true
+		}
+	}
+	return "", nil, false
+}
+
+func releaseTables(tables map[string]array.Record) {
+	for _, rec := range tables {
+		rec.Release()
+	}
+}
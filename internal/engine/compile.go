@@ -0,0 +1,305 @@
+package engine
+
+import (
+	"github.com/apache/arrow/go/arrow/array"
+
+	"github.com/kris-gaudel/tinylake/internal/planner"
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// compiledExpr is an expression bound once to the table it is evaluated over:
+// its columns are resolved to arrays of known types and its constants are
+// parsed, so evaluating it at a row does neither. Integer and float
+// arithmetic and comparisons over such operands run on unboxed values, which
+// are only boxed for the result. It gives the same values and errors as
+// evaluateExpression, which it falls back to for anything it does not
+// compile.
+type compiledExpr struct {
+	eval func(row int) (interface{}, error)
+
+	// kind is kindInt or kindFloat when every non-NULL value has that type,
+	// and the matching accessor reads the value unboxed, reporting false
+	// for NULL
+	kind   operandKind
+	ints   func(row int) (int64, bool, error)
+	floats func(row int) (float64, bool, error)
+}
+
+// compileExpression compiles expr for evaluation over the rows of table. An
+// error found while compiling, such as an unknown column, is returned when a
+// row is evaluated, as evaluateExpression would return it.
+func compileExpression(expr queryparser.Expression, table array.Record) *compiledExpr {
+	switch e := expr.(type) {
+	case *queryparser.ColumnRef:
+		col, err := resolveColumn(table, e)
+		if err != nil {
+			if f := structFieldRef(table.Schema(), e); f != nil {
+				return compileExpression(f, table)
+			}
+			return failed(err)
+		}
+		return compileColumn(table.Column(col))
+	case *queryparser.Literal, *constantValue:
+		val, err := evaluateExpression(e, nil, 0)
+		if err != nil {
+			return failed(err)
+		}
+		return constant(val)
+	case *queryparser.BinaryExpr:
+		return compileBinary(e, compileExpression(e.Left, table), compileExpression(e.Right, table))
+	case *queryparser.UnaryExpr:
+		operand := compileExpression(e.Expr, table)
+		return &compiledExpr{eval: func(row int) (interface{}, error) {
+			val, err := operand.eval(row)
+			if err != nil {
+				return nil, err
+			}
+			val, err = evalUnaryOp(e.Op, val)
+			return val, arithmeticError(err, e)
+		}}
+	case *queryparser.IsNullExpr:
+		operand := compileExpression(e.Expr, table)
+		return &compiledExpr{eval: func(row int) (interface{}, error) {
+			val, err := operand.eval(row)
+			if err != nil {
+				return nil, err
+			}
+			return (val == nil) != e.Not, nil
+		}}
+	case *queryparser.CastExpr:
+		dt, err := castType(e.Type)
+		if err != nil {
+			return failed(err)
+		}
+		operand := compileExpression(e.Expr, table)
+		return &compiledExpr{eval: func(row int) (interface{}, error) {
+			val, err := operand.eval(row)
+			if err != nil {
+				return nil, err
+			}
+			return castTo(val, e.Type, dt)
+		}}
+	case *queryparser.FuncCall:
+		// Aggregates fail, and COALESCE and IF evaluate their arguments
+		// lazily, as evaluateExpression has them
+		if planner.IsAggregate(e) || isCoalesce(e) || isIf(e) {
+			break
+		}
+		args := make([]*compiledExpr, len(e.Args))
+		for i, arg := range e.Args {
+			args[i] = compileExpression(arg, table)
+		}
+		return &compiledExpr{eval: func(row int) (interface{}, error) {
+			vals := make([]interface{}, len(args))
+			for i, arg := range args {
+				val, err := arg.eval(row)
+				if err != nil {
+					return nil, err
+				}
+				vals[i] = val
+			}
+			return evalScalarFunction(e, vals)
+		}}
+	case *sharedExpr:
+		inner := compileExpression(e.expr, table)
+		return &compiledExpr{eval: func(row int) (interface{}, error) {
+			if e.done[row] {
+				return e.values[row], nil
+			}
+			val, err := inner.eval(row)
+			if err != nil {
+				return nil, err
+			}
+			e.values[row], e.done[row] = val, true
+			return val, nil
+		}}
+	}
+	return &compiledExpr{eval: func(row int) (interface{}, error) {
+		return evaluateExpression(expr, table, row)
+	}}
+}
+
+func compileExpressions(exprs []queryparser.Expression, table array.Record) []*compiledExpr {
+	compiled := make([]*compiledExpr, len(exprs))
+	for i, expr := range exprs {
+		compiled[i] = compileExpression(expr, table)
+	}
+	return compiled
+}
+
+func failed(err error) *compiledExpr {
+	return &compiledExpr{eval: func(int) (interface{}, error) { return nil, err }}
+}
+
+func constant(val interface{}) *compiledExpr {
+	c := &compiledExpr{eval: func(int) (interface{}, error) { return val, nil }}
+	switch v := val.(type) {
+	case int64:
+		c.kind = kindInt
+		c.ints = func(int) (int64, bool, error) { return v, true, nil }
+	case float64:
+		c.kind = kindFloat
+		c.floats = func(int) (float64, bool, error) { return v, true, nil }
+	}
+	return c
+}
+
+// compileColumn reads the values of arr, unboxed when it holds integers or
+// floats.
+func compileColumn(arr array.Interface) *compiledExpr {
+	switch a := arr.(type) {
+	case *array.Int64:
+		return typedInts(func(row int) (int64, bool, error) {
+			return a.Value(row), a.IsValid(row), nil
+		})
+	case *array.Float64:
+		return typedFloats(func(row int) (float64, bool, error) {
+			return a.Value(row), a.IsValid(row), nil
+		})
+	}
+	return &compiledExpr{eval: func(row int) (interface{}, error) {
+		return columnValue(arr, row)
+	}}
+}
+
+func typedInts(ints func(row int) (int64, bool, error)) *compiledExpr {
+	return &compiledExpr{kind: kindInt, ints: ints, eval: func(row int) (interface{}, error) {
+		v, ok, err := ints(row)
+		if err != nil || !ok {
+			return nil, err
+		}
+		return v, nil
+	}}
+}
+
+func typedFloats(floats func(row int) (float64, bool, error)) *compiledExpr {
+	return &compiledExpr{kind: kindFloat, floats: floats, eval: func(row int) (interface{}, error) {
+		v, ok, err := floats(row)
+		if err != nil || !ok {
+			return nil, err
+		}
+		return v, nil
+	}}
+}
+
+// asFloats reads the values of c, which must be typed, as floats, the way
+// toFloat widens integers.
+func (c *compiledExpr) asFloats() func(row int) (float64, bool, error) {
+	if c.kind == kindFloat {
+		return c.floats
+	}
+	ints := c.ints
+	return func(row int) (float64, bool, error) {
+		v, ok, err := ints(row)
+		return float64(v), ok, err
+	}
+}
+
+// compileBinary compiles e from its compiled operands. Arithmetic and
+// comparisons between typed operands follow evalBinaryOp: integers stay
+// integers, and an integer meeting a float is widened.
+func compileBinary(e *queryparser.BinaryExpr, left, right *compiledExpr) *compiledExpr {
+	if left.kind != kindUnsupported && right.kind != kindUnsupported {
+		switch e.Op {
+		case "+", "-", "*", "/":
+			if left.kind == kindInt && right.kind == kindInt {
+				return compileIntegerOp(e, left.ints, right.ints)
+			}
+			return compileFloatOp(e, left.asFloats(), right.asFloats())
+		case "=", "!=", "<>", ">", "<", ">=", "<=":
+			return compileComparison(e.Op, left, right)
+		}
+	}
+	return &compiledExpr{eval: func(row int) (interface{}, error) {
+		l, err := left.eval(row)
+		if err != nil {
+			return nil, err
+		}
+		r, err := right.eval(row)
+		if err != nil {
+			return nil, err
+		}
+		val, err := evalBinaryOp(e.Op, l, r)
+		return val, arithmeticError(err, e)
+	}}
+}
+
+func compileIntegerOp(e *queryparser.BinaryExpr, left, right func(row int) (int64, bool, error)) *compiledExpr {
+	return typedInts(func(row int) (int64, bool, error) {
+		l, lok, err := left(row)
+		if err != nil {
+			return 0, false, err
+		}
+		r, rok, err := right(row)
+		if err != nil || !lok || !rok {
+			return 0, false, err
+		}
+		val, err := evalIntegerOp(e.Op, l, r)
+		if err != nil {
+			return 0, false, arithmeticError(err, e)
+		}
+		return val.(int64), true, nil
+	})
+}
+
+func compileFloatOp(e *queryparser.BinaryExpr, left, right func(row int) (float64, bool, error)) *compiledExpr {
+	var op func(l, r float64) (float64, error)
+	switch e.Op {
+	case "+":
+		op = func(l, r float64) (float64, error) { return l + r, nil }
+	case "-":
+		op = func(l, r float64) (float64, error) { return l - r, nil }
+	case "*":
+		op = func(l, r float64) (float64, error) { return l * r, nil }
+	default:
+		op = func(l, r float64) (float64, error) {
+			if r == 0 {
+				return 0, arithmeticError(errDivisionByZero, e)
+			}
+			return l / r, nil
+		}
+	}
+	return typedFloats(func(row int) (float64, bool, error) {
+		l, lok, err := left(row)
+		if err != nil {
+			return 0, false, err
+		}
+		r, rok, err := right(row)
+		if err != nil || !lok || !rok {
+			return 0, false, err
+		}
+		val, err := op(l, r)
+		return val, err == nil, err
+	})
+}
+
+func compileComparison(op string, left, right *compiledExpr) *compiledExpr {
+	var compare func(row int) (int, bool, error)
+	if left.kind == kindInt && right.kind == kindInt {
+		compare = compareTyped(left.ints, right.ints, compareInts)
+	} else {
+		compare = compareTyped(left.asFloats(), right.asFloats(), compareFloats)
+	}
+	holds := comparisonHolds(op)
+	return &compiledExpr{eval: func(row int) (interface{}, error) {
+		c, ok, err := compare(row)
+		if err != nil || !ok {
+			return nil, err
+		}
+		return holds(c), nil
+	}}
+}
+
+func compareTyped[T any](left, right func(row int) (T, bool, error), compare func(l, r T) int) func(row int) (int, bool, error) {
+	return func(row int) (int, bool, error) {
+		l, lok, err := left(row)
+		if err != nil {
+			return 0, false, err
+		}
+		r, rok, err := right(row)
+		if err != nil || !lok || !rok {
+			return 0, false, err
+		}
+		return compare(l, r), true, nil
+	}
+}
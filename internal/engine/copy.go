@@ -0,0 +1,217 @@
+package engine
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/memory"
+
+	"github.com/kris-gaudel/tinylake/internal/arrowengine"
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// copyOptions are the settings of a COPY, from its options list.
+type copyOptions struct {
+	format string // CSV or PARQUET
+	csv    arrowengine.CSVOptions
+}
+
+// parseCopyOptions reads the options of a COPY. FORMAT defaults to the path's
+// extension, or CSV. HEADER and DELIMITER set the layout of a CSV file, by
+// default comma separated with a header row.
+func parseCopyOptions(stmt *queryparser.CopyStmt) (copyOptions, error) {
+	opts := copyOptions{csv: arrowengine.DefaultCSVOptions}
+	for name, value := range stmt.Options {
+		switch name {
+		case "FORMAT":
+			opts.format = strings.ToUpper(value)
+		case "HEADER":
+			header, err := parseCopyBool(value)
+			if err != nil {
+				return opts, fmt.Errorf("COPY: invalid value for HEADER: %q (expected true or false)", value)
+			}
+			opts.csv.Header = header
+		case "DELIMITER":
+			runes := []rune(value)
+			if len(runes) != 1 || runes[0] == '"' || runes[0] == '\r' || runes[0] == '\n' {
+				return opts, fmt.Errorf("COPY: invalid value for DELIMITER: %q (expected a single character)", value)
+			}
+			opts.csv.Delimiter = runes[0]
+		default:
+			return opts, fmt.Errorf("COPY: unknown option %s", name)
+		}
+	}
+
+	if opts.format == "" {
+		opts.format = strings.ToUpper(strings.TrimPrefix(filepath.Ext(stmt.Path), "."))
+		if opts.format == "" {
+			opts.format = "CSV"
+		}
+	}
+	switch opts.format {
+	case "CSV":
+		return opts, nil
+	case "PARQUET":
+		for _, name := range []string{"HEADER", "DELIMITER"} {
+			if _, ok := stmt.Options[name]; ok {
+				return opts, fmt.Errorf("COPY: option %s applies only to CSV files", name)
+			}
+		}
+		return opts, nil
+	default:
+		return opts, fmt.Errorf("COPY: unsupported format %s", opts.format)
+	}
+}
+
+// parseCopyBool parses the value of a boolean COPY option.
+func parseCopyBool(value string) (bool, error) {
+	switch strings.ToUpper(value) {
+	case "TRUE", "ON", "1":
+		return true, nil
+	case "FALSE", "OFF", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("%q is not a boolean", value)
+}
+
+func (s *Session) copy(ec *execContext, stmt *queryparser.CopyStmt) error {
+	opts, err := parseCopyOptions(stmt)
+	if err != nil {
+		return err
+	}
+	if stmt.From {
+		return s.copyFrom(ec, stmt, opts)
+	}
+	return s.copyTo(ec, stmt, opts)
+}
+
+// copyTo exports a table or query result to a file.
+func (s *Session) copyTo(ec *execContext, stmt *queryparser.CopyStmt, opts copyOptions) error {
+	var rec array.Record
+	var err error
+	if stmt.Query != nil {
+		rec, err = s.execute(ec, stmt.Query)
+	} else {
+		rec, err = s.readTable(ec, stmt.TableName)
+	}
+	if err != nil {
+		return err
+	}
+	defer rec.Release()
+
+	if opts.format == "PARQUET" {
+		return arrowengine.WriteParquet(stmt.Path, rec)
+	}
+	out, err := csvCompatible(rec, ec.pool)
+	if err != nil {
+		return err
+	}
+	defer out.Release()
+	return arrowengine.WriteCSV(stmt.Path, out, opts.csv)
+}
+
+// copyFrom loads a file into a table. A new table takes the file's schema,
+// inferred for a CSV file; an existing one gets the rows appended, casting
+// each value to the column's type. Columns are matched by name, or by
+// position when a CSV file has no header row.
+func (s *Session) copyFrom(ec *execContext, stmt *queryparser.CopyStmt, opts copyOptions) error {
+	var loaded array.Record
+	var err error
+	if opts.format == "PARQUET" {
+		loaded, err = arrowengine.LoadParquet(stmt.Path)
+	} else {
+		loaded, err = arrowengine.LoadCSV(stmt.Path, opts.csv)
+	}
+	if err != nil {
+		return err
+	}
+	defer loaded.Release()
+
+	// A new table takes the file's schema as is
+	tables := s.tablesOf(stmt.TableName)
+	if err := tables.Create(stmt.TableName, loaded); err == nil {
+		return nil
+	}
+	return tables.Update(stmt.TableName, func(table array.Record) (array.Record, error) {
+		byPosition := opts.format == "CSV" && !opts.csv.Header
+		return appendRecord(table, loaded, byPosition, ec.pool)
+	})
+}
+
+// appendRecord appends the rows of src to table, matching columns by name, or
+// by position when byPosition is set. Table columns missing from src are NULL.
+func appendRecord(table, src array.Record, byPosition bool, pool memory.Allocator) (array.Record, error) {
+	n := int(src.NumRows())
+	fields := table.Schema().Fields()
+	vals := make([][]interface{}, len(fields))
+	for i := range vals {
+		vals[i] = make([]interface{}, n)
+	}
+
+	if byPosition && len(src.Schema().Fields()) > len(fields) {
+		return nil, fmt.Errorf("COPY: file has %d columns but the table has %d", len(src.Schema().Fields()), len(fields))
+	}
+	for j, sf := range src.Schema().Fields() {
+		i := j
+		if !byPosition {
+			var err error
+			if i, err = resolveColumn(table, &queryparser.ColumnRef{Name: sf.Name}); err != nil {
+				return nil, err
+			}
+		}
+		for row := 0; row < n; row++ {
+			val, err := columnValue(src.Column(j), row)
+			if err != nil {
+				return nil, err
+			}
+			if vals[i][row], err = castValue(val, fields[i].Type); err != nil {
+				return nil, fmt.Errorf("column %s: %w", fields[i].Name, err)
+			}
+		}
+	}
+	return appendValues(table, vals, n, pool)
+}
+
+// csvCompatible returns rec with the column types the CSV writer does not
+// handle, such as dates, timestamps, decimals, lists and structs, converted to
+// strings.
+func csvCompatible(rec array.Record, pool memory.Allocator) (array.Record, error) {
+	fields := make([]arrow.Field, len(rec.Schema().Fields()))
+	cols := make([]array.Interface, 0, len(fields))
+	defer func() {
+		for _, c := range cols {
+			c.Release()
+		}
+	}()
+
+	for i, f := range rec.Schema().Fields() {
+		fields[i] = arrow.Field{Name: f.Name, Type: f.Type, Nullable: f.Nullable}
+		col := rec.Column(i)
+		switch f.Type.ID() {
+		case arrow.DATE32, arrow.DATE64, arrow.TIMESTAMP, arrow.DECIMAL128, arrow.LIST, arrow.STRUCT:
+			vals := make([]interface{}, col.Len())
+			for row := range vals {
+				val, err := columnValue(col, row)
+				if err != nil {
+					return nil, err
+				}
+				if vals[row], err = castValue(val, arrow.BinaryTypes.String); err != nil {
+					return nil, err
+				}
+			}
+			fields[i].Type = arrow.BinaryTypes.String
+			converted, err := buildArray(pool, arrow.BinaryTypes.String, vals)
+			if err != nil {
+				return nil, err
+			}
+			cols = append(cols, converted)
+		default:
+			col.Retain()
+			cols = append(cols, col)
+		}
+	}
+	return array.NewRecord(arrow.NewSchema(fields, nil), cols, rec.NumRows()), nil
+}
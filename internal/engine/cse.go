@@ -0,0 +1,158 @@
+package engine
+
+import (
+	"github.com/apache/arrow/go/arrow/array"
+
+	"github.com/kris-gaudel/tinylake/internal/planner"
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// sharedExpr is a subexpression that a query has in more than one place,
+// evaluated at most once for each row of the table the query reads however
+// many of those places ask for it. Parallel morsels evaluate disjoint rows,
+// so they never write the same value.
+type sharedExpr struct {
+	expr   queryparser.Expression
+	values []interface{}
+	done   []bool
+}
+
+func (s *sharedExpr) evaluate(table array.Record, row int) (interface{}, error) {
+	if s.done[row] {
+		return s.values[row], nil
+	}
+	val, err := evaluateExpression(s.expr, table, row)
+	if err != nil {
+		return nil, err
+	}
+	s.values[row], s.done[row] = val, true
+	return val, nil
+}
+
+// shareSubexpressions replaces the computations that q has more than once
+// across its projections, WHERE and ORDER BY with sharedExprs over the rows
+// of a table with the given number of rows, as in
+//
+//	SELECT (Open + Close) / 2 FROM t WHERE (Open + Close) / 2 > 5000
+//
+// Only arithmetic and scalar function calls are shared: column references
+// and constants cost nothing to repeat, and comparisons are left as they are
+// for filters to evaluate a column at a time. Queries that group, aggregate
+// or use windows evaluate their expressions over other rows and are left
+// alone.
+func shareSubexpressions(q *queryparser.Query, rows int) {
+	exprs := append([]queryparser.Expression{q.Where}, q.Projections...)
+	exprs = append(exprs, orderByExprs(q.OrderBy)...)
+	if len(q.GroupBy) > 0 || q.Having != nil || hasWindow(exprs...) {
+		return
+	}
+	for _, e := range exprs {
+		if hasAggregate(e) {
+			return
+		}
+	}
+
+	counts := map[string]int{}
+	var count func(queryparser.Expression)
+	count = func(expr queryparser.Expression) {
+		if isComputation(expr) && isShareable(expr) {
+			counts[queryparser.FormatExpr(expr)]++
+		}
+		for _, child := range queryparser.Children(expr) {
+			count(child)
+		}
+	}
+	for _, e := range exprs {
+		count(e)
+	}
+
+	shared := map[string]*sharedExpr{}
+	share := func(expr queryparser.Expression) queryparser.Expression {
+		if expr == nil {
+			return nil
+		}
+		return queryparser.Transform(expr, func(node queryparser.Expression) queryparser.Expression {
+			if !isComputation(node) || !isShareable(node) {
+				return node
+			}
+			key := queryparser.FormatExpr(unshare(node))
+			if counts[key] < 2 {
+				return node
+			}
+			if shared[key] == nil {
+				shared[key] = &sharedExpr{expr: node, values: make([]interface{}, rows), done: make([]bool, rows)}
+			}
+			return shared[key]
+		})
+	}
+	q.Where = share(q.Where)
+	projections := make([]queryparser.Expression, len(q.Projections))
+	for i, e := range q.Projections {
+		projections[i] = share(e)
+	}
+	q.Projections = projections
+	orderBy := make([]queryparser.OrderByItem, len(q.OrderBy))
+	for i, item := range q.OrderBy {
+		item.Expr = share(item.Expr)
+		orderBy[i] = item
+	}
+	if q.OrderBy != nil {
+		q.OrderBy = orderBy
+	}
+}
+
+// isComputation reports whether expr computes something worth evaluating
+// once: arithmetic or a scalar function call.
+func isComputation(expr queryparser.Expression) bool {
+	switch e := expr.(type) {
+	case *queryparser.BinaryExpr:
+		switch e.Op {
+		case "+", "-", "*", "/", "%":
+			return true
+		}
+	case *queryparser.UnaryExpr:
+		return e.Op == "-"
+	case *queryparser.FuncCall:
+		return !planner.IsAggregate(e)
+	}
+	return false
+}
+
+// isShareable reports whether expr is made only of nodes that FormatExpr
+// spells out in full, so that two of them with the same text compute the
+// same values. Nodes put in during planning, such as planned subqueries, are
+// not.
+func isShareable(expr queryparser.Expression) bool {
+	switch e := expr.(type) {
+	case *sharedExpr:
+		return true
+	case *queryparser.InExpr:
+		if e.Subquery != nil {
+			return false
+		}
+	case *queryparser.FuncCall:
+		if planner.IsAggregate(e) {
+			return false
+		}
+	case *queryparser.ColumnRef, *queryparser.Literal, *queryparser.BinaryExpr, *queryparser.UnaryExpr,
+		*queryparser.CastExpr, *queryparser.IsNullExpr, *queryparser.BetweenExpr, *queryparser.LikeExpr:
+	default:
+		return false
+	}
+	for _, child := range queryparser.Children(expr) {
+		if !isShareable(child) {
+			return false
+		}
+	}
+	return true
+}
+
+// unshare returns expr with the shared subexpressions in it put back.
+func unshare(expr queryparser.Expression) queryparser.Expression {
+	return queryparser.Transform(expr, func(node queryparser.Expression) queryparser.Expression {
+		if s, ok := node.(*sharedExpr); ok {
+			return unshare(s.expr)
+		}
+		return node
+	})
+}
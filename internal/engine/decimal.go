@@ -0,0 +1,261 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/decimal128"
+)
+
+// decimal is an exact number, unscaled / 10^scale, as read from a Decimal128
+// column. Arithmetic between decimals, and with integers, stays exact; with a
+// float it is done in floating point.
+type decimal struct {
+	unscaled *big.Int
+	scale    int32
+}
+
+// maxDecimalPrecision is the number of digits a Decimal128 holds.
+const maxDecimalPrecision = 38
+
+// minDivisionScale is the fewest fractional digits a decimal quotient keeps.
+const minDivisionScale = 6
+
+// defaultDecimalType is the type of a DECIMAL or NUMERIC without a precision.
+var defaultDecimalType = &arrow.Decimal128Type{Precision: 18, Scale: 3}
+
+func decimalOf(n decimal128.Num, scale int32) decimal {
+	return decimal{unscaled: n.BigInt(), scale: scale}
+}
+
+// decimalFromInt is the decimal with the value of v and no fractional digits.
+func decimalFromInt(v int64) decimal {
+	return decimal{unscaled: big.NewInt(v)}
+}
+
+// parseDecimal parses a number written in decimal notation, keeping every
+// digit after the point.
+func parseDecimal(s string) (decimal, error) {
+	s = strings.TrimSpace(s)
+	digits, scale := s, int32(0)
+	if i := strings.IndexByte(s, '.'); i != -1 {
+		digits = s[:i] + s[i+1:]
+		scale = int32(len(s) - i - 1)
+	}
+	unscaled, ok := new(big.Int).SetString(digits, 10)
+	if !ok {
+		return decimal{}, fmt.Errorf("invalid decimal %q", s)
+	}
+	return decimal{unscaled: unscaled, scale: scale}, nil
+}
+
+// decimalFromFloat is the decimal nearest to f with the given scale.
+func decimalFromFloat(f float64, scale int32) (decimal, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return decimal{}, fmt.Errorf("cannot convert %v to a decimal", f)
+	}
+	d, err := parseDecimal(strconv.FormatFloat(f, 'f', -1, 64))
+	if err != nil {
+		return decimal{}, err
+	}
+	return d.rescale(scale), nil
+}
+
+func (d decimal) String() string {
+	s := new(big.Int).Abs(d.unscaled).String()
+	if d.scale > 0 {
+		if pad := int(d.scale) + 1 - len(s); pad > 0 {
+			s = strings.Repeat("0", pad) + s
+		}
+		s = s[:len(s)-int(d.scale)] + "." + s[len(s)-int(d.scale):]
+	}
+	if d.unscaled.Sign() < 0 {
+		s = "-" + s
+	}
+	return s
+}
+
+func (d decimal) float() float64 {
+	f, _ := strconv.ParseFloat(d.String(), 64)
+	return f
+}
+
+// rescale returns d with the given number of fractional digits, rounding
+// halves away from zero when digits are dropped.
+func (d decimal) rescale(scale int32) decimal {
+	switch {
+	case scale == d.scale:
+		return d
+	case scale > d.scale:
+		return decimal{unscaled: new(big.Int).Mul(d.unscaled, pow10(scale-d.scale)), scale: scale}
+	default:
+		return decimal{unscaled: divRound(d.unscaled, pow10(d.scale-scale)), scale: scale}
+	}
+}
+
+// num converts d to a Decimal128 of type dt, failing when it has more digits
+// than the precision of dt.
+func (d decimal) num(dt *arrow.Decimal128Type) (decimal128.Num, error) {
+	r := d.rescale(dt.Scale)
+	if new(big.Int).Abs(r.unscaled).Cmp(pow10(dt.Precision)) >= 0 {
+		return decimal128.Num{}, fmt.Errorf("decimal %s does not fit DECIMAL(%d, %d)", d, dt.Precision, dt.Scale)
+	}
+	return decimal128.FromBigInt(r.unscaled), nil
+}
+
+// integer returns d without its fractional digits, rounded toward zero when
+// dir is 0, down when it is -1 and up when it is 1.
+func (d decimal) integer(dir int) decimal {
+	if d.scale <= 0 {
+		return d
+	}
+	q, r := new(big.Int).QuoRem(d.unscaled, pow10(d.scale), new(big.Int))
+	if r.Sign() != 0 && r.Sign() == dir {
+		q.Add(q, big.NewInt(int64(dir)))
+	}
+	return decimal{unscaled: q}
+}
+
+func (d decimal) negate() decimal {
+	return decimal{unscaled: new(big.Int).Neg(d.unscaled), scale: d.scale}
+}
+
+// toDecimal reads a decimal or integer operand as a decimal.
+func toDecimal(v interface{}) (decimal, bool) {
+	switch x := v.(type) {
+	case decimal:
+		return x, true
+	case int64:
+		return decimalFromInt(x), true
+	}
+	return decimal{}, false
+}
+
+// isDecimalOperation reports whether an arithmetic operator or comparison
+// between left and right is done exactly as decimals: one side is a decimal
+// and the other a decimal or an integer.
+func isDecimalOperation(left, right interface{}) bool {
+	_, l := left.(decimal)
+	_, r := right.(decimal)
+	if !l && !r {
+		return false
+	}
+	_, lok := toDecimal(left)
+	_, rok := toDecimal(right)
+	return lok && rok
+}
+
+// evalDecimalOp applies an arithmetic operator to two decimals. Sums and
+// differences keep the larger scale and products the sum of the scales; a
+// quotient keeps at least minDivisionScale fractional digits.
+func evalDecimalOp(op string, left, right decimal) (interface{}, error) {
+	switch op {
+	case "+", "-":
+		scale := max(left.scale, right.scale)
+		l, r := left.rescale(scale), right.rescale(scale)
+		if op == "+" {
+			return decimal{unscaled: new(big.Int).Add(l.unscaled, r.unscaled), scale: scale}, nil
+		}
+		return decimal{unscaled: new(big.Int).Sub(l.unscaled, r.unscaled), scale: scale}, nil
+	case "*":
+		return decimal{unscaled: new(big.Int).Mul(left.unscaled, right.unscaled), scale: left.scale + right.scale}, nil
+	default:
+		if right.unscaled.Sign() == 0 {
+			return nil, errDivisionByZero
+		}
+		scale := max(left.scale, right.scale, minDivisionScale)
+		// left/right at scale is left * 10^(scale - left.scale + right.scale) / right
+		n := new(big.Int).Mul(left.unscaled, pow10(scale-left.scale+right.scale))
+		return decimal{unscaled: divRound(n, right.unscaled), scale: scale}, nil
+	}
+}
+
+// compareDecimals orders two decimals by value.
+func compareDecimals(left, right decimal) int {
+	scale := max(left.scale, right.scale)
+	return left.rescale(scale).unscaled.Cmp(right.rescale(scale).unscaled)
+}
+
+// decimalType is the column type for decimal values, of which the one with
+// the most fractional digits sets the scale.
+func decimalType(vals []interface{}) *arrow.Decimal128Type {
+	dt := &arrow.Decimal128Type{Precision: maxDecimalPrecision}
+	for _, v := range vals {
+		if d, ok := v.(decimal); ok && d.scale > dt.Scale {
+			dt.Scale = d.scale
+		}
+	}
+	return dt
+}
+
+// decimalTypeOf parses the precision and scale of DECIMAL(p, s) or
+// NUMERIC(p, s). A missing scale is 0 and a missing precision the default.
+func decimalTypeOf(name string) (*arrow.Decimal128Type, error) {
+	open := strings.IndexByte(name, '(')
+	if open == -1 {
+		return defaultDecimalType, nil
+	}
+	args := strings.Split(strings.TrimSuffix(name[open+1:], ")"), ",")
+	dt := &arrow.Decimal128Type{}
+	precision, err := strconv.Atoi(strings.TrimSpace(args[0]))
+	if err != nil || precision < 1 || precision > maxDecimalPrecision {
+		return nil, fmt.Errorf("invalid precision in %s: must be between 1 and %d", name, maxDecimalPrecision)
+	}
+	dt.Precision = int32(precision)
+	if len(args) > 1 {
+		scale, err := strconv.Atoi(strings.TrimSpace(args[1]))
+		if err != nil || scale < 0 || scale > precision {
+			return nil, fmt.Errorf("invalid scale in %s: must be between 0 and the precision", name)
+		}
+		dt.Scale = int32(scale)
+	}
+	return dt, nil
+}
+
+// castDecimal converts an evaluated value to a decimal of type dt.
+func castDecimal(v interface{}, dt *arrow.Decimal128Type) (interface{}, error) {
+	var d decimal
+	var err error
+	switch x := v.(type) {
+	case decimal:
+		d = x
+	case int64:
+		d = decimalFromInt(x)
+	case float64:
+		d, err = decimalFromFloat(x, dt.Scale)
+	case bool:
+		d = decimalFromInt(boolInt(x))
+	case string:
+		d, err = parseDecimal(x)
+	default:
+		return nil, fmt.Errorf("cannot cast %T to %v", v, dt)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err := d.num(dt); err != nil {
+		return nil, err
+	}
+	return d.rescale(dt.Scale), nil
+}
+
+func pow10(n int32) *big.Int {
+	return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+// divRound divides n by d, rounding halves away from zero.
+func divRound(n, d *big.Int) *big.Int {
+	q, r := new(big.Int).QuoRem(n, d, new(big.Int))
+	if new(big.Int).Mul(new(big.Int).Abs(r), big.NewInt(2)).Cmp(new(big.Int).Abs(d)) >= 0 {
+		if (n.Sign() < 0) != (d.Sign() < 0) {
+			q.Sub(q, big.NewInt(1))
+		} else {
+			q.Add(q, big.NewInt(1))
+		}
+	}
+	return q
+}
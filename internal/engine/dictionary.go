@@ -0,0 +1,173 @@
+package engine
+
+import (
+	"strings"
+
+	"github.com/apache/arrow/go/arrow/array"
+
+	"github.com/kris-gaudel/tinylake/internal/engine/join"
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// dictionaryLimit is the most distinct values a string column may have for the
+// catalog to keep a dictionary of it. It is a variable so that tests can try
+// columns on either side of it.
+var dictionaryLimit = 1 << 12
+
+// codedGroupLimit is the most combinations of codes GROUP BY looks groups up
+// among by code. Beyond it the table of groups by code would be mostly empty.
+const codedGroupLimit = 1 << 16
+
+// stringDictionary numbers the distinct values of a string column in the
+// order they first appear, so that grouping and joining on a low-cardinality
+// column work with the small code of each row rather than hashing its string.
+type stringDictionary struct {
+	codes  []int32  // by row, -1 for NULL
+	values []string // by code
+}
+
+// buildStringDictionary reads arr once to number its values. It returns nil
+// when arr is not a string column or has more than dictionaryLimit distinct
+// values.
+func buildStringDictionary(arr array.Interface) *stringDictionary {
+	col, ok := arr.(*array.String)
+	if !ok {
+		return nil
+	}
+	d := &stringDictionary{codes: make([]int32, col.Len())}
+	seen := map[string]int32{}
+	for row := range d.codes {
+		if col.IsNull(row) {
+			d.codes[row] = -1
+			continue
+		}
+		code, ok := seen[col.Value(row)]
+		if !ok {
+			if len(d.values) == dictionaryLimit {
+				return nil
+			}
+			// The value outlives the column's buffers, which the record owns
+			val := strings.Clone(col.Value(row))
+			code = int32(len(d.values))
+			seen[val] = code
+			d.values = append(d.values, val)
+		}
+		d.codes[row] = code
+	}
+	return d
+}
+
+// value is the value of row, nil for NULL.
+func (d *stringDictionary) value(row int) interface{} {
+	if code := d.codes[row]; code >= 0 {
+		return d.values[code]
+	}
+	return nil
+}
+
+// keyDictionaries returns the dictionaries of the columns keys read, or nil
+// unless every key is a column of one of the catalog's tables, read as it is
+// stored, that has one.
+func keyDictionaries(keys []queryparser.Expression, table array.Record, ec *execContext) []*stringDictionary {
+	if ec == nil || ec.catalog == nil || len(keys) == 0 {
+		return nil
+	}
+	dicts := make([]*stringDictionary, len(keys))
+	for i, k := range keys {
+		col, ok := k.(*queryparser.ColumnRef)
+		if !ok {
+			return nil
+		}
+		idx, err := resolveColumn(table, col)
+		if err != nil {
+			return nil
+		}
+		if dicts[i], ok = ec.catalog.dictionary(table.Column(idx)); !ok {
+			return nil
+		}
+	}
+	return dicts
+}
+
+// codedGroups groups rows by the codes of their GROUP BY columns. Each
+// combination of codes has a slot in a table of group numbers, so a row finds
+// its group without its values being hashed; only a group's first row is
+// looked up by value.
+type codedGroups struct {
+	dicts []*stringDictionary
+	slots int
+}
+
+// newCodedGroups returns the grouping of rows by the codes of dicts, or nil
+// when there are none or too many combinations of codes.
+func newCodedGroups(dicts []*stringDictionary) *codedGroups {
+	if dicts == nil {
+		return nil
+	}
+	slots := 1
+	for _, d := range dicts {
+		if slots *= len(d.values) + 1; slots > codedGroupLimit {
+			return nil
+		}
+	}
+	return &codedGroups{dicts: dicts, slots: slots}
+}
+
+// slot is the slot of the codes of row, NULLs having one of their own.
+func (c *codedGroups) slot(row int) int {
+	s := 0
+	for _, d := range c.dicts {
+		s = s*(len(d.values)+1) + int(d.codes[row]) + 1
+	}
+	return s
+}
+
+// group groups rows as groupedRows.add would, numbering the groups in the
+// order of their first rows.
+func (c *codedGroups) group(rows []int) *groupedRows {
+	groups := newGroupedRows()
+	bySlot := make([]int32, c.slots) // the group number plus one, 0 for none yet
+	for _, row := range rows {
+		s := c.slot(row)
+		if g := bySlot[s]; g > 0 {
+			groups.rows[g-1] = append(groups.rows[g-1], row)
+			continue
+		}
+		key := make([]interface{}, len(c.dicts))
+		for i, d := range c.dicts {
+			key[i] = d.value(row)
+		}
+		groups.add(key, row)
+		bySlot[s] = int32(groups.index.len())
+	}
+	return groups
+}
+
+// dictionaryJoinKeys encodes the join keys of every row from the dictionaries
+// of the key columns, encoding each distinct value once rather than once a
+// row. The keys are those joinKeys gives.
+func dictionaryJoinKeys(dicts []*stringDictionary, n int) []join.Key {
+	encoded := make([][]string, len(dicts))
+	for i, d := range dicts {
+		encoded[i] = make([]string, len(d.values))
+		for code, val := range d.values {
+			encoded[i][code], _ = encodeKey([]interface{}{val})
+		}
+	}
+	out := make([]join.Key, n)
+	for row := range out {
+		var key string
+		for i, d := range dicts {
+			code := d.codes[row]
+			if code < 0 {
+				out[row].Null = true
+				break
+			}
+			key += encoded[i][code]
+		}
+		if !out[row].Null {
+			out[row].Value = key
+		}
+	}
+	return out
+}
@@ -0,0 +1,219 @@
+package engine
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxDistinctValues caps the number of values a DISTINCT aggregate holds in
+// memory for one group. Past it the values are spilled to temporary files,
+// split by hash so that each part can be deduplicated on its own.
+var MaxDistinctValues = 1 << 20
+
+// distinctPartitions is the number of files a distinctSet spills to.
+const distinctPartitions = 16
+
+// distinctSet collects the distinct non-NULL values of a DISTINCT aggregate.
+type distinctSet struct {
+	values map[string]interface{}
+	spill  []*spillFile // nil until the values first outgrow memory
+}
+
+// spillFile is a temporary file of encoded values. It is removed as soon as it
+// is created, so the space goes back once the file is closed, even when the
+// query fails and only the garbage collector closes it.
+type spillFile struct {
+	f *os.File
+	w *bufio.Writer
+}
+
+func newDistinctSet() *distinctSet {
+	return &distinctSet{values: map[string]interface{}{}}
+}
+
+// add adds val unless an equal value was added before.
+func (d *distinctSet) add(val interface{}) error {
+	if val == nil {
+		return nil
+	}
+	d.values[distinctKey([]interface{}{val})] = val
+	if len(d.values) > MaxDistinctValues {
+		return d.spillValues()
+	}
+	return nil
+}
+
+// merge adds the values of o, and closes o.
+func (d *distinctSet) merge(o *distinctSet) error {
+	return o.each(d.add)
+}
+
+// each calls fn once for every distinct value, and closes d.
+func (d *distinctSet) each(fn func(val interface{}) error) error {
+	defer d.close()
+	if d.spill == nil {
+		for _, val := range d.values {
+			if err := fn(val); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// Equal values went to the same file, which is small enough to
+	// deduplicate in memory
+	if err := d.spillValues(); err != nil {
+		return err
+	}
+	for _, part := range d.spill {
+		if err := part.w.Flush(); err != nil {
+			return err
+		}
+		if _, err := part.f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		seen := map[string]bool{}
+		r := bufio.NewReader(part.f)
+		for {
+			val, err := readSpilledValue(r)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			key := distinctKey([]interface{}{val})
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			if err := fn(val); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// spillValues writes the values held in memory to the spill files.
+func (d *distinctSet) spillValues() error {
+	if d.spill == nil {
+		d.spill = make([]*spillFile, distinctPartitions)
+		for i := range d.spill {
+			f, err := os.CreateTemp("", "tinylake-distinct-*")
+			if err != nil {
+				d.close()
+				return fmt.Errorf("spilling DISTINCT values: %w", err)
+			}
+			os.Remove(f.Name())
+			d.spill[i] = &spillFile{f: f, w: bufio.NewWriter(f)}
+		}
+	}
+	for key, val := range d.values {
+		h := fnv.New32a()
+		h.Write([]byte(key))
+		if err := writeSpilledValue(d.spill[h.Sum32()%distinctPartitions].w, val); err != nil {
+			return fmt.Errorf("spilling DISTINCT values: %w", err)
+		}
+	}
+	d.values = map[string]interface{}{}
+	return nil
+}
+
+func (d *distinctSet) close() {
+	for _, part := range d.spill {
+		if part != nil {
+			part.f.Close()
+		}
+	}
+	d.spill = nil
+	d.values = map[string]interface{}{}
+}
+
+// writeSpilledValue writes val as its kind followed by its length-prefixed
+// text.
+func writeSpilledValue(w *bufio.Writer, val interface{}) error {
+	var kind byte
+	var text string
+	switch v := val.(type) {
+	case int64:
+		kind, text = 'i', strconv.FormatInt(v, 10)
+	case float64:
+		kind, text = 'f', strconv.FormatFloat(v, 'g', -1, 64)
+	case decimal:
+		kind, text = 'n', strconv.Itoa(int(v.scale))+":"+v.unscaled.String()
+	case string:
+		kind, text = 's', v
+	case bool:
+		kind, text = 'b', strconv.FormatBool(v)
+	case date:
+		kind, text = 'd', strconv.Itoa(int(v))
+	case time.Time:
+		kind, text = 't', v.Format(time.RFC3339Nano)
+	default:
+		return fmt.Errorf("cannot spill %T", val)
+	}
+	var n [binary.MaxVarintLen64]byte
+	if err := w.WriteByte(kind); err != nil {
+		return err
+	}
+	if _, err := w.Write(n[:binary.PutUvarint(n[:], uint64(len(text)))]); err != nil {
+		return err
+	}
+	_, err := w.WriteString(text)
+	return err
+}
+
+// readSpilledValue reads a value written by writeSpilledValue, returning
+// io.EOF after the last one.
+func readSpilledValue(r *bufio.Reader) (interface{}, error) {
+	kind, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	text := string(buf)
+	switch kind {
+	case 'i':
+		return strconv.ParseInt(text, 10, 64)
+	case 'f':
+		return strconv.ParseFloat(text, 64)
+	case 'n':
+		scale, unscaled, _ := strings.Cut(text, ":")
+		s, err := strconv.Atoi(scale)
+		if err != nil {
+			return nil, err
+		}
+		u, ok := new(big.Int).SetString(unscaled, 10)
+		if !ok {
+			return nil, fmt.Errorf("corrupt spilled decimal %q", text)
+		}
+		return decimal{unscaled: u, scale: int32(s)}, nil
+	case 's':
+		return text, nil
+	case 'b':
+		return text == "true", nil
+	case 'd':
+		d, err := strconv.Atoi(text)
+		return date(d), err
+	case 't':
+		return time.Parse(time.RFC3339Nano, text)
+	default:
+		return nil, fmt.Errorf("corrupt spilled value of kind %q", kind)
+	}
+}
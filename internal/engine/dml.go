@@ -0,0 +1,310 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/memory"
+
+	"github.com/kris-gaudel/tinylake/internal/planner"
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+func (s *Session) insert(ec *execContext, stmt *queryparser.InsertStmt) error {
+	if stmt.OnConflict != nil {
+		return s.upsert(ec, stmt)
+	}
+	return s.tablesOf(stmt.TableName).Update(stmt.TableName, func(table array.Record) (array.Record, error) {
+		return insertRows(table, stmt, ec.pool)
+	})
+}
+
+// insertRows returns a new version of table with the statement's rows
+// appended. Each value is cast to its column's type; columns left out of the
+// column list are NULL.
+func insertRows(table array.Record, stmt *queryparser.InsertStmt, pool memory.Allocator) (array.Record, error) {
+	newVals, err := insertValues(table, stmt)
+	if err != nil {
+		return nil, err
+	}
+	return appendValues(table, newVals, len(stmt.Rows), pool)
+}
+
+// insertValues evaluates the statement's rows, returning the values of each
+// column of table.
+func insertValues(table array.Record, stmt *queryparser.InsertStmt) ([][]interface{}, error) {
+	targets, err := insertTargets(table, stmt.Columns)
+	if err != nil {
+		return nil, err
+	}
+
+	// Values are constant expressions, evaluated against a row with no columns
+	empty := array.NewRecord(arrow.NewSchema(nil, nil), nil, 1)
+	defer empty.Release()
+
+	fields := table.Schema().Fields()
+	newVals := make([][]interface{}, len(fields))
+	for i := range newVals {
+		newVals[i] = make([]interface{}, len(stmt.Rows))
+	}
+	for r, row := range stmt.Rows {
+		if len(row) != len(targets) {
+			return nil, fmt.Errorf("INSERT row %d has %d values but %d columns", r+1, len(row), len(targets))
+		}
+		for i, expr := range row {
+			val, err := evaluateExpression(expr, empty, 0)
+			if err != nil {
+				return nil, err
+			}
+			col := targets[i]
+			if newVals[col][r], err = castValue(val, fields[col].Type); err != nil {
+				return nil, fmt.Errorf("column %s: %w", fields[col].Name, err)
+			}
+		}
+	}
+	return newVals, nil
+}
+
+// executeValues builds the table of a VALUES list, with columns named col0,
+// col1 and so on. Each column takes the type of its values, widening integers
+// to float64 when the two are mixed.
+func executeValues(rows [][]queryparser.Expression, pool memory.Allocator) (array.Record, error) {
+	empty := array.NewRecord(arrow.NewSchema(nil, nil), nil, 1)
+	defer empty.Release()
+
+	width := len(rows[0])
+	cols := make([][]interface{}, width)
+	for i := range cols {
+		cols[i] = make([]interface{}, len(rows))
+	}
+	for r, row := range rows {
+		if len(row) != width {
+			return nil, fmt.Errorf("VALUES row %d has %d values but row 1 has %d", r+1, len(row), width)
+		}
+		for i, expr := range row {
+			val, err := evaluateExpression(expr, empty, 0)
+			if err != nil {
+				return nil, err
+			}
+			cols[i][r] = val
+		}
+	}
+
+	fields := make([]arrow.Field, width)
+	for i, vals := range cols {
+		dt := inferType(vals)
+		if dt == arrow.PrimitiveTypes.Int64 {
+			for _, v := range vals {
+				if _, ok := v.(float64); ok {
+					dt = arrow.PrimitiveTypes.Float64
+					break
+				}
+			}
+		}
+		for r, v := range vals {
+			cast, err := castValue(v, dt)
+			if err != nil {
+				return nil, fmt.Errorf("VALUES column %d: %w", i+1, err)
+			}
+			vals[r] = cast
+		}
+		fields[i] = arrow.Field{Name: fmt.Sprintf("col%d", i), Type: dt, Nullable: true}
+	}
+	return buildRecord(pool, fields, cols)
+}
+
+// appendValues returns a new version of table with n rows appended. vals holds
+// the new values of each column, already of the column's type.
+func appendValues(table array.Record, vals [][]interface{}, n int, pool memory.Allocator) (array.Record, error) {
+	fields := table.Schema().Fields()
+	cols := make([]array.Interface, 0, len(fields))
+	defer func() {
+		for _, c := range cols {
+			c.Release()
+		}
+	}()
+	for i, f := range fields {
+		if !f.Nullable {
+			for _, v := range vals[i] {
+				if v == nil {
+					return nil, fmt.Errorf("column %s does not allow NULL", f.Name)
+				}
+			}
+		}
+
+		added, err := buildArray(pool, f.Type, vals[i])
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", f.Name, err)
+		}
+		col, err := array.Concatenate([]array.Interface{table.Column(i), added}, pool)
+		added.Release()
+		if err != nil {
+			return nil, err
+		}
+		cols = append(cols, col)
+	}
+	return array.NewRecord(table.Schema(), cols, table.NumRows()+int64(n)), nil
+}
+
+func (s *Session) delete(ec *execContext, stmt *queryparser.DeleteStmt) error {
+	// Subqueries in the condition read a snapshot taken before the delete
+	tables := s.snapshot(ec)
+	defer releaseTables(tables)
+
+	return s.tablesOf(stmt.TableName).Update(stmt.TableName, func(table array.Record) (array.Record, error) {
+		matched, err := matchRows(table, stmt.TableName, stmt.Where, tables, ec)
+		if err != nil {
+			return nil, err
+		}
+		keep := make([]int, 0, len(matched))
+		for row, m := range matched {
+			if !m {
+				keep = append(keep, row)
+			}
+		}
+		return takeRecordRows(table, keep, ec.pool)
+	})
+}
+
+// truncate empties a table, keeping its schema.
+func (s *Session) truncate(ec *execContext, stmt *queryparser.TruncateStmt) error {
+	return s.tablesOf(stmt.TableName).Update(stmt.TableName, func(table array.Record) (array.Record, error) {
+		return takeRecordRows(table, nil, ec.pool)
+	})
+}
+
+func (s *Session) update(ec *execContext, stmt *queryparser.UpdateStmt) error {
+	tables := s.snapshot(ec)
+	defer releaseTables(tables)
+
+	return s.tablesOf(stmt.TableName).Update(stmt.TableName, func(table array.Record) (array.Record, error) {
+		return updateRows(table, stmt, tables, ec)
+	})
+}
+
+// updateRows returns a new version of table with the SET clause applied to
+// the rows matching WHERE. Every SET expression sees the row as it was before
+// the update; columns that are not assigned share the old arrays.
+func updateRows(table array.Record, stmt *queryparser.UpdateStmt, tables map[string]array.Record, ec *execContext) (array.Record, error) {
+	matched, err := matchRows(table, stmt.TableName, stmt.Where, tables, ec)
+	if err != nil {
+		return nil, err
+	}
+
+	scan := qualifyRecord(table, stmt.TableName)
+	defer scan.Release()
+
+	assigned := map[int]queryparser.Expression{}
+	for _, a := range stmt.Set {
+		idx, err := resolveColumn(table, &queryparser.ColumnRef{Name: a.Column})
+		if err != nil {
+			return nil, err
+		}
+		if _, dup := assigned[idx]; dup {
+			return nil, fmt.Errorf("column %s assigned more than once", a.Column)
+		}
+		value, err := planSubqueries(planner.DesugarExpr(a.Value), scan, tables, ec)
+		if err != nil {
+			return nil, err
+		}
+		assigned[idx] = value
+	}
+
+	fields := table.Schema().Fields()
+	cols := make([]array.Interface, len(fields))
+	defer func() {
+		for _, c := range cols {
+			if c != nil {
+				c.Release()
+			}
+		}
+	}()
+	for i, f := range fields {
+		value, ok := assigned[i]
+		if !ok {
+			cols[i] = table.Column(i)
+			cols[i].Retain()
+			continue
+		}
+
+		vals := make([]interface{}, table.NumRows())
+		for row := range vals {
+			if !matched[row] {
+				if vals[row], err = columnValue(table.Column(i), row); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			val, err := evaluateExpression(value, scan, row)
+			if err != nil {
+				return nil, err
+			}
+			if vals[row], err = castValue(val, f.Type); err != nil {
+				return nil, fmt.Errorf("column %s: %w", f.Name, err)
+			}
+			if vals[row] == nil && !f.Nullable {
+				return nil, fmt.Errorf("column %s does not allow NULL", f.Name)
+			}
+		}
+		if cols[i], err = buildArray(ec.pool, f.Type, vals); err != nil {
+			return nil, fmt.Errorf("column %s: %w", f.Name, err)
+		}
+	}
+	return array.NewRecord(table.Schema(), cols, table.NumRows()), nil
+}
+
+// matchRows reports, for each row of table, whether where is true for it. A
+// nil condition matches every row; a NULL result does not match.
+func matchRows(table array.Record, name string, where queryparser.Expression, tables map[string]array.Record, ec *execContext) ([]bool, error) {
+	matched := make([]bool, table.NumRows())
+	if where == nil {
+		for i := range matched {
+			matched[i] = true
+		}
+		return matched, nil
+	}
+
+	// Qualify the columns so name.column resolves as it does in a query
+	scan := qualifyRecord(table, name)
+	defer scan.Release()
+	cond, err := planSubqueries(planner.DesugarExpr(where), scan, tables, ec)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := filterRows(cond, scan)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		matched[row] = true
+	}
+	return matched, nil
+}
+
+// insertTargets maps the INSERT column list onto column indices of table.
+func insertTargets(table array.Record, columns []string) ([]int, error) {
+	if len(columns) == 0 {
+		targets := make([]int, table.NumCols())
+		for i := range targets {
+			targets[i] = i
+		}
+		return targets, nil
+	}
+
+	seen := map[int]bool{}
+	targets := make([]int, len(columns))
+	for i, name := range columns {
+		idx, err := resolveColumn(table, &queryparser.ColumnRef{Name: name})
+		if err != nil {
+			return nil, err
+		}
+		if seen[idx] {
+			return nil, fmt.Errorf("column %s specified more than once", name)
+		}
+		seen[idx] = true
+		targets[i] = idx
+	}
+	return targets, nil
+}
@@ -1,69 +1,453 @@
 package engine
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/apache/arrow/go/arrow"
 	"github.com/apache/arrow/go/arrow/array"
 	"github.com/apache/arrow/go/arrow/memory"
 
+	"github.com/kris-gaudel/tinylake/internal/planner"
 	"github.com/kris-gaudel/tinylake/internal/queryparser"
 )
 
-type groupKey struct {
-	parts []interface{}
+// ExecuteQuery runs q against a single table. The table is bound to the name in
+// the query's FROM clause; queries that join other tables need
+// ExecuteQueryWithTables or ExecuteQueryWithCatalog.
+func ExecuteQuery(q *queryparser.Query, table array.Record) (array.Record, error) {
+	return ExecuteQueryContext(context.Background(), q, table)
+}
+
+// ExecuteQueryContext is ExecuteQuery, stopping with an error once ctx is done.
+func ExecuteQueryContext(ctx context.Context, q *queryparser.Query, table array.Record) (array.Record, error) {
+	return ExecuteQueryWithTablesContext(ctx, q, map[string]array.Record{baseTableName(q): table})
 }
 
-func (k groupKey) String() string {
-	s := make([]string, len(k.parts))
-	for i, p := range k.parts {
-		s[i] = fmt.Sprintf("%v", p)
+// baseTableName returns the first table named in q's FROM clause, looking
+// through CTEs and derived tables.
+func baseTableName(q *queryparser.Query) string {
+	if len(q.With) > 0 {
+		return baseTableName(q.With[0].Query)
+	}
+	if q.Subquery != nil {
+		return baseTableName(q.Subquery)
 	}
-	return strings.Join(s, "|")
+	return q.TableName
 }
 
-func ExecuteQuery(q *queryparser.Query, table array.Record) (array.Record, error) {
-	pool := memory.NewGoAllocator()
-	totalRows := int(table.NumRows())
+// ExecuteQueryWithTables runs q, resolving the FROM and JOIN table names in tables.
+func ExecuteQueryWithTables(q *queryparser.Query, tables map[string]array.Record) (array.Record, error) {
+	return ExecuteQueryWithTablesContext(context.Background(), q, tables)
+}
 
-	// Step 1: Filter rows based on WHERE
-	passIndices := make([]int, 0, totalRows)
-	for row := 0; row < totalRows; row++ {
-		pass := true
-		if q.Where != nil {
-			result, err := evaluateExpression(q.Where, table, row)
+// ExecuteQueryWithTablesContext is ExecuteQueryWithTables, stopping with an
+// error once ctx is done.
+func ExecuteQueryWithTablesContext(ctx context.Context, q *queryparser.Query, tables map[string]array.Record) (array.Record, error) {
+	ec := &execContext{ctx: trackProgress(ctx), pool: memory.NewGoAllocator(), now: time.Now(), metrics: newMetricsCollector()}
+	result, err := planAndRun(q, tables, ec)
+	if err != nil {
+		return nil, err
+	}
+	return ec.metrics.attach(result)
+}
+
+// Catalog resolves the names of tables to the tables. MemoryCatalog is one.
+type Catalog interface {
+	// Table returns the table called name, which the caller must release,
+	// or an error when there is no such table.
+	Table(name string) (array.Record, error)
+}
+
+// SnapshotCatalog is a Catalog that can return several tables as they all
+// were at one moment. MemoryCatalog is one.
+type SnapshotCatalog interface {
+	Catalog
+	// Tables returns the tables called names, which the caller must
+	// release, or an error when one of them does not exist.
+	Tables(names []string) (map[string]array.Record, error)
+}
+
+// ExecuteQueryWithCatalog runs q, reading the tables named in its FROM and
+// JOIN clauses, and in those of the queries nested in it, from catalog. When
+// catalog is a SnapshotCatalog, the query reads every table as it was at the
+// same moment.
+func ExecuteQueryWithCatalog(q *queryparser.Query, catalog Catalog) (array.Record, error) {
+	return ExecuteQueryWithCatalogContext(context.Background(), q, catalog)
+}
+
+// ExecuteQueryWithCatalogContext is ExecuteQueryWithCatalog, stopping with an
+// error once ctx is done.
+func ExecuteQueryWithCatalogContext(ctx context.Context, q *queryparser.Query, catalog Catalog) (array.Record, error) {
+	if snapshots, ok := catalog.(SnapshotCatalog); ok {
+		tables, err := snapshots.Tables(tableNames(q, nil))
+		if err != nil {
+			return nil, err
+		}
+		defer releaseTables(tables)
+		return ExecuteQueryWithTablesContext(ctx, q, tables)
+	}
+
+	tables := map[string]array.Record{}
+	defer releaseTables(tables)
+	for _, name := range tableNames(q, nil) {
+		if _, ok := findTable(tables, name); ok {
+			continue
+		}
+		rec, err := catalog.Table(name)
+		if err != nil {
+			return nil, err
+		}
+		tables[name] = rec
+	}
+	return ExecuteQueryWithTablesContext(ctx, q, tables)
+}
+
+// tableNames returns the names of the tables q and the queries nested in it
+// read, leaving out those that name a CTE in scope, as ctes does the CTEs of
+// the queries q is nested in.
+func tableNames(q *queryparser.Query, ctes []string) []string {
+	if q == nil {
+		return nil
+	}
+	var names []string
+	for _, cte := range q.With {
+		names = append(names, tableNames(cte.Query, ctes)...)
+		ctes = append(ctes[:len(ctes):len(ctes)], cte.Name)
+	}
+	table := func(name string) {
+		for _, cte := range ctes {
+			if strings.EqualFold(cte, name) {
+				return
+			}
+		}
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	table(q.TableName)
+	names = append(names, tableNames(q.Subquery, ctes)...)
+	for _, j := range q.Joins {
+		table(j.TableName)
+		names = append(names, tableNames(j.Subquery, ctes)...)
+	}
+	for _, op := range q.SetOps {
+		names = append(names, tableNames(op.Query, ctes)...)
+	}
+	nested := func(expr queryparser.Expression) {
+		queryparser.Inspect(expr, func(e queryparser.Expression) bool {
+			switch e := e.(type) {
+			case *queryparser.SubqueryExpr:
+				names = append(names, tableNames(e.Subquery, ctes)...)
+			case *queryparser.ExistsExpr:
+				names = append(names, tableNames(e.Subquery, ctes)...)
+			case *queryparser.InExpr:
+				names = append(names, tableNames(e.Subquery, ctes)...)
+			}
+			return true
+		})
+	}
+	exprs := append([]queryparser.Expression{q.Where, q.Having, q.Qualify}, q.DistinctOn...)
+	exprs = append(append(exprs, q.Projections...), q.GroupBy...)
+	exprs = append(exprs, orderByExprs(q.OrderBy)...)
+	for _, j := range q.Joins {
+		exprs = append(exprs, j.On)
+		if j.Unnest != nil {
+			exprs = append(exprs, j.Unnest.Args...)
+		}
+	}
+	if q.Unnest != nil {
+		exprs = append(exprs, q.Unnest.Args...)
+	}
+	for _, row := range q.Values {
+		exprs = append(exprs, row...)
+	}
+	for _, e := range exprs {
+		if e != nil {
+			nested(e)
+		}
+	}
+	return names
+}
+
+// planAndRun plans q, checks the plan against the schemas of tables and runs it.
+func planAndRun(q *queryparser.Query, tables map[string]array.Record, ec *execContext) (array.Record, error) {
+	op, err := planQuery(q, tables, ec)
+	if err != nil {
+		return nil, err
+	}
+	return op.execute(tables, ec)
+}
+
+// planQuery plans q and checks the plan against the schemas of tables,
+// returning the operators that run it.
+func planQuery(q *queryparser.Query, tables map[string]array.Record, ec *execContext) (operator, error) {
+	q = fixNow(q, ec.now)
+	if ec.options.NullOnDivisionByZero {
+		q = nullDivisors(q)
+	}
+	plan := planner.Optimize(planner.Build(q), newPlanTables(tables))
+	types, err := bindPlan(plan, tables, ec)
+	if err != nil {
+		return nil, err
+	}
+	return lower(plan, types)
+}
+
+// expandStars replaces each * in a SELECT list with a reference to every column
+// of schema, leaving out the EXCLUDE columns and substituting the REPLACE
+// expressions in place of the columns they name.
+func expandStars(exprs []queryparser.Expression, schema *arrow.Schema) ([]queryparser.Expression, error) {
+	var out []queryparser.Expression
+	for _, expr := range exprs {
+		star, ok := expr.(*queryparser.StarExpr)
+		if !ok {
+			out = append(out, expr)
+			continue
+		}
+
+		// EXCLUDE drops every column with the name, so a join key present on
+		// both sides can be dropped at once
+		excluded := make([]bool, len(schema.Fields()))
+		for _, name := range star.Exclude {
+			found := false
+			for i, f := range schema.Fields() {
+				if strings.EqualFold(f.Name, name) {
+					excluded[i], found = true, true
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("EXCLUDE: column %s not found", name)
+			}
+		}
+		replaced := make(map[int]queryparser.Expression, len(star.Replace))
+		for _, r := range star.Replace {
+			idx, err := resolveField(schema, &queryparser.ColumnRef{Name: r.Alias})
 			if err != nil {
-				return nil, err
+				return nil, fmt.Errorf("REPLACE: %w", err)
 			}
-			if boolResult, ok := result.(bool); ok {
-				pass = boolResult
-			} else {
-				return nil, fmt.Errorf("WHERE clause must evaluate to boolean")
+			replaced[idx] = r
+		}
+
+		for i, f := range schema.Fields() {
+			switch {
+			case excluded[i]:
+			case replaced[i] != nil:
+				out = append(out, replaced[i])
+			default:
+				out = append(out, &queryparser.ColumnRef{Table: columnQualifier(f), Name: f.Name, Quoted: true})
+			}
+		}
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("SELECT list is empty after EXCLUDE")
+	}
+	return out, nil
+}
+
+// splitAliases strips AS aliases from the projections, returning the bare
+// expressions and the alias of each one ("" when not aliased).
+func splitAliases(exprs []queryparser.Expression) ([]queryparser.Expression, []string) {
+	bare := make([]queryparser.Expression, len(exprs))
+	aliases := make([]string, len(exprs))
+	for i, expr := range exprs {
+		if a, ok := expr.(*queryparser.AliasExpr); ok {
+			bare[i] = a.Expr
+			aliases[i] = a.Alias
+		} else {
+			bare[i] = expr
+		}
+	}
+	return bare, aliases
+}
+
+// resolveGroupBy replaces GROUP BY ordinals and projection aliases with the
+// projection expressions they refer to: GROUP BY 1 groups by the first
+// projection. As in PostgreSQL, a name that is a column of the input table
+// means that column even when a projection has the same alias.
+func resolveGroupBy(groupBy, projections []queryparser.Expression, aliases []string, schema *arrow.Schema) ([]queryparser.Expression, error) {
+	if len(groupBy) == 0 {
+		return groupBy, nil
+	}
+	out := make([]queryparser.Expression, len(groupBy))
+	for i, expr := range groupBy {
+		out[i] = expr
+		switch e := expr.(type) {
+		case *queryparser.Literal:
+			if e.Kind != queryparser.LiteralNumber {
+				continue
+			}
+			n, err := strconv.Atoi(e.Value)
+			if err != nil || n < 1 || n > len(projections) {
+				return nil, fmt.Errorf("GROUP BY position %s is not in select list", e.Value)
+			}
+			if hasAggregate(projections[n-1]) {
+				return nil, fmt.Errorf("GROUP BY position %d refers to an aggregate", n)
+			}
+			out[i] = projections[n-1]
+		case *queryparser.ColumnRef:
+			if e.Table != "" {
+				continue
+			}
+			if _, err := resolveField(schema, e); err == nil {
+				continue
+			}
+			for j, alias := range aliases {
+				if alias == e.Name || (!e.Quoted && strings.EqualFold(alias, e.Name)) {
+					if hasAggregate(projections[j]) {
+						return nil, fmt.Errorf("GROUP BY %s refers to an aggregate", e.Name)
+					}
+					out[i] = projections[j]
+					break
+				}
+			}
+		}
+	}
+	return out, nil
+}
+
+// resolveOrderBy replaces ORDER BY ordinals and projection aliases with the
+// projection expressions they refer to: ORDER BY 1 sorts by the first
+// projection. Unlike in GROUP BY, an alias takes precedence over a column of
+// the input table with the same name, as the result is what is sorted.
+func resolveOrderBy(orderBy []queryparser.OrderByItem, projections []queryparser.Expression, aliases []string) ([]queryparser.OrderByItem, error) {
+	if len(orderBy) == 0 {
+		return orderBy, nil
+	}
+	out := make([]queryparser.OrderByItem, len(orderBy))
+	for i, item := range orderBy {
+		out[i] = item
+		switch e := item.Expr.(type) {
+		case *queryparser.Literal:
+			if e.Kind != queryparser.LiteralNumber {
+				continue
+			}
+			n, err := strconv.Atoi(e.Value)
+			if err != nil || n < 1 || n > len(projections) {
+				return nil, fmt.Errorf("ORDER BY position %s is not in select list", e.Value)
+			}
+			out[i].Expr = projections[n-1]
+		case *queryparser.ColumnRef:
+			if e.Table != "" {
+				continue
+			}
+			for j, alias := range aliases {
+				if alias == e.Name || (!e.Quoted && strings.EqualFold(alias, e.Name)) {
+					out[i].Expr = projections[j]
+					break
+				}
 			}
 		}
-		if pass {
-			passIndices = append(passIndices, row)
+	}
+	return out, nil
+}
+
+// outputColumns refers to each column of schema by name, as the projections
+// ORDER BY positions refer to in the result of a set operation.
+func outputColumns(schema *arrow.Schema) []queryparser.Expression {
+	cols := make([]queryparser.Expression, len(schema.Fields()))
+	for i, f := range schema.Fields() {
+		cols[i] = &queryparser.ColumnRef{Name: f.Name, Quoted: true}
+	}
+	return cols
+}
+
+// hasAggregate reports whether expr contains an aggregate function call.
+func hasAggregate(expr queryparser.Expression) bool {
+	switch e := expr.(type) {
+	case *queryparser.FuncCall:
+		if planner.IsAggregate(e) {
+			return true
+		}
+	case *aggregateColumn:
+		return true
+	case *queryparser.WindowExpr:
+		return false
+	}
+	for _, child := range queryparser.Children(expr) {
+		if hasAggregate(child) {
+			return true
+		}
+	}
+	return false
+}
+
+// renameColumns applies the non-empty names to the record's columns, releasing
+// rec and returning a record that shares its arrays.
+func renameColumns(rec array.Record, names []string) array.Record {
+	renamed := false
+	fields := append([]arrow.Field{}, rec.Schema().Fields()...)
+	for i, name := range names {
+		if name != "" && i < len(fields) {
+			fields[i].Name = name
+			renamed = true
+		}
+	}
+	if !renamed {
+		return rec
+	}
+	defer rec.Release()
+	return array.NewRecord(arrow.NewSchema(fields, nil), rec.Columns(), rec.NumRows())
+}
+
+// executeSelect evaluates q over the selected rows of table, or every row when
+// selected is nil. Only the rows and columns of the result are copied.
+func executeSelect(q *queryparser.Query, table array.Record, selected []int, ec *execContext) (array.Record, error) {
+	// Step 1: Filter rows based on WHERE
+	var passIndices []int
+	var err error
+	if selected != nil {
+		passIndices, err = filterSelection(ec.ctx, q.Where, table, selected, ec.options.workers())
+	} else {
+		passIndices, err = filterMorsels(ec.ctx, q.Where, table, ec.options.workers(), newZonePruner(q.Where, table, ec))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if hasWindow(q.Projections...) || hasWindow(orderByExprs(q.OrderBy)...) {
+		if len(q.GroupBy) > 0 {
+			return nil, fmt.Errorf("window functions are not supported with GROUP BY")
+		}
+		planned, err := planWindows(q, table, passIndices, ec.options.NullsFirst)
+		if err != nil {
+			return nil, err
+		}
+		q = planned
+	}
+
+	if len(q.OrderBy) > 0 && len(q.GroupBy) == 0 {
+		sorted, err := sortRows(q.OrderBy, table, passIndices, ec.options.NullsFirst)
+		if err != nil {
+			return nil, err
 		}
+		passIndices = sorted
 	}
 
 	// Step 2: Determine if it's an aggregate query
-	allAgg := true
+	aggregated := false
 	for _, expr := range q.Projections {
-		if _, ok := expr.(*queryparser.FuncCall); !ok {
-			allAgg = false
+		if hasAggregate(expr) {
+			aggregated = true
 			break
 		}
 	}
 
-	if allAgg {
-		return executeAggregates(q.Projections, table, passIndices, pool)
+	if len(q.GroupBy) > 0 {
+		return executeGroupedQuery(q, table, passIndices, ec)
 	}
 
-	if len(q.GroupBy) > 0 {
-		return executeGroupedQuery(q, table, passIndices, pool)
+	if q.Having != nil {
+		return nil, fmt.Errorf("HAVING requires GROUP BY")
+	}
+
+	if aggregated {
+		return executeAggregates(q.Projections, table, passIndices, ec.pool)
 	}
 
 	// Step 3: Regular projection
@@ -71,34 +455,45 @@ func ExecuteQuery(q *queryparser.Query, table array.Record) (array.Record, error
 	projectedFields := []arrow.Field{}
 
 	for i, expr := range q.Projections {
+		if f := structFieldRef(table.Schema(), expr); f != nil {
+			expr = f
+		}
 		switch e := expr.(type) {
 		case *queryparser.ColumnRef:
-			colIdx := findColumnIndex(table, e.Name)
-			if colIdx == -1 {
-				return nil, fmt.Errorf("column %s not found", e.Name)
+			colIdx, err := resolveColumn(table, e)
+			if err != nil {
+				return nil, err
+			}
+			arr, err := takeRows(ec.pool, table.Column(colIdx), passIndices)
+			if err != nil {
+				return nil, err
 			}
-			projectedArrays = append(projectedArrays, table.Column(colIdx))
+			defer arr.Release()
+			projectedArrays = append(projectedArrays, arr)
 			projectedFields = append(projectedFields, table.Schema().Field(colIdx))
 		default:
-			builder := array.NewFloat64Builder(pool)
-			defer builder.Release()
-			for _, row := range passIndices {
-				val, err := evaluateExpression(expr, table, row)
+			vals, err := evaluateMorsels(ec.ctx, expr, table, passIndices, ec.options.workers())
+			if err != nil {
+				return nil, err
+			}
+			dt := inferType(vals)
+			if c, ok := expr.(*queryparser.CastExpr); ok {
+				// The cast fixes the column type even when every value is NULL
+				castDt, err := castType(c.Type)
 				if err != nil {
 					return nil, err
 				}
-				if val == nil {
-					builder.AppendNull()
-				} else {
-					builder.Append(toFloat(val))
-				}
+				dt = castDt
+			}
+			arr, err := buildArray(ec.pool, dt, vals)
+			if err != nil {
+				return nil, err
 			}
-			arr := builder.NewArray()
 			defer arr.Release()
 			projectedArrays = append(projectedArrays, arr)
 			projectedFields = append(projectedFields, arrow.Field{
-				Name:     fmt.Sprintf("expr_%d", i),
-				Type:     arrow.PrimitiveTypes.Float64,
+				Name:     projectionName(expr, i),
+				Type:     dt,
 				Nullable: true,
 			})
 		}
@@ -108,293 +503,1798 @@ func ExecuteQuery(q *queryparser.Query, table array.Record) (array.Record, error
 	return array.NewRecord(schema, projectedArrays, int64(len(passIndices))), nil
 }
 
+// executeAggregates computes a query with aggregates but no GROUP BY, which
+// treats all rows as a single group and produces one row. Columns may only
+// appear inside aggregate calls.
 func executeAggregates(exprs []queryparser.Expression, table array.Record, indices []int, pool memory.Allocator) (array.Record, error) {
-	fields := []arrow.Field{}
-	values := []float64{}
-
+	fields := make([]arrow.Field, len(exprs))
+	cols := make([][]interface{}, len(exprs))
 	for i, e := range exprs {
-		fc, ok := e.(*queryparser.FuncCall)
-		if !ok {
-			return nil, fmt.Errorf("non-aggregate in aggregate-only projection")
+		if col := ungroupedColumn(e); col != nil {
+			return nil, queryparser.ErrorAt(col.Pos, "column %s must appear in the GROUP BY clause or be used in an aggregate function", col.Name)
 		}
-		val, err := evalAggregateFunction(fc, table, indices)
+		val, err := evaluateGroupExpression(e, table, indices)
 		if err != nil {
 			return nil, err
 		}
-		values = append(values, val)
-		fields = append(fields, arrow.Field{
-			Name:     fmt.Sprintf("expr_%d", i),
-			Type:     arrow.PrimitiveTypes.Float64,
-			Nullable: false,
-		})
+		cols[i] = []interface{}{val}
+		fields[i] = arrow.Field{Name: fmt.Sprintf("expr_%d", i), Type: inferType(cols[i]), Nullable: true}
+		switch e := e.(type) {
+		case *queryparser.FuncCall:
+			if planner.IsAggregate(e) {
+				fields[i] = aggregateField(fields[i].Name, e, cols[i])
+			}
+		case *aggregateColumn:
+			fields[i] = aggregateField(fields[i].Name, e.call, cols[i])
+		}
 	}
+	return buildRecord(pool, fields, cols)
+}
 
-	arrays := []array.Interface{}
-	for _, val := range values {
-		b := array.NewFloat64Builder(pool)
-		b.Append(val)
-		arr := b.NewArray()
-		arrays = append(arrays, arr)
-	}
+// aggregateField is the output column of an aggregate call with the given
+// results. Only COUNT and APPROX_COUNT_DISTINCT never return NULL.
+func aggregateField(name string, f *queryparser.FuncCall, vals []interface{}) arrow.Field {
+	counts := strings.EqualFold(f.Name, "COUNT") || strings.EqualFold(f.Name, "APPROX_COUNT_DISTINCT")
+	return arrow.Field{Name: name, Type: inferType(vals), Nullable: !counts}
+}
 
-	schema := arrow.NewSchema(fields, nil)
-	return array.NewRecord(schema, arrays, 1), nil
+// projectionName is the name of the column the i-th projection makes when it
+// is neither a column nor an aggregate: the field a struct field access reads,
+// or expr_i.
+func projectionName(expr queryparser.Expression, i int) string {
+	if f, ok := expr.(*queryparser.FieldExpr); ok {
+		return f.Field
+	}
+	return fmt.Sprintf("expr_%d", i)
 }
 
-func executeGroupedQuery(q *queryparser.Query, table array.Record, indices []int, pool memory.Allocator) (array.Record, error) {
-	groupMap := map[string][]int{} // key: groupKey.String(), value: row indices
+func executeGroupedQuery(q *queryparser.Query, table array.Record, indices []int, ec *execContext) (array.Record, error) {
+	coded := newCodedGroups(keyDictionaries(q.GroupBy, table, ec))
+	grouped, err := groupMorsels(ec.ctx, q.GroupBy, table, indices, coded, ec.options.workers())
+	if err != nil {
+		return nil, err
+	}
 
-	// Group rows
-	for _, row := range indices {
-		keyParts := []interface{}{}
-		for _, expr := range q.GroupBy {
-			val, err := evaluateExpression(expr, table, row)
+	// For each group, compute output row
+	groups := make([]int, 0, grouped.index.len())
+	for g, rows := range grouped.rows {
+		if q.Having != nil {
+			keep, err := evaluateGroupExpression(q.Having, table, rows)
 			if err != nil {
 				return nil, err
 			}
-			keyParts = append(keyParts, val)
+			boolResult, ok := keep.(bool)
+			if !ok && keep != nil {
+				return nil, fmt.Errorf("HAVING clause must evaluate to boolean")
+			}
+			if !boolResult {
+				continue // an unknown (NULL) condition filters the group out
+			}
 		}
-		gkey := groupKey{parts: keyParts}.String()
-		groupMap[gkey] = append(groupMap[gkey], row)
+		groups = append(groups, g)
 	}
 
-	// For each group, compute output row
-	groupKeys := make([]string, 0, len(groupMap))
-	for k := range groupMap {
-		groupKeys = append(groupKeys, k)
+	// Without ORDER BY the groups come in the order of their keys
+	keys := make([][]interface{}, len(groups))
+	for i, g := range groups {
+		keys[i] = grouped.index.keys[g]
+	}
+	groups = sortByKeys(groups, keys, sortOrders(make([]queryparser.OrderByItem, len(q.GroupBy)), false))
+
+	if len(q.OrderBy) > 0 {
+		sorted, err := sortGroups(q.OrderBy, table, groups, grouped.rows, ec.options.NullsFirst)
+		if err != nil {
+			return nil, err
+		}
+		groups = sorted
 	}
-	sort.Strings(groupKeys) // optional: deterministic output
 
 	resultCols := make([]array.Interface, len(q.Projections))
 	fieldTypes := make([]arrow.Field, len(q.Projections))
-
-	// Builders for each projected column
-	builders := make([]array.Builder, len(q.Projections))
 	defer func() {
-		for _, b := range builders {
-			if b != nil {
-				b.Release()
+		for _, arr := range resultCols {
+			if arr != nil {
+				arr.Release()
 			}
 		}
 	}()
 
 	for i, expr := range q.Projections {
+		// Column values come from each group's first row; aggregates are
+		// computed over the whole group. Groups are shared out one at a time
+		// as they may differ greatly in size.
+		vals := make([]interface{}, len(groups))
+		err := forEachMorsel(ec.ctx, len(groups), 1, ec.options.workers(), func(g, _, _ int) error {
+			val, err := evaluateGroupExpression(expr, table, grouped.rows[groups[g]])
+			vals[g] = val
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		var field arrow.Field
+		if f := structFieldRef(table.Schema(), expr); f != nil {
+			expr = f
+		}
 		switch e := expr.(type) {
 		case *queryparser.ColumnRef:
-			colIdx := findColumnIndex(table, e.Name)
-			if colIdx == -1 {
-				return nil, fmt.Errorf("column %s not found", e.Name)
-			}
-			colType := table.Column(colIdx).DataType()
-			switch colType.ID() {
-			case arrow.STRING:
-				builders[i] = array.NewStringBuilder(pool)
-			case arrow.FLOAT64:
-				builders[i] = array.NewFloat64Builder(pool)
-			default:
-				return nil, fmt.Errorf("unsupported data type in GROUP BY: %v", colType)
+			colIdx, err := resolveColumn(table, e)
+			if err != nil {
+				return nil, err
 			}
+			field = arrow.Field{Name: e.Name, Type: table.Column(colIdx).DataType()}
 		case *queryparser.FuncCall:
-			builders[i] = array.NewFloat64Builder(pool)
-		default:
-			return nil, fmt.Errorf("unsupported expression type in GROUP BY projections: %T", expr)
-		}
-	}
-
-	for _, gkey := range groupKeys {
-		rows := groupMap[gkey]
-
-		for i, expr := range q.Projections {
-			switch e := expr.(type) {
-			case *queryparser.ColumnRef:
-				// use first row's value as representative for group key
-				val, _ := evaluateExpression(e, table, rows[0])
-				colIdx := findColumnIndex(table, e.Name)
-				colType := table.Column(colIdx).DataType()
-				fieldTypes[i] = arrow.Field{Name: e.Name, Type: colType}
-				switch b := builders[i].(type) {
-				case *array.StringBuilder:
-					b.Append(val.(string))
-				case *array.Float64Builder:
-					b.Append(toFloat(val))
-				default:
-					return nil, fmt.Errorf("unsupported builder type")
-				}
-
-			case *queryparser.FuncCall:
-				val, err := evalAggregateFunction(e, table, rows)
-				if err != nil {
-					return nil, err
-				}
-				fieldTypes[i] = arrow.Field{Name: strings.ToUpper(e.Name), Type: arrow.PrimitiveTypes.Float64}
-				builders[i].(*array.Float64Builder).Append(val)
-			default:
-				return nil, fmt.Errorf("unsupported projection type in GROUP BY: %T", expr)
+			if planner.IsAggregate(e) {
+				field = aggregateField(strings.ToUpper(e.Name), e, vals)
+				break
 			}
+			field = arrow.Field{Name: fmt.Sprintf("expr_%d", i), Type: inferType(vals), Nullable: true}
+		case *aggregateColumn:
+			field = aggregateField(strings.ToUpper(e.call.Name), e.call, vals)
+		default:
+			field = arrow.Field{Name: projectionName(expr, i), Type: inferType(vals), Nullable: true}
 		}
-	}
 
-	for i := range builders {
-		arr := builders[i].NewArray()
-		defer arr.Release()
+		arr, err := buildArray(ec.pool, field.Type, vals)
+		if err != nil {
+			return nil, err
+		}
 		resultCols[i] = arr
+		fieldTypes[i] = field
 	}
 
 	schema := arrow.NewSchema(fieldTypes, nil)
-	return array.NewRecord(schema, resultCols, int64(len(groupKeys))), nil
+	return array.NewRecord(schema, resultCols, int64(len(groups))), nil
+}
+
+// evalAggregateFunction computes an aggregate over the given rows. COUNT(*)
+// counts every row and COUNT(expr) the rows where expr is not NULL, so both
+// return 0 for no rows. The others skip NULLs, except ARRAY_AGG, and return
+// NULL when no value is left. With DISTINCT each value is counted once.
+func evalAggregateFunction(f *queryparser.FuncCall, table array.Record, indices []int) (interface{}, error) {
+	name, arg, err := aggregateArg(f)
+	if err != nil {
+		return nil, err
+	}
+	state := newAggregateState(f)
+	for _, row := range indices {
+		if err := state.addRow(arg, table, row, rowPosition{row: row}); err != nil {
+			return nil, err
+		}
+	}
+	return state.result(name)
 }
 
-func evalAggregateFunction(f *queryparser.FuncCall, table array.Record, indices []int) (float64, error) {
+// aggregateArg validates an aggregate call, returning its upper-cased name and
+// argument, which is nil for COUNT(*). PERCENTILE_CONT and APPROX_QUANTILE
+// also take the fraction of the way from the smallest value to the largest, as
+// a constant, TOP_K how many values to give, as a constant, and STRING_AGG an
+// optional constant delimiter. ARG_MAX and ARG_MIN also take the key whose
+// largest or smallest value picks the row.
+func aggregateArg(f *queryparser.FuncCall) (string, queryparser.Expression, error) {
 	name := strings.ToUpper(f.Name)
 	switch name {
-	case "COUNT":
-		if len(f.Args) == 1 {
-			if _, ok := f.Args[0].(*queryparser.StarExpr); ok {
-				return float64(len(indices)), nil
-			}
-			count := 0
-			for _, row := range indices {
-				val, err := evaluateExpression(f.Args[0], table, row)
-				if err != nil {
-					return 0, err
-				}
-				if val != nil {
-					count++
-				}
-			}
-			return float64(count), nil
-		}
-	case "SUM", "AVG", "MAX", "MIN":
+	case "COUNT", "SUM", "AVG", "MAX", "MIN",
+		"VARIANCE", "VAR_SAMP", "VAR_POP", "STDDEV", "STDDEV_SAMP", "STDDEV_POP", "MEDIAN", "ARRAY_AGG",
+		"FIRST", "LAST", "ANY_VALUE", "APPROX_COUNT_DISTINCT", "MODE":
 		if len(f.Args) != 1 {
-			return 0, fmt.Errorf("%s expects one argument", name)
+			return "", nil, fmt.Errorf("%s expects one argument", name)
 		}
-		nums := []float64{}
-		for _, row := range indices {
-			val, err := evaluateExpression(f.Args[0], table, row)
-			if err != nil {
-				return 0, err
-			}
-			if val != nil {
-				nums = append(nums, toFloat(val))
-			}
+	case "ARG_MAX", "ARG_MIN":
+		if len(f.Args) != 2 {
+			return "", nil, fmt.Errorf("%s expects two arguments", name)
 		}
-		switch name {
-		case "SUM":
-			sum := 0.0
-			for _, v := range nums {
-				sum += v
-			}
-			return sum, nil
-		case "AVG":
-			if len(nums) == 0 {
-				return 0, nil
-			}
-			sum := 0.0
-			for _, v := range nums {
-				sum += v
-			}
-			return sum / float64(len(nums)), nil
-		case "MAX":
-			if len(nums) == 0 {
-				return 0, nil
-			}
-			max := nums[0]
-			for _, v := range nums[1:] {
-				if v > max {
-					max = v
-				}
-			}
-			return max, nil
-		case "MIN":
-			if len(nums) == 0 {
-				return 0, nil
-			}
-			min := nums[0]
-			for _, v := range nums[1:] {
-				if v < min {
-					min = v
-				}
-			}
-			return min, nil
+		if _, ok := f.Args[1].(*queryparser.StarExpr); ok {
+			return "", nil, fmt.Errorf("%s(*) is not supported", name)
 		}
-	}
-	return 0, fmt.Errorf("unsupported aggregate function: %s", f.Name)
-}
-
-func evaluateExpression(expr queryparser.Expression, table array.Record, row int) (interface{}, error) {
-	switch e := expr.(type) {
-	case *queryparser.ColumnRef:
-		colIdx := findColumnIndex(table, e.Name)
-		if colIdx == -1 {
-			return nil, fmt.Errorf("column %s not found", e.Name)
+	case "TOP_K":
+		if len(f.Args) != 2 {
+			return "", nil, fmt.Errorf("%s expects two arguments", name)
 		}
-		colArr := table.Column(colIdx)
-		switch arr := colArr.(type) {
-		case *array.Float64:
-			if arr.IsValid(row) {
-				return arr.Value(row), nil
-			}
-			return nil, nil
-		case *array.String:
-			if arr.IsValid(row) {
-				return arr.Value(row), nil
-			}
-			return nil, nil
-		default:
-			return nil, fmt.Errorf("unsupported column type: %T", arr)
+		if _, err := topKCount(f); err != nil {
+			return "", nil, err
 		}
-	case *queryparser.Literal:
-		if f, err := strconv.ParseFloat(e.Value, 64); err == nil {
-			return f, nil
+	case "STRING_AGG":
+		if len(f.Args) != 1 && len(f.Args) != 2 {
+			return "", nil, fmt.Errorf("%s expects one or two arguments", name)
 		}
-		return e.Value, nil
-	case *queryparser.BinaryExpr:
-		left, _ := evaluateExpression(e.Left, table, row)
-		right, _ := evaluateExpression(e.Right, table, row)
-		switch e.Op {
-		case "+":
-			return toFloat(left) + toFloat(right), nil
-		case "-":
-			return toFloat(left) - toFloat(right), nil
-		case "*":
-			return toFloat(left) * toFloat(right), nil
-		case "/":
-			return toFloat(left) / toFloat(right), nil
-		case ">":
-			return toFloat(left) > toFloat(right), nil
-		case "<":
-			return toFloat(left) < toFloat(right), nil
-		case "=":
-			return left == right, nil
-		case "AND":
-			return toBool(left) && toBool(right), nil
-		case "OR":
-			return toBool(left) || toBool(right), nil
-		default:
-			return nil, fmt.Errorf("unsupported operator: %s", e.Op)
+		if _, err := stringAggDelimiter(f); err != nil {
+			return "", nil, err
+		}
+	case "PERCENTILE_CONT", "APPROX_QUANTILE":
+		if len(f.Args) != 2 {
+			return "", nil, fmt.Errorf("%s expects two arguments", name)
+		}
+		if _, err := percentileFraction(f); err != nil {
+			return "", nil, err
 		}
-	case *queryparser.StarExpr:
-		return "*", nil
-	case *queryparser.FuncCall:
-		return nil, fmt.Errorf("nested function calls not supported in row-wise projection")
 	default:
-		return nil, fmt.Errorf("unsupported expression: %T", expr)
+		return "", nil, fmt.Errorf("unsupported aggregate function: %s", f.Name)
 	}
+	if _, ok := f.Args[0].(*queryparser.StarExpr); ok {
+		if name != "COUNT" {
+			return "", nil, fmt.Errorf("%s(*) is not supported", name)
+		}
+		if f.Distinct {
+			return "", nil, fmt.Errorf("COUNT(DISTINCT *) is not supported")
+		}
+		return name, nil, nil
+	}
+	return name, f.Args[0], nil
 }
 
-func findColumnIndex(table array.Record, name string) int {
-	for i, f := range table.Schema().Fields() {
-		if f.Name == name {
-			return i
-		}
+// percentileFraction reads the fraction PERCENTILE_CONT(x, fraction) and
+// APPROX_QUANTILE(x, fraction) take, which must be a number from 0 to 1.
+func percentileFraction(f *queryparser.FuncCall) (float64, error) {
+	lit, ok := f.Args[1].(*queryparser.Literal)
+	if !ok || lit.Kind != queryparser.LiteralNumber {
+		return 0, fmt.Errorf("%s fraction must be a constant number", f.Name)
 	}
-	return -1
+	p, err := strconv.ParseFloat(lit.Value, 64)
+	if err != nil || p < 0 || p > 1 {
+		return 0, fmt.Errorf("%s fraction must be between 0 and 1, got %s", f.Name, lit.Value)
+	}
+	return p, nil
 }
 
-func toFloat(v interface{}) float64 {
-	switch x := v.(type) {
-	case float64:
+// topKCount reads how many values TOP_K(x, k) gives, which must be a positive
+// integer.
+func topKCount(f *queryparser.FuncCall) (int, error) {
+	lit, ok := f.Args[1].(*queryparser.Literal)
+	if !ok || lit.Kind != queryparser.LiteralNumber {
+		return 0, fmt.Errorf("%s count must be a constant integer", f.Name)
+	}
+	k, err := strconv.Atoi(lit.Value)
+	if err != nil || k < 1 || k > maxTopK {
+		return 0, fmt.Errorf("%s count must be an integer from 1 to %d, got %s", f.Name, maxTopK, lit.Value)
+	}
+	return k, nil
+}
+
+// stringAggDelimiter reads the delimiter STRING_AGG(x, delimiter) puts between
+// values, a comma when it is left out.
+func stringAggDelimiter(f *queryparser.FuncCall) (string, error) {
+	if len(f.Args) < 2 {
+		return ",", nil
+	}
+	lit, ok := f.Args[1].(*queryparser.Literal)
+	if !ok || lit.Kind != queryparser.LiteralString {
+		return "", fmt.Errorf("%s delimiter must be a constant string", f.Name)
+	}
+	return lit.Value, nil
+}
+
+// aggregateState accumulates an aggregate one value at a time, so it can be
+// computed over rows that are not all held at once. While every value is a
+// decimal the sum, minimum and maximum are also kept exactly.
+type aggregateState struct {
+	count    int
+	sum      float64
+	min, max float64
+
+	inexact          bool // a value was not a decimal
+	dsum, dmin, dmax decimal
+
+	// SUM, MIN and MAX of integers are integers, exact unless the sum
+	// overflows
+	notInteger       bool // a value was not an integer
+	overflow         bool
+	isum, imin, imax int64
+
+	// MIN and MAX of values that are not numbers, such as strings, dates
+	// and timestamps, are the least and greatest of them in their order
+	notNumber  bool // a value was not a number
+	vmin, vmax interface{}
+
+	// mean and m2, the sum of squared differences from the mean, are
+	// updated with Welford's method for the variance
+	mean, m2 float64
+
+	// values holds every value for MEDIAN and PERCENTILE_CONT, which give
+	// the value fraction of the way through them in order
+	values   []float64
+	ordered  bool
+	fraction float64
+
+	// items holds every value for STRING_AGG, which joins them with
+	// delimiter, and ARRAY_AGG, which also keeps NULLs, by where their rows
+	// were in the input
+	items     []collectedValue
+	collect   bool
+	keepNulls bool
+	delimiter string
+
+	// pick is how FIRST, LAST, ANY_VALUE, ARG_MAX and ARG_MIN choose the
+	// one row whose value they give, comparing the key by, or the value
+	// itself when by is nil. The row picked so far is at pickAt
+	pick             picking
+	by               queryparser.Expression
+	picked           bool
+	pickVal, pickKey interface{}
+	pickAt           rowPosition
+
+	// distinct collects the values of a DISTINCT aggregate, which are only
+	// added to the rest of the state once the result is asked for
+	distinct *distinctSet
+
+	// APPROX_COUNT_DISTINCT counts values with hll and APPROX_QUANTILE
+	// keeps them in digest, in bounded memory however many there are
+	hll    *hyperLogLog
+	digest *tDigest
+
+	// MODE and TOP_K count the values given most often in frequent, and
+	// give the k of them given most often
+	frequent *spaceSaving
+	k        int
+}
+
+// collectedValue is a value of STRING_AGG or ARRAY_AGG and the position of
+// its row in the input.
+type collectedValue struct {
+	at  rowPosition
+	val interface{}
+}
+
+// picking is the rule an aggregate that gives the value of one row picks it
+// by.
+type picking int
+
+const (
+	pickNone picking = iota
+	pickFirst
+	pickLast
+	pickMax
+	pickMin
+)
+
+// newAggregateState returns the empty state of the aggregate call f.
+func newAggregateState(f *queryparser.FuncCall) aggregateState {
+	var s aggregateState
+	switch strings.ToUpper(f.Name) {
+	case "FIRST", "ANY_VALUE":
+		s.pick = pickFirst
+	case "LAST":
+		s.pick = pickLast
+	case "ARG_MAX":
+		s.pick, s.by = pickMax, f.Args[1]
+	case "ARG_MIN":
+		s.pick, s.by = pickMin, f.Args[1]
+	}
+	if strings.EqualFold(f.Name, "APPROX_COUNT_DISTINCT") {
+		s.hll = &hyperLogLog{}
+	}
+	// Picking one row is the same whether or not equal values are repeated,
+	// and a sketch of distinct values counts each once anyway
+	if f.Distinct && s.pick == pickNone && s.hll == nil {
+		s.distinct = newDistinctSet()
+	}
+	switch strings.ToUpper(f.Name) {
+	case "MEDIAN":
+		s.ordered, s.fraction = true, 0.5
+	case "PERCENTILE_CONT":
+		s.ordered = true
+		s.fraction, _ = percentileFraction(f)
+	case "APPROX_QUANTILE":
+		s.digest = &tDigest{}
+		s.fraction, _ = percentileFraction(f)
+	case "MODE":
+		s.frequent, s.k = newSpaceSaving(topKCapacity(1)), 1
+	case "TOP_K":
+		s.k, _ = topKCount(f)
+		s.frequent = newSpaceSaving(topKCapacity(s.k))
+	case "STRING_AGG":
+		s.collect = true
+		s.delimiter, _ = stringAggDelimiter(f)
+	case "ARRAY_AGG":
+		s.collect, s.keepNulls = true, !f.Distinct
+	}
+	return s
+}
+
+// addRow adds arg evaluated at row, or counts the row when arg is nil, as for
+// COUNT(*). at is where the row is in the whole input, which the aggregates
+// that depend on the order of the rows go by.
+func (s *aggregateState) addRow(arg queryparser.Expression, table array.Record, row int, at rowPosition) error {
+	if arg == nil {
+		s.count++
+		return nil
+	}
+	val, err := evaluateExpression(arg, table, row)
+	if err != nil {
+		return err
+	}
+	if s.pick != pickNone {
+		key := val
+		if s.by != nil {
+			if key, err = evaluateExpression(s.by, table, row); err != nil {
+				return err
+			}
+		}
+		if key != nil {
+			s.consider(val, key, at)
+		}
+		return nil
+	}
+	if val == nil {
+		if s.keepNulls {
+			s.items = append(s.items, collectedValue{at, nil})
+		}
+		return nil
+	}
+	switch {
+	case s.distinct != nil:
+		return s.distinct.add(val)
+	case s.hll != nil:
+		s.hll.add(val)
+		s.count++
+	case s.frequent != nil:
+		s.frequent.add(val)
+		s.count++
+	case s.collect:
+		s.items = append(s.items, collectedValue{at, val})
+	default:
+		s.addValue(val)
+	}
+	return nil
+}
+
+// consider picks the row at, with value val and non-NULL key, if it is a
+// better pick than the one made so far. Ties go to the earlier row.
+func (s *aggregateState) consider(val, key interface{}, at rowPosition) {
+	better := !s.picked
+	if s.picked {
+		switch s.pick {
+		case pickFirst:
+			better = at.before(s.pickAt)
+		case pickLast:
+			better = s.pickAt.before(at)
+		default:
+			c := compareValues(key, s.pickKey, false)
+			if s.pick == pickMin {
+				c = -c
+			}
+			better = c > 0 || (c == 0 && at.before(s.pickAt))
+		}
+	}
+	if better {
+		s.picked, s.pickVal, s.pickKey, s.pickAt = true, val, key, at
+	}
+}
+
+// addValue adds a non-NULL value.
+func (s *aggregateState) addValue(val interface{}) {
+	switch val.(type) {
+	case int64, float64, decimal:
+	default:
+		s.addOrdered(val)
+		return
+	}
+	s.addDecimal(val)
+	s.addInteger(val)
+	v := toFloat(val)
+	if s.count == 0 || v > s.max {
+		s.max = v
+	}
+	if s.count == 0 || v < s.min {
+		s.min = v
+	}
+	s.sum += v
+	s.count++
+	delta := v - s.mean
+	s.mean += delta / float64(s.count)
+	s.m2 += delta * (v - s.mean)
+	if s.ordered {
+		s.values = append(s.values, v)
+	}
+	if s.digest != nil {
+		s.digest.add(v)
+	}
+}
+
+// addOrdered adds a value that is not a number, which only MIN and MAX
+// take.
+func (s *aggregateState) addOrdered(val interface{}) {
+	if s.count == 0 || compareValues(val, s.vmin, false) < 0 {
+		s.vmin = val
+	}
+	if s.count == 0 || compareValues(val, s.vmax, false) > 0 {
+		s.vmax = val
+	}
+	s.notNumber = true
+	s.count++
+}
+
+// addDecimal adds val to the exact aggregates, before it is counted.
+func (s *aggregateState) addDecimal(val interface{}) {
+	d, ok := val.(decimal)
+	switch {
+	case s.inexact:
+	case !ok:
+		s.inexact = true
+	case s.count == 0:
+		s.dsum, s.dmin, s.dmax = d, d, d
+	default:
+		sum, _ := evalDecimalOp("+", s.dsum, d)
+		s.dsum = sum.(decimal)
+		if compareDecimals(d, s.dmin) < 0 {
+			s.dmin = d
+		}
+		if compareDecimals(d, s.dmax) > 0 {
+			s.dmax = d
+		}
+	}
+}
+
+// addInteger adds val to the integer aggregates, before it is counted.
+func (s *aggregateState) addInteger(val interface{}) {
+	n, ok := val.(int64)
+	switch {
+	case s.notInteger:
+	case !ok:
+		s.notInteger = true
+	case s.count == 0:
+		s.isum, s.imin, s.imax = n, n, n
+	default:
+		s.addIntegerSum(n)
+		s.imin, s.imax = min(s.imin, n), max(s.imax, n)
+	}
+}
+
+func (s *aggregateState) addIntegerSum(n int64) {
+	sum, err := evalIntegerOp("+", s.isum, n)
+	if err != nil {
+		s.overflow = true
+		return
+	}
+	s.isum = sum.(int64)
+}
+
+// result is the value of the aggregate called name over the values added.
+func (s *aggregateState) result(name string) (interface{}, error) {
+	if s.distinct != nil {
+		set := s.distinct
+		s.distinct = nil
+		var vals []interface{}
+		if err := set.each(func(val interface{}) error { vals = append(vals, val); return nil }); err != nil {
+			return nil, err
+		}
+		// The set has no order of its own, which STRING_AGG and
+		// ARRAY_AGG would show
+		sort.Slice(vals, func(i, j int) bool { return compareValues(vals[i], vals[j], false) < 0 })
+		for _, val := range vals {
+			if s.collect {
+				s.items = append(s.items, collectedValue{val: val})
+			} else if s.frequent != nil {
+				s.frequent.add(val)
+				s.count++
+			} else {
+				s.addValue(val)
+			}
+		}
+	}
+	if s.pick != pickNone {
+		return s.pickVal, nil
+	}
+	// Merged states' values were added in no particular order
+	sort.SliceStable(s.items, func(i, j int) bool { return s.items[i].at.before(s.items[j].at) })
+	switch name {
+	case "COUNT":
+		return int64(s.count), nil
+	case "APPROX_COUNT_DISTINCT":
+		return s.hll.estimate(), nil
+	case "MODE", "TOP_K":
+		top := s.frequent.top(s.k)
+		if len(top) == 0 {
+			return nil, nil
+		}
+		if name == "MODE" {
+			return top[0], nil
+		}
+		return list(top), nil
+	case "STRING_AGG":
+		return s.joinItems()
+	case "ARRAY_AGG":
+		if len(s.items) == 0 {
+			return nil, nil
+		}
+		l := make(list, len(s.items))
+		for i, item := range s.items {
+			l[i] = item.val
+		}
+		return l, nil
+	}
+	if s.count == 0 {
+		return nil, nil
+	}
+	if s.notNumber {
+		switch name {
+		case "MAX":
+			return s.vmax, nil
+		case "MIN":
+			return s.vmin, nil
+		}
+	}
+	if !s.notInteger {
+		switch name {
+		case "SUM":
+			if s.overflow {
+				return nil, fmt.Errorf("%w in SUM", errIntegerOverflow)
+			}
+			return s.isum, nil
+		case "MAX":
+			return s.imax, nil
+		case "MIN":
+			return s.imin, nil
+		}
+	}
+	if !s.inexact {
+		switch name {
+		case "SUM":
+			return s.dsum, nil
+		case "AVG":
+			return evalDecimalOp("/", s.dsum, decimalFromInt(int64(s.count)))
+		case "MAX":
+			return s.dmax, nil
+		case "MIN":
+			return s.dmin, nil
+		}
+	}
+	switch name {
+	case "SUM":
+		return s.sum, nil
+	case "AVG":
+		return s.sum / float64(s.count), nil
+	case "MAX":
+		return s.max, nil
+	case "MIN":
+		return s.min, nil
+	case "VAR_POP":
+		return s.m2 / float64(s.count), nil
+	case "STDDEV_POP":
+		return math.Sqrt(s.m2 / float64(s.count)), nil
+	case "VARIANCE", "VAR_SAMP", "STDDEV", "STDDEV_SAMP":
+		// The sample variance of a single value is undefined
+		if s.count < 2 {
+			return nil, nil
+		}
+		variance := s.m2 / float64(s.count-1)
+		if strings.HasPrefix(name, "STDDEV") {
+			return math.Sqrt(variance), nil
+		}
+		return variance, nil
+	case "APPROX_QUANTILE":
+		return s.digest.quantile(s.fraction), nil
+	default:
+		return s.percentile(), nil
+	}
+}
+
+// joinItems is the result of STRING_AGG: the values as strings, separated by
+// the delimiter.
+func (s *aggregateState) joinItems() (interface{}, error) {
+	if len(s.items) == 0 {
+		return nil, nil
+	}
+	parts := make([]string, len(s.items))
+	for i, item := range s.items {
+		str, err := castValue(item.val, arrow.BinaryTypes.String)
+		if err != nil {
+			return nil, err
+		}
+		parts[i] = str.(string)
+	}
+	return strings.Join(parts, s.delimiter), nil
+}
+
+// percentile interpolates between the two values closest to the fraction of
+// the way through the values in order.
+func (s *aggregateState) percentile() float64 {
+	sort.Float64s(s.values)
+	pos := s.fraction * float64(len(s.values)-1)
+	lo := int(math.Floor(pos))
+	hi := int(math.Ceil(pos))
+	return s.values[lo] + (pos-float64(lo))*(s.values[hi]-s.values[lo])
+}
+
+// merge adds the values added to o, as if they had been added to s. The
+// distinct values of o are moved to s.
+func (s *aggregateState) merge(o aggregateState) error {
+	if o.distinct != nil {
+		return s.distinct.merge(o.distinct)
+	}
+	if o.picked {
+		s.consider(o.pickVal, o.pickKey, o.pickAt)
+	}
+	s.items = append(s.items, o.items...)
+	if o.hll != nil {
+		s.hll.merge(o.hll)
+	}
+	if o.digest != nil {
+		s.digest.merge(o.digest)
+	}
+	if o.frequent != nil {
+		s.frequent.merge(o.frequent)
+	}
+	if o.count == 0 {
+		return nil
+	}
+	if o.notNumber {
+		if s.count == 0 || compareValues(o.vmin, s.vmin, false) < 0 {
+			s.vmin = o.vmin
+		}
+		if s.count == 0 || compareValues(o.vmax, s.vmax, false) > 0 {
+			s.vmax = o.vmax
+		}
+		s.notNumber = true
+	}
+	if s.count == 0 || o.max > s.max {
+		s.max = o.max
+	}
+	if s.count == 0 || o.min < s.min {
+		s.min = o.min
+	}
+	switch {
+	case s.inexact:
+	case o.inexact:
+		s.inexact = true
+	case s.count == 0:
+		s.dsum, s.dmin, s.dmax = o.dsum, o.dmin, o.dmax
+	default:
+		sum, _ := evalDecimalOp("+", s.dsum, o.dsum)
+		s.dsum = sum.(decimal)
+		if compareDecimals(o.dmin, s.dmin) < 0 {
+			s.dmin = o.dmin
+		}
+		if compareDecimals(o.dmax, s.dmax) > 0 {
+			s.dmax = o.dmax
+		}
+	}
+	switch {
+	case s.notInteger:
+	case o.notInteger:
+		s.notInteger = true
+	case s.count == 0:
+		s.isum, s.imin, s.imax, s.overflow = o.isum, o.imin, o.imax, o.overflow
+	default:
+		s.overflow = s.overflow || o.overflow
+		s.addIntegerSum(o.isum)
+		s.imin, s.imax = min(s.imin, o.imin), max(s.imax, o.imax)
+	}
+	// Chan et al.'s combination of the two means and sums of squares
+	n := float64(s.count + o.count)
+	delta := o.mean - s.mean
+	s.m2 += o.m2 + delta*delta*float64(s.count)*float64(o.count)/n
+	s.mean += delta * float64(o.count) / n
+	s.values = append(s.values, o.values...)
+	s.sum += o.sum
+	s.count += o.count
+	return nil
+}
+
+func evaluateExpression(expr queryparser.Expression, table array.Record, row int) (interface{}, error) {
+	switch e := expr.(type) {
+	case *queryparser.ColumnRef:
+		colIdx, err := resolveColumn(table, e)
+		if err != nil {
+			if f := structFieldRef(table.Schema(), e); f != nil {
+				return evaluateExpression(f, table, row)
+			}
+			return nil, err
+		}
+		return columnValue(table.Column(colIdx), row)
+	case *queryparser.FieldExpr:
+		val, err := evaluateExpression(e.Expr, table, row)
+		if err != nil {
+			return nil, err
+		}
+		return fieldValue(val, e)
+	case *queryparser.IndexExpr:
+		val, err := evaluateExpression(e.Expr, table, row)
+		if err != nil {
+			return nil, err
+		}
+		index, err := evaluateExpression(e.Index, table, row)
+		if err != nil {
+			return nil, err
+		}
+		return indexValue(val, index, e)
+	case *queryparser.Literal:
+		switch e.Kind {
+		case queryparser.LiteralString:
+			return e.Value, nil
+		case queryparser.LiteralDate:
+			return parseDate(e.Value)
+		case queryparser.LiteralTimestamp:
+			return parseTimestamp(e.Value)
+		case queryparser.LiteralInterval:
+			return parseInterval(e.Value)
+		case queryparser.LiteralBool:
+			return strings.EqualFold(e.Value, "TRUE"), nil
+		case queryparser.LiteralNull:
+			return nil, nil
+		}
+		// Integer literals stay exact; anything with a fraction or exponent is a float
+		if i, err := strconv.ParseInt(e.Value, 10, 64); err == nil {
+			return i, nil
+		}
+		if f, err := strconv.ParseFloat(e.Value, 64); err == nil {
+			return f, nil
+		}
+		return e.Value, nil
+	case *queryparser.BinaryExpr:
+		left, err := evaluateExpression(e.Left, table, row)
+		if err != nil {
+			return nil, err
+		}
+		right, err := evaluateExpression(e.Right, table, row)
+		if err != nil {
+			return nil, err
+		}
+		val, err := evalBinaryOp(e.Op, left, right)
+		return val, arithmeticError(err, e)
+	case *queryparser.UnaryExpr:
+		operand, err := evaluateExpression(e.Expr, table, row)
+		if err != nil {
+			return nil, err
+		}
+		val, err := evalUnaryOp(e.Op, operand)
+		return val, arithmeticError(err, e)
+	case *queryparser.InExpr:
+		if e.Subquery != nil {
+			return nil, fmt.Errorf("IN subquery was not planned")
+		}
+		return evalInList(e, table, row)
+	case *queryparser.LikeExpr:
+		return evalLike(e, table, row)
+	case *likeMatcher:
+		return e.evaluate(table, row)
+	case *semiJoinFilter:
+		return e.evaluate(table, row)
+	case *inSet:
+		return e.evaluate(table, row)
+	case *sharedExpr:
+		return e.evaluate(table, row)
+	case *constantValue:
+		return e.value, nil
+	case *windowColumn:
+		return e.values[row], nil
+	case *aggregateColumn:
+		return e.states[row].result(e.name)
+	case *queryparser.IsNullExpr:
+		val, err := evaluateExpression(e.Expr, table, row)
+		if err != nil {
+			return nil, err
+		}
+		return (val == nil) != e.Not, nil
+	case *queryparser.CastExpr:
+		dt, err := castType(e.Type)
+		if err != nil {
+			return nil, err
+		}
+		val, err := evaluateExpression(e.Expr, table, row)
+		if err != nil {
+			return nil, err
+		}
+		return castTo(val, e.Type, dt)
+	case *queryparser.StarExpr:
+		return "*", nil
+	case *queryparser.FuncCall:
+		if planner.IsAggregate(e) {
+			return nil, queryparser.ErrorAt(e.Pos, "aggregate function %s is not allowed here", e.Name)
+		}
+		if isCoalesce(e) {
+			return evalCoalesce(e, table, row)
+		}
+		if isIf(e) {
+			return evalIfAt(e, table, row)
+		}
+		args := make([]interface{}, len(e.Args))
+		for i, arg := range e.Args {
+			val, err := evaluateExpression(arg, table, row)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = val
+		}
+		return evalScalarFunction(e, args)
+	case *queryparser.Parameter:
+		return nil, unboundParameter(e)
+	default:
+		return nil, fmt.Errorf("unsupported expression: %T", expr)
+	}
+}
+
+// evalInList evaluates x [NOT] IN (v1, v2, ...) as x = v1 OR x = v2 ...: a
+// value x cannot be compared with is an error, as it is for =. When x is
+// NULL, or x matches nothing and the list holds a NULL, the result is unknown
+// and nil is returned.
+func evalInList(e *queryparser.InExpr, table array.Record, row int) (interface{}, error) {
+	needle, err := evaluateExpression(e.Expr, table, row)
+	if err != nil {
+		return nil, err
+	}
+	if needle == nil {
+		return nil, nil
+	}
+
+	found, sawNull := false, false
+	for _, v := range e.Values {
+		val, err := evaluateExpression(v, table, row)
+		if err != nil {
+			return nil, err
+		}
+		if val == nil {
+			sawNull = true
+			continue
+		}
+		if !comparableOperands(needle, val) {
+			return nil, arithmeticError(incomparable(needle, val), e)
+		}
+		found = found || compareOperands(needle, val) == 0
+	}
+	switch {
+	case found:
+		return !e.Not, nil
+	case sawNull:
+		return nil, nil
+	}
+	return e.Not, nil
+}
+
+// FormatValue returns the value of arr at row as text, as a cast to VARCHAR
+// writes it: lists as [1, 2] and structs as {price: 1.5, qty: 2}. A NULL is
+// NULL.
+func FormatValue(arr array.Interface, row int) (string, error) {
+	val, err := columnValue(arr, row)
+	if err != nil || val == nil {
+		return "NULL", err
+	}
+	text, err := castValue(val, arrow.BinaryTypes.String)
+	if err != nil {
+		return "", err
+	}
+	return text.(string), nil
+}
+
+// columnValue returns the value of arr at row, or nil when it is NULL.
+func columnValue(arr array.Interface, row int) (interface{}, error) {
+	switch a := arr.(type) {
+	case *array.Float64:
+		if a.IsValid(row) {
+			return a.Value(row), nil
+		}
+		return nil, nil
+	case *array.Int64:
+		if a.IsValid(row) {
+			return a.Value(row), nil
+		}
+		return nil, nil
+	case *array.String:
+		if a.IsValid(row) {
+			return a.Value(row), nil
+		}
+		return nil, nil
+	case *array.Boolean:
+		if a.IsValid(row) {
+			return a.Value(row), nil
+		}
+		return nil, nil
+	case *array.Date32:
+		if a.IsValid(row) {
+			return date(a.Value(row)), nil
+		}
+		return nil, nil
+	case *array.Timestamp:
+		if a.IsValid(row) {
+			return timestampValue(a.Value(row), a.DataType().(*arrow.TimestampType).Unit), nil
+		}
+		return nil, nil
+	case *array.Decimal128:
+		if a.IsValid(row) {
+			return decimalOf(a.Value(row), a.DataType().(*arrow.Decimal128Type).Scale), nil
+		}
+		return nil, nil
+	case *array.List:
+		if a.IsValid(row) {
+			return listValue(a, row)
+		}
+		return nil, nil
+	case *array.Struct:
+		if a.IsValid(row) {
+			return structValueAt(a, row)
+		}
+		return nil, nil
+	}
+	if arr.IsNull(row) {
+		return nil, nil
+	}
+	// Narrower numbers are widened to int64 and float64, which is what
+	// expressions compute with, and a Date64 becomes the day it falls on
+	switch a := arr.(type) {
+	case *array.Int8:
+		return int64(a.Value(row)), nil
+	case *array.Int16:
+		return int64(a.Value(row)), nil
+	case *array.Int32:
+		return int64(a.Value(row)), nil
+	case *array.Uint8:
+		return int64(a.Value(row)), nil
+	case *array.Uint16:
+		return int64(a.Value(row)), nil
+	case *array.Uint32:
+		return int64(a.Value(row)), nil
+	case *array.Uint64:
+		if v := a.Value(row); v <= math.MaxInt64 {
+			return int64(v), nil
+		}
+		return float64(a.Value(row)), nil
+	case *array.Float32:
+		return float64(a.Value(row)), nil
+	case *array.Date64:
+		return date(floorDiv(int64(a.Value(row)), millisPerDay)), nil
+	default:
+		return nil, fmt.Errorf("unsupported column type: %T", arr)
+	}
+}
+
+const millisPerDay = 24 * 60 * 60 * 1000
+
+// floorDiv divides a by b, rounding towards negative infinity.
+func floorDiv(a, b int64) int64 {
+	q := a / b
+	if a%b != 0 && (a < 0) != (b < 0) {
+		q--
+	}
+	return q
+}
+
+// inferType picks the column type for evaluated values from the first non-NULL
+// value, defaulting to Float64 when every value is NULL.
+func inferType(vals []interface{}) arrow.DataType {
+	for _, v := range vals {
+		switch v.(type) {
+		case string:
+			return arrow.BinaryTypes.String
+		case bool:
+			return arrow.FixedWidthTypes.Boolean
+		case int64, float64, decimal:
+			return numericColumnType(vals)
+		case list:
+			return listType(vals)
+		case structValue:
+			return structType(vals)
+		case date:
+			return arrow.FixedWidthTypes.Date32
+		case time.Time:
+			return arrow.FixedWidthTypes.Timestamp_us
+		case interval:
+			return arrow.BinaryTypes.String
+		}
+	}
+	return arrow.PrimitiveTypes.Float64
+}
+
+// numericColumnType is the column type for numbers, which may be of different
+// kinds when they come from different expressions, as COALESCE's do: integers
+// are stored exactly alongside decimals, and anything alongside a float is a
+// float.
+func numericColumnType(vals []interface{}) arrow.DataType {
+	var floats, decimals bool
+	for _, v := range vals {
+		switch v.(type) {
+		case float64:
+			floats = true
+		case decimal:
+			decimals = true
+		}
+	}
+	switch {
+	case floats:
+		return arrow.PrimitiveTypes.Float64
+	case decimals:
+		return decimalType(vals)
+	default:
+		return arrow.PrimitiveTypes.Int64
+	}
+}
+
+// buildArray builds an array of type dt from evaluated values.
+func buildArray(pool memory.Allocator, dt arrow.DataType, vals []interface{}) (array.Interface, error) {
+	switch dt.ID() {
+	case arrow.FLOAT64:
+		b := array.NewFloat64Builder(pool)
+		defer b.Release()
+		for _, v := range vals {
+			if v == nil {
+				b.AppendNull()
+			} else {
+				b.Append(toFloat(v))
+			}
+		}
+		return b.NewArray(), nil
+	case arrow.INT64:
+		b := array.NewInt64Builder(pool)
+		defer b.Release()
+		for _, v := range vals {
+			if v == nil {
+				b.AppendNull()
+			} else {
+				b.Append(toInt(v))
+			}
+		}
+		return b.NewArray(), nil
+	case arrow.INT8:
+		b := array.NewInt8Builder(pool)
+		defer b.Release()
+		return buildInts(b, vals, func(v int64) int8 { return int8(v) }), nil
+	case arrow.INT16:
+		b := array.NewInt16Builder(pool)
+		defer b.Release()
+		return buildInts(b, vals, func(v int64) int16 { return int16(v) }), nil
+	case arrow.INT32:
+		b := array.NewInt32Builder(pool)
+		defer b.Release()
+		return buildInts(b, vals, func(v int64) int32 { return int32(v) }), nil
+	case arrow.UINT8:
+		b := array.NewUint8Builder(pool)
+		defer b.Release()
+		return buildInts(b, vals, func(v int64) uint8 { return uint8(v) }), nil
+	case arrow.UINT16:
+		b := array.NewUint16Builder(pool)
+		defer b.Release()
+		return buildInts(b, vals, func(v int64) uint16 { return uint16(v) }), nil
+	case arrow.UINT32:
+		b := array.NewUint32Builder(pool)
+		defer b.Release()
+		return buildInts(b, vals, func(v int64) uint32 { return uint32(v) }), nil
+	case arrow.UINT64:
+		b := array.NewUint64Builder(pool)
+		defer b.Release()
+		for _, v := range vals {
+			switch x := v.(type) {
+			case nil:
+				b.AppendNull()
+			case float64:
+				// values past the range of int64 are read as float64
+				b.Append(uint64(x))
+			default:
+				b.Append(uint64(toInt(v)))
+			}
+		}
+		return b.NewArray(), nil
+	case arrow.FLOAT32:
+		b := array.NewFloat32Builder(pool)
+		defer b.Release()
+		for _, v := range vals {
+			if v == nil {
+				b.AppendNull()
+			} else {
+				b.Append(float32(toFloat(v)))
+			}
+		}
+		return b.NewArray(), nil
+	case arrow.LIST:
+		return buildList(pool, dt.(*arrow.ListType), vals)
+	case arrow.STRUCT:
+		return buildStruct(pool, dt.(*arrow.StructType), vals)
+	case arrow.DECIMAL128:
+		b := array.NewDecimal128Builder(pool, dt.(*arrow.Decimal128Type))
+		defer b.Release()
+		for _, v := range vals {
+			if v == nil {
+				b.AppendNull()
+				continue
+			}
+			d, err := castDecimal(v, dt.(*arrow.Decimal128Type))
+			if err != nil {
+				return nil, err
+			}
+			n, _ := d.(decimal).num(dt.(*arrow.Decimal128Type))
+			b.Append(n)
+		}
+		return b.NewArray(), nil
+	case arrow.DATE64:
+		b := array.NewDate64Builder(pool)
+		defer b.Release()
+		for _, v := range vals {
+			d, ok := v.(date)
+			if !ok {
+				b.AppendNull()
+			} else {
+				b.Append(arrow.Date64(int64(d) * millisPerDay))
+			}
+		}
+		return b.NewArray(), nil
+	case arrow.DATE32:
+		b := array.NewDate32Builder(pool)
+		defer b.Release()
+		for _, v := range vals {
+			d, ok := v.(date)
+			if !ok {
+				b.AppendNull()
+			} else {
+				b.Append(arrow.Date32(d))
+			}
+		}
+		return b.NewArray(), nil
+	case arrow.TIMESTAMP:
+		b := array.NewTimestampBuilder(pool, dt.(*arrow.TimestampType))
+		defer b.Release()
+		for _, v := range vals {
+			t, ok := v.(time.Time)
+			if !ok {
+				b.AppendNull()
+			} else {
+				b.Append(timestampOf(t, dt.(*arrow.TimestampType).Unit))
+			}
+		}
+		return b.NewArray(), nil
+	case arrow.STRING:
+		b := array.NewStringBuilder(pool)
+		defer b.Release()
+		for _, v := range vals {
+			if v == nil {
+				b.AppendNull()
+			} else {
+				b.Append(fmt.Sprintf("%v", v))
+			}
+		}
+		return b.NewArray(), nil
+	case arrow.BOOL:
+		b := array.NewBooleanBuilder(pool)
+		defer b.Release()
+		for _, v := range vals {
+			if v == nil {
+				b.AppendNull()
+			} else {
+				b.Append(toBool(v))
+			}
+		}
+		return b.NewArray(), nil
+	default:
+		return nil, fmt.Errorf("unsupported result type: %v", dt)
+	}
+}
+
+// intBuilder is an array builder for one of the integer types narrower than
+// int64.
+type intBuilder[T any] interface {
+	Append(T)
+	AppendNull()
+	NewArray() array.Interface
+}
+
+// buildInts appends evaluated integers to b, converted with conv, and returns
+// the array built.
+func buildInts[T any](b intBuilder[T], vals []interface{}, conv func(int64) T) array.Interface {
+	for _, v := range vals {
+		if v == nil {
+			b.AppendNull()
+		} else {
+			b.Append(conv(toInt(v)))
+		}
+	}
+	return b.NewArray()
+}
+
+// buildRecord builds a record from evaluated values, one slice per field.
+func buildRecord(pool memory.Allocator, fields []arrow.Field, cols [][]interface{}) (array.Record, error) {
+	arrs := make([]array.Interface, 0, len(fields))
+	defer func() {
+		for _, a := range arrs {
+			a.Release()
+		}
+	}()
+	rows := 0
+	for i, f := range fields {
+		arr, err := buildArray(pool, f.Type, cols[i])
+		if err != nil {
+			return nil, err
+		}
+		arrs = append(arrs, arr)
+		rows = len(cols[i])
+	}
+	return array.NewRecord(arrow.NewSchema(fields, nil), arrs, int64(rows)), nil
+}
+
+// evaluateGroupExpression evaluates expr once for a whole group of rows: aggregate
+// calls are computed over the group and plain columns take the first row's value.
+func evaluateGroupExpression(expr queryparser.Expression, table array.Record, rows []int) (interface{}, error) {
+	switch e := expr.(type) {
+	case *queryparser.FuncCall:
+		if planner.IsAggregate(e) {
+			for _, arg := range e.Args {
+				if hasAggregate(arg) {
+					return nil, fmt.Errorf("aggregate function calls cannot be nested")
+				}
+			}
+			return evalAggregateFunction(e, table, rows)
+		}
+		args := make([]interface{}, len(e.Args))
+		for i, arg := range e.Args {
+			val, err := evaluateGroupExpression(arg, table, rows)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = val
+		}
+		return evalScalarFunction(e, args)
+	case *queryparser.UnaryExpr:
+		operand, err := evaluateGroupExpression(e.Expr, table, rows)
+		if err != nil {
+			return nil, err
+		}
+		val, err := evalUnaryOp(e.Op, operand)
+		return val, arithmeticError(err, e)
+	case *queryparser.BinaryExpr:
+		left, err := evaluateGroupExpression(e.Left, table, rows)
+		if err != nil {
+			return nil, err
+		}
+		right, err := evaluateGroupExpression(e.Right, table, rows)
+		if err != nil {
+			return nil, err
+		}
+		val, err := evalBinaryOp(e.Op, left, right)
+		return val, arithmeticError(err, e)
+	case *queryparser.CastExpr:
+		dt, err := castType(e.Type)
+		if err != nil {
+			return nil, err
+		}
+		val, err := evaluateGroupExpression(e.Expr, table, rows)
+		if err != nil {
+			return nil, err
+		}
+		return castTo(val, e.Type, dt)
+	case *queryparser.IsNullExpr:
+		val, err := evaluateGroupExpression(e.Expr, table, rows)
+		if err != nil {
+			return nil, err
+		}
+		return (val == nil) != e.Not, nil
+	case *queryparser.FieldExpr:
+		val, err := evaluateGroupExpression(e.Expr, table, rows)
+		if err != nil {
+			return nil, err
+		}
+		return fieldValue(val, e)
+	case *queryparser.IndexExpr:
+		val, err := evaluateGroupExpression(e.Expr, table, rows)
+		if err != nil {
+			return nil, err
+		}
+		index, err := evaluateGroupExpression(e.Index, table, rows)
+		if err != nil {
+			return nil, err
+		}
+		return indexValue(val, index, e)
+	default:
+		if len(rows) == 0 {
+			return nil, nil
+		}
+		return evaluateExpression(expr, table, rows[0])
+	}
+}
+
+func evalUnaryOp(op string, operand interface{}) (interface{}, error) {
+	switch op {
+	case "NOT":
+		if operand == nil {
+			return nil, nil // NOT NULL is still unknown
+		}
+		return !toBool(operand), nil
+	case "-":
+		switch x := operand.(type) {
+		case nil:
+			return nil, nil
+		case int64:
+			if x == math.MinInt64 {
+				return nil, errIntegerOverflow
+			}
+			return -x, nil
+		case decimal:
+			return x.negate(), nil
+		case interval:
+			return interval{months: -x.months, days: -x.days, clock: -x.clock}, nil
+		default:
+			return -toFloat(x), nil
+		}
+	default:
+		return nil, fmt.Errorf("unsupported unary operator: %s", op)
+	}
+}
+
+func evalBinaryOp(op string, left, right interface{}) (interface{}, error) {
+	switch op {
+	case "+", "-":
+		if isTemporal(left) || isTemporal(right) {
+			if left == nil || right == nil {
+				return nil, nil
+			}
+			result, _, err := evalTemporalOp(op, left, right)
+			return result, err
+		}
+	}
+
+	switch op {
+	case "+", "-", "*", "/":
+		if left == nil || right == nil {
+			return nil, nil // arithmetic on NULL is NULL
+		}
+		if l, ok := left.(int64); ok {
+			if r, ok := right.(int64); ok {
+				return evalIntegerOp(op, l, r)
+			}
+		}
+		if isDecimalOperation(left, right) {
+			l, _ := toDecimal(left)
+			r, _ := toDecimal(right)
+			return evalDecimalOp(op, l, r)
+		}
+	}
+
+	switch op {
+	case "+":
+		return toFloat(left) + toFloat(right), nil
+	case "-":
+		return toFloat(left) - toFloat(right), nil
+	case "*":
+		return toFloat(left) * toFloat(right), nil
+	case "/":
+		if toFloat(right) == 0 {
+			return nil, errDivisionByZero
+		}
+		return toFloat(left) / toFloat(right), nil
+	case "=", "!=", "<>", ">", "<", ">=", "<=":
+		if left == nil || right == nil {
+			return nil, nil // comparing with NULL is unknown
+		}
+		if !comparableOperands(left, right) {
+			return nil, incomparable(left, right)
+		}
+		c := compareOperands(left, right)
+		switch op {
+		case "=":
+			return c == 0, nil
+		case "!=", "<>":
+			return c != 0, nil
+		case ">":
+			return c > 0, nil
+		case "<":
+			return c < 0, nil
+		case ">=":
+			return c >= 0, nil
+		default:
+			return c <= 0, nil
+		}
+	case "AND":
+		return truthOfValue(left).and(truthOfValue(right)).value(), nil
+	case "OR":
+		return truthOfValue(left).or(truthOfValue(right)).value(), nil
+	default:
+		return nil, fmt.Errorf("unsupported operator: %s", op)
+	}
+}
+
+// evalIntegerOp applies an arithmetic operator to two integers; division
+// truncates as in SQL. A result outside the range of int64 is an error rather
+// than wrapping around.
+func evalIntegerOp(op string, left, right int64) (interface{}, error) {
+	switch op {
+	case "+":
+		sum := left + right
+		if (sum > left) != (right > 0) {
+			return nil, errIntegerOverflow
+		}
+		return sum, nil
+	case "-":
+		diff := left - right
+		if (diff < left) != (right > 0) {
+			return nil, errIntegerOverflow
+		}
+		return diff, nil
+	case "*":
+		product := left * right
+		if left != 0 && (product/left != right || (left == -1 && right == math.MinInt64)) {
+			return nil, errIntegerOverflow
+		}
+		return product, nil
+	default:
+		if right == 0 {
+			return nil, errDivisionByZero
+		}
+		if left == math.MinInt64 && right == -1 {
+			return nil, errIntegerOverflow
+		}
+		return left / right, nil
+	}
+}
+
+// compareOperands orders two non-NULL comparison operands: dates and timestamps
+// compare chronologically (parsing a string on the other side), strings
+// lexicographically, booleans with false before true, numbers numerically,
+// and lists and structs element by element. Operands that comparableOperands
+// rejects, which only a sort of mixed values meets, order by their kind.
+func compareOperands(left, right interface{}) int {
+	if c, ok := compareTemporal(left, right); ok {
+		return c
+	}
+	switch l := left.(type) {
+	case string:
+		if r, ok := right.(string); ok {
+			return strings.Compare(l, r)
+		}
+	case bool:
+		if r, ok := right.(bool); ok {
+			return compareInts(boolInt(l), boolInt(r))
+		}
+	case int64:
+		if r, ok := right.(int64); ok {
+			return compareInts(l, r)
+		}
+	case interval:
+		if r, ok := right.(interval); ok {
+			if c := compareInts(int64(l.months), int64(r.months)); c != 0 {
+				return c
+			}
+			if c := compareInts(int64(l.days), int64(r.days)); c != 0 {
+				return c
+			}
+			return compareInts(int64(l.clock), int64(r.clock))
+		}
+	case list:
+		if r, ok := right.(list); ok {
+			for i := 0; i < len(l) && i < len(r); i++ {
+				if c := compareValues(l[i], r[i], false); c != 0 {
+					return c
+				}
+			}
+			return compareInts(int64(len(l)), int64(len(r)))
+		}
+	case structValue:
+		if r, ok := right.(structValue); ok {
+			for i := 0; i < len(l.values) && i < len(r.values); i++ {
+				if c := compareValues(l.values[i], r.values[i], false); c != 0 {
+					return c
+				}
+			}
+			return compareInts(int64(len(l.values)), int64(len(r.values)))
+		}
+	}
+	if !isNumber(left) || !isNumber(right) {
+		return compareInts(int64(valueKind(left)), int64(valueKind(right)))
+	}
+	if isDecimalOperation(left, right) {
+		l, _ := toDecimal(left)
+		r, _ := toDecimal(right)
+		return compareDecimals(l, r)
+	}
+	return compareFloats(toFloat(left), toFloat(right))
+}
+
+// valueKind is the family of values v belongs to for comparison: values of
+// different kinds do not compare, other than a date or timestamp with a
+// string that reads as one.
+func valueKind(v interface{}) int {
+	switch v.(type) {
+	case int64, float64, decimal:
+		return 0
+	case string:
+		return 1
+	case bool:
+		return 2
+	case date, time.Time:
+		return 3
+	case interval:
+		return 4
+	case list:
+		return 5
+	case structValue:
+		return 6
+	default:
+		return 7
+	}
+}
+
+// comparableOperands reports whether two non-NULL values may be compared: a
+// number is never equal to a string or a boolean, however it reads. Lists
+// and structs compare when their elements and fields do.
+func comparableOperands(left, right interface{}) bool {
+	if _, ok := compareTemporal(left, right); ok {
+		return true
+	}
+	if valueKind(left) != valueKind(right) || valueKind(left) == valueKind(nil) {
+		return false
+	}
+	switch l := left.(type) {
+	case list:
+		r := right.(list)
+		for i := 0; i < len(l) && i < len(r); i++ {
+			if l[i] != nil && r[i] != nil && !comparableOperands(l[i], r[i]) {
+				return false
+			}
+		}
+	case structValue:
+		r := right.(structValue)
+		if len(l.names) != len(r.names) {
+			return false
+		}
+		for i := range l.names {
+			if !strings.EqualFold(l.names[i], r.names[i]) ||
+				(l.values[i] != nil && r.values[i] != nil && !comparableOperands(l.values[i], r.values[i])) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// incomparable is the error for comparing values comparableOperands rejects.
+func incomparable(left, right interface{}) error {
+	return fmt.Errorf("cannot compare %s with %s", valueTypeName(left), valueTypeName(right))
+}
+
+// valueTypeName is the SQL name of the type of v, for errors.
+func valueTypeName(v interface{}) string {
+	if _, ok := v.(interval); ok {
+		return "INTERVAL"
+	}
+	return typeName(inferType([]interface{}{v}))
+}
+
+// takeRows builds a new array holding the values of arr at the given row indices.
+// A negative index appends a NULL.
+func takeRows(pool memory.Allocator, arr array.Interface, rows []int) (array.Interface, error) {
+	switch a := arr.(type) {
+	case *array.Float64:
+		b := array.NewFloat64Builder(pool)
+		defer b.Release()
+		for _, row := range rows {
+			if row >= 0 && a.IsValid(row) {
+				b.Append(a.Value(row))
+			} else {
+				b.AppendNull()
+			}
+		}
+		return b.NewArray(), nil
+	case *array.String:
+		b := array.NewStringBuilder(pool)
+		defer b.Release()
+		for _, row := range rows {
+			if row >= 0 && a.IsValid(row) {
+				b.Append(a.Value(row))
+			} else {
+				b.AppendNull()
+			}
+		}
+		return b.NewArray(), nil
+	default:
+		vals := make([]interface{}, len(rows))
+		for i, row := range rows {
+			if row < 0 {
+				continue
+			}
+			val, err := columnValue(arr, row)
+			if err != nil {
+				return nil, err
+			}
+			vals[i] = val
+		}
+		return buildArray(pool, arr.DataType(), vals)
+	}
+}
+
+// takeRecordRows builds a record holding the given rows of rec.
+func takeRecordRows(rec array.Record, rows []int, pool memory.Allocator) (array.Record, error) {
+	cols := make([]array.Interface, 0, rec.NumCols())
+	defer func() {
+		for _, c := range cols {
+			c.Release()
+		}
+	}()
+
+	for i := 0; i < int(rec.NumCols()); i++ {
+		arr, err := takeRows(pool, rec.Column(i), rows)
+		if err != nil {
+			return nil, err
+		}
+		cols = append(cols, arr)
+	}
+	return array.NewRecord(rec.Schema(), cols, int64(len(rows))), nil
+}
+
+// tableQualifierKey is the field metadata key holding the table name or alias
+// a column was scanned from, used to resolve qualified column references.
+const tableQualifierKey = "tinylake.table"
+
+// resolveColumn finds the column a reference points at. Unqualified names must
+// match exactly one column; qualified names must also match the column's table.
+// Quoted names match case-sensitively. Unquoted names prefer an exact match and
+// otherwise match regardless of case.
+func resolveColumn(table array.Record, ref *queryparser.ColumnRef) (int, error) {
+	return resolveField(table.Schema(), ref)
+}
+
+// resolveField finds the field of schema a reference points at, as
+// resolveColumn does for a table's columns.
+func resolveField(schema *arrow.Schema, ref *queryparser.ColumnRef) (int, error) {
+	found, err := findField(schema, ref)
+	if err != nil {
+		return -1, queryparser.ErrorAt(ref.Pos, "%v", err)
+	}
+	if found == -1 {
+		if ref.Table != "" {
+			return -1, queryparser.ErrorAt(ref.Pos, "column %s.%s not found", ref.Table, ref.Name)
+		}
+		return -1, queryparser.ErrorAt(ref.Pos, "column %s not found", ref.Name)
+	}
+	return found, nil
+}
+
+// findField finds the field of schema a reference points at, returning -1
+// when there is none and an error when the reference is ambiguous.
+func findField(schema *arrow.Schema, ref *queryparser.ColumnRef) (int, error) {
+	found, err := matchColumn(schema, ref, func(a, b string) bool { return a == b })
+	if found == -1 && err == nil && !ref.Quoted {
+		found, err = matchColumn(schema, ref, strings.EqualFold)
+	}
+	return found, err
+}
+
+func matchColumn(schema *arrow.Schema, ref *queryparser.ColumnRef, equal func(a, b string) bool) (int, error) {
+	found := -1
+	for i, f := range schema.Fields() {
+		if !equal(f.Name, ref.Name) {
+			continue
+		}
+		if ref.Table != "" && !strings.EqualFold(columnQualifier(f), ref.Table) {
+			continue
+		}
+		if found != -1 {
+			return -1, fmt.Errorf("column reference %s is ambiguous", ref.Name)
+		}
+		found = i
+	}
+	return found, nil
+}
+
+func columnQualifier(f arrow.Field) string {
+	if idx := f.Metadata.FindKey(tableQualifierKey); idx != -1 {
+		return f.Metadata.Values()[idx]
+	}
+	return ""
+}
+
+// qualifyRecord returns a record whose fields are tagged as belonging to the
+// given table name or alias. The column arrays are shared, not copied.
+func qualifyRecord(rec array.Record, qualifier string) array.Record {
+	return array.NewRecord(arrow.NewSchema(qualifyFields(rec.Schema().Fields(), qualifier), nil), rec.Columns(), rec.NumRows())
+}
+
+// qualifyFields tags fields with the table name or alias they are read from.
+func qualifyFields(fields []arrow.Field, qualifier string) []arrow.Field {
+	out := make([]arrow.Field, len(fields))
+	for i, f := range fields {
+		out[i] = arrow.Field{
+			Name:     f.Name,
+			Type:     f.Type,
+			Nullable: f.Nullable,
+			Metadata: arrow.NewMetadata([]string{tableQualifierKey}, []string{qualifier}),
+		}
+	}
+	return out
+}
+
+func toFloat(v interface{}) float64 {
+	switch x := v.(type) {
+	case float64:
 		return x
+	case int64:
+		return float64(x)
+	case decimal:
+		return x.float()
 	case string:
 		f, _ := strconv.ParseFloat(x, 64)
 		return f
@@ -409,9 +2309,38 @@ func toBool(v interface{}) bool {
 		return x
 	case float64:
 		return x != 0
+	case int64:
+		return x != 0
+	case decimal:
+		return x.unscaled.Sign() != 0
 	case string:
 		return x != ""
 	default:
 		return false
 	}
 }
+
+func toInt(v interface{}) int64 {
+	switch x := v.(type) {
+	case int64:
+		return x
+	case float64:
+		return int64(x)
+	case decimal:
+		return x.rescale(0).unscaled.Int64()
+	case string:
+		i, _ := strconv.ParseInt(x, 10, 64)
+		return i
+	default:
+		return 0
+	}
+}
+
+func isNumber(v interface{}) bool {
+	switch v.(type) {
+	case int64, float64, decimal:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,4414 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/decimal128"
+	"github.com/apache/arrow/go/arrow/memory"
+
+	"github.com/kris-gaudel/tinylake/internal/arrowengine"
+	"github.com/kris-gaudel/tinylake/internal/engine/join"
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// newPricesRecord builds a small in-memory table shaped like data/sample.csv.
+func newPricesRecord(t *testing.T) array.Record {
+	t.Helper()
+	pool := memory.NewGoAllocator()
+
+	schema := arrow.NewSchema([]arrow.Field{
+		{Name: "Date", Type: arrow.BinaryTypes.String, Nullable: true},
+		{Name: "Close", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
+		{Name: "Volume", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
+	}, nil)
+
+	b := array.NewRecordBuilder(pool, schema)
+	defer b.Release()
+
+	b.Field(0).(*array.StringBuilder).AppendValues([]string{"2020-12-01", "2020-12-02", "2020-12-01", "2020-12-03", "2020-12-02"}, nil)
+	b.Field(1).(*array.Float64Builder).AppendValues([]float64{900, 20, 300, 4000, 50}, nil)
+	b.Field(2).(*array.Float64Builder).AppendValues([]float64{10, 20, 30, 40, 50}, nil)
+
+	rec := b.NewRecord()
+	t.Cleanup(rec.Release)
+	return rec
+}
+
+func mustParse(t *testing.T, sql string) *queryparser.Query {
+	t.Helper()
+	query, err := queryparser.NewParser(sql).Parse()
+	if err != nil {
+		t.Fatalf("parse %q failed: %v", sql, err)
+	}
+	return query
+}
+
+func runQuery(t *testing.T, table array.Record, sql string) array.Record {
+	t.Helper()
+	query := mustParse(t, sql)
+	result, err := ExecuteQuery(query, table)
+	if err != nil {
+		t.Fatalf("query %q failed: %v", sql, err)
+	}
+	t.Cleanup(result.Release)
+	return result
+}
+
+func float64Column(t *testing.T, rec array.Record, col int) []float64 {
+	t.Helper()
+	arr, ok := rec.Column(col).(*array.Float64)
+	if !ok {
+		t.Fatalf("expected column %d to be Float64, got %T", col, rec.Column(col))
+	}
+	return arr.Float64Values()
+}
+
+func int64Column(t *testing.T, rec array.Record, col int) []int64 {
+	t.Helper()
+	arr, ok := rec.Column(col).(*array.Int64)
+	if !ok {
+		t.Fatalf("expected column %d to be Int64, got %T", col, rec.Column(col))
+	}
+	return arr.Int64Values()
+}
+
+func stringColumn(t *testing.T, rec array.Record, col int) []string {
+	t.Helper()
+	arr, ok := rec.Column(col).(*array.String)
+	if !ok {
+		t.Fatalf("expected column %d to be String, got %T", col, rec.Column(col))
+	}
+	out := make([]string, arr.Len())
+	for i := range out {
+		out[i] = arr.Value(i)
+	}
+	return out
+}
+
+func TestOrderByNumericColumn(t *testing.T) {
+	table := newPricesRecord(t)
+	result := runQuery(t, table, "SELECT Date, Close FROM prices WHERE Close > 30 ORDER BY Close")
+
+	got := float64Column(t, result, 1)
+	want := []float64{50, 300, 900, 4000}
+	if len(got) != len(want) {
+		t.Fatalf("expected %d rows, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("row %d: expected Close %v, got %v", i, want[i], got[i])
+		}
+	}
+
+	dates := stringColumn(t, result, 0)
+	if dates[0] != "2020-12-02" || dates[3] != "2020-12-03" {
+		t.Errorf("Date column not reordered with Close: %v", dates)
+	}
+}
+
+func TestOrderByGroupedAggregate(t *testing.T) {
+	table := newPricesRecord(t)
+	result := runQuery(t, table, "SELECT Date, SUM(Close) FROM prices GROUP BY Date ORDER BY SUM(Close)")
+
+	dates := stringColumn(t, result, 0)
+	want := []string{"2020-12-02", "2020-12-01", "2020-12-03"}
+	for i := range want {
+		if dates[i] != want[i] {
+			t.Errorf("row %d: expected %s, got %s", i, want[i], dates[i])
+		}
+	}
+}
+
+func TestOrderByAlias(t *testing.T) {
+	table := newPricesRecord(t)
+	for sql, want := range map[string]string{
+		"SELECT Date AS d, Close FROM prices ORDER BY d, Close":                                "[[2020-12-01 300] [2020-12-01 900] [2020-12-02 20] [2020-12-02 50] [2020-12-03 4000]]",
+		"SELECT Date AS d, SUM(Close) AS total FROM prices GROUP BY Date ORDER BY total DESC":  "[[2020-12-03 4000] [2020-12-01 1200] [2020-12-02 70]]",
+		"SELECT Close, ROW_NUMBER() OVER (ORDER BY Volume DESC) AS rn FROM prices ORDER BY rn": "[[50 1] [4000 2] [300 3] [20 4] [900 5]]",
+		// An alias names the sorted result rather than the input column
+		"SELECT -Close AS Close FROM prices ORDER BY Close": "[[-4000] [-900] [-300] [-50] [-20]]",
+	} {
+		rows, err := recordRows(runQuery(t, table, sql))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(rows); got != want {
+			t.Errorf("%s: got %s, want %s", sql, got, want)
+		}
+	}
+}
+
+func TestOrderByPosition(t *testing.T) {
+	table := newPricesRecord(t)
+	for sql, want := range map[string]string{
+		"SELECT Close FROM prices ORDER BY 1 DESC":                                "[[4000] [900] [300] [50] [20]]",
+		"SELECT Date, Close / 10 FROM prices ORDER BY 1, 2 DESC":                  "[[2020-12-01 90] [2020-12-01 30] [2020-12-02 5] [2020-12-02 2] [2020-12-03 400]]",
+		"SELECT Date, COUNT(*) FROM prices GROUP BY 1 ORDER BY 2, 1 DESC":         "[[2020-12-03 1] [2020-12-02 2] [2020-12-01 2]]",
+		"SELECT Close FROM prices UNION ALL SELECT Volume FROM prices ORDER BY 1": "[[10] [20] [20] [30] [40] [50] [50] [300] [900] [4000]]",
+	} {
+		rows, err := recordRows(runQuery(t, table, sql))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(rows); got != want {
+			t.Errorf("%s: got %s, want %s", sql, got, want)
+		}
+	}
+
+	for _, bad := range []string{
+		"SELECT Close FROM prices ORDER BY 2",
+		"SELECT Close FROM prices ORDER BY 0",
+		"SELECT Close FROM prices UNION SELECT Volume FROM prices ORDER BY 2",
+	} {
+		_, err := ExecuteQuery(mustParse(t, bad), table)
+		if err == nil || !strings.Contains(err.Error(), "is not in select list") {
+			t.Errorf("%s: expected a position error, got %v", bad, err)
+		}
+	}
+}
+
+func TestHavingFiltersGroups(t *testing.T) {
+	table := newPricesRecord(t)
+	result := runQuery(t, table, "SELECT Date, COUNT(*) FROM prices GROUP BY Date HAVING COUNT(*) > 1")
+
+	if result.NumRows() != 2 {
+		t.Fatalf("expected 2 groups, got %d", result.NumRows())
+	}
+	dates := stringColumn(t, result, 0)
+	if dates[0] != "2020-12-01" || dates[1] != "2020-12-02" {
+		t.Errorf("unexpected groups: %v", dates)
+	}
+
+	empty := runQuery(t, table, "SELECT Date, COUNT(*) FROM prices GROUP BY Date HAVING COUNT(*) > 5")
+	if empty.NumRows() != 0 {
+		t.Errorf("expected no groups, got %d", empty.NumRows())
+	}
+}
+
+// newSymbolsRecord builds a lookup table keyed by Date for join tests.
+func newSymbolsRecord(t *testing.T) array.Record {
+	t.Helper()
+	pool := memory.NewGoAllocator()
+
+	schema := arrow.NewSchema([]arrow.Field{
+		{Name: "Date", Type: arrow.BinaryTypes.String, Nullable: true},
+		{Name: "Label", Type: arrow.BinaryTypes.String, Nullable: true},
+	}, nil)
+
+	b := array.NewRecordBuilder(pool, schema)
+	defer b.Release()
+
+	b.Field(0).(*array.StringBuilder).AppendValues([]string{"2020-12-01", "2020-12-03", "2020-12-09"}, nil)
+	b.Field(1).(*array.StringBuilder).AppendValues([]string{"first", "third", "ninth"}, nil)
+
+	rec := b.NewRecord()
+	t.Cleanup(rec.Release)
+	return rec
+}
+
+func runQueryWithTables(t *testing.T, tables map[string]array.Record, sql string) array.Record {
+	t.Helper()
+	query := mustParse(t, sql)
+	result, err := ExecuteQueryWithTables(query, tables)
+	if err != nil {
+		t.Fatalf("query %q failed: %v", sql, err)
+	}
+	t.Cleanup(result.Release)
+	return result
+}
+
+func TestInnerJoin(t *testing.T) {
+	tables := map[string]array.Record{
+		"prices":  newPricesRecord(t),
+		"symbols": newSymbolsRecord(t),
+	}
+	result := runQueryWithTables(t, tables,
+		"SELECT p.Date, s.Label, Close FROM prices p JOIN symbols s ON p.Date = s.Date AND Close > 500 ORDER BY Close")
+
+	if result.NumRows() != 2 {
+		t.Fatalf("expected 2 joined rows, got %d", result.NumRows())
+	}
+	labels := stringColumn(t, result, 1)
+	if labels[0] != "first" || labels[1] != "third" {
+		t.Errorf("unexpected labels: %v", labels)
+	}
+
+	query := mustParse(t, "SELECT Date FROM prices JOIN symbols ON prices.Date = symbols.Date")
+	if _, err := ExecuteQueryWithTables(query, tables); err == nil {
+		t.Errorf("expected ambiguous column error for unqualified Date")
+	}
+}
+
+func TestOuterJoinsPadWithNulls(t *testing.T) {
+	tables := map[string]array.Record{
+		"prices":  newPricesRecord(t),
+		"symbols": newSymbolsRecord(t),
+	}
+
+	left := runQueryWithTables(t, tables, "SELECT p.Date, s.Label FROM prices p LEFT JOIN symbols s ON p.Date = s.Date")
+	if left.NumRows() != 5 {
+		t.Fatalf("LEFT JOIN: expected 5 rows, got %d", left.NumRows())
+	}
+	if !left.Schema().Field(1).Nullable {
+		t.Errorf("LEFT JOIN: expected right-side column to be nullable")
+	}
+	if left.Column(1).NullN() != 2 {
+		t.Errorf("LEFT JOIN: expected 2 padded rows, got %d", left.Column(1).NullN())
+	}
+
+	right := runQueryWithTables(t, tables, "SELECT p.Date, s.Label FROM prices p RIGHT JOIN symbols s ON p.Date = s.Date")
+	if right.NumRows() != 4 || right.Column(0).NullN() != 1 {
+		t.Errorf("RIGHT JOIN: expected 4 rows with 1 padded, got %d rows with %d NULLs", right.NumRows(), right.Column(0).NullN())
+	}
+
+	full := runQueryWithTables(t, tables, "SELECT p.Date, s.Label FROM prices p FULL OUTER JOIN symbols s ON p.Date = s.Date AND p.Close > 500")
+	// Matches: 12-01/900 and 12-03/4000. Unmatched: 3 price rows, 1 symbol row.
+	if full.NumRows() != 6 {
+		t.Errorf("FULL JOIN: expected 6 rows, got %d", full.NumRows())
+	}
+}
+
+func TestCrossJoin(t *testing.T) {
+	tables := map[string]array.Record{
+		"prices":  newPricesRecord(t),
+		"symbols": newSymbolsRecord(t),
+	}
+
+	result := runQueryWithTables(t, tables, "SELECT Close, Label FROM prices, symbols")
+	if result.NumRows() != 15 {
+		t.Errorf("expected 15 rows, got %d", result.NumRows())
+	}
+
+	filtered := runQueryWithTables(t, tables, "SELECT Close FROM prices p CROSS JOIN symbols s WHERE p.Date = s.Date")
+	if filtered.NumRows() != 3 {
+		t.Errorf("expected 3 rows, got %d", filtered.NumRows())
+	}
+
+	catalog := NewMemoryCatalog()
+	defer catalog.Release()
+	for name, rec := range tables {
+		catalog.Register(name, rec)
+	}
+	session := NewSession(catalog)
+	mustExecuteScript(t, session, "SET cross_join_limit = 10")
+	query := mustParse(t, "SELECT Close FROM prices, symbols")
+	if _, err := session.Execute(query); err == nil || !strings.Contains(err.Error(), "exceeding the limit of 10") {
+		t.Errorf("expected CROSS JOIN over the row limit to fail, got %v", err)
+	}
+	for _, limit := range []string{"none", "0"} {
+		mustExecuteScript(t, session, "SET cross_join_limit = "+limit)
+		result, err := session.Execute(query)
+		if err != nil {
+			t.Fatalf("cross_join_limit = %s: %v", limit, err)
+		}
+		if result.NumRows() != 15 {
+			t.Errorf("cross_join_limit = %s: expected 15 rows, got %d", limit, result.NumRows())
+		}
+		result.Release()
+	}
+	if got := session.Options().CrossJoinLimit; got != 0 {
+		t.Errorf("expected the default limit, got %d", got)
+	}
+	if err := (&Options{}).Set("cross_join_limit", "lots"); err == nil {
+		t.Errorf("expected an invalid cross_join_limit to fail")
+	}
+}
+
+func TestDerivedTable(t *testing.T) {
+	table := newPricesRecord(t)
+	result := runQuery(t, table, "SELECT x FROM (SELECT Close AS x FROM prices WHERE Close > 100) t WHERE t.x < 1000 ORDER BY x")
+
+	if result.Schema().Field(0).Name != "x" {
+		t.Errorf("expected column x, got %s", result.Schema().Field(0).Name)
+	}
+	got := float64Column(t, result, 0)
+	if len(got) != 2 || got[0] != 300 || got[1] != 900 {
+		t.Errorf("unexpected rows: %v", got)
+	}
+}
+
+func TestInAndExistsSubqueries(t *testing.T) {
+	tables := map[string]array.Record{
+		"prices":  newPricesRecord(t),
+		"symbols": newSymbolsRecord(t),
+	}
+
+	cases := []struct {
+		sql  string
+		want int64
+	}{
+		{"SELECT Close FROM prices WHERE Date IN (SELECT Date FROM symbols)", 3},
+		{"SELECT Close FROM prices WHERE Date NOT IN (SELECT Date FROM symbols)", 2},
+		{"SELECT Close FROM prices p WHERE EXISTS (SELECT Label FROM symbols s WHERE s.Date = p.Date)", 3},
+		{"SELECT Close FROM prices p WHERE NOT EXISTS (SELECT Label FROM symbols s WHERE s.Date = p.Date)", 2},
+		{"SELECT Close FROM prices WHERE EXISTS (SELECT Label FROM symbols WHERE Label = Label AND Date = Date)", 5},
+		{"SELECT Close FROM prices p WHERE Close > 500 AND EXISTS (SELECT Label FROM symbols s WHERE s.Date = p.Date)", 2},
+	}
+	for _, c := range cases {
+		result := runQueryWithTables(t, tables, c.sql)
+		if result.NumRows() != c.want {
+			t.Errorf("%s: expected %d rows, got %d", c.sql, c.want, result.NumRows())
+		}
+	}
+}
+
+func TestScalarSubquery(t *testing.T) {
+	table := newPricesRecord(t)
+	result := runQuery(t, table, "SELECT Close, (SELECT MAX(Close) FROM prices) AS max_close FROM prices WHERE Close > (SELECT AVG(Close) FROM prices)")
+
+	if result.NumRows() != 1 {
+		t.Fatalf("expected 1 row above the average, got %d", result.NumRows())
+	}
+	if result.Schema().Field(1).Name != "max_close" {
+		t.Errorf("expected max_close column, got %s", result.Schema().Field(1).Name)
+	}
+	if got := float64Column(t, result, 1); got[0] != 4000 {
+		t.Errorf("expected broadcast max of 4000, got %v", got[0])
+	}
+
+	query := mustParse(t, "SELECT (SELECT Close FROM prices) FROM prices")
+	if _, err := ExecuteQuery(query, table); err == nil {
+		t.Errorf("expected multi-row scalar subquery to fail")
+	}
+}
+
+func TestCommonTableExpressions(t *testing.T) {
+	table := newPricesRecord(t)
+	result := runQuery(t, table,
+		"WITH daily AS (SELECT Date, MAX(Close) AS high FROM prices GROUP BY Date), big AS (SELECT Date FROM daily WHERE high > 500) "+
+			"SELECT daily.Date, high FROM daily JOIN big ON daily.Date = big.Date ORDER BY high")
+
+	dates := stringColumn(t, result, 0)
+	if len(dates) != 2 || dates[0] != "2020-12-01" || dates[1] != "2020-12-03" {
+		t.Errorf("unexpected rows: %v", dates)
+	}
+
+	query := mustParse(t, "WITH a AS (SELECT Close FROM prices), a AS (SELECT Close FROM prices) SELECT Close FROM a")
+	if _, err := ExecuteQuery(query, table); err == nil {
+		t.Errorf("expected duplicate CTE names to fail")
+	}
+}
+
+func TestSetOperations(t *testing.T) {
+	tables := map[string]array.Record{
+		"prices":  newPricesRecord(t),
+		"symbols": newSymbolsRecord(t),
+	}
+
+	cases := []struct {
+		sql  string
+		want []string
+	}{
+		{"SELECT Date FROM prices UNION SELECT Date FROM symbols ORDER BY Date", []string{"2020-12-01", "2020-12-02", "2020-12-03", "2020-12-09"}},
+		{"SELECT Date FROM prices INTERSECT SELECT Date FROM symbols ORDER BY Date", []string{"2020-12-01", "2020-12-03"}},
+		{"SELECT Date FROM prices EXCEPT SELECT Date FROM symbols", []string{"2020-12-02"}},
+		{"SELECT Date FROM prices EXCEPT ALL SELECT Date FROM symbols ORDER BY Date", []string{"2020-12-01", "2020-12-02", "2020-12-02"}},
+	}
+	for _, c := range cases {
+		got := stringColumn(t, runQueryWithTables(t, tables, c.sql), 0)
+		if len(got) != len(c.want) {
+			t.Errorf("%s: expected %v, got %v", c.sql, c.want, got)
+			continue
+		}
+		for i := range c.want {
+			if got[i] != c.want[i] {
+				t.Errorf("%s: expected %v, got %v", c.sql, c.want, got)
+				break
+			}
+		}
+	}
+
+	all := runQueryWithTables(t, tables, "SELECT Date FROM prices UNION ALL SELECT Date FROM symbols")
+	if all.NumRows() != 8 {
+		t.Errorf("UNION ALL: expected 8 rows, got %d", all.NumRows())
+	}
+
+	query := mustParse(t, "SELECT Date FROM prices UNION SELECT Close FROM prices")
+	if _, err := ExecuteQueryWithTables(query, tables); err == nil {
+		t.Errorf("expected incompatible column types to fail")
+	}
+}
+
+func TestInList(t *testing.T) {
+	tables := map[string]array.Record{
+		"prices":  newPricesRecord(t),
+		"symbols": newSymbolsRecord(t),
+	}
+
+	in := runQueryWithTables(t, tables, "SELECT Close FROM prices WHERE Close IN (900, 50, 7) ORDER BY Close")
+	if got := float64Column(t, in, 0); len(got) != 2 || got[0] != 50 || got[1] != 900 {
+		t.Errorf("IN: unexpected rows %v", got)
+	}
+
+	notIn := runQueryWithTables(t, tables, "SELECT Close FROM prices WHERE Close NOT IN (900, 50)")
+	if notIn.NumRows() != 3 {
+		t.Errorf("NOT IN: expected 3 rows, got %d", notIn.NumRows())
+	}
+
+	// s.Label is NULL for unmatched rows, so NOT IN is unknown there and the row is dropped.
+	withNull := runQueryWithTables(t, tables, "SELECT p.Close FROM prices p LEFT JOIN symbols s ON p.Date = s.Date WHERE p.Close NOT IN (1, LENGTH(s.Label))")
+	if withNull.NumRows() != 3 {
+		t.Errorf("NOT IN with NULL: expected 3 rows, got %d", withNull.NumRows())
+	}
+
+	// Long lists of constants are hashed, with the same results
+	long := make([]string, 1000)
+	for i := range long {
+		long[i] = fmt.Sprint(i * 10)
+	}
+	list := strings.Join(long, ", ")
+	for sql, want := range map[string]string{
+		"SELECT Close FROM prices WHERE Close IN (" + list + ") ORDER BY Close":                                                                                                               "[[20] [50] [300] [900] [4000]]",
+		"SELECT Close FROM prices WHERE Close IN (" + list + ", 900.0) AND Close > 100.5 ORDER BY Close":                                                                                      "[[300] [900] [4000]]",
+		"SELECT Close FROM prices WHERE Close NOT IN (1, 2, 3, 4, 5, 6, 7, 8, 50, -900) ORDER BY Close":                                                                                       "[[20] [300] [900] [4000]]",
+		"SELECT Close FROM prices WHERE Close NOT IN (1, 2, 3, 4, 5, 6, 7, 8, 9, NULL)":                                                                                                       "[]",
+		"SELECT Close FROM prices WHERE Close IN (1, 2, 3, 4, 5, 6, 7, 8, 20, NULL)":                                                                                                          "[[20]]",
+		"SELECT x FROM (VALUES (DATE '2020-12-02'), (NULL)) v(x) WHERE x IN ('2020-12-01', '2020-12-02', '2020-12-03', '2020-12-04', '2020-12-05', '2020-12-06', '2020-12-07', '2020-12-08')": "[[2020-12-02]]",
+		"SELECT Date FROM prices WHERE Date IN (DATE '2020-12-02', 'a', 'b', 'c', 'd', 'e', 'f', 'g')":                                                                                        "[[2020-12-02] [2020-12-02]]",
+	} {
+		rows, err := recordRows(runQueryWithTables(t, tables, sql))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(rows); got != want {
+			t.Errorf("%.80s: got %s, want %s", sql, got, want)
+		}
+	}
+}
+
+func TestInListMatchesEquality(t *testing.T) {
+	table := newPricesRecord(t)
+	long := "1, 2, 3, 4, 5, 6, 7, 8"
+	// x IN (a, b) is x = a OR x = b, hashed or not
+	for in, or := range map[string]string{
+		"Close IN (20, 900.0)":                         "Close = 20 OR Close = 900.0",
+		"Close IN (" + long + ", 20, 900.0)":           "Close = 20 OR Close = 900.0",
+		"Close NOT IN (" + long + ", 20, NULL)":        "NOT (Close = 20 OR Close = NULL)",
+		"Date IN ('2020-12-02', DATE '2020-12-03')":    "Date = '2020-12-02' OR Date = DATE '2020-12-03'",
+		"Close IN (CAST(50 AS DECIMAL(4, 1)), 4000)":   "Close = CAST(50 AS DECIMAL(4, 1)) OR Close = 4000",
+		"Close > 100 IN (TRUE, NULL)":                  "Close > 100 = TRUE OR Close > 100 = NULL",
+		"Volume IN (" + long + ", CAST(20 AS BIGINT))": "Volume = CAST(20 AS BIGINT)",
+		"Date IN ('2020-12-01', 'a', 'b', 'c')":        "Date = '2020-12-01' OR Date = 'a'",
+		"Close IN ('20', 1)":                           "Close = '20' OR Close = 1",
+		"Close IN (" + long + ", '20')":                "Close = '20'",
+		"Date IN (1, '2020-12-01')":                    "Date = 1 OR Date = '2020-12-01'",
+		"Close > 100 IN (" + long + ", TRUE)":          "Close > 100 = 1 OR Close > 100 = TRUE",
+	} {
+		var results [2]string
+		for i, cond := range []string{in, or} {
+			rec, err := ExecuteQuery(mustParse(t, "SELECT Close FROM prices WHERE "+cond+" ORDER BY Close"), table)
+			if err != nil {
+				results[i] = "error"
+				continue
+			}
+			rows, err := recordRows(rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			results[i] = fmt.Sprint(rows)
+		}
+		if results[0] != results[1] {
+			t.Errorf("%s gives %s, but %s gives %s", in, results[0], or, results[1])
+		}
+	}
+
+	_, err := ExecuteQuery(mustParse(t, "SELECT Close FROM prices WHERE Close IN (20, '20')"), table)
+	if err == nil || !strings.Contains(err.Error(), "cannot compare DOUBLE with VARCHAR") {
+		t.Errorf("expected IN to fail as = does, got %v", err)
+	}
+}
+
+func TestBetween(t *testing.T) {
+	table := newPricesRecord(t)
+
+	between := runQuery(t, table, "SELECT Close FROM prices WHERE Close BETWEEN 50 AND 900 ORDER BY Close")
+	if got := float64Column(t, between, 0); len(got) != 3 || got[0] != 50 || got[2] != 900 {
+		t.Errorf("BETWEEN: unexpected rows %v", got)
+	}
+
+	notBetween := runQuery(t, table, "SELECT Close FROM prices WHERE Close NOT BETWEEN 50 AND 900 ORDER BY Close")
+	if got := float64Column(t, notBetween, 0); len(got) != 2 || got[0] != 20 || got[1] != 4000 {
+		t.Errorf("NOT BETWEEN: unexpected rows %v", got)
+	}
+}
+
+func TestUnaryNot(t *testing.T) {
+	table := newPricesRecord(t)
+
+	result := runQuery(t, table, "SELECT Close FROM prices WHERE NOT (Close > 100) ORDER BY Close")
+	if got := float64Column(t, result, 0); len(got) != 2 || got[0] != 20 || got[1] != 50 {
+		t.Errorf("NOT: unexpected rows %v", got)
+	}
+
+	nested := runQuery(t, table, "SELECT Close FROM prices WHERE NOT NOT Close > 100 AND NOT Close IN (900)")
+	if nested.NumRows() != 2 {
+		t.Errorf("nested NOT: expected 2 rows, got %d", nested.NumRows())
+	}
+}
+
+func TestStringLiteralFilter(t *testing.T) {
+	table := newPricesRecord(t)
+
+	result := runQuery(t, table, "SELECT Close FROM prices WHERE Date = '2020-12-01' ORDER BY Close")
+	if got := float64Column(t, result, 0); len(got) != 2 || got[0] != 300 || got[1] != 900 {
+		t.Errorf("unexpected rows %v", got)
+	}
+
+	in := runQuery(t, table, "SELECT Close FROM prices WHERE Date IN ('2020-12-02', '2020-12-03')")
+	if in.NumRows() != 3 {
+		t.Errorf("expected 3 rows, got %d", in.NumRows())
+	}
+}
+
+func TestComparisonOperators(t *testing.T) {
+	table := newPricesRecord(t)
+
+	cases := []struct {
+		where string
+		want  int64
+	}{
+		{"Close >= 300", 3},
+		{"Close <= 300", 3},
+		{"Close != 300", 4},
+		{"Close <> 300", 4},
+		{"Date >= '2020-12-02'", 3},
+		{"Date < '2020-12-02'", 2},
+		{"Date != '2020-12-01'", 3},
+	}
+	for _, c := range cases {
+		result := runQuery(t, table, "SELECT Close FROM prices WHERE "+c.where)
+		if result.NumRows() != c.want {
+			t.Errorf("WHERE %s: expected %d rows, got %d", c.where, c.want, result.NumRows())
+		}
+	}
+}
+
+func TestQuotedIdentifiers(t *testing.T) {
+	pool := memory.NewGoAllocator()
+	schema := arrow.NewSchema([]arrow.Field{
+		{Name: "Market Cap", Type: arrow.PrimitiveTypes.Float64},
+		{Name: "Close", Type: arrow.PrimitiveTypes.Float64},
+	}, nil)
+	b := array.NewRecordBuilder(pool, schema)
+	defer b.Release()
+	b.Field(0).(*array.Float64Builder).AppendValues([]float64{1e9, 2e9}, nil)
+	b.Field(1).(*array.Float64Builder).AppendValues([]float64{10, 20}, nil)
+	table := b.NewRecord()
+	defer table.Release()
+
+	result := runQuery(t, table, `SELECT "Market Cap" FROM prices WHERE "Market Cap" > 1500000000`)
+	if got := float64Column(t, result, 0); len(got) != 1 || got[0] != 2e9 {
+		t.Errorf("unexpected rows %v", got)
+	}
+
+	// Unquoted names resolve regardless of case; quoted names must match exactly.
+	runQuery(t, table, "SELECT close FROM prices")
+	query := mustParse(t, `SELECT "close" FROM prices`)
+	if _, err := ExecuteQuery(query, table); err == nil {
+		t.Errorf("expected quoted identifier to resolve case-sensitively")
+	}
+}
+
+func TestNumericLiterals(t *testing.T) {
+	table := newPricesRecord(t)
+
+	neg := runQuery(t, table, "SELECT Close FROM prices WHERE -Close < -1000 OR Close < 2e1 * 1.1")
+	if got := float64Column(t, neg, 0); len(got) != 2 || got[0] != 20 || got[1] != 4000 {
+		t.Errorf("unexpected rows %v", got)
+	}
+
+	result := runQuery(t, table, "SELECT 7 / 2, 7.0 / 2, -3 * 2 FROM prices WHERE Close = 20")
+	ints, ok := result.Column(0).(*array.Int64)
+	if !ok || ints.Value(0) != 3 {
+		t.Errorf("expected integer division to give int64 3, got %v", result.Column(0))
+	}
+	if got := float64Column(t, result, 1); got[0] != 3.5 {
+		t.Errorf("expected float division to give 3.5, got %v", got)
+	}
+	if ints, ok := result.Column(2).(*array.Int64); !ok || ints.Value(0) != -6 {
+		t.Errorf("expected -6, got %v", result.Column(2))
+	}
+
+	query := mustParse(t, "SELECT 1 / 0 FROM prices")
+	if _, err := ExecuteQuery(query, table); err == nil {
+		t.Errorf("expected integer division by zero to fail")
+	}
+}
+
+func TestWindowFunctions(t *testing.T) {
+	table := newPricesRecord(t)
+
+	result := runQuery(t, table, "SELECT Close, ROW_NUMBER() OVER (PARTITION BY Date ORDER BY Close), SUM(Close) OVER (ORDER BY Date), COUNT(*) OVER (PARTITION BY Date) FROM prices ORDER BY Close")
+
+	if got := float64Column(t, result, 0); len(got) != 5 || got[0] != 20 || got[4] != 4000 {
+		t.Fatalf("unexpected rows %v", got)
+	}
+	rowNumbers := result.Column(1).(*array.Int64).Int64Values()
+	if want := []int64{1, 2, 1, 2, 1}; fmt.Sprint(rowNumbers) != fmt.Sprint(want) {
+		t.Errorf("ROW_NUMBER: expected %v, got %v", want, rowNumbers)
+	}
+	// Running sums are per Date, with rows of the same Date sharing a value
+	if got, want := float64Column(t, result, 2), []float64{1270, 1270, 1200, 1200, 5270}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("running SUM: expected %v, got %v", want, got)
+	}
+	if got, want := int64Column(t, result, 3), []int64{2, 2, 2, 2, 1}; fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("COUNT: expected %v, got %v", want, got)
+	}
+
+	ranks := runQuery(t, table, "SELECT RANK() OVER (ORDER BY Date), DENSE_RANK() OVER (ORDER BY Date) FROM prices ORDER BY Date")
+	if got := ranks.Column(0).(*array.Int64).Int64Values(); fmt.Sprint(got) != "[1 1 3 3 5]" {
+		t.Errorf("RANK: unexpected %v", got)
+	}
+	if got := ranks.Column(1).(*array.Int64).Int64Values(); fmt.Sprint(got) != "[1 1 2 2 3]" {
+		t.Errorf("DENSE_RANK: unexpected %v", got)
+	}
+}
+
+func TestLike(t *testing.T) {
+	table := newPricesRecord(t)
+	for sql, want := range map[string]string{
+		"SELECT Close FROM prices WHERE Date LIKE '2020-12-0%' ORDER BY Close":                            "[[20] [50] [300] [900] [4000]]",
+		"SELECT Close FROM prices WHERE Date LIKE '%-01' ORDER BY Close":                                  "[[300] [900]]",
+		"SELECT Close FROM prices WHERE Date NOT LIKE '2020-12-02%' ORDER BY Close":                       "[[300] [900] [4000]]",
+		"SELECT Close FROM prices WHERE Date LIKE '2020-12-0_' ORDER BY Close":                            "[[20] [50] [300] [900] [4000]]",
+		"SELECT Close FROM prices WHERE Date LIKE '2020-12-03'":                                           "[[4000]]",
+		"SELECT Close FROM prices WHERE Date LIKE LOWER('%-0%3')":                                         "[[4000]]",
+		"SELECT x LIKE 'a\\%b', x LIKE '%', x NOT LIKE 'a_b' FROM (VALUES ('a%b'), ('axb'), (NULL)) v(x)": "[[true true false] [false true false] [<nil> <nil> <nil>]]",
+	} {
+		rows, err := recordRows(runQuery(t, table, sql))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(rows); got != want {
+			t.Errorf("%s: got %s, want %s", sql, got, want)
+		}
+	}
+
+	// Prefix patterns become ranges, and patterns without wildcards equalities
+	date := &queryparser.ColumnRef{Name: "Date"}
+	for pattern, want := range map[string]string{
+		"2021-%": "((Date >= '2021-') AND (Date < '2021.'))",
+		"%":      "(Date >= '')",
+		"a\\_b%": "((Date >= 'a_b') AND (Date < 'a_c'))",
+		"2021":   "(Date = '2021')",
+	} {
+		cond, err := planLike(date, &queryparser.Literal{Value: pattern, Kind: queryparser.LiteralString}, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := queryparser.FormatExpr(cond); got != want {
+			t.Errorf("%s: got %s, want %s", pattern, got, want)
+		}
+	}
+
+	for _, sql := range []string{
+		"SELECT Close FROM prices WHERE Close LIKE '1%'",
+		"SELECT Close FROM prices WHERE Date LIKE '2020\\'",
+	} {
+		if _, err := ExecuteQuery(mustParse(t, sql), table); err == nil {
+			t.Errorf("expected %q to fail", sql)
+		}
+	}
+}
+
+func TestSharedSubexpressions(t *testing.T) {
+	table := newPricesRecord(t)
+	for sql, want := range map[string]string{
+		"SELECT (Close + Volume) / 2 AS mid FROM prices WHERE (Close + Volume) / 2 > 100 ORDER BY (Close + Volume) / 2": "[[165] [455] [2020]]",
+		"SELECT ABS(Close - 1000), -ABS(Close - 1000) FROM prices WHERE ABS(Close - 1000) < 960 ORDER BY Close":         "[[950 -950] [700 -700] [100 -100]]",
+		"SELECT Volume * 2, Volume * 2 + 1 FROM prices WHERE Volume * 2 > Volume + 20 ORDER BY Volume":                  "[[60 61] [80 81] [100 101]]",
+	} {
+		rows, err := recordRows(runQuery(t, table, sql))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(rows); got != want {
+			t.Errorf("%s: got %s, want %s", sql, got, want)
+		}
+	}
+
+	// The projection and the filter read the same values
+	q := mustParse(t, "SELECT (Close + Volume) / 2, Close + 1 FROM prices WHERE (Close + Volume) / 2 > 100")
+	shareSubexpressions(q, int(table.NumRows()))
+	shared, ok := q.Projections[0].(*sharedExpr)
+	if !ok {
+		t.Fatalf("projection was not shared: %T", q.Projections[0])
+	}
+	if where := q.Where.(*queryparser.BinaryExpr); where.Left != shared {
+		t.Errorf("WHERE does not share the projection: %T", where.Left)
+	}
+	if _, ok := q.Projections[1].(*queryparser.BinaryExpr); !ok {
+		t.Errorf("an expression used once was shared: %T", q.Projections[1])
+	}
+
+	// Grouped queries evaluate their projections per group and are left alone
+	grouped := mustParse(t, "SELECT Date, SUM(Close + 1) FROM prices WHERE Close + 1 > 0 GROUP BY Date")
+	shareSubexpressions(grouped, int(table.NumRows()))
+	if _, ok := grouped.Where.(*queryparser.BinaryExpr).Left.(*sharedExpr); ok {
+		t.Error("a grouped query shared a subexpression")
+	}
+}
+
+func TestCast(t *testing.T) {
+	table := newPricesRecord(t)
+
+	result := runQuery(t, table, "SELECT CAST(Close AS BIGINT), Close::varchar, '12'::int + 1 FROM prices WHERE Close = 20")
+	if ints, ok := result.Column(0).(*array.Int64); !ok || ints.Value(0) != 20 {
+		t.Errorf("expected BIGINT 20, got %v", result.Column(0))
+	}
+	if got := stringColumn(t, result, 1); got[0] != "20" {
+		t.Errorf("expected '20', got %v", got)
+	}
+	if ints, ok := result.Column(2).(*array.Int64); !ok || ints.Value(0) != 13 {
+		t.Errorf("expected 13, got %v", result.Column(2))
+	}
+
+	filtered := runQuery(t, table, "SELECT Close FROM prices WHERE CAST(Date AS TEXT) = '2020-12-03'")
+	if filtered.NumRows() != 1 {
+		t.Errorf("expected 1 row, got %d", filtered.NumRows())
+	}
+
+	for _, sql := range []string{
+		"SELECT CAST(Date AS INT) FROM prices",
+		"SELECT CAST(Close AS BLOB) FROM prices",
+	} {
+		if _, err := ExecuteQuery(mustParse(t, sql), table); err == nil {
+			t.Errorf("expected %q to fail", sql)
+		}
+	}
+
+	bounds := runQuery(t, table, `SELECT CAST(127 AS TINYINT), CAST(-128 AS TINYINT), CAST(32767 AS SMALLINT),
+		CAST(-32768 AS INT2), CAST(2147483647 AS INT), CAST(-2147483648 AS INT4), CAST(2147483648 AS BIGINT)
+		FROM prices WHERE Close = 20`)
+	if rows, err := recordRows(bounds); err != nil || fmt.Sprint(rows) != "[[127 -128 32767 -32768 2147483647 -2147483648 2147483648]]" {
+		t.Errorf("unexpected integer bounds %v (%v)", rows, err)
+	}
+	for _, sql := range []string{
+		"SELECT CAST(128 AS TINYINT) FROM prices",
+		"SELECT CAST(-129 AS TINYINT) FROM prices",
+		"SELECT CAST(32768 AS SMALLINT) FROM prices",
+		"SELECT CAST(100000 AS SMALLINT) FROM prices",
+		"SELECT CAST('-32769' AS INT2) FROM prices",
+		"SELECT CAST(2147483648 AS INT) FROM prices",
+		"SELECT CAST(-2147483649.0 AS INTEGER) FROM prices",
+		"SELECT CAST(Volume * 100000000 AS INT4) FROM prices",
+		"SELECT CAST(SUM(Close) AS TINYINT) FROM prices",
+	} {
+		_, err := ExecuteQuery(mustParse(t, sql), table)
+		if err == nil || !strings.Contains(err.Error(), "out of range") {
+			t.Errorf("%s: expected an out of range error, got %v", sql, err)
+		}
+	}
+
+	// The narrower integer types are range-checked aliases of BIGINT: their
+	// columns are Int64, and fractions are truncated toward zero whether the
+	// value is a float or a decimal
+	fractions := runQuery(t, table, `SELECT CAST(1.5 AS INT), CAST(-1.5 AS SMALLINT), CAST(Close / 8 AS TINYINT),
+		CAST(-Close / 8 AS INTEGER), CAST(CAST(-2.75 AS DECIMAL(4, 2)) AS INT2), CAST(CAST(2.5 AS DECIMAL(2, 1)) AS BIGINT),
+		CAST(127.9 AS TINYINT), CAST(-0.5 AS INT)
+		FROM prices WHERE Close = 20`)
+	for i, f := range fractions.Schema().Fields() {
+		if f.Type.ID() != arrow.INT64 {
+			t.Errorf("column %d has type %v, want int64", i, f.Type)
+		}
+	}
+	if rows, err := recordRows(fractions); err != nil || fmt.Sprint(rows) != "[[1 -1 2 -2 -2 2 127 0]]" {
+		t.Errorf("unexpected truncated values %v (%v)", rows, err)
+	}
+	if _, err := ExecuteQuery(mustParse(t, "SELECT CAST(-128.9 AS TINYINT) FROM prices"), table); err != nil {
+		t.Errorf("expected -128.9 to truncate into TINYINT, got %v", err)
+	}
+}
+
+func TestTemporalLiterals(t *testing.T) {
+	table := newPricesRecord(t)
+
+	result := runQuery(t, table, "SELECT Close FROM prices WHERE Date >= DATE '2020-12-02' AND Date < (DATE '2020-11-30' + INTERVAL '3 days') ORDER BY Close")
+	if got := float64Column(t, result, 0); len(got) != 2 || got[0] != 20 || got[1] != 50 {
+		t.Errorf("unexpected rows %v", got)
+	}
+
+	dates := runQuery(t, table, "SELECT DATE '2020-12-31' + INTERVAL '1 month', CAST(TIMESTAMP '2020-12-01 10:00:00' - INTERVAL '1 day 2 hours' AS TEXT), DATE '2021-03-01' - DATE '2021-02-01' FROM prices WHERE Close = 20")
+	if d, ok := dates.Column(0).(*array.Date32); !ok || date(d.Value(0)).String() != "2021-01-31" {
+		t.Errorf("expected 2021-01-31, got %v", dates.Column(0))
+	}
+	if got := stringColumn(t, dates, 1); got[0] != "2020-11-30 08:00:00" {
+		t.Errorf("unexpected timestamp %v", got)
+	}
+	if days, ok := dates.Column(2).(*array.Int64); !ok || days.Value(0) != 28 {
+		t.Errorf("expected 28 days, got %v", dates.Column(2))
+	}
+
+	if _, err := ExecuteQuery(mustParse(t, "SELECT Close FROM prices WHERE Date > DATE '2020-13-01'"), table); err == nil {
+		t.Errorf("expected an invalid date literal to fail")
+	}
+}
+
+func mustExecuteScript(t *testing.T, session *Session, script string) {
+	t.Helper()
+	stmts, err := queryparser.NewParser(script).ParseScript()
+	if err != nil {
+		t.Fatalf("parse %q failed: %v", script, err)
+	}
+	for _, stmt := range stmts {
+		result, err := session.Execute(stmt)
+		if err != nil {
+			t.Fatalf("statement %q failed: %v", stmt, err)
+		}
+		if result != nil {
+			result.Release()
+		}
+	}
+}
+
+func TestInsert(t *testing.T) {
+	catalog := NewMemoryCatalog()
+	defer catalog.Release()
+	catalog.Register("prices", newPricesRecord(t))
+	session := NewSession(catalog)
+
+	mustExecuteScript(t, session, `
+		INSERT INTO prices VALUES ('2020-12-04', 7, 70);
+		INSERT INTO prices (Close, Date, Volume) VALUES (8, '2020-12-05', 1), (9.5, '2020-12-05', 2)
+	`)
+
+	result, err := session.Execute(mustParse(t, "SELECT Close FROM prices WHERE Date >= '2020-12-04' ORDER BY Close"))
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	defer result.Release()
+	if got := float64Column(t, result, 0); len(got) != 3 || got[0] != 7 || got[1] != 8 || got[2] != 9.5 {
+		t.Errorf("unexpected rows %v", got)
+	}
+
+	for _, sql := range []string{
+		"INSERT INTO prices VALUES ('2020-12-06', 1)",
+		"INSERT INTO prices (Close) VALUES ('abc')",
+		"INSERT INTO prices (Close, Close) VALUES (1, 2)",
+		"INSERT INTO missing VALUES (1)",
+	} {
+		stmts, err := queryparser.NewParser(sql).ParseScript()
+		if err != nil {
+			t.Fatalf("parse %q failed: %v", sql, err)
+		}
+		if _, err := session.Execute(stmts[0]); err == nil {
+			t.Errorf("expected %q to fail", sql)
+		}
+	}
+
+	rec, err := catalog.Table("prices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rec.Release()
+	if rec.NumRows() != 8 {
+		t.Errorf("expected failed inserts to leave 8 rows, got %d", rec.NumRows())
+	}
+}
+
+func TestInsertOnConflict(t *testing.T) {
+	catalog := NewMemoryCatalog()
+	defer catalog.Release()
+	catalog.Register("symbols", newSymbolsRecord(t))
+	session := NewSession(catalog)
+
+	mustExecuteScript(t, session, `
+		INSERT INTO symbols VALUES ('2020-12-03', 'keep'), ('2020-12-09', 'nine'), ('2020-12-10', 'tenth')
+		ON CONFLICT (Date) DO UPDATE SET Label = IF(EXCLUDED.Label = 'keep', UPPER(symbols.Label), EXCLUDED.Label);
+		INSERT INTO symbols (Label, Date) VALUES ('other', '2020-12-01'), ('a', '2020-12-11'), ('b', '2020-12-11'), ('x', NULL), ('y', NULL)
+		ON CONFLICT (date) DO NOTHING
+	`)
+
+	rows := func() string {
+		t.Helper()
+		result, err := session.Execute(mustParse(t, "SELECT Date, Label FROM symbols ORDER BY Label"))
+		if err != nil {
+			t.Fatalf("query failed: %v", err)
+		}
+		defer result.Release()
+		rows, err := recordRows(result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprint(rows)
+	}
+	want := "[[2020-12-03 THIRD] [2020-12-11 a] [2020-12-01 first] [2020-12-09 nine] [2020-12-10 tenth] [<nil> x] [<nil> y]]"
+	if got := rows(); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	for _, sql := range []string{
+		"INSERT INTO symbols VALUES ('2020-12-20', 'a'), ('2020-12-20', 'b') ON CONFLICT (Date) DO UPDATE SET Label = 'c'",
+		"INSERT INTO symbols VALUES ('2020-12-01', 'a'), ('2020-12-01', 'b') ON CONFLICT (Date) DO UPDATE SET Label = 'c'",
+		"INSERT INTO symbols VALUES ('2020-12-01', 'a') ON CONFLICT (Date) DO UPDATE SET Label = Label",
+		"INSERT INTO symbols VALUES ('2020-12-01', 'a') ON CONFLICT (Missing) DO NOTHING",
+	} {
+		stmts, err := queryparser.NewParser(sql).ParseScript()
+		if err != nil {
+			t.Fatalf("parse %q failed: %v", sql, err)
+		}
+		if _, err := session.Execute(stmts[0]); err == nil {
+			t.Errorf("expected %q to fail", sql)
+		}
+	}
+	if got := rows(); got != want {
+		t.Errorf("expected failed upserts to leave %s, got %s", want, got)
+	}
+}
+
+func TestCreateTableAs(t *testing.T) {
+	catalog := NewMemoryCatalog()
+	defer catalog.Release()
+	catalog.Register("prices", newPricesRecord(t))
+	session := NewSession(catalog)
+
+	mustExecuteScript(t, session, "CREATE TABLE daily AS SELECT Date, SUM(Close) AS total FROM prices GROUP BY Date")
+
+	result, err := session.Execute(mustParse(t, "SELECT total FROM daily WHERE Date = '2020-12-01'"))
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	defer result.Release()
+	if got := float64Column(t, result, 0); len(got) != 1 || got[0] != 1200 {
+		t.Errorf("unexpected rows %v", got)
+	}
+
+	stmts, err := queryparser.NewParser("CREATE TABLE DAILY AS SELECT Close FROM prices").ParseScript()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Execute(stmts[0]); err == nil {
+		t.Errorf("expected creating an existing table to fail")
+	}
+}
+
+func TestTemporaryTables(t *testing.T) {
+	catalog := NewMemoryCatalog()
+	defer catalog.Release()
+	catalog.Register("prices", newPricesRecord(t))
+	session, other := NewSession(catalog), NewSession(catalog)
+	defer session.Close()
+
+	count := func(s *Session, table string) (int64, error) {
+		result, err := s.Execute(mustParse(t, "SELECT COUNT(*) FROM "+table))
+		if err != nil {
+			return 0, err
+		}
+		defer result.Release()
+		return int64Column(t, result, 0)[0], nil
+	}
+
+	mustExecuteScript(t, session, `
+		CREATE TEMP TABLE staged AS SELECT Date, Close FROM prices WHERE Close > 100;
+		INSERT INTO staged VALUES ('2020-12-09', 1);
+		DELETE FROM staged WHERE Close = 4000
+	`)
+	if n, err := count(session, "staged"); err != nil || n != 3 {
+		t.Errorf("expected 3 staged rows, got %d (%v)", n, err)
+	}
+	if _, err := count(other, "staged"); err == nil {
+		t.Errorf("expected another session not to see the temporary table")
+	}
+	if _, err := catalog.Table("staged"); err == nil {
+		t.Errorf("expected the temporary table to stay out of the catalog")
+	}
+
+	// A temporary table hides the catalog's table of the same name from its
+	// session alone, until it is dropped
+	mustExecuteScript(t, session, "CREATE TEMP TABLE prices AS SELECT * FROM prices WHERE Volume > 30")
+	if n, err := count(session, "prices"); err != nil || n != 2 {
+		t.Errorf("expected the temporary prices to have 2 rows, got %d (%v)", n, err)
+	}
+	if n, err := count(other, "prices"); err != nil || n != 5 {
+		t.Errorf("expected the catalog's prices to have 5 rows, got %d (%v)", n, err)
+	}
+	mustExecuteScript(t, session, "DROP TABLE prices")
+	if n, err := count(session, "prices"); err != nil || n != 5 {
+		t.Errorf("expected dropping the temporary prices to show the catalog's, got %d (%v)", n, err)
+	}
+
+	result, err := session.Execute(&queryparser.ShowTablesStmt{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer result.Release()
+	if got := stringColumn(t, result, 0); fmt.Sprint(got) != "[prices staged]" {
+		t.Errorf("unexpected tables %v", got)
+	}
+
+	stmts, err := queryparser.NewParser("CREATE VIEW v AS SELECT Close FROM staged").ParseScript()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Execute(stmts[0]); err == nil {
+		t.Errorf("expected a view reading a temporary table to fail")
+	}
+
+	session.Close()
+	if _, err := count(session, "staged"); err == nil {
+		t.Errorf("expected closing the session to drop its temporary tables")
+	}
+}
+
+func TestViews(t *testing.T) {
+	catalog := NewMemoryCatalog()
+	defer catalog.Release()
+	catalog.Register("prices", newPricesRecord(t))
+	session := NewSession(catalog)
+
+	mustExecuteScript(t, session, `
+		CREATE VIEW big AS SELECT Date, Close FROM prices WHERE Close > 100;
+		CREATE VIEW daily AS SELECT Date, SUM(Close) AS total FROM big GROUP BY Date
+	`)
+
+	// Views see later writes to the tables they read
+	mustExecuteScript(t, session, "INSERT INTO prices VALUES ('2020-12-03', 500, 1)")
+	result, err := session.Execute(mustParse(t, "WITH prices AS (SELECT * FROM prices WHERE Close < 0) SELECT d.total FROM daily d ORDER BY d.Date"))
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	defer result.Release()
+	if got := float64Column(t, result, 0); fmt.Sprint(got) != "[1200 4500]" {
+		t.Errorf("unexpected totals %v", got)
+	}
+
+	mustExecuteScript(t, session, "CREATE OR REPLACE VIEW big AS SELECT Date, Close FROM prices WHERE Close > 1000")
+	result, err = session.Execute(mustParse(t, "SELECT COUNT(*) FROM daily"))
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	defer result.Release()
+	if got := int64Column(t, result, 0); got[0] != 1 {
+		t.Errorf("expected the replaced view to leave 1 day, got %v", got)
+	}
+
+	schema, err := session.Execute(&queryparser.DescribeStmt{TableName: "daily"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer schema.Release()
+	if got := stringColumn(t, schema, 0); fmt.Sprint(got) != "[Date total]" {
+		t.Errorf("unexpected view columns %v", got)
+	}
+
+	for _, sql := range []string{
+		"CREATE VIEW big AS SELECT Close FROM prices",
+		"CREATE VIEW prices AS SELECT Close FROM prices",
+		"CREATE VIEW broken AS SELECT Missing FROM prices",
+		"CREATE TABLE daily AS SELECT Close FROM prices",
+		"CREATE OR REPLACE VIEW big AS SELECT * FROM daily",
+		"DROP VIEW prices",
+		"DROP VIEW missing",
+	} {
+		stmts, err := queryparser.NewParser(sql).ParseScript()
+		if err != nil {
+			t.Fatalf("parse %q failed: %v", sql, err)
+		}
+		if _, err := session.Execute(stmts[0]); err == nil {
+			t.Errorf("expected %q to fail", sql)
+		}
+	}
+
+	mustExecuteScript(t, session, "DROP VIEW daily; DROP VIEW IF EXISTS daily")
+	if _, err := session.Execute(mustParse(t, "SELECT * FROM daily")); err == nil {
+		t.Errorf("expected a dropped view to be gone")
+	}
+}
+
+func TestDelete(t *testing.T) {
+	catalog := NewMemoryCatalog()
+	defer catalog.Release()
+	catalog.Register("prices", newPricesRecord(t))
+	catalog.Register("symbols", newSymbolsRecord(t))
+	session := NewSession(catalog)
+
+	mustExecuteScript(t, session, "DELETE FROM prices WHERE prices.Close < 100 OR Date IN (SELECT Date FROM symbols WHERE Label = 'third')")
+
+	result, err := session.Execute(mustParse(t, "SELECT Close FROM prices ORDER BY Close"))
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	defer result.Release()
+	if got := float64Column(t, result, 0); len(got) != 2 || got[0] != 300 || got[1] != 900 {
+		t.Errorf("unexpected rows %v", got)
+	}
+
+	mustExecuteScript(t, session, "DELETE FROM prices")
+	rec, err := catalog.Table("prices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rec.Release()
+	if rec.NumRows() != 0 || rec.NumCols() != 3 {
+		t.Errorf("expected an empty table with its schema, got %d rows and %d columns", rec.NumRows(), rec.NumCols())
+	}
+}
+
+func TestDropTableAndTruncate(t *testing.T) {
+	catalog := NewMemoryCatalog()
+	defer catalog.Release()
+	catalog.Register("prices", newPricesRecord(t))
+	catalog.Register("symbols", newSymbolsRecord(t))
+	session := NewSession(catalog)
+
+	mustExecuteScript(t, session, "TRUNCATE prices; DROP TABLE symbols; DROP TABLE IF EXISTS symbols")
+	if got := catalog.Names(); fmt.Sprint(got) != "[prices]" {
+		t.Errorf("unexpected tables %v", got)
+	}
+	rec, err := catalog.Table("prices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rec.Release()
+	if rec.NumRows() != 0 || rec.NumCols() != 3 {
+		t.Errorf("expected an empty table with its schema, got %d rows and %d columns", rec.NumRows(), rec.NumCols())
+	}
+
+	mustExecuteScript(t, session, "CREATE VIEW v AS SELECT * FROM prices")
+	for _, sql := range []string{"DROP TABLE symbols", "DROP TABLE v", "TRUNCATE missing"} {
+		stmts, err := queryparser.NewParser(sql).ParseScript()
+		if err != nil {
+			t.Fatalf("parse %q failed: %v", sql, err)
+		}
+		if _, err := session.Execute(stmts[0]); err == nil {
+			t.Errorf("expected %q to fail", sql)
+		}
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	catalog := NewMemoryCatalog()
+	defer catalog.Release()
+	catalog.Register("prices", newPricesRecord(t))
+	session := NewSession(catalog)
+
+	// Both assignments see the row before the update
+	mustExecuteScript(t, session, "UPDATE prices SET Close = Volume, Volume = Close WHERE Date = '2020-12-02'")
+
+	result, err := session.Execute(mustParse(t, "SELECT Close, Volume FROM prices WHERE Date = '2020-12-02' ORDER BY Close"))
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	defer result.Release()
+	closes, volumes := float64Column(t, result, 0), float64Column(t, result, 1)
+	before, err := ExecuteQuery(mustParse(t, "SELECT Volume, Close FROM prices WHERE Date = '2020-12-02' ORDER BY Volume"), newPricesRecord(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer before.Release()
+	if fmt.Sprint(closes, volumes) != fmt.Sprint(float64Column(t, before, 0), float64Column(t, before, 1)) {
+		t.Errorf("expected Close and Volume to be swapped, got %v %v", closes, volumes)
+	}
+
+	untouched, err := session.Execute(mustParse(t, "SELECT Close FROM prices WHERE Date <> '2020-12-02' ORDER BY Close"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer untouched.Release()
+	if got := float64Column(t, untouched, 0); fmt.Sprint(got) != "[300 900 4000]" {
+		t.Errorf("expected other rows untouched, got %v", got)
+	}
+
+	stmts, err := queryparser.NewParser("UPDATE prices SET Close = 'abc'").ParseScript()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Execute(stmts[0]); err == nil {
+		t.Errorf("expected an uncastable value to fail")
+	}
+}
+
+func TestCopy(t *testing.T) {
+	catalog := NewMemoryCatalog()
+	defer catalog.Release()
+	catalog.Register("prices", newPricesRecord(t))
+	session := NewSession(catalog)
+
+	path := filepath.Join(t.TempDir(), "prices.csv")
+	mustExecuteScript(t, session, fmt.Sprintf(`
+		COPY (SELECT Date, Close FROM prices WHERE Close > 100) TO '%[1]s';
+		COPY loaded FROM '%[1]s';
+		COPY prices FROM '%[1]s'
+	`, path))
+
+	loaded, err := session.Execute(mustParse(t, "SELECT Close FROM loaded ORDER BY Close"))
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	defer loaded.Release()
+	// Whole numbers in the file are inferred as integers
+	if got, ok := loaded.Column(0).(*array.Int64); !ok || fmt.Sprint(got.Int64Values()) != "[300 900 4000]" {
+		t.Errorf("unexpected loaded rows %v", loaded.Column(0))
+	}
+
+	// Appending to prices leaves the Volume column it lacks NULL
+	appended, err := session.Execute(mustParse(t, "SELECT COUNT(*), COUNT(Volume) FROM prices"))
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	defer appended.Release()
+	if got := int64Column(t, appended, 0); got[0] != 8 {
+		t.Errorf("expected 8 rows after COPY FROM, got %v", got)
+	}
+
+	// Decimals are written in full, and read back as numbers
+	decimals := filepath.Join(t.TempDir(), "decimals.csv")
+	mustExecuteScript(t, session, fmt.Sprintf(`
+		CREATE TABLE e AS SELECT DISTINCT CAST(Close / 7 AS DECIMAL(10, 2)) AS c FROM prices WHERE Close > 100;
+		COPY e TO '%[1]s';
+		COPY e2 FROM '%[1]s'
+	`, decimals))
+	roundTrip, err := session.Execute(mustParse(t, "SELECT c FROM e2 ORDER BY c"))
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	defer roundTrip.Release()
+	if got := float64Column(t, roundTrip, 0); fmt.Sprint(got) != "[42.86 128.57 571.43]" {
+		t.Errorf("unexpected decimals read back %v", got)
+	}
+
+	// A column the CSV writer cannot write fails before the file is created
+	unwritable := filepath.Join(t.TempDir(), "dates.csv")
+	dates, err := session.Execute(mustParse(t, "SELECT CAST(Date AS DATE) AS d FROM prices"))
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	defer dates.Release()
+	if err := arrowengine.WriteCSV(unwritable, dates, arrowengine.DefaultCSVOptions); err == nil {
+		t.Errorf("expected a DATE column to be rejected")
+	}
+	if _, err := os.Stat(unwritable); !os.IsNotExist(err) {
+		t.Errorf("expected no file to be created, got %v", err)
+	}
+}
+
+func TestCopyOptions(t *testing.T) {
+	catalog := NewMemoryCatalog()
+	defer catalog.Release()
+	catalog.Register("prices", newPricesRecord(t))
+	session := NewSession(catalog)
+	dir := t.TempDir()
+
+	// HEADER and DELIMITER shape the file written
+	path := filepath.Join(dir, "prices.txt")
+	mustExecuteScript(t, session, fmt.Sprintf(
+		"COPY (SELECT Date, Close FROM prices WHERE Close > 100 ORDER BY Close) TO '%s' (FORMAT CSV, HEADER false, DELIMITER '|')", path))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "2020-12-01|300\n2020-12-01|900\n2020-12-03|4000\n"; got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	// and the file read: without a header the columns are numbered, and rows
+	// appended to a table match its columns by position
+	mustExecuteScript(t, session, fmt.Sprintf(`
+		COPY numbered FROM '%[1]s' (FORMAT CSV, HEADER false, DELIMITER '|');
+		CREATE TABLE named AS SELECT Date AS day, Close AS price FROM prices WHERE Close < 0;
+		COPY named FROM '%[1]s' WITH (HEADER off, DELIMITER '|', FORMAT csv)
+	`, path))
+	for sql, want := range map[string]string{
+		"SELECT column0, column1 FROM numbered ORDER BY column1": "[[2020-12-01 300] [2020-12-01 900] [2020-12-03 4000]]",
+		"SELECT day, price FROM named ORDER BY price":            "[[2020-12-01 300] [2020-12-01 900] [2020-12-03 4000]]",
+	} {
+		result, err := session.Execute(mustParse(t, sql))
+		if err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+		rows, err := recordRows(result)
+		result.Release()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(rows); got != want {
+			t.Errorf("%s: got %s, want %s", sql, got, want)
+		}
+	}
+
+	// A header row is written and expected by default
+	tabbed := filepath.Join(dir, "prices.tsv")
+	mustExecuteScript(t, session, fmt.Sprintf(
+		"COPY (SELECT Close FROM prices WHERE Close < 100 ORDER BY Close) TO '%s' (FORMAT CSV, HEADER true, DELIMITER '\t')", tabbed))
+	if data, err = os.ReadFile(tabbed); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(data), "Close\n20\n50\n"; got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+
+	for _, sql := range []string{
+		"COPY prices TO '%s' (COMPRESSION gzip)",
+		"COPY prices TO '%s' (HEADER maybe)",
+		"COPY prices TO '%s' (DELIMITER ';;')",
+		"COPY prices TO '%s' (DELIMITER '')",
+		"COPY prices TO '%s' (FORMAT JSON)",
+		"COPY prices TO '%s' (FORMAT PARQUET, HEADER true)",
+		"COPY prices FROM '%s' (FORMAT PARQUET, DELIMITER ';')",
+		"COPY prices FROM '%s' (HEADER false)",
+	} {
+		bad := filepath.Join(dir, "bad.csv")
+		stmts, err := queryparser.NewParser(fmt.Sprintf(sql, bad)).ParseScript()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := session.Execute(stmts[0]); err == nil {
+			t.Errorf("expected %q to fail", sql)
+		}
+		if _, err := os.Stat(bad); !os.IsNotExist(err) {
+			t.Errorf("%s: expected no file to be created, got %v", sql, err)
+		}
+	}
+}
+
+func TestCopyParquet(t *testing.T) {
+	catalog := NewMemoryCatalog()
+	defer catalog.Release()
+	catalog.Register("prices", newPricesRecord(t))
+	session := NewSession(catalog)
+	dir := t.TempDir()
+
+	// Types CSV cannot hold, dates, decimals, lists and NULLs, survive the
+	// round trip through the file unchanged
+	path := filepath.Join(dir, "summary.parquet")
+	mustExecuteScript(t, session, fmt.Sprintf(`
+		CREATE TABLE summary AS
+			SELECT CAST(Date AS DATE) AS day, COUNT(*) AS n, CAST(SUM(Close) AS DECIMAL(10, 2)) AS total,
+				ARRAY_AGG(Volume) AS volumes, MAX(IF(Close > 1000, Close, NULL)) AS big
+			FROM prices GROUP BY day;
+		COPY summary TO '%[1]s';
+		COPY loaded FROM '%[1]s'
+	`, path))
+
+	const sql = "SELECT day, n, total, volumes, big FROM %s ORDER BY day, n"
+	want, err := session.Execute(mustParse(t, fmt.Sprintf(sql, "summary")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer want.Release()
+	got, err := session.Execute(mustParse(t, fmt.Sprintf(sql, "loaded")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer got.Release()
+	for i, f := range want.Schema().Fields() {
+		if g := got.Schema().Field(i); g.Name != f.Name || !arrow.TypeEqual(g.Type, f.Type) {
+			t.Errorf("column %s %v read back, want %s %v", g.Name, g.Type, f.Name, f.Type)
+		}
+	}
+	wantRows, err := recordRows(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotRows, err := recordRows(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(gotRows) != fmt.Sprint(wantRows) {
+		t.Errorf("read back %v, want %v", gotRows, wantRows)
+	}
+	if fmt.Sprint(gotRows) != "[[2020-12-01 2 1200.00 [10, 30] <nil>] [2020-12-02 2 70.00 [20, 50] <nil>] [2020-12-03 1 4000.00 [40] 4000]]" {
+		t.Errorf("unexpected rows %v", gotRows)
+	}
+
+	// Appending the file to the table it came from doubles every group
+	mustExecuteScript(t, session, fmt.Sprintf("COPY summary FROM '%s' (FORMAT PARQUET)", path))
+	counts, err := session.Execute(mustParse(t, "SELECT COUNT(*), COUNT(DISTINCT day) FROM summary"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer counts.Release()
+	if got := int64Column(t, counts, 0); fmt.Sprint(got) != "[6]" {
+		t.Errorf("expected 6 rows after COPY FROM, got %v", got)
+	}
+
+	// A file that is not Parquet fails to load
+	csvPath := filepath.Join(dir, "prices.csv")
+	mustExecuteScript(t, session, fmt.Sprintf("COPY prices TO '%s'", csvPath))
+	stmts, err := queryparser.NewParser(fmt.Sprintf("COPY other FROM '%s' (FORMAT PARQUET)", csvPath)).ParseScript()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := session.Execute(stmts[0]); err == nil {
+		t.Errorf("expected a CSV file read as Parquet to fail")
+	}
+}
+
+func TestShowTablesAndDescribe(t *testing.T) {
+	catalog := NewMemoryCatalog()
+	defer catalog.Release()
+	catalog.Register("symbols", newSymbolsRecord(t))
+	catalog.Register("prices", newPricesRecord(t))
+	session := NewSession(catalog)
+
+	tables, err := session.Execute(&queryparser.ShowTablesStmt{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tables.Release()
+	if got := stringColumn(t, tables, 0); fmt.Sprint(got) != "[prices symbols]" {
+		t.Errorf("unexpected tables %v", got)
+	}
+
+	schema, err := session.Execute(&queryparser.DescribeStmt{TableName: "prices"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer schema.Release()
+	if got := stringColumn(t, schema, 0); fmt.Sprint(got) != "[Date Close Volume]" {
+		t.Errorf("unexpected columns %v", got)
+	}
+	if got := stringColumn(t, schema, 1); got[1] != "float64" {
+		t.Errorf("expected Close to be float64, got %v", got)
+	}
+
+	if _, err := session.Execute(&queryparser.DescribeStmt{TableName: "missing"}); err == nil {
+		t.Errorf("expected DESCRIBE of a missing table to fail")
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	catalog := NewMemoryCatalog()
+	defer catalog.Release()
+	catalog.Register("prices", newPricesRecord(t))
+	session := NewSession(catalog)
+	mustExecuteScript(t, session, "CREATE TABLE t AS SELECT * FROM (VALUES (1, 'a'), (NULL, 'b'), (3, 'a')) v(n, s)")
+
+	for name, want := range map[string]string{
+		"prices": "[[Date utf8 2020-12-01 2020-12-03 3 <nil> <nil> <nil> <nil> 5 0] " +
+			"[Close float64 20 4000 5 1054 50 300 900 5 0] " +
+			"[Volume float64 10 50 5 30 20 30 40 5 0]]",
+		"t": "[[n int64 1 3 2 2 1.5 2 2.5 3 1] [s utf8 a b 2 <nil> <nil> <nil> <nil> 3 0]]",
+	} {
+		result, err := session.Execute(&queryparser.SummarizeStmt{TableName: name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows, err := recordRows(result)
+		result.Release()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(rows); got != want {
+			t.Errorf("SUMMARIZE %s: got %s, want %s", name, got, want)
+		}
+	}
+
+	if _, err := session.Execute(&queryparser.SummarizeStmt{TableName: "missing"}); err == nil {
+		t.Errorf("expected SUMMARIZE of a missing table to fail")
+	}
+}
+
+func TestSessionOptions(t *testing.T) {
+	catalog := NewMemoryCatalog()
+	defer catalog.Release()
+	catalog.Register("prices", newPricesRecord(t))
+	session := NewSession(catalog)
+
+	mustExecuteScript(t, session, `
+		INSERT INTO prices (Date) VALUES ('2020-12-04');
+		SET null_ordering = nulls_first
+	`)
+	result, err := session.Execute(mustParse(t, "SELECT Close FROM prices ORDER BY Close"))
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	defer result.Release()
+	if col := result.Column(0); !col.IsNull(0) || col.IsNull(1) {
+		t.Errorf("expected the NULL Close to sort first with nulls_first")
+	}
+
+	mustExecuteScript(t, session, "SET memory_limit = 1")
+	if _, err := session.Execute(mustParse(t, "SELECT Close FROM prices")); err == nil || !strings.Contains(err.Error(), "memory limit exceeded in Project Close") {
+		t.Errorf("expected a memory limit error, got %v", err)
+	}
+	// The error names the innermost operator that was running
+	_, err = session.Execute(mustParse(t, "SELECT DISTINCT p.Close FROM prices p JOIN prices q ON p.Date = q.Date"))
+	if err == nil || !strings.Contains(err.Error(), "memory limit exceeded in Join INNER") {
+		t.Errorf("expected the join to exceed the memory limit, got %v", err)
+	}
+	mustExecuteScript(t, session, "SET memory_limit = '64MB'")
+	if got := session.Options().MemoryLimit; got != 64<<20 {
+		t.Errorf("expected a 64MB limit, got %d", got)
+	}
+
+	mustExecuteScript(t, session, "SET statement_timeout = 1500")
+	if got := session.Options().StatementTimeout; got != 1500*time.Millisecond {
+		t.Errorf("expected a 1.5s timeout, got %v", got)
+	}
+	mustExecuteScript(t, session, "SET statement_timeout = '1ns'")
+	if _, err := session.Execute(mustParse(t, "SELECT Close FROM prices")); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the statement to time out, got %v", err)
+	}
+	mustExecuteScript(t, session, "SET statement_timeout = 0")
+
+	for _, sql := range []string{"SET null_ordering = sideways", "SET memory_limit = lots", "SET statement_timeout = soon", "SET no_such_option = 1"} {
+		stmts, err := queryparser.NewParser(sql).ParseScript()
+		if err != nil {
+			t.Fatalf("parse %q failed: %v", sql, err)
+		}
+		if _, err := session.Execute(stmts[0]); err == nil {
+			t.Errorf("expected %q to fail", sql)
+		}
+	}
+}
+
+func TestCancellation(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	table := newPricesRecord(t)
+	q := mustParse(t, "SELECT Date, SUM(Close) FROM prices GROUP BY Date")
+	if _, err := ExecuteQueryContext(ctx, q, table); !errors.Is(err, context.Canceled) || !strings.Contains(err.Error(), "query canceled") {
+		t.Errorf("expected the query to be canceled, got %v", err)
+	}
+
+	catalog := NewMemoryCatalog()
+	defer catalog.Release()
+	catalog.Register("prices", table)
+	session := NewSession(catalog)
+	if _, err := session.ExecuteContext(ctx, q); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the statement to be canceled, got %v", err)
+	}
+
+	// A stream stops before reading the next batch
+	input, err := array.NewRecordReader(table.Schema(), []array.Record{table})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer input.Release()
+	if _, err := ExecuteStreamContext(ctx, q, input, Options{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected the stream to be canceled, got %v", err)
+	}
+
+	// Morsels not yet started when the context is canceled are skipped
+	ctx, cancel = context.WithCancel(context.Background())
+	var ran int
+	err = forEachMorsel(ctx, 10, 1, 1, func(m, _, _ int) error {
+		if ran++; m == 2 {
+			cancel()
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) || ran != 3 {
+		t.Errorf("expected 3 morsels before the cancellation, got %d and %v", ran, err)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	defer func(size int) { morselSize = size }(morselSize)
+	morselSize = 2
+
+	var reports []Progress
+	ctx := WithProgress(context.Background(), ProgressFunc(func(p Progress) {
+		reports = append(reports, p)
+	}))
+	table := newPricesRecord(t)
+	q := mustParse(t, "SELECT Date, SUM(Close) FROM prices WHERE Close > 0 GROUP BY Date")
+	result, err := ExecuteQueryContext(ctx, q, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result.Release()
+	stages := map[string]bool{}
+	for _, p := range reports {
+		stages[p.Stage] = true
+	}
+	if !stages["Scan prices [Date, Close]"] || !stages["Project Date, SUM(Close)"] {
+		t.Errorf("expected the scan and the projection among the stages, got %v", stages)
+	}
+	// Grouping 5 rows takes 3 morsels of 2 rows, and evaluating each of the
+	// 3 groups 1 morsel per SELECT list item
+	last := reports[len(reports)-1]
+	if last.Stage != "" || last.RowsScanned != 5 || last.Batches != 9 {
+		t.Errorf("unexpected final progress %+v", last)
+	}
+
+	reports = nil
+	first, rest := table.NewSlice(0, 2), table.NewSlice(2, 5)
+	defer first.Release()
+	defer rest.Release()
+	input, err := array.NewRecordReader(table.Schema(), []array.Record{first, rest})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer input.Release()
+	stream, err := ExecuteStreamContext(ctx, q, input, Options{Parallelism: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Release()
+	// Both input batches count, as do the morsels of the final SELECT over
+	// the groups
+	if last := reports[len(reports)-1]; last.Stage != "Project Date, SUM(Close)" || last.RowsScanned != 5 || last.Batches <= 2 {
+		t.Errorf("unexpected final stream progress %+v", last)
+	}
+}
+
+func TestOperatorMetrics(t *testing.T) {
+	catalog := NewMemoryCatalog()
+	defer catalog.Release()
+	catalog.Register("prices", newPricesRecord(t))
+	session := NewSession(catalog)
+
+	const sql = "SELECT Date FROM prices WHERE Close > (SELECT AVG(Close) FROM prices) ORDER BY Close"
+	// The second run reuses the session's plan, whose metrics start afresh
+	for run := 0; run < 2; run++ {
+		result, err := session.Query(sql)
+		if err != nil {
+			t.Fatal(err)
+		}
+		metrics, err := ResultMetrics(result)
+		result.Release()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, m := range metrics {
+			got = append(got, fmt.Sprintf("%d %s: %d rows, %d batches", m.Depth, m.Operator, m.Rows, m.Batches))
+			if m.Bytes <= 0 || m.Elapsed < 0 {
+				t.Errorf("unexpected metrics %+v", m)
+			}
+		}
+		want := "[0 Project Date: 1 rows, 1 batches " +
+			"1 Scan prices [Date, Close]: 5 rows, 1 batches " +
+			"1 Project AVG(Close): 1 rows, 1 batches " +
+			"2 Scan prices [Close]: 5 rows, 1 batches]"
+		if fmt.Sprint(got) != want {
+			t.Errorf("run %d: got %v, want %s", run, got, want)
+		}
+	}
+
+	result, err := session.Execute(&queryparser.ShowTablesStmt{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer result.Release()
+	if metrics, err := ResultMetrics(result); metrics != nil || err != nil {
+		t.Errorf("expected SHOW TABLES to carry no metrics, got %v, %v", metrics, err)
+	}
+}
+
+func TestSessionExecuteStream(t *testing.T) {
+	defer func(size int64) { resultBatchSize = size }(resultBatchSize)
+	resultBatchSize = 2
+
+	catalog := NewMemoryCatalog()
+	defer catalog.Release()
+	catalog.Register("prices", newPricesRecord(t))
+	session := NewSession(catalog)
+	mustExecuteScript(t, session, "CREATE VIEW big AS SELECT * FROM prices WHERE Close > 100")
+
+	for _, test := range []struct {
+		sql, want string
+	}{
+		// Streamed over the table's batches, each with a row passing giving one
+		{"SELECT Close FROM prices WHERE Close > 100", "[[[900]] [[300] [4000]]]"},
+		{"SELECT COUNT(*) FROM prices", "[[[5]]]"},
+		// Run in full and then split
+		{"SELECT Close FROM prices ORDER BY Close", "[[[20] [50]] [[300] [900]] [[4000]]]"},
+		{"SELECT Close FROM big", "[[[900] [300]] [[4000]]]"},
+	} {
+		stream, err := session.ExecuteStream(context.Background(), mustParse(t, test.sql))
+		if err != nil {
+			t.Fatalf("%s: %v", test.sql, err)
+		}
+		var batches [][][]interface{}
+		for stream.Next() {
+			rows, err := recordRows(stream.Record())
+			if err != nil {
+				t.Fatal(err)
+			}
+			batches = append(batches, rows)
+		}
+		if err := stream.Err(); err != nil {
+			t.Errorf("%s: %v", test.sql, err)
+		}
+		stream.Release()
+		if got := fmt.Sprint(batches); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.sql, got, test.want)
+		}
+	}
+
+	if _, err := session.ExecuteStream(context.Background(), mustParse(t, "SELECT Nope FROM prices")); err == nil {
+		t.Errorf("expected a missing column to fail")
+	}
+
+	// The first batch holds only NULLs in g, yet the stream has the types
+	// Execute gives
+	mustExecuteScript(t, session, "CREATE TABLE t AS SELECT * FROM (VALUES (NULL, 1), (NULL, 2), ('c', 3), ('d', 4)) v(g, id)")
+	for sql, want := range map[string]string{
+		"SELECT id, UPPER(g) AS u FROM t WHERE id > 1": "[[[2 <nil>]] [[3 C] [4 D]]]",
+		"SELECT SUM(id) FROM t WHERE id > 10":          "[[[<nil>]]]",
+		"SELECT ARG_MIN(g, id) FROM t WHERE id < 3":    "[[[<nil>]]]",
+	} {
+		result, err := session.Execute(mustParse(t, sql))
+		if err != nil {
+			t.Fatal(err)
+		}
+		schema := result.Schema()
+		result.Release()
+		stream, err := session.ExecuteStream(context.Background(), mustParse(t, sql))
+		if err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+		var batches [][][]interface{}
+		for stream.Next() {
+			if got := stream.Record().Schema(); !got.Equal(schema) {
+				t.Errorf("%s: streamed %v, executed %v", sql, got, schema)
+			}
+			rows, err := recordRows(stream.Record())
+			if err != nil {
+				t.Fatal(err)
+			}
+			batches = append(batches, rows)
+		}
+		if err := stream.Err(); err != nil {
+			t.Errorf("%s: %v", sql, err)
+		}
+		stream.Release()
+		if got := fmt.Sprint(batches); got != want {
+			t.Errorf("%s: got %s, want %s", sql, got, want)
+		}
+	}
+}
+
+func TestGroupByOrdinalsAndAliases(t *testing.T) {
+	table := newPricesRecord(t)
+
+	byOrdinal := runQuery(t, table, "SELECT Date, SUM(Close) FROM prices GROUP BY 1 ORDER BY SUM(Close)")
+	if got := stringColumn(t, byOrdinal, 0); fmt.Sprint(got) != "[2020-12-02 2020-12-01 2020-12-03]" {
+		t.Errorf("unexpected groups %v", got)
+	}
+
+	byAlias := runQuery(t, table, "SELECT Close > 100 AS big, COUNT(*) AS n FROM prices GROUP BY big ORDER BY COUNT(*)")
+	if got := int64Column(t, byAlias, 1); fmt.Sprint(got) != "[2 3]" {
+		t.Errorf("unexpected counts %v", got)
+	}
+	if name := byAlias.Schema().Field(0).Name; name != "big" {
+		t.Errorf("expected column big, got %s", name)
+	}
+
+	// A name that is also an input column groups by the input column
+	shadowed := runQuery(t, table, "SELECT Date AS Close, COUNT(*) FROM prices GROUP BY Close")
+	if shadowed.NumRows() != 5 {
+		t.Errorf("expected 5 groups by the Close column, got %d", shadowed.NumRows())
+	}
+
+	for _, sql := range []string{
+		"SELECT Date, SUM(Close) FROM prices GROUP BY 3",
+		"SELECT Date, SUM(Close) FROM prices GROUP BY 2",
+		"SELECT Date, SUM(Close) AS total FROM prices GROUP BY total",
+	} {
+		if _, err := ExecuteQuery(mustParse(t, sql), table); err == nil {
+			t.Errorf("expected %q to fail", sql)
+		}
+	}
+}
+
+func TestOrderByDirectionAndNulls(t *testing.T) {
+	table := newPricesRecord(t)
+	result := runQuery(t, table, "SELECT Close FROM prices ORDER BY Date DESC, Close ASC")
+	if got := float64Column(t, result, 0); fmt.Sprint(got) != "[4000 20 50 300 900]" {
+		t.Errorf("unexpected order %v", got)
+	}
+
+	catalog := NewMemoryCatalog()
+	defer catalog.Release()
+	catalog.Register("prices", table)
+	session := NewSession(catalog)
+	mustExecuteScript(t, session, "INSERT INTO prices (Date) VALUES ('2020-12-04')")
+
+	for _, tc := range []struct {
+		sql      string
+		nullRow  int
+		firstVal float64
+	}{
+		{"SELECT Close FROM prices ORDER BY Close DESC", 5, 4000},
+		{"SELECT Close FROM prices ORDER BY Close DESC NULLS FIRST", 0, 4000},
+		{"SELECT Close FROM prices ORDER BY Close NULLS FIRST", 0, 20},
+		{"SELECT Close FROM prices ORDER BY CAST(Close AS BIGINT) DESC NULLS LAST", 5, 4000},
+	} {
+		result, err := session.Execute(mustParse(t, tc.sql))
+		if err != nil {
+			t.Fatalf("query %q failed: %v", tc.sql, err)
+		}
+		col := result.Column(0)
+		if !col.IsNull(tc.nullRow) {
+			t.Errorf("%s: expected NULL at row %d", tc.sql, tc.nullRow)
+		}
+		first := 0
+		if tc.nullRow == 0 {
+			first = 1
+		}
+		if got := float64Column(t, result, 0)[first]; got != tc.firstVal {
+			t.Errorf("%s: expected %v first, got %v", tc.sql, tc.firstVal, got)
+		}
+		result.Release()
+	}
+}
+
+func TestScalarFunctions(t *testing.T) {
+	table := newPricesRecord(t)
+
+	agg := runQuery(t, table, "SELECT ROUND(AVG(Close) / 3, 2), COUNT(*) + 1 FROM prices")
+	if got := float64Column(t, agg, 0); got[0] != 351.33 {
+		t.Errorf("expected 351.33, got %v", got[0])
+	}
+	if got := int64Column(t, agg, 1); got[0] != 6 {
+		t.Errorf("expected 6, got %v", got[0])
+	}
+
+	rows := runQuery(t, table, "SELECT UPPER(Date), LENGTH(Date) FROM prices WHERE ROUND(Close / 1000) = 4")
+	if rows.NumRows() != 1 || stringColumn(t, rows, 0)[0] != "2020-12-03" {
+		t.Fatalf("unexpected rows: %v", rows)
+	}
+	if n := rows.Column(1).(*array.Int64).Value(0); n != 10 {
+		t.Errorf("expected LENGTH 10, got %d", n)
+	}
+
+	grouped := runQuery(t, table, "SELECT Date, ROUND(SUM(Close) / 7) AS weekly FROM prices GROUP BY Date ORDER BY Date")
+	if got := float64Column(t, grouped, 1); fmt.Sprint(got) != "[171 10 571]" {
+		t.Errorf("unexpected grouped values %v", got)
+	}
+
+	for _, sql := range []string{
+		"SELECT Close, SUM(Close) FROM prices",
+		"SELECT SUM(MAX(Close)) FROM prices",
+		"SELECT Close FROM prices WHERE SUM(Close) > 1",
+		"SELECT NOPE(Close) FROM prices",
+		"SELECT ROUND(Close, 1, 2) FROM prices",
+	} {
+		if _, err := ExecuteQuery(mustParse(t, sql), table); err == nil {
+			t.Errorf("expected %q to fail", sql)
+		}
+	}
+}
+
+func TestBooleanAndNullLiterals(t *testing.T) {
+	catalog := NewMemoryCatalog()
+	defer catalog.Release()
+	catalog.Register("prices", newPricesRecord(t))
+	session := NewSession(catalog)
+
+	mustExecuteScript(t, session, `
+		CREATE TABLE flags AS SELECT Date, Close > 100 AS big FROM prices;
+		UPDATE prices SET Close = NULL WHERE Close < 100
+	`)
+
+	for sql, want := range map[string]int64{
+		"SELECT COUNT(*) FROM flags WHERE big = TRUE":         3,
+		"SELECT COUNT(*) FROM flags WHERE big = false":        2,
+		"SELECT COUNT(*) FROM flags WHERE NOT big OR FALSE":   2,
+		"SELECT COUNT(*) FROM prices WHERE Close IS NULL":     2,
+		"SELECT COUNT(*) FROM prices WHERE Close IS NOT NULL": 3,
+		"SELECT COUNT(*) FROM prices WHERE Close = NULL":      0,
+		"SELECT COUNT(*) FROM prices WHERE Close + 1 IS NULL": 2,
+	} {
+		result, err := session.Execute(mustParse(t, sql))
+		if err != nil {
+			t.Fatalf("query %q failed: %v", sql, err)
+		}
+		if got := int64Column(t, result, 0)[0]; got != want {
+			t.Errorf("%s: expected %v, got %v", sql, want, got)
+		}
+		result.Release()
+	}
+
+	result, err := session.Execute(mustParse(t, "SELECT NULL, NULL * 2, TRUE AS yes FROM prices WHERE Volume = 10"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer result.Release()
+	if !result.Column(0).IsNull(0) || !result.Column(1).IsNull(0) {
+		t.Errorf("expected NULL columns")
+	}
+	if yes, ok := result.Column(2).(*array.Boolean); !ok || !yes.Value(0) {
+		t.Errorf("expected a TRUE boolean column, got %v", result.Column(2))
+	}
+}
+
+func TestSelectStarExcludeReplace(t *testing.T) {
+	table := newPricesRecord(t)
+
+	all := runQuery(t, table, "SELECT * FROM prices")
+	if all.NumCols() != 3 || all.Schema().Field(2).Name != "Volume" {
+		t.Errorf("expected every column, got %v", all.Schema())
+	}
+
+	result := runQuery(t, table, "SELECT * EXCLUDE (Volume) REPLACE (Close * 2 AS Close) FROM prices ORDER BY Close")
+	if result.NumCols() != 2 || result.Schema().Field(1).Name != "Close" {
+		t.Fatalf("expected Date and Close, got %v", result.Schema())
+	}
+	if got := float64Column(t, result, 1); fmt.Sprint(got) != "[40 100 600 1800 8000]" {
+		t.Errorf("unexpected replaced values %v", got)
+	}
+
+	joined := runQueryWithTables(t, map[string]array.Record{"prices": table, "symbols": newSymbolsRecord(t)},
+		"SELECT * EXCLUDE Date, s.Date FROM prices p JOIN symbols s ON p.Date = s.Date")
+	if joined.NumCols() != 4 || joined.Schema().Field(2).Name != "Label" {
+		t.Errorf("expected Close, Volume, Label and Date, got %v", joined.Schema())
+	}
+
+	for _, sql := range []string{
+		"SELECT * EXCLUDE (Missing) FROM prices",
+		"SELECT * REPLACE (1 AS Missing) FROM prices",
+		"SELECT * EXCLUDE (Date, Close, Volume) FROM prices",
+	} {
+		if _, err := ExecuteQuery(mustParse(t, sql), table); err == nil {
+			t.Errorf("expected %q to fail", sql)
+		}
+	}
+}
+
+func TestOperatorPrecedence(t *testing.T) {
+	table := newPricesRecord(t)
+	for sql, want := range map[string]float64{
+		// Close + Volume: 910, 40, 330, 4040, 100
+		"SELECT COUNT(*) FROM prices WHERE Close + Volume > 300 + 30":               2,
+		"SELECT COUNT(*) FROM prices WHERE Close - Volume * 2 = 0":                  0,
+		"SELECT COUNT(*) FROM prices WHERE Volume * 100 - 100 = Close":              1,
+		"SELECT COUNT(*) FROM prices WHERE NOT Close + 1 > 100 AND Volume < 50":     1,
+		"SELECT COUNT(*) FROM prices WHERE Close BETWEEN 10 + 10 AND 25 * 2":        2,
+		"SELECT COUNT(*) FROM prices WHERE Close / 10 IN (2, 5) OR Volume = 10":     3,
+		"SELECT SUM(Volume) FROM prices WHERE Close * 2 >= 600 AND Volume - 5 > 10": 70,
+	} {
+		rows, err := recordRows(runQuery(t, table, sql))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := toFloat(rows[0][0]); got != want {
+			t.Errorf("%s: expected %v, got %v", sql, want, got)
+		}
+	}
+}
+
+func TestErrorPositions(t *testing.T) {
+	table := newPricesRecord(t)
+	sql := "SELECT Date,\n       Closing\nFROM prices"
+	_, err := ExecuteQuery(mustParse(t, sql), table)
+	var perr *queryparser.PosError
+	if !errors.As(err, &perr) {
+		t.Fatalf("expected a positioned error, got %v", err)
+	}
+	if perr.Pos.Line != 2 || perr.Pos.Column != 8 {
+		t.Errorf("unexpected position %+v", perr.Pos)
+	}
+	want := "column Closing not found\n       Closing\n       ^"
+	if got := queryparser.FormatError(sql, err); got != want {
+		t.Errorf("unexpected FormatError output:\n%s", got)
+	}
+
+	_, err = ExecuteQuery(mustParse(t, "SELECT COUNT(*), Date FROM prices"), table)
+	if !errors.As(err, &perr) || perr.Pos.Column != 18 {
+		t.Errorf("expected the ungrouped column error at column 18, got %v", err)
+	}
+}
+
+func TestValuesTable(t *testing.T) {
+	catalog := NewMemoryCatalog()
+	defer catalog.Release()
+	catalog.Register("prices", newPricesRecord(t))
+	session := NewSession(catalog)
+
+	result, err := session.Execute(mustParse(t, `
+		SELECT t.label, SUM(p.Volume) AS volume
+		FROM prices p
+		JOIN (VALUES ('2020-12-01', 'first'), ('2020-12-02', 'second')) AS t(day, label) ON p.Date = t.day
+		GROUP BY t.label
+		ORDER BY t.label`))
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	defer result.Release()
+	if got := stringColumn(t, result, 0); fmt.Sprint(got) != "[first second]" {
+		t.Errorf("unexpected labels %v", got)
+	}
+	if got := float64Column(t, result, 1); fmt.Sprint(got) != "[40 70]" {
+		t.Errorf("unexpected volumes %v", got)
+	}
+
+	// Integers and floats in one column widen to float64; unnamed columns are col0, col1, ...
+	mixed := runQuery(t, newPricesRecord(t), "SELECT * FROM (VALUES (1, NULL), (2.5, 'x')) v")
+	if got := float64Column(t, mixed, 0); fmt.Sprint(got) != "[1 2.5]" {
+		t.Errorf("unexpected values %v", got)
+	}
+	if name := mixed.ColumnName(1); name != "col1" || mixed.Column(1).IsValid(0) {
+		t.Errorf("expected a nullable col1, got %s", name)
+	}
+
+	for _, sql := range []string{
+		"SELECT * FROM (VALUES (1, 2), (3)) v",
+		"SELECT * FROM (VALUES (1), ('a')) v",
+		"SELECT * FROM (VALUES (1)) v(a, b)",
+	} {
+		if _, err := session.Execute(mustParse(t, sql)); err == nil {
+			t.Errorf("expected %q to fail", sql)
+		}
+	}
+}
+
+func TestQualify(t *testing.T) {
+	table := newPricesRecord(t)
+
+	top := runQuery(t, table, "SELECT Date, Close FROM prices QUALIFY ROW_NUMBER() OVER (PARTITION BY Date ORDER BY Close DESC) = 1 ORDER BY Date")
+	if top.NumCols() != 2 {
+		t.Fatalf("expected the QUALIFY column to be dropped, got %d columns", top.NumCols())
+	}
+	if got := float64Column(t, top, 1); fmt.Sprint(got) != "[900 50 4000]" {
+		t.Errorf("unexpected top rows %v", got)
+	}
+
+	// Aliases of window functions can be filtered on, alongside input columns
+	ranked := runQuery(t, table, "SELECT Close, COUNT(*) OVER (PARTITION BY Date) AS n FROM prices QUALIFY n > 1 AND Close > 30 ORDER BY Close")
+	if got := float64Column(t, ranked, 0); fmt.Sprint(got) != "[50 300 900]" {
+		t.Errorf("unexpected rows %v", got)
+	}
+	if name := ranked.ColumnName(1); name != "n" {
+		t.Errorf("expected the alias to be kept, got %s", name)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	catalog := NewMemoryCatalog()
+	defer catalog.Release()
+	catalog.Register("prices", newPricesRecord(t))
+	session := NewSession(catalog)
+
+	mustExecuteScript(t, session, `
+		MERGE INTO prices p
+		USING (VALUES (900, 1), (20, NULL), (7, 70)) AS u(Close, Volume) ON p.Close = u.Close
+		WHEN MATCHED AND u.Volume IS NULL THEN DELETE
+		WHEN MATCHED THEN UPDATE SET Volume = p.Volume + u.Volume
+		WHEN NOT MATCHED THEN INSERT (Date, Close, Volume) VALUES ('2020-12-04', u.Close, u.Volume)
+	`)
+
+	result, err := session.Execute(mustParse(t, "SELECT Close, Volume FROM prices ORDER BY Close"))
+	if err != nil {
+		t.Fatalf("query failed: %v", err)
+	}
+	defer result.Release()
+	if got := float64Column(t, result, 0); fmt.Sprint(got) != "[7 50 300 900 4000]" {
+		t.Errorf("unexpected closes %v", got)
+	}
+	if got := float64Column(t, result, 1); fmt.Sprint(got) != "[70 50 30 11 40]" {
+		t.Errorf("unexpected volumes %v", got)
+	}
+
+	for _, sql := range []string{
+		"MERGE INTO prices USING (VALUES (50), (50)) AS u(c) ON prices.Close = u.c WHEN MATCHED THEN DELETE",
+		"MERGE INTO prices USING (VALUES (10), (20)) AS u(c) ON prices.Close > u.c WHEN MATCHED THEN DELETE",
+		"MERGE INTO prices USING (VALUES (1)) AS u(c) ON prices.Close = u.c WHEN NOT MATCHED THEN INSERT VALUES (u.c)",
+		"MERGE INTO prices USING (VALUES (50)) AS u(c) ON prices.Close = u.c WHEN MATCHED THEN UPDATE SET Missing = 1",
+	} {
+		stmts, err := queryparser.NewParser(sql).ParseScript()
+		if err != nil {
+			t.Fatalf("parse %q failed: %v", sql, err)
+		}
+		if _, err := session.Execute(stmts[0]); err == nil {
+			t.Errorf("expected %q to fail", sql)
+		}
+	}
+}
+
+func TestVectorizedFilter(t *testing.T) {
+	session := NewSession(NewMemoryCatalog())
+	mustExecuteScript(t, session, `
+		CREATE TABLE t AS SELECT * FROM (VALUES
+			(1, 1.5, 'a', TRUE, DATE '2024-01-01'),
+			(2, NULL, 'b', FALSE, DATE '2024-02-01'),
+			(NULL, 3.0, NULL, NULL, NULL),
+			(4, 4.5, 'd', TRUE, DATE '2024-04-01')
+		) v(i, f, s, b, d)`)
+	table, err := session.Catalog().Table("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Release()
+
+	conditions := []string{
+		"i = 2", "i > 1.5", "f <= 3", "2 < i", "i = f", "s >= 'b'", "s <> 'a'",
+		"b", "NOT b", "b = FALSE", "d > DATE '2024-01-15'", "d = '2024-02-01'",
+		"i IS NULL", "f IS NOT NULL", "i > 1 AND NOT f > 4", "s = 'a' OR i > 3",
+		"NOT (i = 1 AND s IS NULL)", "i = NULL", "NOT (i > NULL OR b)",
+		"NOT (f > 2 AND i > 3)", "f > 2 OR i = 2", "NOT (s = 'a' OR f < 2)",
+	}
+	for _, cond := range conditions {
+		where := mustParse(t, "SELECT * FROM t WHERE "+cond).Where
+		mask, ok := evalCondition(where, table)
+		if !ok {
+			t.Errorf("%s: not evaluated column-wise", cond)
+			continue
+		}
+		for row, got := range mask {
+			val, err := evaluateExpression(where, table, row)
+			if err != nil {
+				t.Fatalf("%s: %v", cond, err)
+			}
+			want := truthNull
+			if b, ok := val.(bool); ok {
+				want = truthOf(b)
+			}
+			if got != want {
+				t.Errorf("%s: row %d = %v, want %v", cond, row, got, want)
+			}
+		}
+	}
+
+	// Conditions it cannot evaluate column-wise still filter row by row
+	where := mustParse(t, "SELECT * FROM t WHERE i + 1 = 3 OR UPPER(s) = 'D'").Where
+	if _, ok := evalCondition(where, table); ok {
+		t.Errorf("expected arithmetic to fall back to row-wise evaluation")
+	}
+	rows, err := filterRows(where, table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(rows) != "[1 3]" {
+		t.Errorf("got rows %v, want [1 3]", rows)
+	}
+}
+
+func TestParallelSort(t *testing.T) {
+	defer func(threshold, procs int) {
+		parallelSortThreshold = threshold
+		runtime.GOMAXPROCS(procs)
+	}(parallelSortThreshold, runtime.GOMAXPROCS(4))
+	parallelSortThreshold = 2
+
+	pool := memory.NewGoAllocator()
+	schema := arrow.NewSchema([]arrow.Field{
+		{Name: "id", Type: arrow.PrimitiveTypes.Int64},
+		{Name: "k", Type: arrow.PrimitiveTypes.Int64, Nullable: true},
+	}, nil)
+	b := array.NewRecordBuilder(pool, schema)
+	defer b.Release()
+	const n = 1000
+	for i := 0; i < n; i++ {
+		b.Field(0).(*array.Int64Builder).Append(int64(i))
+		if i%11 == 0 {
+			b.Field(1).(*array.Int64Builder).AppendNull()
+		} else {
+			b.Field(1).(*array.Int64Builder).Append(int64(i * 7 % 13))
+		}
+	}
+	rec := b.NewRecord()
+	defer rec.Release()
+
+	result := runQuery(t, rec, "SELECT id, k FROM t ORDER BY k DESC")
+	ids := result.Column(0).(*array.Int64)
+	keys := result.Column(1).(*array.Int64)
+	if ids.Len() != n {
+		t.Fatalf("got %d rows, want %d", ids.Len(), n)
+	}
+	for i := 1; i < n; i++ {
+		prevNull, null := keys.IsNull(i-1), keys.IsNull(i)
+		switch {
+		case prevNull && !null:
+			t.Fatalf("row %d: NULL sorted before a value", i)
+		case !prevNull && !null && keys.Value(i-1) < keys.Value(i):
+			t.Fatalf("row %d: %d sorted before %d", i, keys.Value(i-1), keys.Value(i))
+		case prevNull == null && (null || keys.Value(i-1) == keys.Value(i)) && ids.Value(i-1) > ids.Value(i):
+			t.Fatalf("row %d: tie on k not kept in input order", i)
+		}
+	}
+}
+
+func TestNullAggregates(t *testing.T) {
+	table := newPricesRecord(t)
+
+	// Over no rows COUNT is 0 and the other aggregates are NULL
+	empty := runQuery(t, table, "SELECT COUNT(*), COUNT(Close), SUM(Close), AVG(Close), MIN(Close), MAX(Close) FROM prices WHERE Close < 0")
+	if got := int64Column(t, empty, 0)[0] + int64Column(t, empty, 1)[0]; got != 0 {
+		t.Errorf("expected COUNTs of 0, got %v", got)
+	}
+	for col := 2; col < 6; col++ {
+		if empty.Column(col).IsValid(0) || !empty.Schema().Field(col).Nullable {
+			t.Errorf("expected column %d to be NULL", col)
+		}
+	}
+
+	// NULLs are skipped, and a group with only NULLs aggregates to NULL
+	values := "(VALUES ('a', 1), ('a', NULL), ('a', 3), ('b', NULL)) v(k, x)"
+	grouped := runQuery(t, table, "SELECT k, COUNT(*), COUNT(x), SUM(x), AVG(x), MIN(x) FROM "+values+" GROUP BY k ORDER BY k")
+	if got := fmt.Sprint(int64Column(t, grouped, 1), int64Column(t, grouped, 2)); got != "[3 1] [2 0]" {
+		t.Errorf("unexpected counts %s", got)
+	}
+	for col, want := range map[int]float64{3: 4, 4: 2, 5: 1} {
+		arr := grouped.Column(col)
+		val, err := columnValue(arr, 0)
+		if err != nil || toFloat(val) != want || arr.IsValid(1) {
+			t.Errorf("column %d: expected [%v NULL], got %v", col, want, arr)
+		}
+	}
+	if sum, avg := grouped.Column(3).DataType(), grouped.Column(4).DataType(); sum.ID() != arrow.INT64 || avg.ID() != arrow.FLOAT64 {
+		t.Errorf("expected an integer SUM and a float AVG of integers, got %v and %v", sum, avg)
+	}
+
+	// A NULL HAVING condition drops the group
+	having := runQuery(t, table, "SELECT k FROM "+values+" GROUP BY k HAVING SUM(x) > 0")
+	if got := stringColumn(t, having, 0); fmt.Sprint(got) != "[a]" {
+		t.Errorf("unexpected groups %v", got)
+	}
+
+	if _, err := ExecuteQuery(mustParse(t, "SELECT SUM(*) FROM prices"), table); err == nil {
+		t.Errorf("expected SUM(*) to fail")
+	}
+}
+
+func TestDistinct(t *testing.T) {
+	table := newPricesRecord(t)
+
+	// The highest close of each day
+	top := runQuery(t, table, "SELECT DISTINCT ON (Date) Date, Close FROM prices ORDER BY Date, Close DESC")
+	if got := fmt.Sprint(stringColumn(t, top, 0), float64Column(t, top, 1)); got != "[2020-12-01 2020-12-02 2020-12-03] [900 50 4000]" {
+		t.Errorf("unexpected DISTINCT ON result %s", got)
+	}
+
+	// Keys may be expressions or refer to projection aliases
+	bySize := runQuery(t, table, "SELECT DISTINCT ON (big) Close > 100 AS big, Volume FROM prices ORDER BY Close > 100, Volume")
+	if got := fmt.Sprint(float64Column(t, bySize, 1)); got != "[20 10]" {
+		t.Errorf("unexpected DISTINCT ON result %s", got)
+	}
+
+	days := runQuery(t, table, "SELECT DISTINCT Date FROM prices ORDER BY Date DESC")
+	if got := stringColumn(t, days, 0); fmt.Sprint(got) != "[2020-12-03 2020-12-02 2020-12-01]" {
+		t.Errorf("unexpected DISTINCT result %v", got)
+	}
+
+	// DISTINCT applies after QUALIFY
+	qualified := runQuery(t, table, "SELECT DISTINCT Date FROM prices QUALIFY ROW_NUMBER() OVER (ORDER BY Close) <= 3")
+	if qualified.NumRows() != 2 {
+		t.Errorf("expected 2 dates, got %d", qualified.NumRows())
+	}
+}
+
+func TestJoinStrategies(t *testing.T) {
+	catalog := NewMemoryCatalog()
+	defer catalog.Release()
+	catalog.Register("prices", newPricesRecord(t))
+	catalog.Register("symbols", newSymbolsRecord(t))
+	session := NewSession(catalog)
+
+	run := func(sql string) string {
+		t.Helper()
+		result, err := session.Execute(mustParse(t, sql))
+		if err != nil {
+			t.Fatalf("query %q failed: %v", sql, err)
+		}
+		defer result.Release()
+		return fmt.Sprint(stringColumn(t, result, 0), float64Column(t, result, 1))
+	}
+
+	const query = "SELECT s.Label, p.Close FROM %s p JOIN symbols s ON p.Date = s.Date"
+	want := "[first first third] [900 300 4000]"
+	if got := run(fmt.Sprintf(query, "prices")); got != want {
+		t.Errorf("hash join: got %s, want %s", got, want)
+	}
+
+	// Both inputs are sorted on the key, so they are merged without hashing
+	if got := run(fmt.Sprintf(query, "(SELECT * FROM prices ORDER BY Date, Close DESC)")); got != want {
+		t.Errorf("sorted inputs: got %s, want %s", got, want)
+	}
+
+	// Every strategy the session can force gives the same pairs
+	for _, strategy := range []string{"merge", "nested_loop", "hash", "auto"} {
+		mustExecuteScript(t, session, "SET join_strategy = '"+strategy+"'")
+		if got := run(fmt.Sprintf(query, "prices")); got != want {
+			t.Errorf("join_strategy %s: got %s, want %s", strategy, got, want)
+		}
+	}
+	if _, err := session.Execute(&queryparser.SetStmt{Name: "join_strategy", Value: "broadcast"}); err == nil {
+		t.Errorf("expected an unknown join strategy to fail")
+	}
+
+	unsorted := []join.Key{{Value: "b"}, {Value: "a"}}
+	sorted := []join.Key{{Value: "a"}, {Value: "b"}}
+	for _, tt := range []struct {
+		lk, rk  []join.Key
+		options Options
+		want    string
+	}{
+		{unsorted, sorted, Options{}, joinHash},
+		{sorted, sorted, Options{}, joinMerge},
+		{unsorted, sorted, Options{MemoryLimit: 1 << 20}, joinHash},
+		{unsorted, sorted, Options{MemoryLimit: 100}, joinMerge},
+		{sorted, sorted, Options{JoinStrategy: joinHash}, joinHash},
+	} {
+		if got := chooseJoinStrategy(tt.lk, tt.rk, tt.options); got != tt.want {
+			t.Errorf("chooseJoinStrategy(%v, %v, %+v) = %s, want %s", tt.lk, tt.rk, tt.options, got, tt.want)
+		}
+	}
+}
+
+func TestJoinFilters(t *testing.T) {
+	tables := map[string]array.Record{
+		"prices":  newPricesRecord(t),
+		"symbols": newSymbolsRecord(t),
+	}
+
+	// The keys of the input run first are pushed into the scans of the other,
+	// through the filters and joins above them
+	scan := &scanOp{name: "prices", alias: "p"}
+	probe := &accountedOp{operator: &filterOp{input: scan, condition: &queryparser.Literal{Value: "TRUE", Kind: queryparser.LiteralBool}}}
+	on := &queryparser.BinaryExpr{Left: &queryparser.ColumnRef{Table: "p", Name: "Date"}, Op: "=", Right: &queryparser.ColumnRef{Table: "s", Name: "Date"}}
+	ec := &execContext{ctx: context.Background(), pool: memory.NewGoAllocator()}
+	done, err := pushJoinFilters(on, qualifyRecord(tables["symbols"], "s"), probe, ec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []int64{3, 5} {
+		rec, err := scan.execute(tables, ec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rec.NumRows() != want {
+			t.Errorf("expected the scan to read %d rows, got %d", want, rec.NumRows())
+		}
+		rec.Release()
+		done()
+	}
+
+	// Only inputs whose unmatched rows are dropped are filtered
+	for sql, want := range map[string]string{
+		"SELECT p.Close, s.Label FROM prices p JOIN symbols s ON p.Date = s.Date ORDER BY p.Close":                                         "[[300 first] [900 first] [4000 third]]",
+		"SELECT p.Close, s.Label FROM prices p LEFT JOIN symbols s ON p.Date = s.Date ORDER BY p.Close":                                    "[[20 <nil>] [50 <nil>] [300 first] [900 first] [4000 third]]",
+		"SELECT p.Close, s.Label FROM symbols s RIGHT JOIN prices p ON s.Date = p.Date ORDER BY p.Close":                                   "[[20 <nil>] [50 <nil>] [300 first] [900 first] [4000 third]]",
+		"SELECT p.Close, s.Label FROM symbols s LEFT JOIN prices p ON s.Date = p.Date ORDER BY s.Label":                                    "[[900 first] [300 first] [<nil> ninth] [4000 third]]",
+		"SELECT p.Close, s.Label FROM prices p FULL JOIN symbols s ON p.Date = s.Date ORDER BY s.Label":                                    "[[900 first] [300 first] [<nil> ninth] [4000 third] [20 <nil>] [50 <nil>]]",
+		"SELECT p.Close, t.Label FROM symbols s JOIN prices p ON s.Date = p.Date JOIN symbols t ON p.Date = t.Date AND t.Label <> 'first'": "[[4000 third]]",
+	} {
+		rows, err := recordRows(runQueryWithTables(t, tables, sql))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(rows); got != want {
+			t.Errorf("%s: got %s, want %s", sql, got, want)
+		}
+	}
+}
+
+func TestLateMaterialization(t *testing.T) {
+	tables := map[string]array.Record{
+		"prices":  newPricesRecord(t),
+		"symbols": newSymbolsRecord(t),
+	}
+
+	// A filter selects rows of its input's record instead of copying them
+	ec := &execContext{ctx: context.Background(), pool: memory.NewGoAllocator()}
+	filter := &accountedOp{operator: &filterOp{
+		input:     &scanOp{name: "prices", alias: "p"},
+		condition: mustParse(t, "SELECT * FROM prices WHERE Close > 100").Where,
+	}}
+	rec, rows, err := executeSelection(filter, tables, ec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rec.Release()
+	if rec.NumRows() != 5 || fmt.Sprint(rows) != "[0 2 3]" {
+		t.Errorf("expected rows [0 2 3] of 5, got %v of %d", rows, rec.NumRows())
+	}
+	keys, err := selectedColumns(rec, rows, mustParse(t, "SELECT * FROM t WHERE p.close = s.Date").Where, ec.pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer keys.Release()
+	// s.Date is another table's, but a column of the same name is kept
+	if keys.NumCols() != 2 || keys.NumRows() != 3 || keys.Schema().Field(0).Name != "Date" || keys.Schema().Field(1).Name != "Close" {
+		t.Errorf("expected the 3 selected rows of Date and Close, got %d rows of %v", keys.NumRows(), keys.Schema())
+	}
+
+	// Joins read the selected rows of their inputs
+	for sql, want := range map[string]string{
+		"SELECT p.Close, s.Label FROM prices p JOIN symbols s ON p.Date = s.Date WHERE p.Close > 500 ORDER BY p.Close":                    "[[900 first] [4000 third]]",
+		"SELECT p.Close, s.Label FROM prices p LEFT JOIN symbols s ON p.Date = s.Date WHERE p.Volume >= 30 ORDER BY p.Close":              "[[50 <nil>] [300 first] [4000 third]]",
+		"SELECT p.Close, s.Label FROM symbols s RIGHT JOIN prices p ON s.Date = p.Date WHERE s.Label <> 'third' ORDER BY p.Close":         "[[300 first] [900 first]]",
+		"SELECT s.Label, p.Close FROM symbols s CROSS JOIN prices p WHERE s.Label = 'ninth' AND p.Close < 100 ORDER BY p.Close":           "[[ninth 20] [ninth 50]]",
+		"SELECT p.Close, s.Label FROM prices p JOIN symbols s ON p.Date = s.Date AND p.Close < 1000 WHERE s.Label < 'z' ORDER BY p.Close": "[[300 first] [900 first]]",
+		"SELECT COUNT(*) FROM prices p JOIN symbols s ON p.Date = s.Date WHERE p.Close > 100000":                                          "[[0]]",
+	} {
+		rows, err := recordRows(runQueryWithTables(t, tables, sql))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(rows); got != want {
+			t.Errorf("%s: got %s, want %s", sql, got, want)
+		}
+	}
+}
+
+func TestPlanCache(t *testing.T) {
+	catalog := NewMemoryCatalog()
+	defer catalog.Release()
+	catalog.Register("prices", newPricesRecord(t))
+	catalog.Register("symbols", newSymbolsRecord(t))
+	session := NewSession(catalog)
+	tables := map[string]array.Record{"prices": newPricesRecord(t), "symbols": newSymbolsRecord(t)}
+
+	query := func(sql string) (string, *cachedPlan) {
+		t.Helper()
+		result, err := session.Query(sql)
+		if err != nil {
+			t.Fatalf("%s: %v", sql, err)
+		}
+		defer result.Release()
+		rows, err := recordRows(result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fingerprint, literals, err := queryparser.Fingerprint(sql)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprint(rows), session.plans.plans[planKey(fingerprint, literals, session.options)]
+	}
+
+	// The queries of each group differ only in their constants, so they run
+	// the plan of the first, and give what planning each afresh would
+	for _, group := range [][]string{
+		{
+			"SELECT Date, Close * 2 FROM prices WHERE Close > 100 ORDER BY Close",
+			"select Date, Close * 2 from prices where Close > 1000 order by Close",
+			"SELECT Date,  Close * 3 FROM prices WHERE Close > 10 ORDER BY Close -- comment",
+		},
+		{
+			"SELECT Date, COUNT(*) FROM prices WHERE Date IN ('2020-12-01', '2020-12-02') GROUP BY Date ORDER BY Date",
+			"SELECT Date, COUNT(*) FROM prices WHERE Date IN ('2020-12-03', '2020-12-02') GROUP BY Date ORDER BY Date",
+		},
+		{
+			"SELECT p.Close, s.Label FROM prices p JOIN symbols s ON p.Date = s.Date AND s.Label <> 'first' ORDER BY p.Close",
+			"SELECT p.Close, s.Label FROM prices p JOIN symbols s ON p.Date = s.Date AND s.Label <> 'second' ORDER BY p.Close",
+		},
+		{
+			"SELECT Close FROM prices WHERE Volume BETWEEN 15 AND 35 AND Date LIKE '%-01'",
+			"SELECT Close FROM prices WHERE Volume BETWEEN 5 AND 55 AND Date LIKE '%-02'",
+		},
+		{
+			"WITH big AS (SELECT * FROM prices WHERE Close > 100) SELECT COUNT(*) FROM big WHERE Volume < (SELECT MAX(Volume) - 10 FROM prices)",
+			"WITH big AS (SELECT * FROM prices WHERE Close > 10) SELECT COUNT(*) FROM big WHERE Volume < (SELECT MAX(Volume) - 25 FROM prices)",
+		},
+		{
+			"SELECT Date, SUM(Close) FROM prices GROUP BY Date HAVING SUM(Close) > 1000 ORDER BY Date",
+			"SELECT Date, SUM(Close) FROM prices GROUP BY Date HAVING SUM(Close) > 50 ORDER BY Date",
+		},
+	} {
+		var op operator
+		for _, sql := range group {
+			got, plan := query(sql)
+			if want, _ := recordRows(runQueryWithTables(t, tables, sql)); got != fmt.Sprint(want) {
+				t.Errorf("%s: got %s, want %v", sql, got, want)
+			}
+			if plan == nil {
+				t.Fatalf("%s: plan was not cached", sql)
+			}
+			if op == nil {
+				op = plan.op
+			} else if plan.op != op {
+				t.Errorf("%s: was planned again", sql)
+			}
+		}
+	}
+
+	// GROUP BY positions and window frame offsets are part of the plan
+	for sql, want := range map[string]string{
+		"SELECT SUM(Close) OVER (ORDER BY Volume ROWS BETWEEN 1 PRECEDING AND CURRENT ROW) FROM prices": "[[900] [920] [320] [4300] [4050]]",
+		"SELECT SUM(Close) OVER (ORDER BY Volume ROWS BETWEEN 2 PRECEDING AND CURRENT ROW) FROM prices": "[[900] [920] [1220] [4320] [4350]]",
+	} {
+		if got, _ := query(sql); got != want {
+			t.Errorf("%s: got %s, want %s", sql, got, want)
+		}
+	}
+	if got, _ := query("SELECT Date, Close > 100 FROM prices GROUP BY 1, 2 ORDER BY Date"); got != "[[2020-12-01 true] [2020-12-02 false] [2020-12-03 true]]" {
+		t.Errorf("unexpected groups %s", got)
+	}
+	if got, _ := query("SELECT Date, Close > 100 FROM prices GROUP BY 2, 2 ORDER BY Date"); got != "[[2020-12-01 true] [2020-12-02 false]]" {
+		t.Errorf("unexpected groups by another position %s", got)
+	}
+
+	// Changing the rows of a table keeps the plans that read it, and
+	// changing the catalog's schema drops them
+	sql := "SELECT COUNT(*) FROM prices WHERE Close > 100"
+	_, before := query(sql)
+	mustExecuteScript(t, session, "INSERT INTO prices VALUES ('2020-12-04', 7000, 70)")
+	if got, plan := query(sql); got != "[[4]]" || plan != before {
+		t.Errorf("after INSERT: got %s, planned again %v", got, plan != before)
+	}
+	mustExecuteScript(t, session, "CREATE TABLE big AS SELECT * FROM prices WHERE Close > 1000")
+	if got, plan := query(sql); got != "[[4]]" || plan == before {
+		t.Errorf("after CREATE TABLE: got %s, planned again %v", got, plan != before)
+	}
+}
+
+func TestPreparedStatements(t *testing.T) {
+	catalog := NewMemoryCatalog()
+	defer catalog.Release()
+	catalog.Register("prices", newPricesRecord(t))
+	session := NewSession(catalog)
+
+	run := func(stmt *PreparedStatement, args ...interface{}) string {
+		t.Helper()
+		result, err := stmt.Execute(args...)
+		if err != nil {
+			t.Fatalf("%v: %v", args, err)
+		}
+		defer result.Release()
+		rows, err := recordRows(result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprint(rows)
+	}
+
+	stmt, err := session.Prepare(mustParse(t, "SELECT Date, Close FROM prices WHERE Close > $1 AND Date <> $2 ORDER BY Close"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stmt.NumParams() != 2 {
+		t.Errorf("expected 2 parameters, got %d", stmt.NumParams())
+	}
+	for _, tc := range []struct {
+		args []interface{}
+		want string
+	}{
+		{[]interface{}{100, "2020-12-03"}, "[[2020-12-01 300] [2020-12-01 900]]"},
+		{[]interface{}{int64(20), "x"}, "[[2020-12-02 50] [2020-12-01 300] [2020-12-01 900] [2020-12-03 4000]]"},
+		{[]interface{}{299.5, "2020-12-01"}, "[[2020-12-03 4000]]"},
+		{[]interface{}{float32(1), "2020-12-02"}, "[[2020-12-01 300] [2020-12-01 900] [2020-12-03 4000]]"},
+		{[]interface{}{nil, "x"}, "[]"},
+	} {
+		if got := run(stmt, tc.args...); got != tc.want {
+			t.Errorf("%v: got %s, want %s", tc.args, got, tc.want)
+		}
+	}
+	// Integers, floats and NULL each have a plan of their own
+	if len(stmt.plans.plans) != 3 {
+		t.Errorf("expected 3 plans, got %d", len(stmt.plans.plans))
+	}
+
+	// A parameter may be used more than once
+	stmt, err = session.Prepare(mustParse(t, "SELECT COUNT(*), $1 * 2 FROM prices WHERE Volume BETWEEN $2 AND $3 OR Volume = $1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := run(stmt, 50, 15, 35); got != "[[3 100]]" {
+		t.Errorf("unexpected result %s", got)
+	}
+	if got := run(stmt, 10, 15, 35); got != "[[3 20]]" {
+		t.Errorf("unexpected result %s", got)
+	}
+
+	if _, err := stmt.Execute(1, 2); err == nil {
+		t.Errorf("expected too few values to fail")
+	}
+	if _, err := stmt.Execute(1, 2, []int{3}); err == nil {
+		t.Errorf("expected a value of an unsupported type to fail")
+	}
+	if _, err := session.Prepare(mustParse(t, "SELECT Close FROM prices WHERE Close > $2")); err == nil {
+		t.Errorf("expected leaving out $1 to fail")
+	}
+	if _, err := session.Execute(mustParse(t, "SELECT Close FROM prices WHERE Close > $1")); err == nil || !strings.Contains(err.Error(), "no value given for parameter $1") {
+		t.Errorf("expected running a query with parameters unprepared to fail, got %v", err)
+	}
+}
+
+func TestExecuteQueryWithCatalog(t *testing.T) {
+	catalog := NewMemoryCatalog()
+	defer catalog.Release()
+	catalog.Register("prices", newPricesRecord(t))
+	catalog.Register("Symbols", newSymbolsRecord(t))
+
+	for sql, want := range map[string]string{
+		"SELECT p.Close, s.Label FROM prices p JOIN symbols s ON p.Date = s.Date ORDER BY p.Close":   "[[300 first] [900 first] [4000 third]]",
+		"WITH prices AS (SELECT Date FROM symbols) SELECT COUNT(*) FROM prices":                      "[[3]]",
+		"SELECT COUNT(*) FROM prices WHERE Date IN (SELECT Date FROM symbols WHERE Label = 'third')": "[[1]]",
+		"SELECT COUNT(*) FROM (SELECT Date FROM symbols UNION SELECT Date FROM prices) d":            "[[4]]",
+	} {
+		// A Catalog without Tables has its tables read one at a time
+		for _, c := range []Catalog{catalog, struct{ Catalog }{catalog}} {
+			result, err := ExecuteQueryWithCatalog(mustParse(t, sql), c)
+			if err != nil {
+				t.Fatalf("%s: %v", sql, err)
+			}
+			rows, err := recordRows(result)
+			result.Release()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := fmt.Sprint(rows); got != want {
+				t.Errorf("%s: got %s, want %s", sql, got, want)
+			}
+		}
+	}
+
+	for sql, want := range map[string]string{
+		"SELECT Close FROM missing":                                       "table missing not found",
+		"SELECT Close FROM prices JOIN other ON prices.Date = other.Date": "table other not found",
+	} {
+		if _, err := ExecuteQueryWithCatalog(mustParse(t, sql), catalog); err == nil || err.Error() != want {
+			t.Errorf("%s: expected %q, got %v", sql, want, err)
+		}
+	}
+}
+
+func TestSnapshotReads(t *testing.T) {
+	catalog := NewMemoryCatalog()
+	defer catalog.Release()
+	catalog.Register("prices", newPricesRecord(t))
+	catalog.Register("symbols", newSymbolsRecord(t))
+	writer := NewSession(catalog)
+
+	// Each statement keeps the sum of Volume at 150 and the number of rows
+	// odd, which a query seeing part of one would not
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			stmts, err := queryparser.NewParser(`
+				INSERT INTO prices VALUES ('2020-12-01', 1, 7), ('2020-12-01', 2, -7);
+				UPDATE prices SET Volume = -Volume WHERE Volume IN (7, -7);
+				DELETE FROM prices WHERE Volume IN (7, -7)
+			`).ParseScript()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for _, stmt := range stmts {
+				if _, err := writer.Execute(stmt); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}
+	}()
+
+	readers := []func(string) (array.Record, error){
+		NewSession(catalog).Query,
+		func(sql string) (array.Record, error) {
+			return ExecuteQueryWithCatalog(mustParse(t, sql), catalog)
+		},
+	}
+	for _, read := range readers {
+		for i := 0; i < 200; i++ {
+			result, err := read("SELECT SUM(p.Volume), COUNT(*), (SELECT COUNT(*) FROM prices) FROM prices p JOIN symbols s ON p.Date = s.Date OR TRUE")
+			if err != nil {
+				t.Fatal(err)
+			}
+			rows, err := recordRows(result)
+			result.Release()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sum, joined, count := rows[0][0], rows[0][1].(int64), rows[0][2].(int64)
+			if sum != 450.0 || count%2 != 1 || joined != 3*count {
+				t.Fatalf("read a partial write: %v", rows)
+			}
+		}
+	}
+	close(done)
+	wg.Wait()
+}
+
+func TestNonEquiJoin(t *testing.T) {
+	tables := map[string]array.Record{"prices": newPricesRecord(t)}
+
+	// Each price falls into the one band whose range contains it
+	bands := "(VALUES ('low', 0, 100), ('mid', 100, 1000), ('high', 1000, 10000)) b(label, lo, hi)"
+	result := runQueryWithTables(t, tables,
+		"SELECT p.Close, b.label FROM prices p JOIN "+bands+" ON p.Close BETWEEN b.lo AND b.hi - 1 ORDER BY p.Close")
+	if got := fmt.Sprint(float64Column(t, result, 0), stringColumn(t, result, 1)); got != "[20 50 300 900 4000] [low low mid mid high]" {
+		t.Errorf("unexpected range join result %s", got)
+	}
+
+	// Unmatched rows are padded as with an equi-join
+	left := runQueryWithTables(t, tables, "SELECT p.Close, b.label FROM prices p LEFT JOIN "+bands+" ON p.Close > b.hi")
+	if left.NumRows() != 6 || left.Column(1).NullN() != 2 {
+		t.Errorf("expected 6 rows with 2 padded, got %d rows with %d NULLs", left.NumRows(), left.Column(1).NullN())
+	}
+}
+
+func TestOffsetAndRollingWindows(t *testing.T) {
+	table := newPricesRecord(t)
+
+	// Close by Volume: 900, 20, 300, 4000, 50
+	result := runQuery(t, table, `SELECT Volume,
+		LAG(Close) OVER (ORDER BY Volume),
+		LEAD(Close, 2, 0) OVER (ORDER BY Volume),
+		AVG(Close) OVER (ORDER BY Volume ROWS BETWEEN 1 PRECEDING AND CURRENT ROW),
+		MAX(Close) OVER (ORDER BY Volume ROWS BETWEEN CURRENT ROW AND 1 FOLLOWING),
+		COUNT(Close) OVER (ORDER BY Volume ROWS BETWEEN 2 FOLLOWING AND UNBOUNDED FOLLOWING),
+		SUM(Close) OVER (ORDER BY Volume ROWS 2 PRECEDING)
+		FROM prices ORDER BY Volume`)
+
+	lag := result.Column(1).(*array.Float64)
+	if lag.IsValid(0) || lag.Value(1) != 900 || lag.Value(4) != 4000 {
+		t.Errorf("unexpected LAG %v", lag)
+	}
+	want := map[int]string{
+		2: "[300 4000 50 0 0]",
+		3: "[900 460 160 2150 2025]",
+		4: "[900 300 4000 4000 50]",
+		6: "[900 920 1220 4320 4350]",
+	}
+	for col, w := range want {
+		if got := fmt.Sprint(float64Column(t, result, col)); got != w {
+			t.Errorf("column %d: got %s, want %s", col, got, w)
+		}
+	}
+	if got := fmt.Sprint(int64Column(t, result, 5)); got != "[3 2 1 0 0]" {
+		t.Errorf("COUNT: got %s, want [3 2 1 0 0]", got)
+	}
+
+	// A frame with no rows aggregates to NULL
+	empty := runQuery(t, table, "SELECT SUM(Close) OVER (ORDER BY Volume ROWS BETWEEN 3 PRECEDING AND 2 PRECEDING) FROM prices ORDER BY Volume")
+	if col := empty.Column(0); col.NullN() != 2 || col.IsValid(0) || col.IsValid(1) {
+		t.Errorf("expected the first two frames to be empty, got %v", col)
+	}
+}
+
+func TestRangeFrames(t *testing.T) {
+	table := newPricesRecord(t)
+
+	// Close by Volume: 900, 20, 300, 4000, 50; Date by Volume: 12-01, 12-02, 12-01, 12-03, 12-02
+	for sql, want := range map[string]string{
+		"SELECT Volume, SUM(Close) OVER (ORDER BY Volume RANGE BETWEEN 25 PRECEDING AND 0 FOLLOWING) FROM prices ORDER BY Volume":                                                                "[[10 900] [20 920] [30 1220] [40 4320] [50 4350]]",
+		"SELECT Volume, SUM(Close) OVER (ORDER BY Volume DESC RANGE BETWEEN CURRENT ROW AND 10 FOLLOWING) FROM prices ORDER BY Volume":                                                           "[[10 900] [20 920] [30 320] [40 4300] [50 4050]]",
+		"SELECT Volume, COUNT(*) OVER (ORDER BY Volume RANGE BETWEEN 15.5 FOLLOWING AND UNBOUNDED FOLLOWING) FROM prices ORDER BY Volume":                                                        "[[10 3] [20 2] [30 1] [40 0] [50 0]]",
+		"SELECT Volume, COUNT(*) OVER (ORDER BY Date RANGE UNBOUNDED PRECEDING) FROM prices ORDER BY Volume":                                                                                     "[[10 2] [20 4] [30 2] [40 5] [50 4]]",
+		"SELECT Volume, COUNT(*) OVER (ORDER BY CAST(Date AS DATE) RANGE INTERVAL '1 day' PRECEDING) FROM prices ORDER BY Volume":                                                                "[[10 2] [20 4] [30 2] [40 3] [50 4]]",
+		"SELECT x, SUM(x) OVER (ORDER BY x RANGE BETWEEN 1 PRECEDING AND 1 FOLLOWING), COUNT(*) OVER (ORDER BY x RANGE 1 PRECEDING) FROM (VALUES (1), (2), (NULL), (4), (NULL)) v(x) ORDER BY x": "[[1 3 1] [2 3 2] [4 4 1] [<nil> <nil> 2] [<nil> <nil> 2]]",
+	} {
+		rows, err := recordRows(runQuery(t, table, sql))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(rows); got != want {
+			t.Errorf("%s: got %s, want %s", sql, got, want)
+		}
+	}
+
+	for _, sql := range []string{
+		"SELECT SUM(Close) OVER (ORDER BY Volume, Close RANGE 1 PRECEDING) FROM prices",
+		"SELECT SUM(Close) OVER (ORDER BY Date RANGE 1 PRECEDING) FROM prices",
+		"SELECT COUNT(*) OVER (ORDER BY CAST(Date AS TIMESTAMP) RANGE 1 PRECEDING) FROM prices",
+	} {
+		if _, err := ExecuteQuery(mustParse(t, sql), table); err == nil {
+			t.Errorf("expected %q to fail", sql)
+		}
+	}
+}
+
+func TestPivot(t *testing.T) {
+	table := newPricesRecord(t)
+
+	const sales = "(SELECT col0 AS k, col1 AS q, col2 AS v FROM (VALUES ('a', 'q1', 1), ('a', 'q2', 2), ('b', 'q1', 3), ('a', 'q1', 4), ('b', 'q4', 5)))"
+	for sql, want := range map[string]string{
+		"SELECT * FROM " + sales + " PIVOT (SUM(v) FOR q IN ('q1', 'q2', 'q3')) p ORDER BY k":                                                      "[[a 5 2 <nil>] [b 3 <nil> <nil>]]",
+		"SELECT k, first_n, q2_total FROM " + sales + " PIVOT (SUM(v) AS total, COUNT(*) AS n FOR q IN ('q1' AS first, 'q2')) p ORDER BY k":        "[[a 2 2] [b 1 <nil>]]",
+		"SELECT SUM(d1), SUM(d3) FROM prices PIVOT (SUM(Volume) FOR Date IN ('2020-12-01' AS d1, '2020-12-03' AS d3)) p":                           "[[40 40]]",
+		"SELECT COUNT(*) FROM prices JOIN prices PIVOT (COUNT(*) FOR Date IN ('2020-12-01' AS d1)) p ON prices.Volume = p.Volume WHERE p.d1 = 1":   "[[2]]",
+		"SELECT Date, metric, val FROM prices UNPIVOT (val FOR metric IN (Close, Volume)) u WHERE Date = '2020-12-02' ORDER BY metric, val":        "[[2020-12-02 Close 20] [2020-12-02 Close 50] [2020-12-02 Volume 20] [2020-12-02 Volume 50]]",
+		"SELECT COUNT(*) FROM prices WHERE Volume IN (SELECT Volume FROM prices PIVOT (COUNT(*) FOR Date IN ('2020-12-01' AS d1)) p WHERE d1 = 1)": "[[2]]",
+		"SELECT * FROM (SELECT col0 AS k, col1 AS x, col2 AS y FROM (VALUES ('a', 1, NULL), ('b', 2, 3))) UNPIVOT (v FOR c IN (x, y)) u":           "[[a x 1] [b x 2] [b y 3]]",
+	} {
+		rows, err := recordRows(runQuery(t, table, sql))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(rows); got != want {
+			t.Errorf("%s: got %s, want %s", sql, got, want)
+		}
+	}
+
+	rec := runQuery(t, table, "SELECT * FROM "+sales+" PIVOT (SUM(v) AS total, COUNT(*) AS n FOR q IN ('q1' AS first, 'q2')) p")
+	var names []string
+	for _, f := range rec.Schema().Fields() {
+		names = append(names, f.Name)
+	}
+	if got, want := fmt.Sprint(names), "[k first_total first_n q2_total q2_n]"; got != want {
+		t.Errorf("got columns %s, want %s", got, want)
+	}
+
+	for _, sql := range []string{
+		"SELECT * FROM prices PIVOT (Close FOR Date IN ('2020-12-01')) p",
+		"SELECT * FROM prices PIVOT (SUM(Close) FOR Day IN ('2020-12-01')) p",
+		"SELECT * FROM prices UNPIVOT (val FOR metric IN (Date, Close)) u",
+		"SELECT * FROM prices UNPIVOT (val FOR metric IN (Close, Close)) u",
+		"SELECT Close FROM prices UNPIVOT (val FOR metric IN (Close, Volume)) u",
+	} {
+		if _, err := ExecuteQuery(mustParse(t, sql), table); err == nil {
+			t.Errorf("expected %q to fail", sql)
+		}
+	}
+}
+
+func TestUnnest(t *testing.T) {
+	table := newPricesRecord(t)
+
+	const lists = "WITH t AS (SELECT g, ARRAY_AGG(n) AS l FROM (VALUES (1, 10), (1, 20), (2, 30)) v(g, n) GROUP BY g) "
+	for sql, want := range map[string]string{
+		lists + "SELECT g, UNNEST(l) FROM t ORDER BY g, unnest DESC":                                                                                                      "[[1 20] [1 10] [2 30]]",
+		lists + "SELECT g, UNNEST(l) + 1 AS x, UNNEST(l) * 2 FROM t ORDER BY x DESC":                                                                                      "[[2 31 60] [1 21 40] [1 11 20]]",
+		lists + "SELECT SUM(UNNEST(l)) FROM t":                                                                                                                            "[[60]]",
+		lists + "SELECT g, x, i FROM t CROSS JOIN UNNEST(t.l) WITH ORDINALITY AS u(x, i) ORDER BY g, i":                                                                   "[[1 10 1] [1 20 2] [2 30 1]]",
+		lists + "SELECT g, x FROM t LEFT JOIN UNNEST(l) AS x ON x > 15 ORDER BY g, x":                                                                                     "[[1 20] [2 30]]",
+		lists + "SELECT g, x FROM t LEFT JOIN UNNEST(l) AS x ON x > 25 ORDER BY g":                                                                                        "[[1 <nil>] [2 30]]",
+		lists + "SELECT g, u.v FROM t JOIN UNNEST(l) u(v) ON u.v < 25 ORDER BY g, u.v":                                                                                    "[[1 10] [1 20]]",
+		"SELECT * FROM UNNEST((SELECT ARRAY_AGG(Volume) FROM prices), (SELECT ARRAY_AGG(Close) FROM prices WHERE Close > 100))":                                           "[[10 900] [20 300] [30 4000] [40 <nil>] [50 <nil>]]",
+		"SELECT COUNT(*) FROM prices WHERE Volume IN (SELECT x FROM UNNEST((SELECT ARRAY_AGG(Volume) FROM prices WHERE Volume < 35)) x)":                                  "[[3]]",
+		"SELECT COUNT(*) FROM prices WHERE EXISTS (SELECT 1 FROM (SELECT ARRAY_AGG(Volume) AS l FROM prices) a CROSS JOIN UNNEST(a.l) AS x WHERE x = prices.Volume + 10)": "[[4]]",
+	} {
+		// The tables are named, as a query in UNNEST reads them
+		rows, err := recordRows(runQueryWithTables(t, map[string]array.Record{"prices": table}, sql))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(rows); got != want {
+			t.Errorf("%s: got %s, want %s", sql, got, want)
+		}
+	}
+
+	rec := runQuery(t, table, lists+"SELECT UNNEST(l), * FROM t CROSS JOIN UNNEST(l, l) WITH ORDINALITY")
+	var names []string
+	for _, f := range rec.Schema().Fields() {
+		names = append(names, f.Name)
+	}
+	if got, want := fmt.Sprint(names), "[unnest g l unnest1 unnest2 ordinality]"; got != want {
+		t.Errorf("got columns %s, want %s", got, want)
+	}
+
+	for _, sql := range []string{
+		"SELECT * FROM prices CROSS JOIN UNNEST(Close) u",
+		"SELECT Close FROM prices WHERE UNNEST(Close) > 1",
+		"SELECT UNNEST(ARRAY_AGG(Close)) FROM prices",
+		"SELECT UNNEST(Close, Volume) FROM prices",
+		"SELECT * FROM UNNEST(Close)",
+		"SELECT * FROM prices CROSS JOIN UNNEST((SELECT ARRAY_AGG(Close) FROM prices)) u(a, b)",
+	} {
+		if _, err := ExecuteQuery(mustParse(t, sql), table); err == nil {
+			t.Errorf("expected %q to fail", sql)
+		}
+	}
+}
+
+func TestNestedTypes(t *testing.T) {
+	pool := memory.NewGoAllocator()
+	payloads := []interface{}{
+		structValue{names: []string{"price", "qty", "meta"}, values: []interface{}{1.5, int64(2), structValue{names: []string{"source"}, values: []interface{}{"web"}}}},
+		structValue{names: []string{"price", "qty", "meta"}, values: []interface{}{3.0, int64(1), structValue{names: []string{"source"}, values: []interface{}{"app"}}}},
+		nil,
+	}
+	tags := []interface{}{list{"a", "b"}, list{"c"}, nil}
+	var cols []array.Interface
+	var fields []arrow.Field
+	for _, c := range []struct {
+		name string
+		vals []interface{}
+	}{
+		{"id", []interface{}{int64(1), int64(2), int64(3)}},
+		{"payload", payloads},
+		{"tags", tags},
+	} {
+		dt := inferType(c.vals)
+		col, err := buildArray(pool, dt, c.vals)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer col.Release()
+		cols = append(cols, col)
+		fields = append(fields, arrow.Field{Name: c.name, Type: dt, Nullable: true})
+	}
+	events := array.NewRecord(arrow.NewSchema(fields, nil), cols, 3)
+	defer events.Release()
+	tables := map[string]array.Record{"events": events}
+
+	for sql, want := range map[string]string{
+		"SELECT id, payload.price FROM events ORDER BY id":                                                        "[[1 1.5] [2 3] [3 <nil>]]",
+		"SELECT e.payload.qty * 2 FROM events e WHERE payload.price > 2":                                          "[[2]]",
+		"SELECT payload.meta.source, tags[1], tags[2] FROM events ORDER BY id":                                    "[[web a b] [app c <nil>] [<nil> <nil> <nil>]]",
+		"SELECT SUM(payload.qty), ARRAY_AGG(id)[3] FROM events":                                                   "[[3 3]]",
+		"SELECT payload.meta.source AS source, COUNT(*) FROM events WHERE id < 3 GROUP BY source ORDER BY source": "[[app 1] [web 1]]",
+		"SELECT payload, tags FROM events WHERE id = 1":                                                           "[[{price: 1.5, qty: 2, meta: {source: web}} [a, b]]]",
+		"SELECT CAST(payload AS VARCHAR) FROM events WHERE id = 2":                                                "[[{price: 3, qty: 1, meta: {source: app}}]]",
+		"SELECT COUNT(DISTINCT payload) FROM events":                                                              "[[2]]",
+		"SELECT id FROM events WHERE id IN (SELECT payload.qty FROM events)":                                      "[[1] [2]]",
+		"SELECT id FROM events WHERE tags IN (tags) ORDER BY id":                                                  "[[1] [2]]",
+		"SELECT id FROM events WHERE payload IN (payload) ORDER BY id":                                            "[[1] [2]]",
+		"SELECT e.id FROM events e, events f WHERE f.id = 2 AND e.tags NOT IN (f.tags)":                           "[[1]]",
+		"SELECT e.id FROM events e, events f WHERE f.id = 1 AND e.payload.meta IN (f.payload.meta, NULL)":         "[[1]]",
+	} {
+		rows, err := recordRows(runQueryWithTables(t, tables, sql))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(rows); got != want {
+			t.Errorf("%s: got %s, want %s", sql, got, want)
+		}
+	}
+
+	rec := runQueryWithTables(t, tables, "SELECT payload.price, payload.meta.source, tags[1] FROM events")
+	var names []string
+	for _, f := range rec.Schema().Fields() {
+		names = append(names, f.Name)
+	}
+	if got, want := fmt.Sprint(names), "[price source expr_2]"; got != want {
+		t.Errorf("got columns %s, want %s", got, want)
+	}
+	if got, err := FormatValue(events.Column(1), 0); err != nil || got != "{price: 1.5, qty: 2, meta: {source: web}}" {
+		t.Errorf("FormatValue = %q, %v", got, err)
+	}
+
+	for _, sql := range []string{
+		"SELECT payload.missing FROM events",
+		"SELECT id.price FROM events",
+		"SELECT id[1] FROM events",
+		"SELECT tags['a'] FROM events",
+	} {
+		if _, err := ExecuteQueryWithTables(mustParse(t, sql), tables); err == nil {
+			t.Errorf("expected %q to fail", sql)
+		}
+	}
+}
+
+func TestExecuteStream(t *testing.T) {
+	// batches reads rec back as a reader of batches of two rows
+	batches := func(rec array.Record) array.RecordReader {
+		var recs []array.Record
+		for i := int64(0); i < rec.NumRows(); i += 2 {
+			slice := rec.NewSlice(i, min(i+2, rec.NumRows()))
+			defer slice.Release()
+			recs = append(recs, slice)
+		}
+		reader, err := array.NewRecordReader(rec.Schema(), recs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reader
+	}
+	stream := func(table array.Record, sql string) (*arrow.Schema, [][]interface{}) {
+		t.Helper()
+		input := batches(table)
+		defer input.Release()
+		result, err := ExecuteStream(mustParse(t, sql), input)
+		if err != nil {
+			t.Fatalf("streaming %q failed: %v", sql, err)
+		}
+		defer result.Release()
+		var rows [][]interface{}
+		for result.Next() {
+			batch, err := recordRows(result.Record())
+			if err != nil {
+				t.Fatal(err)
+			}
+			rows = append(rows, batch...)
+		}
+		if err := result.Err(); err != nil {
+			t.Fatalf("streaming %q failed: %v", sql, err)
+		}
+		return result.Schema(), rows
+	}
+
+	prices := newPricesRecord(t)
+	for _, sql := range []string{
+		"SELECT Date, Close * 2 AS c FROM prices WHERE Close > 100",
+		"SELECT * EXCLUDE (Volume) FROM prices p WHERE p.Volume <> 30",
+		"SELECT Date, COUNT(*), AVG(Close) AS a FROM prices GROUP BY Date HAVING SUM(Volume) > 20 ORDER BY AVG(Close) DESC",
+		"SELECT MAX(Close) - MIN(Close), COUNT(Volume) FROM prices",
+		"SELECT SUM(Close), COUNT(*) FROM prices WHERE Close > 10000",
+		"SELECT DISTINCT COUNT(*) FROM prices GROUP BY Date",
+		"SELECT COUNT(DISTINCT Date), SUM(DISTINCT Volume) FROM prices",
+		"SELECT Date, VAR_POP(Volume), MEDIAN(Close) FROM prices GROUP BY Date ORDER BY Date",
+		"SELECT Date, STRING_AGG(DISTINCT Close), ARRAY_AGG(Volume) FROM prices GROUP BY Date ORDER BY Date",
+		"SELECT Date, FIRST(Close), LAST(Close), ARG_MAX(Close, Volume), ARG_MIN(Volume, Close) FROM prices GROUP BY Date ORDER BY Date",
+	} {
+		schema, got := stream(prices, sql)
+		want := runQuery(t, prices, sql)
+		wantRows, err := recordRows(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !schema.Equal(want.Schema()) {
+			t.Errorf("%s: streamed schema %s, want %s", sql, schema, want.Schema())
+		}
+		if fmt.Sprint(got) != fmt.Sprint(wantRows) {
+			t.Errorf("%s: streamed %v, want %v", sql, got, wantRows)
+		}
+	}
+
+	// A batch whose values are all NULL takes the type of the first batch
+	session := NewSession(NewMemoryCatalog())
+	mustExecuteScript(t, session, "CREATE TABLE t AS SELECT * FROM (VALUES ('a'), ('b'), (NULL), (NULL), ('e')) v(s)")
+	table, err := session.Catalog().Table("t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Release()
+	if schema, got := stream(table, "SELECT UPPER(s) FROM t"); schema.Field(0).Type.ID() != arrow.STRING || fmt.Sprint(got) != "[[A] [B] [<nil>] [<nil>] [E]]" {
+		t.Errorf("got %s %v", schema, got)
+	}
+
+	for _, sql := range []string{
+		"SELECT Date FROM prices ORDER BY Close",
+		"SELECT * FROM prices JOIN symbols ON prices.Date = symbols.Date",
+		"SELECT Close, ROW_NUMBER() OVER (ORDER BY Close) FROM prices",
+		"SELECT Date FROM prices WHERE Close > (SELECT AVG(Close) FROM prices)",
+	} {
+		input := batches(prices)
+		if _, err := ExecuteStream(mustParse(t, sql), input); err == nil || !strings.Contains(err.Error(), "cannot be streamed") {
+			t.Errorf("%s: expected it not to stream, got %v", sql, err)
+		}
+		input.Release()
+	}
+
+	for _, sql := range []string{"SELECT Close * 2 FROM prices", "SELECT Date, SUM(Close) FROM prices GROUP BY Date"} {
+		input := batches(prices)
+		result, err := ExecuteStreamWithOptions(mustParse(t, sql), input, Options{MemoryLimit: 1})
+		if err == nil {
+			for result.Next() {
+			}
+			err = result.Err()
+			result.Release()
+		}
+		if err == nil || !strings.Contains(err.Error(), "memory limit exceeded in Project") {
+			t.Errorf("%s: expected a memory limit error, got %v", sql, err)
+		}
+		input.Release()
+	}
+}
+
+func TestParallelExecution(t *testing.T) {
+	defer func(size int) { morselSize = size }(morselSize)
+	morselSize = 2
+
+	catalog := NewMemoryCatalog()
+	defer catalog.Release()
+	catalog.Register("prices", newPricesRecord(t))
+	session := NewSession(catalog)
+
+	run := func(sql string) string {
+		t.Helper()
+		result, err := session.Execute(mustParse(t, sql))
+		if err != nil {
+			t.Fatalf("query %q failed: %v", sql, err)
+		}
+		defer result.Release()
+		rows, err := recordRows(result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprint(rows)
+	}
+
+	queries := []string{
+		"SELECT Date, Close FROM prices WHERE Close > 30 AND Volume < 50",
+		"SELECT Close * 2, UPPER(Date) FROM prices WHERE Date <> '2020-12-03'",
+		"SELECT Date, SUM(Close), COUNT(*) FROM prices GROUP BY Date HAVING COUNT(*) > 1",
+		"SELECT Date, MIN(Volume) FROM prices WHERE Close > 20 GROUP BY Date ORDER BY MIN(Volume) DESC",
+		"SELECT (Close + Volume) / 2 FROM prices WHERE (Close + Volume) / 2 <> 165",
+	}
+	mustExecuteScript(t, session, "SET parallelism = 1")
+	want := make([]string, len(queries))
+	for i, sql := range queries {
+		want[i] = run(sql)
+	}
+	mustExecuteScript(t, session, "SET parallelism = 4")
+	for i, sql := range queries {
+		if got := run(sql); got != want[i] {
+			t.Errorf("%s: got %s with 4 workers, want %s", sql, got, want[i])
+		}
+	}
+
+	// An error in any morsel fails the statement
+	if _, err := session.Execute(mustParse(t, "SELECT Date FROM prices WHERE Date")); err == nil {
+		t.Errorf("expected a non-boolean WHERE to fail")
+	}
+	if _, err := session.Execute(&queryparser.SetStmt{Name: "parallelism", Value: "-1"}); err == nil {
+		t.Errorf("expected a negative parallelism to fail")
+	}
+
+	// Streamed batches are processed by several workers but keep their order
+	for _, sql := range queries {
+		table, err := catalog.Table("prices")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer table.Release()
+		var batches []array.Record
+		for i := int64(0); i < table.NumRows(); i++ {
+			batch := table.NewSlice(i, i+1)
+			defer batch.Release()
+			batches = append(batches, batch)
+		}
+		input, err := array.NewRecordReader(table.Schema(), batches)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer input.Release()
+		stream, err := ExecuteStreamWithOptions(mustParse(t, sql), input, Options{Parallelism: 4})
+		if err != nil {
+			t.Fatalf("streaming %q failed: %v", sql, err)
+		}
+		var rows [][]interface{}
+		for stream.Next() {
+			batch, err := recordRows(stream.Record())
+			if err != nil {
+				t.Fatal(err)
+			}
+			rows = append(rows, batch...)
+		}
+		if err := stream.Err(); err != nil {
+			t.Fatal(err)
+		}
+		stream.Release()
+		if got := fmt.Sprint(rows); got != run(sql) {
+			t.Errorf("%s: streamed %s, want %s", sql, got, run(sql))
+		}
+	}
+}
+
+func TestPredicatePushdown(t *testing.T) {
+	tables := map[string]array.Record{
+		"prices":  newPricesRecord(t),
+		"symbols": newSymbolsRecord(t),
+	}
+
+	// Only the preserved side of an outer join may be filtered before joining
+	padded := runQueryWithTables(t, tables, "SELECT p.Date FROM prices p LEFT JOIN symbols s ON p.Date = s.Date WHERE Label IS NULL AND Volume > 20")
+	if got := stringColumn(t, padded, 0); fmt.Sprint(got) != "[2020-12-02]" {
+		t.Errorf("LEFT JOIN: unexpected rows %v", got)
+	}
+
+	joined := runQueryWithTables(t, tables, "SELECT Label, Close FROM prices p, symbols s WHERE p.Date = s.Date AND Close > 500 ORDER BY Close")
+	if got := stringColumn(t, joined, 0); fmt.Sprint(got) != "[first third]" {
+		t.Errorf("CROSS JOIN: unexpected rows %v", got)
+	}
+
+	derived := runQueryWithTables(t, tables, "SELECT d FROM (SELECT Date AS day, Close FROM prices) t(d) WHERE Close > 100 AND d <> '2020-12-03' ORDER BY Close")
+	if got := stringColumn(t, derived, 0); fmt.Sprint(got) != "[2020-12-01 2020-12-01]" {
+		t.Errorf("derived table: unexpected rows %v", got)
+	}
+
+	// A scan pruned of every column still has its rows
+	count := runQueryWithTables(t, tables, "SELECT COUNT(*) FROM prices")
+	if got := int64Column(t, count, 0); got[0] != 5 {
+		t.Errorf("expected a count of 5, got %v", got)
+	}
+}
+
+func TestJoinOrdering(t *testing.T) {
+	tables := map[string]array.Record{
+		"prices":  newPricesRecord(t),
+		"symbols": newSymbolsRecord(t),
+	}
+
+	// Written in this order the first join is a cross product of prices with
+	// itself, over the row limit; joined through symbols it is not
+	catalog := NewMemoryCatalog()
+	defer catalog.Release()
+	for name, rec := range tables {
+		catalog.Register(name, rec)
+	}
+	session := NewSession(catalog)
+	mustExecuteScript(t, session, "SET cross_join_limit = 10")
+	result, err := session.Execute(mustParse(t,
+		"SELECT p.Close, q.Close, Label FROM prices p, prices q, symbols s WHERE p.Date = s.Date AND q.Date = s.Date ORDER BY p.Close, q.Close"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer result.Release()
+	if got := float64Column(t, result, 0); fmt.Sprint(got) != "[300 300 900 900 4000]" {
+		t.Errorf("unexpected rows %v", got)
+	}
+	if got := stringColumn(t, result, 2); fmt.Sprint(got) != "[first first first first third]" {
+		t.Errorf("unexpected labels %v", got)
+	}
+
+	// SELECT * keeps the written order of the columns
+	star := runQueryWithTables(t, tables, "SELECT * FROM symbols s, prices p, symbols t WHERE s.Date = p.Date AND p.Date = t.Date")
+	if star.NumRows() != 3 || star.Schema().Field(2).Name != "Date" || star.Schema().Field(3).Name != "Close" {
+		t.Errorf("unexpected result %v", star.Schema())
+	}
+}
+
+func TestEstimateDistinct(t *testing.T) {
+	pool := memory.NewGoAllocator()
+	b := array.NewFloat64Builder(pool)
+	defer b.Release()
+	for i := 0; i < 100000; i++ {
+		b.Append(float64(i % 5000))
+	}
+	arr := b.NewArray()
+	defer arr.Release()
+	if got := estimateDistinct(arr); got < 2500 || got > 10000 {
+		t.Errorf("expected about 5000 distinct values, estimated %d", got)
+	}
+}
+
+func TestBinder(t *testing.T) {
+	table := newPricesRecord(t)
+
+	// Queries are checked before they run, even when they would read no rows
+	for sql, want := range map[string]string{
+		"SELECT Missing FROM prices WHERE FALSE":                                                           "Missing",
+		"SELECT AVG(Date) FROM prices WHERE FALSE":                                                         "AVG expects a number, got VARCHAR",
+		"SELECT NOPE(Close) FROM prices WHERE FALSE":                                                       "unknown function: NOPE",
+		"SELECT UPPER(Close) FROM prices WHERE FALSE":                                                      "UPPER expects a string, got DOUBLE",
+		"SELECT Close FROM prices WHERE Close + 1":                                                         "WHERE clause must evaluate to boolean",
+		"SELECT Close FROM prices WHERE SUM(Close) > 1":                                                    "aggregate function SUM is not allowed here",
+		"SELECT Close FROM prices WHERE FALSE AND Date = 1":                                                "cannot compare VARCHAR with BIGINT",
+		"SELECT Close FROM prices WHERE FALSE AND (Close > 1) = 0":                                         "cannot compare BOOLEAN with BIGINT",
+		"SELECT Close FROM prices WHERE FALSE AND 1 = 1 = 1":                                               "cannot compare BOOLEAN with BIGINT",
+		"SELECT l = 1 FROM (SELECT ARRAY_AGG(Close) AS l FROM prices) a WHERE FALSE":                       "cannot compare DOUBLE[] with BIGINT",
+		"SELECT l = m FROM (SELECT ARRAY_AGG(Close) AS l, ARRAY_AGG(Date) AS m FROM prices) a WHERE FALSE": "cannot compare DOUBLE[] with VARCHAR[]",
+		"SELECT Close FROM prices WHERE Close AND FALSE":                                                   "operator AND expects booleans, got DOUBLE",
+		"SELECT Close FROM prices WHERE FALSE OR Date":                                                     "operator OR expects booleans, got VARCHAR",
+		"SELECT Close FROM prices WHERE FALSE AND Close IN (1, 'a')":                                       "cannot compare DOUBLE with VARCHAR",
+		"SELECT Close FROM prices WHERE FALSE AND Close IN (SELECT Date FROM prices)":                      "cannot compare DOUBLE with VARCHAR",
+		"SELECT Close FROM prices WHERE FALSE AND Date BETWEEN 1 AND 2":                                    "cannot compare VARCHAR with BIGINT",
+		"SELECT Close FROM prices WHERE FALSE AND Close BETWEEN 1 AND TRUE":                                "cannot compare DOUBLE with BOOLEAN",
+	} {
+		_, err := ExecuteQuery(mustParse(t, sql), table)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("query %q: expected error containing %q, got %v", sql, want, err)
+		}
+	}
+
+	// Numbers compare with numbers, and dates and timestamps with strings
+	for _, sql := range []string{
+		"SELECT Close FROM prices WHERE Close = 1 OR Close = CAST(2 AS DECIMAL(3, 1)) OR Volume IN (1, 2.5, NULL)",
+		"SELECT Close FROM prices WHERE DATE '2020-12-01' < Date OR CAST(Date AS TIMESTAMP) BETWEEN DATE '2020-12-01' AND '2020-12-02'",
+		"SELECT l = m FROM (SELECT ARRAY_AGG(Close) AS l, ARRAY_AGG(Volume) AS m FROM prices) a",
+	} {
+		runQuery(t, table, sql)
+	}
+
+	// A result of nothing but NULLs keeps the type the binder inferred
+	result := runQuery(t, table, "SELECT UPPER(Date), Close FROM prices WHERE Close < 0")
+	if dt := result.Schema().Field(0).Type; !arrow.TypeEqual(dt, arrow.BinaryTypes.String) {
+		t.Errorf("expected a string column, got %v", dt)
+	}
+	result = runQuery(t, table, "SELECT LENGTH(NULL) FROM prices")
+	if dt := result.Schema().Field(0).Type; !arrow.TypeEqual(dt, arrow.PrimitiveTypes.Int64) {
+		t.Errorf("expected an integer column, got %v", dt)
+	}
+
+	// So do window functions over no rows
+	result = runQuery(t, table, `SELECT ROW_NUMBER() OVER (ORDER BY Close), RANK() OVER (ORDER BY Close),
+		DENSE_RANK() OVER (ORDER BY Close), LAG(Date) OVER (ORDER BY Close), LEAD(Close, 1, 0.5) OVER (),
+		COUNT(*) OVER (), SUM(Close) OVER (), MAX(Date) OVER (PARTITION BY Volume)
+		FROM prices WHERE Close > 1e9`)
+	for i, want := range []arrow.DataType{
+		arrow.PrimitiveTypes.Int64, arrow.PrimitiveTypes.Int64, arrow.PrimitiveTypes.Int64, arrow.BinaryTypes.String,
+		arrow.PrimitiveTypes.Float64, arrow.PrimitiveTypes.Int64, arrow.PrimitiveTypes.Float64, arrow.BinaryTypes.String,
+	} {
+		if dt := result.Schema().Field(i).Type; !arrow.TypeEqual(dt, want) {
+			t.Errorf("window column %d: expected %v, got %v", i, want, dt)
+		}
+	}
+	catalog := NewMemoryCatalog()
+	defer catalog.Release()
+	catalog.Register("prices", table)
+	session := NewSession(catalog)
+	mustExecuteScript(t, session, "CREATE TABLE z AS SELECT ROW_NUMBER() OVER (ORDER BY Close) AS rn FROM prices WHERE Close > 1e9")
+	saved, err := session.Execute(mustParse(t, "SELECT rn FROM z"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer saved.Release()
+	if dt := saved.Schema().Field(0).Type; !arrow.TypeEqual(dt, arrow.PrimitiveTypes.Int64) {
+		t.Errorf("expected rn to be saved as an integer, got %v", dt)
+	}
+}
+
+func TestColumnTypes(t *testing.T) {
+	pool := memory.NewGoAllocator()
+	schema := arrow.NewSchema([]arrow.Field{
+		{Name: "id", Type: arrow.PrimitiveTypes.Int32, Nullable: true},
+		{Name: "qty", Type: arrow.PrimitiveTypes.Uint8, Nullable: true},
+		{Name: "price", Type: arrow.PrimitiveTypes.Float32, Nullable: true},
+		{Name: "active", Type: arrow.FixedWidthTypes.Boolean, Nullable: true},
+		{Name: "day", Type: arrow.FixedWidthTypes.Date64, Nullable: true},
+		{Name: "at", Type: arrow.FixedWidthTypes.Timestamp_ms, Nullable: true},
+	}, nil)
+	b := array.NewRecordBuilder(pool, schema)
+	defer b.Release()
+	b.Field(0).(*array.Int32Builder).AppendValues([]int32{3, 1, 2}, nil)
+	b.Field(1).(*array.Uint8Builder).AppendValues([]uint8{5, 7, 0}, []bool{true, true, false})
+	b.Field(2).(*array.Float32Builder).AppendValues([]float32{1.5, 2.5, 4}, nil)
+	b.Field(3).(*array.BooleanBuilder).AppendValues([]bool{true, false, true}, nil)
+	b.Field(4).(*array.Date64Builder).AppendValues([]arrow.Date64{18597 * millisPerDay, 18598 * millisPerDay, 18597 * millisPerDay}, nil)
+	b.Field(5).(*array.TimestampBuilder).AppendValues([]arrow.Timestamp{1606780800000, 1606867200000, 1606953600000}, nil)
+	table := b.NewRecord()
+	defer table.Release()
+
+	result := runQuery(t, table, "SELECT id, qty * 2, price + 1, active FROM t WHERE active AND day = DATE '2020-12-01' ORDER BY id")
+	if got := result.Column(0).(*array.Int32).Int32Values(); fmt.Sprint(got) != "[2 3]" {
+		t.Errorf("unexpected ids %v", got)
+	}
+	if got := result.Column(1).(*array.Int64); got.Value(1) != 10 || got.IsValid(0) {
+		t.Errorf("unexpected quantities %v", got)
+	}
+	if got := float64Column(t, result, 2); fmt.Sprint(got) != "[5 2.5]" {
+		t.Errorf("unexpected prices %v", got)
+	}
+
+	grouped := runQuery(t, table, "SELECT day, SUM(id) FROM t WHERE at < TIMESTAMP '2020-12-03 00:00:00' GROUP BY day ORDER BY day")
+	if grouped.NumRows() != 2 {
+		t.Fatalf("expected 2 groups, got %d", grouped.NumRows())
+	}
+	if got := int64Column(t, grouped, 1); fmt.Sprint(got) != "[3 1]" {
+		t.Errorf("unexpected sums %v", got)
+	}
+}
+
+func TestCopyColumnTypes(t *testing.T) {
+	pool := memory.NewGoAllocator()
+	schema := arrow.NewSchema([]arrow.Field{
+		{Name: "i8", Type: arrow.PrimitiveTypes.Int8, Nullable: true},
+		{Name: "i16", Type: arrow.PrimitiveTypes.Int16, Nullable: true},
+		{Name: "i32", Type: arrow.PrimitiveTypes.Int32, Nullable: true},
+		{Name: "u8", Type: arrow.PrimitiveTypes.Uint8, Nullable: true},
+		{Name: "u16", Type: arrow.PrimitiveTypes.Uint16, Nullable: true},
+		{Name: "u32", Type: arrow.PrimitiveTypes.Uint32, Nullable: true},
+		{Name: "u64", Type: arrow.PrimitiveTypes.Uint64, Nullable: true},
+		{Name: "f32", Type: arrow.PrimitiveTypes.Float32, Nullable: true},
+		{Name: "day", Type: arrow.FixedWidthTypes.Date64, Nullable: true},
+	}, nil)
+	b := array.NewRecordBuilder(pool, schema)
+	defer b.Release()
+	valid := []bool{true, false}
+	b.Field(0).(*array.Int8Builder).AppendValues([]int8{-128, 0}, valid)
+	b.Field(1).(*array.Int16Builder).AppendValues([]int16{-32768, 0}, valid)
+	b.Field(2).(*array.Int32Builder).AppendValues([]int32{-2147483648, 0}, valid)
+	b.Field(3).(*array.Uint8Builder).AppendValues([]uint8{255, 0}, valid)
+	b.Field(4).(*array.Uint16Builder).AppendValues([]uint16{65535, 0}, valid)
+	b.Field(5).(*array.Uint32Builder).AppendValues([]uint32{4294967295, 0}, valid)
+	b.Field(6).(*array.Uint64Builder).AppendValues([]uint64{18446744073709551615, 0}, valid)
+	b.Field(7).(*array.Float32Builder).AppendValues([]float32{1.5, 0}, valid)
+	b.Field(8).(*array.Date64Builder).AppendValues([]arrow.Date64{18597 * millisPerDay, 0}, valid)
+	table := b.NewRecord()
+	defer table.Release()
+
+	catalog := NewMemoryCatalog()
+	defer catalog.Release()
+	catalog.Register("t", table)
+	session := NewSession(catalog)
+	path := filepath.Join(t.TempDir(), "t.csv")
+	mustExecuteScript(t, session, fmt.Sprintf("COPY t TO '%s'", path))
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "i8,i16,i32,u8,u16,u32,u64,f32,day\n" +
+		"-128,-32768,-2147483648,255,65535,4294967295,18446744073709551615,1.5,2020-12-01\n" +
+		",,,,,,,,\n"
+	if got := string(data); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestDecimalColumns(t *testing.T) {
+	pool := memory.NewGoAllocator()
+	priceType := &arrow.Decimal128Type{Precision: 10, Scale: 2}
+	schema := arrow.NewSchema([]arrow.Field{
+		{Name: "sym", Type: arrow.BinaryTypes.String},
+		{Name: "price", Type: priceType, Nullable: true},
+	}, nil)
+	b := array.NewRecordBuilder(pool, schema)
+	defer b.Release()
+	b.Field(0).(*array.StringBuilder).AppendValues([]string{"a", "a", "b", "b"}, nil)
+	b.Field(1).(*array.Decimal128Builder).AppendValues([]decimal128.Num{
+		decimal128.FromI64(1010), decimal128.FromI64(2020), decimal128.FromI64(30), decimal128.FromI64(0),
+	}, []bool{true, true, true, false})
+	table := b.NewRecord()
+	defer table.Release()
+
+	decimals := func(rec array.Record, col int) []string {
+		t.Helper()
+		arr, ok := rec.Column(col).(*array.Decimal128)
+		if !ok {
+			t.Fatalf("expected column %d to be Decimal128, got %T", col, rec.Column(col))
+		}
+		scale := arr.DataType().(*arrow.Decimal128Type).Scale
+		out := make([]string, arr.Len())
+		for i := range out {
+			out[i] = "NULL"
+			if arr.IsValid(i) {
+				out[i] = decimalOf(arr.Value(i), scale).String()
+			}
+		}
+		return out
+	}
+
+	// Sums stay exact and keep the scale of the column
+	result := runQuery(t, table, "SELECT sym, SUM(price), AVG(price), MAX(price) FROM t GROUP BY sym ORDER BY sym")
+	if got := decimals(result, 1); fmt.Sprint(got) != "[30.30 0.30]" {
+		t.Errorf("unexpected sums %v", got)
+	}
+	if got := decimals(result, 2); fmt.Sprint(got) != "[15.150000 0.300000]" {
+		t.Errorf("unexpected averages %v", got)
+	}
+	if got := decimals(result, 3); fmt.Sprint(got) != "[20.20 0.30]" {
+		t.Errorf("unexpected maximums %v", got)
+	}
+
+	result = runQuery(t, table, "SELECT price * 3, price - 10, -price FROM t WHERE price > 1 ORDER BY price")
+	if got := decimals(result, 0); fmt.Sprint(got) != "[30.30 60.60]" {
+		t.Errorf("unexpected products %v", got)
+	}
+	if got := decimals(result, 1); fmt.Sprint(got) != "[0.10 10.20]" {
+		t.Errorf("unexpected differences %v", got)
+	}
+	if got := decimals(result, 2); fmt.Sprint(got) != "[-10.10 -20.20]" {
+		t.Errorf("unexpected negations %v", got)
+	}
+
+	result = runQuery(t, table, "SELECT CAST(0.1 AS DECIMAL(4, 1)) + CAST(0.2 AS DECIMAL(4, 1)), CAST('1.005' AS NUMERIC(10, 2)) FROM t WHERE price > 15")
+	if got := decimals(result, 0); fmt.Sprint(got) != "[0.3]" {
+		t.Errorf("unexpected sum %v", got)
+	}
+	if got := decimals(result, 1); fmt.Sprint(got) != "[1.01]" {
+		t.Errorf("unexpected rounding %v", got)
+	}
+
+	query := mustParse(t, "SELECT CAST(12345 AS DECIMAL(4, 1)) FROM t")
+	if _, err := ExecuteQuery(query, table); err == nil {
+		t.Error("expected a value too wide for its precision to be rejected")
+	}
+}
+
+func TestThreeValuedLogic(t *testing.T) {
+	table := newPricesRecord(t)
+
+	result := runQuery(t, table, `SELECT NULL AND FALSE, NULL AND TRUE, NULL OR TRUE, NULL OR FALSE,
+		NOT (NULL AND FALSE), Close > NULL FROM prices WHERE Close = 900`)
+	want := []string{"false", "NULL", "true", "NULL", "true", "NULL"}
+	for i, w := range want {
+		got := "NULL"
+		if result.Column(i).IsValid(0) {
+			v, err := columnValue(result.Column(i), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = fmt.Sprint(v)
+		}
+		if got != w {
+			t.Errorf("column %d: got %s, want %s", i, got, w)
+		}
+	}
+
+	// A NULL that cannot change the outcome keeps the row
+	result = runQuery(t, table, "SELECT Close FROM prices WHERE NOT (Close > NULL AND Volume > 100) ORDER BY Close")
+	if got := float64Column(t, result, 0); fmt.Sprint(got) != "[20 50 300 900 4000]" {
+		t.Errorf("unexpected rows %v", got)
+	}
+}
+
+func TestDistinctAggregates(t *testing.T) {
+	table := newPricesRecord(t)
+	const sql = `SELECT g, COUNT(DISTINCT x), SUM(DISTINCT x), AVG(DISTINCT x), COUNT(x), MAX(DISTINCT x)
+		FROM (VALUES (1, 1), (1, 1), (1, 2), (2, NULL), (2, 3), (2, 3), (2, 4), (2, 4)) v(g, x)
+		GROUP BY g ORDER BY g`
+	check := func() {
+		t.Helper()
+		result := runQuery(t, table, sql)
+		rows, err := recordRows(result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(rows); got != "[[1 2 3 1.5 3 2] [2 2 7 3.5 4 4]]" {
+			t.Errorf("unexpected rows %v", got)
+		}
+	}
+	check()
+
+	// Spilling the values of every group to disk gives the same result
+	defer func(limit int) { MaxDistinctValues = limit }(MaxDistinctValues)
+	MaxDistinctValues = 1
+	check()
+
+	result := runQuery(t, table, "SELECT COUNT(DISTINCT Date), COUNT(Date) FROM prices")
+	if got := int64Column(t, result, 0); got[0] != 3 {
+		t.Errorf("expected 3 distinct dates, got %v", got[0])
+	}
+	for _, bad := range []string{
+		"SELECT COUNT(DISTINCT *) FROM prices",
+		"SELECT UPPER(DISTINCT Date) FROM prices",
+	} {
+		if _, err := ExecuteQuery(mustParse(t, bad), table); err == nil {
+			t.Errorf("expected %q to fail", bad)
+		}
+	}
+}
+
+func TestStatisticalAggregates(t *testing.T) {
+	table := newPricesRecord(t)
+	result := runQuery(t, table, `SELECT VAR_POP(x), STDDEV_POP(x), VARIANCE(x), STDDEV(x), MEDIAN(x),
+		PERCENTILE_CONT(x, 0.25), PERCENTILE_CONT(x, 1), VARIANCE(y), MEDIAN(y)
+		FROM (VALUES (2, 1), (4, NULL), (4, NULL), (4, NULL), (5, NULL), (5, NULL), (7, NULL), (9, NULL)) v(x, y)`)
+	rows, err := recordRows(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{4.0, 2.0, 32.0 / 7, math.Sqrt(32.0 / 7), 4.5, 4.0, 9.0, nil, 1.0}
+	for i, w := range want {
+		got := rows[0][i]
+		if g, ok := got.(float64); ok && w != nil && math.Abs(g-w.(float64)) < 1e-9 {
+			continue
+		}
+		if got != w {
+			t.Errorf("column %d: got %v, want %v", i, got, w)
+		}
+	}
+
+	for _, bad := range []string{
+		"SELECT PERCENTILE_CONT(Close, 1.5) FROM prices",
+		"SELECT PERCENTILE_CONT(Close, Volume) FROM prices",
+		"SELECT MEDIAN(Date) FROM prices",
+	} {
+		if _, err := ExecuteQuery(mustParse(t, bad), table); err == nil {
+			t.Errorf("expected %q to fail", bad)
+		}
+	}
+}
+
+func TestApproxAggregates(t *testing.T) {
+	pool := memory.NewGoAllocator()
+	schema := arrow.NewSchema([]arrow.Field{
+		{Name: "g", Type: arrow.PrimitiveTypes.Int64},
+		{Name: "x", Type: arrow.PrimitiveTypes.Int64},
+		{Name: "y", Type: arrow.PrimitiveTypes.Int64},
+	}, nil)
+	b := array.NewRecordBuilder(pool, schema)
+	defer b.Release()
+	for i := int64(0); i < 100000; i++ {
+		b.Field(0).(*array.Int64Builder).Append(i % 2)
+		b.Field(1).(*array.Int64Builder).Append(i)
+		b.Field(2).(*array.Int64Builder).Append(i % 6000)
+	}
+	numbers := b.NewRecord()
+	defer numbers.Release()
+
+	result := runQueryWithTables(t, map[string]array.Record{"numbers": numbers},
+		`SELECT g, APPROX_COUNT_DISTINCT(y), APPROX_QUANTILE(x, 0.5), APPROX_QUANTILE(x, 0.99)
+		FROM numbers GROUP BY g ORDER BY g`)
+	rows, err := recordRows(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each group has 3000 distinct values of y, and x spread evenly up to
+	// 100000
+	for _, row := range rows {
+		if n := row[1].(int64); math.Abs(float64(n)-3000) > 3000*0.05 {
+			t.Errorf("group %v: estimated %d distinct values, want about 3000", row[0], n)
+		}
+		if q := row[2].(float64); math.Abs(q-50000) > 1000 {
+			t.Errorf("group %v: estimated median %v, want about 50000", row[0], q)
+		}
+		if q := row[3].(float64); math.Abs(q-99000) > 200 {
+			t.Errorf("group %v: estimated 99th percentile %v, want about 99000", row[0], q)
+		}
+	}
+	if result.Schema().Field(1).Nullable {
+		t.Error("expected APPROX_COUNT_DISTINCT never to be NULL")
+	}
+
+	// Few values are counted and ordered exactly, and none give 0 and NULL
+	table := newPricesRecord(t)
+	result = runQuery(t, table, `SELECT APPROX_COUNT_DISTINCT(s), APPROX_COUNT_DISTINCT(DISTINCT x),
+		APPROX_QUANTILE(x, 0.25), PERCENTILE_CONT(x, 0.25), APPROX_QUANTILE(x, 1)
+		FROM (VALUES ('a', 2), ('b', 4), ('a', 4), (NULL, 5), ('c', 9), ('c', NULL)) v(s, x)`)
+	if rows, err = recordRows(result); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(rows), "[[3 4 4 4 9]]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	result = runQuery(t, table, "SELECT APPROX_COUNT_DISTINCT(Date), APPROX_QUANTILE(Close, 0.5) FROM prices WHERE Close < 0")
+	if rows, err = recordRows(result); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(rows), "[[0 <nil>]]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	for _, bad := range []string{
+		"SELECT APPROX_QUANTILE(Close) FROM prices",
+		"SELECT APPROX_QUANTILE(Close, 1.5) FROM prices",
+		"SELECT APPROX_QUANTILE(Date, 0.5) FROM prices",
+		"SELECT APPROX_COUNT_DISTINCT(Date, Close) FROM prices",
+	} {
+		if _, err := ExecuteQuery(mustParse(t, bad), table); err == nil {
+			t.Errorf("expected %q to fail", bad)
+		}
+	}
+}
+
+func TestFrequentAggregates(t *testing.T) {
+	table := newPricesRecord(t)
+	result := runQuery(t, table, `SELECT g, MODE(s), TOP_K(s, 2), TOP_K(s, 5)
+		FROM (VALUES (1, 'a'), (1, 'c'), (1, 'b'), (1, 'c'), (1, 'b'), (1, 'c'), (1, NULL),
+			(2, 'y'), (2, 'x'), (3, NULL)) v(g, s)
+		GROUP BY g ORDER BY g`)
+	rows, err := recordRows(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Ties go to the smaller value
+	want := "[[1 c [c, b] [c, b, a]] [2 x [x, y] [x, y]] [3 <nil> <nil> <nil>]]"
+	if got := fmt.Sprint(rows); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if dt := result.Schema().Field(2).Type; !arrow.TypeEqual(dt, arrow.ListOf(arrow.BinaryTypes.String)) {
+		t.Errorf("TOP_K column has type %v", dt)
+	}
+	result = runQuery(t, table, "SELECT MODE(Close), TOP_K(Close, 3), TOP_K(Date, 3) FROM prices WHERE Close < 0")
+	for i, want := range []arrow.DataType{
+		arrow.PrimitiveTypes.Float64, arrow.ListOf(arrow.PrimitiveTypes.Float64), arrow.ListOf(arrow.BinaryTypes.String),
+	} {
+		if dt := result.Schema().Field(i).Type; !arrow.TypeEqual(dt, want) {
+			t.Errorf("column %d over no rows has type %v, want %v", i, dt, want)
+		}
+	}
+
+	// Far more distinct values than are counted leave those given most
+	// often on top
+	pool := memory.NewGoAllocator()
+	b := array.NewInt64Builder(pool)
+	defer b.Release()
+	for i := int64(0); i < 100000; i++ {
+		switch {
+		case i%7 == 0:
+			b.Append(1)
+		case i%11 == 0:
+			b.Append(2)
+		default:
+			b.Append(i)
+		}
+	}
+	col := b.NewArray()
+	defer col.Release()
+	schema := arrow.NewSchema([]arrow.Field{{Name: "x", Type: arrow.PrimitiveTypes.Int64}}, nil)
+	numbers := array.NewRecord(schema, []array.Interface{col}, int64(col.Len()))
+	defer numbers.Release()
+	result = runQueryWithTables(t, map[string]array.Record{"numbers": numbers},
+		"SELECT MODE(x), TOP_K(x, 2) FROM numbers")
+	if rows, err = recordRows(result); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(rows), "[[1 [1, 2]]]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	// Merging the sketches of parts of the input, as parallel aggregation
+	// does, finds the same values
+	parts := []*spaceSaving{newSpaceSaving(4), newSpaceSaving(4)}
+	for i := int64(0); i < 1000; i++ {
+		val := i
+		if i%3 == 0 {
+			val = -1
+		} else if i%5 == 0 {
+			val = -2
+		}
+		parts[i%2].add(val)
+	}
+	parts[0].merge(parts[1])
+	if got := fmt.Sprint(parts[0].top(2)); got != "[-1 -2]" {
+		t.Errorf("merged sketch found %s", got)
+	}
+
+	for _, bad := range []string{
+		"SELECT TOP_K(Close) FROM prices",
+		"SELECT TOP_K(Close, 0) FROM prices",
+		"SELECT TOP_K(Close, Volume) FROM prices",
+		"SELECT MODE(Close, 1) FROM prices",
+	} {
+		if _, err := ExecuteQuery(mustParse(t, bad), table); err == nil {
+			t.Errorf("expected %q to fail", bad)
+		}
+	}
+}
+
+func TestCollectingAggregates(t *testing.T) {
+	table := newPricesRecord(t)
+	result := runQuery(t, table, `SELECT g, STRING_AGG(s, '; '), STRING_AGG(DISTINCT s), ARRAY_AGG(n)
+		FROM (VALUES (1, 'b', 2), (1, 'a', NULL), (1, 'b', 3), (2, NULL, NULL)) v(g, s, n)
+		GROUP BY g ORDER BY g`)
+	rows, err := recordRows(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]interface{}{
+		{int64(1), "b; a; b", "a,b", "[2, NULL, 3]"},
+		{int64(2), nil, nil, "[NULL]"},
+	}
+	for i, w := range want {
+		got := rows[i]
+		if l, ok := got[3].(list); ok {
+			got[3] = l.String()
+		}
+		if fmt.Sprintf("%#v", got) != fmt.Sprintf("%#v", w) {
+			t.Errorf("row %d: got %v, want %v", i, got, w)
+		}
+	}
+	if dt := result.Schema().Field(3).Type; !arrow.TypeEqual(dt, arrow.ListOf(arrow.PrimitiveTypes.Int64)) {
+		t.Errorf("ARRAY_AGG column has type %v", dt)
+	}
+
+	// Lists of no rows are still lists of the argument's type
+	for _, sql := range []string{
+		"SELECT ARRAY_AGG(Close), ARRAY_AGG(Date) FROM prices WHERE Close < 0",
+		"SELECT ARRAY_AGG(Close), ARRAY_AGG(Date) FROM prices WHERE Close < 0 GROUP BY Volume",
+	} {
+		result = runQuery(t, table, sql)
+		for i, want := range []arrow.DataType{arrow.ListOf(arrow.PrimitiveTypes.Float64), arrow.ListOf(arrow.BinaryTypes.String)} {
+			if dt := result.Schema().Field(i).Type; !arrow.TypeEqual(dt, want) {
+				t.Errorf("%s: column %d has type %v, want %v", sql, i, dt, want)
+			}
+		}
+	}
+
+	// Lists ARRAY_AGG builds compare element by element, in IN as with =
+	for sql, want := range map[string]string{
+		`SELECT a.Date FROM (SELECT Date, ARRAY_AGG(Volume) AS l FROM prices GROUP BY Date) a,
+			(SELECT ARRAY_AGG(Volume) AS l FROM prices WHERE Date = '2020-12-02') b WHERE a.l IN (b.l, NULL)`: "[[2020-12-02]]",
+		`SELECT Date FROM (SELECT Date, ARRAY_AGG(Volume) AS l FROM prices GROUP BY Date) a
+			WHERE l NOT IN (SELECT ARRAY_AGG(Volume) FROM prices WHERE Date <> '2020-12-03' GROUP BY Date)`: "[[2020-12-03]]",
+	} {
+		rows, err := recordRows(runQuery(t, table, sql))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(rows); got != want {
+			t.Errorf("%s: got %s, want %s", sql, got, want)
+		}
+	}
+
+	for _, bad := range []string{
+		"SELECT STRING_AGG(Date, Date) FROM prices",
+		"SELECT STRING_AGG(Date, ',', ';') FROM prices",
+		"SELECT ARRAY_AGG(*) FROM prices",
+	} {
+		if _, err := ExecuteQuery(mustParse(t, bad), table); err == nil {
+			t.Errorf("expected %q to fail", bad)
+		}
+	}
+}
+
+func TestPickingAggregates(t *testing.T) {
+	table := newPricesRecord(t)
+	result := runQuery(t, table, `SELECT Date, FIRST(Close), LAST(Close), ANY_VALUE(Volume),
+		ARG_MAX(Close, Volume), ARG_MIN(Volume, Close) FROM prices GROUP BY Date ORDER BY Date`)
+	rows, err := recordRows(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[[2020-12-01 900 300 10 300 30] [2020-12-02 20 50 20 50 20] [2020-12-03 4000 4000 40 4000 40]]"
+	if got := fmt.Sprint(rows); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	// NULLs are skipped, and ties go to the first row
+	result = runQuery(t, table, `SELECT FIRST(x), LAST(x), ARG_MAX(y, x), ARG_MIN(x, y), FIRST(DISTINCT x)
+		FROM (VALUES (NULL, 'a'), (2, 'b'), (3, NULL), (3, 'c'), (NULL, 'd')) v(x, y)`)
+	if rows, err = recordRows(result); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(rows), "[[2 3 <nil> <nil> 2]]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	for _, bad := range []string{
+		"SELECT ARG_MAX(Close) FROM prices",
+		"SELECT ARG_MIN(Close, *) FROM prices",
+	} {
+		if _, err := ExecuteQuery(mustParse(t, bad), table); err == nil {
+			t.Errorf("expected %q to fail", bad)
+		}
+	}
+}
+
+func TestMixedTypeComparisons(t *testing.T) {
+	table := newPricesRecord(t)
+	const values = "(VALUES ('abc', TRUE), ('1', FALSE), ('0', TRUE)) v(s, b)"
+	for _, bad := range []string{
+		"SELECT 'abc' = 0 FROM prices",
+		"SELECT s FROM " + values + " WHERE s < 1",
+		"SELECT s FROM " + values + " WHERE b = 0",
+		"SELECT s FROM " + values + " WHERE s BETWEEN -1 AND 1",
+		"SELECT tags = 0 FROM (SELECT ARRAY_AGG(Close) AS tags FROM prices) l",
+	} {
+		_, err := ExecuteQuery(mustParse(t, bad), table)
+		if err == nil || !strings.Contains(err.Error(), "cannot compare") {
+			t.Errorf("%s: expected a comparison error, got %v", bad, err)
+		}
+	}
+
+	for sql, want := range map[string]string{
+		"SELECT s FROM " + values + " WHERE s < '1' OR b = FALSE":                                          "[[1] [0]]",
+		"SELECT Close FROM prices WHERE Close = 20.0 OR Volume = CAST(50 AS DECIMAL(4, 1)) ORDER BY Close": "[[20] [50]]",
+		"SELECT l = l, l < m FROM (SELECT ARRAY_AGG(Close) AS l, ARRAY_AGG(Volume) AS m FROM prices) a":    "[[true false]]",
+	} {
+		rows, err := recordRows(runQuery(t, table, sql))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(rows); got != want {
+			t.Errorf("%s: got %s, want %s", sql, got, want)
+		}
+	}
+}
+
+func TestStringOrdering(t *testing.T) {
+	table := newPricesRecord(t)
+	for sql, want := range map[string]string{
+		"SELECT Close FROM prices WHERE Date > '2020-12-01' ORDER BY Close":                        "[[20] [50] [4000]]",
+		"SELECT Close FROM prices WHERE Date BETWEEN '2020-12-02' AND '2020-12-02' ORDER BY Close": "[[20] [50]]",
+		"SELECT Date FROM prices WHERE '2020-12-03' <= Date":                                       "[[2020-12-03]]",
+		"SELECT Date, Close FROM prices ORDER BY Date DESC, Close":                                 "[[2020-12-03 4000] [2020-12-02 20] [2020-12-02 50] [2020-12-01 300] [2020-12-01 900]]",
+		// Strings compare byte by byte, so upper case comes first
+		"SELECT s < 'b', s > 'B', s >= 'ab' FROM (VALUES ('a'), ('B'), ('abc')) v(s)":                     "[[true true false] [true false false] [true true true]]",
+		"SELECT MIN(Date), MAX(Date) FROM prices":                                                         "[[2020-12-01 2020-12-03]]",
+		"SELECT Volume > 25 AS high, MIN(Date), MAX(Date) FROM prices GROUP BY Volume > 25 ORDER BY high": "[[false 2020-12-01 2020-12-02] [true 2020-12-01 2020-12-03]]",
+		"SELECT MIN(Date), MAX(CAST(Date AS DATE)) FROM prices WHERE Close < 0":                           "[[<nil> <nil>]]",
+		"SELECT MIN(CAST(Date AS DATE)), MAX(CAST(Date AS TIMESTAMP)) FROM prices WHERE Close > 100":      "[[2020-12-01 2020-12-03 00:00:00 +0000 UTC]]",
+		"SELECT Close, MAX(Date) OVER (ORDER BY Close) FROM prices ORDER BY Close":                        "[[20 2020-12-02] [50 2020-12-02] [300 2020-12-02] [900 2020-12-02] [4000 2020-12-03]]",
+	} {
+		rows, err := recordRows(runQuery(t, table, sql))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fmt.Sprint(rows); got != want {
+			t.Errorf("%s: got %s, want %s", sql, got, want)
+		}
+	}
+
+	result := runQuery(t, table, "SELECT MIN(Date) FROM prices")
+	if dt := result.Schema().Field(0).Type; !arrow.TypeEqual(dt, arrow.BinaryTypes.String) {
+		t.Errorf("MIN of strings has type %v", dt)
+	}
+	for _, bad := range []string{
+		"SELECT MIN(Close > 100) FROM prices",
+		"SELECT SUM(Date) FROM prices",
+	} {
+		if _, err := ExecuteQuery(mustParse(t, bad), table); err == nil {
+			t.Errorf("expected %q to fail", bad)
+		}
+	}
+}
+
+func TestMathFunctions(t *testing.T) {
+	table := newPricesRecord(t)
+	result := runQuery(t, table, `SELECT ABS(-3), ABS(-2.5), SIGN(-7), FLOOR(-2.5), CEIL(2.1), TRUNC(-2.7),
+		MOD(7, -3), MOD(-7.5, 2), POWER(2, 10), SQRT(16), LN(EXP(1)), LOG10(1000), LOG(2, 8), ROUND(PI(), 4),
+		ROUND(DEGREES(RADIANS(90))), ATAN2(0, 1), ABS(NULL), MOD(NULL, 2)
+		FROM (VALUES (1)) v(x)`)
+	rows, err := recordRows(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[[3 2.5 -1 -3 3 -2 1 -1.5 1024 4 1 3 3 3.1416 90 0 <nil> <nil>]]"
+	if got := fmt.Sprint(rows); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if dt := result.Schema().Field(0).Type; dt.ID() != arrow.INT64 {
+		t.Errorf("ABS of an integer has type %v", dt)
+	}
+
+	// Decimals stay exact
+	result = runQuery(t, table, `SELECT ABS(d), FLOOR(d), CEIL(d), TRUNC(d), ROUND(d, 1), ROUND(d, -1), MOD(d, 2), SIGN(d)
+		FROM (VALUES (CAST(-12.35 AS DECIMAL(10, 2)))) v(d)`)
+	if rows, err = recordRows(result); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(rows), "[[12.35 -13 -12 -12 -12.4 -10 -0.35 -1]]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	for _, sql := range []string{
+		"SELECT SQRT(-1) FROM prices",
+		"SELECT LN(0) FROM prices",
+		"SELECT MOD(Volume, 0) FROM prices",
+		"SELECT ABS(Date) FROM prices",
+		"SELECT POWER(Close) FROM prices",
+		"SELECT PI(1) FROM prices",
+	} {
+		if _, err := ExecuteQuery(mustParse(t, sql), table); err == nil {
+			t.Errorf("expected %q to fail", sql)
+		}
+	}
+}
+
+func TestDateFunctions(t *testing.T) {
+	table := newPricesRecord(t)
+	result := runQuery(t, table, `SELECT DATE_TRUNC('month', Date) AS month, COUNT(*), MIN(EXTRACT(DAY FROM Date)), MAX(DATE_PART('dow', Date))
+		FROM prices GROUP BY DATE_TRUNC('month', Date)`)
+	rows, err := recordRows(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(rows), "[[2020-12-01 5 1 4]]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	result = runQuery(t, table, `SELECT DATE_TRUNC('week', DATE '2021-03-14'), DATE_TRUNC('quarter', DATE '2021-03-14'),
+		CAST(DATE_TRUNC('hour', TIMESTAMP '2021-03-14 15:09:26') AS VARCHAR), EXTRACT(QUARTER FROM DATE '2021-05-02'),
+		EXTRACT(EPOCH FROM TIMESTAMP '1970-01-02 00:00:00'), EXTRACT(MINUTE FROM TIMESTAMP '2021-03-14 15:09:26'),
+		DATE '2021-01-31' + INTERVAL '1 month', DATE_TRUNC('year', NULL)
+		FROM prices WHERE Volume = 10`)
+	if rows, err = recordRows(result); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fmt.Sprint(rows), "[[2021-03-08 2021-01-01 2021-03-14 15:00:00 2 86400 9 2021-02-28 <nil>]]"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if dt := result.Schema().Field(0).Type; dt.ID() != arrow.DATE32 {
+		t.Errorf("DATE_TRUNC of a date has type %v", dt)
+	}
+
+	// NOW() is the same for every row and every query of a statement
+	before := time.Now().UTC()
+	result = runQuery(t, table, "SELECT NOW(), NOW() = (SELECT NOW() FROM prices WHERE Volume = 10) FROM prices")
+	if rows, err = recordRows(result); err != nil {
+		t.Fatal(err)
+	}
+	first := rows[0][0].(time.Time)
+	if first.Before(before.Truncate(time.Microsecond)) || first.After(time.Now()) {
+		t.Errorf("NOW() gave %v, not a time during the query", first)
+	}
+	for _, row := range rows {
+		if !row[0].(time.Time).Equal(first) || row[1] != true {
+			t.Errorf("expected every row to see the same time, got %v", row)
+		}
+	}
+
+	for _, sql := range []string{
+		"SELECT DATE_TRUNC('fortnight', Date) FROM prices",
+		"SELECT DATE_PART('year', Close) FROM prices",
+		"SELECT EXTRACT(YEAR Date) FROM prices",
+		"SELECT NOW(1) FROM prices",
+	} {
+		query, err := queryparser.NewParser(sql).Parse()
+		if err != nil {
+			continue
+		}
+		if _, err := ExecuteQuery(query, table); err == nil {
+			t.Errorf("expected %q to fail", sql)
+		}
+	}
+}
+
+func TestRegexpFunctions(t *testing.T) {
+	table := newPricesRecord(t)
+	result := runQuery(t, table, `SELECT REGEXP_EXTRACT(Date, '(\d+)-(\d+)-(\d+)', 3) AS day, REGEXP_EXTRACT(Date, '^\d{4}'),
+		REGEXP_REPLACE(Date, '(\d+)-(\d+)-(\d+)', '\3/\2/\1'), REGEXP_REPLACE(Date, '0', '_', 'g'), REGEXP_REPLACE(Date, 'X', 'y'),
+		REGEXP_EXTRACT(Date, 'X'), REGEXP_MATCHES('ABC', 'b', 'i'), REGEXP_REPLACE('a.b', '\.', '$')
+		FROM prices WHERE REGEXP_MATCHES(Date, '-0[12]$')`)
+	rows, err := recordRows(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[[01 2020 01/12/2020 2_2_-12-_1 2020-12-01 <nil> true a$b] [02 2020 02/12/2020 2_2_-12-_2 2020-12-02 <nil> true a$b] " +
+		"[01 2020 01/12/2020 2_2_-12-_1 2020-12-01 <nil> true a$b] [02 2020 02/12/2020 2_2_-12-_2 2020-12-02 <nil> true a$b]]"
+	if got := fmt.Sprint(rows); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	for _, sql := range []string{
+		"SELECT REGEXP_MATCHES(Date, '(') FROM prices",
+		"SELECT REGEXP_EXTRACT(Date, '(\\d+)', 2) FROM prices",
+		"SELECT REGEXP_REPLACE(Date, 'a', 'b', 'x') FROM prices",
+		"SELECT REGEXP_MATCHES(Close, 'a') FROM prices",
+	} {
+		if _, err := ExecuteQuery(mustParse(t, sql), table); err == nil {
+			t.Errorf("expected %q to fail", sql)
+		}
+	}
+}
+
+func TestNullFunctions(t *testing.T) {
+	table := newPricesRecord(t)
+	// Only the arguments up to the first that is not NULL are evaluated
+	if _, err := ExecuteQuery(mustParse(t, "SELECT COALESCE(y, 1 / 0) FROM (VALUES (1), (NULL)) v(y)"), table); err == nil {
+		t.Errorf("expected 1 / 0 to be evaluated where y is NULL")
+	}
+
+	result := runQuery(t, table, `SELECT COALESCE(NULLIF(Volume, 30), Close), IFNULL(NULLIF(x, 2), 1.5), COALESCE(NULL, NULL),
+		COALESCE(NULLIF(Date, '2020-12-01'), 'first'), COALESCE(y, 1 / 0)
+		FROM prices, (VALUES (1, 5), (2, 6)) v(x, y) WHERE Close > 1000 OR Volume = 30`)
+	rows, err := recordRows(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[[300 1 <nil> first 5] [300 1.5 <nil> first 6] [40 1 <nil> 2020-12-03 5] [40 1.5 <nil> 2020-12-03 6]]"
+	if got := fmt.Sprint(rows); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if dt := result.Schema().Field(1).Type; dt.ID() != arrow.FLOAT64 {
+		t.Errorf("IFNULL of an integer and a float has type %v", dt)
+	}
+
+	for _, sql := range []string{
+		"SELECT COALESCE() FROM prices",
+		"SELECT COALESCE(Date, Close) FROM prices",
+		"SELECT IFNULL(Close) FROM prices",
+		"SELECT NULLIF(Close, 1, 2) FROM prices",
+	} {
+		if _, err := ExecuteQuery(mustParse(t, sql), table); err == nil {
+			t.Errorf("expected %q to fail", sql)
+		}
+	}
+}
+
+func TestConditionalFunctions(t *testing.T) {
+	table := newPricesRecord(t)
+	result := runQuery(t, table, `SELECT GREATEST(Close, Volume * 10, NULL), LEAST(x, 1.5), GREATEST(Date, '2020-12-02'),
+		IF(Close > 100, 'high', 'low'), IIF(x = 2, NULL, Close), IF(NULL, 1, 2), LEAST(NULL, NULL)
+		FROM prices, (VALUES (1), (2)) v(x) WHERE Close > 1000 OR Volume = 30`)
+	rows, err := recordRows(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[[300 1 2020-12-02 high 300 2 <nil>] [300 1.5 2020-12-02 high <nil> 2 <nil>] [4000 1 2020-12-03 high 4000 2 <nil>] [4000 1.5 2020-12-03 high <nil> 2 <nil>]]"
+	if got := fmt.Sprint(rows); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	// Only the result chosen is evaluated
+	rows, err = recordRows(runQuery(t, table, "SELECT IF(y = 0, 0, 10 / y) FROM (VALUES (0), (5)) v(y)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(rows); got != "[[0] [2]]" {
+		t.Errorf("got %s", got)
+	}
+
+	for _, sql := range []string{
+		"SELECT GREATEST() FROM prices",
+		"SELECT LEAST(Date, Close) FROM prices",
+		"SELECT IF(Close, 1, 2) FROM prices",
+		"SELECT IIF(Close > 1, 1) FROM prices",
+		"SELECT IF(Close > 1, Date, Close) FROM prices",
+	} {
+		if _, err := ExecuteQuery(mustParse(t, sql), table); err == nil {
+			t.Errorf("expected %q to fail", sql)
+		}
+	}
+}
+
+func TestArithmeticErrors(t *testing.T) {
+	table := newPricesRecord(t)
+	for sql, want := range map[string]string{
+		"SELECT Close / 0 FROM prices":                       "division by zero in (Close / 0)",
+		"SELECT Volume / (Volume - Volume) FROM prices":      "division by zero in (Volume / (Volume - Volume))",
+		"SELECT MOD(Close, 0) FROM prices":                   "division by zero in MOD(Close, 0)",
+		"SELECT 9223372036854775807 + 1 FROM prices":         "integer overflow in (9223372036854775807 + 1)",
+		"SELECT -9223372036854775807 - 2 FROM prices":        "integer overflow",
+		"SELECT 4611686018427387904 * 2 FROM prices":         "integer overflow",
+		"SELECT -(-9223372036854775807 - 1) FROM prices":     "integer overflow",
+		"SELECT (-9223372036854775807 - 1) / -1 FROM prices": "integer overflow",
+	} {
+		if _, err := ExecuteQuery(mustParse(t, sql), table); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: expected %q, got %v", sql, want, err)
+		}
+	}
+	rows, err := recordRows(runQuery(t, table, "SELECT 4611686018427387903 * 2, -9223372036854775807 - 1, -4 / 3 FROM prices WHERE Close > 1000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(rows); got != "[[9223372036854775806 -9223372036854775808 -1]]" {
+		t.Errorf("got %s", got)
+	}
+
+	catalog := NewMemoryCatalog()
+	defer catalog.Release()
+	catalog.Register("prices", table)
+	session := NewSession(catalog)
+	mustExecuteScript(t, session, `
+		SET division_by_zero = 'null';
+		CREATE TABLE t AS SELECT Close, Close / 0 AS q FROM prices WHERE Close > 1000;
+		UPDATE t SET Close = MOD(Close, Close - Close)
+	`)
+	result, err := session.Execute(mustParse(t, "SELECT Close, q, 1 / 0.0 FROM t"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer result.Release()
+	if rows, err = recordRows(result); err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprint(rows); got != "[[<nil> <nil> <nil>]]" {
+		t.Errorf("expected NULL for each division by zero, got %s", got)
+	}
+	var options Options
+	if err := options.Set("division_by_zero", "sometimes"); err == nil {
+		t.Errorf("expected an invalid division_by_zero to fail")
+	}
+}
+
+func TestGroupKeys(t *testing.T) {
+	table := newPricesRecord(t)
+	// Keys are compared by value, so no text they contain can make two keys
+	// collide, and NULLs fall in one group apart from the string '<nil>'
+	result := runQuery(t, table, `SELECT x, y, COUNT(*) FROM (VALUES ('a|b', 'c'), ('a', 'b|c'), ('a', 'b|c'),
+		('n', NULL), ('n', '<nil>'), ('n', NULL)) v(x, y) GROUP BY x, y`)
+	rows, err := recordRows(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "[[a b|c 2] [a|b c 1] [n <nil> 1] [n <nil> 2]]"
+	if got := fmt.Sprint(rows); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if rows[2][1] != "<nil>" || rows[3][1] != nil {
+		t.Errorf("NULL keys sort after '<nil>', got %#v and %#v", rows[2][1], rows[3][1])
+	}
+}
+
+func TestIntegerAggregates(t *testing.T) {
+	table := newPricesRecord(t)
+	// 2^53 + 1 has no float64 of its own, so only integer sums are exact
+	rows, err := recordRows(runQuery(t, table, "SELECT COUNT(*), COUNT(x), SUM(x), MIN(x), MAX(x) FROM (VALUES (9007199254740993), (2), (NULL)) v(x)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fmt.Sprintf("%#v", rows[0]); got != "[]interface {}{3, 2, 9007199254740995, 2, 9007199254740993}" {
+		t.Errorf("got %s", got)
+	}
+
+	windows := runQuery(t, table, `SELECT x, SUM(x) OVER (ORDER BY x), COUNT(x) OVER (ORDER BY x ROWS 1 PRECEDING),
+		SUM(x) OVER (ORDER BY x ROWS BETWEEN CURRENT ROW AND UNBOUNDED FOLLOWING)
+		FROM (VALUES (9007199254740993), (2)) v(x) ORDER BY x`)
+	for col, want := range map[int]string{1: "[2 9007199254740995]", 2: "[1 2]", 3: "[9007199254740995 9007199254740993]"} {
+		if got := fmt.Sprint(int64Column(t, windows, col)); got != want {
+			t.Errorf("window column %d: got %s, want %s", col, got, want)
+		}
+	}
+
+	for _, sql := range []string{
+		"SELECT SUM(x) FROM (VALUES (9223372036854775807), (1)) v(x)",
+		"SELECT SUM(x) OVER (ORDER BY x) FROM (VALUES (9223372036854775807), (1)) v(x)",
+		"SELECT SUM(x) OVER (ORDER BY x ROWS 1 PRECEDING) FROM (VALUES (9223372036854775807), (1)) v(x)",
+	} {
+		if _, err := ExecuteQuery(mustParse(t, sql), table); err == nil || !strings.Contains(err.Error(), "integer overflow in SUM") {
+			t.Errorf("%s: expected an overflow, got %v", sql, err)
+		}
+	}
+}
+
+func TestCompiledExpressions(t *testing.T) {
+	table := runQuery(t, newPricesRecord(t), "SELECT * FROM (VALUES (1, 2.5, 'a', 0), (NULL, NULL, NULL, NULL), (9223372036854775807, 0.0, '2020-12-01', 3)) v(i, f, s, z)")
+	for _, expr := range []string{
+		"i", "f", "s", "i + 1", "i * 2", "i - z", "i / z", "f / z", "z / f", "i + f", "-i", "i / 2 + f * 3",
+		"i > 1", "i = 1.0", "f <= 2.5", "f <> z", "z > 2", "i IS NULL", "s > '2020'", "s = DATE '2020-12-01'",
+		"CAST(i AS DOUBLE)", "ABS(z - 5)", "COALESCE(i, 7) + 1", "IF(z > 0, i / z, 0)", "i > 0 AND f > 1", "missing + 1",
+	} {
+		e := mustParse(t, "SELECT "+expr+" FROM t").Projections[0]
+		compiled := compileExpression(e, table)
+		for row := 0; row < int(table.NumRows()); row++ {
+			want, wantErr := evaluateExpression(e, table, row)
+			got, err := compiled.eval(row)
+			if fmt.Sprintf("%T %v", got, got) != fmt.Sprintf("%T %v", want, want) || fmt.Sprint(err) != fmt.Sprint(wantErr) {
+				t.Errorf("%s at row %d: compiled to %v (%v), want %v (%v)", expr, row, got, err, want, wantErr)
+			}
+		}
+	}
+
+	// Integer and float arithmetic over columns runs on unboxed values
+	for expr, want := range map[string]operandKind{"i * 2 - z": kindInt, "i / 2 + f * 3": kindFloat, "s": kindUnsupported} {
+		if got := compileExpression(mustParse(t, "SELECT "+expr+" FROM t").Projections[0], table).kind; got != want {
+			t.Errorf("%s: compiled to kind %v, want %v", expr, got, want)
+		}
+	}
+}
+
+func TestZoneMaps(t *testing.T) {
+	defer func(rows int) { zoneRows = rows }(zoneRows)
+	zoneRows = 2
+
+	catalog := NewMemoryCatalog()
+	defer catalog.Release()
+	catalog.Register("series", runQuery(t, newPricesRecord(t), "SELECT * FROM (VALUES (1, 'a'), (2, 'b'), (3, NULL), (4, NULL), (5, 'e'), (6, 'f'), (7, 'g')) v(x, s)"))
+	session := NewSession(catalog)
+	run := func(sql string) string {
+		t.Helper()
+		result, err := session.Execute(mustParse(t, sql))
+		if err != nil {
+			t.Fatalf("query %q failed: %v", sql, err)
+		}
+		defer result.Release()
+		rows, err := recordRows(result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fmt.Sprint(rows)
+	}
+
+	for sql, want := range map[string]string{
+		"SELECT x FROM series WHERE x > 4":                                             "[[5] [6] [7]]",
+		"SELECT x FROM series WHERE 3 >= x AND s IS NOT NULL":                          "[[1] [2]]",
+		"SELECT x FROM series WHERE x = 2.5 OR x = 6":                                  "[[6]]",
+		"SELECT x FROM series WHERE s IS NULL":                                         "[[3] [4]]",
+		"SELECT x FROM series WHERE s < 'c' OR s >= 'g'":                               "[[1] [2] [7]]",
+		"SELECT x FROM series WHERE x <> 7 AND x * 2 > 10":                             "[[6]]",
+		"SELECT COUNT(*) FROM series WHERE x > 2 GROUP BY s IS NULL ORDER BY COUNT(*)": "[[2] [3]]",
+	} {
+		if got := run(sql); got != want {
+			t.Errorf("%s: got %s, want %s", sql, got, want)
+		}
+	}
+
+	// Zones are rows 1-2, 3-4, 5-6 and 7
+	table, err := catalog.Table("series")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer table.Release()
+	if catalog.zones[table.Column(0)] == nil {
+		t.Error("the filters did not build a zone map")
+	}
+	ec := &execContext{catalog: catalog}
+	for cond, want := range map[string][]bool{
+		"x > 4":                   {true, true, false, false},
+		"x <= 1 OR x = 7":         {false, true, true, false},
+		"s IS NULL":               {true, false, true, true},
+		"s IS NOT NULL AND x < 5": {false, true, true, true},
+		"x + 0 > 4":               {false, false, false, false},
+	} {
+		pruner := newZonePruner(mustParse(t, "SELECT x FROM series WHERE "+cond).Where, table, ec)
+		for z, excluded := range want {
+			if got := pruner.excludes(2*z, min(2*z+2, 7)); got != excluded {
+				t.Errorf("%s: zone %d excluded is %v, want %v", cond, z, got, excluded)
+			}
+		}
+	}
+
+	// A write replaces the table's zone maps
+	mustExecuteScript(t, session, "INSERT INTO series VALUES (0, 'z')")
+	if got := run("SELECT x FROM series WHERE x < 1 OR s > 'y'"); got != "[[0]]" {
+		t.Errorf("after an insert: got %s", got)
+	}
+	if _, ok := catalog.zoneMap(table.Column(0)); ok {
+		t.Errorf("the replaced table still has zone maps")
+	}
+}
+
+func TestStringDictionaries(t *testing.T) {
+	defer func(size, limit int) { morselSize, dictionaryLimit = size, limit }(morselSize, dictionaryLimit)
+
+	newCatalog := func() *MemoryCatalog {
+		catalog := NewMemoryCatalog()
+		prices := newPricesRecord(t)
+		catalog.Register("sales", runQuery(t, prices, "SELECT * FROM (VALUES ('east', 'a', 1), ('west', 'b', 2), (NULL, 'a', 3), ('east', 'b', 4), ('north', NULL, 5), ('west', 'b', 6), (NULL, 'a', 7)) v(region, product, amount)"))
+		catalog.Register("regions", runQuery(t, prices, "SELECT * FROM (VALUES ('west', 'West'), ('east', 'East'), ('south', 'South'), (NULL, 'None')) v(region, label)"))
+		return catalog
+	}
+	queries := map[string]string{
+		"SELECT region, SUM(amount), COUNT(*) FROM sales GROUP BY region":                                             "[[east 5 2] [north 5 1] [west 8 2] [<nil> 10 2]]",
+		"SELECT region, product, SUM(amount) FROM sales GROUP BY region, product":                                     "[[east a 1] [east b 4] [north <nil> 5] [west b 8] [<nil> a 10]]",
+		"SELECT region, SUM(amount) FROM sales WHERE amount > 1 GROUP BY region ORDER BY SUM(amount)":                 "[[east 4] [north 5] [west 8] [<nil> 10]]",
+		"SELECT label, SUM(amount) FROM sales JOIN regions ON sales.region = regions.region GROUP BY label":           "[[East 5] [West 8]]",
+		"SELECT r.label, s.amount FROM regions r LEFT JOIN sales s ON r.region = s.region ORDER BY r.label, s.amount": "[[East 1] [East 4] [None <nil>] [South <nil>] [West 2] [West 6]]",
+		"SELECT COUNT(*) FROM sales s, regions r WHERE s.region = r.region AND s.product = 'b'":                       "[[3]]",
+	}
+
+	// Grouping and joining on codes gives what grouping and joining on the
+	// values does, whether or not the columns have dictionaries, and whether
+	// or not the rows are grouped in several morsels
+	for _, size := range []int{2, 1 << 13} {
+		morselSize = size
+		for _, limit := range []int{0, 2, 1 << 12} {
+			dictionaryLimit = limit
+			catalog := newCatalog()
+			session := NewSession(catalog)
+			for sql, want := range queries {
+				result, err := session.Execute(mustParse(t, sql))
+				if err != nil {
+					t.Fatalf("query %q failed: %v", sql, err)
+				}
+				rows, err := recordRows(result)
+				result.Release()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := fmt.Sprint(rows); got != want {
+					t.Errorf("morsels of %d rows, dictionaries of up to %d values: %s: got %s, want %s", size, limit, sql, got, want)
+				}
+			}
+			catalog.Release()
+		}
+	}
+
+	dictionaryLimit = 3
+	catalog := newCatalog()
+	defer catalog.Release()
+	sales, err := catalog.Table("sales")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sales.Release()
+
+	// Codes number the values in the order they first appear
+	dict, ok := catalog.dictionary(sales.Column(0))
+	if !ok {
+		t.Fatal("expected a dictionary of region")
+	}
+	if got := fmt.Sprint(dict.codes, dict.values); got != "[0 1 -1 0 2 1 -1] [east west north]" {
+		t.Errorf("unexpected dictionary %s", got)
+	}
+	for i, name := range []string{"product", "amount"} {
+		if _, ok := catalog.dictionary(sales.Column(i + 1)); ok != (name == "product") {
+			t.Errorf("%s has a dictionary: %v", name, ok)
+		}
+	}
+	if _, ok := catalog.dictionary(newPricesRecord(t).Column(0)); ok {
+		t.Errorf("a column of no table in the catalog has a dictionary")
+	}
+
+	// Both GROUP BY columns must have dictionaries for the rows to be grouped
+	// by code
+	ec := &execContext{catalog: catalog}
+	for sql, coded := range map[string]bool{
+		"SELECT region FROM sales GROUP BY region":          true,
+		"SELECT region FROM sales GROUP BY region, product": true,
+		"SELECT region FROM sales GROUP BY region, amount":  false,
+		"SELECT region FROM sales GROUP BY UPPER(region)":   false,
+	} {
+		q := mustParse(t, sql)
+		if got := newCodedGroups(keyDictionaries(q.GroupBy, sales, ec)) != nil; got != coded {
+			t.Errorf("%s: grouped by code is %v, want %v", sql, got, coded)
+		}
+	}
+
+	// One more distinct value than the limit and there is no dictionary
+	mustExecuteScript(t, NewSession(catalog), "INSERT INTO sales VALUES ('south', 'c', 8)")
+	updated, err := catalog.Table("sales")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer updated.Release()
+	if _, ok := catalog.dictionary(updated.Column(0)); ok {
+		t.Errorf("expected no dictionary of 4 regions")
+	}
+	if _, ok := catalog.dictionary(sales.Column(0)); ok {
+		t.Errorf("the replaced table still has a dictionary")
+	}
+}
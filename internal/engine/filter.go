@@ -0,0 +1,434 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/apache/arrow/go/arrow/array"
+
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// truth is the outcome of a condition for one row: true, false or unknown.
+type truth uint8
+
+const (
+	truthFalse truth = iota
+	truthTrue
+	truthNull
+)
+
+func truthOf(b bool) truth {
+	if b {
+		return truthTrue
+	}
+	return truthFalse
+}
+
+// truthOfValue reads an evaluated value as a truth, NULL being unknown.
+func truthOfValue(v interface{}) truth {
+	if v == nil {
+		return truthNull
+	}
+	return truthOf(toBool(v))
+}
+
+// value is t as an evaluated value, nil when it is unknown.
+func (t truth) value() interface{} {
+	if t == truthNull {
+		return nil
+	}
+	return t == truthTrue
+}
+
+// and combines two truths as SQL's AND does: false if either is false,
+// otherwise unknown if either is unknown.
+func (t truth) and(u truth) truth {
+	switch {
+	case t == truthFalse || u == truthFalse:
+		return truthFalse
+	case t == truthNull || u == truthNull:
+		return truthNull
+	default:
+		return truthTrue
+	}
+}
+
+// or combines two truths as SQL's OR does: true if either is true, otherwise
+// unknown if either is unknown.
+func (t truth) or(u truth) truth {
+	switch {
+	case t == truthTrue || u == truthTrue:
+		return truthTrue
+	case t == truthNull || u == truthNull:
+		return truthNull
+	default:
+		return truthFalse
+	}
+}
+
+// filterRows returns the rows of table for which where holds, or every row
+// when where is nil. Conditions built from comparisons, IS NULL, NOT, AND and
+// OR over columns and constants are evaluated a column at a time; anything
+// else falls back to evaluating the condition row by row.
+func filterRows(where queryparser.Expression, table array.Record) ([]int, error) {
+	return filterRange(where, table, 0, int(table.NumRows()))
+}
+
+// filterRange is filterRows over the rows [start, end) of table. Rows are
+// numbered, and evaluated row by row, as they are in table itself, so that
+// shared subexpressions find the same rows in every morsel.
+func filterRange(where queryparser.Expression, table array.Record, start, end int) ([]int, error) {
+	rows := make([]int, 0, end-start)
+	if where == nil {
+		for row := start; row < end; row++ {
+			rows = append(rows, row)
+		}
+		return rows, nil
+	}
+
+	slice := table
+	if start > 0 || end < int(table.NumRows()) {
+		slice = table.NewSlice(int64(start), int64(end))
+		defer slice.Release()
+	}
+	if mask, ok := evalCondition(where, slice); ok {
+		for i, t := range mask {
+			if t == truthTrue {
+				rows = append(rows, start+i)
+			}
+		}
+		return rows, nil
+	}
+
+	cond := compileExpression(where, table)
+	for row := start; row < end; row++ {
+		result, err := cond.eval(row)
+		if err != nil {
+			return nil, err
+		}
+		keep, err := whereHolds(result)
+		if err != nil {
+			return nil, err
+		}
+		if keep {
+			rows = append(rows, row)
+		}
+	}
+	return rows, nil
+}
+
+// whereHolds reports whether a row whose WHERE condition evaluated to result
+// is kept.
+func whereHolds(result interface{}) (bool, error) {
+	switch r := result.(type) {
+	case bool:
+		return r, nil
+	case nil:
+		// an unknown (NULL) condition filters the row out
+		return false, nil
+	default:
+		return false, fmt.Errorf("WHERE clause must evaluate to boolean")
+	}
+}
+
+// evalCondition evaluates a condition for every row of table at once. It
+// reports false when the condition uses anything it cannot evaluate that way,
+// and the caller must evaluate it row by row instead. AND and OR follow SQL's
+// three-valued logic, as evalBinaryOp does.
+func evalCondition(expr queryparser.Expression, table array.Record) ([]truth, bool) {
+	switch e := expr.(type) {
+	case *queryparser.BinaryExpr:
+		switch e.Op {
+		case "AND", "OR":
+			left, ok := evalCondition(e.Left, table)
+			if !ok {
+				return nil, false
+			}
+			right, ok := evalCondition(e.Right, table)
+			if !ok {
+				return nil, false
+			}
+			for i, r := range right {
+				if e.Op == "AND" {
+					left[i] = left[i].and(r)
+				} else {
+					left[i] = left[i].or(r)
+				}
+			}
+			return left, true
+		case "=", "!=", "<>", ">", "<", ">=", "<=":
+			return evalComparison(e.Op, e.Left, e.Right, table)
+		}
+	case *queryparser.UnaryExpr:
+		if e.Op != "NOT" {
+			return nil, false
+		}
+		mask, ok := evalCondition(e.Expr, table)
+		if !ok {
+			return nil, false
+		}
+		for i, t := range mask {
+			if t != truthNull {
+				mask[i] = truthOf(t == truthFalse)
+			}
+		}
+		return mask, true
+	case *queryparser.IsNullExpr:
+		ref, ok := e.Expr.(*queryparser.ColumnRef)
+		if !ok {
+			return nil, false
+		}
+		col, err := resolveColumn(table, ref)
+		if err != nil {
+			return nil, false
+		}
+		arr := table.Column(col)
+		mask := make([]truth, arr.Len())
+		for i := range mask {
+			mask[i] = truthOf(arr.IsNull(i) != e.Not)
+		}
+		return mask, true
+	case *queryparser.ColumnRef:
+		col, err := resolveColumn(table, e)
+		if err != nil {
+			return nil, false
+		}
+		arr, ok := table.Column(col).(*array.Boolean)
+		if !ok {
+			return nil, false
+		}
+		mask := make([]truth, arr.Len())
+		for i := range mask {
+			if arr.IsNull(i) {
+				mask[i] = truthNull
+			} else {
+				mask[i] = truthOf(arr.Value(i))
+			}
+		}
+		return mask, true
+	}
+	return nil, false
+}
+
+// operandKind is the family of values a comparison operand holds.
+type operandKind int
+
+const (
+	kindUnsupported operandKind = iota
+	kindInt
+	kindFloat
+	kindString
+	kindBool
+	kindDate
+)
+
+// vectorOperand is one side of a comparison: a column, or a constant when
+// arr is nil.
+type vectorOperand struct {
+	arr   array.Interface
+	value interface{}
+	kind  operandKind
+}
+
+// comparisonOperand resolves a column reference or constant for evalComparison.
+func comparisonOperand(expr queryparser.Expression, table array.Record) (vectorOperand, bool) {
+	switch e := expr.(type) {
+	case *queryparser.ColumnRef:
+		col, err := resolveColumn(table, e)
+		if err != nil {
+			return vectorOperand{}, false
+		}
+		op := vectorOperand{arr: table.Column(col)}
+		switch op.arr.(type) {
+		case *array.Int64:
+			op.kind = kindInt
+		case *array.Float64:
+			op.kind = kindFloat
+		case *array.String:
+			op.kind = kindString
+		case *array.Boolean:
+			op.kind = kindBool
+		case *array.Date32:
+			op.kind = kindDate
+		}
+		return op, op.kind != kindUnsupported
+	case *queryparser.Literal, *constantValue:
+		val, err := evaluateExpression(e, table, 0)
+		if err != nil {
+			return vectorOperand{}, false
+		}
+		op := vectorOperand{value: val}
+		switch val.(type) {
+		case nil:
+			// comparing with NULL is unknown whatever the other side holds
+		case int64:
+			op.kind = kindInt
+		case float64:
+			op.kind = kindFloat
+		case string:
+			op.kind = kindString
+		case bool:
+			op.kind = kindBool
+		case date:
+			op.kind = kindDate
+		default:
+			return vectorOperand{}, false
+		}
+		return op, true
+	}
+	return vectorOperand{}, false
+}
+
+func (o vectorOperand) isNull(i int) bool {
+	if o.arr == nil {
+		return o.value == nil
+	}
+	return o.arr.IsNull(i)
+}
+
+// ints reads an integer, date or boolean operand as int64, ordering false
+// before true.
+func (o vectorOperand) ints() func(i int) int64 {
+	switch a := o.arr.(type) {
+	case *array.Int64:
+		return a.Value
+	case *array.Date32:
+		return func(i int) int64 { return int64(a.Value(i)) }
+	case *array.Boolean:
+		return func(i int) int64 { return boolInt(a.Value(i)) }
+	}
+	var c int64
+	switch v := o.value.(type) {
+	case int64:
+		c = v
+	case date:
+		c = int64(v)
+	case bool:
+		c = boolInt(v)
+	}
+	return func(int) int64 { return c }
+}
+
+func (o vectorOperand) floats() func(i int) float64 {
+	switch a := o.arr.(type) {
+	case *array.Int64:
+		return func(i int) float64 { return float64(a.Value(i)) }
+	case *array.Float64:
+		return a.Value
+	}
+	c := toFloat(o.value)
+	return func(int) float64 { return c }
+}
+
+func (o vectorOperand) strings() func(i int) string {
+	if a, ok := o.arr.(*array.String); ok {
+		return a.Value
+	}
+	c, _ := o.value.(string)
+	return func(int) string { return c }
+}
+
+func boolInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// evalComparison compares two operands row by row with typed loops. The
+// operands must order the same way compareOperands would order their values.
+func evalComparison(op string, leftExpr, rightExpr queryparser.Expression, table array.Record) ([]truth, bool) {
+	left, ok := comparisonOperand(leftExpr, table)
+	if !ok {
+		return nil, false
+	}
+	right, ok := comparisonOperand(rightExpr, table)
+	if !ok {
+		return nil, false
+	}
+	mask := make([]truth, table.NumRows())
+	if (left.arr == nil && left.value == nil) || (right.arr == nil && right.value == nil) {
+		for i := range mask {
+			mask[i] = truthNull
+		}
+		return mask, true
+	}
+
+	// A string constant compared with a date is read as a date
+	for _, pair := range [][2]*vectorOperand{{&left, &right}, {&right, &left}} {
+		if pair[0].kind == kindString && pair[0].arr == nil && pair[1].kind == kindDate {
+			d, err := parseDate(pair[0].value.(string))
+			if err != nil {
+				return nil, false
+			}
+			pair[0].value, pair[0].kind = d, kindDate
+		}
+	}
+
+	var compare func(i int) int
+	switch {
+	case left.kind == right.kind && (left.kind == kindInt || left.kind == kindDate || left.kind == kindBool):
+		l, r := left.ints(), right.ints()
+		compare = func(i int) int { return compareInts(l(i), r(i)) }
+	case (left.kind == kindInt || left.kind == kindFloat) && (right.kind == kindInt || right.kind == kindFloat):
+		l, r := left.floats(), right.floats()
+		compare = func(i int) int { return compareFloats(l(i), r(i)) }
+	case left.kind == kindString && right.kind == kindString:
+		l, r := left.strings(), right.strings()
+		compare = func(i int) int { return strings.Compare(l(i), r(i)) }
+	default:
+		return nil, false
+	}
+
+	holds := comparisonHolds(op)
+	for i := range mask {
+		if left.isNull(i) || right.isNull(i) {
+			mask[i] = truthNull
+			continue
+		}
+		mask[i] = truthOf(holds(compare(i)))
+	}
+	return mask, true
+}
+
+// comparisonHolds returns whether op holds given the three-way comparison of
+// its operands.
+func comparisonHolds(op string) func(c int) bool {
+	switch op {
+	case "=":
+		return func(c int) bool { return c == 0 }
+	case "!=", "<>":
+		return func(c int) bool { return c != 0 }
+	case ">":
+		return func(c int) bool { return c > 0 }
+	case "<":
+		return func(c int) bool { return c < 0 }
+	case ">=":
+		return func(c int) bool { return c >= 0 }
+	default:
+		return func(c int) bool { return c <= 0 }
+	}
+}
+
+func compareInts(l, r int64) int {
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func compareFloats(l, r float64) int {
+	switch {
+	case l < r:
+		return -1
+	case l > r:
+		return 1
+	default:
+		return 0
+	}
+}
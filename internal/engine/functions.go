@@ -0,0 +1,359 @@
+package engine
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+
+	"github.com/kris-gaudel/tinylake/internal/planner"
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// scalarFunction is a function applied to the evaluated arguments of one row.
+// typ gives the binder the type of its result for arguments of the given
+// types, failing for arguments it does not take.
+type scalarFunction struct {
+	minArgs, maxArgs int // maxArgs is -1 when there is no limit
+	eval             func(args []interface{}) (interface{}, error)
+	typ              func(args []arrow.DataType) (arrow.DataType, error)
+}
+
+var scalarFunctions map[string]scalarFunction
+
+func init() {
+	scalarFunctions = map[string]scalarFunction{
+		"ROUND":  {1, 2, evalRound, roundType},
+		"UPPER":  {1, 1, stringFunction(strings.ToUpper), stringType},
+		"LOWER":  {1, 1, stringFunction(strings.ToLower), stringType},
+		"LENGTH": {1, 1, evalLength, lengthType},
+
+		"ABS":     {1, 1, evalAbs, numberType},
+		"SIGN":    {1, 1, evalSign, numberType},
+		"FLOOR":   {1, 1, integerPartFunction("FLOOR", -1, math.Floor), integerPartType},
+		"CEIL":    {1, 1, integerPartFunction("CEIL", 1, math.Ceil), integerPartType},
+		"CEILING": {1, 1, integerPartFunction("CEILING", 1, math.Ceil), integerPartType},
+		"TRUNC":   {1, 1, integerPartFunction("TRUNC", 0, math.Trunc), integerPartType},
+		"MOD":     {2, 2, evalMod, modType},
+		"POWER":   {2, 2, floatFunction2("POWER", math.Pow), floatType},
+		"POW":     {2, 2, floatFunction2("POW", math.Pow), floatType},
+		"SQRT":    {1, 1, floatFunction("SQRT", math.Sqrt), floatType},
+		"CBRT":    {1, 1, floatFunction("CBRT", math.Cbrt), floatType},
+		"EXP":     {1, 1, floatFunction("EXP", math.Exp), floatType},
+		"LN":      {1, 1, floatFunction("LN", math.Log), floatType},
+		"LOG":     {1, 2, evalLog, floatType},
+		"LOG2":    {1, 1, floatFunction("LOG2", math.Log2), floatType},
+		"LOG10":   {1, 1, floatFunction("LOG10", math.Log10), floatType},
+		"PI":      {0, 0, evalPi, floatType},
+		"SIN":     {1, 1, floatFunction("SIN", math.Sin), floatType},
+		"COS":     {1, 1, floatFunction("COS", math.Cos), floatType},
+		"TAN":     {1, 1, floatFunction("TAN", math.Tan), floatType},
+		"ASIN":    {1, 1, floatFunction("ASIN", math.Asin), floatType},
+		"ACOS":    {1, 1, floatFunction("ACOS", math.Acos), floatType},
+		"ATAN":    {1, 1, floatFunction("ATAN", math.Atan), floatType},
+		"ATAN2":   {2, 2, floatFunction2("ATAN2", math.Atan2), floatType},
+		"DEGREES": {1, 1, floatFunction("DEGREES", func(x float64) float64 { return x * 180 / math.Pi }), floatType},
+		"RADIANS": {1, 1, floatFunction("RADIANS", func(x float64) float64 { return x * math.Pi / 180 }), floatType},
+
+		"NOW":        {0, 0, evalNow, nowType},
+		"DATE_TRUNC": {2, 2, evalDateTrunc, dateTruncType},
+		"DATE_PART":  {2, 2, evalDatePart, datePartType},
+
+		"REGEXP_MATCHES": {2, 3, evalRegexpMatches, regexpType(arrow.FixedWidthTypes.Boolean)},
+		"REGEXP_EXTRACT": {2, 3, evalRegexpExtract, regexpExtractType},
+		"REGEXP_REPLACE": {3, 4, evalRegexpReplace, regexpType(arrow.BinaryTypes.String)},
+
+		"COALESCE": {1, -1, evalFirstNonNull, coalesceType},
+		"IFNULL":   {2, 2, evalFirstNonNull, coalesceType},
+		"NULLIF":   {2, 2, evalNullIf, nullIfType},
+		"GREATEST": {1, -1, extremeFunction(1), coalesceType},
+		"LEAST":    {1, -1, extremeFunction(-1), coalesceType},
+		"IF":       {3, 3, evalIf, ifType},
+		"IIF":      {3, 3, evalIf, ifType},
+	}
+}
+
+// lookupFunction returns the scalar function called by fc, checking that it
+// exists and is given a valid number of arguments.
+func lookupFunction(fc *queryparser.FuncCall) (scalarFunction, error) {
+	fn, ok := scalarFunctions[strings.ToUpper(fc.Name)]
+	if !ok {
+		return fn, queryparser.ErrorAt(fc.Pos, "unknown function: %s", fc.Name)
+	}
+	if fc.Distinct {
+		return fn, queryparser.ErrorAt(fc.Pos, "DISTINCT is only allowed in aggregate functions, not %s", fc.Name)
+	}
+	if n := len(fc.Args); n < fn.minArgs || (n > fn.maxArgs && fn.maxArgs >= 0) {
+		switch {
+		case fn.maxArgs < 0:
+			return fn, queryparser.ErrorAt(fc.Pos, "%s expects at least %d argument(s), got %d", fc.Name, fn.minArgs, n)
+		case fn.minArgs == fn.maxArgs:
+			return fn, queryparser.ErrorAt(fc.Pos, "%s expects %d argument(s), got %d", fc.Name, fn.minArgs, n)
+		}
+		return fn, queryparser.ErrorAt(fc.Pos, "%s expects %d to %d arguments, got %d", fc.Name, fn.minArgs, fn.maxArgs, n)
+	}
+	return fn, nil
+}
+
+// evalScalarFunction applies the scalar function called by fc to its already
+// evaluated arguments.
+func evalScalarFunction(fc *queryparser.FuncCall, args []interface{}) (interface{}, error) {
+	fn, err := lookupFunction(fc)
+	if err != nil {
+		return nil, err
+	}
+	val, err := fn.eval(args)
+	if errors.Is(err, errDivisionByZero) || errors.Is(err, errIntegerOverflow) {
+		err = arithmeticError(err, fc)
+	}
+	return val, err
+}
+
+// roundType is the type of ROUND: that of the number rounded, though a
+// decimal may keep fewer fractional digits.
+func roundType(args []arrow.DataType) (arrow.DataType, error) {
+	if len(args) == 2 && !isType(args[1], arrow.PrimitiveTypes.Int64) {
+		return nil, fmt.Errorf("digits must be an integer, got %s", typeName(args[1]))
+	}
+	return integerPartType(args[:1])
+}
+
+// stringType is the type of a function from a string to a string.
+func stringType(args []arrow.DataType) (arrow.DataType, error) {
+	if !isType(args[0], arrow.BinaryTypes.String) {
+		return nil, fmt.Errorf("expects a string, got %s", typeName(args[0]))
+	}
+	return arrow.BinaryTypes.String, nil
+}
+
+func lengthType(args []arrow.DataType) (arrow.DataType, error) {
+	if _, err := stringType(args); err != nil {
+		return nil, err
+	}
+	return arrow.PrimitiveTypes.Int64, nil
+}
+
+// evalRound implements ROUND(x [, digits]). Integers are returned unchanged
+// unless digits is negative, and decimals keep at most digits fractional
+// digits; halves round away from zero.
+func evalRound(args []interface{}) (interface{}, error) {
+	digits := int64(0)
+	if len(args) == 2 {
+		if args[1] == nil {
+			return nil, nil
+		}
+		d, ok := args[1].(int64)
+		if !ok {
+			return nil, fmt.Errorf("ROUND digits must be an integer, got %T", args[1])
+		}
+		digits = d
+	}
+
+	switch x := args[0].(type) {
+	case nil:
+		return nil, nil
+	case int64:
+		if digits >= 0 {
+			return x, nil
+		}
+		scale := math.Pow(10, float64(-digits))
+		return int64(math.Round(float64(x)/scale) * scale), nil
+	case float64:
+		scale := math.Pow(10, float64(digits))
+		return math.Round(x*scale) / scale, nil
+	case decimal:
+		if digits >= int64(x.scale) {
+			return x, nil
+		}
+		// Past the digits a Decimal128 holds every value rounds to 0
+		r := x.rescale(int32(max(digits, -maxDecimalPrecision-1)))
+		if r.scale < 0 {
+			r = r.rescale(0)
+		}
+		return r, nil
+	default:
+		return nil, fmt.Errorf("ROUND expects a number, got %T", args[0])
+	}
+}
+
+// stringFunction lifts a string transformation into a scalar function that
+// passes NULL through.
+func stringFunction(f func(string) string) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		switch s := args[0].(type) {
+		case nil:
+			return nil, nil
+		case string:
+			return f(s), nil
+		default:
+			return nil, fmt.Errorf("expected a string argument, got %T", args[0])
+		}
+	}
+}
+
+// evalLength implements LENGTH(s), counting characters rather than bytes.
+func evalLength(args []interface{}) (interface{}, error) {
+	switch s := args[0].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return int64(utf8.RuneCountInString(s)), nil
+	default:
+		return nil, fmt.Errorf("LENGTH expects a string, got %T", args[0])
+	}
+}
+
+// coalesceType is the type of COALESCE and IFNULL, whose arguments must share
+// a type. Numbers of different kinds are floats when one is, and otherwise
+// decided by the values, as for a mix of integers and decimals.
+func coalesceType(args []arrow.DataType) (arrow.DataType, error) {
+	result := unknownType
+	mixed, floats := false, false
+	for _, dt := range args {
+		dt = evalType(dt)
+		switch {
+		case dt == unknownType:
+			continue
+		case result == unknownType:
+			result = dt
+		case arrow.TypeEqual(dt, result):
+		case isNumericType(dt) && isNumericType(result):
+			mixed = true
+		default:
+			return nil, fmt.Errorf("arguments must share a type, got %s and %s", typeName(result), typeName(dt))
+		}
+		floats = floats || dt.ID() == arrow.FLOAT64
+	}
+	switch {
+	case mixed && floats:
+		return arrow.PrimitiveTypes.Float64, nil
+	case mixed:
+		return unknownType, nil
+	}
+	return result, nil
+}
+
+// nullIfType is the type of NULLIF: that of its first argument.
+func nullIfType(args []arrow.DataType) (arrow.DataType, error) {
+	if args[0] == unknownType {
+		return evalType(args[1]), nil
+	}
+	return evalType(args[0]), nil
+}
+
+func isCoalesce(fc *queryparser.FuncCall) bool {
+	name := strings.ToUpper(fc.Name)
+	return name == "COALESCE" || name == "IFNULL"
+}
+
+// evalCoalesce implements COALESCE(x, ...) and IFNULL(x, y) at row, which give
+// their first argument that is not NULL. The arguments after it are not
+// evaluated, so they may be costly, or fail, where they are not needed.
+func evalCoalesce(fc *queryparser.FuncCall, table array.Record, row int) (interface{}, error) {
+	if _, err := lookupFunction(fc); err != nil {
+		return nil, err
+	}
+	for _, arg := range fc.Args {
+		val, err := evaluateExpression(arg, table, row)
+		if val != nil || err != nil {
+			return val, err
+		}
+	}
+	return nil, nil
+}
+
+// evalFirstNonNull implements COALESCE and IFNULL over arguments that are
+// already evaluated.
+func evalFirstNonNull(args []interface{}) (interface{}, error) {
+	for _, arg := range args {
+		if arg != nil {
+			return arg, nil
+		}
+	}
+	return nil, nil
+}
+
+// evalNullIf implements NULLIF(x, y): NULL when x equals y, and x otherwise.
+func evalNullIf(args []interface{}) (interface{}, error) {
+	if args[0] != nil && args[1] != nil && compareOperands(args[0], args[1]) == 0 {
+		return nil, nil
+	}
+	return args[0], nil
+}
+
+// extremeFunction implements GREATEST (sign 1) and LEAST (sign -1), which give
+// the largest or smallest of their arguments that are not NULL, and NULL only
+// when every argument is.
+func extremeFunction(sign int) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		var best interface{}
+		for _, arg := range args {
+			if arg != nil && (best == nil || compareOperands(arg, best)*sign > 0) {
+				best = arg
+			}
+		}
+		return best, nil
+	}
+}
+
+// ifType is the type of IF and IIF: the condition must be a boolean, and the
+// two results share a type as COALESCE's arguments do.
+func ifType(args []arrow.DataType) (arrow.DataType, error) {
+	if args[0] != unknownType && !isType(args[0], arrow.FixedWidthTypes.Boolean) {
+		return nil, fmt.Errorf("condition must be a boolean, got %s", typeName(args[0]))
+	}
+	return coalesceType(args[1:])
+}
+
+func isIf(fc *queryparser.FuncCall) bool {
+	name := strings.ToUpper(fc.Name)
+	return name == "IF" || name == "IIF"
+}
+
+// evalIfAt implements IF(cond, a, b) and IIF at row, which give a when cond is
+// true and b when it is false or NULL. Only the result given is evaluated, as
+// for COALESCE.
+func evalIfAt(fc *queryparser.FuncCall, table array.Record, row int) (interface{}, error) {
+	if _, err := lookupFunction(fc); err != nil {
+		return nil, err
+	}
+	cond, err := evaluateExpression(fc.Args[0], table, row)
+	if err != nil {
+		return nil, err
+	}
+	if toBool(cond) {
+		return evaluateExpression(fc.Args[1], table, row)
+	}
+	return evaluateExpression(fc.Args[2], table, row)
+}
+
+// evalIf implements IF and IIF over arguments that are already evaluated.
+func evalIf(args []interface{}) (interface{}, error) {
+	if toBool(args[0]) {
+		return args[1], nil
+	}
+	return args[2], nil
+}
+
+// ungroupedColumn returns a column referenced outside any aggregate in expr,
+// or nil when every column reference is inside one.
+func ungroupedColumn(expr queryparser.Expression) *queryparser.ColumnRef {
+	switch e := expr.(type) {
+	case *queryparser.ColumnRef:
+		return e
+	case *queryparser.FuncCall:
+		if planner.IsAggregate(e) {
+			return nil
+		}
+	}
+	for _, child := range queryparser.Children(expr) {
+		if col := ungroupedColumn(child); col != nil {
+			return col
+		}
+	}
+	return nil
+}
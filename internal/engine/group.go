@@ -0,0 +1,185 @@
+package engine
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/maphash"
+	"math"
+	"time"
+)
+
+// groupIndex numbers the distinct GROUP BY keys in the order they are first
+// seen. Keys are hashed and compared by their values, not their text, so two
+// rows share a group only when each of their key values is equal. Numbers are
+// equal when their values are, whatever their kind, and NULLs are equal to
+// each other, as GROUP BY puts them in one group.
+type groupIndex struct {
+	seed    maphash.Seed
+	buckets map[uint64][]int // by hash, the groups whose keys have it
+	keys    [][]interface{}  // by group
+}
+
+func newGroupIndex() *groupIndex {
+	return &groupIndex{seed: maphash.MakeSeed(), buckets: map[uint64][]int{}}
+}
+
+// lookup returns the number of the group with key, adding a group if there is
+// none yet.
+func (x *groupIndex) lookup(key []interface{}) (g int, added bool) {
+	var h maphash.Hash
+	h.SetSeed(x.seed)
+	for _, v := range key {
+		hashValue(&h, v)
+	}
+	sum := h.Sum64()
+	for _, g := range x.buckets[sum] {
+		if keysEqual(x.keys[g], key) {
+			return g, false
+		}
+	}
+	g = len(x.keys)
+	x.keys = append(x.keys, key)
+	x.buckets[sum] = append(x.buckets[sum], g)
+	return g, true
+}
+
+// len is the number of groups.
+func (x *groupIndex) len() int {
+	return len(x.keys)
+}
+
+// groupedRows are rows grouped by key, the groups numbered as their index
+// numbers them.
+type groupedRows struct {
+	index *groupIndex
+	rows  [][]int // by group
+}
+
+func newGroupedRows() *groupedRows {
+	return &groupedRows{index: newGroupIndex()}
+}
+
+// add puts rows in the group with key.
+func (r *groupedRows) add(key []interface{}, rows ...int) {
+	g, added := r.index.lookup(key)
+	if added {
+		r.rows = append(r.rows, nil)
+	}
+	r.rows[g] = append(r.rows[g], rows...)
+}
+
+// hashValue writes v to h so that equal values, as valueEqual has them, hash
+// alike.
+func hashValue(h *maphash.Hash, v interface{}) {
+	var buf [8]byte
+	switch x := v.(type) {
+	case nil:
+		h.WriteByte(0)
+	case int64, float64, decimal:
+		// Hashed as the float nearest to them, as 1 and 1.0 must hash alike
+		f := toFloat(x)
+		switch {
+		case f == 0:
+			f = 0 // -0 equals 0
+		case math.IsNaN(f):
+			f = math.NaN()
+		}
+		h.WriteByte(1)
+		binary.LittleEndian.PutUint64(buf[:], math.Float64bits(f))
+		h.Write(buf[:])
+	case string:
+		h.WriteByte(2)
+		binary.LittleEndian.PutUint64(buf[:], uint64(len(x)))
+		h.Write(buf[:])
+		h.WriteString(x)
+	case bool:
+		h.WriteByte(3)
+		if x {
+			h.WriteByte(1)
+		} else {
+			h.WriteByte(0)
+		}
+	case date:
+		h.WriteByte(4)
+		binary.LittleEndian.PutUint64(buf[:], uint64(x))
+		h.Write(buf[:])
+	case time.Time:
+		h.WriteByte(5)
+		binary.LittleEndian.PutUint64(buf[:], uint64(x.UnixNano()))
+		h.Write(buf[:])
+	case list:
+		h.WriteByte(6)
+		binary.LittleEndian.PutUint64(buf[:], uint64(len(x)))
+		h.Write(buf[:])
+		for _, e := range x {
+			hashValue(h, e)
+		}
+	case structValue:
+		h.WriteByte(8)
+		for i, name := range x.names {
+			hashValue(h, name)
+			hashValue(h, x.values[i])
+		}
+	default:
+		h.WriteByte(7)
+		h.WriteString(fmt.Sprint(x))
+	}
+}
+
+func keysEqual(a, b []interface{}) bool {
+	for i := range a {
+		if !valueEqual(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// valueEqual reports whether two key values are the same for grouping: NULL
+// equals NULL and NaN equals NaN, unlike in a comparison.
+func valueEqual(a, b interface{}) bool {
+	switch x := a.(type) {
+	case nil:
+		return b == nil
+	case int64:
+		if y, ok := b.(int64); ok {
+			return x == y
+		}
+	case decimal:
+		if y, ok := b.(decimal); ok {
+			return compareDecimals(x, y) == 0
+		}
+	case time.Time:
+		y, ok := b.(time.Time)
+		return ok && x.Equal(y)
+	case list:
+		y, ok := b.(list)
+		if !ok || len(x) != len(y) {
+			return false
+		}
+		for i := range x {
+			if !valueEqual(x[i], y[i]) {
+				return false
+			}
+		}
+		return true
+	case structValue:
+		y, ok := b.(structValue)
+		if !ok || len(x.names) != len(y.names) {
+			return false
+		}
+		for i := range x.names {
+			if x.names[i] != y.names[i] || !valueEqual(x.values[i], y.values[i]) {
+				return false
+			}
+		}
+		return true
+	case string, bool, date, interval:
+		return a == b
+	}
+	if !isNumber(a) || !isNumber(b) {
+		return false
+	}
+	fa, fb := toFloat(a), toFloat(b)
+	return fa == fb || (math.IsNaN(fa) && math.IsNaN(fb))
+}
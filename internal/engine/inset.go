@@ -0,0 +1,133 @@
+package engine
+
+import (
+	"hash/maphash"
+
+	"github.com/apache/arrow/go/arrow/array"
+
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// inSetThreshold is the number of constants from which an IN list is hashed
+// rather than compared value by value.
+const inSetThreshold = 8
+
+// inSet is an IN list of constants, hashed once during planning so each row
+// is one probe instead of a comparison with every value. It gives the same
+// results as evalInList.
+type inSet struct {
+	expr     *queryparser.InExpr
+	in       queryparser.Expression
+	seed     maphash.Seed
+	buckets  map[uint64][]interface{} // the values by hash
+	values   []interface{}            // the non-NULL values
+	kinds    []interface{}            // a value of each kind in the set, and every list and struct
+	hasNull  bool
+	temporal bool // some value is a date or timestamp
+	not      bool
+}
+
+// planInSet returns e as an inSet when its list is long enough and every value
+// in it is a constant, evaluating the values once.
+func planInSet(e *queryparser.InExpr) (*inSet, bool, error) {
+	if len(e.Values) < inSetThreshold {
+		return nil, false, nil
+	}
+	for _, v := range e.Values {
+		if !isConstant(v) {
+			return nil, false, nil
+		}
+	}
+	s := &inSet{expr: e, in: e.Expr, seed: maphash.MakeSeed(), buckets: map[uint64][]interface{}{}, not: e.Not}
+	for _, v := range e.Values {
+		val, err := evaluateExpression(v, nil, 0)
+		if err != nil {
+			return nil, false, err
+		}
+		if val == nil {
+			s.hasNull = true
+			continue
+		}
+		h := s.hash(val)
+		s.buckets[h] = append(s.buckets[h], val)
+		s.values = append(s.values, val)
+		if !s.hasKind(val) {
+			s.kinds = append(s.kinds, val)
+		}
+		s.temporal = s.temporal || isTemporal(val)
+	}
+	return s, true, nil
+}
+
+// isConstant reports whether expr has the same value at every row, as a
+// literal, a planned scalar subquery or a negated literal does.
+func isConstant(expr queryparser.Expression) bool {
+	switch e := expr.(type) {
+	case *queryparser.Literal, *constantValue:
+		return true
+	case *queryparser.UnaryExpr:
+		return isConstant(e.Expr)
+	}
+	return false
+}
+
+func (s *inSet) hash(v interface{}) uint64 {
+	var h maphash.Hash
+	h.SetSeed(s.seed)
+	hashValue(&h, v)
+	return h.Sum64()
+}
+
+func (s *inSet) evaluate(table array.Record, row int) (interface{}, error) {
+	needle, err := evaluateExpression(s.in, table, row)
+	if err != nil {
+		return nil, err
+	}
+	if needle == nil {
+		return nil, nil
+	}
+	for _, v := range s.kinds {
+		if !comparableOperands(needle, v) {
+			return nil, arithmeticError(incomparable(needle, v), s.expr)
+		}
+	}
+	switch {
+	case s.contains(needle):
+		return !s.not, nil
+	case s.hasNull:
+		return nil, nil
+	}
+	return s.not, nil
+}
+
+// hasKind reports whether the set has a value of the kind of v, whose
+// comparisons with a needle would go the same way. Lists and structs compare
+// with it as their elements do, so each counts as a kind of its own.
+func (s *inSet) hasKind(v interface{}) bool {
+	switch v.(type) {
+	case list, structValue:
+		return false
+	}
+	for _, k := range s.kinds {
+		if valueKind(k) == valueKind(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// contains reports whether needle equals a value in the set, as = has it.
+func (s *inSet) contains(needle interface{}) bool {
+	candidates := s.buckets[s.hash(needle)]
+	// A string equals the date or timestamp it spells, which hashes apart
+	// from it, so those comparisons go through every value
+	if _, ok := needle.(string); (ok && s.temporal) || isTemporal(needle) {
+		candidates = s.values
+	}
+	for _, v := range candidates {
+		if comparableOperands(needle, v) && compareOperands(needle, v) == 0 {
+			return true
+		}
+	}
+	return false
+}
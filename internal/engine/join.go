@@ -0,0 +1,504 @@
+package engine
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/memory"
+
+	"github.com/kris-gaudel/tinylake/internal/engine/join"
+	"github.com/kris-gaudel/tinylake/internal/planner"
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// buildFromClause resolves the FROM table and every JOIN in written order,
+// returning one record the rest of the query is evaluated against.
+func buildFromClause(q *queryparser.Query, tables map[string]array.Record, ec *execContext) (array.Record, error) {
+	var left array.Record
+	var err error
+	if q.Unnest != nil {
+		left, err = (&unnestOp{clause: q.Unnest, alias: q.TableAlias, columns: q.Columns}).execute(tables, ec)
+	} else {
+		alias, subquery := pivotSource(q.TableName, q.TableAlias, q.Subquery, q.Pivot)
+		left, err = scanTable(tables, q.TableName, alias, q.Columns, subquery, ec)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, j := range q.Joins {
+		if j.Unnest != nil {
+			u := &unnestOp{clause: j.Unnest, alias: j.TableAlias, columns: j.Columns, on: j.On, outer: j.Type == "LEFT"}
+			joined, err := u.join(left, tables, ec)
+			left.Release()
+			if err != nil {
+				return nil, err
+			}
+			left = joined
+			continue
+		}
+		alias, subquery := pivotSource(j.TableName, j.TableAlias, j.Subquery, j.Pivot)
+		right, err := scanTable(tables, j.TableName, alias, j.Columns, subquery, ec)
+		if err != nil {
+			left.Release()
+			return nil, err
+		}
+
+		joined, err := executeJoin(j, left, right, ec)
+		left.Release()
+		right.Release()
+		if err != nil {
+			return nil, err
+		}
+		left = joined
+	}
+
+	return left, nil
+}
+
+// pivotSource returns the alias and derived table of a table in FROM or JOIN
+// that PIVOT or UNPIVOT reshapes, which runs as a query of its own, as the
+// planner runs it. Other tables are returned as they are.
+func pivotSource(name, alias string, subquery *queryparser.Query, pivot *queryparser.PivotClause) (string, *queryparser.Query) {
+	if pivot == nil {
+		return alias, subquery
+	}
+	if alias == "" {
+		alias = name
+	}
+	star := []queryparser.Expression{&queryparser.StarExpr{}}
+	return alias, &queryparser.Query{Projections: star, TableName: name, Subquery: subquery, Pivot: pivot}
+}
+
+// scanTable looks up a table by name, or runs a derived table's subquery, and
+// tags the columns with the alias, or the table name when there is no alias.
+// The leading columns are renamed to the column aliases, if any.
+func scanTable(tables map[string]array.Record, name, alias string, columns []string, subquery *queryparser.Query, ec *execContext) (array.Record, error) {
+	rec, err := resolveTable(tables, name, alias, subquery, ec)
+	if err != nil {
+		return nil, err
+	}
+	if alias == "" {
+		alias = name
+	}
+	return aliasColumns(rec, alias, columns)
+}
+
+// aliasColumns renames the leading columns of rec, the table called alias, to
+// the given column aliases. It takes ownership of rec.
+func aliasColumns(rec array.Record, alias string, columns []string) (array.Record, error) {
+	if n := rec.NumCols(); len(columns) > int(n) {
+		rec.Release()
+		return nil, fmt.Errorf("table %s has %d columns but %d column aliases were given", alias, n, len(columns))
+	}
+	return renameColumns(rec, columns), nil
+}
+
+func resolveTable(tables map[string]array.Record, name, alias string, subquery *queryparser.Query, ec *execContext) (array.Record, error) {
+	if subquery != nil {
+		rec, err := planAndRun(subquery, tables, ec)
+		if err != nil {
+			return nil, err
+		}
+		defer rec.Release()
+		return qualifyRecord(rec, alias), nil
+	}
+
+	rec, ok := findTable(tables, name)
+	if alias == "" {
+		alias = name
+	}
+	if !ok {
+		view, isView, err := expandView(name, ec)
+		if !isView {
+			return nil, fmt.Errorf("table %s not found", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		defer view.Release()
+		rec = view
+	}
+	return qualifyRecord(rec, alias), nil
+}
+
+// findTable looks up a table by name, matching case-insensitively when there
+// is no exact match.
+func findTable(tables map[string]array.Record, name string) (array.Record, bool) {
+	if rec, ok := tables[name]; ok {
+		return rec, true
+	}
+	for tableName, rec := range tables {
+		if strings.EqualFold(tableName, name) {
+			return rec, true
+		}
+	}
+	return nil, false
+}
+
+// executeJoin joins left and right on j.On. Equality conjuncts that compare a
+// left-side expression to a right-side expression become hash join keys; any
+// other conjuncts are applied as a filter on the joined rows.
+func executeJoin(j queryparser.JoinClause, left, right array.Record, ec *execContext) (array.Record, error) {
+	leftRows, rightRows, err := joinRows(j, left, right, ec)
+	if err != nil {
+		return nil, err
+	}
+	padLeft, padRight := joinPadding(j.Type)
+	return combineRows(left, right, leftRows, rightRows, padLeft, padRight, ec.pool)
+}
+
+// joinRows returns the pairs of rows of left and right that the join outputs,
+// in order, with -1 standing for the NULLs an outer join pads a side with.
+func joinRows(j queryparser.JoinClause, left, right array.Record, ec *execContext) (leftRows, rightRows []int, err error) {
+	if j.Type == "CROSS" {
+		return crossPairs(left.NumRows(), right.NumRows(), ec.options.crossJoinLimit())
+	}
+
+	leftRows, rightRows, err = joinPairs(j.On, left, right, ec)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	padLeft, padRight := joinPadding(j.Type)
+	if padRight {
+		leftRows, rightRows = appendUnmatched(leftRows, rightRows, int(left.NumRows()))
+	}
+	if padLeft {
+		rightRows, leftRows = appendUnmatched(rightRows, leftRows, int(right.NumRows()))
+	}
+	return leftRows, rightRows, nil
+}
+
+// joinPadding reports which sides a join of the given type pads with NULLs
+// for the unmatched rows of the other.
+func joinPadding(joinType string) (padLeft, padRight bool) {
+	return joinType == "RIGHT" || joinType == "FULL", joinType == "LEFT" || joinType == "FULL"
+}
+
+// joinPairs returns the pairs of left and right rows that satisfy on. The
+// equalities between the two sides are hashed and the rest of on is checked
+// for each candidate pair. Without such equalities, as in a range join, or when
+// the session asks for it, every pair of rows is checked with a block
+// nested-loop join.
+func joinPairs(on queryparser.Expression, left, right array.Record, ec *execContext) (leftRows, rightRows []int, err error) {
+	var leftKeys, rightKeys, residual []queryparser.Expression
+	for _, cond := range planner.SplitConjuncts(on) {
+		l, r, isKey, err := equiJoinKeys(cond, left, right)
+		if err != nil {
+			return nil, nil, err
+		}
+		if isKey {
+			leftKeys = append(leftKeys, l)
+			rightKeys = append(rightKeys, r)
+		} else {
+			residual = append(residual, cond)
+		}
+	}
+	if len(leftKeys) == 0 || ec.options.JoinStrategy == joinNestedLoop {
+		residual = planner.SplitConjuncts(on)
+		return join.NestedLoop(int(left.NumRows()), int(right.NumRows()), func(leftRows, rightRows []int) ([]int, []int, error) {
+			return filterJoinPairs(left, right, leftRows, rightRows, residual, ec.pool)
+		})
+	}
+
+	leftRows, rightRows, err = equiJoin(left, right, leftKeys, rightKeys, ec)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if len(residual) > 0 {
+		// Residual conditions are part of the match, so they are checked before
+		// outer join padding decides which rows went unmatched.
+		leftRows, rightRows, err = filterJoinPairs(left, right, leftRows, rightRows, residual, ec.pool)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return leftRows, rightRows, nil
+}
+
+// crossPairs pairs every one of n left rows with every one of m right rows,
+// producing the Cartesian product, unless it has more than limit rows. A limit
+// of 0 is no limit.
+func crossPairs(n, m, limit int64) ([]int, []int, error) {
+	total := n * m
+	if limit > 0 && total > limit {
+		return nil, nil, fmt.Errorf("CROSS JOIN would produce %d rows, exceeding the limit of %d", total, limit)
+	}
+
+	leftRows := make([]int, 0, total)
+	rightRows := make([]int, 0, total)
+	for l := 0; l < int(n); l++ {
+		for r := 0; r < int(m); r++ {
+			leftRows = append(leftRows, l)
+			rightRows = append(rightRows, r)
+		}
+	}
+	return leftRows, rightRows, nil
+}
+
+// filterJoinPairs keeps the candidate pairs that satisfy every residual condition.
+func filterJoinPairs(left, right array.Record, leftRows, rightRows []int, residual []queryparser.Expression, pool memory.Allocator) ([]int, []int, error) {
+	candidates, err := combineRows(left, right, leftRows, rightRows, false, false, pool)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer candidates.Release()
+
+	keptLeft := make([]int, 0, len(leftRows))
+	keptRight := make([]int, 0, len(rightRows))
+	for row := 0; row < int(candidates.NumRows()); row++ {
+		pass := true
+		for _, cond := range residual {
+			val, err := evaluateExpression(cond, candidates, row)
+			if err != nil {
+				return nil, nil, err
+			}
+			if !toBool(val) {
+				pass = false
+				break
+			}
+		}
+		if pass {
+			keptLeft = append(keptLeft, leftRows[row])
+			keptRight = append(keptRight, rightRows[row])
+		}
+	}
+	return keptLeft, keptRight, nil
+}
+
+// appendUnmatched adds a pair for every row of the preserved side that has no
+// match, pairing it with -1 so the other side is padded with NULLs.
+func appendUnmatched(preserved, other []int, numRows int) ([]int, []int) {
+	matched := make([]bool, numRows)
+	for _, row := range preserved {
+		if row >= 0 {
+			matched[row] = true
+		}
+	}
+	for row := 0; row < numRows; row++ {
+		if !matched[row] {
+			preserved = append(preserved, row)
+			other = append(other, -1)
+		}
+	}
+	return preserved, other
+}
+
+// The strategies for joining on equalities, as named by the join_strategy option
+const (
+	joinHash       = "hash"
+	joinMerge      = "merge"
+	joinNestedLoop = "nested_loop"
+)
+
+// equiJoin evaluates the join keys of both inputs and returns the pairs of
+// rows whose keys are equal. NULL keys never match.
+func equiJoin(left, right array.Record, leftKeys, rightKeys []queryparser.Expression, ec *execContext) ([]int, []int, error) {
+	lk, err := joinKeys(leftKeys, left, ec)
+	if err != nil {
+		return nil, nil, err
+	}
+	rk, err := joinKeys(rightKeys, right, ec)
+	if err != nil {
+		return nil, nil, err
+	}
+	if chooseJoinStrategy(lk, rk, ec.options) == joinMerge {
+		leftRows, rightRows := join.Merge(lk, rk)
+		return leftRows, rightRows, nil
+	}
+	leftRows, rightRows := join.Hash(lk, rk)
+	return leftRows, rightRows, nil
+}
+
+// chooseJoinStrategy picks how to join inputs with the given keys, unless the
+// session forces a strategy. A hash join builds its table over the smaller
+// input, in effect broadcasting it to every row of the larger one; it is used
+// unless both inputs are already sorted on their keys, or the table would take
+// more than half the statement's memory limit, where a sort-merge join is
+// cheaper.
+func chooseJoinStrategy(lk, rk []join.Key, options Options) string {
+	if options.JoinStrategy != "" {
+		return options.JoinStrategy
+	}
+	if join.IsSorted(lk) && join.IsSorted(rk) {
+		return joinMerge
+	}
+	build := lk
+	if len(rk) < len(lk) {
+		build = rk
+	}
+	if options.MemoryLimit > 0 && join.HashTableSize(build) > options.MemoryLimit/2 {
+		return joinMerge
+	}
+	return joinHash
+}
+
+// joinKeys encodes the key values of every row of table, from the
+// dictionaries of the key columns when they all have one.
+func joinKeys(keys []queryparser.Expression, table array.Record, ec *execContext) ([]join.Key, error) {
+	if dicts := keyDictionaries(keys, table, ec); dicts != nil {
+		return dictionaryJoinKeys(dicts, int(table.NumRows())), nil
+	}
+	out := make([]join.Key, table.NumRows())
+	vals := make([]interface{}, len(keys))
+	compiled := compileExpressions(keys, table)
+	for row := range out {
+		for i, k := range compiled {
+			val, err := k.eval(row)
+			if err != nil {
+				return nil, err
+			}
+			vals[i] = val
+		}
+		key, ok := encodeKey(vals)
+		out[row] = join.Key{Value: key, Null: !ok}
+	}
+	return out, nil
+}
+
+// encodeKey encodes values into a hashable key. It reports false when any
+// value is NULL, since NULL keys never compare equal.
+func encodeKey(vals []interface{}) (string, bool) {
+	var sb strings.Builder
+	for _, val := range vals {
+		switch v := val.(type) {
+		case nil:
+			return "", false
+		case string:
+			sb.WriteString(strconv.Quote(v))
+		case float64:
+			sb.WriteString(strconv.FormatFloat(v, 'g', -1, 64))
+		case int64:
+			// Encoded like the equal float so 1 and 1.0 share a key
+			sb.WriteString(strconv.FormatFloat(float64(v), 'g', -1, 64))
+		case decimal:
+			sb.WriteString(strconv.FormatFloat(v.float(), 'g', -1, 64))
+		default:
+			sb.WriteString(fmt.Sprintf("%v", v))
+		}
+		sb.WriteByte(0)
+	}
+	return sb.String(), true
+}
+
+// equiJoinKeys reports whether cond is an equality with one side over the left
+// input and the other over the right input, returning the sides in that order.
+func equiJoinKeys(cond queryparser.Expression, left, right array.Record) (queryparser.Expression, queryparser.Expression, bool, error) {
+	bin, ok := cond.(*queryparser.BinaryExpr)
+	if !ok || bin.Op != "=" {
+		return nil, nil, false, nil
+	}
+
+	lside, err := exprSide(bin.Left, left, right)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	rside, err := exprSide(bin.Right, left, right)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	switch {
+	case lside == sideLeft && rside == sideRight:
+		return bin.Left, bin.Right, true, nil
+	case lside == sideRight && rside == sideLeft:
+		return bin.Right, bin.Left, true, nil
+	default:
+		return nil, nil, false, nil
+	}
+}
+
+const (
+	sideNone = iota
+	sideLeft
+	sideRight
+	sideBoth
+)
+
+// exprSide reports which join input the columns referenced by expr come from.
+func exprSide(expr queryparser.Expression, left, right array.Record) (int, error) {
+	switch e := expr.(type) {
+	case *queryparser.ColumnRef:
+		_, lerr := resolveColumn(left, e)
+		_, rerr := resolveColumn(right, e)
+		switch {
+		case lerr == nil && rerr == nil:
+			return sideNone, fmt.Errorf("column reference %s is ambiguous", e.Name)
+		case lerr == nil:
+			return sideLeft, nil
+		case rerr == nil:
+			return sideRight, nil
+		case structFieldRef(left.Schema(), e) != nil:
+			return sideLeft, nil
+		case structFieldRef(right.Schema(), e) != nil:
+			return sideRight, nil
+		default:
+			return sideNone, lerr
+		}
+	default:
+		side := sideNone
+		for _, child := range queryparser.Children(expr) {
+			s, err := exprSide(child, left, right)
+			if err != nil {
+				return sideNone, err
+			}
+			side = mergeSides(side, s)
+		}
+		return side, nil
+	}
+}
+
+func mergeSides(a, b int) int {
+	switch {
+	case a == sideNone:
+		return b
+	case b == sideNone || a == b:
+		return a
+	default:
+		return sideBoth
+	}
+}
+
+// combineRows builds a record with every left column followed by every right
+// column, taking leftRows[i] and rightRows[i] as output row i. A row index of -1
+// produces NULLs; the padded side's fields are marked nullable.
+func combineRows(left, right array.Record, leftRows, rightRows []int, padLeft, padRight bool, pool memory.Allocator) (array.Record, error) {
+	fields := make([]arrow.Field, 0, left.NumCols()+right.NumCols())
+	for _, f := range left.Schema().Fields() {
+		f.Nullable = f.Nullable || padLeft
+		fields = append(fields, f)
+	}
+	for _, f := range right.Schema().Fields() {
+		f.Nullable = f.Nullable || padRight
+		fields = append(fields, f)
+	}
+
+	cols := make([]array.Interface, 0, len(fields))
+	defer func() {
+		for _, c := range cols {
+			c.Release()
+		}
+	}()
+
+	for i := 0; i < int(left.NumCols()); i++ {
+		arr, err := takeRows(pool, left.Column(i), leftRows)
+		if err != nil {
+			return nil, err
+		}
+		cols = append(cols, arr)
+	}
+	for i := 0; i < int(right.NumCols()); i++ {
+		arr, err := takeRows(pool, right.Column(i), rightRows)
+		if err != nil {
+			return nil, err
+		}
+		cols = append(cols, arr)
+	}
+
+	return array.NewRecord(arrow.NewSchema(fields, nil), cols, int64(len(leftRows))), nil
+}
@@ -0,0 +1,51 @@
+package join
+
+import "hash/maphash"
+
+// The bits a Bloom filter gives each key and the bits each key sets, which
+// make about 1% of the keys it was not given seem present.
+const (
+	bloomBitsPerKey = 10
+	bloomHashes     = 7
+)
+
+// Bloom is a Bloom filter of the keys of one join input, with which the other
+// input can drop rows whose keys match none of them before it is joined. It
+// may take a key it was not given for one it was, but never the reverse.
+type Bloom struct {
+	seed maphash.Seed
+	bits []uint64
+}
+
+// NewBloom returns a Bloom filter of the keys that are not NULL.
+func NewBloom(keys []Key) *Bloom {
+	b := &Bloom{seed: maphash.MakeSeed(), bits: make([]uint64, (len(keys)*bloomBitsPerKey+63)/64+1)}
+	for _, k := range keys {
+		if !k.Null {
+			b.each(k.Value, func(bit uint64) { b.bits[bit/64] |= 1 << (bit % 64) })
+		}
+	}
+	return b
+}
+
+// MayContain reports whether k may be one of the filter's keys. A NULL key is
+// not, as it matches no other key.
+func (b *Bloom) MayContain(k Key) bool {
+	if k.Null {
+		return false
+	}
+	found := true
+	b.each(k.Value, func(bit uint64) { found = found && b.bits[bit/64]&(1<<(bit%64)) != 0 })
+	return found
+}
+
+// each calls set with the bits of value, derived from two halves of its hash
+// by double hashing.
+func (b *Bloom) each(value string, set func(bit uint64)) {
+	h := maphash.String(b.seed, value)
+	h1, h2 := h&0xffffffff, h>>32|1
+	n := uint64(len(b.bits)) * 64
+	for i := uint64(0); i < bloomHashes; i++ {
+		set((h1 + i*h2) % n)
+	}
+}
@@ -0,0 +1,36 @@
+package join
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBloom(t *testing.T) {
+	var build []Key
+	for i := 0; i < 1000; i++ {
+		build = append(build, Key{Value: fmt.Sprint(i)})
+	}
+	build = append(build, Key{Null: true})
+	b := NewBloom(build)
+
+	for _, k := range build[:1000] {
+		if !b.MayContain(k) {
+			t.Fatalf("expected %q to be found", k.Value)
+		}
+	}
+	if b.MayContain(Key{Null: true}) {
+		t.Errorf("expected a NULL key to be left out")
+	}
+	positives := 0
+	for i := 1000; i < 11000; i++ {
+		if b.MayContain(Key{Value: fmt.Sprint(i)}) {
+			positives++
+		}
+	}
+	if positives > 300 {
+		t.Errorf("expected about 1%% of absent keys to be found, got %d of 10000", positives)
+	}
+	if NewBloom(nil).MayContain(Key{Value: "a"}) {
+		t.Errorf("expected an empty filter to contain nothing")
+	}
+}
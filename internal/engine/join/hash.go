@@ -0,0 +1,71 @@
+package join
+
+// Hash returns the pairs of left and right rows with equal keys. The hash
+// table is built over the smaller input and probed with the larger one.
+// Either way the pairs come out ordered by left row, and then by right row.
+func Hash(left, right []Key) (leftRows, rightRows []int) {
+	if len(right) <= len(left) {
+		return probe(left, right)
+	}
+	rightRows, leftRows = probe(right, left)
+	return orderByFirst(leftRows, rightRows, len(left))
+}
+
+// hashEntryOverhead approximates the bytes a hash table entry takes beyond
+// its key: the map slot, string header and row slice.
+const hashEntryOverhead = 64
+
+// HashTableSize estimates the bytes Hash holds in its hash table when it is
+// built over keys.
+func HashTableSize(keys []Key) int64 {
+	var size int64
+	for _, k := range keys {
+		if !k.Null {
+			size += int64(len(k.Value)) + hashEntryOverhead
+		}
+	}
+	return size
+}
+
+// probe builds a hash table over build and looks up each row of probeKeys in
+// it, in order. The pairs are ordered by probe row, and then by build row.
+func probe(probeKeys, build []Key) (probeRows, buildRows []int) {
+	table := make(map[string][]int, len(build))
+	for row, k := range build {
+		if !k.Null {
+			table[k.Value] = append(table[k.Value], row)
+		}
+	}
+
+	for row, k := range probeKeys {
+		if k.Null {
+			continue
+		}
+		for _, match := range table[k.Value] {
+			probeRows = append(probeRows, row)
+			buildRows = append(buildRows, match)
+		}
+	}
+	return probeRows, buildRows
+}
+
+// orderByFirst stably reorders the pairs by their first row, which is below
+// n, with a counting sort.
+func orderByFirst(first, second []int, n int) ([]int, []int) {
+	starts := make([]int, n+1)
+	for _, row := range first {
+		starts[row+1]++
+	}
+	for i := 1; i <= n; i++ {
+		starts[i] += starts[i-1]
+	}
+
+	outFirst := make([]int, len(first))
+	outSecond := make([]int, len(second))
+	for i, row := range first {
+		pos := starts[row]
+		starts[row]++
+		outFirst[pos], outSecond[pos] = row, second[i]
+	}
+	return outFirst, outSecond
+}
@@ -0,0 +1,40 @@
+package join
+
+import (
+	"fmt"
+	"testing"
+)
+
+func keys(vals ...string) []Key {
+	out := make([]Key, len(vals))
+	for i, v := range vals {
+		if v == "NULL" {
+			out[i] = Key{Null: true}
+		} else {
+			out[i] = Key{Value: v}
+		}
+	}
+	return out
+}
+
+func TestHash(t *testing.T) {
+	tests := []struct {
+		left, right []Key
+		want        string
+	}{
+		// Building on the right input, which is smaller
+		{keys("a", "b", "a", "c", "NULL"), keys("a", "a", "NULL"), "[0 0 2 2] [0 1 0 1]"},
+		// Building on the left input, which is smaller, gives the same order
+		{keys("a", "a", "NULL"), keys("a", "b", "a", "c", "NULL"), "[0 0 1 1] [0 2 0 2]"},
+		{keys("x", "y"), keys("z"), "[] []"},
+		{nil, keys("a"), "[] []"},
+		// Multi-column keys are compared as a whole
+		{keys("1\x002\x00", "1\x003\x00"), keys("1\x003\x00", "2\x002\x00", "1\x002\x00"), "[0 1] [2 0]"},
+	}
+	for _, tt := range tests {
+		leftRows, rightRows := Hash(tt.left, tt.right)
+		if got := fmt.Sprint(leftRows, rightRows); got != tt.want {
+			t.Errorf("Hash(%v, %v) = %s, want %s", tt.left, tt.right, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+// Package join implements the algorithms behind the engine's join operators.
+// They work on join keys the caller has already evaluated for every row and
+// return the matching pairs as parallel slices of left and right row indices.
+package join
+
+// Key is the encoded join key of one row. Keys are equal when their Values
+// are. A key with a NULL component has Null set and matches no other key, not
+// even another NULL one.
+type Key struct {
+	Value string
+	Null  bool
+}
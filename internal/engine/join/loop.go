@@ -0,0 +1,33 @@
+package join
+
+// BlockSize is the number of rows per input that NestedLoop pairs up at once.
+const BlockSize = 256
+
+// NestedLoop pairs every left row with every right row, a block of rows from
+// each side at a time, and keeps the pairs match returns. match receives the
+// candidate pairs of one block as parallel slices and returns those that
+// satisfy the join condition. The pairs come out ordered by left row, and
+// then by right row, as long as match keeps them in the order given.
+func NestedLoop(numLeft, numRight int, match func(leftRows, rightRows []int) ([]int, []int, error)) (leftRows, rightRows []int, err error) {
+	candLeft := make([]int, 0, BlockSize*BlockSize)
+	candRight := make([]int, 0, BlockSize*BlockSize)
+	for lo := 0; lo < numLeft; lo += BlockSize {
+		for ro := 0; ro < numRight; ro += BlockSize {
+			candLeft, candRight = candLeft[:0], candRight[:0]
+			for l := lo; l < min(lo+BlockSize, numLeft); l++ {
+				for r := ro; r < min(ro+BlockSize, numRight); r++ {
+					candLeft = append(candLeft, l)
+					candRight = append(candRight, r)
+				}
+			}
+			keptLeft, keptRight, err := match(candLeft, candRight)
+			if err != nil {
+				return nil, nil, err
+			}
+			leftRows = append(leftRows, keptLeft...)
+			rightRows = append(rightRows, keptRight...)
+		}
+	}
+	leftRows, rightRows = orderByFirst(leftRows, rightRows, numLeft)
+	return leftRows, rightRows, nil
+}
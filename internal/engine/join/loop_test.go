@@ -0,0 +1,40 @@
+package join
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestNestedLoop(t *testing.T) {
+	// A range join: left row l matches right rows r with l <= r < l+3, over
+	// inputs large enough to span several blocks
+	numLeft, numRight := BlockSize+10, 2*BlockSize+5
+	leftRows, rightRows, err := NestedLoop(numLeft, numRight, func(ls, rs []int) ([]int, []int, error) {
+		var keptLeft, keptRight []int
+		for i := range ls {
+			if rs[i] >= ls[i] && rs[i] < ls[i]+3 {
+				keptLeft = append(keptLeft, ls[i])
+				keptRight = append(keptRight, rs[i])
+			}
+		}
+		return keptLeft, keptRight, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leftRows) != 3*numLeft {
+		t.Fatalf("expected %d pairs, got %d", 3*numLeft, len(leftRows))
+	}
+	for i := range leftRows {
+		if want := [2]int{i / 3, i/3 + i%3}; [2]int{leftRows[i], rightRows[i]} != want {
+			t.Fatalf("pair %d = (%d, %d), want %v", i, leftRows[i], rightRows[i], want)
+		}
+	}
+
+	_, _, err = NestedLoop(1, 1, func(ls, rs []int) ([]int, []int, error) {
+		return nil, nil, fmt.Errorf("bad condition")
+	})
+	if err == nil {
+		t.Errorf("expected the match error to be returned")
+	}
+}
@@ -0,0 +1,74 @@
+package join
+
+import "sort"
+
+// Merge returns the same pairs as Hash by sorting both inputs on their keys
+// and merging the sorted runs. Inputs that are already sorted skip the sort.
+// The merge reads each run once, front to back, and holds only the current
+// group of equal keys from each side, so it needs no hash table.
+func Merge(left, right []Key) (leftRows, rightRows []int) {
+	mergeSorted(left, right, sortedRows(left), sortedRows(right), func(l, r int) {
+		leftRows = append(leftRows, l)
+		rightRows = append(rightRows, r)
+	})
+	return orderByFirst(leftRows, rightRows, len(left))
+}
+
+// IsSorted reports whether keys are in the order Merge sorts them in, with
+// any NULL keys anywhere.
+func IsSorted(keys []Key) bool {
+	prev := -1
+	for row, k := range keys {
+		if k.Null {
+			continue
+		}
+		if prev >= 0 && keys[prev].Value > k.Value {
+			return false
+		}
+		prev = row
+	}
+	return true
+}
+
+// sortedRows returns the rows of keys with a non-NULL key, ordered by key.
+func sortedRows(keys []Key) []int {
+	rows := make([]int, 0, len(keys))
+	for row, k := range keys {
+		if !k.Null {
+			rows = append(rows, row)
+		}
+	}
+	if !IsSorted(keys) {
+		sort.SliceStable(rows, func(a, b int) bool { return keys[rows[a]].Value < keys[rows[b]].Value })
+	}
+	return rows
+}
+
+// mergeSorted walks the sorted runs of both inputs in step and calls emit for
+// every pair of rows with equal keys.
+func mergeSorted(left, right []Key, lrows, rrows []int, emit func(l, r int)) {
+	for i, j := 0, 0; i < len(lrows) && j < len(rrows); {
+		lk, rk := left[lrows[i]].Value, right[rrows[j]].Value
+		switch {
+		case lk < rk:
+			i++
+		case lk > rk:
+			j++
+		default:
+			// Pair the group of equal keys on each side
+			iEnd, jEnd := i, j
+			for iEnd < len(lrows) && left[lrows[iEnd]].Value == lk {
+				iEnd++
+			}
+			for jEnd < len(rrows) && right[rrows[jEnd]].Value == rk {
+				jEnd++
+			}
+			for _, l := range lrows[i:iEnd] {
+				for _, r := range rrows[j:jEnd] {
+					emit(l, r)
+				}
+			}
+			i, j = iEnd, jEnd
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package join
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	randomKeys := func(n int) []Key {
+		out := make([]Key, n)
+		for i := range out {
+			if rng.Intn(10) == 0 {
+				out[i] = Key{Null: true}
+			} else {
+				out[i] = Key{Value: fmt.Sprint(rng.Intn(20))}
+			}
+		}
+		return out
+	}
+
+	for i := 0; i < 50; i++ {
+		left, right := randomKeys(rng.Intn(40)), randomKeys(rng.Intn(40))
+		hl, hr := Hash(left, right)
+		ml, mr := Merge(left, right)
+		if fmt.Sprint(hl, hr) != fmt.Sprint(ml, mr) {
+			t.Fatalf("Merge(%v, %v) = %v %v, want %v %v", left, right, ml, mr, hl, hr)
+		}
+	}
+
+	if !IsSorted(keys("a", "NULL", "a", "b")) || IsSorted(keys("b", "NULL", "a")) {
+		t.Errorf("IsSorted misjudged the order of keys")
+	}
+}
@@ -0,0 +1,165 @@
+package engine
+
+import (
+	"github.com/apache/arrow/go/arrow/array"
+
+	"github.com/kris-gaudel/tinylake/internal/engine/join"
+	"github.com/kris-gaudel/tinylake/internal/planner"
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// joinFilter is a Bloom filter of the values one input of a join has in a key
+// column, given to a scan beneath the other input so that the scan drops the
+// rows whose key cannot match before anything else reads them.
+type joinFilter struct {
+	column *queryparser.ColumnRef // the key column of the scanned side
+	bloom  *join.Bloom
+}
+
+// pushJoinFilters builds a filter for each equality in on between a column of
+// build and a column of the other input, probe, and gives it to the scans in
+// probe that can apply it. Those are the scans reached through filters and
+// joins alone, which never change the values of the rows they keep, so a
+// row dropped by the scan is one the join would have dropped. The filters
+// apply until the function returned is called.
+func pushJoinFilters(on queryparser.Expression, build array.Record, probe operator, ec *execContext) (func(), error) {
+	scans := filterableScans(probe)
+	if len(scans) == 0 || ec.options.JoinStrategy == joinNestedLoop {
+		return func() {}, nil
+	}
+
+	var filters []joinFilter
+	for _, cond := range planner.SplitConjuncts(on) {
+		buildCol, probeCol, ok := buildKeyColumn(cond, build)
+		if !ok {
+			continue
+		}
+		keys, err := joinKeys([]queryparser.Expression{buildCol}, build, ec)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, joinFilter{column: probeCol, bloom: join.NewBloom(keys)})
+	}
+	if len(filters) == 0 {
+		return func() {}, nil
+	}
+
+	if ec.joinFilters == nil {
+		ec.joinFilters = map[*scanOp][]joinFilter{}
+	}
+	prev := make([][]joinFilter, len(scans))
+	for i, scan := range scans {
+		prev[i] = ec.joinFilters[scan]
+		ec.joinFilters[scan] = append(prev[i][:len(prev[i]):len(prev[i])], filters...)
+	}
+	return func() {
+		for i, scan := range scans {
+			ec.joinFilters[scan] = prev[i]
+		}
+	}, nil
+}
+
+// buildKeyColumn reports whether cond equates a column of build with a
+// column that is not one of build's, returning them in that order.
+func buildKeyColumn(cond queryparser.Expression, build array.Record) (*queryparser.ColumnRef, *queryparser.ColumnRef, bool) {
+	eq, ok := cond.(*queryparser.BinaryExpr)
+	if !ok || eq.Op != "=" {
+		return nil, nil, false
+	}
+	left, lok := eq.Left.(*queryparser.ColumnRef)
+	right, rok := eq.Right.(*queryparser.ColumnRef)
+	if !lok || !rok {
+		return nil, nil, false
+	}
+	l, lerr := findField(build.Schema(), left)
+	r, rerr := findField(build.Schema(), right)
+	switch {
+	case lerr != nil || rerr != nil:
+		return nil, nil, false
+	case l >= 0 && r == -1:
+		return left, right, true
+	case r >= 0 && l == -1:
+		return right, left, true
+	}
+	return nil, nil, false
+}
+
+// filterableScans returns the scans beneath op that a join above it may give
+// filters to.
+func filterableScans(op operator) []*scanOp {
+	switch o := op.(type) {
+	case *accountedOp:
+		return filterableScans(o.operator)
+	case *filterOp:
+		return filterableScans(o.input)
+	case *joinOp:
+		return append(filterableScans(o.left), filterableScans(o.right)...)
+	case *scanOp:
+		return []*scanOp{o}
+	}
+	return nil
+}
+
+// joinFilterRows selects the rows of rec, which the scan read, whose keys may
+// match in the joins that gave it filters, returning nil when that is every
+// row. A filter whose column rec does not have is for another scan and is
+// skipped. A column with a dictionary is checked once a distinct value.
+func joinFilterRows(rec array.Record, filters []joinFilter, ec *execContext) ([]int, error) {
+	var cols []int
+	var blooms []*join.Bloom
+	var dicts []*stringDictionary
+	var mayMatch [][]bool // by filter with a dictionary, whether each code may match
+	for _, f := range filters {
+		col, err := findField(rec.Schema(), f.column)
+		if err != nil || col < 0 {
+			continue
+		}
+		cols = append(cols, col)
+		blooms = append(blooms, f.bloom)
+		var byCode []bool
+		dict := keyDictionaries([]queryparser.Expression{f.column}, rec, ec)
+		if dict != nil {
+			byCode = make([]bool, len(dict[0].values))
+			for code, val := range dict[0].values {
+				key, _ := encodeKey([]interface{}{val})
+				byCode[code] = f.bloom.MayContain(join.Key{Value: key})
+			}
+			dicts = append(dicts, dict[0])
+		} else {
+			dicts = append(dicts, nil)
+		}
+		mayMatch = append(mayMatch, byCode)
+	}
+	if len(cols) == 0 {
+		return nil, nil
+	}
+
+	rows := make([]int, 0, rec.NumRows())
+	for row := 0; row < int(rec.NumRows()); row++ {
+		keep := true
+		for i, col := range cols {
+			if d := dicts[i]; d != nil {
+				code := d.codes[row]
+				if keep = code >= 0 && mayMatch[i][code]; !keep {
+					break
+				}
+				continue
+			}
+			val, err := columnValue(rec.Column(col), row)
+			if err != nil {
+				return nil, err
+			}
+			key, ok := encodeKey([]interface{}{val})
+			if keep = blooms[i].MayContain(join.Key{Value: key, Null: !ok}); !keep {
+				break
+			}
+		}
+		if keep {
+			rows = append(rows, row)
+		}
+	}
+	if len(rows) == int(rec.NumRows()) {
+		return nil, nil
+	}
+	return rows, nil
+}
@@ -0,0 +1,155 @@
+package engine
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/apache/arrow/go/arrow/array"
+
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// likeMatcher is a LIKE whose pattern is a constant, compiled once during
+// planning rather than for every row.
+type likeMatcher struct {
+	expr queryparser.Expression
+	re   *regexp.Regexp
+	not  bool
+}
+
+func (m *likeMatcher) evaluate(table array.Record, row int) (interface{}, error) {
+	val, err := evaluateExpression(m.expr, table, row)
+	if err != nil || val == nil {
+		return nil, err
+	}
+	s, ok := val.(string)
+	if !ok {
+		return nil, fmt.Errorf("LIKE expects a string, got %T", val)
+	}
+	return m.re.MatchString(s) != m.not, nil
+}
+
+// planLike plans x [NOT] LIKE pattern, whose operands are already planned.
+// A pattern that is only a prefix followed by %, as in '2021-%', becomes a
+// pair of range comparisons, which filters evaluate a column at a time like
+// any other; a pattern without wildcards becomes an equality. Other constant
+// patterns are compiled once.
+func planLike(expr, pattern queryparser.Expression, not bool) (queryparser.Expression, error) {
+	lit, ok := pattern.(*queryparser.Literal)
+	if !ok || lit.Kind != queryparser.LiteralString {
+		return &queryparser.LikeExpr{Expr: expr, Pattern: pattern, Not: not}, nil
+	}
+	var cond queryparser.Expression
+	switch prefix, wildcard, ok := likePrefix(lit.Value); {
+	case ok && !wildcard:
+		cond = &queryparser.BinaryExpr{Left: expr, Op: "=", Right: stringLiteral(prefix)}
+	case ok:
+		cond = &queryparser.BinaryExpr{Left: expr, Op: ">=", Right: stringLiteral(prefix)}
+		if upper, ok := prefixUpperBound(prefix); ok {
+			cond = &queryparser.BinaryExpr{
+				Left:  cond,
+				Op:    "AND",
+				Right: &queryparser.BinaryExpr{Left: expr, Op: "<", Right: stringLiteral(upper)},
+			}
+		}
+	default:
+		re, err := compileLike(lit.Value)
+		if err != nil {
+			return nil, err
+		}
+		return &likeMatcher{expr: expr, re: re, not: not}, nil
+	}
+	if not {
+		return &queryparser.UnaryExpr{Op: "NOT", Expr: cond}, nil
+	}
+	return cond, nil
+}
+
+func stringLiteral(s string) *queryparser.Literal {
+	return &queryparser.Literal{Value: s, Kind: queryparser.LiteralString}
+}
+
+// likePrefix reads a pattern that is some text, optionally followed by a
+// single %, returning the text with its escapes removed. It reports false for
+// a pattern with any other wildcard.
+func likePrefix(pattern string) (prefix string, wildcard, ok bool) {
+	var sb strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '\\':
+			if i++; i == len(pattern) {
+				return "", false, false
+			}
+			sb.WriteByte(pattern[i])
+		case '%':
+			return sb.String(), true, i == len(pattern)-1
+		case '_':
+			return "", false, false
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String(), false, true
+}
+
+// prefixUpperBound returns the least string greater than every string that
+// starts with prefix, or false when there is none, as when prefix is empty.
+func prefixUpperBound(prefix string) (string, bool) {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1]), true
+		}
+	}
+	return "", false
+}
+
+// compileLike compiles a LIKE pattern into the regular expression matching
+// the same strings.
+func compileLike(pattern string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString("^(?s)")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '\\':
+			if i++; i == len(pattern) {
+				return nil, fmt.Errorf("LIKE pattern %q must not end with an escape character", pattern)
+			}
+			sb.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		case '%':
+			sb.WriteString(".*")
+		case '_':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+		}
+	}
+	sb.WriteString("$")
+	return compilePattern(sb.String(), false)
+}
+
+// evalLike evaluates x [NOT] LIKE pattern at row, for a pattern that was not
+// compiled during planning. Compiled patterns are cached, so a pattern that
+// is the same for many rows is compiled only once.
+func evalLike(e *queryparser.LikeExpr, table array.Record, row int) (interface{}, error) {
+	val, err := evaluateExpression(e.Expr, table, row)
+	if err != nil {
+		return nil, err
+	}
+	pattern, err := evaluateExpression(e.Pattern, table, row)
+	if err != nil || val == nil || pattern == nil {
+		return nil, err
+	}
+	s, ok := val.(string)
+	p, pok := pattern.(string)
+	if !ok || !pok {
+		return nil, fmt.Errorf("LIKE expects strings, got %T and %T", val, pattern)
+	}
+	re, err := compileLike(p)
+	if err != nil {
+		return nil, err
+	}
+	return re.MatchString(s) != e.Not, nil
+}
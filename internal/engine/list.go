@@ -0,0 +1,85 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/bitutil"
+	"github.com/apache/arrow/go/arrow/memory"
+)
+
+// list is the value of a List column: its elements, evaluated.
+type list []interface{}
+
+func (l list) String() string {
+	parts := make([]string, len(l))
+	for i, v := range l {
+		if v == nil {
+			parts[i] = "NULL"
+		} else {
+			parts[i] = fmt.Sprint(v)
+		}
+	}
+	return "[" + strings.Join(parts, ", ") + "]"
+}
+
+// listValue reads the list at row of a.
+func listValue(a *array.List, row int) (list, error) {
+	j := row + a.Data().Offset()
+	begin, end := int(a.Offsets()[j]), int(a.Offsets()[j+1])
+	out := make(list, 0, end-begin)
+	for i := begin; i < end; i++ {
+		val, err := columnValue(a.ListValues(), i)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, val)
+	}
+	return out, nil
+}
+
+// listType is the column type for lists, whose element type is inferred from
+// the elements of all of them.
+func listType(vals []interface{}) arrow.DataType {
+	var elems []interface{}
+	for _, v := range vals {
+		if l, ok := v.(list); ok {
+			elems = append(elems, l...)
+		}
+	}
+	return arrow.ListOf(inferType(elems))
+}
+
+// buildList builds a List array of type dt from evaluated lists.
+func buildList(pool memory.Allocator, dt *arrow.ListType, vals []interface{}) (array.Interface, error) {
+	var elems []interface{}
+	offsets := make([]int32, 1, len(vals)+1)
+	valid := make([]byte, bitutil.BytesForBits(int64(len(vals))))
+	nulls := 0
+	for i, v := range vals {
+		switch l := v.(type) {
+		case nil:
+			nulls++
+		case list:
+			bitutil.SetBit(valid, i)
+			elems = append(elems, l...)
+		default:
+			return nil, fmt.Errorf("cannot store %T in a %v column", v, dt)
+		}
+		offsets = append(offsets, int32(len(elems)))
+	}
+	child, err := buildArray(pool, dt.Elem(), elems)
+	if err != nil {
+		return nil, err
+	}
+	defer child.Release()
+
+	data := array.NewData(dt, len(vals), []*memory.Buffer{
+		memory.NewBufferBytes(valid),
+		memory.NewBufferBytes(arrow.Int32Traits.CastToBytes(offsets)),
+	}, []*array.Data{child.Data()}, nulls, 0)
+	defer data.Release()
+	return array.NewListData(data), nil
+}
@@ -0,0 +1,223 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+
+	"github.com/apache/arrow/go/arrow"
+)
+
+// numberType is the type of a function that keeps the type of the number it
+// is given.
+func numberType(args []arrow.DataType) (arrow.DataType, error) {
+	if !maybeNumeric(args[0]) {
+		return nil, fmt.Errorf("expects a number, got %s", typeName(args[0]))
+	}
+	return evalType(args[0]), nil
+}
+
+// integerPartType is the type of FLOOR, CEIL and TRUNC: that of the number,
+// except that a decimal loses its fractional digits.
+func integerPartType(args []arrow.DataType) (arrow.DataType, error) {
+	dt, err := numberType(args)
+	if err != nil {
+		return nil, err
+	}
+	if dt.ID() == arrow.DECIMAL128 {
+		return unknownType, nil
+	}
+	return dt, nil
+}
+
+// floatType is the type of a function of numbers computed in floating point.
+func floatType(args []arrow.DataType) (arrow.DataType, error) {
+	for _, dt := range args {
+		if !maybeNumeric(dt) {
+			return nil, fmt.Errorf("expects numbers, got %s", typeName(dt))
+		}
+	}
+	return arrow.PrimitiveTypes.Float64, nil
+}
+
+// modType is the type of MOD, which is that of dividing its arguments.
+func modType(args []arrow.DataType) (arrow.DataType, error) {
+	if _, err := floatType(args); err != nil {
+		return nil, err
+	}
+	return binaryType("/", args[0], args[1])
+}
+
+// floatArgs reads the arguments of the function name as floats. It returns nil
+// when any of them is NULL.
+func floatArgs(name string, args []interface{}) ([]float64, error) {
+	xs := make([]float64, len(args))
+	for i, arg := range args {
+		switch arg.(type) {
+		case nil:
+			return nil, nil
+		case int64, float64, decimal:
+			xs[i] = toFloat(arg)
+		default:
+			return nil, fmt.Errorf("%s expects a number, got %T", name, arg)
+		}
+	}
+	return xs, nil
+}
+
+// floatResult checks the result of the function name for the arguments xs: a
+// NaN or infinity from finite arguments means they are outside its domain or
+// the result overflowed.
+func floatResult(name string, r float64, xs []float64) (interface{}, error) {
+	if !math.IsNaN(r) && !math.IsInf(r, 0) {
+		return r, nil
+	}
+	parts := make([]string, len(xs))
+	for i, x := range xs {
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			return r, nil
+		}
+		parts[i] = fmt.Sprint(x)
+	}
+	return nil, fmt.Errorf("%s(%s) has no finite value", name, strings.Join(parts, ", "))
+}
+
+// floatFunction lifts f into the scalar function name of one number, which is
+// computed in floating point and passes NULL through.
+func floatFunction(name string, f func(float64) float64) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		xs, err := floatArgs(name, args)
+		if xs == nil || err != nil {
+			return nil, err
+		}
+		return floatResult(name, f(xs[0]), xs)
+	}
+}
+
+// floatFunction2 is floatFunction for functions of two numbers.
+func floatFunction2(name string, f func(x, y float64) float64) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		xs, err := floatArgs(name, args)
+		if xs == nil || err != nil {
+			return nil, err
+		}
+		return floatResult(name, f(xs[0], xs[1]), xs)
+	}
+}
+
+// evalLog implements LOG(x), the base 10 logarithm, and LOG(base, x).
+func evalLog(args []interface{}) (interface{}, error) {
+	xs, err := floatArgs("LOG", args)
+	if xs == nil || err != nil {
+		return nil, err
+	}
+	if len(xs) == 1 {
+		return floatResult("LOG", math.Log10(xs[0]), xs)
+	}
+	return floatResult("LOG", math.Log(xs[1])/math.Log(xs[0]), xs)
+}
+
+func evalPi(args []interface{}) (interface{}, error) {
+	return math.Pi, nil
+}
+
+// evalAbs implements ABS(x), keeping the type of x.
+func evalAbs(args []interface{}) (interface{}, error) {
+	switch x := args[0].(type) {
+	case nil:
+		return nil, nil
+	case int64:
+		if x == math.MinInt64 {
+			return nil, fmt.Errorf("ABS(%d) overflows an integer", x)
+		}
+		if x < 0 {
+			return -x, nil
+		}
+		return x, nil
+	case float64:
+		return math.Abs(x), nil
+	case decimal:
+		if x.unscaled.Sign() < 0 {
+			return x.negate(), nil
+		}
+		return x, nil
+	default:
+		return nil, fmt.Errorf("ABS expects a number, got %T", args[0])
+	}
+}
+
+// evalSign implements SIGN(x): -1, 0 or 1 as x is negative, zero or positive,
+// of the type of x.
+func evalSign(args []interface{}) (interface{}, error) {
+	switch x := args[0].(type) {
+	case nil:
+		return nil, nil
+	case int64:
+		return int64(compareInts(x, 0)), nil
+	case float64:
+		if math.IsNaN(x) {
+			return x, nil
+		}
+		return float64(compareFloats(x, 0)), nil
+	case decimal:
+		return decimalFromInt(int64(x.unscaled.Sign())), nil
+	default:
+		return nil, fmt.Errorf("SIGN expects a number, got %T", args[0])
+	}
+}
+
+// integerPartFunction implements FLOOR, CEIL and TRUNC, which round a number
+// to an integer down, up or toward zero as dir is negative, positive or zero;
+// f does the same for floats. Integers are returned unchanged.
+func integerPartFunction(name string, dir int, f func(float64) float64) func([]interface{}) (interface{}, error) {
+	return func(args []interface{}) (interface{}, error) {
+		switch x := args[0].(type) {
+		case nil:
+			return nil, nil
+		case int64:
+			return x, nil
+		case float64:
+			return f(x), nil
+		case decimal:
+			return x.integer(dir), nil
+		default:
+			return nil, fmt.Errorf("%s expects a number, got %T", name, args[0])
+		}
+	}
+}
+
+// evalMod implements MOD(x, y), the remainder of dividing x by y, which has
+// the sign of x. Integers and decimals give an exact remainder.
+func evalMod(args []interface{}) (interface{}, error) {
+	x, y := args[0], args[1]
+	if x == nil || y == nil {
+		return nil, nil
+	}
+	if l, ok := x.(int64); ok {
+		if r, ok := y.(int64); ok {
+			if r == 0 {
+				return nil, errDivisionByZero
+			}
+			return l % r, nil
+		}
+	}
+	if isDecimalOperation(x, y) {
+		l, _ := toDecimal(x)
+		r, _ := toDecimal(y)
+		if r.unscaled.Sign() == 0 {
+			return nil, errDivisionByZero
+		}
+		scale := max(l.scale, r.scale)
+		rem := new(big.Int).Rem(l.rescale(scale).unscaled, r.rescale(scale).unscaled)
+		return decimal{unscaled: rem, scale: scale}, nil
+	}
+	xs, err := floatArgs("MOD", args)
+	if err != nil {
+		return nil, err
+	}
+	if xs[1] == 0 {
+		return nil, errDivisionByZero
+	}
+	return math.Mod(xs[0], xs[1]), nil
+}
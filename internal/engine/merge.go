@@ -0,0 +1,264 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/apache/arrow/go/arrow/array"
+
+	"github.com/kris-gaudel/tinylake/internal/planner"
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// merge applies a MERGE statement. Each target row matched by a source row
+// takes the first WHEN MATCHED clause that applies to the pair, and each
+// source row matching no target row takes the first WHEN NOT MATCHED clause
+// that applies to it.
+func (s *Session) merge(ec *execContext, stmt *queryparser.MergeStmt) error {
+	tables := s.snapshot(ec)
+	defer releaseTables(tables)
+
+	source, err := scanTable(tables, stmt.SourceName, stmt.SourceAlias, stmt.SourceCols, stmt.Source, ec)
+	if err != nil {
+		return err
+	}
+	defer source.Release()
+
+	return s.tablesOf(stmt.TableName).Update(stmt.TableName, func(table array.Record) (array.Record, error) {
+		return mergeRows(table, source, stmt, tables, ec)
+	})
+}
+
+// mergeAction is a WHEN clause with its expressions planned against the
+// joined target and source rows.
+type mergeAction struct {
+	queryparser.MergeClause
+	set     map[int]queryparser.Expression // UPDATE values by target column
+	targets []int                          // INSERT target columns
+}
+
+// mergeRows returns a new version of table with the statement's clauses
+// applied. A target row matched by more than one source row is an error.
+func mergeRows(table, source array.Record, stmt *queryparser.MergeStmt, tables map[string]array.Record, ec *execContext) (array.Record, error) {
+	alias := stmt.TableAlias
+	if alias == "" {
+		alias = stmt.TableName
+	}
+	target := qualifyRecord(table, alias)
+	defer target.Release()
+
+	targetRows, sourceRows, err := joinPairs(planner.DesugarExpr(stmt.On), target, source, ec)
+	if err != nil {
+		return nil, err
+	}
+	seen := make([]bool, table.NumRows())
+	for _, row := range targetRows {
+		if seen[row] {
+			return nil, fmt.Errorf("MERGE matched a row of %s with more than one source row", stmt.TableName)
+		}
+		seen[row] = true
+	}
+
+	// Unmatched source rows are paired with a NULL target row
+	sourceRows, targetRows = appendUnmatched(sourceRows, targetRows, int(source.NumRows()))
+	joined, err := combineRows(target, source, targetRows, sourceRows, true, false, ec.pool)
+	if err != nil {
+		return nil, err
+	}
+	defer joined.Release()
+
+	actions, err := planMergeActions(stmt.Clauses, table, joined, tables, ec)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := table.Schema().Fields()
+	deleted := make([]bool, table.NumRows())
+	updated := map[int]map[int]interface{}{}
+	inserted := make([][]interface{}, len(fields))
+	numInserted := 0
+	for row := 0; row < int(joined.NumRows()); row++ {
+		matched := targetRows[row] >= 0
+		action, err := chooseMergeAction(actions, matched, joined, row)
+		if err != nil {
+			return nil, err
+		}
+		if action == nil {
+			continue
+		}
+
+		switch action.Action {
+		case "DELETE":
+			deleted[targetRows[row]] = true
+		case "UPDATE":
+			vals := map[int]interface{}{}
+			for col, expr := range action.set {
+				val, err := evaluateExpression(expr, joined, row)
+				if err != nil {
+					return nil, err
+				}
+				if vals[col], err = castValue(val, fields[col].Type); err != nil {
+					return nil, fmt.Errorf("column %s: %w", fields[col].Name, err)
+				}
+				if vals[col] == nil && !fields[col].Nullable {
+					return nil, fmt.Errorf("column %s does not allow NULL", fields[col].Name)
+				}
+			}
+			updated[targetRows[row]] = vals
+		case "INSERT":
+			for col := range inserted {
+				inserted[col] = append(inserted[col], nil)
+			}
+			for i, expr := range action.Values {
+				val, err := evaluateExpression(expr, joined, row)
+				if err != nil {
+					return nil, err
+				}
+				col := action.targets[i]
+				if inserted[col][numInserted], err = castValue(val, fields[col].Type); err != nil {
+					return nil, fmt.Errorf("column %s: %w", fields[col].Name, err)
+				}
+			}
+			numInserted++
+		}
+	}
+
+	merged, err := applyMergeChanges(table, deleted, updated, ec)
+	if err != nil || numInserted == 0 {
+		return merged, err
+	}
+	defer merged.Release()
+	return appendValues(merged, inserted, numInserted, ec.pool)
+}
+
+// planMergeActions resolves the columns each clause writes and plans its
+// expressions against the joined rows.
+func planMergeActions(clauses []queryparser.MergeClause, table, joined array.Record, tables map[string]array.Record, ec *execContext) ([]mergeAction, error) {
+	plan := func(expr queryparser.Expression) (queryparser.Expression, error) {
+		if expr == nil {
+			return nil, nil
+		}
+		return planSubqueries(planner.DesugarExpr(expr), joined, tables, ec)
+	}
+
+	actions := make([]mergeAction, len(clauses))
+	for i, c := range clauses {
+		a := mergeAction{MergeClause: c}
+		var err error
+		if a.Cond, err = plan(c.Cond); err != nil {
+			return nil, err
+		}
+		switch c.Action {
+		case "UPDATE":
+			a.set = map[int]queryparser.Expression{}
+			for _, assign := range c.Set {
+				idx, err := resolveColumn(table, &queryparser.ColumnRef{Name: assign.Column})
+				if err != nil {
+					return nil, err
+				}
+				if _, dup := a.set[idx]; dup {
+					return nil, fmt.Errorf("column %s assigned more than once", assign.Column)
+				}
+				if a.set[idx], err = plan(assign.Value); err != nil {
+					return nil, err
+				}
+			}
+		case "INSERT":
+			if a.targets, err = insertTargets(table, c.Columns); err != nil {
+				return nil, err
+			}
+			if len(c.Values) != len(a.targets) {
+				return nil, fmt.Errorf("MERGE INSERT has %d values but %d columns", len(c.Values), len(a.targets))
+			}
+			a.Values = make([]queryparser.Expression, len(c.Values))
+			for j, v := range c.Values {
+				if a.Values[j], err = plan(v); err != nil {
+					return nil, err
+				}
+			}
+		}
+		actions[i] = a
+	}
+	return actions, nil
+}
+
+// chooseMergeAction returns the first action for matched or unmatched rows
+// whose condition holds for the joined row, or nil when none does.
+func chooseMergeAction(actions []mergeAction, matched bool, joined array.Record, row int) (*mergeAction, error) {
+	for i := range actions {
+		a := &actions[i]
+		if a.Matched != matched {
+			continue
+		}
+		if a.Cond == nil {
+			return a, nil
+		}
+		result, err := evaluateExpression(a.Cond, joined, row)
+		if err != nil {
+			return nil, err
+		}
+		switch r := result.(type) {
+		case bool:
+			if r {
+				return a, nil
+			}
+		case nil:
+			// unknown, so the clause does not apply
+		default:
+			return nil, fmt.Errorf("WHEN condition must evaluate to boolean")
+		}
+	}
+	return nil, nil
+}
+
+// applyMergeChanges returns table without the deleted rows and with the
+// updated values substituted.
+func applyMergeChanges(table array.Record, deleted []bool, updated map[int]map[int]interface{}, ec *execContext) (array.Record, error) {
+	keep := make([]int, 0, len(deleted))
+	for row, d := range deleted {
+		if !d {
+			keep = append(keep, row)
+		}
+	}
+	assigned := map[int]bool{}
+	for _, vals := range updated {
+		for col := range vals {
+			assigned[col] = true
+		}
+	}
+
+	fields := table.Schema().Fields()
+	cols := make([]array.Interface, 0, len(fields))
+	defer func() {
+		for _, c := range cols {
+			c.Release()
+		}
+	}()
+	for i, f := range fields {
+		if !assigned[i] {
+			arr, err := takeRows(ec.pool, table.Column(i), keep)
+			if err != nil {
+				return nil, err
+			}
+			cols = append(cols, arr)
+			continue
+		}
+
+		vals := make([]interface{}, len(keep))
+		for j, row := range keep {
+			if v, ok := updated[row][i]; ok {
+				vals[j] = v
+				continue
+			}
+			var err error
+			if vals[j], err = columnValue(table.Column(i), row); err != nil {
+				return nil, err
+			}
+		}
+		arr, err := buildArray(ec.pool, f.Type, vals)
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %w", f.Name, err)
+		}
+		cols = append(cols, arr)
+	}
+	return array.NewRecord(table.Schema(), cols, int64(len(keep))), nil
+}
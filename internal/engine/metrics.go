@@ -0,0 +1,142 @@
+package engine
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+)
+
+// metricsKey is the key of the schema metadata of a query's result that holds
+// the metrics of its operators, as JSON.
+const metricsKey = "tinylake.metrics"
+
+// OperatorMetrics is the work one operator of a query did.
+type OperatorMetrics struct {
+	Operator string        `json:"operator"` // the operator, as EXPLAIN shows it
+	Depth    int           `json:"depth"`    // how many operators it runs beneath, 0 for the root
+	Rows     int64         `json:"rows"`     // rows in its results
+	Batches  int64         `json:"batches"`  // results it returned, one each time it ran
+	Elapsed  time.Duration `json:"ns"`       // time it ran for, its inputs included
+	Bytes    int64         `json:"bytes"`    // size of the records it returned
+}
+
+// ResultMetrics returns the metrics of the operators that computed rec, the
+// result of a query, in the order they started running, or nil when rec
+// carries none. Operators of the queries nested in it, such as subqueries,
+// are among them, beneath the operator that ran them.
+func ResultMetrics(rec array.Record) ([]OperatorMetrics, error) {
+	md := rec.Schema().Metadata()
+	idx := md.FindKey(metricsKey)
+	if idx == -1 {
+		return nil, nil
+	}
+	var metrics []OperatorMetrics
+	if err := json.Unmarshal([]byte(md.Values()[idx]), &metrics); err != nil {
+		return nil, fmt.Errorf("reading the metrics of a result: %w", err)
+	}
+	return metrics, nil
+}
+
+// metricsCollector gathers the metrics of the operators of one statement.
+// A nil collector gathers nothing.
+type metricsCollector struct {
+	mu        sync.Mutex
+	depth     int
+	operators []OperatorMetrics
+	index     map[*accountedOp]int // the metrics of each operator that has run
+}
+
+func newMetricsCollector() *metricsCollector {
+	return &metricsCollector{index: map[*accountedOp]int{}}
+}
+
+// start records that op has started running, returning the function to call
+// with its result once it is done.
+func (c *metricsCollector) start(op *accountedOp) func(rec array.Record, rows int) {
+	if c == nil {
+		return func(array.Record, int) {}
+	}
+	c.mu.Lock()
+	i, ok := c.index[op]
+	if !ok {
+		i = len(c.operators)
+		c.index[op] = i
+		c.operators = append(c.operators, OperatorMetrics{Operator: op.name, Depth: c.depth})
+	}
+	c.depth++
+	c.mu.Unlock()
+
+	began := time.Now()
+	return func(rec array.Record, rows int) {
+		elapsed := time.Since(began)
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.depth--
+		m := &c.operators[i]
+		m.Elapsed += elapsed
+		if rec != nil {
+			m.Rows += int64(rows)
+			m.Batches++
+			m.Bytes += recordBytes(rec)
+		}
+	}
+}
+
+// attach returns rec with the metrics gathered so far in its schema's
+// metadata, releasing rec. A result no operator computed, such as that of
+// SHOW TABLES, is returned as it is.
+func (c *metricsCollector) attach(rec array.Record) (array.Record, error) {
+	if c == nil || rec == nil || len(c.operators) == 0 {
+		return rec, nil
+	}
+	c.mu.Lock()
+	data, err := json.Marshal(c.operators)
+	c.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	defer rec.Release()
+	// The metrics of the query that made a table read whole are not these
+	md := rec.Schema().Metadata()
+	var keys, values []string
+	for i, key := range md.Keys() {
+		if key != metricsKey {
+			keys, values = append(keys, key), append(values, md.Values()[i])
+		}
+	}
+	meta := arrow.NewMetadata(append(keys, metricsKey), append(values, string(data)))
+	return array.NewRecord(arrow.NewSchema(rec.Schema().Fields(), &meta), rec.Columns(), rec.NumRows()), nil
+}
+
+// recordBytes is the size of the buffers holding the columns of rec, which
+// the columns it shares with other records count towards too.
+func recordBytes(rec array.Record) int64 {
+	var n int64
+	for _, col := range rec.Columns() {
+		n += arrayBytes(col)
+	}
+	return n
+}
+
+// arrayBytes is the size of the buffers of arr and of the arrays nested in it.
+func arrayBytes(arr array.Interface) int64 {
+	var n int64
+	for _, buf := range arr.Data().Buffers() {
+		if buf != nil {
+			n += int64(buf.Len())
+		}
+	}
+	switch a := arr.(type) {
+	case *array.List:
+		n += arrayBytes(a.ListValues())
+	case *array.Struct:
+		for i := 0; i < a.NumField(); i++ {
+			n += arrayBytes(a.Field(i))
+		}
+	}
+	return n
+}
@@ -0,0 +1,253 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/memory"
+
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// Options are the per-session settings changed with SET.
+type Options struct {
+	NullsFirst           bool          // null_ordering: sort NULLs before other values instead of after
+	MemoryLimit          int64         // memory_limit: bytes a statement may hold at once, 0 for no limit
+	JoinStrategy         string        // join_strategy: "hash", "merge" or "nested_loop" for every join, "" to choose per join
+	Parallelism          int           // parallelism: goroutines a statement may run on, 0 for one per CPU
+	StatementTimeout     time.Duration // statement_timeout: how long a statement may run, 0 for no limit
+	NullOnDivisionByZero bool          // division_by_zero: give NULL for x / 0 and MOD(x, 0) instead of failing
+	CrossJoinLimit       int64         // cross_join_limit: rows a CROSS JOIN may produce, 0 for the default and -1 for no limit
+}
+
+// Set changes the option called name, parsing value as that option expects.
+func (o *Options) Set(name, value string) error {
+	switch strings.ToLower(name) {
+	case "null_ordering":
+		switch strings.ToLower(value) {
+		case "nulls_first", "first":
+			o.NullsFirst = true
+		case "nulls_last", "last":
+			o.NullsFirst = false
+		default:
+			return fmt.Errorf("invalid value for null_ordering: %q (expected nulls_first or nulls_last)", value)
+		}
+	case "memory_limit":
+		n, err := parseByteSize(value)
+		if err != nil {
+			return fmt.Errorf("invalid value for memory_limit: %v", err)
+		}
+		o.MemoryLimit = n
+	case "join_strategy":
+		switch v := strings.ToLower(value); v {
+		case "auto":
+			o.JoinStrategy = ""
+		case joinHash, joinMerge, joinNestedLoop:
+			o.JoinStrategy = v
+		default:
+			return fmt.Errorf("invalid value for join_strategy: %q (expected auto, hash, merge or nested_loop)", value)
+		}
+	case "parallelism":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid value for parallelism: %q (expected a number of workers, or 0 for one per CPU)", value)
+		}
+		o.Parallelism = n
+	case "division_by_zero":
+		switch strings.ToLower(value) {
+		case "error":
+			o.NullOnDivisionByZero = false
+		case "null":
+			o.NullOnDivisionByZero = true
+		default:
+			return fmt.Errorf("invalid value for division_by_zero: %q (expected error or null)", value)
+		}
+	case "statement_timeout":
+		d, err := parseTimeout(value)
+		if err != nil {
+			return fmt.Errorf("invalid value for statement_timeout: %v", err)
+		}
+		o.StatementTimeout = d
+	case "cross_join_limit":
+		n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+		if strings.EqualFold(strings.TrimSpace(value), "none") {
+			n, err = -1, nil
+		}
+		if err != nil || n < -1 {
+			return fmt.Errorf("invalid value for cross_join_limit: %q (expected a number of rows, 0 for the default or none)", value)
+		}
+		o.CrossJoinLimit = n
+	default:
+		return fmt.Errorf("unknown option: %s", name)
+	}
+	return nil
+}
+
+var byteUnits = []struct {
+	suffix string
+	scale  int64
+}{
+	{"KB", 1 << 10}, {"MB", 1 << 20}, {"GB", 1 << 30}, {"TB", 1 << 40}, {"B", 1},
+}
+
+// parseByteSize parses a byte count such as 1048576, '512KB' or '2 GB'.
+func parseByteSize(s string) (int64, error) {
+	num, scale := strings.ToUpper(strings.TrimSpace(s)), int64(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(num, u.suffix) {
+			num, scale = strings.TrimSpace(strings.TrimSuffix(num, u.suffix)), u.scale
+			break
+		}
+	}
+	n, err := strconv.ParseInt(num, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%q is not a byte size", s)
+	}
+	return n * scale, nil
+}
+
+// parseTimeout parses a duration such as '30s' or '1m30s', or a number of
+// milliseconds.
+func parseTimeout(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if ms, err := strconv.ParseInt(s, 10, 64); err == nil && ms >= 0 {
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("%q is not a duration", s)
+	}
+	return d, nil
+}
+
+// execContext is the state shared by the operators running one statement.
+type execContext struct {
+	ctx     context.Context // canceled to stop the statement
+	pool    memory.Allocator
+	options Options
+	now     time.Time // when the statement started, which NOW() gives
+
+	views      map[string]*queryparser.Query // catalog views, expanded where they are referenced
+	viewTables map[string]array.Record       // catalog tables the view queries read
+	expanding  []string                      // views being expanded, innermost last
+
+	metrics     *metricsCollector        // the work of the operators, for the result's metadata
+	joinFilters map[*scanOp][]joinFilter // filters joins give the scans beneath them
+	catalog     *MemoryCatalog           // where the tables read come from, for their zone maps
+	schema      uint64                   // the version of the catalog's schema the tables read have
+}
+
+// defaultCrossJoinLimit is how many rows a CROSS JOIN may produce unless the
+// session says otherwise, guarding against accidental Cartesian blowups.
+const defaultCrossJoinLimit = 10_000_000
+
+// crossJoinLimit is how many rows a CROSS JOIN may produce, 0 for no limit.
+func (o Options) crossJoinLimit() int64 {
+	switch {
+	case o.CrossJoinLimit == 0:
+		return defaultCrossJoinLimit
+	case o.CrossJoinLimit < 0:
+		return 0
+	}
+	return o.CrossJoinLimit
+}
+
+// allocator returns pool, limited to MemoryLimit bytes when there is a limit.
+func (o Options) allocator(pool memory.Allocator) memory.Allocator {
+	if o.MemoryLimit > 0 {
+		return &limitAllocator{Allocator: pool, limit: o.MemoryLimit}
+	}
+	return pool
+}
+
+// interrupted returns an error saying why ctx is done, or nil if it is not.
+// Operators check it between morsels and batches, so a canceled statement
+// stops soon after.
+func interrupted(ctx context.Context) error {
+	switch err := ctx.Err(); {
+	case err == nil:
+		return nil
+	case errors.Is(err, context.DeadlineExceeded):
+		return fmt.Errorf("query timed out: %w", err)
+	default:
+		return fmt.Errorf("query canceled: %w", err)
+	}
+}
+
+// memoryLimitError is raised by limitAllocator when an allocation would go
+// over the limit. Arrow's builders cannot return errors, so it is a panic that
+// recoverMemoryLimit turns back into an error. operator is the plan operator
+// that made the allocation, once one has claimed it.
+type memoryLimitError struct {
+	limit, used, requested int64
+	operator               string
+}
+
+func (e memoryLimitError) Error() string {
+	in := ""
+	if e.operator != "" {
+		in = " in " + e.operator
+	}
+	return fmt.Sprintf("memory limit exceeded%s: allocating %d bytes with %d in use would exceed the limit of %d bytes",
+		in, e.requested, e.used, e.limit)
+}
+
+// limitAllocator tracks the bytes held through it and refuses allocations
+// that would take the total over limit.
+type limitAllocator struct {
+	memory.Allocator
+	limit int64
+	used  int64 // accessed atomically
+}
+
+func (a *limitAllocator) reserve(n int64) {
+	if used := atomic.AddInt64(&a.used, n); used > a.limit && n > 0 {
+		atomic.AddInt64(&a.used, -n)
+		panic(memoryLimitError{limit: a.limit, used: used - n, requested: n})
+	}
+}
+
+func (a *limitAllocator) Allocate(size int) []byte {
+	a.reserve(int64(size))
+	return a.Allocator.Allocate(size)
+}
+
+func (a *limitAllocator) Reallocate(size int, b []byte) []byte {
+	a.reserve(int64(size - len(b)))
+	return a.Allocator.Reallocate(size, b)
+}
+
+func (a *limitAllocator) Free(b []byte) {
+	atomic.AddInt64(&a.used, -int64(len(b)))
+	a.Allocator.Free(b)
+}
+
+// recoverMemoryLimit turns a memoryLimitError panic into an error returned
+// through err.
+func recoverMemoryLimit(err *error) {
+	if r := recover(); r != nil {
+		merr, ok := r.(memoryLimitError)
+		if !ok {
+			panic(r)
+		}
+		*err = merr
+	}
+}
+
+// claimMemoryLimit names operator in err if it is a memory limit error that no
+// operator has claimed yet. Operators claim the errors of their inputs first,
+// so the one named is the innermost that was running.
+func claimMemoryLimit(err error, operator string) error {
+	var merr memoryLimitError
+	if !errors.As(err, &merr) || merr.operator != "" {
+		return err
+	}
+	merr.operator = operator
+	return merr
+}
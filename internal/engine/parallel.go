@@ -0,0 +1,339 @@
+package engine
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/apache/arrow/go/arrow/array"
+
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// morselSize is the number of rows a worker takes at a time. It is a variable
+// so that tests can run the parallel paths over small tables.
+var morselSize = 1 << 13
+
+// workers is the number of goroutines a statement may run on.
+func (o Options) workers() int {
+	if o.Parallelism > 0 {
+		return o.Parallelism
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// forEachMorsel splits [0, n) into ranges of size items and calls fn with the
+// index and bounds of each, on up to workers goroutines. Workers take the next
+// range as they become free. It returns the first error, after which the
+// remaining ranges are skipped, as they are once ctx is done. Each range done
+// counts as a batch toward the statement's progress.
+func forEachMorsel(ctx context.Context, n, size, workers int, fn func(m, start, end int) error) error {
+	morsels := (n + size - 1) / size
+	if workers > morsels {
+		workers = morsels
+	}
+	tracker := progressOf(ctx)
+	if workers <= 1 {
+		for m := 0; m < morsels; m++ {
+			if err := interrupted(ctx); err != nil {
+				return err
+			}
+			if err := fn(m, m*size, min((m+1)*size, n)); err != nil {
+				return err
+			}
+			tracker.batchDone()
+		}
+		return nil
+	}
+
+	var (
+		next     int64 = -1
+		failed   int32
+		firstErr error
+		once     sync.Once
+		wg       sync.WaitGroup
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&failed) == 0 {
+				m := int(atomic.AddInt64(&next, 1))
+				if m >= morsels {
+					return
+				}
+				err := interrupted(ctx)
+				if err == nil {
+					err = runMorsel(fn, m, size, n)
+				}
+				if err != nil {
+					once.Do(func() { firstErr = err })
+					atomic.StoreInt32(&failed, 1)
+				} else {
+					tracker.batchDone()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// runMorsel runs fn on morsel m on a worker goroutine, where a memory limit
+// panic must be recovered as there is no caller above to recover it.
+func runMorsel(fn func(m, start, end int) error, m, size, n int) (err error) {
+	defer recoverMemoryLimit(&err)
+	return fn(m, m*size, min((m+1)*size, n))
+}
+
+// numMorsels is the number of ranges forEachMorsel splits n items into.
+func numMorsels(n, size int) int {
+	return (n + size - 1) / size
+}
+
+// filterMorsels is filterRows run over morsels of table on several workers.
+// The rows are returned in table order, as filterRows returns them. Morsels
+// whose rows zones excludes are skipped without being read.
+func filterMorsels(ctx context.Context, where queryparser.Expression, table array.Record, workers int, zones *zonePruner) ([]int, error) {
+	n := int(table.NumRows())
+	if zones == nil && (where == nil || workers <= 1 || n <= morselSize) {
+		return filterRows(where, table)
+	}
+	parts := make([][]int, numMorsels(n, morselSize))
+	err := forEachMorsel(ctx, n, morselSize, workers, func(m, start, end int) error {
+		if zones.excludes(start, end) {
+			return nil
+		}
+		rows, err := filterRange(where, table, start, end)
+		parts[m] = rows
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return concatRows(parts), nil
+}
+
+// evaluateMorsels evaluates expr at each of rows, splitting the rows across
+// workers.
+func evaluateMorsels(ctx context.Context, expr queryparser.Expression, table array.Record, rows []int, workers int) ([]interface{}, error) {
+	vals := make([]interface{}, len(rows))
+	compiled := compileExpression(expr, table)
+	err := forEachMorsel(ctx, len(rows), morselSize, workers, func(_, start, end int) error {
+		for i := start; i < end; i++ {
+			val, err := compiled.eval(rows[i])
+			if err != nil {
+				return err
+			}
+			vals[i] = val
+		}
+		return nil
+	})
+	return vals, err
+}
+
+// groupMorsels groups rows by the GROUP BY keys, with each worker grouping a
+// morsel of the rows on its own. The partial groups are merged in morsel order,
+// so each group's rows stay in the order they were given, and the groups are
+// numbered in the order of their first rows. With coded, the rows are grouped
+// by the dictionary codes of the GROUP BY columns instead of their values.
+func groupMorsels(ctx context.Context, groupBy []queryparser.Expression, table array.Record, rows []int, coded *codedGroups, workers int) (*groupedRows, error) {
+	parts := make([]*groupedRows, numMorsels(len(rows), morselSize))
+	keys := compileExpressions(groupBy, table)
+	err := forEachMorsel(ctx, len(rows), morselSize, workers, func(m, start, end int) error {
+		if coded != nil {
+			parts[m] = coded.group(rows[start:end])
+			return nil
+		}
+		groups := newGroupedRows()
+		for _, row := range rows[start:end] {
+			key := make([]interface{}, len(keys))
+			for i, k := range keys {
+				val, err := k.eval(row)
+				if err != nil {
+					return err
+				}
+				key[i] = val
+			}
+			groups.add(key, row)
+		}
+		parts[m] = groups
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	grouped := newGroupedRows()
+	for _, groups := range parts {
+		for g, key := range groups.index.keys {
+			grouped.add(key, groups.rows[g]...)
+		}
+	}
+	return grouped, nil
+}
+
+func concatRows(parts [][]int) []int {
+	total := 0
+	for _, p := range parts {
+		total += len(p)
+	}
+	rows := make([]int, 0, total)
+	for _, p := range parts {
+		rows = append(rows, p...)
+	}
+	return rows
+}
+
+// orderedBatch is the result of processing the input batch numbered seq.
+type orderedBatch struct {
+	seq int
+	rec array.Record
+	err error
+}
+
+// parallelBatches runs process over the batches pulled from scan on up to
+// workers goroutines and returns them, through next, in input order. At most
+// twice as many batches as workers are in flight at once, so a slow batch
+// holds back the input rather than letting results pile up. stop ends the
+// workers and releases the batches not yet returned.
+func parallelBatches(scan *streamScan, workers int, process func(array.Record) (array.Record, error)) (next func() (array.Record, error), stop func()) {
+	inFlight := 2 * workers
+	tickets := make(chan struct{}, inFlight)
+	for i := 0; i < inFlight; i++ {
+		tickets <- struct{}{}
+	}
+	results := make(chan orderedBatch, inFlight)
+	done := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				select {
+				case <-tickets:
+				case <-done:
+					return
+				}
+				batch, seq, err := scan.next()
+				if batch == nil && err == nil {
+					return
+				}
+				var rec array.Record
+				if err == nil {
+					rec, err = process(batch)
+				}
+				results <- orderedBatch{seq: seq, rec: rec, err: err}
+				if err != nil {
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	pending := map[int]orderedBatch{}
+	want := 0
+	next = func() (array.Record, error) {
+		for {
+			if b, ok := pending[want]; ok {
+				delete(pending, want)
+				want++
+				tickets <- struct{}{}
+				return b.rec, b.err
+			}
+			b, ok := <-results
+			if !ok {
+				return nil, nil
+			}
+			pending[b.seq] = b
+		}
+	}
+	stop = func() {
+		close(done)
+		for b := range results {
+			pending[b.seq] = b
+		}
+		for _, b := range pending {
+			if b.rec != nil {
+				b.rec.Release()
+			}
+		}
+	}
+	return next, stop
+}
+
+// partialAggregate holds a worker's groups while the input is streamed: the
+// first row of each group and the state of every aggregate for it.
+type partialAggregate struct {
+	index   *groupIndex
+	first   [][]interface{}
+	firstAt []rowPosition
+	states  [][]aggregateState // by aggregate, then by group
+	calls   []*queryparser.FuncCall
+}
+
+// rowPosition locates a row in the streamed input.
+type rowPosition struct {
+	batch, row int
+}
+
+func (p rowPosition) before(o rowPosition) bool {
+	return p.batch < o.batch || (p.batch == o.batch && p.row < o.row)
+}
+
+func newPartialAggregate(aggregates []*aggregateColumn) *partialAggregate {
+	p := &partialAggregate{index: newGroupIndex(), states: make([][]aggregateState, len(aggregates))}
+	for _, agg := range aggregates {
+		p.calls = append(p.calls, agg.call)
+	}
+	return p
+}
+
+// group returns the number of the group with key, adding it with first as its
+// first row if it is new.
+func (p *partialAggregate) group(key []interface{}, at rowPosition, first func() ([]interface{}, error)) (int, error) {
+	g, added := p.index.lookup(key)
+	if !added {
+		return g, nil
+	}
+	values, err := first()
+	if err != nil {
+		return 0, err
+	}
+	p.first = append(p.first, values)
+	p.firstAt = append(p.firstAt, at)
+	for a := range p.states {
+		p.states[a] = append(p.states[a], newAggregateState(p.calls[a]))
+	}
+	return g, nil
+}
+
+// merge adds the groups of o to p. A group's first row is whichever of the
+// two came first in the input.
+func (p *partialAggregate) merge(o *partialAggregate) error {
+	for og, key := range o.index.keys {
+		before := p.index.len()
+		g, _ := p.group(key, o.firstAt[og], func() ([]interface{}, error) { return o.first[og], nil })
+		if g < before && o.firstAt[og].before(p.firstAt[g]) {
+			p.first[g], p.firstAt[g] = o.first[og], o.firstAt[og]
+		}
+		for a := range p.states {
+			if err := p.states[a][g].merge(o.states[a][og]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
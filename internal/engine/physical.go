@@ -0,0 +1,532 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+
+	"github.com/kris-gaudel/tinylake/internal/planner"
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// operator is a physical operator: one step of an executable plan, which runs
+// its inputs and computes its result from theirs. tables are the tables
+// visible to it by name.
+type operator interface {
+	execute(tables map[string]array.Record, ec *execContext) (array.Record, error)
+}
+
+// lower turns a logical plan into physical operators. A Project is lowered
+// together with the Sort, Aggregate and Filter directly beneath it into a
+// single selectOp, which evaluates them all over the same input rows instead
+// of copying the rows between them. types are the column types the binder
+// inferred for each SELECT list.
+func lower(n planner.Node, types planTypes) (operator, error) {
+	op, err := lowerNode(n, types)
+	if err != nil {
+		return nil, err
+	}
+	return &accountedOp{operator: op, name: fmt.Sprint(n)}, nil
+}
+
+func lowerNode(n planner.Node, types planTypes) (operator, error) {
+	switch n := n.(type) {
+	case *planner.Scan:
+		return &scanOp{name: n.Table, alias: n.Alias, columns: n.Columns, needed: n.Needed}, nil
+	case *planner.Derived:
+		input, err := lower(n.Input, types)
+		if err != nil {
+			return nil, err
+		}
+		return &derivedOp{input: input, alias: n.Alias, columns: n.Columns}, nil
+	case *planner.Pivot:
+		input, err := lower(n.Input, types)
+		if err != nil {
+			return nil, err
+		}
+		return &pivotOp{input: input, clause: n.Clause, alias: n.Alias, columns: n.Columns}, nil
+	case *planner.Unnest:
+		u := &unnestOp{clause: n.Clause, alias: n.Alias, columns: n.Columns, on: n.On, outer: n.Outer}
+		if n.Input != nil {
+			input, err := lower(n.Input, types)
+			if err != nil {
+				return nil, err
+			}
+			u.input = input
+		}
+		return u, nil
+	case *planner.Values:
+		return &valuesOp{rows: n.Rows}, nil
+	case *planner.Join:
+		left, err := lower(n.Left, types)
+		if err != nil {
+			return nil, err
+		}
+		right, err := lower(n.Right, types)
+		if err != nil {
+			return nil, err
+		}
+		return &joinOp{left: left, right: right, join: queryparser.JoinClause{Type: n.Type, On: n.On}}, nil
+	case *planner.Filter:
+		input, err := lower(n.Input, types)
+		if err != nil {
+			return nil, err
+		}
+		return &filterOp{input: input, condition: n.Condition}, nil
+	case *planner.Project:
+		return lowerSelect(n, types)
+	case *planner.Aggregate:
+		// An Aggregate is only ever evaluated for the Project above it
+		return nil, fmt.Errorf("aggregate without a SELECT list")
+	case *planner.Sort:
+		input, err := lower(n.Input, types)
+		if err != nil {
+			return nil, err
+		}
+		return &sortOp{input: input, orderBy: n.OrderBy}, nil
+	case *planner.Distinct:
+		input, err := lower(n.Input, types)
+		if err != nil {
+			return nil, err
+		}
+		return &distinctOp{input: input}, nil
+	case *planner.SetOp:
+		left, err := lower(n.Left, types)
+		if err != nil {
+			return nil, err
+		}
+		right, err := lower(n.Right, types)
+		if err != nil {
+			return nil, err
+		}
+		return &setOp{left: left, right: right, op: queryparser.SetOperation{Op: n.Op, All: n.All}}, nil
+	case *planner.With:
+		op := &withOp{ctes: make([]namedOp, len(n.CTEs))}
+		for i, cte := range n.CTEs {
+			plan, err := lower(cte.Plan, types)
+			if err != nil {
+				return nil, err
+			}
+			op.ctes[i] = namedOp{name: cte.Name, op: plan}
+		}
+		input, err := lower(n.Input, types)
+		if err != nil {
+			return nil, err
+		}
+		op.input = input
+		return op, nil
+	default:
+		return nil, fmt.Errorf("unsupported plan node %T", n)
+	}
+}
+
+// lowerSelect lowers a Project and the clauses beneath it to a selectOp.
+func lowerSelect(p *planner.Project, types planTypes) (operator, error) {
+	q, n := selectClauses(p)
+	input, err := lower(n, types)
+	if err != nil {
+		return nil, err
+	}
+	return &selectOp{input: input, query: q, types: types[p]}, nil
+}
+
+// selectClauses gathers a Project and the Sort, Aggregate and Filter beneath it
+// into the clauses of a query, which are evaluated as one step. It returns the
+// plan of the rows they are evaluated over.
+func selectClauses(p *planner.Project) (*queryparser.Query, planner.Node) {
+	q := &queryparser.Query{Projections: p.Exprs}
+	n := p.Input
+	if s, ok := n.(*planner.Sort); ok {
+		q.OrderBy = s.OrderBy
+		n = s.Input
+	}
+	if a, ok := n.(*planner.Aggregate); ok {
+		q.GroupBy, q.Having = a.GroupBy, a.Having
+		n = a.Input
+	}
+	if f, ok := n.(*planner.Filter); ok {
+		q.Where = f.Condition
+		n = f.Input
+	}
+	return q, n
+}
+
+// accountedOp runs an operator unless the statement has been canceled,
+// blaming it for the memory limit being exceeded while it runs unless an
+// operator beneath it already is, reporting it as the stage the statement is
+// at and measuring the work it does. name is the operator as EXPLAIN shows it.
+type accountedOp struct {
+	operator
+	name string
+}
+
+func (a *accountedOp) execute(tables map[string]array.Record, ec *execContext) (rec array.Record, err error) {
+	err = a.account(ec, func() (array.Record, int, error) {
+		if rec, err = a.operator.execute(tables, ec); err != nil {
+			return nil, 0, err
+		}
+		return rec, int(rec.NumRows()), nil
+	})
+	return rec, err
+}
+
+func (a *accountedOp) executeSelection(tables map[string]array.Record, ec *execContext) (rec array.Record, rows []int, err error) {
+	err = a.account(ec, func() (array.Record, int, error) {
+		if rec, rows, err = executeSelection(a.operator, tables, ec); err != nil {
+			return nil, 0, err
+		}
+		if rows == nil {
+			return rec, int(rec.NumRows()), nil
+		}
+		return rec, len(rows), nil
+	})
+	return rec, rows, err
+}
+
+// account runs fn as the operator's step of the statement. fn returns the
+// result of the step and the number of rows in it.
+func (a *accountedOp) account(ec *execContext, fn func() (array.Record, int, error)) (err error) {
+	if err := interrupted(ec.ctx); err != nil {
+		return err
+	}
+	tracker := progressOf(ec.ctx)
+	defer tracker.leave(tracker.enter(a.name))
+	defer func() { err = claimMemoryLimit(err, a.name) }()
+	defer recoverMemoryLimit(&err)
+	var rec array.Record
+	var rows int
+	defer func(done func(array.Record, int)) { done(rec, rows) }(ec.metrics.start(a))
+	rec, rows, err = fn()
+	return err
+}
+
+// scanOp reads a table, view or CTE by name, keeping only the needed columns
+// when the plan names them.
+type scanOp struct {
+	name, alias string
+	columns     []string
+	needed      []string
+}
+
+func (s *scanOp) execute(tables map[string]array.Record, ec *execContext) (array.Record, error) {
+	rec, rows, err := s.executeSelection(tables, ec)
+	if err != nil {
+		return nil, err
+	}
+	return materialize(rec, rows, ec.pool)
+}
+
+// executeSelection selects the rows that the filters of the joins above may
+// match, if they have given the scan any.
+func (s *scanOp) executeSelection(tables map[string]array.Record, ec *execContext) (array.Record, []int, error) {
+	rec, err := scanTable(tables, s.name, s.alias, s.columns, nil, ec)
+	if err != nil {
+		return nil, nil, err
+	}
+	progressOf(ec.ctx).scanned(rec.NumRows())
+	rec = selectColumns(rec, s.needed)
+	rows, err := joinFilterRows(rec, ec.joinFilters[s], ec)
+	if err != nil {
+		rec.Release()
+		return nil, nil, err
+	}
+	return rec, rows, nil
+}
+
+// selectColumns keeps the columns of rec with the given names, in rec's order,
+// or every column when names is nil. It takes ownership of rec.
+func selectColumns(rec array.Record, names []string) array.Record {
+	if names == nil {
+		return rec
+	}
+	defer rec.Release()
+	keep := make(map[string]bool, len(names))
+	for _, name := range names {
+		keep[name] = true
+	}
+	var fields []arrow.Field
+	var cols []array.Interface
+	for i, f := range rec.Schema().Fields() {
+		if keep[f.Name] {
+			fields = append(fields, f)
+			cols = append(cols, rec.Column(i))
+		}
+	}
+	return array.NewRecord(arrow.NewSchema(fields, nil), cols, rec.NumRows())
+}
+
+// derivedOp qualifies the result of a subquery in FROM with its alias.
+type derivedOp struct {
+	input   operator
+	alias   string
+	columns []string
+}
+
+func (d *derivedOp) execute(tables map[string]array.Record, ec *execContext) (array.Record, error) {
+	rec, err := d.input.execute(tables, ec)
+	if err != nil {
+		return nil, err
+	}
+	defer rec.Release()
+	return aliasColumns(qualifyRecord(rec, d.alias), d.alias, d.columns)
+}
+
+type valuesOp struct {
+	rows [][]queryparser.Expression
+}
+
+func (v *valuesOp) execute(tables map[string]array.Record, ec *execContext) (array.Record, error) {
+	return executeValues(v.rows, ec.pool)
+}
+
+// joinOp joins its inputs. The input whose unmatched rows are kept, if
+// either's are, runs first, and the keys it has are pushed as Bloom filters
+// into the scans of the other, which then reads only the rows that may match.
+type joinOp struct {
+	left, right operator
+	join        queryparser.JoinClause
+}
+
+// Inputs that hand up selections are matched on copies of the selected rows
+// of just the columns the join condition reads, and the rows of the other
+// columns are copied once, into the joined rows.
+func (j *joinOp) execute(tables map[string]array.Record, ec *execContext) (array.Record, error) {
+	first, second := j.left, j.right
+	if j.join.Type == "RIGHT" {
+		first, second = j.right, j.left
+	}
+	build, buildRows, err := executeSelection(first, tables, ec)
+	if err != nil {
+		return nil, err
+	}
+	defer build.Release()
+	buildKeys, err := selectedColumns(build, buildRows, j.join.On, ec.pool)
+	if err != nil {
+		return nil, err
+	}
+	defer buildKeys.Release()
+
+	done := func() {}
+	if j.join.Type != "FULL" && j.join.Type != "CROSS" {
+		if done, err = pushJoinFilters(j.join.On, buildKeys, second, ec); err != nil {
+			return nil, err
+		}
+	}
+	probe, probeRows, err := executeSelection(second, tables, ec)
+	done()
+	if err != nil {
+		return nil, err
+	}
+	defer probe.Release()
+	probeKeys, err := selectedColumns(probe, probeRows, j.join.On, ec.pool)
+	if err != nil {
+		return nil, err
+	}
+	defer probeKeys.Release()
+
+	left, leftKeys, leftSelection := build, buildKeys, buildRows
+	right, rightKeys, rightSelection := probe, probeKeys, probeRows
+	if j.join.Type == "RIGHT" {
+		left, leftKeys, leftSelection, right, rightKeys, rightSelection = right, rightKeys, rightSelection, left, leftKeys, leftSelection
+	}
+	leftRows, rightRows, err := joinRows(j.join, leftKeys, rightKeys, ec)
+	if err != nil {
+		return nil, err
+	}
+	padLeft, padRight := joinPadding(j.join.Type)
+	return combineRows(left, right, selectRows(leftRows, leftSelection), selectRows(rightRows, rightSelection), padLeft, padRight, ec.pool)
+}
+
+// filterOp keeps the rows of its input for which condition holds.
+type filterOp struct {
+	input     operator
+	condition queryparser.Expression
+}
+
+func (f *filterOp) execute(tables map[string]array.Record, ec *execContext) (array.Record, error) {
+	table, rows, err := f.executeSelection(tables, ec)
+	if err != nil {
+		return nil, err
+	}
+	return materialize(table, rows, ec.pool)
+}
+
+// executeSelection selects the rows of its input for which the condition
+// holds, from among those the input selected.
+func (f *filterOp) executeSelection(tables map[string]array.Record, ec *execContext) (array.Record, []int, error) {
+	table, selected, err := executeSelection(f.input, tables, ec)
+	if err != nil {
+		return nil, nil, err
+	}
+	cond, err := planSubqueries(f.condition, table, tables, ec)
+	if err != nil {
+		table.Release()
+		return nil, nil, err
+	}
+	var rows []int
+	if selected != nil {
+		rows, err = filterSelection(ec.ctx, cond, table, selected, ec.options.workers())
+	} else {
+		rows, err = filterMorsels(ec.ctx, cond, table, ec.options.workers(), newZonePruner(cond, table, ec))
+	}
+	if err != nil {
+		table.Release()
+		return nil, nil, err
+	}
+	return table, rows, nil
+}
+
+// selectOp evaluates a SELECT list over its input, together with the WHERE,
+// GROUP BY, HAVING and ORDER BY clauses of query. Result columns holding only
+// NULLs take their types from types rather than from their values.
+type selectOp struct {
+	input operator
+	query *queryparser.Query
+	types []arrow.DataType
+}
+
+func (s *selectOp) execute(tables map[string]array.Record, ec *execContext) (array.Record, error) {
+	table, selected, err := executeSelection(s.input, tables, ec)
+	if err != nil {
+		return nil, err
+	}
+	defer table.Release()
+
+	q := s.query
+	expanded, err := expandStars(q.Projections, table.Schema())
+	if err != nil {
+		return nil, err
+	}
+	projections, aliases := splitAliases(expanded)
+	unaliased := *q
+	unaliased.Projections = projections
+	unaliased.GroupBy, err = resolveGroupBy(q.GroupBy, projections, aliases, table.Schema())
+	if err != nil {
+		return nil, err
+	}
+	unaliased.OrderBy, err = resolveOrderBy(q.OrderBy, projections, aliases)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, expr := range unaliased.Projections {
+		unaliased.Projections[i], err = planSubqueries(expr, table, tables, ec)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if q.Where != nil {
+		unaliased.Where, err = planSubqueries(q.Where, table, tables, ec)
+		if err != nil {
+			return nil, err
+		}
+	}
+	shareSubexpressions(&unaliased, int(table.NumRows()))
+
+	result, err := executeSelect(&unaliased, table, selected, ec)
+	if err != nil {
+		return nil, err
+	}
+	return typeNullColumns(renameColumns(result, aliases), s.types, ec.pool)
+}
+
+// sortOp orders the rows of its input, whose columns the keys refer to.
+type sortOp struct {
+	input   operator
+	orderBy []queryparser.OrderByItem
+}
+
+func (s *sortOp) execute(tables map[string]array.Record, ec *execContext) (array.Record, error) {
+	result, err := s.input.execute(tables, ec)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Release()
+
+	orderBy, err := resolveOrderBy(s.orderBy, outputColumns(result.Schema()), nil)
+	if err != nil {
+		return nil, err
+	}
+	rows := make([]int, result.NumRows())
+	for i := range rows {
+		rows[i] = i
+	}
+	sorted, err := sortRows(orderBy, result, rows, ec.options.NullsFirst)
+	if err != nil {
+		return nil, err
+	}
+	return takeRecordRows(result, sorted, ec.pool)
+}
+
+type distinctOp struct {
+	input operator
+}
+
+func (d *distinctOp) execute(tables map[string]array.Record, ec *execContext) (array.Record, error) {
+	result, err := d.input.execute(tables, ec)
+	if err != nil {
+		return nil, err
+	}
+	return distinctRecord(result, ec.pool)
+}
+
+type setOp struct {
+	left, right operator
+	op          queryparser.SetOperation
+}
+
+func (s *setOp) execute(tables map[string]array.Record, ec *execContext) (array.Record, error) {
+	left, err := s.left.execute(tables, ec)
+	if err != nil {
+		return nil, err
+	}
+	defer left.Release()
+	right, err := s.right.execute(tables, ec)
+	if err != nil {
+		return nil, err
+	}
+	defer right.Release()
+	return executeSetOp(s.op, left, right, ec.pool)
+}
+
+// withOp runs each CTE once, in order, and then its input with the CTEs
+// visible by name. Later CTEs may reference earlier ones, and every reference
+// to a CTE shares its single materialized record.
+type withOp struct {
+	ctes  []namedOp
+	input operator
+}
+
+type namedOp struct {
+	name string
+	op   operator
+}
+
+func (w *withOp) execute(tables map[string]array.Record, ec *execContext) (array.Record, error) {
+	withTables := make(map[string]array.Record, len(tables)+len(w.ctes))
+	for name, rec := range tables {
+		withTables[name] = rec
+	}
+	var done []string
+	defer func() {
+		for _, name := range done {
+			withTables[name].Release()
+		}
+	}()
+
+	for _, cte := range w.ctes {
+		for _, prev := range done {
+			if prev == cte.name {
+				return nil, fmt.Errorf("WITH query name %s specified more than once", cte.name)
+			}
+		}
+		rec, err := cte.op.execute(withTables, ec)
+		if err != nil {
+			return nil, fmt.Errorf("WITH %s: %w", cte.name, err)
+		}
+		withTables[cte.name] = rec
+		done = append(done, cte.name)
+	}
+	return w.input.execute(withTables, ec)
+}
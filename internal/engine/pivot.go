@@ -0,0 +1,292 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/memory"
+
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// pivotOp reshapes the table its input reads with PIVOT or UNPIVOT and
+// qualifies the result with its alias.
+type pivotOp struct {
+	input   operator
+	clause  *queryparser.PivotClause
+	alias   string
+	columns []string
+}
+
+func (p *pivotOp) execute(tables map[string]array.Record, ec *execContext) (array.Record, error) {
+	rec, err := p.input.execute(tables, ec)
+	if err != nil {
+		return nil, err
+	}
+	defer rec.Release()
+
+	var out array.Record
+	if p.clause.Unpivot {
+		out, err = unpivotRecord(rec, p.clause, ec.pool)
+	} else {
+		out, err = pivotRecord(rec, p.clause, ec.pool)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer out.Release()
+	return aliasColumns(qualifyRecord(out, p.alias), p.alias, p.columns)
+}
+
+// pivotRecord is the aggregate PIVOT computes: it groups the rows of rec by
+// the columns the clause leaves, as GROUP BY would, and splits each group by
+// the value of the FOR column, computing every aggregate over the rows of
+// each group with each of the clause's values. A group without rows for a
+// value has an empty set of them, of which COUNT is 0 and other aggregates
+// are NULL; rows whose value is none of the clause's are left out.
+func pivotRecord(rec array.Record, c *queryparser.PivotClause, pool memory.Allocator) (array.Record, error) {
+	fields := rec.Schema().Fields()
+	keys, forCol, err := pivotKeys(rec.Schema(), c)
+	if err != nil {
+		return nil, err
+	}
+
+	// The values are constants, evaluated against a row with no columns
+	empty := array.NewRecord(arrow.NewSchema(nil, nil), nil, 1)
+	defer empty.Release()
+	values := make([]interface{}, len(c.In))
+	for i, v := range c.In {
+		if values[i], err = evaluateExpression(unalias(v), empty, 0); err != nil {
+			return nil, err
+		}
+	}
+
+	index := map[string]int{}
+	var first []int     // the first row of each group
+	var cells [][][]int // the rows of each group with each value
+	vals := make([]interface{}, len(keys))
+	for row := 0; row < int(rec.NumRows()); row++ {
+		for i, col := range keys {
+			if vals[i], err = columnValue(rec.Column(col), row); err != nil {
+				return nil, err
+			}
+		}
+		key := distinctKey(vals)
+		g, ok := index[key]
+		if !ok {
+			g = len(first)
+			index[key] = g
+			first = append(first, row)
+			cells = append(cells, make([][]int, len(values)))
+		}
+
+		val, err := columnValue(rec.Column(forCol), row)
+		if err != nil {
+			return nil, err
+		}
+		for j, v := range values {
+			if val != nil && v != nil && compareOperands(val, v) == 0 {
+				cells[g][j] = append(cells[g][j], row)
+				break
+			}
+		}
+	}
+
+	var outFields []arrow.Field
+	var cols []array.Interface
+	defer func() {
+		for _, col := range cols {
+			col.Release()
+		}
+	}()
+	for _, k := range keys {
+		col, err := takeRows(pool, rec.Column(k), first)
+		if err != nil {
+			return nil, err
+		}
+		outFields = append(outFields, arrow.Field{Name: fields[k].Name, Type: fields[k].Type, Nullable: true})
+		cols = append(cols, col)
+	}
+	names := pivotColumnNames(c)
+	for j := range values {
+		for a, agg := range c.Aggregates {
+			results := make([]interface{}, len(first))
+			for g := range first {
+				if results[g], err = evaluateGroupExpression(unalias(agg), rec, cells[g][j]); err != nil {
+					return nil, err
+				}
+			}
+			dt := inferType(results)
+			col, err := buildArray(pool, dt, results)
+			if err != nil {
+				return nil, err
+			}
+			outFields = append(outFields, arrow.Field{Name: names[j*len(c.Aggregates)+a], Type: dt, Nullable: true})
+			cols = append(cols, col)
+		}
+	}
+	return array.NewRecord(arrow.NewSchema(outFields, nil), cols, int64(len(first))), nil
+}
+
+// pivotKeys returns the columns of schema that group the rows of a PIVOT,
+// which are those other than the FOR column and the columns the aggregates
+// read, along with the FOR column.
+func pivotKeys(schema *arrow.Schema, c *queryparser.PivotClause) ([]int, int, error) {
+	forCol, err := resolveField(schema, &queryparser.ColumnRef{Name: c.For})
+	if err != nil {
+		return nil, -1, err
+	}
+	read := map[int]bool{forCol: true}
+	for _, agg := range c.Aggregates {
+		if !hasAggregate(agg) {
+			return nil, -1, fmt.Errorf("PIVOT expects aggregates, got %s", queryparser.FormatExpr(agg))
+		}
+		queryparser.Inspect(agg, func(e queryparser.Expression) bool {
+			if ref, ok := e.(*queryparser.ColumnRef); ok {
+				if col, err := findField(schema, ref); err == nil && col >= 0 {
+					read[col] = true
+				}
+			}
+			return true
+		})
+	}
+	var keys []int
+	for i := range schema.Fields() {
+		if !read[i] {
+			keys = append(keys, i)
+		}
+	}
+	return keys, forCol, nil
+}
+
+// pivotColumnNames returns the names of the columns PIVOT makes, for each
+// value in turn one for each aggregate. A column is named after its value,
+// by its alias if it has one, and when there is more than one aggregate also
+// after its aggregate, as in 2020_total.
+func pivotColumnNames(c *queryparser.PivotClause) []string {
+	name := func(expr queryparser.Expression) string {
+		switch e := expr.(type) {
+		case *queryparser.AliasExpr:
+			return e.Alias
+		case *queryparser.Literal:
+			return e.Value
+		}
+		return queryparser.FormatExpr(expr)
+	}
+	names := make([]string, 0, len(c.In)*len(c.Aggregates))
+	for _, v := range c.In {
+		for _, agg := range c.Aggregates {
+			if len(c.Aggregates) == 1 {
+				names = append(names, name(v))
+			} else {
+				names = append(names, name(v)+"_"+name(agg))
+			}
+		}
+	}
+	return names
+}
+
+// unpivotRecord turns each row of rec into a row for every one of the
+// clause's columns whose value is not NULL, holding the row's other columns,
+// the column's name and its value.
+func unpivotRecord(rec array.Record, c *queryparser.PivotClause, pool memory.Allocator) (array.Record, error) {
+	fields := rec.Schema().Fields()
+	keep, unpivoted, dt, err := unpivotLayout(rec.Schema(), c)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []int
+	var names, values []interface{}
+	for row := 0; row < int(rec.NumRows()); row++ {
+		for _, col := range unpivoted {
+			val, err := columnValue(rec.Column(col), row)
+			if err != nil {
+				return nil, err
+			}
+			if val == nil {
+				continue
+			}
+			if val, err = castValue(val, dt); err != nil {
+				return nil, err
+			}
+			rows = append(rows, row)
+			names = append(names, fields[col].Name)
+			values = append(values, val)
+		}
+	}
+
+	var outFields []arrow.Field
+	var cols []array.Interface
+	defer func() {
+		for _, col := range cols {
+			col.Release()
+		}
+	}()
+	for _, k := range keep {
+		col, err := takeRows(pool, rec.Column(k), rows)
+		if err != nil {
+			return nil, err
+		}
+		outFields = append(outFields, arrow.Field{Name: fields[k].Name, Type: fields[k].Type, Nullable: true})
+		cols = append(cols, col)
+	}
+	for _, out := range []struct {
+		field arrow.Field
+		vals  []interface{}
+	}{
+		{arrow.Field{Name: c.For, Type: arrow.BinaryTypes.String}, names},
+		{arrow.Field{Name: c.Value, Type: dt, Nullable: true}, values},
+	} {
+		col, err := buildArray(pool, out.field.Type, out.vals)
+		if err != nil {
+			return nil, err
+		}
+		outFields = append(outFields, out.field)
+		cols = append(cols, col)
+	}
+	return array.NewRecord(arrow.NewSchema(outFields, nil), cols, int64(len(rows))), nil
+}
+
+// unpivotLayout returns the columns of schema UNPIVOT keeps as they are and
+// those it turns into rows, with the type their values take: the type the
+// columns share, or float64 for a mix of integers and floats.
+func unpivotLayout(schema *arrow.Schema, c *queryparser.PivotClause) (keep, unpivoted []int, dt arrow.DataType, err error) {
+	read := map[int]bool{}
+	for _, name := range c.Columns {
+		col, err := resolveField(schema, &queryparser.ColumnRef{Name: name})
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if read[col] {
+			return nil, nil, nil, fmt.Errorf("UNPIVOT names column %s more than once", name)
+		}
+		read[col] = true
+		unpivoted = append(unpivoted, col)
+
+		switch t := schema.Field(col).Type; {
+		case dt == nil || arrow.TypeEqual(dt, t):
+			dt = t
+		case isType(dt, arrow.PrimitiveTypes.Int64) && isType(t, arrow.PrimitiveTypes.Float64),
+			isType(dt, arrow.PrimitiveTypes.Float64) && isType(t, arrow.PrimitiveTypes.Int64):
+			dt = arrow.PrimitiveTypes.Float64
+		default:
+			return nil, nil, nil, fmt.Errorf("UNPIVOT columns must share a type, got %s and %s", typeName(dt), typeName(t))
+		}
+	}
+	for i := range schema.Fields() {
+		if !read[i] {
+			keep = append(keep, i)
+		}
+	}
+	return keep, unpivoted, dt, nil
+}
+
+// unalias returns the expression an alias names, or expr itself.
+func unalias(expr queryparser.Expression) queryparser.Expression {
+	if a, ok := expr.(*queryparser.AliasExpr); ok {
+		return a.Expr
+	}
+	return expr
+}
@@ -0,0 +1,186 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// planCacheSize is the number of plans a session keeps, the least recently
+// used being dropped to make room for more.
+const planCacheSize = 256
+
+// planCache keeps the plans of the queries a session runs from their text,
+// so that running a query again, or one that differs from it only in its
+// constants, skips parsing, planning and binding. Queries are matched by
+// queryparser.Fingerprint, with their literals abstracted into parameters:
+// a plan reads the literals of the query it was built for where they are, so
+// it runs another query once they are given the values of that query's
+// literals. A plan therefore runs one query at a time, and is taken out of
+// the cache while it does. Plans are built against a version of the catalog's
+// schema and are not used once it has changed.
+type planCache struct {
+	mu    sync.Mutex
+	plans map[string]*cachedPlan
+	clock uint64 // counts the plans taken, to find the least recently used
+}
+
+type cachedPlan struct {
+	op     operator
+	schema uint64 // the version of the catalog's schema op was bound against
+	used   uint64
+
+	// params[i] is the literal of the plan that takes the value of the i-th
+	// literal of the text, or nil when the plan holds on to the value it was
+	// built with, values[i], as it does for GROUP BY and ORDER BY positions
+	params []*queryparser.Literal
+	values []string
+}
+
+// planKey returns the key of the plan for a query with the given fingerprint
+// and literals under opts. Plans for numbers of different types bind to
+// different types, so the key tells them apart.
+func planKey(fingerprint string, literals []queryparser.Token, opts Options) string {
+	var sb strings.Builder
+	sb.WriteString(fingerprint)
+	for _, tok := range literals {
+		if tok.Type == queryparser.TOKEN_LITERAL {
+			fmt.Fprintf(&sb, "%v ", literalType(&queryparser.Literal{Value: tok.Literal, Kind: queryparser.LiteralNumber}))
+		}
+	}
+	fmt.Fprintf(&sb, "%t", opts.NullOnDivisionByZero)
+	return sb.String()
+}
+
+// take removes the plan cached under key from the cache and returns it, or
+// nil when there is none for the version schema of the catalog's schema.
+func (c *planCache) take(key string, schema uint64) *cachedPlan {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.plans[key]
+	if !ok {
+		return nil
+	}
+	delete(c.plans, key)
+	if p.schema != schema {
+		return nil
+	}
+	c.clock++
+	p.used = c.clock
+	return p
+}
+
+// put caches p under key, replacing any plan already there.
+func (c *planCache) put(key string, p *cachedPlan) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.plans == nil {
+		c.plans = map[string]*cachedPlan{}
+	}
+	if _, ok := c.plans[key]; !ok && len(c.plans) >= planCacheSize {
+		var oldest string
+		for k, cached := range c.plans {
+			if oldest == "" || cached.used < c.plans[oldest].used {
+				oldest = k
+			}
+		}
+		delete(c.plans, oldest)
+	}
+	c.plans[key] = p
+}
+
+// newCachedPlan returns op, built for q against the version schema of the
+// catalog's schema, as a plan for the queries whose text has the literals of
+// q's in the same places.
+func newCachedPlan(op operator, q *queryparser.Query, literals []queryparser.Token, schema uint64) *cachedPlan {
+	positions := positionItems(q)
+	params := map[queryparser.Pos]*queryparser.Literal{}
+	queryparser.WalkQuery(q, func(expr queryparser.Expression) {
+		queryparser.Inspect(expr, func(e queryparser.Expression) bool {
+			if lit, ok := e.(*queryparser.Literal); ok && !positions[lit] && lit.Pos.IsValid() {
+				params[lit.Pos] = lit
+			}
+			return true
+		})
+	})
+
+	p := &cachedPlan{
+		op:     op,
+		schema: schema,
+		params: make([]*queryparser.Literal, len(literals)),
+		values: make([]string, len(literals)),
+	}
+	for i, tok := range literals {
+		// A literal the parser built from more than the token, such as
+		// DATE '2021-01-01' or -1, is not at the token or has another value
+		if lit, ok := params[tok.Pos]; ok && lit.Value == tok.Literal {
+			p.params[i] = lit
+		} else {
+			p.values[i] = tok.Literal
+		}
+	}
+	return p
+}
+
+// bind gives the plan's parameters values, those of the literals of the text
+// of the query to run, reporting false when the plan was built for other
+// values of the literals it has no parameters for.
+func (p *cachedPlan) bind(values []string) bool {
+	for i, val := range values {
+		if p.params[i] == nil && p.values[i] != val {
+			return false
+		}
+	}
+	for i, val := range values {
+		if p.params[i] != nil {
+			p.params[i].Value = val
+		}
+	}
+	return true
+}
+
+// positionItems returns the GROUP BY and ORDER BY items of q and of the
+// queries nested in it, which planning reads as positions in the SELECT list
+// when they are numbers.
+func positionItems(q *queryparser.Query) map[queryparser.Expression]bool {
+	positions := map[queryparser.Expression]bool{}
+	var visit func(q *queryparser.Query)
+	visit = func(q *queryparser.Query) {
+		if q == nil {
+			return
+		}
+		for _, e := range q.GroupBy {
+			positions[e] = true
+		}
+		for _, item := range q.OrderBy {
+			positions[item.Expr] = true
+		}
+		for _, cte := range q.With {
+			visit(cte.Query)
+		}
+		visit(q.Subquery)
+		for _, j := range q.Joins {
+			visit(j.Subquery)
+		}
+		for _, op := range q.SetOps {
+			visit(op.Query)
+		}
+		queryparser.WalkQuery(q, func(expr queryparser.Expression) {
+			queryparser.Inspect(expr, func(e queryparser.Expression) bool {
+				switch e := e.(type) {
+				case *queryparser.SubqueryExpr:
+					visit(e.Subquery)
+				case *queryparser.ExistsExpr:
+					visit(e.Subquery)
+				case *queryparser.InExpr:
+					visit(e.Subquery)
+				}
+				return true
+			})
+		})
+	}
+	visit(q)
+	return positions
+}
@@ -0,0 +1,171 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow/go/arrow/array"
+
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// PreparedStatement is a query with parameters that runs any number of times
+// with values bound to them. It is planned the first time it runs and its
+// plan reused after that, until the catalog's schema changes. Values of
+// different types bind to different types, so a plan is kept for each
+// combination of types the statement has run with. A plan runs one
+// execution at a time; an execution that finds it running plans the query
+// for itself.
+type PreparedStatement struct {
+	session   *Session
+	query     *queryparser.Query
+	params    int          // the number of values each execution binds
+	positions map[int]bool // parameters read as GROUP BY or ORDER BY positions
+	plans     planCache
+}
+
+// Prepare readies q to run in the session with values for its parameters,
+// $1 to $n, each time. Every parameter from $1 to the last must be used.
+func (s *Session) Prepare(q *queryparser.Query) (*PreparedStatement, error) {
+	stmt := &PreparedStatement{session: s, query: q, positions: map[int]bool{}}
+	used := map[int]bool{}
+	positions := positionItems(q)
+	queryparser.WalkQuery(q, func(expr queryparser.Expression) {
+		queryparser.Inspect(expr, func(e queryparser.Expression) bool {
+			if p, ok := e.(*queryparser.Parameter); ok {
+				used[p.Index] = true
+				stmt.params = max(stmt.params, p.Index)
+				if positions[p] {
+					stmt.positions[p.Index] = true
+				}
+			}
+			return true
+		})
+	})
+	for i := 1; i <= stmt.params; i++ {
+		if !used[i] {
+			return nil, fmt.Errorf("parameter $%d is not used", i)
+		}
+	}
+	return stmt, nil
+}
+
+// NumParams returns the number of values each execution of the statement
+// binds.
+func (p *PreparedStatement) NumParams() int {
+	return p.params
+}
+
+// Execute runs the statement with args as the values of its parameters, the
+// first for $1. A value may be nil for NULL, a bool, an integer, a float, a
+// string or a time.Time. The caller must release the result.
+func (p *PreparedStatement) Execute(args ...interface{}) (array.Record, error) {
+	return p.ExecuteContext(context.Background(), args...)
+}
+
+// ExecuteContext is Execute, stopping with an error once ctx is done or the
+// statement_timeout has passed.
+func (p *PreparedStatement) ExecuteContext(ctx context.Context, args ...interface{}) (result array.Record, err error) {
+	if len(args) != p.params {
+		return nil, fmt.Errorf("expected %d parameter value(s), got %d", p.params, len(args))
+	}
+	lits := make([]*queryparser.Literal, len(args))
+	values := make([]string, len(args))
+	var key strings.Builder
+	for i, arg := range args {
+		if lits[i], err = parameterLiteral(arg); err != nil {
+			return nil, fmt.Errorf("parameter $%d: %v", i+1, err)
+		}
+		values[i] = lits[i].Value
+		fmt.Fprintf(&key, "%d %v ", lits[i].Kind, literalType(lits[i]))
+		if p.positions[i+1] {
+			fmt.Fprintf(&key, "%q ", lits[i].Value)
+		}
+	}
+	s := p.session
+	fmt.Fprintf(&key, "%t", s.options.NullOnDivisionByZero)
+
+	ctx, cancel := s.statementContext(ctx)
+	defer cancel()
+	ec := s.newExecContext(ctx)
+	defer recoverMemoryLimit(&err)
+	tables := s.snapshot(ec)
+	defer releaseTables(tables)
+
+	plan := p.plans.take(key.String(), ec.schema)
+	if plan == nil {
+		if plan, err = p.plan(lits, tables, ec); err != nil {
+			return nil, err
+		}
+	}
+	plan.bind(values)
+	if result, err = plan.op.execute(tables, ec); err != nil {
+		return nil, err
+	}
+	if !callsNow(p.query) {
+		p.plans.put(key.String(), plan)
+	}
+	return ec.metrics.attach(result)
+}
+
+// plan plans the statement's query with a literal of the kind of lits[i] in
+// place of each use of $i+1, the literals being the plan's parameters.
+func (p *PreparedStatement) plan(lits []*queryparser.Literal, tables map[string]array.Record, ec *execContext) (*cachedPlan, error) {
+	params := make([]*queryparser.Literal, len(lits))
+	q := queryparser.TransformQuery(p.query, func(e queryparser.Expression) queryparser.Expression {
+		param, ok := e.(*queryparser.Parameter)
+		if !ok {
+			return e
+		}
+		lit := params[param.Index-1]
+		if lit == nil {
+			lit = &queryparser.Literal{Value: lits[param.Index-1].Value, Kind: lits[param.Index-1].Kind, Pos: param.Pos}
+			params[param.Index-1] = lit
+		}
+		return lit
+	})
+	op, err := planQuery(q, tables, ec)
+	if err != nil {
+		return nil, err
+	}
+	return &cachedPlan{op: op, schema: ec.schema, params: params, values: make([]string, len(params))}, nil
+}
+
+// parameterLiteral returns the literal a parameter bound to v stands for.
+func parameterLiteral(v interface{}) (*queryparser.Literal, error) {
+	switch v := v.(type) {
+	case nil:
+		return &queryparser.Literal{Value: "NULL", Kind: queryparser.LiteralNull}, nil
+	case bool:
+		return &queryparser.Literal{Value: strings.ToUpper(strconv.FormatBool(v)), Kind: queryparser.LiteralBool}, nil
+	case int:
+		return &queryparser.Literal{Value: strconv.Itoa(v), Kind: queryparser.LiteralNumber}, nil
+	case int32:
+		return &queryparser.Literal{Value: strconv.FormatInt(int64(v), 10), Kind: queryparser.LiteralNumber}, nil
+	case int64:
+		return &queryparser.Literal{Value: strconv.FormatInt(v, 10), Kind: queryparser.LiteralNumber}, nil
+	case float32:
+		return parameterLiteral(float64(v))
+	case float64:
+		// A whole number keeps a point so that it stays a float
+		s := strconv.FormatFloat(v, 'g', -1, 64)
+		if _, err := strconv.ParseInt(s, 10, 64); err == nil {
+			s += ".0"
+		}
+		return &queryparser.Literal{Value: s, Kind: queryparser.LiteralNumber}, nil
+	case string:
+		return &queryparser.Literal{Value: v, Kind: queryparser.LiteralString}, nil
+	case time.Time:
+		return timestampLiteral(v), nil
+	}
+	return nil, fmt.Errorf("unsupported value type %T", v)
+}
+
+// unboundParameter is the error for a parameter used without a value, as in a
+// query with parameters run without being prepared.
+func unboundParameter(p *queryparser.Parameter) error {
+	return queryparser.ErrorAt(p.Pos, "no value given for parameter $%d", p.Index)
+}
@@ -0,0 +1,101 @@
+package engine
+
+import (
+	"context"
+	"sync"
+)
+
+// Progress is how far a statement has got.
+type Progress struct {
+	Stage       string // the operator running, as EXPLAIN shows it
+	RowsScanned int64  // rows read from tables and input batches so far
+	Batches     int64  // morsels and input batches processed so far
+}
+
+// ProgressListener is told of a statement's progress as it runs. Calls for
+// one statement are never made at once, but may come from any goroutine, so
+// a listener should return quickly.
+type ProgressListener interface {
+	OnProgress(Progress)
+}
+
+// ProgressFunc lets an ordinary function be used as a ProgressListener.
+type ProgressFunc func(Progress)
+
+func (f ProgressFunc) OnProgress(p Progress) { f(p) }
+
+type progressKey struct{}
+
+// WithProgress returns a copy of ctx under which the statements run with it
+// report their progress to listener.
+func WithProgress(ctx context.Context, listener ProgressListener) context.Context {
+	return context.WithValue(ctx, progressKey{}, listener)
+}
+
+type trackerKey struct{}
+
+// progressTracker counts the work of one statement and reports it to the
+// listener given with WithProgress. A nil tracker counts nothing.
+type progressTracker struct {
+	mu       sync.Mutex
+	progress Progress
+	listener ProgressListener
+}
+
+// trackProgress returns ctx with a new tracker for a statement, if its
+// progress is to be reported.
+func trackProgress(ctx context.Context) context.Context {
+	listener, ok := ctx.Value(progressKey{}).(ProgressListener)
+	if !ok || listener == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, trackerKey{}, &progressTracker{listener: listener})
+}
+
+// progressOf returns the statement's tracker, or nil if there is none.
+func progressOf(ctx context.Context) *progressTracker {
+	t, _ := ctx.Value(trackerKey{}).(*progressTracker)
+	return t
+}
+
+// update changes the progress with f and reports the result.
+func (t *progressTracker) update(f func(p *Progress)) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f(&t.progress)
+	t.listener.OnProgress(t.progress)
+}
+
+// enter records that the operator called stage has started, returning the
+// stage to restore with leave once it is done.
+func (t *progressTracker) enter(stage string) (prev string) {
+	t.update(func(p *Progress) {
+		prev, p.Stage = p.Stage, stage
+	})
+	return prev
+}
+
+func (t *progressTracker) leave(prev string) {
+	t.update(func(p *Progress) { p.Stage = prev })
+}
+
+// scanned records that rows were read.
+func (t *progressTracker) scanned(rows int64) {
+	t.update(func(p *Progress) { p.RowsScanned += rows })
+}
+
+// batchDone records that a morsel was processed.
+func (t *progressTracker) batchDone() {
+	t.update(func(p *Progress) { p.Batches++ })
+}
+
+// batchScanned records that an input batch of rows was read.
+func (t *progressTracker) batchScanned(rows int64) {
+	t.update(func(p *Progress) {
+		p.RowsScanned += rows
+		p.Batches++
+	})
+}
@@ -0,0 +1,196 @@
+package engine
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/apache/arrow/go/arrow"
+)
+
+// maxCachedPatterns bounds the regular expressions kept compiled. Patterns are
+// nearly always constants, so a query needs few of them; the cache is emptied
+// when one that computes its patterns fills it.
+const maxCachedPatterns = 256
+
+var patternCache = struct {
+	sync.Mutex
+	compiled map[string]*regexp.Regexp
+}{compiled: map[string]*regexp.Regexp{}}
+
+// compilePattern compiles pattern, or returns it compiled by an earlier call.
+// The i flag makes it ignore case.
+func compilePattern(pattern string, ignoreCase bool) (*regexp.Regexp, error) {
+	if ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	patternCache.Lock()
+	defer patternCache.Unlock()
+	if re, ok := patternCache.compiled[pattern]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regular expression %q: %v", pattern, err)
+	}
+	if len(patternCache.compiled) >= maxCachedPatterns {
+		patternCache.compiled = map[string]*regexp.Regexp{}
+	}
+	patternCache.compiled[pattern] = re
+	return re, nil
+}
+
+// regexpArgs reads the string arguments of the function name. It returns nil
+// when any of them is NULL.
+func regexpArgs(name string, args []interface{}) ([]string, error) {
+	strs := make([]string, len(args))
+	for i, arg := range args {
+		switch s := arg.(type) {
+		case nil:
+			return nil, nil
+		case string:
+			strs[i] = s
+		default:
+			return nil, fmt.Errorf("%s expects strings, got %T", name, arg)
+		}
+	}
+	return strs, nil
+}
+
+// regexpFlags reads the flags of REGEXP_MATCHES and REGEXP_REPLACE: i to
+// ignore case, and for REGEXP_REPLACE g to replace every match.
+func regexpFlags(name, flags, allowed string) (ignoreCase, global bool, err error) {
+	for _, f := range flags {
+		if !strings.ContainsRune(allowed, f) {
+			return false, false, fmt.Errorf("%s: unknown flag %q", name, f)
+		}
+	}
+	return strings.ContainsRune(flags, 'i'), strings.ContainsRune(flags, 'g'), nil
+}
+
+// regexpType is the type of a regular expression function of strings that
+// returns result.
+func regexpType(result arrow.DataType) func(args []arrow.DataType) (arrow.DataType, error) {
+	return func(args []arrow.DataType) (arrow.DataType, error) {
+		for _, dt := range args {
+			if !isType(dt, arrow.BinaryTypes.String) {
+				return nil, fmt.Errorf("expects strings, got %s", typeName(dt))
+			}
+		}
+		return result, nil
+	}
+}
+
+func regexpExtractType(args []arrow.DataType) (arrow.DataType, error) {
+	if len(args) == 3 && !isType(args[2], arrow.PrimitiveTypes.Int64) {
+		return nil, fmt.Errorf("group must be an integer, got %s", typeName(args[2]))
+	}
+	return regexpType(arrow.BinaryTypes.String)(args[:2])
+}
+
+// evalRegexpMatches implements REGEXP_MATCHES(s, pattern [, flags]), which
+// holds when pattern matches anywhere in s.
+func evalRegexpMatches(args []interface{}) (interface{}, error) {
+	strs, err := regexpArgs("REGEXP_MATCHES", args)
+	if strs == nil || err != nil {
+		return nil, err
+	}
+	var ignoreCase bool
+	if len(strs) == 3 {
+		if ignoreCase, _, err = regexpFlags("REGEXP_MATCHES", strs[2], "i"); err != nil {
+			return nil, err
+		}
+	}
+	re, err := compilePattern(strs[1], ignoreCase)
+	if err != nil {
+		return nil, err
+	}
+	return re.MatchString(strs[0]), nil
+}
+
+// evalRegexpExtract implements REGEXP_EXTRACT(s, pattern [, group]): the text
+// of the first match of pattern in s, or of its group'th parenthesized group.
+// It is NULL when nothing matches.
+func evalRegexpExtract(args []interface{}) (interface{}, error) {
+	group := int64(0)
+	if len(args) == 3 {
+		if args[2] == nil {
+			return nil, nil
+		}
+		g, ok := args[2].(int64)
+		if !ok {
+			return nil, fmt.Errorf("REGEXP_EXTRACT group must be an integer, got %T", args[2])
+		}
+		group = g
+	}
+	strs, err := regexpArgs("REGEXP_EXTRACT", args[:2])
+	if strs == nil || err != nil {
+		return nil, err
+	}
+	re, err := compilePattern(strs[1], false)
+	if err != nil {
+		return nil, err
+	}
+	if group < 0 || group > int64(re.NumSubexp()) {
+		return nil, fmt.Errorf("REGEXP_EXTRACT: pattern %q has no group %d", strs[1], group)
+	}
+	match := re.FindStringSubmatchIndex(strs[0])
+	if match == nil || match[2*group] < 0 {
+		return nil, nil
+	}
+	return strs[0][match[2*group]:match[2*group+1]], nil
+}
+
+// evalRegexpReplace implements REGEXP_REPLACE(s, pattern, replacement
+// [, flags]), which replaces the first match of pattern in s, or every match
+// with the g flag. \1 to \9 in replacement stand for the text of the groups
+// and \0 for the whole match.
+func evalRegexpReplace(args []interface{}) (interface{}, error) {
+	strs, err := regexpArgs("REGEXP_REPLACE", args)
+	if strs == nil || err != nil {
+		return nil, err
+	}
+	var ignoreCase, global bool
+	if len(strs) == 4 {
+		if ignoreCase, global, err = regexpFlags("REGEXP_REPLACE", strs[3], "ig"); err != nil {
+			return nil, err
+		}
+	}
+	re, err := compilePattern(strs[1], ignoreCase)
+	if err != nil {
+		return nil, err
+	}
+	template := replacementTemplate(strs[2])
+	if global {
+		return re.ReplaceAllString(strs[0], template), nil
+	}
+	match := re.FindStringSubmatchIndex(strs[0])
+	if match == nil {
+		return strs[0], nil
+	}
+	replaced := re.ExpandString(nil, template, strs[0], match)
+	return strs[0][:match[0]] + string(replaced) + strs[0][match[1]:], nil
+}
+
+// replacementTemplate turns SQL's \N group references into Go's ${N},
+// escaping the $ that Go would otherwise read as one.
+func replacementTemplate(replacement string) string {
+	var b strings.Builder
+	for i := 0; i < len(replacement); i++ {
+		c := replacement[i]
+		switch {
+		case c == '$':
+			b.WriteString("$$")
+		case c == '\\' && i+1 < len(replacement) && replacement[i+1] >= '0' && replacement[i+1] <= '9':
+			fmt.Fprintf(&b, "${%c}", replacement[i+1])
+			i++
+		case c == '\\' && i+1 < len(replacement) && replacement[i+1] == '\\':
+			b.WriteByte('\\')
+			i++
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
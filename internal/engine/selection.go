@@ -0,0 +1,127 @@
+package engine
+
+import (
+	"context"
+	"strings"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/memory"
+
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// selectingOperator is an operator that can hand its result up as a
+// selection: a record it has not copied and the rows of it the result is
+// made of, nil standing for all of them. The operator above then reads the
+// rows where they are and copies only what it outputs, instead of every
+// column of the rows being copied at each step.
+type selectingOperator interface {
+	operator
+	executeSelection(tables map[string]array.Record, ec *execContext) (array.Record, []int, error)
+}
+
+// executeSelection runs op, returning its result as a selection when op can
+// select its rows and as a whole record otherwise.
+func executeSelection(op operator, tables map[string]array.Record, ec *execContext) (array.Record, []int, error) {
+	if s, ok := op.(selectingOperator); ok {
+		return s.executeSelection(tables, ec)
+	}
+	rec, err := op.execute(tables, ec)
+	return rec, nil, err
+}
+
+// materialize copies the selected rows of rec into a record of their own. It
+// takes ownership of rec.
+func materialize(rec array.Record, rows []int, pool memory.Allocator) (array.Record, error) {
+	if rows == nil {
+		return rec, nil
+	}
+	defer rec.Release()
+	return takeRecordRows(rec, rows, pool)
+}
+
+// selectRows maps rows of a selection back to the rows of the record it
+// selects from. A negative row, standing for NULL padding, stays as it is.
+func selectRows(rows, selection []int) []int {
+	if selection == nil {
+		return rows
+	}
+	for i, row := range rows {
+		if row >= 0 {
+			rows[i] = selection[row]
+		}
+	}
+	return rows
+}
+
+// selectedColumns copies the selected rows of the columns of rec that expr
+// may refer to, which is all a join needs to match them on expr. Any column
+// with the name of one expr refers to is kept, so that names resolve, or
+// fail as ambiguous, as they would against rec. Without a selection rec is
+// returned retained, as it is.
+func selectedColumns(rec array.Record, rows []int, expr queryparser.Expression, pool memory.Allocator) (array.Record, error) {
+	if rows == nil {
+		rec.Retain()
+		return rec, nil
+	}
+	var names []string
+	queryparser.Inspect(expr, func(e queryparser.Expression) bool {
+		if col, ok := e.(*queryparser.ColumnRef); ok {
+			names = append(names, col.Name)
+		}
+		return true
+	})
+
+	var fields []arrow.Field
+	var cols []array.Interface
+	defer func() {
+		for _, c := range cols {
+			c.Release()
+		}
+	}()
+	for i, f := range rec.Schema().Fields() {
+		for _, name := range names {
+			if strings.EqualFold(f.Name, name) {
+				arr, err := takeRows(pool, rec.Column(i), rows)
+				if err != nil {
+					return nil, err
+				}
+				fields = append(fields, f)
+				cols = append(cols, arr)
+				break
+			}
+		}
+	}
+	return array.NewRecord(arrow.NewSchema(fields, nil), cols, int64(len(rows))), nil
+}
+
+// filterSelection is filterMorsels over the selected rows of table alone,
+// which are evaluated row by row.
+func filterSelection(ctx context.Context, where queryparser.Expression, table array.Record, rows []int, workers int) ([]int, error) {
+	if where == nil {
+		return rows, nil
+	}
+	cond := compileExpression(where, table)
+	parts := make([][]int, numMorsels(len(rows), morselSize))
+	err := forEachMorsel(ctx, len(rows), morselSize, workers, func(m, start, end int) error {
+		for _, row := range rows[start:end] {
+			result, err := cond.eval(row)
+			if err != nil {
+				return err
+			}
+			keep, err := whereHolds(result)
+			if err != nil {
+				return err
+			}
+			if keep {
+				parts[m] = append(parts[m], row)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return concatRows(parts), nil
+}
@@ -0,0 +1,291 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/memory"
+
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// Session runs parsed statements against the tables in a catalog, along with
+// the temporary tables it creates itself, which no other session sees and
+// which last until Close.
+type Session struct {
+	catalog *MemoryCatalog
+	temp    *MemoryCatalog // temporary tables, which hide the catalog's tables of the same names
+	pool    memory.Allocator
+	options Options
+	plans   planCache // plans of the queries Query has run
+}
+
+func NewSession(catalog *MemoryCatalog) *Session {
+	return &Session{catalog: catalog, temp: NewMemoryCatalog(), pool: memory.NewGoAllocator()}
+}
+
+// Close drops the session's temporary tables.
+func (s *Session) Close() {
+	s.temp.Release()
+}
+
+// tablesOf returns where the table called name is kept: among the session's
+// temporary tables when one of them has the name, and in the catalog
+// otherwise.
+func (s *Session) tablesOf(name string) *MemoryCatalog {
+	if s.temp.hasTable(name) {
+		return s.temp
+	}
+	return s.catalog
+}
+
+// Catalog returns the catalog the session reads and writes.
+func (s *Session) Catalog() *MemoryCatalog {
+	return s.catalog
+}
+
+// Options returns the session's current options.
+func (s *Session) Options() Options {
+	return s.options
+}
+
+// createTableAs runs the statement's query and registers the result as a new
+// table, or as a new temporary table of the session.
+func (s *Session) createTableAs(ec *execContext, stmt *queryparser.CreateTableStmt) error {
+	result, err := s.execute(ec, stmt.Query)
+	if err != nil {
+		return err
+	}
+	defer result.Release()
+	if stmt.Temp {
+		return s.temp.Create(stmt.TableName, result)
+	}
+	return s.catalog.Create(stmt.TableName, result)
+}
+
+// Execute runs a single statement. Queries return their result, which the
+// caller must release; statements that only modify the catalog return nil.
+func (s *Session) Execute(stmt queryparser.Statement) (array.Record, error) {
+	return s.ExecuteContext(context.Background(), stmt)
+}
+
+// ExecuteContext is Execute, stopping with an error once ctx is done or the
+// statement_timeout has passed.
+func (s *Session) ExecuteContext(ctx context.Context, stmt queryparser.Statement) (result array.Record, err error) {
+	ctx, cancel := s.statementContext(ctx)
+	defer cancel()
+	ec := s.newExecContext(ctx)
+	defer recoverMemoryLimit(&err)
+	if s.options.NullOnDivisionByZero {
+		stmt = nullDivisorsInStatement(stmt)
+	}
+	if result, err = s.execute(ec, stmt); err != nil {
+		return nil, err
+	}
+	return ec.metrics.attach(result)
+}
+
+// Query parses and runs the query sql, returning its result, which the caller
+// must release. The session keeps the plans of the queries it runs this way,
+// so a query run again, or another that differs from it only in its
+// constants, is neither parsed nor planned again until the catalog's schema
+// changes.
+func (s *Session) Query(sql string) (array.Record, error) {
+	return s.QueryContext(context.Background(), sql)
+}
+
+// QueryContext is Query, stopping with an error once ctx is done or the
+// statement_timeout has passed.
+func (s *Session) QueryContext(ctx context.Context, sql string) (result array.Record, err error) {
+	fingerprint, literals, err := queryparser.Fingerprint(sql)
+	if err != nil {
+		return nil, err
+	}
+	key := planKey(fingerprint, literals, s.options)
+
+	ctx, cancel := s.statementContext(ctx)
+	defer cancel()
+	ec := s.newExecContext(ctx)
+	defer recoverMemoryLimit(&err)
+	tables := s.snapshot(ec)
+	defer releaseTables(tables)
+
+	values := make([]string, len(literals))
+	for i, tok := range literals {
+		values[i] = tok.Literal
+	}
+	if plan := s.plans.take(key, ec.schema); plan != nil && plan.bind(values) {
+		result, err := plan.op.execute(tables, ec)
+		var located interface{ Position() queryparser.Pos }
+		if err == nil {
+			s.plans.put(key, plan)
+			return ec.metrics.attach(result)
+		}
+		if !errors.As(err, &located) {
+			s.plans.put(key, plan)
+			return nil, err
+		}
+		// The plan's errors point into the text it was built from; running
+		// the query afresh points them into sql
+	}
+
+	q, err := queryparser.NewParser(sql).Parse()
+	if err != nil {
+		return nil, err
+	}
+	op, err := planQuery(q, tables, ec)
+	if err != nil {
+		return nil, err
+	}
+	if result, err = op.execute(tables, ec); err != nil {
+		return nil, err
+	}
+	if !callsNow(q) {
+		s.plans.put(key, newCachedPlan(op, q, literals, ec.schema))
+	}
+	return ec.metrics.attach(result)
+}
+
+// resultBatchSize is the number of rows in each batch ExecuteStream returns
+// for a result it has computed in full. It is a variable so that tests can
+// split small results.
+var resultBatchSize int64 = 1 << 13
+
+// ExecuteStream runs q and returns its result a batch at a time, which the
+// caller must release. A query over a single table that ExecuteStream in
+// streaming mode can run is run over the table's batches as the caller pulls
+// them, so the whole result is never held at once; any other query is run in
+// full first and its result handed out in batches.
+func (s *Session) ExecuteStream(ctx context.Context, q *queryparser.Query) (RecordStream, error) {
+	if table, err := s.tablesOf(q.TableName).Table(q.TableName); err == nil {
+		defer table.Release()
+		ctx, cancel := s.statementContext(ctx)
+		var batches []array.Record
+		for offset := int64(0); offset < table.NumRows(); offset += resultBatchSize {
+			batch := table.NewSlice(offset, min(offset+resultBatchSize, table.NumRows()))
+			defer batch.Release()
+			batches = append(batches, batch)
+		}
+		input, err := array.NewRecordReader(table.Schema(), batches)
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		stream, err := ExecuteStreamContext(ctx, q, input, s.options)
+		if err == nil {
+			return wrapStream(stream, func() {
+				input.Release()
+				cancel()
+			}), nil
+		}
+		input.Release()
+		cancel()
+		if !errors.Is(err, errNotStreamable) {
+			return nil, err
+		}
+	}
+
+	result, err := s.ExecuteContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	return batchStream(result, resultBatchSize), nil
+}
+
+// newExecContext returns the context to run a statement in under ctx.
+func (s *Session) newExecContext(ctx context.Context) *execContext {
+	return &execContext{ctx: trackProgress(ctx), pool: s.options.allocator(s.pool), options: s.options, now: time.Now(), metrics: newMetricsCollector()}
+}
+
+// statementContext returns the context to run a statement under, which the
+// statement_timeout ends. The caller must call cancel once the statement is
+// done.
+func (s *Session) statementContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.options.StatementTimeout > 0 {
+		return context.WithTimeout(ctx, s.options.StatementTimeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+func (s *Session) execute(ec *execContext, stmt queryparser.Statement) (array.Record, error) {
+	switch st := stmt.(type) {
+	case *queryparser.Query:
+		tables := s.snapshot(ec)
+		defer releaseTables(tables)
+		return planAndRun(st, tables, ec)
+	case *queryparser.InsertStmt:
+		return nil, s.insert(ec, st)
+	case *queryparser.CreateTableStmt:
+		return nil, s.createTableAs(ec, st)
+	case *queryparser.CreateViewStmt:
+		return nil, s.createView(ec, st)
+	case *queryparser.DropTableStmt:
+		return nil, s.tablesOf(st.TableName).Drop(st.TableName, st.IfExists)
+	case *queryparser.TruncateStmt:
+		return nil, s.truncate(ec, st)
+	case *queryparser.DropViewStmt:
+		return nil, s.catalog.DropView(st.ViewName, st.IfExists)
+	case *queryparser.MergeStmt:
+		return nil, s.merge(ec, st)
+	case *queryparser.DeleteStmt:
+		return nil, s.delete(ec, st)
+	case *queryparser.UpdateStmt:
+		return nil, s.update(ec, st)
+	case *queryparser.CopyStmt:
+		return nil, s.copy(ec, st)
+	case *queryparser.SetStmt:
+		return nil, s.options.Set(st.Name, st.Value)
+	case *queryparser.ShowTablesStmt:
+		return s.showTables(ec)
+	case *queryparser.DescribeStmt:
+		return s.describe(ec, st.TableName)
+	case *queryparser.SummarizeStmt:
+		return s.summarize(ec, st.TableName)
+	default:
+		return nil, fmt.Errorf("unsupported statement: %T", stmt)
+	}
+}
+
+// showTables lists the catalog's tables and the session's temporary tables
+// as a record with a single name column.
+func (s *Session) showTables(ec *execContext) (array.Record, error) {
+	names := s.catalog.Names()
+	for _, name := range s.temp.Names() {
+		if !s.catalog.hasTable(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	vals := make([]interface{}, len(names))
+	for i, name := range names {
+		vals[i] = name
+	}
+	return buildRecord(ec.pool, []arrow.Field{{Name: "name", Type: arrow.BinaryTypes.String}}, [][]interface{}{vals})
+}
+
+// describe returns a table's schema as a record with one row per column.
+func (s *Session) describe(ec *execContext, name string) (array.Record, error) {
+	table, err := s.readTable(ec, name)
+	if err != nil {
+		return nil, err
+	}
+	defer table.Release()
+
+	fields := table.Schema().Fields()
+	names := make([]interface{}, len(fields))
+	types := make([]interface{}, len(fields))
+	nullable := make([]interface{}, len(fields))
+	for i, f := range fields {
+		names[i], types[i], nullable[i] = f.Name, fmt.Sprint(f.Type), f.Nullable
+	}
+	return buildRecord(ec.pool, []arrow.Field{
+		{Name: "column_name", Type: arrow.BinaryTypes.String},
+		{Name: "column_type", Type: arrow.BinaryTypes.String},
+		{Name: "nullable", Type: arrow.FixedWidthTypes.Boolean},
+	}, [][]interface{}{names, types, nullable})
+}
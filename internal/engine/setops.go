@@ -0,0 +1,189 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/memory"
+
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// executeSetOp combines two results with UNION, INTERSECT or EXCEPT. Rows are
+// compared as whole tuples with NULLs equal to each other, as SQL requires for
+// set operations. Without ALL the output has no duplicate rows.
+func executeSetOp(op queryparser.SetOperation, left, right array.Record, pool memory.Allocator) (array.Record, error) {
+	if left.NumCols() != right.NumCols() {
+		return nil, fmt.Errorf("%s: each query must return the same number of columns, got %d and %d", op.Op, left.NumCols(), right.NumCols())
+	}
+
+	fields := make([]arrow.Field, left.NumCols())
+	for i := range fields {
+		lf, rf := left.Schema().Field(i), right.Schema().Field(i)
+		dt, err := unifyTypes(lf.Type, rf.Type)
+		if err != nil {
+			return nil, fmt.Errorf("%s: column %d: %w", op.Op, i+1, err)
+		}
+		fields[i] = arrow.Field{Name: lf.Name, Type: dt, Nullable: lf.Nullable || rf.Nullable}
+	}
+
+	leftRows, err := recordRows(left)
+	if err != nil {
+		return nil, err
+	}
+	rightRows, err := recordRows(right)
+	if err != nil {
+		return nil, err
+	}
+
+	rightCounts := map[string]int{}
+	for _, row := range rightRows {
+		rightCounts[distinctKey(row)]++
+	}
+
+	var out [][]interface{}
+	seen := map[string]bool{}
+	emitDistinct := func(row []interface{}, key string) {
+		if !seen[key] {
+			seen[key] = true
+			out = append(out, row)
+		}
+	}
+
+	switch op.Op {
+	case "UNION":
+		if op.All {
+			out = append(append(out, leftRows...), rightRows...)
+			break
+		}
+		for _, row := range append(append([][]interface{}{}, leftRows...), rightRows...) {
+			emitDistinct(row, distinctKey(row))
+		}
+	case "INTERSECT":
+		for _, row := range leftRows {
+			key := distinctKey(row)
+			if rightCounts[key] == 0 {
+				continue
+			}
+			if op.All {
+				rightCounts[key]--
+				out = append(out, row)
+			} else {
+				emitDistinct(row, key)
+			}
+		}
+	case "EXCEPT":
+		for _, row := range leftRows {
+			key := distinctKey(row)
+			if op.All {
+				if rightCounts[key] > 0 {
+					rightCounts[key]--
+				} else {
+					out = append(out, row)
+				}
+			} else if rightCounts[key] == 0 {
+				emitDistinct(row, key)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unsupported set operation: %s", op.Op)
+	}
+
+	cols := make([]array.Interface, 0, len(fields))
+	defer func() {
+		for _, c := range cols {
+			c.Release()
+		}
+	}()
+	for i, f := range fields {
+		vals := make([]interface{}, len(out))
+		for r, row := range out {
+			vals[r] = row[i]
+		}
+		arr, err := buildArray(pool, f.Type, vals)
+		if err != nil {
+			return nil, err
+		}
+		cols = append(cols, arr)
+	}
+	return array.NewRecord(arrow.NewSchema(fields, nil), cols, int64(len(out))), nil
+}
+
+// distinctRecord returns rec without duplicate rows, keeping the first
+// occurrence of each. Takes ownership of rec.
+func distinctRecord(rec array.Record, pool memory.Allocator) (array.Record, error) {
+	defer rec.Release()
+	rows, err := recordRows(rec)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	keep := make([]int, 0, len(rows))
+	for i, row := range rows {
+		key := distinctKey(row)
+		if !seen[key] {
+			seen[key] = true
+			keep = append(keep, i)
+		}
+	}
+	return takeRecordRows(rec, keep, pool)
+}
+
+// unifyTypes returns the type two set operation inputs are combined as.
+func unifyTypes(a, b arrow.DataType) (arrow.DataType, error) {
+	if arrow.TypeEqual(a, b) {
+		return a, nil
+	}
+	if ad, ok := a.(*arrow.Decimal128Type); ok {
+		if bd, ok := b.(*arrow.Decimal128Type); ok {
+			return &arrow.Decimal128Type{Precision: maxDecimalPrecision, Scale: max(ad.Scale, bd.Scale)}, nil
+		}
+	}
+	if isNumericType(a) && isNumericType(b) {
+		return arrow.PrimitiveTypes.Float64, nil
+	}
+	return nil, fmt.Errorf("incompatible types %v and %v", a, b)
+}
+
+func isNumericType(dt arrow.DataType) bool {
+	switch dt.ID() {
+	case arrow.INT8, arrow.INT16, arrow.INT32, arrow.INT64,
+		arrow.UINT8, arrow.UINT16, arrow.UINT32, arrow.UINT64,
+		arrow.FLOAT32, arrow.FLOAT64, arrow.DECIMAL128:
+		return true
+	default:
+		return false
+	}
+}
+
+// recordRows reads every row of rec as evaluated values.
+func recordRows(rec array.Record) ([][]interface{}, error) {
+	rows := make([][]interface{}, rec.NumRows())
+	for r := range rows {
+		rows[r] = make([]interface{}, rec.NumCols())
+		for c := range rows[r] {
+			val, err := columnValue(rec.Column(c), r)
+			if err != nil {
+				return nil, err
+			}
+			rows[r][c] = val
+		}
+	}
+	return rows, nil
+}
+
+// distinctKey encodes a row for duplicate detection. Unlike join keys, NULLs
+// are encoded rather than rejected so that NULL rows compare equal.
+func distinctKey(vals []interface{}) string {
+	key := make([]byte, 0, 16*len(vals))
+	for _, v := range vals {
+		if v == nil {
+			key = append(key, 1, 0)
+			continue
+		}
+		k, _ := encodeKey([]interface{}{v})
+		key = append(key, k...)
+	}
+	return string(key)
+}
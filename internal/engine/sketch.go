@@ -0,0 +1,340 @@
+package engine
+
+import (
+	"container/heap"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// hllPrecision is the number of bits of a value's hash that pick its
+// register in a hyperLogLog, which has 2^hllPrecision of them. 4096
+// registers estimate a count to within about 1.6%.
+const hllPrecision = 12
+
+// hyperLogLog estimates how many distinct values it has been given, in a
+// fixed 4KB however many there are. Each value's hash picks a register,
+// which keeps the most leading zeros seen in the rest of the hashes it
+// picks; the more distinct values, the more zeros.
+type hyperLogLog struct {
+	registers []uint8 // allocated by the first value
+}
+
+// add counts val, which is not NULL. Values equal as valueEqual has them
+// count once.
+func (h *hyperLogLog) add(val interface{}) {
+	if h.registers == nil {
+		h.registers = make([]uint8, 1<<hllPrecision)
+	}
+	hash := sketchHash(val)
+	idx := hash >> (64 - hllPrecision)
+	// The marker bit bounds the rank when the rest of the hash is zero
+	rank := uint8(bits.LeadingZeros64(hash<<hllPrecision|1<<(hllPrecision-1))) + 1
+	if rank > h.registers[idx] {
+		h.registers[idx] = rank
+	}
+}
+
+// merge counts the values given to o, as if they had been given to h.
+func (h *hyperLogLog) merge(o *hyperLogLog) {
+	if o.registers == nil {
+		return
+	}
+	if h.registers == nil {
+		h.registers = make([]uint8, len(o.registers))
+	}
+	for i, rank := range o.registers {
+		h.registers[i] = max(h.registers[i], rank)
+	}
+}
+
+// estimate is the number of distinct values given, estimated with the
+// harmonic mean of the registers, or by linear counting of the empty
+// registers when few of them are filled.
+func (h *hyperLogLog) estimate() int64 {
+	if h.registers == nil {
+		return 0
+	}
+	m := float64(len(h.registers))
+	sum, zeros := 0.0, 0
+	for _, rank := range h.registers {
+		sum += math.Ldexp(1, -int(rank))
+		if rank == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		e = m * math.Log(m/float64(zeros))
+	}
+	return int64(math.Round(e))
+}
+
+// sketchHash hashes val the same way in every run, so that the estimates of
+// a query do not change from one run to the next. Its bits are mixed with
+// MurmurHash3's finalizer, as the registers of a hyperLogLog need them to be
+// independent.
+func sketchHash(val interface{}) uint64 {
+	key, _ := encodeKey([]interface{}{val})
+	f := fnv.New64a()
+	f.Write([]byte(key))
+	x := f.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// tDigestCompression bounds the number of centroids a tDigest keeps, at
+// about half as many. The more it keeps, the more accurate its quantiles.
+const tDigestCompression = 100
+
+// tDigest estimates the quantiles of the numbers it is given from a bounded
+// number of centroids, each the mean of neighbouring numbers and how many
+// there are. Centroids near the middle may take in many numbers, but those
+// near either end few, so the extreme quantiles, the ones usually asked for,
+// stay accurate.
+type tDigest struct {
+	centroids []centroid // merged, in order of their means
+	pending   []centroid // added since the centroids were merged
+	min, max  float64
+}
+
+type centroid struct {
+	mean, weight float64
+}
+
+// add adds the number v.
+func (d *tDigest) add(v float64) {
+	d.addCentroid(centroid{mean: v, weight: 1}, v, v)
+}
+
+func (d *tDigest) addCentroid(c centroid, lo, hi float64) {
+	if len(d.centroids) == 0 && len(d.pending) == 0 {
+		d.min, d.max = lo, hi
+	}
+	d.min, d.max = math.Min(d.min, lo), math.Max(d.max, hi)
+	d.pending = append(d.pending, c)
+	if len(d.pending) >= 5*tDigestCompression {
+		d.compress()
+	}
+}
+
+// merge adds the numbers given to o, as if they had been given to d.
+func (d *tDigest) merge(o *tDigest) {
+	for _, cs := range [][]centroid{o.centroids, o.pending} {
+		for _, c := range cs {
+			d.addCentroid(c, o.min, o.max)
+		}
+	}
+}
+
+// compress merges the pending centroids into the others, combining
+// neighbours while each spans at most 1 on the arcsine scale, which
+// stretches the quantiles near either end. The scale spans
+// tDigestCompression/2 over them all, so it bounds how many centroids there
+// are however many numbers.
+func (d *tDigest) compress() {
+	if len(d.pending) == 0 {
+		return
+	}
+	all := append(d.centroids, d.pending...)
+	sort.Slice(all, func(i, j int) bool { return all[i].mean < all[j].mean })
+	total := 0.0
+	for _, c := range all {
+		total += c.weight
+	}
+	scale := func(q float64) float64 {
+		return tDigestCompression / (2 * math.Pi) * math.Asin(2*q-1)
+	}
+	merged := []centroid{all[0]}
+	before := 0.0 // the weight of the centroids before the last one merged
+	for _, c := range all[1:] {
+		last := &merged[len(merged)-1]
+		if scale((before+last.weight+c.weight)/total)-scale(before/total) <= 1 {
+			last.weight += c.weight
+			last.mean += (c.mean - last.mean) * c.weight / last.weight
+		} else {
+			before += last.weight
+			merged = append(merged, c)
+		}
+	}
+	d.centroids, d.pending = merged, nil
+}
+
+// quantile estimates the number fraction of the way through the numbers in
+// order, interpolating between the centres of the centroids it lies between
+// as PERCENTILE_CONT does between numbers, so that it is exact while every
+// centroid is a single number.
+func (d *tDigest) quantile(fraction float64) float64 {
+	d.compress()
+	total := 0.0
+	for _, c := range d.centroids {
+		total += c.weight
+	}
+	// Positions count from the centre of the first number, which is min,
+	// to that of the last, which is max
+	target := fraction*(total-1) + 0.5
+	prev, prevCentre := d.min, 0.5
+	cum := 0.0
+	for _, c := range d.centroids {
+		centre := cum + c.weight/2
+		if target < centre {
+			return prev + (c.mean-prev)*(target-prevCentre)/(centre-prevCentre)
+		}
+		prev, prevCentre = c.mean, centre
+		cum += c.weight
+	}
+	if last := total - 0.5; last > prevCentre {
+		return prev + (d.max-prev)*(target-prevCentre)/(last-prevCentre)
+	}
+	return prev
+}
+
+// maxTopK is the most values TOP_K gives.
+const maxTopK = 1000
+
+// topKCapacity is how many values MODE and TOP_K count to find the k given
+// most often: enough that which they are is exact for the columns of few
+// distinct values they are mostly asked of, and that the counts of the k are
+// close for the rest.
+func topKCapacity(k int) int {
+	return max(10*k, 1024)
+}
+
+// spaceSaving finds the values given most often, counting at most capacity
+// of them however many there are. Once it counts that many, a value it does
+// not count replaces the one counted least often, taking its count, which
+// may overstate how often the new value was given by at most that count. The
+// counts are exact while no more than capacity distinct values are given.
+type spaceSaving struct {
+	capacity int
+	counters counterHeap         // least often given first
+	index    map[string]*counter // the counter of each value, by encodeKey
+}
+
+type counter struct {
+	val   interface{}
+	count int64
+	pos   int // in the heap
+}
+
+func newSpaceSaving(capacity int) *spaceSaving {
+	return &spaceSaving{capacity: capacity, index: map[string]*counter{}}
+}
+
+// add counts val, which is not NULL.
+func (s *spaceSaving) add(val interface{}) {
+	key, _ := encodeKey([]interface{}{val})
+	if c, ok := s.index[key]; ok {
+		c.count++
+		heap.Fix(&s.counters, c.pos)
+		return
+	}
+	if len(s.counters) < s.capacity {
+		c := &counter{val: val, count: 1}
+		s.index[key] = c
+		heap.Push(&s.counters, c)
+		return
+	}
+	c := s.counters[0]
+	oldKey, _ := encodeKey([]interface{}{c.val})
+	delete(s.index, oldKey)
+	c.val, c.count = val, c.count+1
+	s.index[key] = c
+	heap.Fix(&s.counters, 0)
+}
+
+// merge counts the values given to o, as if they had been given to s. A
+// value only one of them counts may have been given to the other as often as
+// the least often counted value there, once it has replaced any.
+func (s *spaceSaving) merge(o *spaceSaving) {
+	sFloor, oFloor := s.floor(), o.floor()
+	counts := map[string]*counter{}
+	for key, c := range s.index {
+		n := oFloor
+		if oc, ok := o.index[key]; ok {
+			n = oc.count
+		}
+		counts[key] = &counter{val: c.val, count: c.count + n}
+	}
+	for key, c := range o.index {
+		if _, ok := s.index[key]; !ok {
+			counts[key] = &counter{val: c.val, count: c.count + sFloor}
+		}
+	}
+	merged := make([]*counter, 0, len(counts))
+	for _, c := range counts {
+		merged = append(merged, c)
+	}
+	sortCounters(merged)
+	if len(merged) > s.capacity {
+		merged = merged[:s.capacity]
+	}
+	s.counters, s.index = s.counters[:0], map[string]*counter{}
+	for _, c := range merged {
+		key, _ := encodeKey([]interface{}{c.val})
+		s.index[key] = c
+		heap.Push(&s.counters, c)
+	}
+}
+
+// floor is the most often a value not counted may have been given.
+func (s *spaceSaving) floor() int64 {
+	if len(s.counters) < s.capacity {
+		return 0
+	}
+	return s.counters[0].count
+}
+
+// top returns the k values given most often, most often first, ties going
+// to the smaller value.
+func (s *spaceSaving) top(k int) []interface{} {
+	counters := append([]*counter(nil), s.counters...)
+	sortCounters(counters)
+	if len(counters) > k {
+		counters = counters[:k]
+	}
+	vals := make([]interface{}, len(counters))
+	for i, c := range counters {
+		vals[i] = c.val
+	}
+	return vals
+}
+
+// sortCounters orders counters from the most often given value.
+func sortCounters(counters []*counter) {
+	sort.Slice(counters, func(i, j int) bool {
+		if counters[i].count != counters[j].count {
+			return counters[i].count > counters[j].count
+		}
+		return compareValues(counters[i].val, counters[j].val, false) < 0
+	})
+}
+
+// counterHeap orders counters from the least often given value.
+type counterHeap []*counter
+
+func (h counterHeap) Len() int           { return len(h) }
+func (h counterHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+
+func (h counterHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].pos, h[j].pos = i, j
+}
+
+func (h *counterHeap) Push(x interface{}) {
+	c := x.(*counter)
+	c.pos = len(*h)
+	*h = append(*h, c)
+}
+
+func (h *counterHeap) Pop() interface{} {
+	old := *h
+	c := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return c
+}
@@ -0,0 +1,213 @@
+package engine
+
+import (
+	"container/heap"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/apache/arrow/go/arrow/array"
+
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// sortRows orders row indices by the ORDER BY keys, evaluating each key once per row.
+// nullsFirst is the session's placement for keys without NULLS FIRST or LAST.
+func sortRows(orderBy []queryparser.OrderByItem, table array.Record, rows []int, nullsFirst bool) ([]int, error) {
+	keys := make([][]interface{}, len(rows))
+	exprs := compileExpressions(orderByExprs(orderBy), table)
+	for i, row := range rows {
+		keys[i] = make([]interface{}, len(orderBy))
+		for k, expr := range exprs {
+			val, err := expr.eval(row)
+			if err != nil {
+				return nil, err
+			}
+			keys[i][k] = val
+		}
+	}
+	return sortByKeys(rows, keys, sortOrders(orderBy, nullsFirst)), nil
+}
+
+// sortGroups orders groups by the ORDER BY keys evaluated against each group's
+// rows, which rows holds by group.
+func sortGroups(orderBy []queryparser.OrderByItem, table array.Record, groups []int, rows [][]int, nullsFirst bool) ([]int, error) {
+	keys := make([][]interface{}, len(groups))
+	for i, g := range groups {
+		keys[i] = make([]interface{}, len(orderBy))
+		for k, item := range orderBy {
+			val, err := evaluateGroupExpression(item.Expr, table, rows[g])
+			if err != nil {
+				return nil, err
+			}
+			keys[i][k] = val
+		}
+	}
+
+	order := make([]int, len(groups))
+	for i := range order {
+		order[i] = i
+	}
+	order = sortByKeys(order, keys, sortOrders(orderBy, nullsFirst))
+
+	sorted := make([]int, len(groups))
+	for i, idx := range order {
+		sorted[i] = groups[idx]
+	}
+	return sorted, nil
+}
+
+// sortOrder is the direction and NULL placement of one ORDER BY key.
+type sortOrder struct {
+	desc       bool
+	nullsFirst bool
+}
+
+// sortOrders resolves each key's order, falling back to the session's NULL
+// placement when the key does not give one. NULL placement is independent of
+// the direction, so DESC alone does not move NULLs.
+func sortOrders(orderBy []queryparser.OrderByItem, nullsFirst bool) []sortOrder {
+	orders := make([]sortOrder, len(orderBy))
+	for i, item := range orderBy {
+		orders[i] = sortOrder{desc: item.Desc, nullsFirst: nullsFirst}
+		switch item.Nulls {
+		case queryparser.NullsFirst:
+			orders[i].nullsFirst = true
+		case queryparser.NullsLast:
+			orders[i].nullsFirst = false
+		}
+	}
+	return orders
+}
+
+// sortByKeys returns items reordered by their sort keys. keys[i] belongs to items[i].
+// The sort is stable so ties keep their input order.
+func sortByKeys(items []int, keys [][]interface{}, orders []sortOrder) []int {
+	perm := sortIndices(len(items), func(a, b int) bool {
+		ka, kb := keys[a], keys[b]
+		for k := range ka {
+			c := compareValues(ka[k], kb[k], orders[k].nullsFirst)
+			if orders[k].desc && ka[k] != nil && kb[k] != nil {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+
+	out := make([]int, len(items))
+	for i, p := range perm {
+		out[i] = items[p]
+	}
+	return out
+}
+
+// parallelSortThreshold is the input size below which sortIndices sorts on a
+// single goroutine, as splitting small inputs costs more than it saves.
+var parallelSortThreshold = 1 << 14
+
+// sortIndices returns 0..n-1 stably ordered by less. Large inputs are cut into
+// one run per CPU, the runs are sorted concurrently and then merged.
+func sortIndices(n int, less func(a, b int) bool) []int {
+	perm := make([]int, n)
+	for i := range perm {
+		perm[i] = i
+	}
+	workers := runtime.GOMAXPROCS(0)
+	if n < parallelSortThreshold || workers < 2 {
+		sort.SliceStable(perm, func(a, b int) bool { return less(perm[a], perm[b]) })
+		return perm
+	}
+
+	size := (n + workers - 1) / workers
+	var runs [][]int
+	var wg sync.WaitGroup
+	for lo := 0; lo < n; lo += size {
+		run := perm[lo:min(lo+size, n)]
+		runs = append(runs, run)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sort.SliceStable(run, func(a, b int) bool { return less(run[a], run[b]) })
+		}()
+	}
+	wg.Wait()
+	return mergeRuns(runs, less)
+}
+
+// mergeRuns merges sorted runs of consecutive input ranges into one. Ties take
+// the item from the earlier run, which keeps the merge stable.
+func mergeRuns(runs [][]int, less func(a, b int) bool) []int {
+	h := &runHeap{runs: runs, less: less}
+	total := 0
+	for i, run := range runs {
+		total += len(run)
+		if len(run) > 0 {
+			h.heads = append(h.heads, i)
+		}
+	}
+	heap.Init(h)
+
+	out := make([]int, 0, total)
+	for h.Len() > 0 {
+		r := h.heads[0]
+		out = append(out, h.runs[r][0])
+		if h.runs[r] = h.runs[r][1:]; len(h.runs[r]) > 0 {
+			heap.Fix(h, 0)
+		} else {
+			heap.Pop(h)
+		}
+	}
+	return out
+}
+
+// runHeap orders the non-empty runs by their first item.
+type runHeap struct {
+	runs  [][]int
+	heads []int // indices into runs
+	less  func(a, b int) bool
+}
+
+func (h *runHeap) Len() int { return len(h.heads) }
+
+func (h *runHeap) Less(i, j int) bool {
+	a, b := h.runs[h.heads[i]][0], h.runs[h.heads[j]][0]
+	if h.less(a, b) {
+		return true
+	}
+	if h.less(b, a) {
+		return false
+	}
+	return h.heads[i] < h.heads[j]
+}
+
+func (h *runHeap) Swap(i, j int) { h.heads[i], h.heads[j] = h.heads[j], h.heads[i] }
+
+func (h *runHeap) Push(x interface{}) { h.heads = append(h.heads, x.(int)) }
+
+func (h *runHeap) Pop() interface{} {
+	last := h.heads[len(h.heads)-1]
+	h.heads = h.heads[:len(h.heads)-1]
+	return last
+}
+
+// compareValues orders two evaluated values. NULLs sort after every non-NULL
+// value, or before them when nullsFirst is set.
+func compareValues(a, b interface{}, nullsFirst bool) int {
+	if a == nil || b == nil {
+		c := 0
+		switch {
+		case a == nil && b != nil:
+			c = 1
+		case a != nil && b == nil:
+			c = -1
+		}
+		if nullsFirst {
+			return -c
+		}
+		return c
+	}
+	return compareOperands(a, b)
+}
@@ -0,0 +1,108 @@
+package engine
+
+import (
+	"math"
+	"math/rand"
+
+	"github.com/apache/arrow/go/arrow/array"
+
+	"github.com/kris-gaudel/tinylake/internal/planner"
+)
+
+// statsSampleRows is the number of rows of a column that its statistics are
+// estimated from.
+const statsSampleRows = 1024
+
+// planTables describes in-memory tables to the optimizer. The statistics of
+// each table are estimated once, on first use.
+type planTables struct {
+	tables map[string]array.Record
+	stats  map[string]planner.TableStats
+}
+
+func newPlanTables(tables map[string]array.Record) *planTables {
+	return &planTables{tables: tables, stats: map[string]planner.TableStats{}}
+}
+
+func (t *planTables) Columns(name string) ([]string, bool) {
+	rec, ok := findTable(t.tables, name)
+	if !ok {
+		return nil, false
+	}
+	names := make([]string, rec.NumCols())
+	for i, f := range rec.Schema().Fields() {
+		names[i] = f.Name
+	}
+	return names, true
+}
+
+func (t *planTables) Stats(name string) (planner.TableStats, bool) {
+	rec, ok := findTable(t.tables, name)
+	if !ok {
+		return planner.TableStats{}, false
+	}
+	if stats, ok := t.stats[name]; ok {
+		return stats, true
+	}
+	stats := planner.TableStats{Rows: rec.NumRows(), Distinct: make([]int64, rec.NumCols())}
+	for i, col := range rec.Columns() {
+		stats.Distinct[i] = estimateDistinct(col)
+	}
+	t.stats[name] = stats
+	return stats, true
+}
+
+// estimateDistinct estimates the number of distinct non-NULL values of arr
+// from a sample of its rows, with the GEE estimator: each value seen once
+// in the sample stands for sqrt(rows/sample) values of the column, and each
+// value seen more often for itself.
+func estimateDistinct(arr array.Interface) int64 {
+	n := arr.Len()
+	sample := min(n, statsSampleRows)
+	counts := map[string]int{}
+	for _, row := range sampleRows(n, sample) {
+		val, err := columnValue(arr, row)
+		if err != nil {
+			return int64(n)
+		}
+		if key, ok := encodeKey([]interface{}{val}); ok {
+			counts[key]++
+		}
+	}
+
+	once, more := 0, 0
+	for _, c := range counts {
+		if c == 1 {
+			once++
+		} else {
+			more++
+		}
+	}
+	if sample == n {
+		return int64(once + more)
+	}
+	estimate := math.Sqrt(float64(n)/float64(sample))*float64(once) + float64(more)
+	return int64(math.Min(estimate, float64(n)))
+}
+
+// sampleRows picks k distinct rows out of n at random, always the same ones for
+// the same n, so a plan does not change from one run to the next.
+func sampleRows(n, k int) []int {
+	if k == n {
+		rows := make([]int, n)
+		for i := range rows {
+			rows[i] = i
+		}
+		return rows
+	}
+	rng := rand.New(rand.NewSource(int64(n)))
+	picked := make(map[int]bool, k)
+	rows := make([]int, 0, k)
+	for len(rows) < k {
+		if row := rng.Intn(n); !picked[row] {
+			picked[row] = true
+			rows = append(rows, row)
+		}
+	}
+	return rows
+}
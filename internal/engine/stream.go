@@ -0,0 +1,639 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/memory"
+
+	"github.com/kris-gaudel/tinylake/internal/planner"
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// errNotStreamable is wrapped by the errors of queries that cannot be run a
+// batch at a time.
+var errNotStreamable = errors.New("cannot be streamed")
+
+// RecordStream is a RecordReader that reports the error that ended it, if
+// any, once Next returns false.
+type RecordStream interface {
+	array.RecordReader
+	Err() error
+}
+
+// ExecuteStream runs q over the record batches pulled from input, which stands
+// for the table in q's FROM clause, and returns the result as a stream of
+// batches. Only a few input batches are held at a time: WHERE and the
+// projections produce a result batch for each input batch, and aggregates keep
+// a running state per group instead of the group's rows, so the input may be
+// larger than memory. The batches are processed on one worker per CPU and the
+// results keep the input's order. Queries that need the whole table at once,
+// such as joins, window functions or ORDER BY without aggregates, are rejected
+// and must be run with ExecuteQuery instead. The caller releases both input and the result.
+func ExecuteStream(q *queryparser.Query, input array.RecordReader) (RecordStream, error) {
+	return ExecuteStreamWithOptions(q, input, Options{})
+}
+
+// ExecuteStreamWithOptions is ExecuteStream with the given settings, of which
+// Parallelism sets how many batches are processed at once and MemoryLimit
+// bounds the memory the result batches and aggregates hold. Each worker
+// aggregates its batches on its own before the groups are merged, so a SUM or
+// AVG may differ in its last digits from adding the values in input order.
+func ExecuteStreamWithOptions(q *queryparser.Query, input array.RecordReader, options Options) (RecordStream, error) {
+	return ExecuteStreamContext(context.Background(), q, input, options)
+}
+
+// ExecuteStreamContext is ExecuteStreamWithOptions, stopping with an error
+// once ctx is done. It is checked before each input batch is read, so a
+// stream whose consumer has gone away can be stopped between batches.
+func ExecuteStreamContext(ctx context.Context, q *queryparser.Query, input array.RecordReader, options Options) (stream RecordStream, err error) {
+	if err := checkStreamable(q); err != nil {
+		return nil, err
+	}
+	q = fixNow(q, time.Now())
+	if options.NullOnDivisionByZero {
+		q = nullDivisors(q)
+	}
+	ctx = trackProgress(ctx)
+
+	// What is left is a SELECT over a single scan, possibly with DISTINCT
+	plan := planner.Optimize(planner.Build(q), streamTables{input.Schema()})
+	bound := plan
+	distinct, isDistinct := plan.(*planner.Distinct)
+	if isDistinct {
+		plan = distinct.Input
+	}
+	operator := fmt.Sprint(plan)
+	progressOf(ctx).enter(operator)
+	defer func() { err = claimMemoryLimit(err, operator) }()
+	defer recoverMemoryLimit(&err)
+	q, from := selectClauses(plan.(*planner.Project))
+	q.Distinct = isDistinct
+	scan := from.(*planner.Scan)
+
+	s := &streamScan{
+		input:     input,
+		columns:   scan.Columns,
+		qualifier: scan.Table,
+		needed:    scan.Needed,
+		ctx:       ctx,
+		pool:      options.allocator(memory.NewGoAllocator()),
+		workers:   options.workers(),
+	}
+	if scan.Alias != "" {
+		s.qualifier = scan.Alias
+	}
+	if n := len(input.Schema().Fields()); len(scan.Columns) > n {
+		return nil, fmt.Errorf("table %s has %d columns but %d column aliases were given", s.qualifier, n, len(scan.Columns))
+	}
+
+	// The plan is resolved against an empty batch, as only the schema matters
+	empty, err := s.empty()
+	if err != nil {
+		return nil, err
+	}
+	defer empty.Release()
+	ec := &execContext{ctx: ctx, pool: s.pool, options: options}
+	types, err := bindPlan(bound, map[string]array.Record{scan.Table: empty}, ec)
+	if err != nil {
+		return nil, err
+	}
+	resultTypes := types[plan.(*planner.Project)]
+
+	expanded, err := expandStars(q.Projections, empty.Schema())
+	if err != nil {
+		return nil, err
+	}
+	projections, aliases := splitAliases(expanded)
+	unaliased := *q
+	unaliased.Projections = projections
+	unaliased.GroupBy, err = resolveGroupBy(q.GroupBy, projections, aliases, empty.Schema())
+	if err != nil {
+		return nil, err
+	}
+	unaliased.OrderBy, err = resolveOrderBy(q.OrderBy, projections, aliases)
+	if err != nil {
+		return nil, err
+	}
+
+	aggregated := len(unaliased.GroupBy) > 0 || unaliased.Having != nil
+	for _, expr := range unaliased.Projections {
+		aggregated = aggregated || hasAggregate(expr)
+	}
+	if aggregated {
+		return streamAggregate(&unaliased, aliases, resultTypes, s, ec)
+	}
+	if len(q.OrderBy) > 0 || q.Distinct {
+		return nil, fmt.Errorf("ORDER BY and DISTINCT %w without aggregates", errNotStreamable)
+	}
+	return streamProject(&unaliased, aliases, resultTypes, operator, s, ec)
+}
+
+// checkStreamable reports why q cannot be run a batch at a time, if it cannot.
+func checkStreamable(q *queryparser.Query) error {
+	var unsupported string
+	switch {
+	case len(q.With) > 0:
+		unsupported = "WITH"
+	case q.Values != nil:
+		unsupported = "VALUES"
+	case len(q.SetOps) > 0:
+		unsupported = "set operations"
+	case q.Subquery != nil:
+		unsupported = "derived tables"
+	case q.Pivot != nil:
+		unsupported = "PIVOT"
+	case q.Unnest != nil:
+		unsupported = "UNNEST"
+	case len(q.Joins) > 0:
+		unsupported = "joins"
+	case q.DistinctOn != nil:
+		unsupported = "DISTINCT ON"
+	case q.Qualify != nil:
+		unsupported = "QUALIFY"
+	case hasWindow(q.Projections...) || hasWindow(orderByExprs(q.OrderBy)...):
+		unsupported = "window functions"
+	}
+	queryparser.WalkQuery(q, func(expr queryparser.Expression) {
+		queryparser.Inspect(expr, func(e queryparser.Expression) bool {
+			switch e := e.(type) {
+			case *queryparser.SubqueryExpr, *queryparser.ExistsExpr:
+				unsupported = "subqueries"
+			case *queryparser.InExpr:
+				if e.Subquery != nil {
+					unsupported = "subqueries"
+				}
+			}
+			return unsupported == ""
+		})
+	})
+	if unsupported != "" {
+		return fmt.Errorf("%s %w", unsupported, errNotStreamable)
+	}
+	return nil
+}
+
+// streamTables describes the input of a stream to the optimizer, which only
+// knows its schema.
+type streamTables struct {
+	schema *arrow.Schema
+}
+
+func (t streamTables) Columns(string) ([]string, bool) {
+	names := make([]string, len(t.schema.Fields()))
+	for i, f := range t.schema.Fields() {
+		names[i] = f.Name
+	}
+	return names, true
+}
+
+func (t streamTables) Stats(string) (planner.TableStats, bool) {
+	return planner.TableStats{}, false
+}
+
+// streamScan reads the FROM table a batch at a time, naming and qualifying
+// each batch's columns as scanTable does for a whole table. Its workers share
+// it, each pulling the next batch when it is free.
+type streamScan struct {
+	input     array.RecordReader
+	columns   []string
+	qualifier string
+	needed    []string // the columns the query reads, nil for all
+	ctx       context.Context
+	pool      memory.Allocator
+	workers   int
+
+	mu  sync.Mutex
+	seq int // number of batches pulled so far
+}
+
+// next returns the next input batch and its place in the input, or nil once
+// the input is exhausted. Once the context is done it returns why instead.
+func (s *streamScan) next() (array.Record, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := interrupted(s.ctx); err != nil {
+		s.seq++
+		return nil, s.seq - 1, err
+	}
+	if !s.input.Next() {
+		if r, ok := s.input.(interface{ Err() error }); ok && r.Err() != nil {
+			s.seq++
+			return nil, s.seq - 1, r.Err()
+		}
+		return nil, 0, nil
+	}
+	s.seq++
+	batch := s.input.Record()
+	progressOf(s.ctx).batchScanned(batch.NumRows())
+	return s.wrap(batch), s.seq - 1, nil
+}
+
+func (s *streamScan) wrap(batch array.Record) array.Record {
+	batch.Retain()
+	renamed := renameColumns(batch, s.columns)
+	defer renamed.Release()
+	return selectColumns(qualifyRecord(renamed, s.qualifier), s.needed)
+}
+
+// empty returns a batch with the columns of a wrapped input batch and no rows.
+func (s *streamScan) empty() (array.Record, error) {
+	fields := s.input.Schema().Fields()
+	rec, err := buildRecord(s.pool, fields, make([][]interface{}, len(fields)))
+	if err != nil {
+		return nil, err
+	}
+	defer rec.Release()
+	return s.wrap(rec), nil
+}
+
+// streamProject filters and projects each input batch on its own, on the
+// scan's workers. Batches that no row passes are skipped, and every batch is
+// given the types the binder inferred, or where it could not those of the
+// first result batch. operator names the projection in memory limit errors
+// raised after the stream is returned.
+func streamProject(q *queryparser.Query, aliases []string, types []arrow.DataType, operator string, s *streamScan, ec *execContext) (RecordStream, error) {
+	project := func(batch array.Record) (result array.Record, err error) {
+		defer batch.Release()
+		defer func() { err = claimMemoryLimit(err, operator) }()
+		defer recoverMemoryLimit(&err)
+		result, err = executeSelect(q, batch, nil, ec)
+		if err != nil {
+			return nil, err
+		}
+		return renameColumns(result, aliases), nil
+	}
+	pull, stop := parallelBatches(s, s.workers, project)
+	next := func() (array.Record, error) {
+		for {
+			result, err := pull()
+			if err != nil || result == nil || result.NumRows() > 0 {
+				return result, err
+			}
+			result.Release()
+		}
+	}
+
+	// Pull the first batch with rows now, as the types the binder could not
+	// infer depend on the values
+	first, err := next()
+	if err == nil && first == nil {
+		var empty array.Record
+		if empty, err = s.empty(); err == nil {
+			first, err = project(empty)
+		}
+	}
+	var schema *arrow.Schema
+	if err == nil {
+		schema = boundSchema(first.Schema(), types)
+		first, err = conformBatch(first, schema, operator, ec.pool)
+	}
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	return newRecordStream(schema, func() (array.Record, error) {
+		if first != nil {
+			rec := first
+			first = nil
+			if rec.NumRows() == 0 {
+				rec.Release()
+				return nil, nil
+			}
+			return rec, nil
+		}
+		rec, err := next()
+		if err != nil || rec == nil {
+			return nil, err
+		}
+		return conformBatch(rec, schema, operator, ec.pool)
+	}, func() {
+		stop()
+		if first != nil {
+			first.Release()
+		}
+	}), nil
+}
+
+// boundSchema is schema with the types the binder inferred for its columns in
+// place of those of one batch's values.
+func boundSchema(schema *arrow.Schema, types []arrow.DataType) *arrow.Schema {
+	fields := append([]arrow.Field{}, schema.Fields()...)
+	for i, dt := range types {
+		if i < len(fields) && dt != unknownType && !arrow.TypeEqual(dt, fields[i].Type) {
+			fields[i].Type, fields[i].Nullable = dt, true
+		}
+	}
+	md := schema.Metadata()
+	return arrow.NewSchema(fields, &md)
+}
+
+// conformBatch is conformRecord for a batch of a stream, which must recover
+// from exceeding the memory limit itself.
+func conformBatch(rec array.Record, schema *arrow.Schema, operator string, pool memory.Allocator) (result array.Record, err error) {
+	defer func() { err = claimMemoryLimit(err, operator) }()
+	defer recoverMemoryLimit(&err)
+	return conformRecord(rec, schema, pool)
+}
+
+// conformRecord gives rec the stream's schema, casting the columns whose type
+// was inferred differently from this batch's values. It takes ownership of rec.
+func conformRecord(rec array.Record, schema *arrow.Schema, pool memory.Allocator) (array.Record, error) {
+	defer rec.Release()
+	cols := make([]array.Interface, rec.NumCols())
+	for i, f := range schema.Fields() {
+		arr := rec.Column(i)
+		if arrow.TypeEqual(arr.DataType(), f.Type) {
+			arr.Retain()
+			cols[i] = arr
+			continue
+		}
+		vals := make([]interface{}, arr.Len())
+		for row := range vals {
+			val, err := columnValue(arr, row)
+			if err == nil {
+				val, err = castValue(val, f.Type)
+			}
+			if err != nil {
+				releaseArrays(cols)
+				return nil, err
+			}
+			vals[row] = val
+		}
+		cast, err := buildArray(pool, f.Type, vals)
+		if err != nil {
+			releaseArrays(cols)
+			return nil, err
+		}
+		cols[i] = cast
+	}
+	defer releaseArrays(cols)
+	return array.NewRecord(schema, cols, rec.NumRows()), nil
+}
+
+func releaseArrays(arrs []array.Interface) {
+	for _, arr := range arrs {
+		if arr != nil {
+			arr.Release()
+		}
+	}
+}
+
+// aggregateColumn stands in for an aggregate call whose state was accumulated
+// a batch at a time, holding one state per group. It is indexed by the row of
+// the group's representative, as windowColumn is indexed by table row.
+type aggregateColumn struct {
+	call   *queryparser.FuncCall
+	name   string
+	arg    queryparser.Expression // nil for COUNT(*)
+	states []aggregateState
+}
+
+// streamAggregate consumes the whole input, keeping for each group the values
+// of its first row and the state of every aggregate. The grouped query then
+// runs over a table of those first rows, one per group, with each aggregate
+// replaced by its accumulated result.
+func streamAggregate(q *queryparser.Query, aliases []string, types []arrow.DataType, s *streamScan, ec *execContext) (RecordStream, error) {
+	var aggregates []*aggregateColumn
+	var err error
+	replace := func(expr queryparser.Expression) queryparser.Expression {
+		fc, ok := expr.(*queryparser.FuncCall)
+		if !ok || !planner.IsAggregate(fc) || err != nil {
+			return expr
+		}
+		for _, arg := range fc.Args {
+			if hasAggregate(arg) {
+				err = fmt.Errorf("aggregate function calls cannot be nested")
+				return expr
+			}
+		}
+		col := &aggregateColumn{call: fc}
+		col.name, col.arg, err = aggregateArg(fc)
+		aggregates = append(aggregates, col)
+		return col
+	}
+	final := *q
+	final.Where = nil
+	final.Projections = make([]queryparser.Expression, len(q.Projections))
+	for i, e := range q.Projections {
+		final.Projections[i] = queryparser.Transform(e, replace)
+	}
+	if q.Having != nil {
+		final.Having = queryparser.Transform(q.Having, replace)
+	}
+	final.OrderBy = make([]queryparser.OrderByItem, len(q.OrderBy))
+	for i, item := range q.OrderBy {
+		item.Expr = queryparser.Transform(item.Expr, replace)
+		final.OrderBy[i] = item
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Each worker aggregates the batches it pulls into its own groups, which
+	// are merged once the input is exhausted
+	partials := make([]*partialAggregate, s.workers)
+	errs := make([]error, s.workers)
+	var wg sync.WaitGroup
+	for w := range partials {
+		partials[w] = newPartialAggregate(aggregates)
+		wg.Add(1)
+		go func(p *partialAggregate, err *error) {
+			defer wg.Done()
+			for {
+				batch, seq, e := s.next()
+				if e != nil || batch == nil {
+					*err = e
+					return
+				}
+				e = p.accumulate(q, batch, seq, aggregates)
+				batch.Release()
+				if e != nil {
+					*err = e
+					return
+				}
+			}
+		}(partials[w], &errs[w])
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	groups := partials[0]
+	for _, p := range partials[1:] {
+		if err := groups.merge(p); err != nil {
+			return nil, err
+		}
+	}
+	if len(q.GroupBy) == 0 && groups.index.len() == 0 {
+		// Without GROUP BY there is a single group even when no row passed
+		groups.group(nil, rowPosition{}, func() ([]interface{}, error) {
+			return make([]interface{}, len(s.input.Schema().Fields())), nil
+		})
+	}
+	for a, agg := range aggregates {
+		agg.states = groups.states[a]
+	}
+
+	empty, err := s.empty()
+	if err != nil {
+		return nil, err
+	}
+	defer empty.Release()
+	fields := empty.Schema().Fields()
+	cols := make([][]interface{}, len(fields))
+	for _, row := range groups.first {
+		for c := range cols {
+			cols[c] = append(cols[c], row[c])
+		}
+	}
+	groupTable, err := buildRecord(ec.pool, fields, cols)
+	if err != nil {
+		return nil, err
+	}
+	defer groupTable.Release()
+
+	result, err := executeSelect(&final, groupTable, nil, ec)
+	if err != nil {
+		return nil, err
+	}
+	result = renameColumns(result, aliases)
+	if q.Distinct {
+		if result, err = distinctRecord(result, ec.pool); err != nil {
+			return nil, err
+		}
+	}
+	if result, err = typeNullColumns(result, types, ec.pool); err != nil {
+		return nil, err
+	}
+	return newRecordStream(result.Schema(), func() (array.Record, error) {
+		rec := result
+		result = nil
+		return rec, nil
+	}, func() {
+		if result != nil {
+			result.Release()
+		}
+	}), nil
+}
+
+// accumulate adds the rows of batch that pass WHERE to their groups, starting
+// a group at the first row with its key. seq is the batch's place in the input.
+func (p *partialAggregate) accumulate(q *queryparser.Query, batch array.Record, seq int, aggregates []*aggregateColumn) error {
+	rows, err := filterRows(q.Where, batch)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		key := make([]interface{}, len(q.GroupBy))
+		for i, expr := range q.GroupBy {
+			if key[i], err = evaluateExpression(expr, batch, row); err != nil {
+				return err
+			}
+		}
+		g, err := p.group(key, rowPosition{seq, row}, func() ([]interface{}, error) {
+			values := make([]interface{}, batch.NumCols())
+			for c := range values {
+				val, err := columnValue(batch.Column(c), row)
+				if err != nil {
+					return nil, err
+				}
+				values[c] = val
+			}
+			return values, nil
+		})
+		if err != nil {
+			return err
+		}
+		for a, agg := range aggregates {
+			if err := p.states[a][g].addRow(agg.arg, batch, row, rowPosition{seq, row}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// recordStream pulls its batches from next, which returns nil at the end.
+// Each batch is released when the stream moves past it.
+type recordStream struct {
+	refs    int64
+	schema  *arrow.Schema
+	next    func() (array.Record, error)
+	release func()
+	cur     array.Record
+	err     error
+}
+
+// batchStream hands out rec in batches of up to size rows. It takes ownership
+// of rec.
+func batchStream(rec array.Record, size int64) RecordStream {
+	var offset int64
+	return newRecordStream(rec.Schema(), func() (array.Record, error) {
+		if offset >= rec.NumRows() {
+			return nil, nil
+		}
+		batch := rec.NewSlice(offset, min(offset+size, rec.NumRows()))
+		offset += batch.NumRows()
+		return batch, nil
+	}, rec.Release)
+}
+
+// wrapStream passes on the batches of stream, calling release once it is
+// released.
+func wrapStream(stream RecordStream, release func()) RecordStream {
+	return newRecordStream(stream.Schema(), func() (array.Record, error) {
+		if !stream.Next() {
+			return nil, stream.Err()
+		}
+		rec := stream.Record()
+		rec.Retain()
+		return rec, nil
+	}, func() {
+		stream.Release()
+		release()
+	})
+}
+
+func newRecordStream(schema *arrow.Schema, next func() (array.Record, error), release func()) *recordStream {
+	return &recordStream{refs: 1, schema: schema, next: next, release: release}
+}
+
+func (s *recordStream) Retain() {
+	atomic.AddInt64(&s.refs, 1)
+}
+
+func (s *recordStream) Release() {
+	if atomic.AddInt64(&s.refs, -1) != 0 {
+		return
+	}
+	if s.cur != nil {
+		s.cur.Release()
+		s.cur = nil
+	}
+	s.release()
+}
+
+func (s *recordStream) Schema() *arrow.Schema { return s.schema }
+func (s *recordStream) Record() array.Record  { return s.cur }
+func (s *recordStream) Err() error            { return s.err }
+
+func (s *recordStream) Next() bool {
+	if s.cur != nil {
+		s.cur.Release()
+		s.cur = nil
+	}
+	if s.err != nil {
+		return false
+	}
+	s.cur, s.err = s.next()
+	return s.cur != nil
+}
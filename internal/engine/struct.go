@@ -0,0 +1,182 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+	"github.com/apache/arrow/go/arrow/bitutil"
+	"github.com/apache/arrow/go/arrow/memory"
+
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// structValue is the value of a Struct column: the names of its fields and
+// their values, evaluated.
+type structValue struct {
+	names  []string
+	values []interface{}
+}
+
+func (s structValue) String() string {
+	parts := make([]string, len(s.names))
+	for i, name := range s.names {
+		if s.values[i] == nil {
+			parts[i] = name + ": NULL"
+		} else {
+			parts[i] = fmt.Sprintf("%s: %v", name, s.values[i])
+		}
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+// field returns the value of the field named name, matched as column names
+// are: exactly, or regardless of case unless the name is quoted.
+func (s structValue) field(name string, quoted bool) (interface{}, bool) {
+	for i, n := range s.names {
+		if n == name {
+			return s.values[i], true
+		}
+	}
+	if !quoted {
+		for i, n := range s.names {
+			if strings.EqualFold(n, name) {
+				return s.values[i], true
+			}
+		}
+	}
+	return nil, false
+}
+
+// structValueAt reads the struct at row of a.
+func structValueAt(a *array.Struct, row int) (structValue, error) {
+	fields := a.DataType().(*arrow.StructType).Fields()
+	s := structValue{names: make([]string, len(fields)), values: make([]interface{}, len(fields))}
+	for i, f := range fields {
+		val, err := columnValue(a.Field(i), row)
+		if err != nil {
+			return structValue{}, err
+		}
+		s.names[i], s.values[i] = f.Name, val
+	}
+	return s, nil
+}
+
+// structType is the column type for structs, which have the fields of the
+// first of them, each of a type inferred from its values in all of them.
+func structType(vals []interface{}) arrow.DataType {
+	var names []string
+	for _, v := range vals {
+		if s, ok := v.(structValue); ok {
+			names = s.names
+			break
+		}
+	}
+	fields := make([]arrow.Field, len(names))
+	for i, name := range names {
+		var field []interface{}
+		for _, v := range vals {
+			if s, ok := v.(structValue); ok && i < len(s.values) {
+				field = append(field, s.values[i])
+			}
+		}
+		fields[i] = arrow.Field{Name: name, Type: inferType(field), Nullable: true}
+	}
+	return arrow.StructOf(fields...)
+}
+
+// buildStruct builds a Struct array of type dt from evaluated structs, which
+// must have its fields.
+func buildStruct(pool memory.Allocator, dt *arrow.StructType, vals []interface{}) (array.Interface, error) {
+	fields := dt.Fields()
+	columns := make([][]interface{}, len(fields))
+	for i := range columns {
+		columns[i] = make([]interface{}, len(vals))
+	}
+	valid := make([]byte, bitutil.BytesForBits(int64(len(vals))))
+	nulls := 0
+	for row, v := range vals {
+		switch s := v.(type) {
+		case nil:
+			nulls++
+		case structValue:
+			if len(s.names) != len(fields) {
+				return nil, fmt.Errorf("cannot store %v in a %v column", s, dt)
+			}
+			bitutil.SetBit(valid, row)
+			for i := range fields {
+				columns[i][row] = s.values[i]
+			}
+		default:
+			return nil, fmt.Errorf("cannot store %T in a %v column", v, dt)
+		}
+	}
+
+	children := make([]*array.Data, len(fields))
+	for i, f := range fields {
+		child, err := buildArray(pool, f.Type, columns[i])
+		if err != nil {
+			return nil, err
+		}
+		defer child.Release()
+		children[i] = child.Data()
+	}
+	data := array.NewData(dt, len(vals), []*memory.Buffer{memory.NewBufferBytes(valid)}, children, nulls, 0)
+	defer data.Release()
+	return array.NewStructData(data), nil
+}
+
+// fieldValue reads the field of a struct. A NULL struct has NULL fields.
+func fieldValue(val interface{}, e *queryparser.FieldExpr) (interface{}, error) {
+	switch s := val.(type) {
+	case nil:
+		return nil, nil
+	case structValue:
+		if v, ok := s.field(e.Field, e.Quoted); ok {
+			return v, nil
+		}
+		return nil, queryparser.ErrorAt(e.Pos, "struct has no field %s", e.Field)
+	}
+	return nil, queryparser.ErrorAt(e.Pos, "field access expects a struct, got %T", val)
+}
+
+// indexValue reads the element of a list at index, counted from 1. An index
+// outside the list, like a NULL list or index, reads NULL.
+func indexValue(val, index interface{}, e *queryparser.IndexExpr) (interface{}, error) {
+	if val == nil || index == nil {
+		return nil, nil
+	}
+	l, ok := val.(list)
+	if !ok {
+		return nil, queryparser.ErrorAt(e.Pos, "list index expects a list, got %T", val)
+	}
+	i, ok := index.(int64)
+	if !ok {
+		return nil, queryparser.ErrorAt(e.Pos, "list index must be an integer, got %T", index)
+	}
+	if i < 1 || i > int64(len(l)) {
+		return nil, nil
+	}
+	return l[i-1], nil
+}
+
+// structFieldRef returns the field access a column reference stands for when
+// its qualifier names a struct column of schema rather than a table, as
+// payload.price does, or nil when it is an ordinary column reference.
+// Qualified columns take precedence over struct fields.
+func structFieldRef(schema *arrow.Schema, expr queryparser.Expression) *queryparser.FieldExpr {
+	ref, ok := expr.(*queryparser.ColumnRef)
+	if !ok || ref.Table == "" {
+		return nil
+	}
+	if col, err := findField(schema, ref); err != nil || col != -1 {
+		return nil
+	}
+	column := &queryparser.ColumnRef{Name: ref.Table, Pos: ref.Pos}
+	col, err := findField(schema, column)
+	if err != nil || col == -1 || schema.Field(col).Type.ID() != arrow.STRUCT {
+		return nil
+	}
+	return &queryparser.FieldExpr{Expr: column, Field: ref.Name, Quoted: ref.Quoted, Pos: ref.Pos}
+}
@@ -0,0 +1,344 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/apache/arrow/go/arrow/array"
+
+	"github.com/kris-gaudel/tinylake/internal/planner"
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// semiJoinFilter is an IN or EXISTS subquery predicate. The subquery runs once
+// and its keys are hashed, so each outer row is a single probe (a semi join,
+// or an anti join when negated) instead of a re-execution of the subquery.
+type semiJoinFilter struct {
+	in         queryparser.Expression   // left side of IN, nil for EXISTS
+	correlated []queryparser.Expression // outer sides of correlated equalities
+	keys       map[string]struct{}
+	nullGroups map[string]struct{} // correlation keys whose IN values include NULL
+	nonEmpty   bool                // the subquery produced at least one row
+	anti       bool
+}
+
+func (f *semiJoinFilter) evaluate(table array.Record, row int) (interface{}, error) {
+	corr := make([]interface{}, len(f.correlated))
+	for i, expr := range f.correlated {
+		val, err := evaluateExpression(expr, table, row)
+		if err != nil {
+			return nil, err
+		}
+		corr[i] = val
+	}
+
+	probe := corr
+	if f.in != nil {
+		val, err := evaluateExpression(f.in, table, row)
+		if err != nil {
+			return nil, err
+		}
+		probe = append([]interface{}{val}, corr...)
+	} else if len(corr) == 0 {
+		return f.nonEmpty != f.anti, nil
+	}
+
+	key, ok := encodeKey(probe)
+	if !ok {
+		// A NULL probe never matches: NOT EXISTS passes, while [NOT] IN is unknown.
+		return f.in == nil && f.anti, nil
+	}
+
+	_, found := f.keys[key]
+	if !f.anti {
+		return found, nil
+	}
+	if found {
+		return false, nil
+	}
+	if f.in != nil {
+		// x NOT IN (..., NULL) is unknown rather than true
+		corrKey, _ := encodeKey(corr)
+		if _, hasNull := f.nullGroups[corrKey]; hasNull {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// constantValue is a value computed once during planning, such as the result
+// of a scalar subquery, and broadcast to every row.
+type constantValue struct {
+	value interface{}
+}
+
+// planSubqueries replaces the subqueries in an expression evaluated against
+// outer: IN and EXISTS become semi join filters, scalar subqueries become
+// constants, long IN lists of constants become hash sets and constant LIKE
+// patterns are compiled.
+func planSubqueries(expr queryparser.Expression, outer array.Record, tables map[string]array.Record, ec *execContext) (queryparser.Expression, error) {
+	switch e := expr.(type) {
+	case *queryparser.BinaryExpr:
+		left, err := planSubqueries(e.Left, outer, tables, ec)
+		if err != nil {
+			return nil, err
+		}
+		right, err := planSubqueries(e.Right, outer, tables, ec)
+		if err != nil {
+			return nil, err
+		}
+		return &queryparser.BinaryExpr{Left: left, Op: e.Op, Right: right}, nil
+	case *queryparser.UnaryExpr:
+		operand, err := planSubqueries(e.Expr, outer, tables, ec)
+		if err != nil {
+			return nil, err
+		}
+		return &queryparser.UnaryExpr{Op: e.Op, Expr: operand}, nil
+	case *queryparser.CastExpr:
+		operand, err := planSubqueries(e.Expr, outer, tables, ec)
+		if err != nil {
+			return nil, err
+		}
+		return &queryparser.CastExpr{Expr: operand, Type: e.Type}, nil
+	case *queryparser.IsNullExpr:
+		operand, err := planSubqueries(e.Expr, outer, tables, ec)
+		if err != nil {
+			return nil, err
+		}
+		return &queryparser.IsNullExpr{Expr: operand, Not: e.Not}, nil
+	case *queryparser.FieldExpr:
+		operand, err := planSubqueries(e.Expr, outer, tables, ec)
+		if err != nil {
+			return nil, err
+		}
+		return &queryparser.FieldExpr{Expr: operand, Field: e.Field, Quoted: e.Quoted, Pos: e.Pos}, nil
+	case *queryparser.IndexExpr:
+		operand, err := planSubqueries(e.Expr, outer, tables, ec)
+		if err != nil {
+			return nil, err
+		}
+		index, err := planSubqueries(e.Index, outer, tables, ec)
+		if err != nil {
+			return nil, err
+		}
+		return &queryparser.IndexExpr{Expr: operand, Index: index, Pos: e.Pos}, nil
+	case *queryparser.FuncCall:
+		if isNowCall(e) {
+			return timestampLiteral(ec.now), nil
+		}
+		args := make([]queryparser.Expression, len(e.Args))
+		for i, arg := range e.Args {
+			planned, err := planSubqueries(arg, outer, tables, ec)
+			if err != nil {
+				return nil, err
+			}
+			args[i] = planned
+		}
+		return &queryparser.FuncCall{Name: e.Name, Args: args, Distinct: e.Distinct, Pos: e.Pos}, nil
+	case *queryparser.SubqueryExpr:
+		return evalScalarSubquery(e.Subquery, tables, ec)
+	case *queryparser.InExpr:
+		if e.Subquery != nil {
+			return buildSemiJoin(e.Subquery, e.Expr, e.Not, outer, tables, ec)
+		}
+		needle, err := planSubqueries(e.Expr, outer, tables, ec)
+		if err != nil {
+			return nil, err
+		}
+		values := make([]queryparser.Expression, len(e.Values))
+		for i, v := range e.Values {
+			if values[i], err = planSubqueries(v, outer, tables, ec); err != nil {
+				return nil, err
+			}
+		}
+		planned := &queryparser.InExpr{Expr: needle, Values: values, Not: e.Not}
+		if set, ok, err := planInSet(planned); ok || err != nil {
+			return set, err
+		}
+		return planned, nil
+	case *queryparser.LikeExpr:
+		operand, err := planSubqueries(e.Expr, outer, tables, ec)
+		if err != nil {
+			return nil, err
+		}
+		pattern, err := planSubqueries(e.Pattern, outer, tables, ec)
+		if err != nil {
+			return nil, err
+		}
+		return planLike(operand, pattern, e.Not)
+	case *queryparser.ExistsExpr:
+		return buildSemiJoin(e.Subquery, nil, e.Not, outer, tables, ec)
+	default:
+		return expr, nil
+	}
+}
+
+// evalScalarSubquery runs an uncorrelated subquery once. It must produce one
+// column and at most one row; no rows yields NULL.
+func evalScalarSubquery(sub *queryparser.Query, tables map[string]array.Record, ec *execContext) (*constantValue, error) {
+	result, err := planAndRun(sub, tables, ec)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Release()
+
+	if result.NumCols() != 1 {
+		return nil, fmt.Errorf("scalar subquery must return exactly one column, got %d", result.NumCols())
+	}
+	switch result.NumRows() {
+	case 0:
+		return &constantValue{}, nil
+	case 1:
+		val, err := columnValue(result.Column(0), 0)
+		if err != nil {
+			return nil, err
+		}
+		return &constantValue{value: val}, nil
+	default:
+		return nil, fmt.Errorf("scalar subquery returned %d rows, expected at most one", result.NumRows())
+	}
+}
+
+// buildSemiJoin runs a subquery once and hashes its rows. Equalities in the
+// subquery's WHERE that compare an inner expression to an outer one are pulled
+// out as correlation keys; the remaining conditions filter the inner rows.
+func buildSemiJoin(sub *queryparser.Query, in queryparser.Expression, anti bool, outer array.Record, tables map[string]array.Record, ec *execContext) (*semiJoinFilter, error) {
+	sub = planner.DesugarQuery(sub)
+	inner, err := buildFromClause(sub, tables, ec)
+	if err != nil {
+		return nil, err
+	}
+	defer inner.Release()
+
+	var innerKeys, outerKeys, kept []queryparser.Expression
+	if sub.Where != nil {
+		for _, cond := range planner.SplitConjuncts(sub.Where) {
+			side, err := correlationSide(cond, inner, outer)
+			if err != nil {
+				return nil, err
+			}
+			if side == sideNone || side == sideLeft {
+				kept = append(kept, cond)
+				continue
+			}
+			bin, ok := cond.(*queryparser.BinaryExpr)
+			if !ok || bin.Op != "=" {
+				return nil, fmt.Errorf("unsupported correlated subquery condition: only equalities may reference the outer query")
+			}
+			l, err := correlationSide(bin.Left, inner, outer)
+			if err != nil {
+				return nil, err
+			}
+			r, err := correlationSide(bin.Right, inner, outer)
+			if err != nil {
+				return nil, err
+			}
+			switch {
+			case l == sideLeft && r == sideRight:
+				innerKeys = append(innerKeys, bin.Left)
+				outerKeys = append(outerKeys, bin.Right)
+			case l == sideRight && r == sideLeft:
+				innerKeys = append(innerKeys, bin.Right)
+				outerKeys = append(outerKeys, bin.Left)
+			default:
+				return nil, fmt.Errorf("unsupported correlated subquery condition: each side of the equality must reference one query")
+			}
+		}
+	}
+	if len(innerKeys) > 0 && (len(sub.GroupBy) > 0 || sub.Having != nil) {
+		return nil, fmt.Errorf("correlated subqueries with GROUP BY are not supported")
+	}
+
+	innerQ := *sub
+	innerQ.Where = planner.JoinConjuncts(kept)
+	innerQ.OrderBy = nil
+	expanded, err := expandStars(sub.Projections, inner.Schema())
+	if err != nil {
+		return nil, err
+	}
+	projections, _ := splitAliases(expanded)
+	if in != nil {
+		if len(projections) != 1 {
+			return nil, fmt.Errorf("IN subquery must return exactly one column, got %d", len(projections))
+		}
+		innerQ.Projections = append(projections, innerKeys...)
+	} else if len(innerKeys) > 0 {
+		innerQ.Projections = innerKeys
+	} else {
+		innerQ.Projections = projections
+	}
+	if innerQ.Where != nil {
+		innerQ.Where, err = planSubqueries(innerQ.Where, inner, tables, ec)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := executeSelect(&innerQ, inner, nil, ec)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Release()
+
+	f := &semiJoinFilter{
+		in:         in,
+		correlated: outerKeys,
+		keys:       map[string]struct{}{},
+		nullGroups: map[string]struct{}{},
+		nonEmpty:   result.NumRows() > 0,
+		anti:       anti,
+	}
+	if in == nil && len(outerKeys) == 0 {
+		return f, nil
+	}
+
+	vals := make([]interface{}, result.NumCols())
+	for row := 0; row < int(result.NumRows()); row++ {
+		for col := range vals {
+			vals[col], err = columnValue(result.Column(col), row)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if key, ok := encodeKey(vals); ok {
+			f.keys[key] = struct{}{}
+		} else if in != nil && vals[0] == nil {
+			if corrKey, ok := encodeKey(vals[1:]); ok {
+				f.nullGroups[corrKey] = struct{}{}
+			}
+		}
+	}
+	return f, nil
+}
+
+// correlationSide reports whether expr references the subquery's own tables
+// (sideLeft), the outer query (sideRight), both, or neither. Names resolve
+// against the inner tables first, as SQL scoping requires.
+func correlationSide(expr queryparser.Expression, inner, outer array.Record) (int, error) {
+	switch e := expr.(type) {
+	case *queryparser.ColumnRef:
+		if _, err := resolveColumn(inner, e); err == nil {
+			return sideLeft, nil
+		}
+		if _, err := resolveColumn(outer, e); err == nil {
+			return sideRight, nil
+		}
+		if structFieldRef(inner.Schema(), e) != nil {
+			return sideLeft, nil
+		}
+		if structFieldRef(outer.Schema(), e) != nil {
+			return sideRight, nil
+		}
+		_, err := resolveColumn(inner, e)
+		return sideNone, err
+	default:
+		side := sideNone
+		for _, child := range queryparser.Children(expr) {
+			s, err := correlationSide(child, inner, outer)
+			if err != nil {
+				return sideNone, err
+			}
+			side = mergeSides(side, s)
+		}
+		return side, nil
+	}
+}
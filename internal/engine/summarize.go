@@ -0,0 +1,100 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+)
+
+// summaryFields are the columns of SUMMARIZE's result, which has a row for
+// each column of the table summarized.
+var summaryFields = []arrow.Field{
+	{Name: "column_name", Type: arrow.BinaryTypes.String},
+	{Name: "column_type", Type: arrow.BinaryTypes.String},
+	{Name: "min", Type: arrow.BinaryTypes.String, Nullable: true},
+	{Name: "max", Type: arrow.BinaryTypes.String, Nullable: true},
+	{Name: "approx_unique", Type: arrow.PrimitiveTypes.Int64},
+	{Name: "avg", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
+	{Name: "q25", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
+	{Name: "q50", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
+	{Name: "q75", Type: arrow.PrimitiveTypes.Float64, Nullable: true},
+	{Name: "count", Type: arrow.PrimitiveTypes.Int64},
+	{Name: "null_count", Type: arrow.PrimitiveTypes.Int64},
+}
+
+// summarize profiles each column of a table for SUMMARIZE: its smallest and
+// largest values as text, an estimate of how many distinct values it has, and
+// for numbers their mean and quartiles, along with how many rows there are and
+// how many are NULL. Each column is read once.
+func (s *Session) summarize(ec *execContext, name string) (array.Record, error) {
+	table, err := s.readTable(ec, name)
+	if err != nil {
+		return nil, err
+	}
+	defer table.Release()
+
+	cols := make([][]interface{}, len(summaryFields))
+	for i, f := range table.Schema().Fields() {
+		if err := interrupted(ec.ctx); err != nil {
+			return nil, err
+		}
+		summary, err := summarizeColumn(table.Column(i))
+		if err != nil {
+			return nil, fmt.Errorf("SUMMARIZE %s: column %s: %w", name, f.Name, err)
+		}
+		summary = append([]interface{}{f.Name, fmt.Sprint(f.Type)}, summary...)
+		for j, val := range summary {
+			cols[j] = append(cols[j], val)
+		}
+	}
+	return buildRecord(ec.pool, summaryFields, cols)
+}
+
+// summarizeColumn gives the values of summaryFields after the column's name
+// and type.
+func summarizeColumn(arr array.Interface) ([]interface{}, error) {
+	var lo, hi interface{}
+	numbers := aggregateState{ordered: true}
+	for row := 0; row < arr.Len(); row++ {
+		val, err := columnValue(arr, row)
+		if err != nil {
+			return nil, err
+		}
+		if val == nil {
+			continue
+		}
+		if lo == nil || compareValues(val, lo, false) < 0 {
+			lo = val
+		}
+		if hi == nil || compareValues(val, hi, false) > 0 {
+			hi = val
+		}
+		if isNumber(val) {
+			numbers.addValue(val)
+		}
+	}
+
+	summary := make([]interface{}, len(summaryFields)-2)
+	for i, bound := range []interface{}{lo, hi} {
+		if bound == nil {
+			continue
+		}
+		text, err := castValue(bound, arrow.BinaryTypes.String)
+		if err != nil {
+			return nil, err
+		}
+		summary[i] = text
+	}
+	summary[2] = estimateDistinct(arr)
+	if numbers.count > 0 {
+		summary[3] = numbers.sum / float64(numbers.count)
+		for i, fraction := range []float64{0.25, 0.5, 0.75} {
+			numbers.fraction = fraction
+			summary[4+i] = numbers.percentile()
+		}
+	}
+	summary[7] = int64(arr.Len())
+	summary[8] = int64(arr.NullN())
+	return summary, nil
+}
@@ -0,0 +1,428 @@
+package engine
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow/go/arrow"
+
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// date is a calendar date without a time of day, stored like Arrow's Date32 as
+// days since the Unix epoch. Timestamps are evaluated as time.Time in UTC.
+type date int32
+
+// interval is a span of calendar months, days and clock time, kept apart
+// because months and days vary in length.
+type interval struct {
+	months int
+	days   int
+	clock  time.Duration
+}
+
+const dateLayout = "2006-01-02"
+
+var timestampLayouts = []string{
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	time.RFC3339Nano,
+	"2006-01-02 15:04",
+	dateLayout,
+}
+
+func dateOf(t time.Time) date {
+	t = t.UTC()
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	return date(midnight.Unix() / 86400)
+}
+
+func (d date) time() time.Time {
+	return time.Unix(int64(d)*86400, 0).UTC()
+}
+
+func (d date) String() string {
+	return d.time().Format(dateLayout)
+}
+
+func (iv interval) String() string {
+	var parts []string
+	if iv.months != 0 {
+		parts = append(parts, fmt.Sprintf("%d months", iv.months))
+	}
+	if iv.days != 0 {
+		parts = append(parts, fmt.Sprintf("%d days", iv.days))
+	}
+	if iv.clock != 0 || len(parts) == 0 {
+		parts = append(parts, iv.clock.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+func parseDate(s string) (date, error) {
+	t, err := time.Parse(dateLayout, strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid date %q", s)
+	}
+	return dateOf(t), nil
+}
+
+func parseTimestamp(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, layout := range timestampLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid timestamp %q", s)
+}
+
+// parseInterval parses quantity/unit pairs such as '7 days' or
+// '1 year 2 months 3 hours'.
+func parseInterval(s string) (interval, error) {
+	fields := strings.Fields(strings.ToLower(s))
+	if len(fields) == 0 || len(fields)%2 != 0 {
+		return interval{}, fmt.Errorf("invalid interval %q", s)
+	}
+
+	var iv interval
+	for i := 0; i < len(fields); i += 2 {
+		n, err := strconv.Atoi(fields[i])
+		if err != nil {
+			return interval{}, fmt.Errorf("invalid interval %q", s)
+		}
+		switch strings.TrimSuffix(fields[i+1], "s") {
+		case "year":
+			iv.months += 12 * n
+		case "month", "mon":
+			iv.months += n
+		case "week":
+			iv.days += 7 * n
+		case "day":
+			iv.days += n
+		case "hour":
+			iv.clock += time.Duration(n) * time.Hour
+		case "minute", "min":
+			iv.clock += time.Duration(n) * time.Minute
+		case "second", "sec":
+			iv.clock += time.Duration(n) * time.Second
+		default:
+			return interval{}, fmt.Errorf("invalid interval unit %q", fields[i+1])
+		}
+	}
+	return iv, nil
+}
+
+// addInterval shifts t by sign times iv. Adding months keeps the day of the
+// month, or moves it to the last day of a shorter month, so a month after
+// January 31 is February 28 or 29.
+func addInterval(t time.Time, iv interval, sign int) time.Time {
+	if months := sign * iv.months; months != 0 {
+		y, m, d := t.Date()
+		first := time.Date(y, m+time.Month(months), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+		last := first.AddDate(0, 1, -1).Day()
+		t = first.AddDate(0, 0, min(d, last)-1)
+	}
+	return t.AddDate(0, 0, sign*iv.days).Add(time.Duration(sign) * iv.clock)
+}
+
+// evalTemporalOp applies + or - when an operand is a date, timestamp or
+// interval. ok is false when neither operand is temporal.
+func evalTemporalOp(op string, left, right interface{}) (result interface{}, ok bool, err error) {
+	sign := 1
+	if op == "-" {
+		sign = -1
+	}
+
+	switch l := left.(type) {
+	case date:
+		switch r := right.(type) {
+		case interval:
+			t := addInterval(l.time(), r, sign)
+			if r.clock != 0 {
+				return t, true, nil // a time of day makes the result a timestamp
+			}
+			return dateOf(t), true, nil
+		case int64:
+			return l + date(sign*int(r)), true, nil
+		case date:
+			if op == "-" {
+				return int64(l - r), true, nil // days between
+			}
+		}
+	case time.Time:
+		switch r := right.(type) {
+		case interval:
+			return addInterval(l, r, sign), true, nil
+		case time.Time:
+			if op == "-" {
+				return interval{clock: l.Sub(r)}, true, nil
+			}
+		}
+	case interval:
+		switch r := right.(type) {
+		case date, time.Time:
+			if op == "+" {
+				return evalTemporalOp(op, r, l)
+			}
+		case interval:
+			return interval{
+				months: l.months + sign*r.months,
+				days:   l.days + sign*r.days,
+				clock:  l.clock + time.Duration(sign)*r.clock,
+			}, true, nil
+		}
+	default:
+		if !isTemporal(right) {
+			return nil, false, nil
+		}
+	}
+	return nil, true, fmt.Errorf("unsupported operation: %T %s %T", left, op, right)
+}
+
+func isTemporal(v interface{}) bool {
+	switch v.(type) {
+	case date, time.Time, interval:
+		return true
+	default:
+		return false
+	}
+}
+
+// compareTemporal orders a date or timestamp against another date, timestamp
+// or a string in date or timestamp form. ok is false when the operands are not
+// comparable this way.
+func compareTemporal(left, right interface{}) (c int, ok bool) {
+	lt, lok := temporalTime(left, right)
+	rt, rok := temporalTime(right, left)
+	if !lok || !rok {
+		return 0, false
+	}
+	return lt.Compare(rt), true
+}
+
+// temporalTime converts v to a time for comparison against other. Strings are
+// parsed only when compared with a date or timestamp.
+func temporalTime(v, other interface{}) (time.Time, bool) {
+	switch x := v.(type) {
+	case date:
+		return x.time(), true
+	case time.Time:
+		return x, true
+	case string:
+		switch other.(type) {
+		case date:
+			d, err := parseDate(x)
+			return d.time(), err == nil
+		case time.Time:
+			t, err := parseTimestamp(x)
+			return t, err == nil
+		}
+	}
+	return time.Time{}, false
+}
+
+// timestampValue reads a raw Arrow timestamp in the given unit as a UTC time.
+func timestampValue(v arrow.Timestamp, unit arrow.TimeUnit) time.Time {
+	switch unit {
+	case arrow.Second:
+		return time.Unix(int64(v), 0).UTC()
+	case arrow.Millisecond:
+		return time.UnixMilli(int64(v)).UTC()
+	case arrow.Microsecond:
+		return time.UnixMicro(int64(v)).UTC()
+	default:
+		return time.Unix(0, int64(v)).UTC()
+	}
+}
+
+// timestampOf converts t to a raw Arrow timestamp in the given unit.
+func timestampOf(t time.Time, unit arrow.TimeUnit) arrow.Timestamp {
+	switch unit {
+	case arrow.Second:
+		return arrow.Timestamp(t.Unix())
+	case arrow.Millisecond:
+		return arrow.Timestamp(t.UnixMilli())
+	case arrow.Microsecond:
+		return arrow.Timestamp(t.UnixMicro())
+	default:
+		return arrow.Timestamp(t.UnixNano())
+	}
+}
+
+// fixNow replaces the calls to NOW() in q with now, the time the statement
+// started, so that every row and every query the statement runs see the same
+// time.
+func fixNow(q *queryparser.Query, now time.Time) *queryparser.Query {
+	if !callsNow(q) {
+		return q
+	}
+	return queryparser.TransformQuery(q, func(e queryparser.Expression) queryparser.Expression {
+		if isNowCall(e) {
+			return timestampLiteral(now)
+		}
+		return e
+	})
+}
+
+// callsNow reports whether q, or a query nested in it, calls NOW().
+func callsNow(q *queryparser.Query) bool {
+	calls := false
+	queryparser.WalkQuery(q, func(expr queryparser.Expression) {
+		queryparser.Inspect(expr, func(e queryparser.Expression) bool {
+			calls = calls || isNowCall(e)
+			return !calls
+		})
+	})
+	return calls
+}
+
+func isNowCall(expr queryparser.Expression) bool {
+	fc, ok := expr.(*queryparser.FuncCall)
+	return ok && strings.EqualFold(fc.Name, "NOW") && len(fc.Args) == 0
+}
+
+// timestampLiteral is t as a timestamp literal, to the microsecond that
+// timestamp columns keep, so it equals itself read back from one.
+func timestampLiteral(t time.Time) *queryparser.Literal {
+	return &queryparser.Literal{Value: t.UTC().Truncate(time.Microsecond).Format(time.RFC3339Nano), Kind: queryparser.LiteralTimestamp}
+}
+
+// evalNow implements NOW() where it was not replaced by the time the
+// statement started.
+func evalNow(args []interface{}) (interface{}, error) {
+	return time.Now().UTC().Truncate(time.Microsecond), nil
+}
+
+func nowType(args []arrow.DataType) (arrow.DataType, error) {
+	return arrow.FixedWidthTypes.Timestamp_us, nil
+}
+
+// datePartType checks the arguments of DATE_TRUNC and DATE_PART: the name of
+// a part of a date and a date, a timestamp or a string holding either.
+func datePartType(args []arrow.DataType) (arrow.DataType, error) {
+	if !isType(args[0], arrow.BinaryTypes.String) {
+		return nil, fmt.Errorf("part must be a string, got %s", typeName(args[0]))
+	}
+	if !isTemporalType(args[1]) && !isType(args[1], arrow.BinaryTypes.String) {
+		return nil, fmt.Errorf("expects a date or timestamp, got %s", typeName(args[1]))
+	}
+	return arrow.PrimitiveTypes.Int64, nil
+}
+
+// dateTruncType is the type of DATE_TRUNC: that of what it truncates, which
+// for a string depends on whether it holds a time of day.
+func dateTruncType(args []arrow.DataType) (arrow.DataType, error) {
+	if _, err := datePartType(args); err != nil {
+		return nil, err
+	}
+	if args[1].ID() == arrow.DATE32 {
+		return args[1], nil
+	}
+	if args[1].ID() == arrow.TIMESTAMP {
+		return arrow.FixedWidthTypes.Timestamp_us, nil
+	}
+	return unknownType, nil
+}
+
+// datePartArgs reads the arguments of DATE_TRUNC and DATE_PART: the part,
+// lower-cased and singular, and the time, which is a date unless it has a time
+// of day. It returns a zero time when either is NULL.
+func datePartArgs(name string, args []interface{}) (part string, t time.Time, isDate bool, err error) {
+	if args[0] == nil || args[1] == nil {
+		return "", time.Time{}, false, nil
+	}
+	p, ok := args[0].(string)
+	if !ok {
+		return "", time.Time{}, false, fmt.Errorf("%s part must be a string, got %T", name, args[0])
+	}
+	part = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(p)), "s")
+	switch x := args[1].(type) {
+	case date:
+		return part, x.time(), true, nil
+	case time.Time:
+		return part, x, false, nil
+	case string:
+		if d, err := parseDate(x); err == nil {
+			return part, d.time(), true, nil
+		}
+		t, err := parseTimestamp(x)
+		return part, t, false, err
+	default:
+		return "", time.Time{}, false, fmt.Errorf("%s expects a date or timestamp, got %T", name, args[1])
+	}
+}
+
+// evalDateTrunc implements DATE_TRUNC(part, t), which rounds t down to the
+// start of its year, quarter, month, week (starting on Monday), day, hour,
+// minute or second. Dates stay dates.
+func evalDateTrunc(args []interface{}) (interface{}, error) {
+	part, t, isDate, err := datePartArgs("DATE_TRUNC", args)
+	if err != nil || t.IsZero() {
+		return nil, err
+	}
+	y, m, d := t.Date()
+	switch part {
+	case "year":
+		t = time.Date(y, 1, 1, 0, 0, 0, 0, time.UTC)
+	case "quarter":
+		t = time.Date(y, (m-1)/3*3+1, 1, 0, 0, 0, 0, time.UTC)
+	case "month":
+		t = time.Date(y, m, 1, 0, 0, 0, 0, time.UTC)
+	case "week":
+		t = time.Date(y, m, d-(int(t.Weekday())+6)%7, 0, 0, 0, 0, time.UTC)
+	case "day":
+		t = time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+	case "hour":
+		t = t.Truncate(time.Hour)
+	case "minute":
+		t = t.Truncate(time.Minute)
+	case "second":
+		t = t.Truncate(time.Second)
+	default:
+		return nil, fmt.Errorf("DATE_TRUNC: unknown part %q", args[0])
+	}
+	if isDate {
+		return dateOf(t), nil
+	}
+	return t, nil
+}
+
+// evalDatePart implements DATE_PART(part, t), and so EXTRACT(part FROM t): the
+// year, quarter, month, ISO week, day, day of the week (0 for Sunday), day of
+// the year, hour, minute, whole second or seconds since the Unix epoch.
+func evalDatePart(args []interface{}) (interface{}, error) {
+	part, t, _, err := datePartArgs("DATE_PART", args)
+	if err != nil || t.IsZero() {
+		return nil, err
+	}
+	switch part {
+	case "year":
+		return int64(t.Year()), nil
+	case "quarter":
+		return int64(t.Month()-1)/3 + 1, nil
+	case "month":
+		return int64(t.Month()), nil
+	case "week":
+		_, week := t.ISOWeek()
+		return int64(week), nil
+	case "day":
+		return int64(t.Day()), nil
+	case "dow", "dayofweek":
+		return int64(t.Weekday()), nil
+	case "doy", "dayofyear":
+		return int64(t.YearDay()), nil
+	case "hour":
+		return int64(t.Hour()), nil
+	case "minute":
+		return int64(t.Minute()), nil
+	case "second":
+		return int64(t.Second()), nil
+	case "epoch":
+		return t.Unix(), nil
+	default:
+		return nil, fmt.Errorf("DATE_PART: unknown part %q", args[0])
+	}
+}
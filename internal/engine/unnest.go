@@ -0,0 +1,204 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/apache/arrow/go/arrow"
+	"github.com/apache/arrow/go/arrow/array"
+
+	"github.com/kris-gaudel/tinylake/internal/planner"
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// unnestOp expands lists into rows. In FROM it reads its lists once; joined
+// onto its input it reads them for each row of the input, which it repeats
+// for each of their elements.
+type unnestOp struct {
+	input   operator // nil for UNNEST in FROM
+	clause  *queryparser.UnnestClause
+	alias   string
+	columns []string
+	on      queryparser.Expression
+	outer   bool
+}
+
+func (u *unnestOp) execute(tables map[string]array.Record, ec *execContext) (array.Record, error) {
+	var rec array.Record
+	if u.input == nil {
+		// The lists are constants, read against a row with no columns
+		rec = array.NewRecord(arrow.NewSchema(nil, nil), nil, 1)
+	} else {
+		var err error
+		if rec, err = u.input.execute(tables, ec); err != nil {
+			return nil, err
+		}
+	}
+	defer rec.Release()
+	return u.join(rec, tables, ec)
+}
+
+// join returns the rows of rec joined with the elements of the lists read
+// from each of them, in the order of the rows and then of the elements. A row
+// whose lists are NULL or empty has no elements, and is kept, padded with
+// NULLs, only by an outer join, as is one whose joined rows the ON condition
+// drops.
+func (u *unnestOp) join(rec array.Record, tables map[string]array.Record, ec *execContext) (array.Record, error) {
+	args := make([]queryparser.Expression, len(u.clause.Args))
+	for i, arg := range u.clause.Args {
+		planned, err := planSubqueries(planner.DesugarExpr(arg), rec, tables, ec)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = planned
+	}
+
+	var rows []int // the row of rec each element is read from
+	elems := make([][]interface{}, len(args))
+	var ordinals []interface{}
+	lists := make([]list, len(args))
+	for row := 0; row < int(rec.NumRows()); row++ {
+		n := 0
+		for i, arg := range args {
+			val, err := evaluateExpression(arg, rec, row)
+			if err != nil {
+				return nil, err
+			}
+			switch l := val.(type) {
+			case nil:
+				lists[i] = nil
+			case list:
+				lists[i] = l
+			default:
+				return nil, fmt.Errorf("UNNEST expects a list, got %T", val)
+			}
+			n = max(n, len(lists[i]))
+		}
+		for k := 0; k < n; k++ {
+			rows = append(rows, row)
+			for i, l := range lists {
+				var v interface{}
+				if k < len(l) {
+					v = l[k]
+				}
+				elems[i] = append(elems[i], v)
+			}
+			ordinals = append(ordinals, int64(k+1))
+		}
+	}
+
+	unnested, err := u.elements(elems, ordinals, ec)
+	if err != nil {
+		return nil, err
+	}
+	defer unnested.Release()
+
+	var kept []bool // nil for all of them
+	if u.on != nil {
+		all := make([]int, len(rows))
+		for i := range all {
+			all[i] = i
+		}
+		joined, err := combineRows(rec, unnested, rows, all, false, false, ec.pool)
+		if err != nil {
+			return nil, err
+		}
+		defer joined.Release()
+		cond, err := planSubqueries(planner.DesugarExpr(u.on), joined, tables, ec)
+		if err != nil {
+			return nil, err
+		}
+		kept = make([]bool, len(rows))
+		for i := range rows {
+			result, err := evaluateExpression(cond, joined, i)
+			if err != nil {
+				return nil, err
+			}
+			if kept[i], err = whereHolds(result); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var left, right []int
+	next := 0
+	for row := 0; row < int(rec.NumRows()); row++ {
+		matched := false
+		for ; next < len(rows) && rows[next] == row; next++ {
+			if kept == nil || kept[next] {
+				left = append(left, row)
+				right = append(right, next)
+				matched = true
+			}
+		}
+		if !matched && u.outer {
+			left = append(left, row)
+			right = append(right, -1)
+		}
+	}
+	return combineRows(rec, unnested, left, right, false, u.outer, ec.pool)
+}
+
+// elements builds the columns of the elements, and of their ordinals WITH
+// ORDINALITY, qualified by the alias.
+func (u *unnestOp) elements(elems [][]interface{}, ordinals []interface{}, ec *execContext) (array.Record, error) {
+	names := unnestNames(u.clause, u.alias, u.columns)
+	var fields []arrow.Field
+	var cols []array.Interface
+	defer func() {
+		for _, col := range cols {
+			col.Release()
+		}
+	}()
+	add := func(name string, dt arrow.DataType, vals []interface{}) error {
+		col, err := buildArray(ec.pool, dt, vals)
+		if err != nil {
+			return err
+		}
+		fields = append(fields, arrow.Field{Name: name, Type: dt, Nullable: true})
+		cols = append(cols, col)
+		return nil
+	}
+	for i, vals := range elems {
+		if err := add(names[i], inferType(vals), vals); err != nil {
+			return nil, err
+		}
+	}
+	if u.clause.Ordinality {
+		if err := add(names[len(elems)], arrow.PrimitiveTypes.Int64, ordinals); err != nil {
+			return nil, err
+		}
+	}
+	qualifier := unnestQualifier(u.alias)
+	rec := array.NewRecord(arrow.NewSchema(qualifyFields(fields, qualifier), nil), cols, int64(len(ordinals)))
+	return aliasColumns(rec, qualifier, u.columns)
+}
+
+// unnestNames returns the names of the columns of an UNNEST before any column
+// aliases apply: unnest for the elements of one list, unnest1, unnest2 and so
+// on for several, and ordinality for their ordinals. As in PostgreSQL, the
+// elements of one list take the name of an alias without column aliases.
+func unnestNames(u *queryparser.UnnestClause, alias string, columns []string) []string {
+	var names []string
+	switch {
+	case len(u.Args) == 1 && alias != "" && len(columns) == 0:
+		names = []string{alias}
+	case len(u.Args) == 1:
+		names = []string{"unnest"}
+	default:
+		for i := range u.Args {
+			names = append(names, fmt.Sprintf("unnest%d", i+1))
+		}
+	}
+	if u.Ordinality {
+		names = append(names, "ordinality")
+	}
+	return names
+}
+
+// unnestQualifier is the name that qualifies the columns of an UNNEST.
+func unnestQualifier(alias string) string {
+	if alias == "" {
+		return "unnest"
+	}
+	return alias
+}
@@ -0,0 +1,161 @@
+package engine
+
+import (
+	"fmt"
+
+	"github.com/apache/arrow/go/arrow/array"
+
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// upsert applies an INSERT with an ON CONFLICT clause.
+func (s *Session) upsert(ec *execContext, stmt *queryparser.InsertStmt) error {
+	// Subqueries in DO UPDATE read a snapshot taken before the insert
+	tables := s.snapshot(ec)
+	defer releaseTables(tables)
+
+	return s.tablesOf(stmt.TableName).Update(stmt.TableName, func(table array.Record) (array.Record, error) {
+		return upsertRows(table, stmt, tables, ec)
+	})
+}
+
+// upsertRows returns a new version of table with the statement's rows
+// inserted, except for those whose key conflicts with a row's already in the
+// table, which update that row instead or, for DO NOTHING, are dropped. The
+// keys of the table's rows are put in a hash table, where each row's key is
+// looked up and, once the row is inserted, added, so that rows of the
+// statement conflict with each other too. A key with a NULL in it conflicts
+// with none. DO UPDATE updates a row at most once, as the order of two
+// updates of a row would decide which of them is kept.
+func upsertRows(table array.Record, stmt *queryparser.InsertStmt, tables map[string]array.Record, ec *execContext) (array.Record, error) {
+	vals, err := insertValues(table, stmt)
+	if err != nil {
+		return nil, err
+	}
+	conflict := stmt.OnConflict
+	keyCols := make([]int, len(conflict.Columns))
+	for i, name := range conflict.Columns {
+		if keyCols[i], err = resolveColumn(table, &queryparser.ColumnRef{Name: name}); err != nil {
+			return nil, err
+		}
+	}
+
+	key := make([]interface{}, len(keyCols))
+	rowKey := func(value func(col int) (interface{}, error)) (string, bool, error) {
+		for i, col := range keyCols {
+			if key[i], err = value(col); err != nil {
+				return "", false, err
+			}
+		}
+		k, ok := encodeKey(key)
+		return k, ok, nil
+	}
+
+	// index maps each key to the row that has it: a row of the table, or
+	// one inserted, numbered from table.NumRows() on
+	numRows := int(table.NumRows())
+	index := map[string]int{}
+	for row := 0; row < numRows; row++ {
+		k, ok, err := rowKey(func(col int) (interface{}, error) { return columnValue(table.Column(col), row) })
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			index[k] = row
+		}
+	}
+
+	var inserted, targetRows, excludedRows []int
+	updated := make([]bool, numRows)
+	for r := range stmt.Rows {
+		k, ok, err := rowKey(func(col int) (interface{}, error) { return vals[col][r], nil })
+		if err != nil {
+			return nil, err
+		}
+		row, found := index[k]
+		switch {
+		case !ok || !found:
+			if ok {
+				index[k] = numRows + len(inserted)
+			}
+			inserted = append(inserted, r)
+		case len(conflict.Set) == 0:
+			// DO NOTHING
+		case row >= numRows || updated[row]:
+			return nil, fmt.Errorf("ON CONFLICT DO UPDATE would update a row of %s more than once", stmt.TableName)
+		default:
+			updated[row] = true
+			targetRows = append(targetRows, row)
+			excludedRows = append(excludedRows, r)
+		}
+	}
+
+	changes, err := conflictUpdates(table, stmt, vals, targetRows, excludedRows, tables, ec)
+	if err != nil {
+		return nil, err
+	}
+	result, err := applyMergeChanges(table, make([]bool, numRows), changes, ec)
+	if err != nil || len(inserted) == 0 {
+		return result, err
+	}
+	defer result.Release()
+
+	newVals := make([][]interface{}, len(vals))
+	for col := range vals {
+		newVals[col] = make([]interface{}, len(inserted))
+		for i, r := range inserted {
+			newVals[col][i] = vals[col][r]
+		}
+	}
+	return appendValues(result, newVals, len(inserted), ec.pool)
+}
+
+// conflictUpdates evaluates the DO UPDATE assignments for each row of table
+// in targetRows, paired with the statement's row in excludedRows whose key
+// conflicts with it, returning the new values by row and column as
+// applyMergeChanges takes them. The assignments read the row of the table by
+// the table's name and the statement's row, whose values vals holds, as
+// EXCLUDED.
+func conflictUpdates(table array.Record, stmt *queryparser.InsertStmt, vals [][]interface{}, targetRows, excludedRows []int, tables map[string]array.Record, ec *execContext) (map[int]map[int]interface{}, error) {
+	changes := map[int]map[int]interface{}{}
+	if len(targetRows) == 0 {
+		return changes, nil
+	}
+
+	fields := table.Schema().Fields()
+	excluded, err := buildRecord(ec.pool, qualifyFields(fields, "excluded"), vals)
+	if err != nil {
+		return nil, err
+	}
+	defer excluded.Release()
+	target := qualifyRecord(table, stmt.TableName)
+	defer target.Release()
+	joined, err := combineRows(target, excluded, targetRows, excludedRows, false, false, ec.pool)
+	if err != nil {
+		return nil, err
+	}
+	defer joined.Release()
+
+	clause := queryparser.MergeClause{Matched: true, Action: "UPDATE", Set: stmt.OnConflict.Set}
+	actions, err := planMergeActions([]queryparser.MergeClause{clause}, table, joined, tables, ec)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, row := range targetRows {
+		changes[row] = map[int]interface{}{}
+		for col, expr := range actions[0].set {
+			val, err := evaluateExpression(expr, joined, i)
+			if err != nil {
+				return nil, err
+			}
+			if changes[row][col], err = castValue(val, fields[col].Type); err != nil {
+				return nil, fmt.Errorf("column %s: %w", fields[col].Name, err)
+			}
+			if changes[row][col] == nil && !fields[col].Nullable {
+				return nil, fmt.Errorf("column %s does not allow NULL", fields[col].Name)
+			}
+		}
+	}
+	return changes, nil
+}
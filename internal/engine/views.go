@@ -0,0 +1,109 @@
+package engine
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/apache/arrow/go/arrow/array"
+
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// createView checks that the view runs against the current catalog, with the
+// new definition in place so that cycles through other views are caught,
+// before storing it.
+func (s *Session) createView(ec *execContext, stmt *queryparser.CreateViewStmt) error {
+	// Views outlive the session, so they may not read its temporary tables
+	for _, name := range tableNames(stmt.Query, nil) {
+		if s.temp.hasTable(name) {
+			return fmt.Errorf("view %s cannot read temporary table %s", stmt.ViewName, name)
+		}
+	}
+
+	tables := s.snapshot(ec)
+	defer releaseTables(tables)
+	if key, _, ok := findView(ec.views, stmt.ViewName); ok {
+		delete(ec.views, key)
+	}
+	ec.views[stmt.ViewName] = stmt.Query
+
+	result, _, err := expandView(stmt.ViewName, ec)
+	if err != nil {
+		return err
+	}
+	result.Release()
+	return s.catalog.CreateView(stmt.ViewName, stmt.Query, stmt.OrReplace)
+}
+
+// snapshot returns the catalog's tables for a statement to read, with the
+// session's temporary tables in place of those they hide, and makes them and
+// the catalog's views the scope views are expanded in. The tables and views
+// are those of one moment, and the records are retained, so writes that
+// commit while the statement runs neither show in it nor release what it
+// reads. The caller must release the tables.
+func (s *Session) snapshot(ec *execContext) map[string]array.Record {
+	tables, views, schema := s.catalog.snapshot()
+	temp, _, tempSchema := s.temp.snapshot()
+	for name, rec := range temp {
+		for key, hidden := range tables {
+			if strings.EqualFold(key, name) {
+				hidden.Release()
+				delete(tables, key)
+			}
+		}
+		tables[name] = rec
+	}
+	// Both versions only grow, so their sum changes whenever either does
+	ec.viewTables, ec.views, ec.catalog, ec.schema = tables, views, s.catalog, schema+tempSchema
+	return tables
+}
+
+// readTable returns the table registered under name, or the result of the view
+// called name. The caller must release the returned record.
+func (s *Session) readTable(ec *execContext, name string) (array.Record, error) {
+	rec, err := s.tablesOf(name).Table(name)
+	if err == nil {
+		return rec, nil
+	}
+	tables := s.snapshot(ec)
+	defer releaseTables(tables)
+	if rec, ok, verr := expandView(name, ec); ok {
+		return rec, verr
+	}
+	return nil, err
+}
+
+// expandView runs the query defining the view called name, reporting false
+// when there is no such view. A view's query is resolved against the catalog
+// alone, so the CTEs of the query referencing it do not leak into it.
+func expandView(name string, ec *execContext) (array.Record, bool, error) {
+	key, query, ok := findView(ec.views, name)
+	if !ok {
+		return nil, false, nil
+	}
+	for _, outer := range ec.expanding {
+		if outer == key {
+			return nil, true, fmt.Errorf("view %s references itself", key)
+		}
+	}
+	ec.expanding = append(ec.expanding, key)
+	defer func() { ec.expanding = ec.expanding[:len(ec.expanding)-1] }()
+
+	rec, err := planAndRun(query, ec.viewTables, ec)
+	if err != nil {
+		return nil, true, fmt.Errorf("view %s: %w", key, err)
+	}
+	return rec, true, nil
+}
+
+func findView(views map[string]*queryparser.Query, name string) (string, *queryparser.Query, bool) {
+	if q, ok := views[name]; ok {
+		return name, q, true
+	}
+	for key, q := range views {
+		if strings.EqualFold(key, name) {
+			return key, q, true
+		}
+	}
+	return "", nil, false
+}
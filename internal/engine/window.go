@@ -0,0 +1,491 @@
+package engine
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/apache/arrow/go/arrow/array"
+
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// windowColumn holds the computed values of a window function, indexed by
+// table row. It replaces the WindowExpr it was computed from once the window
+// operator has run, so the projection evaluates it like any other expression.
+type windowColumn struct {
+	values []interface{}
+}
+
+// planWindows computes every window function in q's projections and ORDER BY
+// over the rows that passed WHERE, returning a copy of q with each one replaced
+// by its computed values.
+func planWindows(q *queryparser.Query, table array.Record, rows []int, nullsFirst bool) (*queryparser.Query, error) {
+	var err error
+	replace := func(expr queryparser.Expression) queryparser.Expression {
+		w, ok := expr.(*queryparser.WindowExpr)
+		if !ok || err != nil {
+			return expr
+		}
+		var col *windowColumn
+		col, err = evaluateWindow(w, table, rows, nullsFirst)
+		if err != nil {
+			return expr
+		}
+		return col
+	}
+
+	out := *q
+	out.Projections = make([]queryparser.Expression, len(q.Projections))
+	for i, e := range q.Projections {
+		out.Projections[i] = queryparser.Transform(e, replace)
+	}
+	out.OrderBy = make([]queryparser.OrderByItem, len(q.OrderBy))
+	for i, item := range q.OrderBy {
+		item.Expr = queryparser.Transform(item.Expr, replace)
+		out.OrderBy[i] = item
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &out, nil
+}
+
+// hasWindow reports whether any of exprs contains a window function.
+func hasWindow(exprs ...queryparser.Expression) bool {
+	for _, e := range exprs {
+		if _, ok := e.(*queryparser.WindowExpr); ok {
+			return true
+		}
+		if hasWindow(queryparser.Children(e)...) {
+			return true
+		}
+	}
+	return false
+}
+
+func orderByExprs(items []queryparser.OrderByItem) []queryparser.Expression {
+	exprs := make([]queryparser.Expression, len(items))
+	for i, item := range items {
+		exprs[i] = item.Expr
+	}
+	return exprs
+}
+
+// evaluateWindow is the window operator: it splits rows into partitions, orders
+// each partition and computes w's function for every row. With an ORDER BY,
+// aggregates are running totals over the partition up to and including the
+// current row's peers; without one they cover the whole partition.
+func evaluateWindow(w *queryparser.WindowExpr, table array.Record, rows []int, nullsFirst bool) (*windowColumn, error) {
+	if hasWindow(w.Func.Args...) {
+		return nil, fmt.Errorf("window functions cannot be nested")
+	}
+
+	partitions, err := partitionRows(w.PartitionBy, table, rows)
+	if err != nil {
+		return nil, err
+	}
+
+	col := &windowColumn{values: make([]interface{}, table.NumRows())}
+	for _, part := range partitions {
+		if len(w.OrderBy) > 0 {
+			if part, err = sortRows(w.OrderBy, table, part, nullsFirst); err != nil {
+				return nil, err
+			}
+		}
+		peers, err := peerGroups(w.OrderBy, table, part)
+		if err != nil {
+			return nil, err
+		}
+		if err := computeWindow(w, table, part, peers, col.values); err != nil {
+			return nil, err
+		}
+	}
+	return col, nil
+}
+
+// partitionRows groups rows by the PARTITION BY keys, keeping partitions and
+// the rows within them in input order. NULL keys form a partition of their own.
+func partitionRows(keys []queryparser.Expression, table array.Record, rows []int) ([][]int, error) {
+	if len(keys) == 0 {
+		return [][]int{rows}, nil
+	}
+
+	index := map[string]int{}
+	var partitions [][]int
+	vals := make([]interface{}, len(keys))
+	for _, row := range rows {
+		for i, k := range keys {
+			val, err := evaluateExpression(k, table, row)
+			if err != nil {
+				return nil, err
+			}
+			vals[i] = val
+		}
+		key := distinctKey(vals)
+		p, ok := index[key]
+		if !ok {
+			p = len(partitions)
+			index[key] = p
+			partitions = append(partitions, nil)
+		}
+		partitions[p] = append(partitions[p], row)
+	}
+	return partitions, nil
+}
+
+// peerGroups returns, for each position in the ordered partition, the end
+// (exclusive) of the run of rows sharing its ORDER BY keys. Without an ORDER BY
+// every row is a peer of every other.
+func peerGroups(orderBy []queryparser.OrderByItem, table array.Record, part []int) ([]int, error) {
+	ends := make([]int, len(part))
+	if len(orderBy) == 0 {
+		for i := range ends {
+			ends[i] = len(part)
+		}
+		return ends, nil
+	}
+
+	keys := make([][]interface{}, len(part))
+	for i, row := range part {
+		keys[i] = make([]interface{}, len(orderBy))
+		for k, item := range orderBy {
+			val, err := evaluateExpression(item.Expr, table, row)
+			if err != nil {
+				return nil, err
+			}
+			keys[i][k] = val
+		}
+	}
+
+	for start := 0; start < len(part); {
+		end := start + 1
+		for end < len(part) && sameKeys(keys[start], keys[end]) {
+			end++
+		}
+		for i := start; i < end; i++ {
+			ends[i] = end
+		}
+		start = end
+	}
+	return ends, nil
+}
+
+func sameKeys(a, b []interface{}) bool {
+	for i := range a {
+		if compareValues(a[i], b[i], false) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// computeWindow writes w's value for each row of the ordered partition into out.
+func computeWindow(w *queryparser.WindowExpr, table array.Record, part []int, peers []int, out []interface{}) error {
+	fn := w.Func
+	name := strings.ToUpper(fn.Name)
+	if fn.Distinct {
+		return fmt.Errorf("DISTINCT is not supported in window functions")
+	}
+	switch name {
+	case "ROW_NUMBER", "RANK", "DENSE_RANK":
+		if len(fn.Args) != 0 {
+			return fmt.Errorf("%s takes no arguments", name)
+		}
+		var groupStart, dense int
+		for i, row := range part {
+			if i == 0 || peers[i-1] == i {
+				groupStart = i
+				dense++
+			}
+			switch name {
+			case "ROW_NUMBER":
+				out[row] = int64(i + 1)
+			case "RANK":
+				out[row] = int64(groupStart + 1)
+			default:
+				out[row] = int64(dense)
+			}
+		}
+		return nil
+	case "LAG", "LEAD":
+		return computeOffset(fn, table, part, out)
+	case "COUNT", "SUM", "AVG", "MIN", "MAX":
+		if len(fn.Args) != 1 {
+			return fmt.Errorf("%s expects one argument", name)
+		}
+		_, star := fn.Args[0].(*queryparser.StarExpr)
+		if star && name != "COUNT" {
+			return fmt.Errorf("%s(*) is not supported", name)
+		}
+		if w.Frame != nil {
+			lo, hi, err := frameRows(w.Frame, w.OrderBy, table, part, peers)
+			if err != nil {
+				return err
+			}
+			return computeFramed(name, fn.Args[0], star, lo, hi, table, part, out)
+		}
+
+		// Accumulate one peer group at a time so every peer sees the same
+		// frame, which gives the same results as the aggregate over the frame
+		arg := fn.Args[0]
+		if star {
+			arg = nil
+		}
+		var state aggregateState
+		for start := 0; start < len(part); start = peers[start] {
+			for _, row := range part[start:peers[start]] {
+				if err := state.addRow(arg, table, row, rowPosition{row: row}); err != nil {
+					return err
+				}
+			}
+			result, err := state.result(name)
+			if err != nil {
+				return err
+			}
+			for _, row := range part[start:peers[start]] {
+				out[row] = result
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported window function: %s", fn.Name)
+	}
+}
+
+// computeOffset computes LAG(expr [, offset [, default]]) or LEAD, the value of
+// expr offset rows before or after the current row in the ordered partition.
+// Past either end of the partition the result is default, or NULL.
+func computeOffset(fn *queryparser.FuncCall, table array.Record, part []int, out []interface{}) error {
+	name := strings.ToUpper(fn.Name)
+	if len(fn.Args) < 1 || len(fn.Args) > 3 {
+		return fmt.Errorf("%s expects one to three arguments", name)
+	}
+	for i, row := range part {
+		offset := int64(1)
+		if len(fn.Args) > 1 {
+			val, err := evaluateExpression(fn.Args[1], table, row)
+			if err != nil {
+				return err
+			}
+			n, ok := val.(int64)
+			if !ok || n < 0 {
+				return fmt.Errorf("%s offset must be a non-negative integer", name)
+			}
+			offset = n
+		}
+		if name == "LAG" {
+			offset = -offset
+		}
+
+		var err error
+		if target := int64(i) + offset; target >= 0 && target < int64(len(part)) {
+			out[row], err = evaluateExpression(fn.Args[0], table, part[target])
+		} else if len(fn.Args) > 2 {
+			out[row], err = evaluateExpression(fn.Args[2], table, row)
+		} else {
+			out[row] = nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// computeFramed computes an aggregate over each row's frame in the ordered
+// partition, such as a moving average over the last 7 rows, the frame of the
+// row at position i being the rows from lo[i] up to hi[i]. COUNT of an empty
+// frame is 0 and the other aggregates are NULL. As for the aggregates, the SUM,
+// MIN and MAX of integers are integers.
+func computeFramed(name string, arg queryparser.Expression, star bool, lo, hi []int, table array.Record, part []int, out []interface{}) error {
+	// Prefix sums and counts of the non-NULL values make SUM, AVG and COUNT
+	// constant time per row. The integer sums may wrap around, but the
+	// difference of two is still exact for a frame whose sum does not.
+	vals := make([]interface{}, len(part))
+	sums := make([]float64, len(part)+1)
+	isums := make([]int64, len(part)+1)
+	counts := make([]int, len(part)+1)
+	integers := true
+	for i, row := range part {
+		sums[i+1], isums[i+1], counts[i+1] = sums[i], isums[i], counts[i]
+		if star {
+			counts[i+1]++
+			continue
+		}
+		val, err := evaluateExpression(arg, table, row)
+		if err != nil {
+			return err
+		}
+		if val != nil {
+			n, ok := val.(int64)
+			integers = integers && ok
+			vals[i] = val
+			sums[i+1] += toFloat(val)
+			isums[i+1] += n
+			counts[i+1]++
+		}
+	}
+
+	for i, row := range part {
+		lo, hi := lo[i], hi[i]
+		count := counts[hi] - counts[lo]
+		if name == "COUNT" {
+			out[row] = int64(count)
+			continue
+		}
+		if count == 0 {
+			out[row] = nil
+			continue
+		}
+
+		switch {
+		case name == "SUM" && integers:
+			// A sum that wrapped around is a multiple of 2^64 away from the
+			// float sum, which is never that far from the true sum
+			sum := isums[hi] - isums[lo]
+			if math.Abs(sums[hi]-sums[lo]-float64(sum)) > 1<<62 {
+				return fmt.Errorf("%w in SUM", errIntegerOverflow)
+			}
+			out[row] = sum
+		case name == "SUM":
+			out[row] = sums[hi] - sums[lo]
+		case name == "AVG":
+			out[row] = (sums[hi] - sums[lo]) / float64(count)
+		default:
+			var best interface{}
+			for _, v := range vals[lo:hi] {
+				if v == nil {
+					continue
+				}
+				if best == nil {
+					best = v
+					continue
+				}
+				if c := compareValues(v, best, false); (name == "MIN" && c < 0) || (name == "MAX" && c > 0) {
+					best = v
+				}
+			}
+			out[row] = best
+		}
+	}
+	return nil
+}
+
+// frameRows returns the frame of each row of the ordered partition, the rows
+// at positions from lo[i] up to hi[i] for the row at position i, which are
+// both 0 for an empty frame.
+func frameRows(frame *queryparser.WindowFrame, orderBy []queryparser.OrderByItem, table array.Record, part []int, peers []int) (lo, hi []int, err error) {
+	lo, hi = make([]int, len(part)), make([]int, len(part))
+	if frame.Range {
+		if lo, err = rangeBounds(frame.Start, orderBy, table, part, peers, false); err != nil {
+			return nil, nil, err
+		}
+		if hi, err = rangeBounds(frame.End, orderBy, table, part, peers, true); err != nil {
+			return nil, nil, err
+		}
+	} else {
+		for i := range part {
+			lo[i] = max(frameOffset(frame.Start, i, len(part)), 0)
+			hi[i] = min(frameOffset(frame.End, i, len(part))+1, len(part))
+		}
+	}
+	for i := range part {
+		if lo[i] >= hi[i] {
+			lo[i], hi[i] = 0, 0
+		}
+	}
+	return lo, hi, nil
+}
+
+// rangeBounds returns, for each row of the ordered partition, the position at
+// which its RANGE frame starts, or ends, exclusive, when end is set. CURRENT
+// ROW lies at the edge of the row's peers, and an offset at the edge of the
+// rows whose ORDER BY value is no further than it from the row's. That value
+// must then be the only ORDER BY key, and a number, date or timestamp. The
+// frame of a row whose value is NULL takes in the other NULLs rather than
+// those within an offset.
+func rangeBounds(b queryparser.FrameBound, orderBy []queryparser.OrderByItem, table array.Record, part []int, peers []int, end bool) ([]int, error) {
+	bounds := make([]int, len(part))
+	for i := range part {
+		switch {
+		case b.Kind == queryparser.UnboundedPreceding:
+			bounds[i] = 0
+		case b.Kind == queryparser.UnboundedFollowing:
+			bounds[i] = len(part)
+		case end:
+			bounds[i] = peers[i]
+		case i > 0 && peers[i-1] > i:
+			bounds[i] = bounds[i-1]
+		default:
+			bounds[i] = i
+		}
+	}
+	if b.Value == nil {
+		return bounds, nil
+	}
+
+	if len(orderBy) != 1 {
+		return nil, fmt.Errorf("RANGE with an offset needs exactly one ORDER BY key, got %d", len(orderBy))
+	}
+	offset, err := evaluateExpression(b.Value, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]interface{}, len(part))
+	first, last := len(part), 0 // the positions of the non-NULL values
+	for i, row := range part {
+		if keys[i], err = evaluateExpression(orderBy[0].Expr, table, row); err != nil {
+			return nil, err
+		}
+		switch keys[i].(type) {
+		case nil:
+			continue
+		case int64, float64, decimal, date, time.Time:
+		default:
+			return nil, fmt.Errorf("RANGE with an offset needs a numeric, date or timestamp ORDER BY key, got %v", keys[i])
+		}
+		first, last = min(first, i), i+1
+	}
+
+	// The partition runs from low to high values, or high to low for DESC
+	op := "+"
+	if (b.Kind == queryparser.Preceding) != orderBy[0].Desc {
+		op = "-"
+	}
+	for i := first; i < last; i++ {
+		target, err := evalBinaryOp(op, keys[i], offset)
+		if err != nil {
+			return nil, err
+		}
+		// Find the first row past the target, or from it on for a start
+		bounds[i] = first + sort.Search(last-first, func(j int) bool {
+			c := compareOperands(keys[first+j], target)
+			if orderBy[0].Desc {
+				c = -c
+			}
+			return c > 0 || (!end && c == 0)
+		})
+	}
+	return bounds, nil
+}
+
+// frameOffset returns the position in a partition of n rows that a frame bound
+// refers to for the row at position i. Unbounded bounds lie just outside the
+// partition.
+func frameOffset(b queryparser.FrameBound, i, n int) int {
+	switch b.Kind {
+	case queryparser.UnboundedPreceding:
+		return -1
+	case queryparser.Preceding:
+		return i - b.Offset
+	case queryparser.Following:
+		return i + b.Offset
+	case queryparser.UnboundedFollowing:
+		return n
+	default:
+		return i
+	}
+}
@@ -0,0 +1,233 @@
+package engine
+
+import (
+	"math"
+	"time"
+
+	"github.com/apache/arrow/go/arrow/array"
+
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// zoneRows is the number of rows each zone of a zone map covers. It is a
+// variable so that tests can split small tables into several zones.
+var zoneRows = 1 << 13
+
+// zone is the range of the values of a column over a run of its rows.
+type zone struct {
+	min, max interface{} // nil when every value is NULL
+	nulls    int
+	rows     int
+	ordered  bool // min and max bound every value; false for NaNs and types without an order
+}
+
+// zoneMap is the zones of a column, the i-th covering the zoneRows rows from
+// i*zoneRows on.
+type zoneMap []zone
+
+// buildZoneMap reads arr once to find the range of each zone. Columns of
+// types whose values do not order the way comparisons do have unordered
+// zones.
+func buildZoneMap(arr array.Interface) zoneMap {
+	var ordered bool
+	switch arr.(type) {
+	case *array.Int64, *array.Float64, *array.String, *array.Date32, *array.Timestamp:
+		ordered = true
+	}
+	zones := make(zoneMap, numMorsels(arr.Len(), zoneRows))
+	for i := range zones {
+		z := &zones[i]
+		start := i * zoneRows
+		z.rows = min(zoneRows, arr.Len()-start)
+		z.ordered = ordered
+		for row := start; row < start+z.rows && z.ordered; row++ {
+			val, err := columnValue(arr, row)
+			if err != nil {
+				z.ordered = false
+				break
+			}
+			switch v := val.(type) {
+			case nil:
+				z.nulls++
+				continue
+			case float64:
+				if math.IsNaN(v) {
+					z.ordered = false
+					continue
+				}
+			}
+			if z.min == nil || compareOperands(val, z.min) < 0 {
+				z.min = val
+			}
+			if z.max == nil || compareOperands(val, z.max) > 0 {
+				z.max = val
+			}
+		}
+	}
+	return zones
+}
+
+// zonePruner tells from zone maps which zones of a table a WHERE condition
+// cannot hold in, so that filters skip them without reading their rows.
+type zonePruner struct {
+	cond  queryparser.Expression
+	zones map[*queryparser.ColumnRef]zoneMap
+}
+
+// newZonePruner returns a pruner for cond over table, or nil when no column
+// cond compares has a zone map: only the columns of the catalog's tables,
+// read by a scan as they are stored, do.
+func newZonePruner(cond queryparser.Expression, table array.Record, ec *execContext) *zonePruner {
+	if cond == nil || ec.catalog == nil {
+		return nil
+	}
+	p := &zonePruner{cond: cond, zones: map[*queryparser.ColumnRef]zoneMap{}}
+	queryparser.Inspect(cond, func(expr queryparser.Expression) bool {
+		if col, ok := expr.(*queryparser.ColumnRef); ok {
+			if idx, err := resolveColumn(table, col); err == nil {
+				if zones, ok := ec.catalog.zoneMap(table.Column(idx)); ok {
+					p.zones[col] = zones
+				}
+			}
+		}
+		return true
+	})
+	if len(p.zones) == 0 {
+		return nil
+	}
+	return p
+}
+
+// excludes reports whether the condition is not true for any of the rows
+// [start, end), as none of the zones they fall in may hold it.
+func (p *zonePruner) excludes(start, end int) bool {
+	if p == nil {
+		return false
+	}
+	for z := start / zoneRows; z*zoneRows < end; z++ {
+		if p.mayHold(p.cond, z) {
+			return false
+		}
+	}
+	return true
+}
+
+// mayHold reports whether expr may be true for some row of zone z. It is
+// false only where the zone's ranges prove it: for comparisons of a column
+// with a constant, IS [NOT] NULL, and AND and OR of those.
+func (p *zonePruner) mayHold(expr queryparser.Expression, z int) bool {
+	switch e := expr.(type) {
+	case *queryparser.BinaryExpr:
+		switch e.Op {
+		case "AND":
+			return p.mayHold(e.Left, z) && p.mayHold(e.Right, z)
+		case "OR":
+			return p.mayHold(e.Left, z) || p.mayHold(e.Right, z)
+		}
+		if zn, c, op, ok := p.comparison(e, z); ok {
+			return zoneMayCompare(zn, op, c)
+		}
+	case *queryparser.IsNullExpr:
+		if col, ok := e.Expr.(*queryparser.ColumnRef); ok {
+			if zones, ok := p.zones[col]; ok {
+				zn := zones[z]
+				if e.Not {
+					return zn.nulls < zn.rows
+				}
+				return zn.nulls > 0
+			}
+		}
+	}
+	return true
+}
+
+// comparison reads e as a column compared with a constant, returning the
+// column's zone z, the constant and the operator with the column on the
+// left.
+func (p *zonePruner) comparison(e *queryparser.BinaryExpr, z int) (zone, interface{}, string, bool) {
+	op := flipComparison(flipComparison(e.Op))
+	col, colOK := e.Left.(*queryparser.ColumnRef)
+	other := e.Right
+	if !colOK {
+		col, colOK = e.Right.(*queryparser.ColumnRef)
+		other = e.Left
+		op = flipComparison(op)
+	}
+	zones, ok := p.zones[col]
+	if !colOK || !ok || op == "" || !isConstant(other) {
+		return zone{}, nil, "", false
+	}
+	c, err := evaluateExpression(other, nil, 0)
+	if err != nil {
+		return zone{}, nil, "", false
+	}
+	return zones[z], c, op, true
+}
+
+// flipComparison returns the operator that compares the same way with its
+// operands swapped, or "" for an operator that is not a comparison.
+func flipComparison(op string) string {
+	switch op {
+	case "=", "!=", "<>":
+		return op
+	case "<":
+		return ">"
+	case ">":
+		return "<"
+	case "<=":
+		return ">="
+	case ">=":
+		return "<="
+	}
+	return ""
+}
+
+// zoneMayCompare reports whether "value op c" may be true for a value in zn.
+// A comparison with NULL is never true.
+func zoneMayCompare(zn zone, op string, c interface{}) bool {
+	if c == nil || zn.nulls == zn.rows {
+		return false
+	}
+	if !zn.ordered || !zoneComparable(zn.min, c) {
+		return true
+	}
+	lo, hi := compareOperands(zn.min, c), compareOperands(zn.max, c)
+	switch op {
+	case "=":
+		return lo <= 0 && hi >= 0
+	case "!=", "<>":
+		return lo != 0 || hi != 0
+	case "<":
+		return lo < 0
+	case "<=":
+		return lo <= 0
+	case ">":
+		return hi > 0
+	case ">=":
+		return hi >= 0
+	}
+	return true
+}
+
+// zoneComparable reports whether comparing v with c orders v the way the
+// zone's range does, as between two numbers, two strings or two values of
+// the same temporal type.
+func zoneComparable(v, c interface{}) bool {
+	switch v.(type) {
+	case int64, float64:
+		switch c.(type) {
+		case int64, float64:
+			return true
+		}
+	case string:
+		_, ok := c.(string)
+		return ok
+	case date:
+		_, ok := c.(date)
+		return ok
+	case time.Time:
+		_, ok := c.(time.Time)
+		return ok
+	}
+	return false
+}
@@ -0,0 +1,393 @@
+package planner
+
+import (
+	"math"
+
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// maxReorderedJoins caps the number of inputs of a run of inner joins that the
+// optimizer reorders, as it considers every subset of them.
+const maxReorderedJoins = 12
+
+// The selectivities assumed for conditions the statistics say nothing about.
+const (
+	equalitySelectivity = 0.1
+	defaultSelectivity  = 1.0 / 3
+)
+
+// reorder reorders every run of inner joins in n by estimated cost.
+func (o *optimizer) reorder(n Node) Node {
+	switch n := n.(type) {
+	case *Project:
+		project := *n
+		project.Input = o.reorderBlock(n.Input, !HasStar(n.Exprs))
+		return &project
+	case *With:
+		return o.with(n, o.reorder)
+	default:
+		return mapInputs(n, o.reorder)
+	}
+}
+
+// reorderBlock reorders the inner joins of the query below a Project. A query
+// that selects every column with a star keeps its joins in written order, as
+// the order decides the order of its columns.
+func (o *optimizer) reorderBlock(n Node, allowed bool) Node {
+	switch n := n.(type) {
+	case *Join:
+		if !isInnerJoin(n) {
+			return mapInputs(n, func(in Node) Node { return o.reorderBlock(in, allowed) })
+		}
+		var inputs []Node
+		var conds []queryparser.Expression
+		flattenJoins(n, &inputs, &conds)
+		for i, in := range inputs {
+			inputs[i] = o.reorderBlock(in, allowed)
+		}
+		if allowed {
+			if joined, ok := o.orderJoins(inputs, conds); ok {
+				return joined
+			}
+		}
+		return rebuildJoins(n, inputs)
+	case *Filter, *Sort, *Aggregate:
+		return mapInputs(n, func(in Node) Node { return o.reorderBlock(in, allowed) })
+	default:
+		return o.reorder(n)
+	}
+}
+
+func isInnerJoin(n Node) bool {
+	j, ok := n.(*Join)
+	return ok && (j.Type == "INNER" || j.Type == "CROSS")
+}
+
+// flattenJoins collects the inputs of a run of inner joins, in written order,
+// and the conditions of their ON clauses.
+func flattenJoins(n Node, inputs *[]Node, conds *[]queryparser.Expression) {
+	if !isInnerJoin(n) {
+		*inputs = append(*inputs, n)
+		return
+	}
+	j := n.(*Join)
+	flattenJoins(j.Left, inputs, conds)
+	flattenJoins(j.Right, inputs, conds)
+	if j.On != nil {
+		*conds = append(*conds, SplitConjuncts(j.On)...)
+	}
+}
+
+// rebuildJoins returns the run of inner joins n, in its written order, over the
+// given inputs.
+func rebuildJoins(n Node, inputs []Node) Node {
+	var next int
+	var build func(n Node) Node
+	build = func(n Node) Node {
+		if !isInnerJoin(n) {
+			next++
+			return inputs[next-1]
+		}
+		j := *n.(*Join)
+		j.Left = build(j.Left)
+		j.Right = build(j.Right)
+		return &j
+	}
+	return build(n)
+}
+
+// joinInput is one of the inputs of a run of inner joins.
+type joinInput struct {
+	node Node
+	cols []column
+	rows float64
+}
+
+// joinCondition is a condition of a run of inner joins, with the set of inputs
+// it reads as a bit mask.
+type joinCondition struct {
+	expr        queryparser.Expression
+	inputs      uint
+	selectivity float64
+}
+
+// orderJoins finds the left-deep order of joining inputs that keeps the
+// estimated intermediate results smallest, and joins them in that order, each
+// condition applied by the first join that has every input it reads. It
+// returns false when the inputs or conditions cannot be estimated, or when the
+// written order is as cheap, so that the written order is kept.
+func (o *optimizer) orderJoins(nodes []Node, conds []queryparser.Expression) (Node, bool) {
+	if len(nodes) < 3 || len(nodes) > maxReorderedJoins {
+		return nil, false
+	}
+	inputs := make([]joinInput, len(nodes))
+	var all []column
+	for i, n := range nodes {
+		cols, ok := o.columns(n)
+		if !ok {
+			return nil, false
+		}
+		rows, ok := o.rows(n)
+		if !ok {
+			return nil, false
+		}
+		inputs[i] = joinInput{node: n, cols: cols, rows: math.Max(rows, 1)}
+		all = append(all, cols...)
+	}
+
+	conditions := make([]joinCondition, len(conds))
+	for i, cond := range conds {
+		if !movable(cond) {
+			return nil, false
+		}
+		c := joinCondition{expr: cond, selectivity: defaultSelectivity}
+		resolved := true
+		queryparser.Inspect(cond, func(e queryparser.Expression) bool {
+			if ref, ok := e.(*queryparser.ColumnRef); ok {
+				col, ok := resolve(ref, all)
+				if !ok {
+					resolved = false
+					return false
+				}
+				c.inputs |= 1 << inputOf(inputs, col)
+			}
+			return true
+		})
+		if !resolved {
+			return nil, false
+		}
+		if sel, ok := o.equalitySelectivity(cond, inputs, all); ok {
+			c.selectivity = sel
+		}
+		conditions[i] = c
+	}
+
+	// size estimates the rows of joining a set of inputs, in any order
+	size := func(set uint) float64 {
+		rows := 1.0
+		for i, in := range inputs {
+			if set&(1<<i) != 0 {
+				rows *= in.rows
+			}
+		}
+		for _, c := range conditions {
+			if c.inputs != 0 && c.inputs&set == c.inputs {
+				rows *= c.selectivity
+			}
+		}
+		return rows
+	}
+
+	// The cost of an order is the sum of the rows of its intermediate results.
+	// best[set] is the cheapest order that joins the inputs in set.
+	type plan struct {
+		cost  float64
+		order []int
+	}
+	full := uint(1)<<len(inputs) - 1
+	best := make([]*plan, full+1)
+	for i := range inputs {
+		best[1<<i] = &plan{order: []int{i}}
+	}
+	for set := uint(1); set <= full; set++ {
+		if best[set] != nil {
+			continue
+		}
+		rows := size(set)
+		for i := range inputs {
+			rest := set &^ (1 << i)
+			if rest == set || best[rest] == nil {
+				continue
+			}
+			cost := best[rest].cost + rows
+			if best[set] == nil || cost < best[set].cost {
+				best[set] = &plan{cost: cost, order: append(append([]int{}, best[rest].order...), i)}
+			}
+		}
+	}
+
+	written := 0.0
+	for k := 2; k <= len(inputs); k++ {
+		written += size(uint(1)<<k - 1)
+	}
+	if best[full].cost >= written {
+		return nil, false
+	}
+
+	// The first join's larger input goes on the left, to probe the other
+	order := best[full].order
+	if inputs[order[0]].rows < inputs[order[1]].rows {
+		order[0], order[1] = order[1], order[0]
+	}
+	joined := inputs[order[0]].node
+	set := uint(1) << order[0]
+	placed := make([]bool, len(conditions))
+	for _, i := range order[1:] {
+		set |= 1 << i
+		var on []queryparser.Expression
+		for c, cond := range conditions {
+			if !placed[c] && cond.inputs&set == cond.inputs {
+				on = append(on, cond.expr)
+				placed[c] = true
+			}
+		}
+		j := &Join{Left: joined, Right: inputs[i].node, Type: "INNER", On: JoinConjuncts(on)}
+		if j.On == nil {
+			j.Type = "CROSS"
+		}
+		joined = j
+	}
+	return joined, true
+}
+
+// inputOf returns the input that the column at index col of their combined
+// columns belongs to.
+func inputOf(inputs []joinInput, col int) int {
+	for i, in := range inputs {
+		if col < len(in.cols) {
+			return i
+		}
+		col -= len(in.cols)
+	}
+	return -1
+}
+
+// equalitySelectivity estimates the share of pairs of rows for which cond, an
+// equality between columns of two inputs, holds: one in the larger number of
+// distinct values of the two.
+func (o *optimizer) equalitySelectivity(cond queryparser.Expression, inputs []joinInput, all []column) (float64, bool) {
+	bin, ok := cond.(*queryparser.BinaryExpr)
+	if !ok || bin.Op != "=" {
+		return 0, false
+	}
+	distinct := 1.0
+	for _, side := range []queryparser.Expression{bin.Left, bin.Right} {
+		ref, ok := side.(*queryparser.ColumnRef)
+		if !ok {
+			return 0, false
+		}
+		col, ok := resolve(ref, all)
+		if !ok {
+			return 0, false
+		}
+		in := inputOf(inputs, col)
+		for _, prev := range inputs[:in] {
+			col -= len(prev.cols)
+		}
+		distinct = math.Max(distinct, o.distinct(inputs[in].node, col, inputs[in].rows))
+	}
+	return 1 / distinct, true
+}
+
+// distinct estimates the number of distinct values of column col of n, which
+// has the given number of rows. Without statistics every value is taken to be
+// distinct.
+func (o *optimizer) distinct(n Node, col int, rows float64) float64 {
+	for {
+		switch in := n.(type) {
+		case *Filter:
+			n = in.Input
+			continue
+		case *Scan:
+			if o.isCTE(in.Table) {
+				return rows
+			}
+			stats, ok := o.tables.Stats(in.Table)
+			if !ok || col >= len(stats.Distinct) {
+				return rows
+			}
+			return math.Max(1, math.Min(float64(stats.Distinct[col]), rows))
+		}
+		return rows
+	}
+}
+
+// rows estimates the number of rows n produces.
+func (o *optimizer) rows(n Node) (float64, bool) {
+	switch n := n.(type) {
+	case *Scan:
+		if o.isCTE(n.Table) {
+			return 0, false
+		}
+		stats, ok := o.tables.Stats(n.Table)
+		return float64(stats.Rows), ok
+	case *Values:
+		return float64(len(n.Rows)), true
+	case *Filter:
+		rows, ok := o.rows(n.Input)
+		if !ok {
+			return 0, false
+		}
+		cols, _ := o.columns(n.Input)
+		for _, cond := range SplitConjuncts(n.Condition) {
+			rows *= o.filterSelectivity(cond, n.Input, cols, rows)
+		}
+		return rows, true
+	case *Join:
+		left, ok := o.rows(n.Left)
+		if !ok {
+			return 0, false
+		}
+		right, ok := o.rows(n.Right)
+		if !ok {
+			return 0, false
+		}
+		rows := left * right
+		if n.On != nil {
+			rows *= math.Pow(defaultSelectivity, float64(len(SplitConjuncts(n.On))))
+		}
+		if n.Type != "INNER" && n.Type != "CROSS" {
+			rows = math.Max(rows, math.Max(left, right))
+		}
+		return rows, true
+	case *SetOp:
+		left, ok := o.rows(n.Left)
+		if !ok {
+			return 0, false
+		}
+		right, ok := o.rows(n.Right)
+		return left + right, ok
+	case *With:
+		return 0, false
+	default:
+		// Derived tables, sorts, projections and the rest produce at most the
+		// rows of their input
+		return o.rows(n.Inputs()[0])
+	}
+}
+
+// filterSelectivity estimates the share of the rows of input that cond keeps.
+// An equality between a column and a constant keeps one distinct value.
+func (o *optimizer) filterSelectivity(cond queryparser.Expression, input Node, cols []column, rows float64) float64 {
+	bin, ok := cond.(*queryparser.BinaryExpr)
+	if !ok || bin.Op != "=" {
+		return defaultSelectivity
+	}
+	ref, ok := bin.Left.(*queryparser.ColumnRef)
+	other := bin.Right
+	if !ok {
+		ref, ok = bin.Right.(*queryparser.ColumnRef)
+		other = bin.Left
+	}
+	if _, literal := other.(*queryparser.Literal); !ok || !literal || cols == nil {
+		return equalitySelectivity
+	}
+	col, ok := resolve(ref, cols)
+	if !ok {
+		return equalitySelectivity
+	}
+	if distinct := o.distinct(input, col, math.Inf(1)); !math.IsInf(distinct, 1) {
+		return 1 / distinct
+	}
+	return equalitySelectivity
+}
+
+// HasStar reports whether exprs select every column with a star.
+func HasStar(exprs []queryparser.Expression) bool {
+	for _, expr := range exprs {
+		if _, ok := expr.(*queryparser.StarExpr); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,576 @@
+package planner
+
+import (
+	"strings"
+
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// Tables describes the tables a plan reads to the optimizer.
+type Tables interface {
+	// Columns returns the columns of a table, or false when they are not
+	// known before the plan runs, as for views.
+	Columns(table string) ([]string, bool)
+	// Stats returns the statistics of a table, or false when it has none.
+	Stats(table string) (TableStats, bool)
+}
+
+// TableStats are what the optimizer estimates the size of a table's joins from.
+type TableStats struct {
+	Rows     int64
+	Distinct []int64 // the estimated number of distinct values of each column
+}
+
+// Optimize rewrites a plan into an equivalent one that does less work. It
+// pushes filters down through joins and into derived tables, so rows are
+// dropped as early as possible and conditions across an inner join become join
+// keys, reorders inner joins by their estimated cost, and prunes every scan to
+// the columns the plan references. Rules that depend on columns or statistics
+// it cannot see, such as those of views, are skipped.
+func Optimize(n Node, tables Tables) Node {
+	o := &optimizer{tables: tables}
+	return o.prune(o.reorder(o.pushDown(n)))
+}
+
+type optimizer struct {
+	tables Tables
+	ctes   []string // the CTEs in scope, which hide tables of the same name
+}
+
+// column is an output column of a node and the name that qualifies it.
+type column struct {
+	table, name string
+}
+
+// columns returns the output columns of n, or false when they are unknown.
+func (o *optimizer) columns(n Node) ([]column, bool) {
+	switch n := n.(type) {
+	case *Scan:
+		if o.isCTE(n.Table) {
+			return nil, false
+		}
+		names, ok := o.tables.Columns(n.Table)
+		if !ok || len(n.Columns) > len(names) {
+			return nil, false
+		}
+		qualifier := n.Alias
+		if qualifier == "" {
+			qualifier = n.Table
+		}
+		cols := make([]column, len(names))
+		for i, name := range names {
+			if i < len(n.Columns) {
+				name = n.Columns[i]
+			}
+			cols[i] = column{table: qualifier, name: name}
+		}
+		return cols, true
+	case *Derived:
+		names, _, ok := o.derivedColumns(n)
+		if !ok {
+			return nil, false
+		}
+		cols := make([]column, len(names))
+		for i, name := range names {
+			cols[i] = column{table: n.Alias, name: name}
+		}
+		return cols, true
+	case *Join:
+		left, ok := o.columns(n.Left)
+		if !ok {
+			return nil, false
+		}
+		right, ok := o.columns(n.Right)
+		if !ok {
+			return nil, false
+		}
+		return append(append([]column{}, left...), right...), true
+	case *Filter, *Sort, *Distinct:
+		return o.columns(n.Inputs()[0])
+	default:
+		return nil, false
+	}
+}
+
+func (o *optimizer) isCTE(name string) bool {
+	for _, cte := range o.ctes {
+		if strings.EqualFold(cte, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// derivedColumns returns the output names of a derived table whose SELECT list
+// only picks columns, with the column each one picks. It returns false for any
+// other subquery.
+func (o *optimizer) derivedColumns(d *Derived) ([]string, []*queryparser.ColumnRef, bool) {
+	p, input, ok := simpleProject(d.Input)
+	if !ok {
+		return nil, nil, false
+	}
+	cols, ok := o.columns(input)
+	if !ok {
+		return nil, nil, false
+	}
+	names := make([]string, len(p.Exprs))
+	refs := make([]*queryparser.ColumnRef, len(p.Exprs))
+	for i, expr := range p.Exprs {
+		alias := ""
+		if a, ok := expr.(*queryparser.AliasExpr); ok {
+			alias, expr = a.Alias, a.Expr
+		}
+		ref, ok := expr.(*queryparser.ColumnRef)
+		if !ok {
+			return nil, nil, false
+		}
+		c, ok := resolve(ref, cols)
+		if !ok {
+			return nil, nil, false
+		}
+		names[i], refs[i] = cols[c].name, ref
+		if alias != "" {
+			names[i] = alias
+		}
+	}
+	if len(d.Columns) > len(names) {
+		return nil, nil, false
+	}
+	copy(names, d.Columns)
+	return names, refs, true
+}
+
+// simpleProject returns the Project of a plan that is one, possibly under a
+// Distinct, when it computes no aggregates, and the plan it reads from.
+func simpleProject(n Node) (*Project, Node, bool) {
+	if d, ok := n.(*Distinct); ok {
+		n = d.Input
+	}
+	p, ok := n.(*Project)
+	if !ok {
+		return nil, nil, false
+	}
+	input := p.Input
+	if s, ok := input.(*Sort); ok {
+		input = s.Input
+	}
+	if _, ok := input.(*Aggregate); ok {
+		return nil, nil, false
+	}
+	return p, input, true
+}
+
+// resolve finds the column ref names, as the engine does: by exact name first,
+// then ignoring case unless the name is quoted. It returns false when no
+// column or more than one matches.
+func resolve(ref *queryparser.ColumnRef, cols []column) (int, bool) {
+	match := func(equal func(a, b string) bool) (int, bool) {
+		found := -1
+		for i, c := range cols {
+			if !equal(c.name, ref.Name) || (ref.Table != "" && !strings.EqualFold(c.table, ref.Table)) {
+				continue
+			}
+			if found != -1 {
+				return -1, false
+			}
+			found = i
+		}
+		return found, true
+	}
+	found, ok := match(func(a, b string) bool { return a == b })
+	if ok && found == -1 && !ref.Quoted {
+		found, ok = match(strings.EqualFold)
+	}
+	return found, ok && found != -1
+}
+
+// pushDown moves every Filter in n as far towards the scans as it can go.
+func (o *optimizer) pushDown(n Node) Node {
+	switch n := n.(type) {
+	case *Filter:
+		return o.filter(SplitConjuncts(n.Condition), n.Input)
+	case *With:
+		return o.with(n, o.pushDown)
+	default:
+		return mapInputs(n, o.pushDown)
+	}
+}
+
+// filter returns the plan that keeps the rows of input for which every one of
+// conds holds, with each condition applied as low in input as it can be.
+func (o *optimizer) filter(conds []queryparser.Expression, input Node) Node {
+	switch in := input.(type) {
+	case *Filter:
+		return o.filter(append(conds, SplitConjuncts(in.Condition)...), in.Input)
+	case *Join:
+		return o.filterJoin(conds, in)
+	case *Derived:
+		return o.filterDerived(conds, in)
+	default:
+		return withFilter(o.pushDown(input), conds)
+	}
+}
+
+// filterJoin pushes the conditions that only read one side of a join into that
+// side, unless the join pads it with NULLs. The conditions of an inner join
+// that read both sides join its ON condition.
+func (o *optimizer) filterJoin(conds []queryparser.Expression, j *Join) Node {
+	left, lok := o.columns(j.Left)
+	right, rok := o.columns(j.Right)
+	inner := j.Type == "INNER" || j.Type == "CROSS"
+	var leftConds, rightConds, onConds, kept []queryparser.Expression
+	for _, cond := range conds {
+		side := sideNone
+		if lok && rok && movable(cond) {
+			side = exprSide(cond, left, right)
+		}
+		switch {
+		case side == sideLeft && (inner || j.Type == "LEFT"):
+			leftConds = append(leftConds, cond)
+		case side == sideRight && (inner || j.Type == "RIGHT"):
+			rightConds = append(rightConds, cond)
+		case side == sideBoth && inner:
+			onConds = append(onConds, cond)
+		default:
+			kept = append(kept, cond)
+		}
+	}
+
+	joined := *j
+	joined.Left = o.filter(leftConds, j.Left)
+	joined.Right = o.filter(rightConds, j.Right)
+	if len(onConds) > 0 {
+		if j.On != nil {
+			onConds = append(SplitConjuncts(j.On), onConds...)
+		}
+		joined.Type, joined.On = "INNER", JoinConjuncts(onConds)
+	}
+	return withFilter(&joined, kept)
+}
+
+// filterDerived pushes the conditions on a derived table that picks columns
+// into its subquery, reading the picked columns in place of its own.
+func (o *optimizer) filterDerived(conds []queryparser.Expression, d *Derived) Node {
+	names, refs, ok := o.derivedColumns(d)
+	if !ok {
+		return withFilter(o.pushDown(d), conds)
+	}
+	cols := make([]column, len(names))
+	for i, name := range names {
+		cols[i] = column{table: d.Alias, name: name}
+	}
+
+	var inner, kept []queryparser.Expression
+	for _, cond := range conds {
+		if !movable(cond) {
+			kept = append(kept, cond)
+			continue
+		}
+		resolved := true
+		rewritten := queryparser.Transform(cond, func(e queryparser.Expression) queryparser.Expression {
+			ref, ok := e.(*queryparser.ColumnRef)
+			if !ok {
+				return e
+			}
+			c, ok := resolve(ref, cols)
+			if !ok {
+				resolved = false
+				return e
+			}
+			return refs[c]
+		})
+		if resolved {
+			inner = append(inner, rewritten)
+		} else {
+			kept = append(kept, cond)
+		}
+	}
+	if len(inner) == 0 {
+		return withFilter(o.pushDown(d), conds)
+	}
+
+	// The conditions go below the subquery's ORDER BY, which they preserve
+	p, _, _ := simpleProject(d.Input)
+	project := *p
+	if s, ok := p.Input.(*Sort); ok {
+		sorted := *s
+		sorted.Input = o.filter(inner, s.Input)
+		project.Input = &sorted
+	} else {
+		project.Input = o.filter(inner, p.Input)
+	}
+	derived := *d
+	derived.Input = &project
+	if _, ok := d.Input.(*Distinct); ok {
+		derived.Input = &Distinct{Input: &project}
+	}
+	return withFilter(&derived, kept)
+}
+
+// movable reports whether cond may be evaluated somewhere else in the plan
+// than where it was written. Subqueries are kept in place, as they may refer to
+// columns of the outer query.
+func movable(cond queryparser.Expression) bool {
+	ok := true
+	queryparser.Inspect(cond, func(e queryparser.Expression) bool {
+		switch e.(type) {
+		case *queryparser.SubqueryExpr, *queryparser.ExistsExpr, *queryparser.WindowExpr:
+			ok = false
+		case *queryparser.InExpr:
+			if e.(*queryparser.InExpr).Subquery != nil {
+				ok = false
+			}
+		}
+		return ok
+	})
+	return ok
+}
+
+const (
+	sideNone = iota
+	sideLeft
+	sideRight
+	sideBoth
+	sideUnknown
+)
+
+// exprSide reports which of the two inputs of a join the columns of expr come
+// from. A column that does not resolve makes the side unknown.
+func exprSide(expr queryparser.Expression, left, right []column) int {
+	both := append(append([]column{}, left...), right...)
+	side := sideNone
+	queryparser.Inspect(expr, func(e queryparser.Expression) bool {
+		ref, ok := e.(*queryparser.ColumnRef)
+		if !ok {
+			return true
+		}
+		c, ok := resolve(ref, both)
+		switch {
+		case !ok:
+			side = sideUnknown
+		case c < len(left) && side != sideUnknown:
+			side = mergeSides(side, sideLeft)
+		case side != sideUnknown:
+			side = mergeSides(side, sideRight)
+		}
+		return true
+	})
+	return side
+}
+
+func mergeSides(a, b int) int {
+	switch {
+	case a == sideNone:
+		return b
+	case a == b:
+		return a
+	default:
+		return sideBoth
+	}
+}
+
+// SplitConjuncts flattens a tree of ANDs into its individual conditions.
+func SplitConjuncts(expr queryparser.Expression) []queryparser.Expression {
+	if bin, ok := expr.(*queryparser.BinaryExpr); ok && strings.EqualFold(bin.Op, "AND") {
+		return append(SplitConjuncts(bin.Left), SplitConjuncts(bin.Right)...)
+	}
+	return []queryparser.Expression{expr}
+}
+
+// JoinConjuncts combines conditions with AND, returning nil when there are none.
+func JoinConjuncts(conds []queryparser.Expression) queryparser.Expression {
+	var out queryparser.Expression
+	for _, c := range conds {
+		if out == nil {
+			out = c
+		} else {
+			out = &queryparser.BinaryExpr{Left: out, Op: "AND", Right: c}
+		}
+	}
+	return out
+}
+
+// withFilter puts a Filter for conds on top of n, if there are any.
+func withFilter(n Node, conds []queryparser.Expression) Node {
+	if len(conds) == 0 {
+		return n
+	}
+	return &Filter{Input: n, Condition: JoinConjuncts(conds)}
+}
+
+// prune limits the scans in n to the columns that the query reading them
+// references.
+func (o *optimizer) prune(n Node) Node {
+	switch n := n.(type) {
+	case *Project:
+		refs, star := blockRefs(n)
+		project := *n
+		project.Input = o.pruneBlock(n.Input, refs, star)
+		return &project
+	case *With:
+		return o.with(n, o.prune)
+	default:
+		return mapInputs(n, o.prune)
+	}
+}
+
+// pruneBlock prunes the scans of the query below a Project, down to its
+// derived tables, which are queries of their own. star reports whether the
+// query selects every column.
+func (o *optimizer) pruneBlock(n Node, refs []*queryparser.ColumnRef, star bool) Node {
+	switch n := n.(type) {
+	case *Scan:
+		cols, ok := o.columns(n)
+		if star || !ok {
+			return n
+		}
+		var needed []string
+		for _, c := range cols {
+			for _, ref := range refs {
+				// A qualifier may name a struct column whose field is read
+				if strings.EqualFold(c.name, ref.Name) && (ref.Table == "" || strings.EqualFold(c.table, ref.Table)) ||
+					strings.EqualFold(c.name, ref.Table) {
+					needed = append(needed, c.name)
+					break
+				}
+			}
+		}
+		if len(needed) == 0 {
+			// The rows are still counted, so keep a column to carry them
+			needed = []string{cols[0].name}
+		}
+		if len(needed) == len(cols) {
+			return n
+		}
+		scan := *n
+		scan.Needed = needed
+		return &scan
+	case *Filter, *Join, *Unnest, *Sort, *Aggregate:
+		return mapInputs(n, func(in Node) Node { return o.pruneBlock(in, refs, star) })
+	default:
+		return o.prune(n)
+	}
+}
+
+// blockRefs returns every column reference in the query below Project p, and
+// whether it selects all columns with a star. References in subqueries are
+// included, as they may name columns of this query.
+func blockRefs(p *Project) ([]*queryparser.ColumnRef, bool) {
+	var refs []*queryparser.ColumnRef
+	collect := func(expr queryparser.Expression) {
+		if expr == nil {
+			return
+		}
+		queryparser.WalkQuery(&queryparser.Query{Where: expr}, func(e queryparser.Expression) {
+			queryparser.Inspect(e, func(e queryparser.Expression) bool {
+				if ref, ok := e.(*queryparser.ColumnRef); ok {
+					refs = append(refs, ref)
+				}
+				return true
+			})
+		})
+	}
+	for _, expr := range p.Exprs {
+		collect(expr)
+	}
+	var walk func(n Node)
+	walk = func(n Node) {
+		switch n := n.(type) {
+		case *Filter:
+			collect(n.Condition)
+		case *Join:
+			collect(n.On)
+		case *Unnest:
+			for _, arg := range n.Clause.Args {
+				collect(arg)
+			}
+			collect(n.On)
+		case *Sort:
+			for _, item := range n.OrderBy {
+				collect(item.Expr)
+			}
+		case *Aggregate:
+			for _, expr := range n.GroupBy {
+				collect(expr)
+			}
+			collect(n.Having)
+		default:
+			return
+		}
+		for _, in := range n.Inputs() {
+			walk(in)
+		}
+	}
+	walk(p.Input)
+	return refs, HasStar(p.Exprs)
+}
+
+// with applies f to the CTEs and the input of w, each with the CTEs before it
+// in scope.
+func (o *optimizer) with(w *With, f func(Node) Node) Node {
+	defer func(ctes []string) { o.ctes = ctes }(o.ctes)
+	out := &With{CTEs: make([]CTE, len(w.CTEs))}
+	for i, cte := range w.CTEs {
+		out.CTEs[i] = CTE{Name: cte.Name, Plan: f(cte.Plan)}
+		o.ctes = append(o.ctes, cte.Name)
+	}
+	out.Input = f(w.Input)
+	return out
+}
+
+// mapInputs returns a copy of n with f applied to each of its inputs.
+func mapInputs(n Node, f func(Node) Node) Node {
+	switch n := n.(type) {
+	case *Derived:
+		c := *n
+		c.Input = f(n.Input)
+		return &c
+	case *Pivot:
+		c := *n
+		c.Input = f(n.Input)
+		return &c
+	case *Unnest:
+		if n.Input == nil {
+			return n
+		}
+		c := *n
+		c.Input = f(n.Input)
+		return &c
+	case *Join:
+		c := *n
+		c.Left, c.Right = f(n.Left), f(n.Right)
+		return &c
+	case *Filter:
+		c := *n
+		c.Input = f(n.Input)
+		return &c
+	case *Aggregate:
+		c := *n
+		c.Input = f(n.Input)
+		return &c
+	case *Sort:
+		c := *n
+		c.Input = f(n.Input)
+		return &c
+	case *Project:
+		c := *n
+		c.Input = f(n.Input)
+		return &c
+	case *Distinct:
+		c := *n
+		c.Input = f(n.Input)
+		return &c
+	case *SetOp:
+		c := *n
+		c.Left, c.Right = f(n.Left), f(n.Right)
+		return &c
+	case *With:
+		c := &With{CTEs: make([]CTE, len(n.CTEs)), Input: f(n.Input)}
+		for i, cte := range n.CTEs {
+			c.CTEs[i] = CTE{Name: cte.Name, Plan: f(cte.Plan)}
+		}
+		return c
+	default:
+		return n
+	}
+}
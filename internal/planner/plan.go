@@ -0,0 +1,426 @@
+// Package planner turns a parsed query into a logical plan: a tree of
+// relational operators that says what the query computes, without saying how.
+// The engine lowers a logical plan to physical operators to run it.
+package planner
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// Node is an operator of a logical plan. Its inputs are the nodes whose rows
+// it consumes; the leaves read tables.
+type Node interface {
+	Inputs() []Node
+	// String describes the operator alone, leaving out its inputs.
+	String() string
+}
+
+// Scan reads a table, view or CTE by name. Its columns are qualified with
+// Alias, or with Table when there is no alias.
+type Scan struct {
+	Table   string
+	Alias   string
+	Columns []string // column aliases for the leading columns
+	Needed  []string // the columns the plan reads, in table order; nil for all
+}
+
+// Derived runs a subquery in FROM and qualifies its columns with Alias.
+type Derived struct {
+	Input   Node
+	Alias   string
+	Columns []string // column aliases for the leading columns
+}
+
+// Pivot reshapes the table its input reads with PIVOT or UNPIVOT, and
+// qualifies the columns it makes with Alias.
+type Pivot struct {
+	Input   Node
+	Clause  *queryparser.PivotClause
+	Alias   string
+	Columns []string // column aliases for the leading columns
+}
+
+// Unnest is UNNEST in FROM, which reads its lists once, or joined onto
+// Input, when it reads them for each row of Input and adds a row for each of
+// their elements, as a lateral join does. On filters the joined rows, and
+// Outer keeps the input rows none of whose are kept, padded with NULLs, as
+// a LEFT JOIN does.
+type Unnest struct {
+	Input   Node // nil for UNNEST in FROM
+	Clause  *queryparser.UnnestClause
+	Alias   string
+	Columns []string // column aliases for the leading columns of the elements
+	On      queryparser.Expression
+	Outer   bool
+}
+
+// Values produces the rows of a VALUES list.
+type Values struct {
+	Rows [][]queryparser.Expression
+}
+
+// Join combines the rows of two inputs that satisfy On. Type is "INNER",
+// "LEFT", "RIGHT", "FULL" or "CROSS".
+type Join struct {
+	Left, Right Node
+	Type        string
+	On          queryparser.Expression // nil for CROSS joins
+}
+
+// Filter keeps the rows for which Condition holds.
+type Filter struct {
+	Input     Node
+	Condition queryparser.Expression
+}
+
+// Aggregate groups its input by GroupBy, or into a single group when there are
+// no keys, and keeps the groups for which Having holds. The expressions above
+// it are evaluated once per group.
+type Aggregate struct {
+	Input   Node
+	GroupBy []queryparser.Expression
+	Having  queryparser.Expression // nil when every group is kept
+}
+
+// Sort orders its input by OrderBy.
+type Sort struct {
+	Input   Node
+	OrderBy []queryparser.OrderByItem
+}
+
+// Project computes the output columns. Exprs are the SELECT list as written:
+// stars are expanded and aliases applied against the input's columns.
+type Project struct {
+	Input Node
+	Exprs []queryparser.Expression
+}
+
+// Distinct drops duplicate rows.
+type Distinct struct {
+	Input Node
+}
+
+// SetOp combines two inputs with UNION, INTERSECT or EXCEPT.
+type SetOp struct {
+	Left, Right Node
+	Op          string
+	All         bool
+}
+
+// With computes each CTE in order and makes it visible by name to the CTEs
+// after it and to Input.
+type With struct {
+	CTEs  []CTE
+	Input Node
+}
+
+// CTE is a named plan computed by With.
+type CTE struct {
+	Name string
+	Plan Node
+}
+
+func (n *Scan) Inputs() []Node      { return nil }
+func (n *Derived) Inputs() []Node   { return []Node{n.Input} }
+func (n *Pivot) Inputs() []Node     { return []Node{n.Input} }
+func (n *Values) Inputs() []Node    { return nil }
+func (n *Join) Inputs() []Node      { return []Node{n.Left, n.Right} }
+func (n *Filter) Inputs() []Node    { return []Node{n.Input} }
+func (n *Aggregate) Inputs() []Node { return []Node{n.Input} }
+func (n *Sort) Inputs() []Node      { return []Node{n.Input} }
+func (n *Project) Inputs() []Node   { return []Node{n.Input} }
+func (n *Distinct) Inputs() []Node  { return []Node{n.Input} }
+func (n *SetOp) Inputs() []Node     { return []Node{n.Left, n.Right} }
+
+func (n *With) Inputs() []Node {
+	inputs := make([]Node, 0, len(n.CTEs)+1)
+	for _, cte := range n.CTEs {
+		inputs = append(inputs, cte.Plan)
+	}
+	return append(inputs, n.Input)
+}
+
+func (n *Unnest) Inputs() []Node {
+	if n.Input == nil {
+		return nil
+	}
+	return []Node{n.Input}
+}
+
+func (n *Scan) String() string {
+	s := "Scan " + n.Table
+	if n.Alias != "" {
+		s += " AS " + n.Alias
+	}
+	s += formatColumns(n.Columns)
+	if n.Needed != nil {
+		s += " [" + strings.Join(n.Needed, ", ") + "]"
+	}
+	return s
+}
+
+func (n *Derived) String() string {
+	s := "Derived"
+	if n.Alias != "" {
+		s += " " + n.Alias
+	}
+	return s + formatColumns(n.Columns)
+}
+
+func (n *Pivot) String() string {
+	s := n.Clause.String()
+	if n.Alias != "" {
+		s += " " + n.Alias
+	}
+	return s + formatColumns(n.Columns)
+}
+
+func (n *Unnest) String() string {
+	s := n.Clause.String()
+	if n.Alias != "" {
+		s += " " + n.Alias
+	}
+	s += formatColumns(n.Columns)
+	switch {
+	case n.Outer:
+		s = "LEFT JOIN " + s
+	case n.Input != nil:
+		s = "JOIN " + s
+	}
+	if n.On != nil {
+		s += " ON " + queryparser.FormatExpr(n.On)
+	}
+	return s
+}
+
+func (n *Values) String() string {
+	return fmt.Sprintf("Values %d rows", len(n.Rows))
+}
+
+func (n *Join) String() string {
+	s := "Join " + n.Type
+	if n.On != nil {
+		s += " ON " + queryparser.FormatExpr(n.On)
+	}
+	return s
+}
+
+func (n *Filter) String() string {
+	return "Filter " + queryparser.FormatExpr(n.Condition)
+}
+
+func (n *Aggregate) String() string {
+	s := "Aggregate"
+	if len(n.GroupBy) > 0 {
+		s += " GROUP BY " + formatExprs(n.GroupBy)
+	}
+	if n.Having != nil {
+		s += " HAVING " + queryparser.FormatExpr(n.Having)
+	}
+	return s
+}
+
+func (n *Sort) String() string {
+	keys := make([]string, len(n.OrderBy))
+	for i, item := range n.OrderBy {
+		keys[i] = item.String()
+	}
+	return "Sort " + strings.Join(keys, ", ")
+}
+
+func (n *Project) String() string {
+	return "Project " + formatExprs(n.Exprs)
+}
+
+func (n *Distinct) String() string { return "Distinct" }
+
+func (n *SetOp) String() string {
+	if n.All {
+		return n.Op + " ALL"
+	}
+	return n.Op
+}
+
+func (n *With) String() string {
+	names := make([]string, len(n.CTEs))
+	for i, cte := range n.CTEs {
+		names[i] = cte.Name
+	}
+	return "With " + strings.Join(names, ", ")
+}
+
+func formatExprs(exprs []queryparser.Expression) string {
+	s := make([]string, len(exprs))
+	for i, e := range exprs {
+		s[i] = queryparser.FormatExpr(e)
+	}
+	return strings.Join(s, ", ")
+}
+
+func formatColumns(columns []string) string {
+	if len(columns) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(columns, ", ") + ")"
+}
+
+// Format prints a plan as an indented tree, one operator per line with its
+// inputs below it.
+func Format(n Node) string {
+	var sb strings.Builder
+	var write func(n Node, depth int)
+	write = func(n Node, depth int) {
+		sb.WriteString(strings.Repeat("  ", depth) + n.String() + "\n")
+		for _, input := range n.Inputs() {
+			write(input, depth+1)
+		}
+	}
+	write(n, 0)
+	return sb.String()
+}
+
+// Build returns the logical plan of q. The plan of a SELECT reads bottom-up
+// in the order SQL evaluates its clauses: FROM and its joins, WHERE, GROUP BY
+// and HAVING, ORDER BY, the SELECT list and finally DISTINCT. ORDER BY comes
+// before the SELECT list as it may sort by columns the query does not return.
+func Build(q *queryparser.Query) Node {
+	if len(q.With) > 0 {
+		with := &With{CTEs: make([]CTE, len(q.With))}
+		for i, cte := range q.With {
+			with.CTEs[i] = CTE{Name: cte.Name, Plan: Build(cte.Query)}
+		}
+		inner := *q
+		inner.With = nil
+		with.Input = Build(&inner)
+		return with
+	}
+	if q.Values != nil {
+		return &Values{Rows: q.Values}
+	}
+	if len(q.SetOps) > 0 {
+		core := *q
+		core.SetOps, core.OrderBy = nil, nil
+		var n Node = Build(&core)
+		for _, op := range q.SetOps {
+			n = &SetOp{Left: n, Right: Build(op.Query), Op: op.Op, All: op.All}
+		}
+		if len(q.OrderBy) > 0 {
+			n = &Sort{Input: n, OrderBy: q.OrderBy}
+		}
+		return n
+	}
+	if q.DistinctOn != nil {
+		return Build(desugarDistinctOn(q))
+	}
+	if q.Qualify != nil {
+		return Build(desugarQualify(q))
+	}
+	if hasUnnest(q.Projections...) {
+		return Build(desugarUnnest(q))
+	}
+	q = DesugarQuery(q)
+
+	var n Node
+	if q.Unnest != nil {
+		n = &Unnest{Clause: q.Unnest, Alias: q.TableAlias, Columns: q.Columns}
+	} else {
+		n = buildTable(q.TableName, q.TableAlias, q.Columns, q.Subquery, q.Pivot)
+	}
+	for _, j := range q.Joins {
+		if j.Unnest != nil {
+			n = &Unnest{Input: n, Clause: j.Unnest, Alias: j.TableAlias, Columns: j.Columns, On: j.On, Outer: j.Type == "LEFT"}
+			continue
+		}
+		right := buildTable(j.TableName, j.TableAlias, j.Columns, j.Subquery, j.Pivot)
+		n = &Join{Left: n, Right: right, Type: j.Type, On: j.On}
+	}
+	if q.Where != nil {
+		n = &Filter{Input: n, Condition: q.Where}
+	}
+	if len(q.GroupBy) > 0 || q.Having != nil || hasAggregate(q.Projections...) {
+		n = &Aggregate{Input: n, GroupBy: q.GroupBy, Having: q.Having}
+	}
+	if len(q.OrderBy) > 0 {
+		n = &Sort{Input: n, OrderBy: q.OrderBy}
+	}
+	n = &Project{Input: n, Exprs: q.Projections}
+	if q.Distinct {
+		n = &Distinct{Input: n}
+	}
+	return n
+}
+
+// buildTable is the plan of a table in FROM or JOIN: a scan of a named
+// table, or the plan of a derived table's subquery, reshaped by pivot when it
+// is set. The pivot reads every column of the table, which it takes in full
+// from a query of its own, and the alias names the pivot's output; the
+// columns of a named table keep the table's name as their qualifier.
+func buildTable(name, alias string, columns []string, subquery *queryparser.Query, pivot *queryparser.PivotClause) Node {
+	if pivot != nil {
+		if alias == "" {
+			alias = name
+		}
+		input := &queryparser.Query{Projections: []queryparser.Expression{&queryparser.StarExpr{}}, TableName: name, Subquery: subquery}
+		return &Pivot{Input: Build(input), Clause: pivot, Alias: alias, Columns: columns}
+	}
+	if subquery != nil {
+		return &Derived{Input: Build(subquery), Alias: alias, Columns: columns}
+	}
+	return &Scan{Table: name, Alias: alias, Columns: columns}
+}
+
+// aggregateFunctions are the functions computed over a group of rows.
+var aggregateFunctions = map[string]bool{
+	"COUNT":           true,
+	"SUM":             true,
+	"AVG":             true,
+	"MIN":             true,
+	"MAX":             true,
+	"VARIANCE":        true,
+	"VAR_SAMP":        true,
+	"VAR_POP":         true,
+	"STDDEV":          true,
+	"STDDEV_SAMP":     true,
+	"STDDEV_POP":      true,
+	"MEDIAN":          true,
+	"PERCENTILE_CONT": true,
+	"STRING_AGG":      true,
+	"ARRAY_AGG":       true,
+	"FIRST":           true,
+	"LAST":            true,
+	"ANY_VALUE":       true,
+	"ARG_MAX":         true,
+	"ARG_MIN":         true,
+
+	"APPROX_COUNT_DISTINCT": true,
+	"APPROX_QUANTILE":       true,
+	"MODE":                  true,
+	"TOP_K":                 true,
+}
+
+// IsAggregate reports whether fc calls an aggregate function.
+func IsAggregate(fc *queryparser.FuncCall) bool {
+	return aggregateFunctions[strings.ToUpper(fc.Name)]
+}
+
+// hasAggregate reports whether any of exprs calls an aggregate function
+// outside a window.
+func hasAggregate(exprs ...queryparser.Expression) bool {
+	for _, expr := range exprs {
+		switch e := expr.(type) {
+		case *queryparser.FuncCall:
+			if IsAggregate(e) {
+				return true
+			}
+		case *queryparser.WindowExpr:
+			continue
+		}
+		if hasAggregate(queryparser.Children(expr)...) {
+			return true
+		}
+	}
+	return false
+}
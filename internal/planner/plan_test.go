@@ -0,0 +1,253 @@
+package planner
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+func mustParse(t *testing.T, sql string) *queryparser.Query {
+	t.Helper()
+	q, err := queryparser.NewParser(sql).Parse()
+	if err != nil {
+		t.Fatalf("parse %q failed: %v", sql, err)
+	}
+	return q
+}
+
+func TestBuild(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want string
+	}{
+		{
+			"SELECT Close FROM prices",
+			`
+Project Close
+  Scan prices`,
+		},
+		{
+			"SELECT DISTINCT p.Date, SUM(Close) AS total FROM prices p JOIN symbols s ON p.Date = s.Date WHERE Close BETWEEN 1 AND 2 GROUP BY p.Date HAVING COUNT(*) > 1 ORDER BY SUM(Close) DESC",
+			`
+Distinct
+  Project p.Date, SUM(Close) AS total
+    Sort SUM(Close) DESC
+      Aggregate GROUP BY p.Date HAVING (COUNT(*) > 1)
+        Filter ((Close >= 1) AND (Close <= 2))
+          Join INNER ON (p.Date = s.Date)
+            Scan prices AS p
+            Scan symbols AS s`,
+		},
+		{
+			"SELECT COUNT(*) FROM (SELECT * FROM prices) t(d)",
+			`
+Project COUNT(*)
+  Aggregate
+    Derived t (d)
+      Project *
+        Scan prices`,
+		},
+		{
+			"WITH w AS (SELECT * FROM (VALUES (1), (2)) v(x)) SELECT * FROM w UNION ALL SELECT 3 FROM prices ORDER BY 1",
+			`
+With w
+  Project *
+    Derived v (x)
+      Values 2 rows
+  Sort 1
+    UNION ALL
+      Project *
+        Scan w
+      Project 3
+        Scan prices`,
+		},
+		{
+			"SELECT p.total FROM prices PIVOT (SUM(Volume) FOR Date IN ('2020-12-01' AS total)) p",
+			`
+Project p.total
+  PIVOT (SUM(Volume) FOR Date IN ('2020-12-01' AS total)) p
+    Project *
+      Scan prices`,
+		},
+		{
+			"SELECT *, UNNEST(l) FROM t LEFT JOIN UNNEST(t.m) WITH ORDINALITY u ON u.ordinality > 1",
+			`
+Project * EXCLUDE (__unnest1), __unnest."__unnest1" AS unnest
+  JOIN UNNEST(l) __unnest (__unnest1)
+    LEFT JOIN UNNEST(t.m) WITH ORDINALITY u ON (u.ordinality > 1)
+      Scan t`,
+		},
+		{
+			// QUALIFY filters a derived table that computes its condition
+			"SELECT Close, ROW_NUMBER() OVER (ORDER BY Close) AS r FROM prices QUALIFY r = 1",
+			`
+Project * EXCLUDE (__qualify)
+  Filter "__qualify"
+    Derived
+      Project Close, ROW_NUMBER() OVER (ORDER BY Close) AS r, (ROW_NUMBER() OVER (ORDER BY Close) = 1) AS __qualify
+        Scan prices`,
+		},
+	}
+	for _, tt := range tests {
+		got := strings.TrimSpace(Format(Build(mustParse(t, tt.sql))))
+		if want := strings.TrimSpace(tt.want); got != want {
+			t.Errorf("%s: got plan\n%s\nwant\n%s", tt.sql, got, want)
+		}
+	}
+}
+
+// testTables describes tables by name. Tables without statistics have none.
+type testTables struct {
+	columns map[string][]string
+	stats   map[string]TableStats
+}
+
+func (t testTables) Columns(table string) ([]string, bool) {
+	cols, ok := t.columns[strings.ToLower(table)]
+	return cols, ok
+}
+
+func (t testTables) Stats(table string) (TableStats, bool) {
+	stats, ok := t.stats[strings.ToLower(table)]
+	return stats, ok
+}
+
+func TestOptimize(t *testing.T) {
+	tables := testTables{columns: map[string][]string{
+		"prices":  {"Date", "Close", "Volume"},
+		"symbols": {"Date", "Label"},
+	}}
+	tests := []struct {
+		sql  string
+		want string
+	}{
+		{
+			// Single-side conditions move into the join's inputs, conditions
+			// across both sides join the ON condition
+			"SELECT Label FROM prices p, symbols s WHERE p.Date = s.Date AND Close > 10 AND Label <> 'x'",
+			`
+Project Label
+  Join INNER ON (p.Date = s.Date)
+    Filter (Close > 10)
+      Scan prices AS p [Date, Close]
+    Filter (Label <> 'x')
+      Scan symbols AS s`,
+		},
+		{
+			// The padded side of an outer join keeps its filter above the join
+			"SELECT p.Date FROM prices p LEFT JOIN symbols s ON p.Date = s.Date WHERE Label IS NULL AND Volume > 1",
+			`
+Project p.Date
+  Filter (Label IS NULL)
+    Join LEFT ON (p.Date = s.Date)
+      Filter (Volume > 1)
+        Scan prices AS p [Date, Volume]
+      Scan symbols AS s`,
+		},
+		{
+			"SELECT x FROM (SELECT Close AS x FROM prices WHERE Volume > 1) t WHERE t.x < 5",
+			`
+Project x
+  Derived t
+    Project Close AS x
+      Filter ((Close < 5) AND (Volume > 1))
+        Scan prices [Close, Volume]`,
+		},
+		{
+			// Columns are unknown for a CTE, views and after SELECT *
+			"WITH prices AS (SELECT * FROM symbols) SELECT COUNT(*) FROM prices WHERE Date > 'a'",
+			`
+With prices
+  Project *
+    Scan symbols
+  Project COUNT(*)
+    Aggregate
+      Filter (Date > 'a')
+        Scan prices`,
+		},
+		{
+			"SELECT COUNT(*) FROM prices",
+			`
+Project COUNT(*)
+  Aggregate
+    Scan prices [Date]`,
+		},
+	}
+	for _, tt := range tests {
+		got := strings.TrimSpace(Format(Optimize(Build(mustParse(t, tt.sql)), tables)))
+		if want := strings.TrimSpace(tt.want); got != want {
+			t.Errorf("%s: got plan\n%s\nwant\n%s", tt.sql, got, want)
+		}
+	}
+}
+
+func TestJoinOrder(t *testing.T) {
+	tables := testTables{
+		columns: map[string][]string{
+			"orders":    {"id", "customer", "item"},
+			"customers": {"id", "country"},
+			"items":     {"id", "name"},
+			"countries": {"code"},
+		},
+		stats: map[string]TableStats{
+			"orders":    {Rows: 1000000, Distinct: []int64{1000000, 10000, 100}},
+			"customers": {Rows: 100000, Distinct: []int64{100000, 50}},
+			"items":     {Rows: 100, Distinct: []int64{100, 100}},
+		},
+	}
+	tests := []struct {
+		sql  string
+		want string
+	}{
+		{
+			// Joining the two small tables first would be a cross product
+			"SELECT name FROM items i, customers c, orders o WHERE o.item = i.id AND o.customer = c.id",
+			`
+Project name
+  Join INNER ON (o.customer = c.id)
+    Join INNER ON (o.item = i.id)
+      Scan orders AS o [customer, item]
+      Scan items AS i
+    Scan customers AS c [id]`,
+		},
+		{
+			// The written order is already the cheapest
+			"SELECT name FROM orders o JOIN items i ON o.item = i.id JOIN customers c ON o.customer = c.id",
+			`
+Project name
+  Join INNER ON (o.customer = c.id)
+    Join INNER ON (o.item = i.id)
+      Scan orders AS o [customer, item]
+      Scan items AS i
+    Scan customers AS c [id]`,
+		},
+		{
+			// Without statistics, and with SELECT *, joins keep their order
+			"SELECT name FROM items i, countries n, orders o WHERE o.item = i.id",
+			`
+Project name
+  Join INNER ON (o.item = i.id)
+    Join CROSS
+      Scan items AS i
+      Scan countries AS n
+    Scan orders AS o [item]`,
+		},
+		{
+			"SELECT * FROM items i, customers c, orders o WHERE o.item = i.id AND o.customer = c.id",
+			`
+Project *
+  Join INNER ON ((o.item = i.id) AND (o.customer = c.id))
+    Join CROSS
+      Scan items AS i
+      Scan customers AS c
+    Scan orders AS o`,
+		},
+	}
+	for _, tt := range tests {
+		got := strings.TrimSpace(Format(Optimize(Build(mustParse(t, tt.sql)), tables)))
+		if want := strings.TrimSpace(tt.want); got != want {
+			t.Errorf("%s: got plan\n%s\nwant\n%s", tt.sql, got, want)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package planner
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/kris-gaudel/tinylake/internal/queryparser"
+)
+
+// qualifyColumn is the hidden column desugarQualify computes QUALIFY into
+const qualifyColumn = "__qualify"
+
+// desugarQualify rewrites a query with QUALIFY into a subquery that computes
+// the condition as an extra column next to the projections, and an outer query
+// that keeps the rows where it holds and drops it again:
+//
+//	SELECT a, w AS r FROM t QUALIFY r = 1
+//	SELECT * EXCLUDE (__qualify) FROM (SELECT a, w AS r, w = 1 AS __qualify FROM t) WHERE __qualify
+//
+// Unqualified names in the condition that match a projection alias refer to
+// that projection. The inner query keeps the ORDER BY, which the filter
+// preserves, while DISTINCT moves to the outer query so it applies after the
+// filter.
+func desugarQualify(q *queryparser.Query) *queryparser.Query {
+	aliases := make([]string, len(q.Projections))
+	for i, expr := range q.Projections {
+		if a, ok := expr.(*queryparser.AliasExpr); ok {
+			aliases[i] = a.Alias
+		}
+	}
+	cond := queryparser.Transform(q.Qualify, func(expr queryparser.Expression) queryparser.Expression {
+		ref, ok := expr.(*queryparser.ColumnRef)
+		if !ok || ref.Table != "" {
+			return expr
+		}
+		for i, alias := range aliases {
+			if alias == ref.Name || (alias != "" && !ref.Quoted && strings.EqualFold(alias, ref.Name)) {
+				return q.Projections[i].(*queryparser.AliasExpr).Expr
+			}
+		}
+		return expr
+	})
+
+	inner := *q
+	inner.With, inner.Qualify, inner.Distinct = nil, nil, false
+	inner.Projections = append(append([]queryparser.Expression{}, q.Projections...),
+		&queryparser.AliasExpr{Expr: cond, Alias: qualifyColumn})
+	return &queryparser.Query{
+		Distinct:    q.Distinct,
+		Projections: []queryparser.Expression{&queryparser.StarExpr{Exclude: []string{qualifyColumn}}},
+		Subquery:    &inner,
+		Where:       &queryparser.ColumnRef{Name: qualifyColumn, Quoted: true},
+	}
+}
+
+// unnestAlias names the UNNEST desugarUnnest joins onto a query
+const unnestAlias = "__unnest"
+
+// desugarUnnest rewrites UNNEST in a SELECT list into UNNEST joined onto the
+// tables of the query, the calls reading the elements from its columns,
+// which a star leaves out:
+//
+//	SELECT a, UNNEST(l) AS x FROM t
+//	SELECT a, __unnest.__unnest1 AS x FROM t CROSS JOIN UNNEST(l) __unnest(__unnest1)
+//
+// The lists of several calls are read side by side, as the arguments of one
+// UNNEST. A call that is a whole projection without an alias is named unnest.
+func desugarUnnest(q *queryparser.Query) *queryparser.Query {
+	u := &queryparser.UnnestClause{}
+	var columns []string
+	out := *q
+	out.Projections = make([]queryparser.Expression, len(q.Projections))
+	for i, expr := range q.Projections {
+		if fc, ok := expr.(*queryparser.FuncCall); ok && isUnnest(fc) {
+			expr = &queryparser.AliasExpr{Expr: expr, Alias: "unnest"}
+		}
+		out.Projections[i] = queryparser.Transform(expr, func(e queryparser.Expression) queryparser.Expression {
+			fc, ok := e.(*queryparser.FuncCall)
+			if !ok || !isUnnest(fc) {
+				return e
+			}
+			u.Args = append(u.Args, fc.Args[0])
+			columns = append(columns, fmt.Sprintf("%s%d", unnestAlias, len(u.Args)))
+			return &queryparser.ColumnRef{Table: unnestAlias, Name: columns[len(columns)-1], Quoted: true}
+		})
+	}
+	for i, expr := range out.Projections {
+		if star, ok := expr.(*queryparser.StarExpr); ok {
+			excluded := *star
+			excluded.Exclude = append(append([]string{}, star.Exclude...), columns...)
+			out.Projections[i] = &excluded
+		}
+	}
+	out.Joins = append(append([]queryparser.JoinClause{}, q.Joins...),
+		queryparser.JoinClause{Type: "CROSS", TableAlias: unnestAlias, Columns: columns, Unnest: u})
+	return &out
+}
+
+// hasUnnest reports whether any of exprs calls UNNEST, outside the
+// subqueries in them.
+func hasUnnest(exprs ...queryparser.Expression) bool {
+	for _, expr := range exprs {
+		if fc, ok := expr.(*queryparser.FuncCall); ok && isUnnest(fc) {
+			return true
+		}
+		if hasUnnest(queryparser.Children(expr)...) {
+			return true
+		}
+	}
+	return false
+}
+
+// isUnnest reports whether fc is UNNEST of one list, as a SELECT list may
+// call it.
+func isUnnest(fc *queryparser.FuncCall) bool {
+	return strings.EqualFold(fc.Name, "UNNEST") && len(fc.Args) == 1
+}
+
+// desugarDistinctOn rewrites DISTINCT ON into a QUALIFY condition that keeps
+// the first row of each key in ORDER BY order:
+//
+//	SELECT DISTINCT ON (a) a, b FROM t ORDER BY a, b DESC
+//	SELECT a, b FROM t QUALIFY ROW_NUMBER() OVER (PARTITION BY a ORDER BY a, b DESC) = 1 ORDER BY a, b DESC
+//
+// A QUALIFY the query already has is applied together with it.
+func desugarDistinctOn(q *queryparser.Query) *queryparser.Query {
+	out := *q
+	out.Distinct, out.DistinctOn = false, nil
+	out.Qualify = &queryparser.BinaryExpr{
+		Left: &queryparser.WindowExpr{
+			Func:        &queryparser.FuncCall{Name: "ROW_NUMBER"},
+			PartitionBy: q.DistinctOn,
+			OrderBy:     q.OrderBy,
+		},
+		Op:    "=",
+		Right: &queryparser.Literal{Kind: queryparser.LiteralNumber, Value: "1"},
+	}
+	if q.Qualify != nil {
+		out.Qualify = &queryparser.BinaryExpr{Left: q.Qualify, Op: "AND", Right: out.Qualify}
+	}
+	return &out
+}
+
+// DesugarQuery returns a copy of q with syntactic shorthands lowered into core
+// expressions, so later stages only see the forms they evaluate directly.
+func DesugarQuery(q *queryparser.Query) *queryparser.Query {
+	out := *q
+	out.Projections = desugarExprs(q.Projections)
+	out.Where = DesugarExpr(q.Where)
+	out.GroupBy = desugarExprs(q.GroupBy)
+	out.Having = DesugarExpr(q.Having)
+
+	out.Joins = make([]queryparser.JoinClause, len(q.Joins))
+	for i, j := range q.Joins {
+		j.On = DesugarExpr(j.On)
+		out.Joins[i] = j
+	}
+
+	out.OrderBy = make([]queryparser.OrderByItem, len(q.OrderBy))
+	for i, item := range q.OrderBy {
+		item.Expr = DesugarExpr(item.Expr)
+		out.OrderBy[i] = item
+	}
+	return &out
+}
+
+func desugarExprs(exprs []queryparser.Expression) []queryparser.Expression {
+	if exprs == nil {
+		return nil
+	}
+	out := make([]queryparser.Expression, len(exprs))
+	for i, e := range exprs {
+		out[i] = DesugarExpr(e)
+	}
+	return out
+}
+
+// DesugarExpr lowers the shorthands in expr, as DesugarQuery does for a query.
+func DesugarExpr(expr queryparser.Expression) queryparser.Expression {
+	if expr == nil {
+		return nil
+	}
+	return queryparser.Transform(expr, desugarNode)
+}
+
+func desugarNode(expr queryparser.Expression) queryparser.Expression {
+	switch e := expr.(type) {
+	case *queryparser.BetweenExpr:
+		// x BETWEEN a AND b is x >= a AND x <= b, so it can be treated like any
+		// other pair of range comparisons; NOT BETWEEN is x < a OR x > b.
+		if e.Not {
+			return &queryparser.BinaryExpr{
+				Left:  &queryparser.BinaryExpr{Left: e.Expr, Op: "<", Right: e.Low},
+				Op:    "OR",
+				Right: &queryparser.BinaryExpr{Left: e.Expr, Op: ">", Right: e.High},
+			}
+		}
+		return &queryparser.BinaryExpr{
+			Left:  &queryparser.BinaryExpr{Left: e.Expr, Op: ">=", Right: e.Low},
+			Op:    "AND",
+			Right: &queryparser.BinaryExpr{Left: e.Expr, Op: "<=", Right: e.High},
+		}
+	}
+	return expr
+}
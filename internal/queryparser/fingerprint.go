@@ -0,0 +1,30 @@
+package queryparser
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Fingerprint reads the tokens of input, which need not be a valid statement,
+// and returns a key that two inputs share when they differ only in whitespace,
+// comments, the case of keywords and the values of their number and string
+// literals, along with those literals in the order they appear. Lexing errors
+// are returned as a SyntaxError, as Parse would return them.
+func Fingerprint(input string) (key string, literals []Token, err error) {
+	defer recoverSyntaxError(&err)
+
+	var sb strings.Builder
+	l := NewLexer(input)
+	for tok := l.NextToken(); tok.Type != TOKEN_EOF; tok = l.NextToken() {
+		switch tok.Type {
+		case TOKEN_LITERAL, TOKEN_STRING:
+			literals = append(literals, tok)
+			fmt.Fprintf(&sb, "%d ? ", tok.Type)
+		case TOKEN_IDENTIFIER:
+			fmt.Fprintf(&sb, "%d %t %q ", tok.Type, tok.Quoted, tok.Literal)
+		default:
+			fmt.Fprintf(&sb, "%d %q ", tok.Type, strings.ToUpper(tok.Literal))
+		}
+	}
+	return sb.String(), literals, nil
+}
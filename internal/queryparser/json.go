@@ -0,0 +1,308 @@
+package queryparser
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+// The JSON form of the AST mirrors the Go types. Every node is an object whose
+// keys are the field names in snake_case, leaving out fields that hold their
+// zero value. Expressions and statements also carry their type name under
+// "node", e.g. {"name":"Close","node":"ColumnRef"}, so they can be decoded.
+// Keys are written in sorted order, so equal trees encode to equal bytes.
+
+// nodeKey is the key holding the type name of an expression or statement
+const nodeKey = "node"
+
+// nodeTypes are the expression and statement types by the name used for them
+// under nodeKey.
+var nodeTypes = map[string]reflect.Type{}
+
+func init() {
+	for _, node := range []interface{}{
+		&Query{}, &ColumnRef{}, &Literal{}, &BinaryExpr{}, &FuncCall{}, &StarExpr{}, &UnaryExpr{},
+		&InExpr{}, &BetweenExpr{}, &LikeExpr{}, &IsNullExpr{}, &SubqueryExpr{}, &ExistsExpr{}, &WindowExpr{},
+		&CastExpr{}, &AliasExpr{}, &Parameter{}, &FieldExpr{}, &IndexExpr{},
+		&InsertStmt{}, &CreateTableStmt{}, &CreateViewStmt{}, &DropViewStmt{}, &DropTableStmt{},
+		&TruncateStmt{}, &DeleteStmt{}, &UpdateStmt{}, &MergeStmt{}, &CopyStmt{}, &ShowTablesStmt{},
+		&DescribeStmt{}, &SummarizeStmt{}, &SetStmt{},
+	} {
+		t := reflect.TypeOf(node).Elem()
+		nodeTypes[t.Name()] = t
+	}
+}
+
+var (
+	textMarshalerType   = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// EncodeJSON encodes a statement or expression as JSON.
+func EncodeJSON(node interface{}) ([]byte, error) {
+	v, err := encodeValue(reflect.ValueOf(node))
+	if err != nil {
+		return nil, err
+	}
+	var sb strings.Builder
+	enc := json.NewEncoder(&sb)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return []byte(strings.TrimSuffix(sb.String(), "\n")), nil
+}
+
+// DecodeStatementJSON decodes a statement written by EncodeJSON.
+func DecodeStatementJSON(data []byte) (Statement, error) {
+	v, err := decodeValue(data, reflect.TypeOf((*Statement)(nil)).Elem())
+	if err != nil {
+		return nil, err
+	}
+	if v.IsNil() {
+		return nil, fmt.Errorf("expected a statement, got null")
+	}
+	return v.Interface().(Statement), nil
+}
+
+// DecodeExpressionJSON decodes an expression written by EncodeJSON.
+func DecodeExpressionJSON(data []byte) (Expression, error) {
+	v, err := decodeValue(data, reflect.TypeOf((*Expression)(nil)).Elem())
+	if err != nil {
+		return nil, err
+	}
+	return v.Interface(), nil
+}
+
+func encodeValue(v reflect.Value) (interface{}, error) {
+	if !v.IsValid() {
+		return nil, nil
+	}
+	if v.Kind() != reflect.Ptr && v.Kind() != reflect.Interface && v.Type().Implements(textMarshalerType) {
+		text, err := v.Interface().(encoding.TextMarshaler).MarshalText()
+		return string(text), err
+	}
+
+	switch v.Kind() {
+	case reflect.Interface:
+		if v.IsNil() {
+			return nil, nil
+		}
+		return encodeValue(v.Elem())
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil, nil
+		}
+		if v.Elem().Kind() != reflect.Struct {
+			return nil, fmt.Errorf("cannot encode %s as JSON", v.Type())
+		}
+		obj, err := encodeStruct(v.Elem())
+		if err != nil {
+			return nil, err
+		}
+		if name := v.Elem().Type().Name(); nodeTypes[name] == v.Elem().Type() {
+			obj[nodeKey] = name
+		}
+		return obj, nil
+	case reflect.Struct:
+		return encodeStruct(v)
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil, nil
+		}
+		items := make([]interface{}, v.Len())
+		for i := range items {
+			item, err := encodeValue(v.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			items[i] = item
+		}
+		return items, nil
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Map:
+		return v.Interface(), nil
+	default:
+		return nil, fmt.Errorf("cannot encode %s as JSON", v.Type())
+	}
+}
+
+func encodeStruct(v reflect.Value) (map[string]interface{}, error) {
+	obj := map[string]interface{}{}
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if f.PkgPath != "" || v.Field(i).IsZero() {
+			continue
+		}
+		val, err := encodeValue(v.Field(i))
+		if err != nil {
+			return nil, err
+		}
+		obj[jsonKey(f.Name)] = val
+	}
+	return obj, nil
+}
+
+func decodeValue(data json.RawMessage, t reflect.Type) (reflect.Value, error) {
+	if string(data) == "null" {
+		return reflect.Zero(t), nil
+	}
+	if reflect.PtrTo(t).Implements(textUnmarshalerType) {
+		v := reflect.New(t)
+		err := json.Unmarshal(data, v.Interface())
+		return v.Elem(), err
+	}
+
+	switch t.Kind() {
+	case reflect.Interface:
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(data, &obj); err != nil {
+			return reflect.Value{}, err
+		}
+		var name string
+		if err := json.Unmarshal(obj[nodeKey], &name); err != nil || nodeTypes[name] == nil {
+			return reflect.Value{}, fmt.Errorf("unknown node type %s", obj[nodeKey])
+		}
+		v, err := decodeStruct(obj, nodeTypes[name])
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		if !v.Type().Implements(t) {
+			return reflect.Value{}, fmt.Errorf("%s is not a %s", name, t.Name())
+		}
+		return v, nil
+	case reflect.Ptr:
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(data, &obj); err != nil {
+			return reflect.Value{}, err
+		}
+		if name, ok := obj[nodeKey]; ok && string(name) != `"`+t.Elem().Name()+`"` {
+			return reflect.Value{}, fmt.Errorf("expected a %s, got %s", t.Elem().Name(), name)
+		}
+		return decodeStruct(obj, t.Elem())
+	case reflect.Struct:
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(data, &obj); err != nil {
+			return reflect.Value{}, err
+		}
+		v, err := decodeStruct(obj, t)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		return v.Elem(), nil
+	case reflect.Slice:
+		var items []json.RawMessage
+		if err := json.Unmarshal(data, &items); err != nil {
+			return reflect.Value{}, err
+		}
+		s := reflect.MakeSlice(t, len(items), len(items))
+		for i, item := range items {
+			v, err := decodeValue(item, t.Elem())
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			s.Index(i).Set(v)
+		}
+		return s, nil
+	default:
+		v := reflect.New(t)
+		err := json.Unmarshal(data, v.Interface())
+		return v.Elem(), err
+	}
+}
+
+// decodeStruct decodes the fields of obj into a new t and returns a pointer to
+// it. Keys that are not fields of t are an error.
+func decodeStruct(obj map[string]json.RawMessage, t reflect.Type) (reflect.Value, error) {
+	v := reflect.New(t)
+	fields := map[string]int{}
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).PkgPath == "" {
+			fields[jsonKey(t.Field(i).Name)] = i
+		}
+	}
+	for key, raw := range obj {
+		if key == nodeKey {
+			continue
+		}
+		i, ok := fields[key]
+		if !ok {
+			return reflect.Value{}, fmt.Errorf("unknown field %s in %s", key, t.Name())
+		}
+		val, err := decodeValue(raw, t.Field(i).Type)
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("%s.%s: %w", t.Name(), key, err)
+		}
+		v.Elem().Field(i).Set(val)
+	}
+	return v, nil
+}
+
+// jsonKey converts a Go field name such as TableName to table_name
+func jsonKey(name string) string {
+	var sb strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				sb.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		sb.WriteRune(r)
+	}
+	return sb.String()
+}
+
+var literalKindNames = []string{"number", "string", "date", "timestamp", "interval", "bool", "null"}
+
+func (k LiteralKind) MarshalText() ([]byte, error) {
+	return marshalEnum(int(k), literalKindNames, "literal kind")
+}
+
+func (k *LiteralKind) UnmarshalText(text []byte) error {
+	i, err := unmarshalEnum(text, literalKindNames, "literal kind")
+	*k = LiteralKind(i)
+	return err
+}
+
+var boundKindNames = []string{"unbounded_preceding", "preceding", "current_row", "following", "unbounded_following"}
+
+func (k BoundKind) MarshalText() ([]byte, error) {
+	return marshalEnum(int(k), boundKindNames, "frame bound")
+}
+
+func (k *BoundKind) UnmarshalText(text []byte) error {
+	i, err := unmarshalEnum(text, boundKindNames, "frame bound")
+	*k = BoundKind(i)
+	return err
+}
+
+var nullOrderNames = []string{"default", "first", "last"}
+
+func (o NullOrder) MarshalText() ([]byte, error) {
+	return marshalEnum(int(o), nullOrderNames, "null order")
+}
+
+func (o *NullOrder) UnmarshalText(text []byte) error {
+	i, err := unmarshalEnum(text, nullOrderNames, "null order")
+	*o = NullOrder(i)
+	return err
+}
+
+func marshalEnum(i int, names []string, what string) ([]byte, error) {
+	if i < 0 || i >= len(names) {
+		return nil, fmt.Errorf("invalid %s %d", what, i)
+	}
+	return []byte(names[i]), nil
+}
+
+func unmarshalEnum(text []byte, names []string, what string) (int, error) {
+	for i, name := range names {
+		if string(text) == name {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown %s %q", what, text)
+}
@@ -2,26 +2,199 @@ package queryparser
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 	"unicode"
 )
 
+// Statement is a single parsed SQL statement. Scripts parse into a list of
+// them; a *Query is a SELECT statement and the other kinds are in statements.go.
+type Statement interface {
+	String() string
+}
+
 type Query struct {
-	Projections []Expression // list of projections (columns or simple expressions)
-	TableName   string       // FROM table
-	Where       Expression   // filter expression (WHERE condition), can be nil
+	With        []CommonTableExpr // WITH clause, visible to the whole query
+	Distinct    bool              // SELECT DISTINCT: drop duplicate result rows
+	DistinctOn  []Expression      // DISTINCT ON keys: keep the first row, in ORDER BY order, of each key
+	Projections []Expression      // list of projections (columns or simple expressions)
+	TableName   string            // FROM table
+	TableAlias  string            // alias of the FROM table, can be empty
+	Columns     []string          // column aliases given after TableAlias, e.g. t(a, b)
+	Subquery    *Query            // derived table in FROM, set instead of TableName
+	Pivot       *PivotClause      // PIVOT or UNPIVOT applied to the FROM table, can be nil
+	Unnest      *UnnestClause     // UNNEST in FROM, set instead of TableName
+	Joins       []JoinClause      // tables joined onto the FROM table, in written order
+	Where       Expression        // filter expression (WHERE condition), can be nil
 	GroupBy     []Expression
+	Having      Expression     // filter applied to each group, can be nil
+	Qualify     Expression     // filter applied after window functions, can be nil
+	SetOps      []SetOperation // set operations combining further SELECTs, applied left to right
+	OrderBy     []OrderByItem  // ORDER BY keys, applied to the final result
+	Values      [][]Expression // rows of a VALUES list, which stands in for the whole SELECT
+}
+
+// SetOperation combines the rows of the query so far with another SELECT
+type SetOperation struct {
+	Op    string // "UNION", "INTERSECT" or "EXCEPT"
+	All   bool   // keep duplicates
+	Query *Query
+}
+
+// CommonTableExpr is a named query defined in a WITH clause
+type CommonTableExpr struct {
+	Name  string
+	Query *Query
+}
+
+// JoinClause is a single JOIN onto the tables to its left
+type JoinClause struct {
+	Type       string // "INNER", "LEFT", "RIGHT", "FULL" or "CROSS"
+	TableName  string
+	TableAlias string
+	Columns    []string      // column aliases given after TableAlias
+	Subquery   *Query        // derived table, set instead of TableName
+	Pivot      *PivotClause  // PIVOT or UNPIVOT applied to the table, can be nil
+	Unnest     *UnnestClause // UNNEST joined laterally, set instead of TableName
+	On         Expression    // join condition, nil for CROSS joins
+}
+
+// PivotClause reshapes a table in FROM or JOIN. PIVOT (agg, ... FOR column
+// IN (value, ...)) turns the values of column into columns, one for each
+// value and aggregate, holding the aggregate over the rows with that value;
+// the table's other columns, less those the aggregates read, group the rows.
+// UNPIVOT (value FOR name IN (column, ...)) turns the columns into rows, each
+// with the column's name in name and its value, unless NULL, in value. The
+// aggregates and the values may be given aliases with AS, which name the
+// columns PIVOT makes.
+type PivotClause struct {
+	Unpivot    bool
+	Aggregates []Expression // PIVOT
+	For        string       // the column PIVOT reads the values of, or UNPIVOT writes the names to
+	In         []Expression // PIVOT values
+	Value      string       // the column UNPIVOT writes the values to
+	Columns    []string     // UNPIVOT columns
+}
+
+func (c *PivotClause) String() string {
+	if c.Unpivot {
+		return fmt.Sprintf("UNPIVOT (%s FOR %s IN (%s))", c.Value, c.For, strings.Join(c.Columns, ", "))
+	}
+	aggs := make([]string, len(c.Aggregates))
+	for i, agg := range c.Aggregates {
+		aggs[i] = formatExpr(agg)
+	}
+	values := make([]string, len(c.In))
+	for i, v := range c.In {
+		values[i] = formatExpr(v)
+	}
+	return fmt.Sprintf("PIVOT (%s FOR %s IN (%s))", strings.Join(aggs, ", "), c.For, strings.Join(values, ", "))
+}
+
+// UnnestClause is UNNEST(list, ...) in FROM or JOIN, a table with a row for
+// each element of its lists, which are read side by side, the shorter ones
+// padded with NULLs. WITH ORDINALITY adds a column numbering the rows from 1.
+// In a JOIN the lists may read the columns of the tables to its left, and
+// are read once for each of their rows.
+type UnnestClause struct {
+	Args       []Expression
+	Ordinality bool
+}
+
+func (u *UnnestClause) String() string {
+	args := make([]string, len(u.Args))
+	for i, arg := range u.Args {
+		args[i] = formatExpr(arg)
+	}
+	s := "UNNEST(" + strings.Join(args, ", ") + ")"
+	if u.Ordinality {
+		s += " WITH ORDINALITY"
+	}
+	return s
+}
+
+// OrderByItem is a single ORDER BY key
+type OrderByItem struct {
+	Expr  Expression
+	Desc  bool      // DESC, sorting from largest to smallest
+	Nulls NullOrder // NULLS FIRST or NULLS LAST
+}
+
+// NullOrder is where an ORDER BY key puts NULLs
+type NullOrder int
+
+const (
+	NullsDefault NullOrder = iota // not given, the session's null_ordering applies
+	NullsFirst
+	NullsLast
+)
+
+func (item OrderByItem) String() string {
+	s := formatExpr(item.Expr)
+	if item.Desc {
+		s += " DESC"
+	}
+	switch item.Nulls {
+	case NullsFirst:
+		s += " NULLS FIRST"
+	case NullsLast:
+		s += " NULLS LAST"
+	}
+	return s
 }
 
 // Expression represents a parsed expression
 type Expression interface{}
 
 type ColumnRef struct {
-	Name string
+	Table  string // optional table name or alias qualifier, or a struct column whose field Name is
+	Name   string
+	Quoted bool // quoted names match case-sensitively
+	Pos    Pos
+}
+
+// FieldExpr reads a field of a struct: t.payload.price, or (expr).price. A
+// two-part name such as payload.price is a ColumnRef, which reads the field
+// when payload names a struct column rather than a table.
+type FieldExpr struct {
+	Expr   Expression
+	Field  string
+	Quoted bool // quoted names match case-sensitively
+	Pos    Pos
+}
+
+// IndexExpr reads an element of a list: tags[1]. Elements count from 1, and
+// an index outside the list reads NULL.
+type IndexExpr struct {
+	Expr  Expression
+	Index Expression
+	Pos   Pos
 }
 
 type Literal struct {
 	Value string
+	Kind  LiteralKind
+	Pos   Pos
+}
+
+// LiteralKind tags what a literal's text denotes, so '123' stays a string
+type LiteralKind int
+
+const (
+	LiteralNumber LiteralKind = iota
+	LiteralString
+	LiteralDate      // DATE '2021-01-01'
+	LiteralTimestamp // TIMESTAMP '2021-01-01 09:30:00'
+	LiteralInterval  // INTERVAL '7 days'
+	LiteralBool      // TRUE or FALSE
+	LiteralNull      // NULL
+)
+
+// typedLiteralKinds maps the keyword before a typed literal to its kind
+var typedLiteralKinds = map[string]LiteralKind{
+	"DATE":      LiteralDate,
+	"TIMESTAMP": LiteralTimestamp,
+	"INTERVAL":  LiteralInterval,
 }
 
 type BinaryExpr struct {
@@ -31,11 +204,149 @@ type BinaryExpr struct {
 }
 
 type FuncCall struct {
-	Name string
-	Args []Expression
+	Name     string
+	Args     []Expression
+	Distinct bool // aggregate over distinct argument values: COUNT(DISTINCT x)
+	Pos      Pos
+}
+
+// StarExpr is * in a SELECT list or COUNT(*). In a SELECT list it may be
+// followed by EXCLUDE (column, ...) and REPLACE (expr AS column, ...).
+type StarExpr struct {
+	Exclude []string     // columns left out
+	Replace []*AliasExpr // columns whose values are replaced, keeping their position
+}
+
+// UnaryExpr is a prefix operator applied to an operand, e.g. NOT x
+type UnaryExpr struct {
+	Op   string
+	Expr Expression
+}
+
+// InExpr is expr [NOT] IN (subquery) or expr [NOT] IN (value, ...)
+type InExpr struct {
+	Expr     Expression
+	Subquery *Query       // set for IN (SELECT ...)
+	Values   []Expression // set for IN (value, ...)
+	Not      bool
+}
+
+// BetweenExpr is expr [NOT] BETWEEN low AND high
+type BetweenExpr struct {
+	Expr Expression
+	Low  Expression
+	High Expression
+	Not  bool
+}
+
+// LikeExpr is expr [NOT] LIKE pattern. In the pattern % matches any run of
+// characters, _ matches one, and a backslash makes the character after it
+// match only itself.
+type LikeExpr struct {
+	Expr    Expression
+	Pattern Expression
+	Not     bool
+}
+
+// IsNullExpr is expr IS [NOT] NULL
+type IsNullExpr struct {
+	Expr Expression
+	Not  bool
+}
+
+// SubqueryExpr is a scalar subquery used as a value: (SELECT MAX(x) FROM t)
+type SubqueryExpr struct {
+	Subquery *Query
+}
+
+// ExistsExpr is [NOT] EXISTS (subquery)
+type ExistsExpr struct {
+	Subquery *Query
+	Not      bool
+}
+
+// WindowExpr is a function evaluated over a window of rows:
+// fn(args) OVER (PARTITION BY ... ORDER BY ...)
+type WindowExpr struct {
+	Func        *FuncCall
+	PartitionBy []Expression
+	OrderBy     []OrderByItem // orders rows within each partition, can be empty
+	Frame       *WindowFrame  // rows an aggregate covers, nil for the default frame
+}
+
+// WindowFrame limits a window aggregate to the rows between Start and End,
+// e.g. ROWS BETWEEN 6 PRECEDING AND CURRENT ROW. In a RANGE frame the bounds
+// are ORDER BY values rather than rows, e.g. RANGE BETWEEN INTERVAL '7 days'
+// PRECEDING AND CURRENT ROW, and CURRENT ROW takes in the current row's peers.
+type WindowFrame struct {
+	Range bool
+	Start FrameBound
+	End   FrameBound
+}
+
+// FrameBound is one end of a window frame
+type FrameBound struct {
+	Kind   BoundKind
+	Offset int      // rows before or after the current row, for Preceding and Following in ROWS
+	Value  *Literal // how far the ORDER BY value is from the current row's, a number or an INTERVAL, in RANGE
 }
 
-type StarExpr struct{}
+// BoundKind is where a frame bound lies relative to the current row
+type BoundKind int
+
+const (
+	UnboundedPreceding BoundKind = iota // the first row of the partition
+	Preceding                           // n PRECEDING
+	CurrentRow                          // CURRENT ROW
+	Following                           // n FOLLOWING
+	UnboundedFollowing                  // the last row of the partition
+)
+
+func (f *WindowFrame) String() string {
+	unit := "ROWS"
+	if f.Range {
+		unit = "RANGE"
+	}
+	return fmt.Sprintf("%s BETWEEN %s AND %s", unit, f.Start, f.End)
+}
+
+func (b FrameBound) String() string {
+	offset := strconv.Itoa(b.Offset)
+	if b.Value != nil {
+		offset = formatExpr(b.Value)
+	}
+	switch b.Kind {
+	case UnboundedPreceding:
+		return "UNBOUNDED PRECEDING"
+	case Preceding:
+		return offset + " PRECEDING"
+	case CurrentRow:
+		return "CURRENT ROW"
+	case Following:
+		return offset + " FOLLOWING"
+	default:
+		return "UNBOUNDED FOLLOWING"
+	}
+}
+
+// CastExpr converts a value to another type: CAST(expr AS type) or expr::type
+type CastExpr struct {
+	Expr Expression
+	Type string // SQL type name as written, upper-cased, e.g. "BIGINT" or "VARCHAR(10)"
+}
+
+// AliasExpr names a projection: expr AS alias
+type AliasExpr struct {
+	Expr  Expression
+	Alias string
+}
+
+// Parameter stands for a value given when a prepared query runs: $1 is the
+// first, and each ? is the one after the ? before it
+type Parameter struct {
+	Index int // from 1
+	Pos   Pos
+}
 
 type TokenType int
 
@@ -57,24 +368,102 @@ const (
 	TOKEN_SLASH
 	TOKEN_LPAREN
 	TOKEN_RPAREN
+	TOKEN_LBRACKET
+	TOKEN_RBRACKET
 	TOKEN_GROUP
 	TOKEN_BY
+	TOKEN_ORDER
+	TOKEN_HAVING
+	TOKEN_QUALIFY
+	TOKEN_DOT
+	TOKEN_JOIN
+	TOKEN_INNER
+	TOKEN_LEFT
+	TOKEN_RIGHT
+	TOKEN_FULL
+	TOKEN_OUTER
+	TOKEN_CROSS
+	TOKEN_IN
+	TOKEN_EXISTS
+	TOKEN_WITH
+	TOKEN_UNION
+	TOKEN_INTERSECT
+	TOKEN_EXCEPT
+	TOKEN_ALL
+	TOKEN_BETWEEN
+	TOKEN_LIKE
+	TOKEN_STRING
+	TOKEN_ON
+	TOKEN_AS
+	TOKEN_OVER
+	TOKEN_PARTITION
+	TOKEN_DOUBLECOLON
+	TOKEN_SEMICOLON
+	TOKEN_INSERT
+	TOKEN_INTO
+	TOKEN_VALUES
+	TOKEN_CREATE
+	TOKEN_TABLE
+	TOKEN_DELETE
+	TOKEN_UPDATE
+	TOKEN_SET
+	TOKEN_COPY
+	TOKEN_TO
+	TOKEN_SHOW
+	TOKEN_DESCRIBE
+	TOKEN_ASC
+	TOKEN_DESC
+	TOKEN_TRUE
+	TOKEN_FALSE
+	TOKEN_NULL
+	TOKEN_IS
+	TOKEN_DROP
+	TOKEN_TRUNCATE
+	TOKEN_MERGE
+	TOKEN_DISTINCT
+	TOKEN_PARAM
 )
 
 type Token struct {
 	Type    TokenType
 	Literal string
+	Quoted  bool // identifier written as "name" or `name`
+	Pos     Pos  // where the token starts
 }
 
 type Lexer struct {
-	input []rune
-	pos   int
+	input      []rune
+	pos        int
+	start      int   // offset of the token being read
+	lineStarts []int // offset of the first character of each line
 }
 
 // Helper functions to print tokens
 func (q *Query) String() string {
+	if q.Values != nil {
+		return formatValues(q.Values)
+	}
 	var sb strings.Builder
+	if len(q.With) > 0 {
+		sb.WriteString("WITH ")
+		for i, cte := range q.With {
+			sb.WriteString(fmt.Sprintf("%s AS (%s)", cte.Name, cte.Query.String()))
+			if i != len(q.With)-1 {
+				sb.WriteString(", ")
+			}
+		}
+		sb.WriteString(" ")
+	}
 	sb.WriteString("SELECT ")
+	if len(q.DistinctOn) > 0 {
+		keys := make([]string, len(q.DistinctOn))
+		for i, key := range q.DistinctOn {
+			keys[i] = formatExpr(key)
+		}
+		sb.WriteString("DISTINCT ON (" + strings.Join(keys, ", ") + ") ")
+	} else if q.Distinct {
+		sb.WriteString("DISTINCT ")
+	}
 
 	for i, expr := range q.Projections {
 		sb.WriteString(formatExpr(expr))
@@ -83,22 +472,127 @@ func (q *Query) String() string {
 		}
 	}
 
-	sb.WriteString(fmt.Sprintf(" FROM %s", q.TableName))
+	sb.WriteString(" FROM " + formatTableRef(tableRef{q.TableName, q.TableAlias, q.Columns, q.Subquery, q.Pivot, q.Unnest}))
+
+	for _, j := range q.Joins {
+		sb.WriteString(fmt.Sprintf(" %s JOIN %s", j.Type, formatTableRef(tableRef{j.TableName, j.TableAlias, j.Columns, j.Subquery, j.Pivot, j.Unnest})))
+		if j.On != nil {
+			sb.WriteString(" ON ")
+			sb.WriteString(formatExpr(j.On))
+		}
+	}
 
 	if q.Where != nil {
 		sb.WriteString(" WHERE ")
 		sb.WriteString(formatExpr(q.Where))
 	}
 
+	if len(q.GroupBy) > 0 {
+		sb.WriteString(" GROUP BY ")
+		for i, expr := range q.GroupBy {
+			sb.WriteString(formatExpr(expr))
+			if i != len(q.GroupBy)-1 {
+				sb.WriteString(", ")
+			}
+		}
+	}
+
+	if q.Having != nil {
+		sb.WriteString(" HAVING ")
+		sb.WriteString(formatExpr(q.Having))
+	}
+
+	if q.Qualify != nil {
+		sb.WriteString(" QUALIFY ")
+		sb.WriteString(formatExpr(q.Qualify))
+	}
+
+	for _, op := range q.SetOps {
+		sb.WriteString(" " + op.Op)
+		if op.All {
+			sb.WriteString(" ALL")
+		}
+		sb.WriteString(" " + op.Query.String())
+	}
+
+	if len(q.OrderBy) > 0 {
+		sb.WriteString(" ORDER BY ")
+		for i, item := range q.OrderBy {
+			sb.WriteString(item.String())
+			if i != len(q.OrderBy)-1 {
+				sb.WriteString(", ")
+			}
+		}
+	}
+
 	return sb.String()
 }
 
+func formatTableRef(ref tableRef) string {
+	s := ref.name
+	switch {
+	case ref.subquery != nil:
+		s = "(" + ref.subquery.String() + ")"
+	case ref.unnest != nil:
+		s = ref.unnest.String()
+	}
+	if ref.pivot != nil {
+		s += " " + ref.pivot.String()
+	}
+	if ref.alias != "" {
+		s += " " + ref.alias
+	}
+	if len(ref.columns) > 0 {
+		s += "(" + strings.Join(ref.columns, ", ") + ")"
+	}
+	return s
+}
+
+func formatValues(rows [][]Expression) string {
+	lists := make([]string, len(rows))
+	for i, row := range rows {
+		vals := make([]string, len(row))
+		for j, v := range row {
+			vals[j] = formatExpr(v)
+		}
+		lists[i] = "(" + strings.Join(vals, ", ") + ")"
+	}
+	return "VALUES " + strings.Join(lists, ", ")
+}
+
+// FormatExpr writes expr back as SQL.
+func FormatExpr(expr Expression) string {
+	return formatExpr(expr)
+}
+
 func formatExpr(expr Expression) string {
 	switch e := expr.(type) {
 	case *ColumnRef:
-		return e.Name
+		name := e.Name
+		if e.Quoted {
+			name = `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+		}
+		if e.Table != "" {
+			return e.Table + "." + name
+		}
+		return name
 	case *Literal:
+		quoted := "'" + strings.ReplaceAll(e.Value, "'", "''") + "'"
+		switch e.Kind {
+		case LiteralString:
+			return quoted
+		case LiteralDate:
+			return "DATE " + quoted
+		case LiteralTimestamp:
+			return "TIMESTAMP " + quoted
+		case LiteralInterval:
+			return "INTERVAL " + quoted
+		case LiteralBool, LiteralNull:
+			return strings.ToUpper(e.Value)
+		}
 		return fmt.Sprintf("%v", e.Value)
+	case *Parameter:
+		return fmt.Sprintf("$%d", e.Index)
 	case *BinaryExpr:
 		return fmt.Sprintf("(%s %s %s)", formatExpr(e.Left), e.Op, formatExpr(e.Right))
 	case *FuncCall:
@@ -106,21 +600,119 @@ func formatExpr(expr Expression) string {
 		for i, a := range e.Args {
 			argStrs[i] = formatExpr(a)
 		}
+		if e.Distinct {
+			return fmt.Sprintf("%s(DISTINCT %s)", e.Name, strings.Join(argStrs, ", "))
+		}
 		return fmt.Sprintf("%s(%s)", e.Name, strings.Join(argStrs, ", "))
 	case *StarExpr:
-		return "*"
+		s := "*"
+		if len(e.Exclude) > 0 {
+			s += " EXCLUDE (" + strings.Join(e.Exclude, ", ") + ")"
+		}
+		if len(e.Replace) > 0 {
+			repl := make([]string, len(e.Replace))
+			for i, r := range e.Replace {
+				repl[i] = formatExpr(r)
+			}
+			s += " REPLACE (" + strings.Join(repl, ", ") + ")"
+		}
+		return s
+	case *AliasExpr:
+		return fmt.Sprintf("%s AS %s", formatExpr(e.Expr), e.Alias)
+	case *InExpr:
+		op := "IN"
+		if e.Not {
+			op = "NOT IN"
+		}
+		if e.Subquery != nil {
+			return fmt.Sprintf("(%s %s (%s))", formatExpr(e.Expr), op, e.Subquery.String())
+		}
+		vals := make([]string, len(e.Values))
+		for i, v := range e.Values {
+			vals[i] = formatExpr(v)
+		}
+		return fmt.Sprintf("(%s %s (%s))", formatExpr(e.Expr), op, strings.Join(vals, ", "))
+	case *UnaryExpr:
+		return fmt.Sprintf("(%s %s)", e.Op, formatExpr(e.Expr))
+	case *IsNullExpr:
+		if e.Not {
+			return fmt.Sprintf("(%s IS NOT NULL)", formatExpr(e.Expr))
+		}
+		return fmt.Sprintf("(%s IS NULL)", formatExpr(e.Expr))
+	case *BetweenExpr:
+		op := "BETWEEN"
+		if e.Not {
+			op = "NOT BETWEEN"
+		}
+		return fmt.Sprintf("(%s %s %s AND %s)", formatExpr(e.Expr), op, formatExpr(e.Low), formatExpr(e.High))
+	case *LikeExpr:
+		op := "LIKE"
+		if e.Not {
+			op = "NOT LIKE"
+		}
+		return fmt.Sprintf("(%s %s %s)", formatExpr(e.Expr), op, formatExpr(e.Pattern))
+	case *WindowExpr:
+		var parts []string
+		if len(e.PartitionBy) > 0 {
+			keys := make([]string, len(e.PartitionBy))
+			for i, k := range e.PartitionBy {
+				keys[i] = formatExpr(k)
+			}
+			parts = append(parts, "PARTITION BY "+strings.Join(keys, ", "))
+		}
+		if len(e.OrderBy) > 0 {
+			keys := make([]string, len(e.OrderBy))
+			for i, item := range e.OrderBy {
+				keys[i] = item.String()
+			}
+			parts = append(parts, "ORDER BY "+strings.Join(keys, ", "))
+		}
+		if e.Frame != nil {
+			parts = append(parts, e.Frame.String())
+		}
+		return fmt.Sprintf("%s OVER (%s)", formatExpr(e.Func), strings.Join(parts, " "))
+	case *CastExpr:
+		return fmt.Sprintf("CAST(%s AS %s)", formatExpr(e.Expr), e.Type)
+	case *FieldExpr:
+		field := e.Field
+		if e.Quoted {
+			field = `"` + strings.ReplaceAll(field, `"`, `""`) + `"`
+		}
+		return formatExpr(e.Expr) + "." + field
+	case *IndexExpr:
+		return fmt.Sprintf("%s[%s]", formatExpr(e.Expr), formatExpr(e.Index))
+	case *SubqueryExpr:
+		return fmt.Sprintf("(%s)", e.Subquery.String())
+	case *ExistsExpr:
+		op := "EXISTS"
+		if e.Not {
+			op = "NOT EXISTS"
+		}
+		return fmt.Sprintf("%s (%s)", op, e.Subquery.String())
 	default:
 		return "UNKNOWN_EXPR"
 	}
 }
 
 func NewLexer(input string) *Lexer {
-	return &Lexer{input: []rune(input)}
+	l := &Lexer{input: []rune(input), lineStarts: []int{0}}
+	for i, ch := range l.input {
+		if ch == '\n' {
+			l.lineStarts = append(l.lineStarts, i+1)
+		}
+	}
+	return l
 }
 
 func (l *Lexer) NextToken() Token {
 	l.skipWhitespace()
+	l.start = l.pos
+	tok := l.readToken()
+	tok.Pos = l.position(l.start)
+	return tok
+}
 
+func (l *Lexer) readToken() Token {
 	if l.pos >= len(l.input) {
 		return Token{Type: TOKEN_EOF}
 	}
@@ -137,6 +729,50 @@ func (l *Lexer) NextToken() Token {
 		switch strings.ToUpper(word) {
 		case "SELECT":
 			return Token{Type: TOKEN_SELECT, Literal: word}
+		case "INSERT":
+			return Token{Type: TOKEN_INSERT, Literal: word}
+		case "INTO":
+			return Token{Type: TOKEN_INTO, Literal: word}
+		case "VALUES":
+			return Token{Type: TOKEN_VALUES, Literal: word}
+		case "CREATE":
+			return Token{Type: TOKEN_CREATE, Literal: word}
+		case "TABLE":
+			return Token{Type: TOKEN_TABLE, Literal: word}
+		case "DELETE":
+			return Token{Type: TOKEN_DELETE, Literal: word}
+		case "UPDATE":
+			return Token{Type: TOKEN_UPDATE, Literal: word}
+		case "SET":
+			return Token{Type: TOKEN_SET, Literal: word}
+		case "COPY":
+			return Token{Type: TOKEN_COPY, Literal: word}
+		case "TO":
+			return Token{Type: TOKEN_TO, Literal: word}
+		case "SHOW":
+			return Token{Type: TOKEN_SHOW, Literal: word}
+		case "DESCRIBE":
+			return Token{Type: TOKEN_DESCRIBE, Literal: word}
+		case "DROP":
+			return Token{Type: TOKEN_DROP, Literal: word}
+		case "TRUNCATE":
+			return Token{Type: TOKEN_TRUNCATE, Literal: word}
+		case "MERGE":
+			return Token{Type: TOKEN_MERGE, Literal: word}
+		case "DISTINCT":
+			return Token{Type: TOKEN_DISTINCT, Literal: word}
+		case "ASC":
+			return Token{Type: TOKEN_ASC, Literal: word}
+		case "TRUE":
+			return Token{Type: TOKEN_TRUE, Literal: word}
+		case "FALSE":
+			return Token{Type: TOKEN_FALSE, Literal: word}
+		case "NULL":
+			return Token{Type: TOKEN_NULL, Literal: word}
+		case "IS":
+			return Token{Type: TOKEN_IS, Literal: word}
+		case "DESC":
+			return Token{Type: TOKEN_DESC, Literal: word}
 		case "FROM":
 			return Token{Type: TOKEN_FROM, Literal: word}
 		case "WHERE":
@@ -151,10 +787,72 @@ func (l *Lexer) NextToken() Token {
 			return Token{Type: TOKEN_GROUP, Literal: word}
 		case "BY":
 			return Token{Type: TOKEN_BY, Literal: word}
+		case "ORDER":
+			return Token{Type: TOKEN_ORDER, Literal: word}
+		case "HAVING":
+			return Token{Type: TOKEN_HAVING, Literal: word}
+		case "QUALIFY":
+			return Token{Type: TOKEN_QUALIFY, Literal: word}
+		case "OVER":
+			return Token{Type: TOKEN_OVER, Literal: word}
+		case "PARTITION":
+			return Token{Type: TOKEN_PARTITION, Literal: word}
+		case "JOIN":
+			return Token{Type: TOKEN_JOIN, Literal: word}
+		case "INNER":
+			return Token{Type: TOKEN_INNER, Literal: word}
+		case "LEFT":
+			return Token{Type: TOKEN_LEFT, Literal: word}
+		case "RIGHT":
+			return Token{Type: TOKEN_RIGHT, Literal: word}
+		case "FULL":
+			return Token{Type: TOKEN_FULL, Literal: word}
+		case "OUTER":
+			return Token{Type: TOKEN_OUTER, Literal: word}
+		case "CROSS":
+			return Token{Type: TOKEN_CROSS, Literal: word}
+		case "IN":
+			return Token{Type: TOKEN_IN, Literal: word}
+		case "EXISTS":
+			return Token{Type: TOKEN_EXISTS, Literal: word}
+		case "WITH":
+			return Token{Type: TOKEN_WITH, Literal: word}
+		case "UNION":
+			return Token{Type: TOKEN_UNION, Literal: word}
+		case "INTERSECT":
+			return Token{Type: TOKEN_INTERSECT, Literal: word}
+		case "EXCEPT":
+			return Token{Type: TOKEN_EXCEPT, Literal: word}
+		case "ALL":
+			return Token{Type: TOKEN_ALL, Literal: word}
+		case "BETWEEN":
+			return Token{Type: TOKEN_BETWEEN, Literal: word}
+		case "LIKE":
+			return Token{Type: TOKEN_LIKE, Literal: word}
+		case "ON":
+			return Token{Type: TOKEN_ON, Literal: word}
+		case "AS":
+			return Token{Type: TOKEN_AS, Literal: word}
 		}
 		return Token{Type: TOKEN_IDENTIFIER, Literal: word}
 	}
 
+	// Single-quoted string literal; a doubled quote is an escaped quote
+	if ch == '\'' {
+		return Token{Type: TOKEN_STRING, Literal: l.readQuoted('\'', "string literal")}
+	}
+
+	// Quoted identifiers may contain spaces and are never keywords
+	if ch == '"' || ch == '`' {
+		return Token{Type: TOKEN_IDENTIFIER, Literal: l.readQuoted(ch, "quoted identifier"), Quoted: true}
+	}
+
+	// A dot not followed by a digit separates a qualifier from a column name
+	if ch == '.' && (l.pos+1 >= len(l.input) || !isDigit(l.input[l.pos+1])) {
+		l.pos++
+		return Token{Type: TOKEN_DOT, Literal: "."}
+	}
+
 	if isDigit(ch) || ch == '.' {
 		start := l.pos
 		hasDot := false
@@ -179,18 +877,59 @@ func (l *Lexer) NextToken() Token {
 			}
 		}
 
+		// Exponent: 1.2e9, 5E-3
+		if l.pos < len(l.input) && (l.input[l.pos] == 'e' || l.input[l.pos] == 'E') {
+			exp := l.pos + 1
+			if exp < len(l.input) && (l.input[exp] == '+' || l.input[exp] == '-') {
+				exp++
+			}
+			if exp < len(l.input) && isDigit(l.input[exp]) {
+				l.pos = exp
+				for l.pos < len(l.input) && isDigit(l.input[l.pos]) {
+					l.pos++
+				}
+			}
+		}
+
 		return Token{Type: TOKEN_LITERAL, Literal: string(l.input[start:l.pos])}
 	}
 
+	// Parameters: $1, $2, ... or ?
+	if ch == '?' {
+		l.pos++
+		return Token{Type: TOKEN_PARAM, Literal: "?"}
+	}
+	if ch == '$' && l.pos+1 < len(l.input) && isDigit(l.input[l.pos+1]) {
+		start := l.pos
+		for l.pos++; l.pos < len(l.input) && isDigit(l.input[l.pos]); l.pos++ {
+		}
+		return Token{Type: TOKEN_PARAM, Literal: string(l.input[start:l.pos])}
+	}
+
 	// Operators
 	// Single-char operators
 	switch ch {
 	case '>':
 		l.pos++
+		if l.match('=') {
+			return Token{Type: TOKEN_OPERATOR, Literal: ">="}
+		}
 		return Token{Type: TOKEN_OPERATOR, Literal: ">"}
 	case '<':
 		l.pos++
+		if l.match('=') {
+			return Token{Type: TOKEN_OPERATOR, Literal: "<="}
+		}
+		if l.match('>') {
+			return Token{Type: TOKEN_OPERATOR, Literal: "<>"}
+		}
 		return Token{Type: TOKEN_OPERATOR, Literal: "<"}
+	case '!':
+		l.pos++
+		if l.match('=') {
+			return Token{Type: TOKEN_OPERATOR, Literal: "!="}
+		}
+		l.failAt(l.start, "unexpected character: !")
 	case '=':
 		l.pos++
 		return Token{Type: TOKEN_OPERATOR, Literal: "="}
@@ -212,9 +951,23 @@ func (l *Lexer) NextToken() Token {
 	case ')':
 		l.pos++
 		return Token{Type: TOKEN_RPAREN, Literal: ")"}
+	case '[':
+		l.pos++
+		return Token{Type: TOKEN_LBRACKET, Literal: "["}
+	case ']':
+		l.pos++
+		return Token{Type: TOKEN_RBRACKET, Literal: "]"}
 	case ',':
 		l.pos++
 		return Token{Type: TOKEN_COMMA, Literal: ","}
+	case ';':
+		l.pos++
+		return Token{Type: TOKEN_SEMICOLON, Literal: ";"}
+	case ':':
+		if l.pos+1 < len(l.input) && l.input[l.pos+1] == ':' {
+			l.pos += 2
+			return Token{Type: TOKEN_DOUBLECOLON, Literal: "::"}
+		}
 	}
 
 	// Comma
@@ -223,15 +976,77 @@ func (l *Lexer) NextToken() Token {
 		return Token{Type: TOKEN_COMMA, Literal: ","}
 	}
 
-	panic("unexpected character: " + string(ch))
+	l.failAt(l.start, "unexpected character: "+string(ch))
+	return Token{}
 }
 
-func (l *Lexer) skipWhitespace() {
-	for l.pos < len(l.input) && unicode.IsSpace(l.input[l.pos]) {
+// match consumes the next character if it is ch
+func (l *Lexer) match(ch rune) bool {
+	if l.pos < len(l.input) && l.input[l.pos] == ch {
 		l.pos++
+		return true
+	}
+	return false
+}
+
+// readQuoted reads text enclosed in quote characters, where a doubled quote
+// stands for one literal quote
+func (l *Lexer) readQuoted(quote rune, what string) string {
+	l.pos++ // opening quote
+	var sb strings.Builder
+	for {
+		if l.pos >= len(l.input) {
+			l.failAt(l.start, "unterminated "+what)
+		}
+		ch := l.input[l.pos]
+		l.pos++
+		if ch == quote {
+			if l.pos < len(l.input) && l.input[l.pos] == quote {
+				sb.WriteRune(quote)
+				l.pos++
+				continue
+			}
+			return sb.String()
+		}
+		sb.WriteRune(ch)
+	}
+}
+
+// skipWhitespace skips whitespace along with -- line comments and /* block comments */
+func (l *Lexer) skipWhitespace() {
+	for l.pos < len(l.input) {
+		switch {
+		case unicode.IsSpace(l.input[l.pos]):
+			l.pos++
+		case l.hasPrefix("--"):
+			for l.pos < len(l.input) && l.input[l.pos] != '\n' {
+				l.pos++
+			}
+		case l.hasPrefix("/*"):
+			start := l.pos
+			l.pos += 2
+			for !l.hasPrefix("*/") {
+				if l.pos >= len(l.input) {
+					l.failAt(start, "unterminated block comment")
+				}
+				l.pos++
+			}
+			l.pos += 2
+		default:
+			return
+		}
 	}
 }
 
+func (l *Lexer) hasPrefix(prefix string) bool {
+	for i, ch := range []rune(prefix) {
+		if l.pos+i >= len(l.input) || l.input[l.pos+i] != ch {
+			return false
+		}
+	}
+	return true
+}
+
 func isLetter(ch rune) bool {
 	return unicode.IsLetter(ch) || ch == '_'
 }
@@ -243,26 +1058,371 @@ func isDigit(ch rune) bool {
 type Parser struct {
 	lexer *Lexer
 	curr  Token
+
+	positional, numbered bool // whether ? and $n parameters have been read
+	params               int  // ? parameters read so far
 }
 
 func NewParser(input string) *Parser {
-	lexer := NewLexer(input)
-	return &Parser{
-		lexer: lexer,
-		curr:  lexer.NextToken(),
-	}
+	return &Parser{lexer: NewLexer(input)}
 }
 
 func (p *Parser) eat(t TokenType) {
 	if p.curr.Type != t {
-		panic("unexpected token: " + p.curr.Literal)
+		p.fail("unexpected token: " + p.curr.Literal)
+	}
+	p.curr = p.lexer.NextToken()
+}
+
+// recoverSyntaxError turns a SyntaxError panic raised while parsing into an
+// error returned through err
+func recoverSyntaxError(err *error) {
+	if r := recover(); r != nil {
+		serr, ok := r.(*SyntaxError)
+		if !ok {
+			panic(r)
+		}
+		*err = serr
+	}
+}
+
+// Parse parses the whole input as a single query, optionally followed by a
+// semicolon. Malformed input is reported as an error rather than a panic
+func (p *Parser) Parse() (query *Query, err error) {
+	defer recoverSyntaxError(&err)
+
+	p.curr = p.lexer.NextToken()
+	query = p.parseSelect()
+	p.skipSemicolons()
+	if p.curr.Type != TOKEN_EOF {
+		p.fail("unexpected token after query: " + p.curr.Literal)
 	}
+	return query, nil
+}
+
+// ParseScript parses semicolon-separated statements, such as the contents of
+// a .sql file, in the order they appear. Empty statements are skipped
+func (p *Parser) ParseScript() (stmts []Statement, err error) {
+	defer recoverSyntaxError(&err)
+
 	p.curr = p.lexer.NextToken()
+	for p.skipSemicolons(); p.curr.Type != TOKEN_EOF; p.skipSemicolons() {
+		stmts = append(stmts, p.parseStatement())
+		if p.curr.Type != TOKEN_SEMICOLON && p.curr.Type != TOKEN_EOF {
+			p.fail("expected ';' after statement, got: " + p.curr.Literal)
+		}
+	}
+	return stmts, nil
+}
+
+func (p *Parser) parseStatement() Statement {
+	// Each statement numbers its own parameters
+	p.positional, p.numbered, p.params = false, false, 0
+	switch p.curr.Type {
+	case TOKEN_SELECT, TOKEN_WITH:
+		return p.parseSelect()
+	case TOKEN_VALUES:
+		return p.parseValues()
+	case TOKEN_INSERT:
+		return p.parseInsert()
+	case TOKEN_CREATE:
+		return p.parseCreate()
+	case TOKEN_DELETE:
+		return p.parseDelete()
+	case TOKEN_MERGE:
+		return p.parseMerge()
+	case TOKEN_UPDATE:
+		return p.parseUpdate()
+	case TOKEN_COPY:
+		return p.parseCopy()
+	case TOKEN_SET:
+		return p.parseSet()
+	case TOKEN_SHOW:
+		return p.parseShow()
+	case TOKEN_DROP:
+		return p.parseDrop()
+	case TOKEN_TRUNCATE:
+		p.eat(TOKEN_TRUNCATE)
+		if p.curr.Type == TOKEN_TABLE {
+			p.eat(TOKEN_TABLE)
+		}
+		return &TruncateStmt{TableName: p.parseName("table name")}
+	case TOKEN_DESCRIBE:
+		p.eat(TOKEN_DESCRIBE)
+		return &DescribeStmt{TableName: p.parseName("table name")}
+	default:
+		if p.isWord("SUMMARIZE") {
+			p.eat(TOKEN_IDENTIFIER)
+			return &SummarizeStmt{TableName: p.parseName("table name")}
+		}
+		p.fail("expected a statement, got: " + p.curr.Literal)
+		return nil
+	}
 }
 
-func (p *Parser) Parse() *Query {
+func (p *Parser) skipSemicolons() {
+	for p.curr.Type == TOKEN_SEMICOLON {
+		p.eat(TOKEN_SEMICOLON)
+	}
+}
+
+// parseSelect parses a SELECT statement with an optional WITH clause; it is
+// also used for nested subqueries
+func (p *Parser) parseSelect() *Query {
+	var with []CommonTableExpr
+	if p.curr.Type == TOKEN_WITH {
+		with = p.parseWith()
+	}
+
+	q := p.parseSelectCore()
+	q.With = with
+
+	for {
+		op, all := p.parseSetOp()
+		if op == "" {
+			break
+		}
+		q.SetOps = append(q.SetOps, SetOperation{Op: op, All: all, Query: p.parseSelectCore()})
+	}
+
+	if p.curr.Type == TOKEN_ORDER {
+		q.OrderBy = p.parseOrderBy()
+	}
+
+	return q
+}
+
+// parseOrderBy parses ORDER BY key [, key ...]
+func (p *Parser) parseOrderBy() []OrderByItem {
+	p.eat(TOKEN_ORDER)
+	if p.curr.Type != TOKEN_BY {
+		p.fail("expected BY after ORDER")
+	}
+	p.eat(TOKEN_BY)
+
+	items := []OrderByItem{p.parseOrderByItem()}
+	for p.curr.Type == TOKEN_COMMA {
+		p.eat(TOKEN_COMMA)
+		items = append(items, p.parseOrderByItem())
+	}
+	return items
+}
+
+// parseOrderByItem parses expr [ASC | DESC] [NULLS FIRST | NULLS LAST]
+func (p *Parser) parseOrderByItem() OrderByItem {
+	item := OrderByItem{Expr: p.parseExpression(precLowest)}
+	switch p.curr.Type {
+	case TOKEN_ASC:
+		p.eat(TOKEN_ASC)
+	case TOKEN_DESC:
+		p.eat(TOKEN_DESC)
+		item.Desc = true
+	}
+
+	if p.isWord("NULLS") {
+		p.eat(TOKEN_IDENTIFIER)
+		switch {
+		case p.isWord("FIRST"):
+			item.Nulls = NullsFirst
+		case p.isWord("LAST"):
+			item.Nulls = NullsLast
+		default:
+			p.fail("expected FIRST or LAST after NULLS, got: " + p.curr.Literal)
+		}
+		p.eat(TOKEN_IDENTIFIER)
+	}
+	return item
+}
+
+// parseFrame parses ROWS or RANGE BETWEEN start AND end, or ROWS or RANGE
+// start, which ends at the current row
+func (p *Parser) parseFrame() *WindowFrame {
+	frame := &WindowFrame{Range: p.isWord("RANGE"), End: FrameBound{Kind: CurrentRow}}
+	p.eat(TOKEN_IDENTIFIER)
+	if p.curr.Type == TOKEN_BETWEEN {
+		p.eat(TOKEN_BETWEEN)
+		frame.Start = p.parseFrameBound(frame.Range)
+		if p.curr.Type != TOKEN_AND {
+			p.fail("expected AND in frame, got: " + p.curr.Literal)
+		}
+		p.eat(TOKEN_AND)
+		frame.End = p.parseFrameBound(frame.Range)
+	} else {
+		frame.Start = p.parseFrameBound(frame.Range)
+	}
+
+	switch {
+	case frame.Start.Kind == UnboundedFollowing:
+		p.fail("frame cannot start at UNBOUNDED FOLLOWING")
+	case frame.End.Kind == UnboundedPreceding:
+		p.fail("frame cannot end at UNBOUNDED PRECEDING")
+	case frame.Start.Kind > frame.End.Kind:
+		p.fail(fmt.Sprintf("frame starting at %s cannot end at %s", frame.Start, frame.End))
+	}
+	return frame
+}
+
+// parseFrameBound parses UNBOUNDED PRECEDING, n PRECEDING, CURRENT ROW,
+// n FOLLOWING or UNBOUNDED FOLLOWING. In a RANGE frame n is any non-negative
+// number or an INTERVAL; in a ROWS frame it is a count of rows.
+func (p *Parser) parseFrameBound(inRange bool) FrameBound {
+	var bound FrameBound
+	switch {
+	case p.isWord("CURRENT"):
+		p.eat(TOKEN_IDENTIFIER)
+		if !p.isWord("ROW") {
+			p.fail("expected ROW after CURRENT, got: " + p.curr.Literal)
+		}
+		p.eat(TOKEN_IDENTIFIER)
+		return FrameBound{Kind: CurrentRow}
+	case p.isWord("UNBOUNDED"):
+		p.eat(TOKEN_IDENTIFIER)
+		bound.Kind = UnboundedPreceding
+	case inRange && p.curr.Type == TOKEN_LITERAL:
+		if _, err := strconv.ParseFloat(p.curr.Literal, 64); err != nil {
+			p.fail("frame offset must be a non-negative number, got: " + p.curr.Literal)
+		}
+		bound = FrameBound{Kind: Preceding, Value: &Literal{Value: p.curr.Literal, Kind: LiteralNumber, Pos: p.curr.Pos}}
+		p.eat(TOKEN_LITERAL)
+	case inRange && p.isWord("INTERVAL"):
+		pos := p.curr.Pos
+		p.eat(TOKEN_IDENTIFIER)
+		if p.curr.Type != TOKEN_STRING {
+			p.fail("expected a string after INTERVAL, got: " + p.curr.Literal)
+		}
+		bound = FrameBound{Kind: Preceding, Value: &Literal{Value: p.curr.Literal, Kind: LiteralInterval, Pos: pos}}
+		p.eat(TOKEN_STRING)
+	case p.curr.Type == TOKEN_LITERAL:
+		n, err := strconv.Atoi(p.curr.Literal)
+		if err != nil || n < 0 {
+			p.fail("frame offset must be a non-negative integer, got: " + p.curr.Literal)
+		}
+		p.eat(TOKEN_LITERAL)
+		bound = FrameBound{Kind: Preceding, Offset: n}
+	default:
+		p.fail("expected frame bound, got: " + p.curr.Literal)
+	}
+
+	switch {
+	case p.isWord("PRECEDING"):
+	case p.isWord("FOLLOWING"):
+		if bound.Kind == UnboundedPreceding {
+			bound.Kind = UnboundedFollowing
+		} else {
+			bound.Kind = Following
+		}
+	default:
+		p.fail("expected PRECEDING or FOLLOWING, got: " + p.curr.Literal)
+	}
+	p.eat(TOKEN_IDENTIFIER)
+	return bound
+}
+
+// parseOver parses the OVER (PARTITION BY ... ORDER BY ...) suffix of a window
+// function call
+func (p *Parser) parseOver(fn *FuncCall) Expression {
+	p.eat(TOKEN_OVER)
+	p.eat(TOKEN_LPAREN)
+
+	w := &WindowExpr{Func: fn}
+	if p.curr.Type == TOKEN_PARTITION {
+		p.eat(TOKEN_PARTITION)
+		if p.curr.Type != TOKEN_BY {
+			p.fail("expected BY after PARTITION")
+		}
+		p.eat(TOKEN_BY)
+
+		w.PartitionBy = append(w.PartitionBy, p.parseExpression(precLowest))
+		for p.curr.Type == TOKEN_COMMA {
+			p.eat(TOKEN_COMMA)
+			w.PartitionBy = append(w.PartitionBy, p.parseExpression(precLowest))
+		}
+	}
+	if p.curr.Type == TOKEN_ORDER {
+		w.OrderBy = p.parseOrderBy()
+	}
+	if p.isWord("ROWS") || p.isWord("RANGE") {
+		w.Frame = p.parseFrame()
+	}
+
+	if p.curr.Type != TOKEN_RPAREN {
+		p.fail("expected ')' to close OVER clause, got: " + p.curr.Literal)
+	}
+	p.eat(TOKEN_RPAREN)
+	return w
+}
+
+// parseSelectCore parses a single SELECT ... FROM ... [WHERE] [GROUP BY] [HAVING]
+// parseStarModifiers parses the optional EXCLUDE and REPLACE lists after a *
+// in a SELECT list. The parentheses may be left out around a single entry.
+func (p *Parser) parseStarModifiers(star *StarExpr) {
+	if p.isWord("EXCLUDE") {
+		p.eat(TOKEN_IDENTIFIER)
+		p.parseStarList(func() {
+			star.Exclude = append(star.Exclude, p.parseName("column name"))
+		})
+	}
+	if p.isWord("REPLACE") {
+		p.eat(TOKEN_IDENTIFIER)
+		p.parseStarList(func() {
+			expr := p.parseExpression(precLowest)
+			if p.curr.Type != TOKEN_AS {
+				p.fail("expected AS in REPLACE, got: " + p.curr.Literal)
+			}
+			p.eat(TOKEN_AS)
+			star.Replace = append(star.Replace, &AliasExpr{Expr: expr, Alias: p.parseName("column name")})
+		})
+	}
+}
+
+// parseStarList calls item for each entry of (item, ...) or for a single
+// unparenthesized entry.
+func (p *Parser) parseStarList(item func()) {
+	if p.curr.Type != TOKEN_LPAREN {
+		item()
+		return
+	}
+	p.eat(TOKEN_LPAREN)
+	item()
+	for p.curr.Type == TOKEN_COMMA {
+		p.eat(TOKEN_COMMA)
+		item()
+	}
+	p.eat(TOKEN_RPAREN)
+}
+
+// isWord reports whether the current token is the unquoted identifier word,
+// used for words that are keywords only in one position
+func (p *Parser) isWord(word string) bool {
+	return p.curr.Type == TOKEN_IDENTIFIER && !p.curr.Quoted && strings.EqualFold(p.curr.Literal, word)
+}
+
+func (p *Parser) parseSelectCore() *Query {
 	p.eat(TOKEN_SELECT)
 
+	var distinct bool
+	var distinctOn []Expression
+	if p.curr.Type == TOKEN_DISTINCT {
+		p.eat(TOKEN_DISTINCT)
+		distinct = true
+		if p.curr.Type == TOKEN_ON {
+			p.eat(TOKEN_ON)
+			if p.curr.Type != TOKEN_LPAREN {
+				p.fail("expected '(' after DISTINCT ON, got: " + p.curr.Literal)
+			}
+			p.eat(TOKEN_LPAREN)
+			distinctOn = append(distinctOn, p.parseExpression(precLowest))
+			for p.curr.Type == TOKEN_COMMA {
+				p.eat(TOKEN_COMMA)
+				distinctOn = append(distinctOn, p.parseExpression(precLowest))
+			}
+			if p.curr.Type != TOKEN_RPAREN {
+				p.fail("expected ')' to close DISTINCT ON, got: " + p.curr.Literal)
+			}
+			p.eat(TOKEN_RPAREN)
+		}
+	}
+
 	projections := []Expression{}
 	expectExpr := true
 
@@ -273,16 +1433,27 @@ func (p *Parser) Parse() *Query {
 
 		case p.curr.Type == TOKEN_COMMA:
 			if expectExpr {
-				panic("unexpected comma in SELECT list")
+				p.fail("unexpected comma in SELECT list")
 			}
 			p.eat(TOKEN_COMMA)
 			expectExpr = true
 
 		default:
 			if !expectExpr {
-				panic("expected ',' or 'FROM' after SELECT expression, got: " + p.curr.Literal)
+				p.fail("expected ',' or 'FROM' after SELECT expression, got: " + p.curr.Literal)
+			}
+			expr := p.parseExpression(precLowest)
+			if star, ok := expr.(*StarExpr); ok {
+				p.parseStarModifiers(star)
+			}
+			if p.curr.Type == TOKEN_AS {
+				p.eat(TOKEN_AS)
+				if p.curr.Type != TOKEN_IDENTIFIER {
+					p.fail("expected alias after AS, got: " + p.curr.Literal)
+				}
+				expr = &AliasExpr{Expr: expr, Alias: p.curr.Literal}
+				p.eat(TOKEN_IDENTIFIER)
 			}
-			expr := p.parseExpression(0)
 			projections = append(projections, expr)
 			expectExpr = false
 		}
@@ -292,56 +1463,389 @@ func (p *Parser) Parse() *Query {
 			break
 		}
 	}
+	if expectExpr {
+		p.fail("expected expression before FROM")
+	}
 
 	p.eat(TOKEN_FROM)
 
-	if p.curr.Type != TOKEN_IDENTIFIER {
-		panic("expected table name")
+	from := p.parseTableRef()
+
+	var joins []JoinClause
+	for {
+		joinType := p.parseJoinType()
+		if joinType == "" {
+			break
+		}
+
+		ref := p.parseTableRef()
+		if ref.unnest != nil && (joinType == "RIGHT" || joinType == "FULL") {
+			p.fail("UNNEST is not supported in a " + joinType + " JOIN")
+		}
+		join := JoinClause{Type: joinType, TableName: ref.name, TableAlias: ref.alias, Columns: ref.columns, Subquery: ref.subquery, Pivot: ref.pivot, Unnest: ref.unnest}
+		if joinType == "CROSS" {
+			joins = append(joins, join)
+			continue
+		}
+		if p.curr.Type != TOKEN_ON {
+			p.fail("expected ON after JOIN table, got: " + p.curr.Literal)
+		}
+		p.eat(TOKEN_ON)
+
+		join.On = p.parseExpression(precLowest)
+		joins = append(joins, join)
 	}
-	tableName := p.curr.Literal
-	p.eat(TOKEN_IDENTIFIER)
 
 	var where Expression = nil
 	if p.curr.Type == TOKEN_WHERE {
 		p.eat(TOKEN_WHERE)
-		where = p.parseExpression(0)
+		where = p.parseExpression(precLowest)
 	}
 
 	var groupBy []Expression
 	if p.curr.Type == TOKEN_GROUP {
 		p.eat(TOKEN_GROUP)
 		if p.curr.Type != TOKEN_BY {
-			panic("expected BY after GROUP")
+			p.fail("expected BY after GROUP")
 		}
 		p.eat(TOKEN_BY)
 
-		groupBy = append(groupBy, p.parseExpression(0))
+		groupBy = append(groupBy, p.parseExpression(precLowest))
 		for p.curr.Type == TOKEN_COMMA {
 			p.eat(TOKEN_COMMA)
-			groupBy = append(groupBy, p.parseExpression(0))
+			groupBy = append(groupBy, p.parseExpression(precLowest))
 		}
 	}
 
+	var having Expression
+	if p.curr.Type == TOKEN_HAVING {
+		p.eat(TOKEN_HAVING)
+		having = p.parseExpression(precLowest)
+	}
+
+	var qualify Expression
+	if p.curr.Type == TOKEN_QUALIFY {
+		p.eat(TOKEN_QUALIFY)
+		qualify = p.parseExpression(precLowest)
+	}
+
 	return &Query{
+		Distinct:    distinct,
+		DistinctOn:  distinctOn,
 		Projections: projections,
-		TableName:   tableName,
+		TableName:   from.name,
+		TableAlias:  from.alias,
+		Columns:     from.columns,
+		Subquery:    from.subquery,
+		Pivot:       from.pivot,
+		Unnest:      from.unnest,
+		Joins:       joins,
 		Where:       where,
 		GroupBy:     groupBy,
+		Having:      having,
+		Qualify:     qualify,
+	}
+}
+
+// parseSetOp consumes UNION, INTERSECT or EXCEPT with an optional ALL, or
+// returns "" when the current token is not a set operator
+func (p *Parser) parseSetOp() (string, bool) {
+	switch p.curr.Type {
+	case TOKEN_UNION, TOKEN_INTERSECT, TOKEN_EXCEPT:
+	default:
+		return "", false
+	}
+	op := strings.ToUpper(p.curr.Literal)
+	p.eat(p.curr.Type)
+
+	all := false
+	if p.curr.Type == TOKEN_ALL {
+		p.eat(TOKEN_ALL)
+		all = true
+	}
+	return op, all
+}
+
+// parseWith parses WITH name AS (SELECT ...) [, ...]
+func (p *Parser) parseWith() []CommonTableExpr {
+	p.eat(TOKEN_WITH)
+
+	var ctes []CommonTableExpr
+	for {
+		if p.curr.Type != TOKEN_IDENTIFIER {
+			p.fail("expected CTE name after WITH, got: " + p.curr.Literal)
+		}
+		name := p.curr.Literal
+		p.eat(TOKEN_IDENTIFIER)
+		p.eat(TOKEN_AS)
+		ctes = append(ctes, CommonTableExpr{Name: name, Query: p.parseSubquery()})
+
+		if p.curr.Type != TOKEN_COMMA {
+			return ctes
+		}
+		p.eat(TOKEN_COMMA)
+	}
+}
+
+// parseJoinType consumes a join keyword sequence such as LEFT OUTER JOIN and
+// returns its type, or "" when the current token does not start a join
+func (p *Parser) parseJoinType() string {
+	joinType := ""
+	switch p.curr.Type {
+	case TOKEN_COMMA:
+		// FROM a, b is shorthand for a CROSS JOIN
+		p.eat(TOKEN_COMMA)
+		return "CROSS"
+	case TOKEN_CROSS:
+		p.eat(TOKEN_CROSS)
+		joinType = "CROSS"
+	case TOKEN_JOIN:
+		joinType = "INNER"
+	case TOKEN_INNER:
+		p.eat(TOKEN_INNER)
+		joinType = "INNER"
+	case TOKEN_LEFT, TOKEN_RIGHT, TOKEN_FULL:
+		joinType = strings.ToUpper(p.curr.Literal)
+		p.eat(p.curr.Type)
+		if p.curr.Type == TOKEN_OUTER {
+			p.eat(TOKEN_OUTER)
+		}
+	default:
+		return ""
+	}
+	p.eat(TOKEN_JOIN)
+	return joinType
+}
+
+// tableRef is a table in a FROM or JOIN clause as written
+type tableRef struct {
+	name     string
+	alias    string
+	columns  []string
+	subquery *Query
+	pivot    *PivotClause
+	unnest   *UnnestClause
+}
+
+// parseTableRef parses a table name, a parenthesized subquery or a
+// parenthesized VALUES list, which may be followed by PIVOT or UNPIVOT, or
+// UNNEST(list, ...) [WITH ORDINALITY], with an optional alias given with or
+// without AS. The alias may be followed by a list of column aliases, e.g.
+// t(id, name).
+func (p *Parser) parseTableRef() tableRef {
+	var ref tableRef
+	switch p.curr.Type {
+	case TOKEN_IDENTIFIER:
+		if p.isWord("UNNEST") && p.peek().Type == TOKEN_LPAREN {
+			ref.unnest = p.parseUnnest()
+			break
+		}
+		ref.name = p.curr.Literal
+		p.eat(TOKEN_IDENTIFIER)
+	case TOKEN_LPAREN:
+		p.eat(TOKEN_LPAREN)
+		if p.curr.Type == TOKEN_VALUES {
+			ref.subquery = p.parseValues()
+		} else {
+			ref.subquery = p.parseSelect()
+		}
+		p.eat(TOKEN_RPAREN)
+	default:
+		p.fail("expected table name")
+	}
+	if ref.unnest == nil && (p.isWord("PIVOT") || p.isWord("UNPIVOT")) {
+		ref.pivot = p.parsePivot()
+	}
+
+	if p.curr.Type == TOKEN_AS {
+		p.eat(TOKEN_AS)
+		if p.curr.Type != TOKEN_IDENTIFIER {
+			p.fail("expected alias after AS")
+		}
+	}
+	if p.curr.Type == TOKEN_IDENTIFIER {
+		ref.alias = p.curr.Literal
+		p.eat(TOKEN_IDENTIFIER)
+		if p.curr.Type == TOKEN_LPAREN {
+			ref.columns = p.parseNameList("column alias")
+		}
+	}
+	return ref
+}
+
+// parseUnnest parses UNNEST(list, ...) [WITH ORDINALITY]
+func (p *Parser) parseUnnest() *UnnestClause {
+	u := &UnnestClause{}
+	p.eat(TOKEN_IDENTIFIER)
+	p.eat(TOKEN_LPAREN)
+	for {
+		u.Args = append(u.Args, p.parseExpression(precLowest))
+		if p.curr.Type != TOKEN_COMMA {
+			break
+		}
+		p.eat(TOKEN_COMMA)
+	}
+	if p.curr.Type != TOKEN_RPAREN {
+		p.fail("expected ')' to close UNNEST, got: " + p.curr.Literal)
+	}
+	p.eat(TOKEN_RPAREN)
+	if p.curr.Type == TOKEN_WITH {
+		p.eat(TOKEN_WITH)
+		if !p.isWord("ORDINALITY") {
+			p.fail("expected ORDINALITY after WITH, got: " + p.curr.Literal)
+		}
+		p.eat(TOKEN_IDENTIFIER)
+		u.Ordinality = true
+	}
+	return u
+}
+
+// parsePivot parses PIVOT (agg [AS alias], ... FOR column IN (value [AS
+// alias], ...)) or UNPIVOT (value FOR name IN (column, ...))
+func (p *Parser) parsePivot() *PivotClause {
+	c := &PivotClause{Unpivot: p.isWord("UNPIVOT")}
+	p.eat(TOKEN_IDENTIFIER)
+	if p.curr.Type != TOKEN_LPAREN {
+		p.fail("expected '(' after PIVOT, got: " + p.curr.Literal)
+	}
+	p.eat(TOKEN_LPAREN)
+	if c.Unpivot {
+		c.Value = p.parseName("column name")
+	} else {
+		for {
+			c.Aggregates = append(c.Aggregates, p.parseAliasedExpression())
+			if p.curr.Type != TOKEN_COMMA {
+				break
+			}
+			p.eat(TOKEN_COMMA)
+		}
+	}
+	if !p.isWord("FOR") {
+		p.fail("expected FOR in PIVOT, got: " + p.curr.Literal)
+	}
+	p.eat(TOKEN_IDENTIFIER)
+	c.For = p.parseName("column name")
+	if p.curr.Type != TOKEN_IN {
+		p.fail("expected IN in PIVOT, got: " + p.curr.Literal)
+	}
+	p.eat(TOKEN_IN)
+	if c.Unpivot {
+		if p.curr.Type != TOKEN_LPAREN {
+			p.fail("expected '(' after IN, got: " + p.curr.Literal)
+		}
+		c.Columns = p.parseNameList("column name")
+	} else {
+		if p.curr.Type != TOKEN_LPAREN {
+			p.fail("expected '(' after IN, got: " + p.curr.Literal)
+		}
+		p.eat(TOKEN_LPAREN)
+		for {
+			c.In = append(c.In, p.parseAliasedExpression())
+			if p.curr.Type != TOKEN_COMMA {
+				break
+			}
+			p.eat(TOKEN_COMMA)
+		}
+		p.eat(TOKEN_RPAREN)
+	}
+	if p.curr.Type != TOKEN_RPAREN {
+		p.fail("expected ')' to close PIVOT, got: " + p.curr.Literal)
 	}
+	p.eat(TOKEN_RPAREN)
+	return c
+}
 
+// parseAliasedExpression parses an expression optionally followed by AS alias
+func (p *Parser) parseAliasedExpression() Expression {
+	expr := p.parseExpression(precLowest)
+	if p.curr.Type == TOKEN_AS {
+		p.eat(TOKEN_AS)
+		return &AliasExpr{Expr: expr, Alias: p.parseName("alias")}
+	}
+	return expr
+}
+
+// parseValues parses VALUES (expr, ...), ... into a query whose rows are the
+// lists
+func (p *Parser) parseValues() *Query {
+	p.eat(TOKEN_VALUES)
+	q := &Query{}
+	for {
+		p.eat(TOKEN_LPAREN)
+		row := []Expression{p.parseExpression(precLowest)}
+		for p.curr.Type == TOKEN_COMMA {
+			p.eat(TOKEN_COMMA)
+			row = append(row, p.parseExpression(precLowest))
+		}
+		p.eat(TOKEN_RPAREN)
+		q.Values = append(q.Values, row)
+
+		if p.curr.Type != TOKEN_COMMA {
+			return q
+		}
+		p.eat(TOKEN_COMMA)
+	}
 }
 
 func (p *Parser) parseExpression(precedence int) Expression {
 	left := p.parsePrimary()
 
+	// expr::type, list[i] and struct.field bind tighter than any operator
+	for postfix := true; postfix; {
+		pos := p.curr.Pos
+		switch p.curr.Type {
+		case TOKEN_DOUBLECOLON:
+			p.eat(TOKEN_DOUBLECOLON)
+			left = &CastExpr{Expr: left, Type: p.parseTypeName()}
+		case TOKEN_LBRACKET:
+			p.eat(TOKEN_LBRACKET)
+			index := p.parseExpression(precLowest)
+			p.eat(TOKEN_RBRACKET)
+			left = &IndexExpr{Expr: left, Index: index, Pos: pos}
+		case TOKEN_DOT:
+			p.eat(TOKEN_DOT)
+			if p.curr.Type != TOKEN_IDENTIFIER {
+				p.fail("expected field name after '.', got: " + p.curr.Literal)
+			}
+			left = &FieldExpr{Expr: left, Field: p.curr.Literal, Quoted: p.curr.Quoted, Pos: pos}
+			p.eat(TOKEN_IDENTIFIER)
+		default:
+			postfix = false
+		}
+	}
+
 	for precedence < p.currentPrecedence() {
 		token := p.curr
+		if token.Type == TOKEN_NOT {
+			token = p.peek()
+		}
+		if token.Type == TOKEN_IN {
+			left = p.parseIn(left)
+			continue
+		}
+		if token.Type == TOKEN_BETWEEN {
+			left = p.parseBetween(left)
+			continue
+		}
+		if token.Type == TOKEN_LIKE {
+			left = p.parseLike(left)
+			continue
+		}
+		if token.Type == TOKEN_IS {
+			left = p.parseIsNull(left)
+			continue
+		}
 		p.eat(token.Type)
 
+		op := token.Literal
+		if token.Type == TOKEN_AND || token.Type == TOKEN_OR {
+			op = strings.ToUpper(op)
+		}
+
 		right := p.parseExpression(p.tokenPrecedence(token))
 		left = &BinaryExpr{
 			Left:  left,
-			Op:    token.Literal,
+			Op:    op,
 			Right: right,
 		}
 	}
@@ -349,63 +1853,313 @@ func (p *Parser) parseExpression(precedence int) Expression {
 	return left
 }
 
+// parseIn parses the [NOT] IN (subquery) or [NOT] IN (value, ...) suffix of left
+func (p *Parser) parseIn(left Expression) Expression {
+	not := false
+	if p.curr.Type == TOKEN_NOT {
+		p.eat(TOKEN_NOT)
+		not = true
+	}
+	p.eat(TOKEN_IN)
+	if p.peek().Type == TOKEN_SELECT || p.peek().Type == TOKEN_WITH {
+		return &InExpr{Expr: left, Subquery: p.parseSubquery(), Not: not}
+	}
+
+	p.eat(TOKEN_LPAREN)
+	values := []Expression{p.parseExpression(precLowest)}
+	for p.curr.Type == TOKEN_COMMA {
+		p.eat(TOKEN_COMMA)
+		values = append(values, p.parseExpression(precLowest))
+	}
+	p.eat(TOKEN_RPAREN)
+	return &InExpr{Expr: left, Values: values, Not: not}
+}
+
+// parseIsNull parses the IS [NOT] NULL suffix of left
+func (p *Parser) parseIsNull(left Expression) Expression {
+	p.eat(TOKEN_IS)
+	not := false
+	if p.curr.Type == TOKEN_NOT {
+		p.eat(TOKEN_NOT)
+		not = true
+	}
+	if p.curr.Type != TOKEN_NULL {
+		p.fail("expected NULL after IS, got: " + p.curr.Literal)
+	}
+	p.eat(TOKEN_NULL)
+	return &IsNullExpr{Expr: left, Not: not}
+}
+
+// parseBetween parses the [NOT] BETWEEN low AND high suffix of left
+func (p *Parser) parseBetween(left Expression) Expression {
+	not := false
+	if p.curr.Type == TOKEN_NOT {
+		p.eat(TOKEN_NOT)
+		not = true
+	}
+	p.eat(TOKEN_BETWEEN)
+
+	// Bounds are arithmetic expressions, so the AND separating them is not consumed
+	low := p.parseExpression(precComparison)
+	p.eat(TOKEN_AND)
+	high := p.parseExpression(precComparison)
+	return &BetweenExpr{Expr: left, Low: low, High: high, Not: not}
+}
+
+// parseLike parses the [NOT] LIKE pattern suffix of left
+func (p *Parser) parseLike(left Expression) Expression {
+	not := false
+	if p.curr.Type == TOKEN_NOT {
+		p.eat(TOKEN_NOT)
+		not = true
+	}
+	p.eat(TOKEN_LIKE)
+	return &LikeExpr{Expr: left, Pattern: p.parseExpression(precComparison), Not: not}
+}
+
+// parseSubquery parses a parenthesized SELECT
+func (p *Parser) parseSubquery() *Query {
+	p.eat(TOKEN_LPAREN)
+	if p.curr.Type != TOKEN_SELECT && p.curr.Type != TOKEN_WITH {
+		p.fail("expected SELECT in subquery, got: " + p.curr.Literal)
+	}
+	sub := p.parseSelect()
+	p.eat(TOKEN_RPAREN)
+	return sub
+}
+
+// peek returns the token after the current one without consuming it
+// parseParameter reads a $n or ? parameter. A query numbers its parameters
+// one way or the other, not both.
+func (p *Parser) parseParameter() Expression {
+	pos, text := p.curr.Pos, p.curr.Literal
+	if text == "?" {
+		if p.numbered {
+			p.fail("cannot mix ? and $n parameters")
+		}
+		p.positional = true
+		p.params++
+		p.eat(TOKEN_PARAM)
+		return &Parameter{Index: p.params, Pos: pos}
+	}
+	if p.positional {
+		p.fail("cannot mix ? and $n parameters")
+	}
+	p.numbered = true
+	n, err := strconv.Atoi(text[1:])
+	if err != nil || n < 1 {
+		p.fail("invalid parameter: " + text)
+	}
+	p.eat(TOKEN_PARAM)
+	return &Parameter{Index: n, Pos: pos}
+}
+
+func (p *Parser) peek() Token {
+	pos := p.lexer.pos
+	tok := p.lexer.NextToken()
+	p.lexer.pos = pos
+	return tok
+}
+
 func (p *Parser) parsePrimary() Expression {
+	pos := p.curr.Pos
 	switch p.curr.Type {
+	case TOKEN_EXISTS:
+		p.eat(TOKEN_EXISTS)
+		return &ExistsExpr{Subquery: p.parseSubquery()}
+	case TOKEN_NOT:
+		p.eat(TOKEN_NOT)
+		if p.curr.Type == TOKEN_EXISTS {
+			p.eat(TOKEN_EXISTS)
+			return &ExistsExpr{Subquery: p.parseSubquery(), Not: true}
+		}
+		// NOT binds looser than comparisons but tighter than AND and OR
+		return &UnaryExpr{Op: "NOT", Expr: p.parseExpression(precNot)}
 	case TOKEN_IDENTIFIER:
-		ident := p.curr.Literal
+		ident, quoted := p.curr.Literal, p.curr.Quoted
 		p.eat(TOKEN_IDENTIFIER)
 
+		// DATE '...', TIMESTAMP '...' and INTERVAL '...'; without the string the
+		// word is an ordinary name, so a column called Date still works
+		if kind, ok := typedLiteralKinds[strings.ToUpper(ident)]; ok && !quoted && p.curr.Type == TOKEN_STRING {
+			val := p.curr.Literal
+			p.eat(TOKEN_STRING)
+			return &Literal{Value: val, Kind: kind, Pos: pos}
+		}
+
+		if p.curr.Type == TOKEN_LPAREN && strings.EqualFold(ident, "CAST") && !quoted {
+			p.eat(TOKEN_LPAREN)
+			expr := p.parseExpression(precLowest)
+			if p.curr.Type != TOKEN_AS {
+				p.fail("expected AS in CAST, got: " + p.curr.Literal)
+			}
+			p.eat(TOKEN_AS)
+			cast := &CastExpr{Expr: expr, Type: p.parseTypeName()}
+			p.eat(TOKEN_RPAREN)
+			return cast
+		}
+
+		if p.curr.Type == TOKEN_LPAREN && strings.EqualFold(ident, "EXTRACT") && !quoted {
+			// EXTRACT(field FROM expr) is DATE_PART('field', expr)
+			p.eat(TOKEN_LPAREN)
+			field := &Literal{Value: strings.ToLower(p.curr.Literal), Kind: LiteralString, Pos: p.curr.Pos}
+			p.eat(TOKEN_IDENTIFIER)
+			if p.curr.Type != TOKEN_FROM {
+				p.fail("expected FROM in EXTRACT, got: " + p.curr.Literal)
+			}
+			p.eat(TOKEN_FROM)
+			expr := p.parseExpression(precLowest)
+			p.eat(TOKEN_RPAREN)
+			return &FuncCall{Name: "DATE_PART", Args: []Expression{field, expr}, Pos: pos}
+		}
+
 		if p.curr.Type == TOKEN_LPAREN {
 			// It's a function call
 			p.eat(TOKEN_LPAREN)
 			args := []Expression{}
+			distinct := p.curr.Type == TOKEN_DISTINCT
+			if distinct {
+				p.eat(TOKEN_DISTINCT)
+			}
 
 			if p.curr.Type != TOKEN_RPAREN {
-				args = append(args, p.parseExpression(0))
+				args = append(args, p.parseExpression(precLowest))
 				for p.curr.Type == TOKEN_COMMA {
 					p.eat(TOKEN_COMMA)
-					args = append(args, p.parseExpression(0))
+					args = append(args, p.parseExpression(precLowest))
 				}
 			}
 
 			p.eat(TOKEN_RPAREN)
-			return &FuncCall{Name: strings.ToUpper(ident), Args: args}
+			fn := &FuncCall{Name: strings.ToUpper(ident), Args: args, Distinct: distinct, Pos: pos}
+			if p.curr.Type == TOKEN_OVER {
+				return p.parseOver(fn)
+			}
+			return fn
+		}
+
+		if p.curr.Type == TOKEN_DOT {
+			// Qualified column reference: table.column
+			p.eat(TOKEN_DOT)
+			if p.curr.Type != TOKEN_IDENTIFIER {
+				p.fail("expected column name after '.', got: " + p.curr.Literal)
+			}
+			name, quoted := p.curr.Literal, p.curr.Quoted
+			p.eat(TOKEN_IDENTIFIER)
+			return &ColumnRef{Table: ident, Name: name, Quoted: quoted, Pos: pos}
 		}
 
-		return &ColumnRef{Name: ident}
+		return &ColumnRef{Name: ident, Quoted: quoted, Pos: pos}
+	case TOKEN_MINUS:
+		p.eat(TOKEN_MINUS)
+		// Unary minus binds tighter than any binary operator
+		operand := p.parseExpression(precMultiplicative)
+		if lit, ok := operand.(*Literal); ok && lit.Kind == LiteralNumber && !strings.HasPrefix(lit.Value, "-") {
+			return &Literal{Value: "-" + lit.Value, Pos: pos}
+		}
+		return &UnaryExpr{Op: "-", Expr: operand}
 	case TOKEN_LITERAL:
 		val := p.curr.Literal
 		p.eat(TOKEN_LITERAL)
-		return &Literal{Value: val}
+		return &Literal{Value: val, Pos: pos}
+	case TOKEN_STRING:
+		val := p.curr.Literal
+		p.eat(TOKEN_STRING)
+		return &Literal{Value: val, Kind: LiteralString, Pos: pos}
+	case TOKEN_PARAM:
+		return p.parseParameter()
+	case TOKEN_TRUE, TOKEN_FALSE:
+		val := strings.ToUpper(p.curr.Literal)
+		p.eat(p.curr.Type)
+		return &Literal{Value: val, Kind: LiteralBool, Pos: pos}
+	case TOKEN_NULL:
+		p.eat(TOKEN_NULL)
+		return &Literal{Value: "NULL", Kind: LiteralNull, Pos: pos}
 	case TOKEN_LPAREN:
+		if p.peek().Type == TOKEN_SELECT {
+			return &SubqueryExpr{Subquery: p.parseSubquery()}
+		}
 		p.eat(TOKEN_LPAREN)
-		expr := p.parseExpression(0) // parse inner expression
+		expr := p.parseExpression(precLowest) // parse inner expression
 		p.eat(TOKEN_RPAREN)
 		return expr
 	case TOKEN_ASTERISK:
 		p.eat(TOKEN_ASTERISK)
 		return &StarExpr{}
 	default:
-		panic("unexpected token in primary: " + p.curr.Literal)
+		p.fail("unexpected token in primary: " + p.curr.Literal)
+		return nil
 	}
 }
 
+// parseTypeName parses a type name such as BIGINT, DOUBLE PRECISION or
+// DECIMAL(10, 2), returning it upper-cased
+func (p *Parser) parseTypeName() string {
+	if p.curr.Type != TOKEN_IDENTIFIER {
+		p.fail("expected type name, got: " + p.curr.Literal)
+	}
+	name := strings.ToUpper(p.curr.Literal)
+	p.eat(TOKEN_IDENTIFIER)
+
+	if name == "DOUBLE" && p.isWord("PRECISION") {
+		p.eat(TOKEN_IDENTIFIER)
+		name += " PRECISION"
+	}
+
+	if p.curr.Type == TOKEN_LPAREN {
+		p.eat(TOKEN_LPAREN)
+		var params []string
+		for {
+			if p.curr.Type != TOKEN_LITERAL {
+				p.fail("expected number in type parameters, got: " + p.curr.Literal)
+			}
+			params = append(params, p.curr.Literal)
+			p.eat(TOKEN_LITERAL)
+			if p.curr.Type != TOKEN_COMMA {
+				break
+			}
+			p.eat(TOKEN_COMMA)
+		}
+		p.eat(TOKEN_RPAREN)
+		name += "(" + strings.Join(params, ", ") + ")"
+	}
+	return name
+}
+
+// Binary operator precedence, from loosest to tightest binding. An operand
+// parsed with parseExpression(prec) only takes operators binding tighter than
+// prec, so a + b > c + d is (a + b) > (c + d).
+const (
+	precLowest         = 0
+	precOr             = 1 // above precLowest so that parseExpression(precLowest) consumes OR
+	precAnd            = 2
+	precNot            = 3 // prefix NOT
+	precComparison     = 4 // =, <>, <, >, <=, >=, IN, BETWEEN, LIKE, IS
+	precAdditive       = 5
+	precMultiplicative = 6
+)
+
 func (p *Parser) currentPrecedence() int {
+	if p.curr.Type == TOKEN_NOT {
+		if next := p.peek().Type; next == TOKEN_IN || next == TOKEN_BETWEEN || next == TOKEN_LIKE {
+			return precComparison // NOT IN, NOT BETWEEN and NOT LIKE bind like a comparison
+		}
+	}
 	return p.tokenPrecedence(p.curr)
 }
 
 func (p *Parser) tokenPrecedence(tok Token) int {
 	switch tok.Type {
 	case TOKEN_ASTERISK, TOKEN_SLASH:
-		return 3
+		return precMultiplicative
 	case TOKEN_PLUS, TOKEN_MINUS:
-		return 2
-	case TOKEN_OPERATOR:
-		return 2 // same precedence as + and -
+		return precAdditive
+	case TOKEN_OPERATOR, TOKEN_IN, TOKEN_BETWEEN, TOKEN_LIKE, TOKEN_IS:
+		return precComparison
 	case TOKEN_AND:
-		return 1
+		return precAnd
 	case TOKEN_OR:
-		return 0
+		return precOr
 	default:
 		return -1
 	}
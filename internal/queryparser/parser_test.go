@@ -1,14 +1,28 @@
 package queryparser
 
 import (
+	"errors"
 	"fmt"
+	"strings"
 	"testing"
 )
 
+func mustParse(t *testing.T, sql string) *Query {
+	t.Helper()
+	query, err := NewParser(sql).Parse()
+	if err != nil {
+		t.Fatalf("parse %q failed: %v", sql, err)
+	}
+	return query
+}
+
 func TestParseSimpleSelect(t *testing.T) {
 	queryStr := "SELECT Date, Close FROM prices WHERE Close > 1000"
 	parser := NewParser(queryStr)
-	query := parser.Parse()
+	query, err := parser.Parse()
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
 
 	if len(query.Projections) != 2 {
 		t.Errorf("expected 2 projections, got %d", len(query.Projections))
@@ -49,7 +63,10 @@ func TestParseSimpleSelect(t *testing.T) {
 func TestParseFloatLiteral(t *testing.T) {
 	queryStr := "SELECT Close FROM prices WHERE Close > 123.45"
 	parser := NewParser(queryStr)
-	query := parser.Parse()
+	query, err := parser.Parse()
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
 
 	whereExpr, ok := query.Where.(*BinaryExpr)
 	if !ok {
@@ -65,7 +82,10 @@ func TestParseFloatLiteral(t *testing.T) {
 func TestParseComplexWhere(t *testing.T) {
 	queryStr := "SELECT Date, Close FROM prices WHERE Close > 1000 AND Volume < 5000"
 	parser := NewParser(queryStr)
-	query := parser.Parse()
+	query, err := parser.Parse()
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
 
 	fmt.Println("Parsed Query:", query.String())
 
@@ -106,7 +126,10 @@ func printAST(expr Expression, indent int) {
 func TestParseFuncCall(t *testing.T) {
 	queryStr := "SELECT SUM(Volume), COUNT(*) FROM prices"
 	parser := NewParser(queryStr)
-	query := parser.Parse()
+	query, err := parser.Parse()
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
 
 	if len(query.Projections) != 2 {
 		t.Errorf("expected 2 projections, got %d", len(query.Projections))
@@ -118,10 +141,21 @@ func TestParseFuncCall(t *testing.T) {
 	if fc, ok := query.Projections[1].(*FuncCall); !ok || fc.Name != "COUNT" {
 		t.Errorf("expected COUNT function call, got %+v", query.Projections[1])
 	}
+
+	query = mustParse(t, "SELECT COUNT(DISTINCT Region), SUM(Volume) FROM prices")
+	if fc, ok := query.Projections[0].(*FuncCall); !ok || !fc.Distinct {
+		t.Errorf("expected COUNT(DISTINCT ...), got %+v", query.Projections[0])
+	}
+	if got, want := formatExpr(query.Projections[0]), "COUNT(DISTINCT Region)"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if fc := query.Projections[1].(*FuncCall); fc.Distinct {
+		t.Errorf("expected SUM without DISTINCT")
+	}
 }
 
 func TestParseGroupBy(t *testing.T) {
-	query := NewParser("SELECT Region, COUNT(*) FROM prices GROUP BY Region").Parse()
+	query := mustParse(t, "SELECT Region, COUNT(*) FROM prices GROUP BY Region")
 
 	if len(query.GroupBy) != 1 {
 		t.Errorf("expected 1 GROUP BY expression, got %d", len(query.GroupBy))
@@ -131,3 +165,1142 @@ func TestParseGroupBy(t *testing.T) {
 		t.Errorf("expected GROUP BY Region, got %+v", query.GroupBy[0])
 	}
 }
+
+func TestParseOrderBy(t *testing.T) {
+	query := mustParse(t, "SELECT Date, Close FROM prices WHERE Close > 1000 ORDER BY Close, (Open + Close) / 2")
+
+	if len(query.OrderBy) != 2 {
+		t.Fatalf("expected 2 ORDER BY keys, got %d", len(query.OrderBy))
+	}
+
+	if col, ok := query.OrderBy[0].Expr.(*ColumnRef); !ok || col.Name != "Close" {
+		t.Errorf("expected first ORDER BY key to be Close, got %+v", query.OrderBy[0].Expr)
+	}
+
+	if bin, ok := query.OrderBy[1].Expr.(*BinaryExpr); !ok || bin.Op != "/" {
+		t.Errorf("expected second ORDER BY key to be a division, got %+v", query.OrderBy[1].Expr)
+	}
+}
+
+func TestParseHaving(t *testing.T) {
+	query := mustParse(t, "SELECT Region, COUNT(*) FROM t GROUP BY Region HAVING COUNT(*) > 10")
+
+	having, ok := query.Having.(*BinaryExpr)
+	if !ok || having.Op != ">" {
+		t.Fatalf("expected HAVING to be a '>' comparison, got %+v", query.Having)
+	}
+
+	if fc, ok := having.Left.(*FuncCall); !ok || fc.Name != "COUNT" {
+		t.Errorf("expected HAVING left side to be COUNT(*), got %+v", having.Left)
+	}
+}
+
+func TestParseInnerJoin(t *testing.T) {
+	query := mustParse(t, "SELECT p.Date, s.Name FROM prices p INNER JOIN symbols AS s ON p.Symbol = s.Symbol JOIN sectors ON s.Sector = sectors.Id")
+
+	if query.TableName != "prices" || query.TableAlias != "p" {
+		t.Errorf("expected FROM prices p, got %s %s", query.TableName, query.TableAlias)
+	}
+
+	if len(query.Joins) != 2 {
+		t.Fatalf("expected 2 joins, got %d", len(query.Joins))
+	}
+
+	first := query.Joins[0]
+	if first.Type != "INNER" || first.TableName != "symbols" || first.TableAlias != "s" {
+		t.Errorf("unexpected first join: %+v", first)
+	}
+
+	on, ok := first.On.(*BinaryExpr)
+	if !ok || on.Op != "=" {
+		t.Fatalf("expected ON to be an equality, got %+v", first.On)
+	}
+	if col, ok := on.Left.(*ColumnRef); !ok || col.Table != "p" || col.Name != "Symbol" {
+		t.Errorf("expected ON left side p.Symbol, got %+v", on.Left)
+	}
+
+	if query.Joins[1].TableName != "sectors" || query.Joins[1].TableAlias != "" {
+		t.Errorf("unexpected second join: %+v", query.Joins[1])
+	}
+}
+
+func TestParseOuterJoins(t *testing.T) {
+	query := mustParse(t, "SELECT * FROM a LEFT JOIN b ON a.k = b.k RIGHT OUTER JOIN c ON a.k = c.k FULL JOIN d ON a.k = d.k")
+
+	want := []string{"LEFT", "RIGHT", "FULL"}
+	if len(query.Joins) != len(want) {
+		t.Fatalf("expected %d joins, got %d", len(want), len(query.Joins))
+	}
+	for i, w := range want {
+		if query.Joins[i].Type != w {
+			t.Errorf("join %d: expected %s, got %s", i, w, query.Joins[i].Type)
+		}
+	}
+}
+
+func TestParseCrossJoin(t *testing.T) {
+	query := mustParse(t, "SELECT * FROM a, b CROSS JOIN c WHERE a.k = b.k")
+
+	if len(query.Joins) != 2 {
+		t.Fatalf("expected 2 joins, got %d", len(query.Joins))
+	}
+	for i, j := range query.Joins {
+		if j.Type != "CROSS" || j.On != nil {
+			t.Errorf("join %d: expected CROSS join without ON, got %+v", i, j)
+		}
+	}
+	if query.Where == nil {
+		t.Errorf("expected WHERE after comma-separated FROM list")
+	}
+}
+
+func TestParseDerivedTable(t *testing.T) {
+	query := mustParse(t, "SELECT x FROM (SELECT Close AS x FROM prices WHERE Close > 100) t")
+
+	if query.Subquery == nil || query.TableAlias != "t" {
+		t.Fatalf("expected derived table aliased t, got %+v", query)
+	}
+
+	alias, ok := query.Subquery.Projections[0].(*AliasExpr)
+	if !ok || alias.Alias != "x" {
+		t.Fatalf("expected inner projection aliased x, got %+v", query.Subquery.Projections[0])
+	}
+	if col, ok := alias.Expr.(*ColumnRef); !ok || col.Name != "Close" {
+		t.Errorf("expected aliased expression Close, got %+v", alias.Expr)
+	}
+	if query.Subquery.Where == nil {
+		t.Errorf("expected inner WHERE to be parsed")
+	}
+}
+
+func TestParseInAndExistsSubqueries(t *testing.T) {
+	query := mustParse(t, "SELECT Close FROM prices p WHERE Date NOT IN (SELECT Date FROM other) AND NOT EXISTS (SELECT Date FROM other o WHERE o.Date = p.Date)")
+
+	and, ok := query.Where.(*BinaryExpr)
+	if !ok || and.Op != "AND" {
+		t.Fatalf("expected AND at the root of WHERE, got %+v", query.Where)
+	}
+
+	in, ok := and.Left.(*InExpr)
+	if !ok || !in.Not || in.Subquery.TableName != "other" {
+		t.Errorf("expected NOT IN subquery over other, got %+v", and.Left)
+	}
+
+	exists, ok := and.Right.(*ExistsExpr)
+	if !ok || !exists.Not || exists.Subquery.Where == nil {
+		t.Errorf("expected correlated NOT EXISTS, got %+v", and.Right)
+	}
+}
+
+func TestParseScalarSubquery(t *testing.T) {
+	query := mustParse(t, "SELECT Close, (SELECT MAX(Close) FROM prices) AS max_close FROM prices")
+
+	alias, ok := query.Projections[1].(*AliasExpr)
+	if !ok || alias.Alias != "max_close" {
+		t.Fatalf("expected aliased second projection, got %+v", query.Projections[1])
+	}
+	sub, ok := alias.Expr.(*SubqueryExpr)
+	if !ok {
+		t.Fatalf("expected scalar subquery, got %+v", alias.Expr)
+	}
+	if fc, ok := sub.Subquery.Projections[0].(*FuncCall); !ok || fc.Name != "MAX" {
+		t.Errorf("expected MAX(Close) inside subquery, got %+v", sub.Subquery.Projections[0])
+	}
+}
+
+func TestParseWith(t *testing.T) {
+	query := mustParse(t, "WITH daily AS (SELECT Date, AVG(Close) FROM prices GROUP BY Date), top AS (SELECT Date FROM daily) SELECT * FROM daily JOIN top ON daily.Date = top.Date")
+
+	if len(query.With) != 2 {
+		t.Fatalf("expected 2 CTEs, got %d", len(query.With))
+	}
+	if query.With[0].Name != "daily" || len(query.With[0].Query.GroupBy) != 1 {
+		t.Errorf("unexpected first CTE: %+v", query.With[0])
+	}
+	if query.With[1].Name != "top" || query.With[1].Query.TableName != "daily" {
+		t.Errorf("unexpected second CTE: %+v", query.With[1])
+	}
+	if query.TableName != "daily" {
+		t.Errorf("expected main query to read daily, got %s", query.TableName)
+	}
+}
+
+func TestParseSetOperations(t *testing.T) {
+	query := mustParse(t, "SELECT Date FROM a UNION ALL SELECT Date FROM b EXCEPT SELECT Date FROM c ORDER BY Date")
+
+	if len(query.SetOps) != 2 {
+		t.Fatalf("expected 2 set operations, got %d", len(query.SetOps))
+	}
+	if query.SetOps[0].Op != "UNION" || !query.SetOps[0].All || query.SetOps[0].Query.TableName != "b" {
+		t.Errorf("unexpected first set operation: %+v", query.SetOps[0])
+	}
+	if query.SetOps[1].Op != "EXCEPT" || query.SetOps[1].All {
+		t.Errorf("unexpected second set operation: %+v", query.SetOps[1])
+	}
+	if len(query.OrderBy) != 1 || len(query.SetOps[1].Query.OrderBy) != 0 {
+		t.Errorf("expected ORDER BY to apply to the whole statement")
+	}
+}
+
+func TestParseInList(t *testing.T) {
+	query := mustParse(t, "SELECT Close FROM prices WHERE Close NOT IN (1, 2.5, Open + 1)")
+
+	in, ok := query.Where.(*InExpr)
+	if !ok || !in.Not || in.Subquery != nil {
+		t.Fatalf("expected NOT IN value list, got %+v", query.Where)
+	}
+	if len(in.Values) != 3 {
+		t.Fatalf("expected 3 values, got %d", len(in.Values))
+	}
+	if _, ok := in.Values[2].(*BinaryExpr); !ok {
+		t.Errorf("expected expression value, got %+v", in.Values[2])
+	}
+}
+
+func TestParseBetween(t *testing.T) {
+	query := mustParse(t, "SELECT Close FROM prices WHERE Close BETWEEN 1000 AND 2000 + 1 AND Open NOT BETWEEN 1 AND 2")
+
+	and, ok := query.Where.(*BinaryExpr)
+	if !ok || and.Op != "AND" {
+		t.Fatalf("expected AND joining the two BETWEENs, got %+v", query.Where)
+	}
+
+	between, ok := and.Left.(*BetweenExpr)
+	if !ok || between.Not {
+		t.Fatalf("expected BETWEEN, got %+v", and.Left)
+	}
+	if hi, ok := between.High.(*BinaryExpr); !ok || hi.Op != "+" {
+		t.Errorf("expected upper bound 2000 + 1, got %+v", between.High)
+	}
+
+	if nb, ok := and.Right.(*BetweenExpr); !ok || !nb.Not {
+		t.Errorf("expected NOT BETWEEN, got %+v", and.Right)
+	}
+}
+
+func TestParseLike(t *testing.T) {
+	query := mustParse(t, "SELECT Close FROM prices WHERE Date LIKE UPPER('2021-%') AND Date NOT LIKE '%-01'")
+
+	and, ok := query.Where.(*BinaryExpr)
+	if !ok || and.Op != "AND" {
+		t.Fatalf("expected AND joining the two LIKEs, got %+v", query.Where)
+	}
+	like, ok := and.Left.(*LikeExpr)
+	if !ok || like.Not {
+		t.Fatalf("expected LIKE, got %+v", and.Left)
+	}
+	if _, ok := like.Pattern.(*FuncCall); !ok {
+		t.Errorf("expected the pattern UPPER('2021-%%'), got %+v", like.Pattern)
+	}
+	if nl, ok := and.Right.(*LikeExpr); !ok || !nl.Not {
+		t.Errorf("expected NOT LIKE, got %+v", and.Right)
+	}
+	if got, want := FormatExpr(and.Right), "(Date NOT LIKE '%-01')"; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestParseUnaryNot(t *testing.T) {
+	query := mustParse(t, "SELECT Close FROM prices WHERE NOT NOT Close > 100 AND NOT (Open < 5 OR Volume > 10)")
+
+	and, ok := query.Where.(*BinaryExpr)
+	if !ok || and.Op != "AND" {
+		t.Fatalf("expected AND at the root, got %+v", query.Where)
+	}
+
+	outer, ok := and.Left.(*UnaryExpr)
+	if !ok || outer.Op != "NOT" {
+		t.Fatalf("expected NOT on the left, got %+v", and.Left)
+	}
+	inner, ok := outer.Expr.(*UnaryExpr)
+	if !ok {
+		t.Fatalf("expected nested NOT, got %+v", outer.Expr)
+	}
+	if cmp, ok := inner.Expr.(*BinaryExpr); !ok || cmp.Op != ">" {
+		t.Errorf("expected NOT to apply to the whole comparison, got %+v", inner.Expr)
+	}
+
+	right, ok := and.Right.(*UnaryExpr)
+	if !ok {
+		t.Fatalf("expected NOT on the right, got %+v", and.Right)
+	}
+	if or, ok := right.Expr.(*BinaryExpr); !ok || or.Op != "OR" {
+		t.Errorf("expected NOT over the parenthesized OR, got %+v", right.Expr)
+	}
+}
+
+func TestParseStringLiteral(t *testing.T) {
+	query := mustParse(t, "SELECT Close FROM prices WHERE Date = '2020-12-01' OR Note = 'it''s' OR Code = '123'")
+
+	or, ok := query.Where.(*BinaryExpr)
+	if !ok || or.Op != "OR" {
+		t.Fatalf("expected OR at the root, got %+v", query.Where)
+	}
+	escaped := or.Left.(*BinaryExpr).Right.(*BinaryExpr).Right.(*Literal)
+	if escaped.Value != "it's" || escaped.Kind != LiteralString {
+		t.Errorf("expected escaped string it's, got %+v", escaped)
+	}
+
+	numeric := or.Right.(*BinaryExpr).Right.(*Literal)
+	if numeric.Value != "123" || numeric.Kind != LiteralString {
+		t.Errorf("expected '123' to stay a string literal, got %+v", numeric)
+	}
+
+	if got := query.String(); !strings.Contains(got, "'it''s'") {
+		t.Errorf("expected String() to re-escape quotes, got %s", got)
+	}
+}
+
+func TestLexUnterminatedString(t *testing.T) {
+	if _, err := NewParser("SELECT Close FROM prices WHERE Date = '2020").Parse(); err == nil {
+		t.Errorf("expected unterminated string to be rejected")
+	}
+}
+
+func TestLexComparisonOperators(t *testing.T) {
+	lexer := NewLexer("a != b <> c >= d <= e > f < g = h")
+
+	var ops []string
+	for tok := lexer.NextToken(); tok.Type != TOKEN_EOF; tok = lexer.NextToken() {
+		if tok.Type == TOKEN_OPERATOR {
+			ops = append(ops, tok.Literal)
+		}
+	}
+
+	want := []string{"!=", "<>", ">=", "<=", ">", "<", "="}
+	if len(ops) != len(want) {
+		t.Fatalf("expected operators %v, got %v", want, ops)
+	}
+	for i := range want {
+		if ops[i] != want[i] {
+			t.Errorf("operator %d: expected %s, got %s", i, want[i], ops[i])
+		}
+	}
+}
+
+func TestParseComments(t *testing.T) {
+	queryStr := `-- daily closes
+SELECT Date, /* the closing price */ Close
+FROM prices -- main table
+WHERE Close > 1000 /* filter
+spanning lines */ ORDER BY Close -- trailing`
+	query := mustParse(t, queryStr)
+
+	if len(query.Projections) != 2 || query.TableName != "prices" {
+		t.Errorf("unexpected query: %s", query.String())
+	}
+	if query.Where == nil || len(query.OrderBy) != 1 {
+		t.Errorf("expected WHERE and ORDER BY around comments, got %s", query.String())
+	}
+}
+
+func TestParseQuotedIdentifiers(t *testing.T) {
+	query := mustParse(t, "SELECT \"Market Cap\", `Close` AS \"select\" FROM prices WHERE \"Market Cap\" > 5")
+
+	col, ok := query.Projections[0].(*ColumnRef)
+	if !ok || col.Name != "Market Cap" || !col.Quoted {
+		t.Errorf("expected quoted column Market Cap, got %+v", query.Projections[0])
+	}
+
+	alias, ok := query.Projections[1].(*AliasExpr)
+	if !ok || alias.Alias != "select" {
+		t.Fatalf("expected quoted keyword usable as alias, got %+v", query.Projections[1])
+	}
+	if col, ok := alias.Expr.(*ColumnRef); !ok || col.Name != "Close" || !col.Quoted {
+		t.Errorf("expected backtick-quoted Close, got %+v", alias.Expr)
+	}
+
+	if got := query.String(); !strings.Contains(got, `"Market Cap" > 5`) {
+		t.Errorf("expected String() to keep quotes, got %s", got)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, sql := range []string{
+		"SELECT",
+		"SELECT Close FROM",
+		"SELECT Close, FROM prices",
+		"SELECT FROM prices",
+		"SELECT Close FROM prices WHERE (Close > 1",
+		"SELECT Close FROM prices ORDER Close",
+		"SELECT Close FROM prices WHERE Close ! 1",
+		"SELECT Close FROM prices extra tokens",
+		"SELECT Close FROM prices /* unterminated",
+	} {
+		query, err := NewParser(sql).Parse()
+		if err == nil {
+			t.Errorf("expected %q to fail, got %s", sql, query)
+		} else if !strings.HasPrefix(err.Error(), "syntax error: ") {
+			t.Errorf("unexpected error for %q: %v", sql, err)
+		}
+	}
+}
+
+func TestParseSignedAndExponentLiterals(t *testing.T) {
+	query := mustParse(t, "SELECT -Close, 1.2e9, 5E-3 FROM prices WHERE Close > -5 AND Open < 2 * -1")
+
+	if u, ok := query.Projections[0].(*UnaryExpr); !ok || u.Op != "-" {
+		t.Errorf("expected unary minus, got %+v", query.Projections[0])
+	}
+	for i, want := range []string{"1.2e9", "5E-3"} {
+		if lit, ok := query.Projections[i+1].(*Literal); !ok || lit.Value != want {
+			t.Errorf("expected literal %s, got %+v", want, query.Projections[i+1])
+		}
+	}
+
+	if got, want := formatExpr(query.Where), "((Close > -5) AND (Open < (2 * -1)))"; got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestParseWindowFunction(t *testing.T) {
+	query := mustParse(t, "SELECT Date, ROW_NUMBER() OVER (PARTITION BY Date ORDER BY Close), SUM(Close) OVER () FROM prices")
+
+	w, ok := query.Projections[1].(*WindowExpr)
+	if !ok {
+		t.Fatalf("expected window expression, got %+v", query.Projections[1])
+	}
+	if w.Func.Name != "ROW_NUMBER" || len(w.PartitionBy) != 1 || len(w.OrderBy) != 1 {
+		t.Errorf("unexpected window %+v", w)
+	}
+
+	if got, want := formatExpr(query.Projections[2]), "SUM(Close) OVER ()"; got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestParseCast(t *testing.T) {
+	query := mustParse(t, "SELECT CAST(Volume AS BIGINT), Close::double precision * 2, Price::decimal(10, 2) FROM prices")
+
+	if c, ok := query.Projections[0].(*CastExpr); !ok || c.Type != "BIGINT" {
+		t.Errorf("expected CAST to BIGINT, got %+v", query.Projections[0])
+	}
+
+	mul, ok := query.Projections[1].(*BinaryExpr)
+	if !ok || mul.Op != "*" {
+		t.Fatalf("expected :: to bind tighter than *, got %+v", query.Projections[1])
+	}
+	if c, ok := mul.Left.(*CastExpr); !ok || c.Type != "DOUBLE PRECISION" {
+		t.Errorf("expected cast to DOUBLE PRECISION, got %+v", mul.Left)
+	}
+
+	if got, want := formatExpr(query.Projections[2]), "CAST(Price AS DECIMAL(10, 2))"; got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestParseExtract(t *testing.T) {
+	query := mustParse(t, "SELECT EXTRACT(year FROM Date + 1), extract(DOW FROM Date) FROM prices")
+	for i, want := range []string{"DATE_PART('year', (Date + 1))", "DATE_PART('dow', Date)"} {
+		if got := formatExpr(query.Projections[i]); got != want {
+			t.Errorf("expected %s, got %s", want, got)
+		}
+	}
+	if _, err := NewParser("SELECT EXTRACT(YEAR, Date) FROM prices").Parse(); err == nil {
+		t.Errorf("expected EXTRACT without FROM to fail")
+	}
+}
+
+func TestParseTypedLiterals(t *testing.T) {
+	query := mustParse(t, "SELECT Date FROM prices WHERE Date >= DATE '2021-01-01' AND Time < (TIMESTAMP '2021-01-01 09:30:00' + INTERVAL '7 days')")
+
+	if col, ok := query.Projections[0].(*ColumnRef); !ok || col.Name != "Date" {
+		t.Errorf("expected Date to stay a column reference, got %+v", query.Projections[0])
+	}
+
+	want := "((Date >= DATE '2021-01-01') AND (Time < (TIMESTAMP '2021-01-01 09:30:00' + INTERVAL '7 days')))"
+	if got := formatExpr(query.Where); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestParseScript(t *testing.T) {
+	script := `
+		-- daily closes
+		SELECT Date, Close FROM prices WHERE Note = 'a;b';
+		;
+		WITH t AS (SELECT Close FROM prices) SELECT Close FROM t
+	`
+	stmts, err := NewParser(script).ParseScript()
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if len(stmts) != 2 {
+		t.Fatalf("expected 2 statements, got %d", len(stmts))
+	}
+	if q, ok := stmts[1].(*Query); !ok || len(q.With) != 1 {
+		t.Errorf("expected second statement to be a WITH query, got %s", stmts[1])
+	}
+
+	if _, err := NewParser("SELECT Close FROM a SELECT Close FROM b").ParseScript(); err == nil {
+		t.Errorf("expected statements without a separator to fail")
+	}
+	// A single query may end with a semicolon too
+	mustParse(t, "SELECT Close FROM prices;")
+}
+
+func TestParseInsert(t *testing.T) {
+	stmts, err := NewParser("INSERT INTO prices (Date, Close) VALUES ('2021-01-01', 10.5), ('2021-01-02', -1)").ParseScript()
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	insert, ok := stmts[0].(*InsertStmt)
+	if !ok {
+		t.Fatalf("expected an INSERT statement, got %T", stmts[0])
+	}
+	if insert.TableName != "prices" || len(insert.Columns) != 2 || len(insert.Rows) != 2 {
+		t.Errorf("unexpected statement %+v", insert)
+	}
+	if got, want := insert.String(), "INSERT INTO prices (Date, Close) VALUES ('2021-01-01', 10.5), ('2021-01-02', -1)"; got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	if _, err := NewParser("INSERT INTO prices VALUES").ParseScript(); err == nil {
+		t.Errorf("expected INSERT without rows to fail")
+	}
+
+	for _, sql := range []string{
+		"INSERT INTO prices VALUES ('2021-01-01', 1) ON CONFLICT (Date) DO NOTHING",
+		"INSERT INTO prices VALUES ('2021-01-01', 1) ON CONFLICT (Date, Close) DO UPDATE SET Close = excluded.Close, Volume = 0",
+	} {
+		stmts, err := NewParser(sql).ParseScript()
+		if err != nil {
+			t.Fatalf("parse %q failed: %v", sql, err)
+		}
+		if got := stmts[0].String(); got != sql {
+			t.Errorf("expected %s, got %s", sql, got)
+		}
+	}
+	for _, sql := range []string{
+		"INSERT INTO prices VALUES (1) ON CONFLICT DO NOTHING",
+		"INSERT INTO prices VALUES (1) ON CONFLICT (Date) NOTHING",
+		"INSERT INTO prices VALUES (1) ON CONFLICT (Date) DO DELETE",
+	} {
+		if _, err := NewParser(sql).ParseScript(); err == nil {
+			t.Errorf("expected %q to fail", sql)
+		}
+	}
+}
+
+func TestParseCreateTableAs(t *testing.T) {
+	stmts, err := NewParser("CREATE TABLE daily_avg AS SELECT Date, AVG(Close) FROM prices GROUP BY Date").ParseScript()
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	create, ok := stmts[0].(*CreateTableStmt)
+	if !ok {
+		t.Fatalf("expected a CREATE TABLE statement, got %T", stmts[0])
+	}
+	if create.TableName != "daily_avg" || len(create.Query.GroupBy) != 1 {
+		t.Errorf("unexpected statement %s", create)
+	}
+
+	if _, err := NewParser("CREATE TABLE t SELECT 1").ParseScript(); err == nil {
+		t.Errorf("expected CREATE TABLE without AS to fail")
+	}
+
+	for _, sql := range []string{"CREATE TEMP TABLE staged AS SELECT Close FROM prices", "create temporary table staged as select Close from prices"} {
+		stmts, err := NewParser(sql).ParseScript()
+		if err != nil {
+			t.Fatalf("parse %q failed: %v", sql, err)
+		}
+		if create, ok := stmts[0].(*CreateTableStmt); !ok || !create.Temp || create.String() != "CREATE TEMP TABLE staged AS SELECT Close FROM prices" {
+			t.Errorf("unexpected statement %s", stmts[0])
+		}
+	}
+	for _, sql := range []string{"CREATE TEMP VIEW v AS SELECT 1", "CREATE OR REPLACE TEMP TABLE t AS SELECT 1"} {
+		if _, err := NewParser(sql).ParseScript(); err == nil {
+			t.Errorf("expected %q to fail", sql)
+		}
+	}
+}
+
+func TestParseViews(t *testing.T) {
+	stmts, err := NewParser("CREATE VIEW big AS SELECT * FROM prices WHERE Close > 100; CREATE OR REPLACE VIEW big AS SELECT Close FROM prices; DROP VIEW IF EXISTS big; DROP VIEW big").ParseScript()
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if create, ok := stmts[0].(*CreateViewStmt); !ok || create.ViewName != "big" || create.OrReplace || create.Query.Where == nil {
+		t.Errorf("unexpected statement %+v", stmts[0])
+	}
+	if got, want := stmts[1].String(), "CREATE OR REPLACE VIEW big AS SELECT Close FROM prices"; got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+	if drop, ok := stmts[2].(*DropViewStmt); !ok || !drop.IfExists || drop.ViewName != "big" {
+		t.Errorf("unexpected statement %+v", stmts[2])
+	}
+	if drop, ok := stmts[3].(*DropViewStmt); !ok || drop.IfExists {
+		t.Errorf("unexpected statement %+v", stmts[3])
+	}
+
+	for _, sql := range []string{"CREATE OR REPLACE TABLE t AS SELECT 1", "CREATE VIEW v SELECT 1", "DROP TABLES t"} {
+		if _, err := NewParser(sql).ParseScript(); err == nil {
+			t.Errorf("expected %q to fail", sql)
+		}
+	}
+}
+
+func TestParseDropTableAndTruncate(t *testing.T) {
+	stmts, err := NewParser("DROP TABLE prices; DROP TABLE IF EXISTS old; TRUNCATE prices; TRUNCATE TABLE prices").ParseScript()
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if drop, ok := stmts[0].(*DropTableStmt); !ok || drop.TableName != "prices" || drop.IfExists {
+		t.Errorf("unexpected statement %+v", stmts[0])
+	}
+	if got, want := stmts[1].String(), "DROP TABLE IF EXISTS old"; got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+	for _, stmt := range stmts[2:] {
+		if trunc, ok := stmt.(*TruncateStmt); !ok || trunc.TableName != "prices" {
+			t.Errorf("unexpected statement %+v", stmt)
+		}
+	}
+
+	if _, err := NewParser("DROP TABLE IF prices").ParseScript(); err == nil {
+		t.Errorf("expected IF without EXISTS to fail")
+	}
+}
+
+func TestParseValues(t *testing.T) {
+	q := mustParse(t, "SELECT * FROM (VALUES (1, 'a'), (2, 'b')) AS t(id, name) JOIN prices p(d) ON t.id = p.Close")
+	if q.Subquery == nil || len(q.Subquery.Values) != 2 || q.TableAlias != "t" || fmt.Sprint(q.Columns) != "[id name]" {
+		t.Errorf("unexpected FROM clause %+v", q)
+	}
+	if j := q.Joins[0]; j.TableAlias != "p" || fmt.Sprint(j.Columns) != "[d]" {
+		t.Errorf("unexpected join %+v", j)
+	}
+	want := "SELECT * FROM (VALUES (1, 'a'), (2, 'b')) t(id, name) INNER JOIN prices p(d) ON (t.id = p.Close)"
+	if got := q.String(); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	stmts, err := NewParser("VALUES (1), (2)").ParseScript()
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if v, ok := stmts[0].(*Query); !ok || len(v.Values) != 2 {
+		t.Errorf("expected a VALUES query, got %+v", stmts[0])
+	}
+
+	if _, err := NewParser("SELECT * FROM (VALUES (1), ) t").Parse(); err == nil {
+		t.Errorf("expected a trailing comma in VALUES to fail")
+	}
+}
+
+func TestParseDelete(t *testing.T) {
+	stmts, err := NewParser("DELETE FROM prices WHERE Close < 100; DELETE FROM prices").ParseScript()
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if del, ok := stmts[0].(*DeleteStmt); !ok || del.TableName != "prices" || del.Where == nil {
+		t.Errorf("unexpected statement %+v", stmts[0])
+	}
+	if del, ok := stmts[1].(*DeleteStmt); !ok || del.Where != nil {
+		t.Errorf("expected DELETE without WHERE, got %+v", stmts[1])
+	}
+}
+
+func TestParseUpdate(t *testing.T) {
+	stmts, err := NewParser("UPDATE prices SET Close = Close * 2, Volume = 0 WHERE Date = '2020-12-01'").ParseScript()
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	update, ok := stmts[0].(*UpdateStmt)
+	if !ok {
+		t.Fatalf("expected an UPDATE statement, got %T", stmts[0])
+	}
+	if len(update.Set) != 2 || update.Set[0].Column != "Close" || update.Where == nil {
+		t.Errorf("unexpected statement %+v", update)
+	}
+	if got, want := update.String(), "UPDATE prices SET Close = (Close * 2), Volume = 0 WHERE (Date = '2020-12-01')"; got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	if _, err := NewParser("UPDATE prices SET Close > 1").ParseScript(); err == nil {
+		t.Errorf("expected SET without '=' to fail")
+	}
+}
+
+func TestParseCopy(t *testing.T) {
+	stmts, err := NewParser("COPY prices TO 'out.parquet' (FORMAT PARQUET); COPY prices FROM 'in.csv'; COPY (SELECT Close FROM prices) TO 'c.csv' WITH (format csv, header true)").ParseScript()
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	to, ok := stmts[0].(*CopyStmt)
+	if !ok || to.From || to.TableName != "prices" || to.Path != "out.parquet" || to.Options["FORMAT"] != "PARQUET" {
+		t.Errorf("unexpected COPY TO %+v", stmts[0])
+	}
+	if from, ok := stmts[1].(*CopyStmt); !ok || !from.From || from.Path != "in.csv" {
+		t.Errorf("unexpected COPY FROM %+v", stmts[1])
+	}
+	if q, ok := stmts[2].(*CopyStmt); !ok || q.Query == nil || q.Options["HEADER"] != "true" {
+		t.Errorf("unexpected COPY query %+v", stmts[2])
+	} else if got, want := q.String(), "COPY (SELECT Close FROM prices) TO 'c.csv' (FORMAT csv, HEADER true)"; got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	if _, err := NewParser("COPY (SELECT Close FROM prices) FROM 'in.csv'").ParseScript(); err == nil {
+		t.Errorf("expected COPY query FROM to fail")
+	}
+}
+
+func TestParseShowAndDescribe(t *testing.T) {
+	stmts, err := NewParser("SHOW TABLES; DESCRIBE prices; summarize prices").ParseScript()
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if _, ok := stmts[0].(*ShowTablesStmt); !ok {
+		t.Errorf("expected SHOW TABLES, got %T", stmts[0])
+	}
+	if d, ok := stmts[1].(*DescribeStmt); !ok || d.TableName != "prices" {
+		t.Errorf("expected DESCRIBE prices, got %+v", stmts[1])
+	}
+	if s, ok := stmts[2].(*SummarizeStmt); !ok || s.TableName != "prices" {
+		t.Errorf("expected SUMMARIZE prices, got %+v", stmts[2])
+	}
+
+	if _, err := NewParser("SHOW prices").ParseScript(); err == nil {
+		t.Errorf("expected SHOW without TABLES to fail")
+	}
+}
+
+func TestParseSet(t *testing.T) {
+	stmts, err := NewParser("SET null_ordering = nulls_first; SET Memory_Limit TO '64MB'; SET batch_size = -1").ParseScript()
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	want := []SetStmt{
+		{Name: "null_ordering", Value: "nulls_first"},
+		{Name: "memory_limit", Value: "64MB"},
+		{Name: "batch_size", Value: "-1"},
+	}
+	for i, w := range want {
+		s, ok := stmts[i].(*SetStmt)
+		if !ok || *s != w {
+			t.Errorf("statement %d: expected %+v, got %+v", i, w, stmts[i])
+		}
+	}
+
+	if _, err := NewParser("SET null_ordering").ParseScript(); err == nil {
+		t.Errorf("expected SET without a value to fail")
+	}
+}
+
+func TestParseOrderByDirection(t *testing.T) {
+	q := mustParse(t, "SELECT Date, Close FROM prices ORDER BY Date DESC NULLS LAST, Close asc, Volume NULLS FIRST")
+	want := []OrderByItem{
+		{Desc: true, Nulls: NullsLast},
+		{},
+		{Nulls: NullsFirst},
+	}
+	if len(q.OrderBy) != len(want) {
+		t.Fatalf("expected %d ORDER BY keys, got %d", len(want), len(q.OrderBy))
+	}
+	for i, w := range want {
+		if got := q.OrderBy[i]; got.Desc != w.Desc || got.Nulls != w.Nulls {
+			t.Errorf("key %d: expected %+v, got %+v", i, w, got)
+		}
+	}
+	if got := q.String(); got != "SELECT Date, Close FROM prices ORDER BY Date DESC NULLS LAST, Close, Volume NULLS FIRST" {
+		t.Errorf("unexpected String(): %s", got)
+	}
+
+	if _, err := NewParser("SELECT Close FROM prices ORDER BY Close NULLS").Parse(); err == nil {
+		t.Errorf("expected NULLS without FIRST or LAST to fail")
+	}
+}
+
+func TestParseNestedFunctionCalls(t *testing.T) {
+	q := mustParse(t, "SELECT ROUND(AVG(Close), 2), coalesce(lower(trim(Date)), 'none') FROM prices")
+
+	round, ok := q.Projections[0].(*FuncCall)
+	if !ok || round.Name != "ROUND" || len(round.Args) != 2 {
+		t.Fatalf("expected ROUND with two arguments, got %#v", q.Projections[0])
+	}
+	if avg, ok := round.Args[0].(*FuncCall); !ok || avg.Name != "AVG" {
+		t.Errorf("expected AVG inside ROUND, got %#v", round.Args[0])
+	}
+	if got := formatExpr(q.Projections[1]); got != "COALESCE(LOWER(TRIM(Date)), 'none')" {
+		t.Errorf("unexpected nested call %s", got)
+	}
+}
+
+func TestParseBooleanAndNullLiterals(t *testing.T) {
+	q := mustParse(t, "SELECT NULL, true FROM flags WHERE big = TRUE AND Close IS NOT NULL OR Volume IS NULL")
+
+	if lit, ok := q.Projections[0].(*Literal); !ok || lit.Kind != LiteralNull {
+		t.Errorf("expected a NULL literal, got %#v", q.Projections[0])
+	}
+	if lit, ok := q.Projections[1].(*Literal); !ok || lit.Kind != LiteralBool || lit.Value != "TRUE" {
+		t.Errorf("expected a TRUE literal, got %#v", q.Projections[1])
+	}
+	want := "(((big = TRUE) AND (Close IS NOT NULL)) OR (Volume IS NULL))"
+	if got := formatExpr(q.Where); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	if _, err := NewParser("SELECT Close FROM prices WHERE Close IS 1").Parse(); err == nil {
+		t.Errorf("expected IS without NULL to fail")
+	}
+}
+
+func TestParseStarExcludeReplace(t *testing.T) {
+	q := mustParse(t, "SELECT * EXCLUDE (Volume, Date) REPLACE (Close * 2 AS Close), Date FROM prices")
+	star, ok := q.Projections[0].(*StarExpr)
+	if !ok {
+		t.Fatalf("expected a star, got %#v", q.Projections[0])
+	}
+	if fmt.Sprint(star.Exclude) != "[Volume Date]" || len(star.Replace) != 1 || star.Replace[0].Alias != "Close" {
+		t.Errorf("unexpected modifiers %+v", star)
+	}
+	if got := q.String(); got != "SELECT * EXCLUDE (Volume, Date) REPLACE ((Close * 2) AS Close), Date FROM prices" {
+		t.Errorf("unexpected String(): %s", got)
+	}
+
+	single := mustParse(t, "SELECT * EXCLUDE Volume FROM prices")
+	if star := single.Projections[0].(*StarExpr); len(star.Exclude) != 1 || star.Exclude[0] != "Volume" {
+		t.Errorf("expected EXCLUDE Volume, got %+v", star)
+	}
+
+	if _, err := NewParser("SELECT * REPLACE (Close * 2) FROM prices").Parse(); err == nil {
+		t.Errorf("expected REPLACE without AS to fail")
+	}
+}
+
+func TestParseOperatorPrecedence(t *testing.T) {
+	cases := map[string]string{
+		"a + b > c + d":               "((a + b) > (c + d))",
+		"a * b + c = d - e / f":       "(((a * b) + c) = (d - (e / f)))",
+		"NOT a = b AND c < d OR e":    "(((NOT (a = b)) AND (c < d)) OR e)",
+		"a + 1 BETWEEN b - 1 AND b*2": "((a + 1) BETWEEN (b - 1) AND (b * 2))",
+		"a - b IN (1, 2)":             "((a - b) IN (1, 2))",
+		"a + b IS NULL":               "((a + b) IS NULL)",
+		"-a * b":                      "((- a) * b)",
+	}
+	for where, want := range cases {
+		q := mustParse(t, "SELECT a FROM t WHERE "+where)
+		if got := formatExpr(q.Where); got != want {
+			t.Errorf("%s: expected %s, got %s", where, want, got)
+		}
+	}
+}
+
+func TestPositions(t *testing.T) {
+	q := mustParse(t, "SELECT Date,\n  ROUND(Close)\nFROM prices")
+	col := q.Projections[0].(*ColumnRef)
+	if col.Pos != (Pos{Offset: 7, Line: 1, Column: 8}) {
+		t.Errorf("unexpected column position %+v", col.Pos)
+	}
+	fc := q.Projections[1].(*FuncCall)
+	if fc.Pos != (Pos{Offset: 15, Line: 2, Column: 3}) {
+		t.Errorf("unexpected function position %+v", fc.Pos)
+	}
+
+	query := "SELECT Close\nFROM prices WHERE Close >> 1"
+	_, err := NewParser(query).Parse()
+	var serr *SyntaxError
+	if !errors.As(err, &serr) {
+		t.Fatalf("expected a *SyntaxError, got %v", err)
+	}
+	if serr.Pos.Line != 2 || serr.Pos.Column != 26 {
+		t.Errorf("unexpected error position %+v", serr.Pos)
+	}
+	want := err.Error() + "\nFROM prices WHERE Close >> 1\n                         ^"
+	if got := FormatError(query, err); got != want {
+		t.Errorf("unexpected FormatError output:\n%s", got)
+	}
+}
+
+func TestParseQualify(t *testing.T) {
+	q := mustParse(t, "SELECT Date, Close FROM prices WHERE Close > 0 QUALIFY ROW_NUMBER() OVER (PARTITION BY Date ORDER BY Close DESC) = 1 ORDER BY Date")
+	if q.Qualify == nil || q.Where == nil || len(q.OrderBy) != 1 {
+		t.Fatalf("unexpected query %+v", q)
+	}
+	want := "SELECT Date, Close FROM prices WHERE (Close > 0) QUALIFY (ROW_NUMBER() OVER (PARTITION BY Date ORDER BY Close DESC) = 1) ORDER BY Date"
+	if got := q.String(); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+}
+
+func TestParseMerge(t *testing.T) {
+	sql := `MERGE INTO prices p USING (SELECT Date, Close FROM updates) u ON p.Date = u.Date
+		WHEN MATCHED AND u.Close IS NULL THEN DELETE
+		WHEN MATCHED THEN UPDATE SET Close = u.Close
+		WHEN NOT MATCHED THEN INSERT (Date, Close) VALUES (u.Date, u.Close)`
+	stmts, err := NewParser(sql).ParseScript()
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	merge, ok := stmts[0].(*MergeStmt)
+	if !ok {
+		t.Fatalf("expected a MERGE statement, got %T", stmts[0])
+	}
+	if merge.TableAlias != "p" || merge.Source == nil || merge.SourceAlias != "u" || len(merge.Clauses) != 3 {
+		t.Errorf("unexpected statement %+v", merge)
+	}
+	if c := merge.Clauses[0]; !c.Matched || c.Cond == nil || c.Action != "DELETE" {
+		t.Errorf("unexpected first clause %+v", c)
+	}
+	if c := merge.Clauses[2]; c.Matched || c.Action != "INSERT" || len(c.Columns) != 2 || len(c.Values) != 2 {
+		t.Errorf("unexpected last clause %+v", c)
+	}
+	want := "MERGE INTO prices p USING (SELECT Date, Close FROM updates) u ON (p.Date = u.Date)" +
+		" WHEN MATCHED AND (u.Close IS NULL) THEN DELETE WHEN MATCHED THEN UPDATE SET Close = u.Close" +
+		" WHEN NOT MATCHED THEN INSERT (Date, Close) VALUES (u.Date, u.Close)"
+	if got := merge.String(); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	for _, bad := range []string{
+		"MERGE INTO prices USING updates ON prices.Date = updates.Date",
+		"MERGE INTO prices USING updates ON prices.Date = updates.Date WHEN MATCHED THEN INSERT VALUES (1)",
+		"MERGE INTO prices USING updates ON prices.Date = updates.Date WHEN NOT MATCHED THEN DELETE",
+	} {
+		if _, err := NewParser(bad).ParseScript(); err == nil {
+			t.Errorf("expected %q to fail", bad)
+		}
+	}
+}
+
+func TestParseDistinct(t *testing.T) {
+	q := mustParse(t, "SELECT DISTINCT ON (Date, Close > 1) Date, Close FROM prices ORDER BY Date, Close DESC")
+	if !q.Distinct || len(q.DistinctOn) != 2 {
+		t.Fatalf("unexpected query %+v", q)
+	}
+	want := "SELECT DISTINCT ON (Date, (Close > 1)) Date, Close FROM prices ORDER BY Date, Close DESC"
+	if got := q.String(); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	plain := mustParse(t, "SELECT DISTINCT Date FROM prices")
+	if !plain.Distinct || plain.DistinctOn != nil || plain.String() != "SELECT DISTINCT Date FROM prices" {
+		t.Errorf("unexpected query %s", plain)
+	}
+
+	for _, sql := range []string{
+		"SELECT DISTINCT ON Date, Close FROM prices",
+		"SELECT DISTINCT ON (Date Close FROM prices",
+		"SELECT DISTINCT ON () Date FROM prices",
+	} {
+		if _, err := NewParser(sql).Parse(); err == nil {
+			t.Errorf("expected %q to fail", sql)
+		}
+	}
+}
+
+func TestParseWindowFrames(t *testing.T) {
+	q := mustParse(t, "SELECT AVG(Close) OVER (PARTITION BY Date ORDER BY Volume ROWS BETWEEN 6 PRECEDING AND CURRENT ROW), SUM(Close) OVER (ORDER BY Volume ROWS UNBOUNDED PRECEDING), LAG(Close, 2) OVER (ORDER BY Volume) FROM prices")
+	w, ok := q.Projections[0].(*WindowExpr)
+	if !ok || w.Frame == nil || w.Frame.Start != (FrameBound{Kind: Preceding, Offset: 6}) || w.Frame.End.Kind != CurrentRow {
+		t.Fatalf("unexpected window %#v", q.Projections[0])
+	}
+	want := "SELECT AVG(Close) OVER (PARTITION BY Date ORDER BY Volume ROWS BETWEEN 6 PRECEDING AND CURRENT ROW), " +
+		"SUM(Close) OVER (ORDER BY Volume ROWS BETWEEN UNBOUNDED PRECEDING AND CURRENT ROW), LAG(Close, 2) OVER (ORDER BY Volume) FROM prices"
+	if got := q.String(); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	q = mustParse(t, "SELECT SUM(Close) OVER (ORDER BY Date RANGE BETWEEN INTERVAL '7 days' PRECEDING AND 1.5 FOLLOWING), COUNT(*) OVER (ORDER BY Date RANGE CURRENT ROW) FROM prices")
+	w, ok = q.Projections[0].(*WindowExpr)
+	if !ok || !w.Frame.Range || w.Frame.Start.Value == nil || w.Frame.Start.Value.Kind != LiteralInterval || w.Frame.End.Kind != Following {
+		t.Fatalf("unexpected window %#v", q.Projections[0])
+	}
+	want = "SELECT SUM(Close) OVER (ORDER BY Date RANGE BETWEEN INTERVAL '7 days' PRECEDING AND 1.5 FOLLOWING), " +
+		"COUNT(*) OVER (ORDER BY Date RANGE BETWEEN CURRENT ROW AND CURRENT ROW) FROM prices"
+	if got := q.String(); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	for _, frame := range []string{
+		"RANGE BETWEEN INTERVAL PRECEDING AND CURRENT ROW",
+		"RANGE BETWEEN 1 FOLLOWING AND 1 PRECEDING",
+		"ROWS BETWEEN INTERVAL '1 day' PRECEDING AND CURRENT ROW",
+		"ROWS BETWEEN 1.5 PRECEDING AND CURRENT ROW",
+		"ROWS BETWEEN 1 FOLLOWING AND CURRENT ROW",
+		"ROWS BETWEEN UNBOUNDED FOLLOWING AND UNBOUNDED FOLLOWING",
+		"ROWS BETWEEN CURRENT ROW AND UNBOUNDED PRECEDING",
+		"ROWS BETWEEN -1 PRECEDING AND CURRENT ROW",
+		"ROWS 2",
+		"ROWS BETWEEN CURRENT AND 1 FOLLOWING",
+	} {
+		sql := "SELECT SUM(Close) OVER (ORDER BY Volume " + frame + ") FROM prices"
+		if _, err := NewParser(sql).Parse(); err == nil {
+			t.Errorf("expected %q to fail", sql)
+		}
+	}
+}
+
+func TestParsePivot(t *testing.T) {
+	q := mustParse(t, "SELECT * FROM prices PIVOT (SUM(Volume) AS total, COUNT(*) FOR Date IN ('2020-12-01' AS first, '2020-12-02')) AS p JOIN (SELECT * FROM prices) UNPIVOT (val FOR metric IN (Close, Volume)) u ON p.Close = u.Close")
+	if q.Pivot == nil || q.Pivot.Unpivot || len(q.Pivot.Aggregates) != 2 || q.Pivot.For != "Date" || len(q.Pivot.In) != 2 || q.TableAlias != "p" {
+		t.Fatalf("unexpected pivot %#v", q.Pivot)
+	}
+	if j := q.Joins[0]; j.Pivot == nil || !j.Pivot.Unpivot || j.Pivot.Value != "val" || j.Pivot.For != "metric" || len(j.Pivot.Columns) != 2 || j.Subquery == nil {
+		t.Fatalf("unexpected unpivot %#v", j.Pivot)
+	}
+	want := "SELECT * FROM prices PIVOT (SUM(Volume) AS total, COUNT(*) FOR Date IN ('2020-12-01' AS first, '2020-12-02')) p " +
+		"INNER JOIN (SELECT * FROM prices) UNPIVOT (val FOR metric IN (Close, Volume)) u ON (p.Close = u.Close)"
+	if got := q.String(); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	for _, from := range []string{
+		"prices PIVOT SUM(Volume) FOR Date IN ('x')",
+		"prices PIVOT (SUM(Volume) Date IN ('x'))",
+		"prices PIVOT (SUM(Volume) FOR Date ('x'))",
+		"prices PIVOT (SUM(Volume) FOR Date IN 'x')",
+		"prices UNPIVOT (val FOR metric IN ('Close'))",
+		"prices UNPIVOT (SUM(val) FOR metric IN (Close))",
+	} {
+		sql := "SELECT * FROM " + from
+		if _, err := NewParser(sql).Parse(); err == nil {
+			t.Errorf("expected %q to fail", sql)
+		}
+	}
+}
+
+func TestParseUnnest(t *testing.T) {
+	q := mustParse(t, "SELECT * FROM UNNEST(a, b) WITH ORDINALITY AS u(x, y, n) LEFT JOIN UNNEST(u.x) v ON v > 1 CROSS JOIN unnest")
+	if q.Unnest == nil || len(q.Unnest.Args) != 2 || !q.Unnest.Ordinality || q.TableAlias != "u" || len(q.Columns) != 3 {
+		t.Fatalf("unexpected FROM %#v", q.Unnest)
+	}
+	if j := q.Joins[0]; j.Unnest == nil || j.Unnest.Ordinality || j.TableAlias != "v" || j.Type != "LEFT" {
+		t.Fatalf("unexpected join %#v", j)
+	}
+	if j := q.Joins[1]; j.Unnest != nil || j.TableName != "unnest" {
+		t.Fatalf("expected a table called unnest, got %#v", j)
+	}
+	want := "SELECT * FROM UNNEST(a, b) WITH ORDINALITY u(x, y, n) LEFT JOIN UNNEST(u.x) v ON (v > 1) CROSS JOIN unnest"
+	if got := q.String(); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	for _, sql := range []string{
+		"SELECT * FROM UNNEST(a",
+		"SELECT * FROM UNNEST(a) WITH",
+		"SELECT * FROM UNNEST(a) PIVOT (SUM(x) FOR y IN (1)) p",
+		"SELECT * FROM t RIGHT JOIN UNNEST(t.a) u ON TRUE",
+	} {
+		if _, err := NewParser(sql).Parse(); err == nil {
+			t.Errorf("expected %q to fail", sql)
+		}
+	}
+	merge := "MERGE INTO t USING UNNEST(a) u ON t.x = u WHEN MATCHED THEN DELETE"
+	if _, err := NewParser(merge).ParseScript(); err == nil || !strings.Contains(err.Error(), "UNNEST") {
+		t.Errorf("expected %q to fail for its UNNEST, got %v", merge, err)
+	}
+}
+
+func TestParseFieldAndIndex(t *testing.T) {
+	q := mustParse(t, `SELECT payload.price, t.payload."Qty", tags[i + 1].name, -tags[1]::DOUBLE FROM t`)
+	if ref, ok := q.Projections[0].(*ColumnRef); !ok || ref.Table != "payload" || ref.Name != "price" {
+		t.Fatalf("expected payload.price to be a qualified name, got %#v", q.Projections[0])
+	}
+	field, ok := q.Projections[1].(*FieldExpr)
+	if !ok || field.Field != "Qty" || !field.Quoted {
+		t.Fatalf("expected a field access, got %#v", q.Projections[1])
+	}
+	if ref, ok := field.Expr.(*ColumnRef); !ok || ref.Table != "t" || ref.Name != "payload" {
+		t.Fatalf("expected t.payload, got %#v", field.Expr)
+	}
+	field, ok = q.Projections[2].(*FieldExpr)
+	if !ok {
+		t.Fatalf("expected a field access, got %#v", q.Projections[2])
+	}
+	if index, ok := field.Expr.(*IndexExpr); !ok || FormatExpr(index.Index) != "(i + 1)" {
+		t.Fatalf("expected an index, got %#v", field.Expr)
+	}
+	want := `SELECT payload.price, t.payload."Qty", tags[(i + 1)].name, (- CAST(tags[1] AS DOUBLE)) FROM t`
+	if got := q.String(); got != want {
+		t.Errorf("expected %s, got %s", want, got)
+	}
+
+	data, err := EncodeJSON(Statement(q))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeStatementJSON(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := decoded.(*Query).String(); got != want {
+		t.Errorf("expected %s after a JSON round trip, got %s", want, got)
+	}
+
+	for _, sql := range []string{
+		"SELECT tags[1 FROM t",
+		"SELECT tags[] FROM t",
+		"SELECT payload.price. FROM t",
+		"SELECT payload.* FROM t",
+	} {
+		if _, err := NewParser(sql).Parse(); err == nil {
+			t.Errorf("expected %q to fail", sql)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	key, literals, err := Fingerprint("SELECT Date, Close * 2 FROM prices WHERE Close > 100 AND Date = 'x'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(literals) != 3 || literals[0].Literal != "2" || literals[1].Literal != "100" || literals[2].Literal != "x" {
+		t.Errorf("unexpected literals %v", literals)
+	}
+
+	for _, sql := range []string{
+		"select Date, Close * 7 from prices -- comment\n WHERE Close > 1.5 AND Date = 'it''s'",
+		"SELECT Date,Close*2 FROM prices /* block */ WHERE Close>100 AND Date=''",
+	} {
+		if other, _, err := Fingerprint(sql); err != nil || other != key {
+			t.Errorf("expected %q to share the key, got %q (%v)", sql, other, err)
+		}
+	}
+	for _, sql := range []string{
+		"SELECT date, Close * 2 FROM prices WHERE Close > 100 AND Date = 'x'",
+		"SELECT Date, Close * 2 FROM prices WHERE Close >= 100 AND Date = 'x'",
+		"SELECT Date, Close * 2 FROM prices WHERE Close > 100 AND Date = x",
+		`SELECT "Date", Close * 2 FROM prices WHERE Close > 100 AND Date = 'x'`,
+	} {
+		if other, _, _ := Fingerprint(sql); other == key {
+			t.Errorf("expected %q to have another key", sql)
+		}
+	}
+
+	if _, _, err := Fingerprint("SELECT 'unterminated"); err == nil {
+		t.Errorf("expected an unterminated string to fail")
+	}
+}
+
+func TestParseParameters(t *testing.T) {
+	q := mustParse(t, "SELECT Close FROM prices WHERE Close > ? AND Date IN (?, ?)")
+	if got := q.String(); got != "SELECT Close FROM prices WHERE ((Close > $1) AND (Date IN ($2, $3)))" {
+		t.Errorf("unexpected query %s", got)
+	}
+	q = mustParse(t, "SELECT $2 * Close FROM prices WHERE Close > $1 OR Volume > $12")
+	if got := q.String(); got != "SELECT ($2 * Close) FROM prices WHERE ((Close > $1) OR (Volume > $12))" {
+		t.Errorf("unexpected query %s", got)
+	}
+
+	for _, sql := range []string{
+		"SELECT Close FROM prices WHERE Close > ? AND Volume > $1",
+		"SELECT Close FROM prices WHERE Close > $1 AND Volume > ?",
+		"SELECT Close FROM prices WHERE Close > $0",
+		"SELECT Close FROM prices WHERE Close > $",
+	} {
+		if _, err := NewParser(sql).Parse(); err == nil {
+			t.Errorf("expected %q to fail", sql)
+		}
+	}
+
+	// Each statement of a script numbers its ? parameters from 1
+	stmts, err := NewParser("SELECT ? FROM prices; SELECT ? FROM prices").ParseScript()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := stmts[1].String(); got != "SELECT $1 FROM prices" {
+		t.Errorf("unexpected second statement %s", got)
+	}
+}
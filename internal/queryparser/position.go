@@ -0,0 +1,115 @@
+package queryparser
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Pos is a position in the query text. Offset counts characters from the
+// start of the input; Line and Column start at 1. The zero Pos is unknown.
+type Pos struct {
+	Offset int
+	Line   int
+	Column int
+}
+
+func (p Pos) IsValid() bool {
+	return p.Line > 0
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("line %d, column %d", p.Line, p.Column)
+}
+
+// SyntaxError is a lexing or parsing failure at a position in the query
+type SyntaxError struct {
+	Pos Pos
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	if !e.Pos.IsValid() {
+		return "syntax error: " + e.Msg
+	}
+	return fmt.Sprintf("syntax error: %s (%s)", e.Msg, e.Pos)
+}
+
+func (e *SyntaxError) Position() Pos {
+	return e.Pos
+}
+
+// PosError is an error found after parsing, such as an unknown column, that
+// points at the part of the query it is about
+type PosError struct {
+	Pos Pos
+	Msg string
+}
+
+func (e *PosError) Error() string {
+	return e.Msg
+}
+
+func (e *PosError) Position() Pos {
+	return e.Pos
+}
+
+// ErrorAt returns an error at pos with a formatted message. With an unknown
+// pos it is an ordinary error.
+func ErrorAt(pos Pos, format string, args ...interface{}) error {
+	if !pos.IsValid() {
+		return fmt.Errorf(format, args...)
+	}
+	return &PosError{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// FormatError renders err for display. When err carries a position in query
+// the offending line is printed below it with a caret under the position:
+//
+//	syntax error: unexpected token: FORM (line 1, column 14)
+//	SELECT Close FORM prices
+//	             ^
+func FormatError(query string, err error) string {
+	var located interface{ Position() Pos }
+	if !errors.As(err, &located) || !located.Position().IsValid() {
+		return err.Error()
+	}
+	pos := located.Position()
+
+	lines := strings.Split(query, "\n")
+	if pos.Line > len(lines) {
+		return err.Error()
+	}
+	line := []rune(strings.TrimRight(lines[pos.Line-1], "\r"))
+
+	// Keep tabs in the padding so the caret lines up however they render
+	col := pos.Column - 1
+	if col > len(line) {
+		col = len(line)
+	}
+	pad := make([]rune, col)
+	for i := range pad {
+		pad[i] = ' '
+		if line[i] == '\t' {
+			pad[i] = '\t'
+		}
+	}
+	return fmt.Sprintf("%s\n%s\n%s^", err.Error(), string(line), string(pad))
+}
+
+// position converts a character offset in the lexer's input to a Pos
+func (l *Lexer) position(offset int) Pos {
+	line := sort.Search(len(l.lineStarts), func(i int) bool { return l.lineStarts[i] > offset })
+	return Pos{Offset: offset, Line: line, Column: offset - l.lineStarts[line-1] + 1}
+}
+
+// failAt reports a lexing error at the character offset
+func (l *Lexer) failAt(offset int, msg string) {
+	panic(&SyntaxError{Pos: l.position(offset), Msg: msg})
+}
+
+// fail reports a parsing error at the current token
+func (p *Parser) fail(msg string) {
+	panic(&SyntaxError{Pos: p.curr.Pos, Msg: msg})
+}
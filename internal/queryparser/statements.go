@@ -0,0 +1,673 @@
+package queryparser
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// InsertStmt is INSERT INTO table [(column, ...)] VALUES (value, ...), ...
+// [ON CONFLICT (column, ...) DO NOTHING | DO UPDATE SET ...]
+type InsertStmt struct {
+	TableName  string
+	Columns    []string       // target columns, empty for all columns in table order
+	Rows       [][]Expression // one list of values per inserted row
+	OnConflict *OnConflict    // nil for a plain INSERT
+}
+
+// OnConflict is the ON CONFLICT clause of an INSERT: a row whose values in
+// the key columns equal those of a row already in the table is not inserted,
+// and the row in the table is left as it is, or updated by Set. Set reads
+// the row that was not inserted as EXCLUDED.
+type OnConflict struct {
+	Columns []string     // the key columns
+	Set     []Assignment // empty for DO NOTHING
+}
+
+func (s *InsertStmt) String() string {
+	var sb strings.Builder
+	sb.WriteString("INSERT INTO " + s.TableName)
+	if len(s.Columns) > 0 {
+		sb.WriteString(" (" + strings.Join(s.Columns, ", ") + ")")
+	}
+	sb.WriteString(" " + formatValues(s.Rows))
+	if c := s.OnConflict; c != nil {
+		sb.WriteString(" ON CONFLICT (" + strings.Join(c.Columns, ", ") + ")")
+		if len(c.Set) == 0 {
+			sb.WriteString(" DO NOTHING")
+		} else {
+			sb.WriteString(" DO UPDATE SET " + formatAssignments(c.Set))
+		}
+	}
+	return sb.String()
+}
+
+// CreateTableStmt is CREATE TABLE name AS query
+type CreateTableStmt struct {
+	TableName string
+	Query     *Query
+	Temp      bool // CREATE TEMP TABLE: the table lasts as long as the session that creates it
+}
+
+func (s *CreateTableStmt) String() string {
+	if s.Temp {
+		return fmt.Sprintf("CREATE TEMP TABLE %s AS %s", s.TableName, s.Query.String())
+	}
+	return fmt.Sprintf("CREATE TABLE %s AS %s", s.TableName, s.Query.String())
+}
+
+func formatAssignments(set []Assignment) string {
+	sets := make([]string, len(set))
+	for i, a := range set {
+		sets[i] = fmt.Sprintf("%s = %s", a.Column, formatExpr(a.Value))
+	}
+	return strings.Join(sets, ", ")
+}
+
+// CreateViewStmt is CREATE [OR REPLACE] VIEW name AS query
+type CreateViewStmt struct {
+	ViewName  string
+	Query     *Query
+	OrReplace bool // replace an existing view of the same name
+}
+
+func (s *CreateViewStmt) String() string {
+	create := "CREATE"
+	if s.OrReplace {
+		create += " OR REPLACE"
+	}
+	return fmt.Sprintf("%s VIEW %s AS %s", create, s.ViewName, s.Query.String())
+}
+
+// DropViewStmt is DROP VIEW [IF EXISTS] name
+type DropViewStmt struct {
+	ViewName string
+	IfExists bool // succeed without doing anything when the view is missing
+}
+
+func (s *DropViewStmt) String() string {
+	if s.IfExists {
+		return "DROP VIEW IF EXISTS " + s.ViewName
+	}
+	return "DROP VIEW " + s.ViewName
+}
+
+// DropTableStmt is DROP TABLE [IF EXISTS] name
+type DropTableStmt struct {
+	TableName string
+	IfExists  bool // succeed without doing anything when the table is missing
+}
+
+func (s *DropTableStmt) String() string {
+	if s.IfExists {
+		return "DROP TABLE IF EXISTS " + s.TableName
+	}
+	return "DROP TABLE " + s.TableName
+}
+
+// TruncateStmt is TRUNCATE [TABLE] name, deleting every row but keeping the
+// table
+type TruncateStmt struct {
+	TableName string
+}
+
+func (s *TruncateStmt) String() string {
+	return "TRUNCATE TABLE " + s.TableName
+}
+
+// DeleteStmt is DELETE FROM table [WHERE condition]
+type DeleteStmt struct {
+	TableName string
+	Where     Expression // rows to delete, nil deletes every row
+}
+
+func (s *DeleteStmt) String() string {
+	if s.Where == nil {
+		return "DELETE FROM " + s.TableName
+	}
+	return fmt.Sprintf("DELETE FROM %s WHERE %s", s.TableName, formatExpr(s.Where))
+}
+
+// UpdateStmt is UPDATE table SET column = value, ... [WHERE condition]
+type UpdateStmt struct {
+	TableName string
+	Set       []Assignment
+	Where     Expression // rows to update, nil updates every row
+}
+
+// Assignment is a single column = value in an UPDATE's SET clause
+type Assignment struct {
+	Column string
+	Value  Expression
+}
+
+func (s *UpdateStmt) String() string {
+	out := fmt.Sprintf("UPDATE %s SET %s", s.TableName, formatAssignments(s.Set))
+	if s.Where != nil {
+		out += " WHERE " + formatExpr(s.Where)
+	}
+	return out
+}
+
+// MergeStmt is MERGE INTO target [alias] USING source [alias] ON condition
+// followed by WHEN [NOT] MATCHED clauses
+type MergeStmt struct {
+	TableName   string
+	TableAlias  string
+	SourceName  string
+	SourceAlias string
+	SourceCols  []string // column aliases given after SourceAlias
+	Source      *Query   // derived table, set instead of SourceName
+	On          Expression
+	Clauses     []MergeClause // tried in order, the first that applies to a row wins
+}
+
+// MergeClause is WHEN MATCHED [AND condition] THEN UPDATE SET ... | DELETE or
+// WHEN NOT MATCHED [AND condition] THEN INSERT [(column, ...)] VALUES (...)
+type MergeClause struct {
+	Matched bool
+	Cond    Expression   // extra condition, can be nil
+	Action  string       // "UPDATE", "DELETE" or "INSERT"
+	Set     []Assignment // UPDATE assignments
+	Columns []string     // INSERT target columns, empty for all columns in table order
+	Values  []Expression // INSERT values
+}
+
+func (s *MergeStmt) String() string {
+	var sb strings.Builder
+	sb.WriteString("MERGE INTO " + formatTableRef(tableRef{name: s.TableName, alias: s.TableAlias}))
+	sb.WriteString(" USING " + formatTableRef(tableRef{name: s.SourceName, alias: s.SourceAlias, columns: s.SourceCols, subquery: s.Source}))
+	sb.WriteString(" ON " + formatExpr(s.On))
+	for _, c := range s.Clauses {
+		sb.WriteString(" WHEN ")
+		if !c.Matched {
+			sb.WriteString("NOT ")
+		}
+		sb.WriteString("MATCHED")
+		if c.Cond != nil {
+			sb.WriteString(" AND " + formatExpr(c.Cond))
+		}
+		sb.WriteString(" THEN " + c.Action)
+		switch c.Action {
+		case "UPDATE":
+			sb.WriteString(" SET " + formatAssignments(c.Set))
+		case "INSERT":
+			if len(c.Columns) > 0 {
+				sb.WriteString(" (" + strings.Join(c.Columns, ", ") + ")")
+			}
+			sb.WriteString(" " + formatValues([][]Expression{c.Values}))
+		}
+	}
+	return sb.String()
+}
+
+// CopyStmt is COPY table TO 'path', COPY (query) TO 'path' or
+// COPY table FROM 'path', each with optional (option value, ...)
+type CopyStmt struct {
+	TableName string
+	Query     *Query // set for COPY (query) TO, instead of TableName
+	From      bool   // load from Path rather than export to it
+	Path      string
+	Options   map[string]string // option names upper-cased, e.g. FORMAT -> PARQUET
+}
+
+func (s *CopyStmt) String() string {
+	source := s.TableName
+	if s.Query != nil {
+		source = "(" + s.Query.String() + ")"
+	}
+	dir := "TO"
+	if s.From {
+		dir = "FROM"
+	}
+	out := fmt.Sprintf("COPY %s %s '%s'", source, dir, strings.ReplaceAll(s.Path, "'", "''"))
+	if len(s.Options) > 0 {
+		names := make([]string, 0, len(s.Options))
+		for name := range s.Options {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		opts := make([]string, len(names))
+		for i, name := range names {
+			opts[i] = name + " " + s.Options[name]
+		}
+		out += " (" + strings.Join(opts, ", ") + ")"
+	}
+	return out
+}
+
+// ShowTablesStmt is SHOW TABLES
+type ShowTablesStmt struct{}
+
+func (s *ShowTablesStmt) String() string {
+	return "SHOW TABLES"
+}
+
+// DescribeStmt is DESCRIBE table
+type DescribeStmt struct {
+	TableName string
+}
+
+func (s *DescribeStmt) String() string {
+	return "DESCRIBE " + s.TableName
+}
+
+// SummarizeStmt is SUMMARIZE table, profiling each of its columns
+type SummarizeStmt struct {
+	TableName string
+}
+
+func (s *SummarizeStmt) String() string {
+	return "SUMMARIZE " + s.TableName
+}
+
+// SetStmt is SET option = value, changing a session option
+type SetStmt struct {
+	Name  string // option name, lower-cased
+	Value string
+}
+
+func (s *SetStmt) String() string {
+	return fmt.Sprintf("SET %s = '%s'", s.Name, strings.ReplaceAll(s.Value, "'", "''"))
+}
+
+// parseInsert parses INSERT INTO table [(column, ...)] VALUES (value, ...), ...
+func (p *Parser) parseInsert() *InsertStmt {
+	p.eat(TOKEN_INSERT)
+	if p.curr.Type != TOKEN_INTO {
+		p.fail("expected INTO after INSERT, got: " + p.curr.Literal)
+	}
+	p.eat(TOKEN_INTO)
+
+	stmt := &InsertStmt{TableName: p.parseName("table name")}
+	if p.curr.Type == TOKEN_LPAREN {
+		stmt.Columns = p.parseNameList("column name")
+	}
+
+	if p.curr.Type != TOKEN_VALUES {
+		p.fail("expected VALUES, got: " + p.curr.Literal)
+	}
+	stmt.Rows = p.parseValues().Values
+	if p.curr.Type == TOKEN_ON {
+		stmt.OnConflict = p.parseOnConflict()
+	}
+	return stmt
+}
+
+// parseOnConflict parses ON CONFLICT (column, ...) followed by DO NOTHING or
+// DO UPDATE SET column = value, ...
+func (p *Parser) parseOnConflict() *OnConflict {
+	p.eat(TOKEN_ON)
+	if !p.isWord("CONFLICT") {
+		p.fail("expected CONFLICT after ON, got: " + p.curr.Literal)
+	}
+	p.eat(TOKEN_IDENTIFIER)
+	if p.curr.Type != TOKEN_LPAREN {
+		p.fail("expected key columns after ON CONFLICT, got: " + p.curr.Literal)
+	}
+	c := &OnConflict{Columns: p.parseNameList("column name")}
+	if !p.isWord("DO") {
+		p.fail("expected DO in ON CONFLICT, got: " + p.curr.Literal)
+	}
+	p.eat(TOKEN_IDENTIFIER)
+
+	switch {
+	case p.isWord("NOTHING"):
+		p.eat(TOKEN_IDENTIFIER)
+	case p.curr.Type == TOKEN_UPDATE:
+		p.eat(TOKEN_UPDATE)
+		if p.curr.Type != TOKEN_SET {
+			p.fail("expected SET after UPDATE, got: " + p.curr.Literal)
+		}
+		c.Set = p.parseAssignments()
+	default:
+		p.fail("expected NOTHING or UPDATE after DO, got: " + p.curr.Literal)
+	}
+	return c
+}
+
+// parseNameList parses a parenthesized, comma separated list of names
+func (p *Parser) parseNameList(what string) []string {
+	p.eat(TOKEN_LPAREN)
+	names := []string{p.parseName(what)}
+	for p.curr.Type == TOKEN_COMMA {
+		p.eat(TOKEN_COMMA)
+		names = append(names, p.parseName(what))
+	}
+	p.eat(TOKEN_RPAREN)
+	return names
+}
+
+// parseName parses a table or column name
+func (p *Parser) parseName(what string) string {
+	if p.curr.Type != TOKEN_IDENTIFIER {
+		p.fail("expected " + what + ", got: " + p.curr.Literal)
+	}
+	name := p.curr.Literal
+	p.eat(TOKEN_IDENTIFIER)
+	return name
+}
+
+// parseCreate parses CREATE TABLE name AS query and
+// CREATE [OR REPLACE] VIEW name AS query
+func (p *Parser) parseCreate() Statement {
+	p.eat(TOKEN_CREATE)
+	orReplace := false
+	if p.curr.Type == TOKEN_OR {
+		p.eat(TOKEN_OR)
+		if !p.isWord("REPLACE") {
+			p.fail("expected REPLACE after CREATE OR, got: " + p.curr.Literal)
+		}
+		p.eat(TOKEN_IDENTIFIER)
+		orReplace = true
+	}
+
+	temp := false
+	if (p.isWord("TEMP") || p.isWord("TEMPORARY")) && !orReplace {
+		p.eat(TOKEN_IDENTIFIER)
+		if p.curr.Type != TOKEN_TABLE {
+			p.fail("expected TABLE after CREATE TEMP, got: " + p.curr.Literal)
+		}
+		temp = true
+	}
+
+	switch {
+	case p.curr.Type == TOKEN_TABLE && !orReplace:
+		p.eat(TOKEN_TABLE)
+		stmt := &CreateTableStmt{TableName: p.parseName("table name"), Temp: temp}
+		stmt.Query = p.parseAsQuery("table name")
+		return stmt
+	case p.isWord("VIEW"):
+		p.eat(TOKEN_IDENTIFIER)
+		stmt := &CreateViewStmt{ViewName: p.parseName("view name"), OrReplace: orReplace}
+		stmt.Query = p.parseAsQuery("view name")
+		return stmt
+	case orReplace:
+		p.fail("expected VIEW after CREATE OR REPLACE, got: " + p.curr.Literal)
+	default:
+		p.fail("expected TABLE or VIEW after CREATE, got: " + p.curr.Literal)
+	}
+	return nil
+}
+
+// parseAsQuery parses the AS query that ends a CREATE statement
+func (p *Parser) parseAsQuery(after string) *Query {
+	if p.curr.Type != TOKEN_AS {
+		p.fail("expected AS after " + after + ", got: " + p.curr.Literal)
+	}
+	p.eat(TOKEN_AS)
+	if p.curr.Type != TOKEN_SELECT && p.curr.Type != TOKEN_WITH {
+		p.fail("expected SELECT after AS, got: " + p.curr.Literal)
+	}
+	return p.parseSelect()
+}
+
+// parseDrop parses DROP TABLE [IF EXISTS] name and DROP VIEW [IF EXISTS] name
+func (p *Parser) parseDrop() Statement {
+	p.eat(TOKEN_DROP)
+	table := p.curr.Type == TOKEN_TABLE
+	if !table && !p.isWord("VIEW") {
+		p.fail("expected TABLE or VIEW after DROP, got: " + p.curr.Literal)
+	}
+	p.eat(p.curr.Type)
+
+	ifExists := false
+	if p.isWord("IF") {
+		p.eat(TOKEN_IDENTIFIER)
+		if p.curr.Type != TOKEN_EXISTS {
+			p.fail("expected EXISTS after IF, got: " + p.curr.Literal)
+		}
+		p.eat(TOKEN_EXISTS)
+		ifExists = true
+	}
+	if table {
+		return &DropTableStmt{TableName: p.parseName("table name"), IfExists: ifExists}
+	}
+	return &DropViewStmt{ViewName: p.parseName("view name"), IfExists: ifExists}
+}
+
+// parseDelete parses DELETE FROM table [WHERE condition]
+func (p *Parser) parseDelete() *DeleteStmt {
+	p.eat(TOKEN_DELETE)
+	if p.curr.Type != TOKEN_FROM {
+		p.fail("expected FROM after DELETE, got: " + p.curr.Literal)
+	}
+	p.eat(TOKEN_FROM)
+
+	stmt := &DeleteStmt{TableName: p.parseName("table name")}
+	if p.curr.Type == TOKEN_WHERE {
+		p.eat(TOKEN_WHERE)
+		stmt.Where = p.parseExpression(precLowest)
+	}
+	return stmt
+}
+
+// parseUpdate parses UPDATE table SET column = value, ... [WHERE condition]
+func (p *Parser) parseUpdate() *UpdateStmt {
+	p.eat(TOKEN_UPDATE)
+	stmt := &UpdateStmt{TableName: p.parseName("table name")}
+	if p.curr.Type != TOKEN_SET {
+		p.fail("expected SET after table name, got: " + p.curr.Literal)
+	}
+	stmt.Set = p.parseAssignments()
+
+	if p.curr.Type == TOKEN_WHERE {
+		p.eat(TOKEN_WHERE)
+		stmt.Where = p.parseExpression(precLowest)
+	}
+	return stmt
+}
+
+// parseAssignments parses SET column = value, ...
+func (p *Parser) parseAssignments() []Assignment {
+	p.eat(TOKEN_SET)
+	var set []Assignment
+	for {
+		column := p.parseName("column name")
+		if p.curr.Type != TOKEN_OPERATOR || p.curr.Literal != "=" {
+			p.fail("expected '=' after column name in SET, got: " + p.curr.Literal)
+		}
+		p.eat(TOKEN_OPERATOR)
+		set = append(set, Assignment{Column: column, Value: p.parseExpression(precLowest)})
+
+		if p.curr.Type != TOKEN_COMMA {
+			return set
+		}
+		p.eat(TOKEN_COMMA)
+	}
+}
+
+// parseMerge parses MERGE INTO target [[AS] alias] USING source [[AS] alias]
+// ON condition followed by one or more WHEN [NOT] MATCHED clauses
+func (p *Parser) parseMerge() *MergeStmt {
+	p.eat(TOKEN_MERGE)
+	if p.curr.Type != TOKEN_INTO {
+		p.fail("expected INTO after MERGE, got: " + p.curr.Literal)
+	}
+	p.eat(TOKEN_INTO)
+
+	stmt := &MergeStmt{TableName: p.parseName("table name")}
+	if p.curr.Type == TOKEN_AS {
+		p.eat(TOKEN_AS)
+		stmt.TableAlias = p.parseName("alias")
+	} else if p.curr.Type == TOKEN_IDENTIFIER && !p.isWord("USING") {
+		stmt.TableAlias = p.parseName("alias")
+	}
+
+	if !p.isWord("USING") {
+		p.fail("expected USING in MERGE, got: " + p.curr.Literal)
+	}
+	p.eat(TOKEN_IDENTIFIER)
+	source := p.parseTableRef()
+	if source.pivot != nil {
+		p.fail("PIVOT is not supported in a MERGE source")
+	}
+	if source.unnest != nil {
+		p.fail("UNNEST is not supported in a MERGE source")
+	}
+	stmt.SourceName, stmt.SourceAlias, stmt.SourceCols, stmt.Source = source.name, source.alias, source.columns, source.subquery
+
+	if p.curr.Type != TOKEN_ON {
+		p.fail("expected ON after MERGE source, got: " + p.curr.Literal)
+	}
+	p.eat(TOKEN_ON)
+	stmt.On = p.parseExpression(precLowest)
+
+	for p.isWord("WHEN") {
+		stmt.Clauses = append(stmt.Clauses, p.parseMergeClause())
+	}
+	if len(stmt.Clauses) == 0 {
+		p.fail("expected WHEN after MERGE condition, got: " + p.curr.Literal)
+	}
+	return stmt
+}
+
+func (p *Parser) parseMergeClause() MergeClause {
+	p.eat(TOKEN_IDENTIFIER)
+	var c MergeClause
+	if p.curr.Type == TOKEN_NOT {
+		p.eat(TOKEN_NOT)
+	} else {
+		c.Matched = true
+	}
+	if !p.isWord("MATCHED") {
+		p.fail("expected MATCHED after WHEN, got: " + p.curr.Literal)
+	}
+	p.eat(TOKEN_IDENTIFIER)
+	if p.curr.Type == TOKEN_AND {
+		p.eat(TOKEN_AND)
+		c.Cond = p.parseExpression(precLowest)
+	}
+	if !p.isWord("THEN") {
+		p.fail("expected THEN in WHEN clause, got: " + p.curr.Literal)
+	}
+	p.eat(TOKEN_IDENTIFIER)
+
+	switch {
+	case c.Matched && p.curr.Type == TOKEN_UPDATE:
+		p.eat(TOKEN_UPDATE)
+		c.Action = "UPDATE"
+		if p.curr.Type != TOKEN_SET {
+			p.fail("expected SET after UPDATE, got: " + p.curr.Literal)
+		}
+		c.Set = p.parseAssignments()
+	case c.Matched && p.curr.Type == TOKEN_DELETE:
+		p.eat(TOKEN_DELETE)
+		c.Action = "DELETE"
+	case !c.Matched && p.curr.Type == TOKEN_INSERT:
+		p.eat(TOKEN_INSERT)
+		c.Action = "INSERT"
+		if p.curr.Type == TOKEN_LPAREN {
+			c.Columns = p.parseNameList("column name")
+		}
+		if p.curr.Type != TOKEN_VALUES {
+			p.fail("expected VALUES, got: " + p.curr.Literal)
+		}
+		values := p.parseValues().Values
+		if len(values) != 1 {
+			p.fail("MERGE INSERT takes a single row of values")
+		}
+		c.Values = values[0]
+	case c.Matched:
+		p.fail("expected UPDATE or DELETE after WHEN MATCHED THEN, got: " + p.curr.Literal)
+	default:
+		p.fail("expected INSERT after WHEN NOT MATCHED THEN, got: " + p.curr.Literal)
+	}
+	return c
+}
+
+// parseCopy parses COPY table|(query) TO|FROM 'path' [[WITH] (option value, ...)]
+func (p *Parser) parseCopy() *CopyStmt {
+	p.eat(TOKEN_COPY)
+
+	stmt := &CopyStmt{}
+	if p.curr.Type == TOKEN_LPAREN {
+		stmt.Query = p.parseSubquery()
+	} else {
+		stmt.TableName = p.parseName("table name")
+	}
+
+	switch p.curr.Type {
+	case TOKEN_TO:
+		p.eat(TOKEN_TO)
+	case TOKEN_FROM:
+		if stmt.Query != nil {
+			p.fail("COPY FROM needs a table, not a query")
+		}
+		p.eat(TOKEN_FROM)
+		stmt.From = true
+	default:
+		p.fail("expected TO or FROM in COPY, got: " + p.curr.Literal)
+	}
+
+	if p.curr.Type != TOKEN_STRING {
+		p.fail("expected file path string in COPY, got: " + p.curr.Literal)
+	}
+	stmt.Path = p.curr.Literal
+	p.eat(TOKEN_STRING)
+
+	if p.curr.Type == TOKEN_WITH {
+		p.eat(TOKEN_WITH)
+	}
+	if p.curr.Type == TOKEN_LPAREN {
+		p.eat(TOKEN_LPAREN)
+		stmt.Options = map[string]string{}
+		for {
+			name := strings.ToUpper(p.parseName("option name"))
+			switch p.curr.Type {
+			case TOKEN_IDENTIFIER, TOKEN_STRING, TOKEN_LITERAL, TOKEN_TRUE, TOKEN_FALSE:
+				stmt.Options[name] = p.curr.Literal
+				p.eat(p.curr.Type)
+			default:
+				p.fail("expected value for option " + name + ", got: " + p.curr.Literal)
+			}
+			if p.curr.Type != TOKEN_COMMA {
+				break
+			}
+			p.eat(TOKEN_COMMA)
+		}
+		p.eat(TOKEN_RPAREN)
+	}
+	return stmt
+}
+
+// parseSet parses SET option = value or SET option TO value. The value is a
+// word, a string or a number.
+func (p *Parser) parseSet() *SetStmt {
+	p.eat(TOKEN_SET)
+	stmt := &SetStmt{Name: strings.ToLower(p.parseName("option name"))}
+	switch {
+	case p.curr.Type == TOKEN_OPERATOR && p.curr.Literal == "=":
+		p.eat(TOKEN_OPERATOR)
+	case p.curr.Type == TOKEN_TO:
+		p.eat(TOKEN_TO)
+	default:
+		p.fail("expected '=' or TO after option name, got: " + p.curr.Literal)
+	}
+
+	sign := ""
+	if p.curr.Type == TOKEN_MINUS {
+		p.eat(TOKEN_MINUS)
+		sign = "-"
+	}
+	switch {
+	case p.curr.Type == TOKEN_LITERAL:
+	case sign == "" && (p.curr.Type == TOKEN_IDENTIFIER || p.curr.Type == TOKEN_STRING ||
+		p.curr.Type == TOKEN_TRUE || p.curr.Type == TOKEN_FALSE):
+	default:
+		p.fail("expected value for option " + stmt.Name + ", got: " + p.curr.Literal)
+	}
+	stmt.Value = sign + p.curr.Literal
+	p.eat(p.curr.Type)
+	return stmt
+}
+
+// parseShow parses SHOW TABLES
+func (p *Parser) parseShow() *ShowTablesStmt {
+	p.eat(TOKEN_SHOW)
+	if !p.isWord("TABLES") {
+		p.fail("expected TABLES after SHOW, got: " + p.curr.Literal)
+	}
+	p.eat(TOKEN_IDENTIFIER)
+	return &ShowTablesStmt{}
+}
@@ -0,0 +1,323 @@
+package queryparser
+
+// Children returns the direct sub-expressions of expr in source order. It does
+// not descend into subqueries; use WalkQuery to visit those too.
+func Children(expr Expression) []Expression {
+	switch e := expr.(type) {
+	case *BinaryExpr:
+		return []Expression{e.Left, e.Right}
+	case *UnaryExpr:
+		return []Expression{e.Expr}
+	case *IsNullExpr:
+		return []Expression{e.Expr}
+	case *CastExpr:
+		return []Expression{e.Expr}
+	case *FieldExpr:
+		return []Expression{e.Expr}
+	case *IndexExpr:
+		return []Expression{e.Expr, e.Index}
+	case *FuncCall:
+		return e.Args
+	case *AliasExpr:
+		return []Expression{e.Expr}
+	case *InExpr:
+		return append([]Expression{e.Expr}, e.Values...)
+	case *BetweenExpr:
+		return []Expression{e.Expr, e.Low, e.High}
+	case *LikeExpr:
+		return []Expression{e.Expr, e.Pattern}
+	case *WindowExpr:
+		children := append([]Expression{e.Func}, e.PartitionBy...)
+		for _, item := range e.OrderBy {
+			children = append(children, item.Expr)
+		}
+		return children
+	default:
+		return nil
+	}
+}
+
+// A Visitor's Visit method is called for each expression Walk reaches. If it
+// returns a non-nil Visitor w, Walk visits each child of expr with w and then
+// calls w.Visit(nil).
+type Visitor interface {
+	Visit(expr Expression) (w Visitor)
+}
+
+// Walk traverses expr depth-first, in the manner of go/ast.Walk.
+func Walk(v Visitor, expr Expression) {
+	if v = v.Visit(expr); v == nil {
+		return
+	}
+	for _, child := range Children(expr) {
+		Walk(v, child)
+	}
+	v.Visit(nil)
+}
+
+type inspector func(Expression) bool
+
+func (f inspector) Visit(expr Expression) Visitor {
+	if f(expr) {
+		return f
+	}
+	return nil
+}
+
+// Inspect traverses expr depth-first, calling f for each expression and then
+// f(nil) after its children. The children are skipped when f returns false.
+func Inspect(expr Expression, f func(Expression) bool) {
+	Walk(inspector(f), expr)
+}
+
+// WalkQuery calls f for every top-level expression of q and of the queries
+// nested in it: CTEs, derived tables, set operations and the subqueries inside
+// expressions. Use Inspect or Walk from f to reach sub-expressions.
+func WalkQuery(q *Query, f func(Expression)) {
+	for _, cte := range q.With {
+		WalkQuery(cte.Query, f)
+	}
+	visit := func(expr Expression) {
+		if expr == nil {
+			return
+		}
+		f(expr)
+		Inspect(expr, func(e Expression) bool {
+			switch e := e.(type) {
+			case *SubqueryExpr:
+				WalkQuery(e.Subquery, f)
+			case *ExistsExpr:
+				WalkQuery(e.Subquery, f)
+			case *InExpr:
+				if e.Subquery != nil {
+					WalkQuery(e.Subquery, f)
+				}
+			}
+			return true
+		})
+	}
+
+	for _, e := range q.DistinctOn {
+		visit(e)
+	}
+	for _, e := range q.Projections {
+		visit(e)
+	}
+	if q.Subquery != nil {
+		WalkQuery(q.Subquery, f)
+	}
+	visitPivot := func(c *PivotClause) {
+		if c == nil {
+			return
+		}
+		for _, e := range c.Aggregates {
+			visit(e)
+		}
+		for _, e := range c.In {
+			visit(e)
+		}
+	}
+	visitUnnest := func(u *UnnestClause) {
+		if u == nil {
+			return
+		}
+		for _, e := range u.Args {
+			visit(e)
+		}
+	}
+	visitPivot(q.Pivot)
+	visitUnnest(q.Unnest)
+	for _, j := range q.Joins {
+		if j.Subquery != nil {
+			WalkQuery(j.Subquery, f)
+		}
+		visitPivot(j.Pivot)
+		visitUnnest(j.Unnest)
+		visit(j.On)
+	}
+	visit(q.Where)
+	for _, e := range q.GroupBy {
+		visit(e)
+	}
+	visit(q.Having)
+	visit(q.Qualify)
+	for _, op := range q.SetOps {
+		WalkQuery(op.Query, f)
+	}
+	for _, item := range q.OrderBy {
+		visit(item.Expr)
+	}
+	for _, row := range q.Values {
+		for _, e := range row {
+			visit(e)
+		}
+	}
+}
+
+// TransformQuery returns a copy of q in which every expression WalkQuery would
+// reach, including those of the nested queries, is rebuilt by Transform with
+// fn. q is not modified.
+func TransformQuery(q *Query, fn func(Expression) Expression) *Query {
+	if q == nil {
+		return nil
+	}
+	nested := func(expr Expression) Expression {
+		switch e := expr.(type) {
+		case *SubqueryExpr:
+			expr = &SubqueryExpr{Subquery: TransformQuery(e.Subquery, fn)}
+		case *ExistsExpr:
+			expr = &ExistsExpr{Subquery: TransformQuery(e.Subquery, fn), Not: e.Not}
+		case *InExpr:
+			if e.Subquery != nil {
+				expr = &InExpr{Expr: e.Expr, Subquery: TransformQuery(e.Subquery, fn), Not: e.Not}
+			}
+		}
+		return fn(expr)
+	}
+	one := func(expr Expression) Expression {
+		if expr == nil {
+			return nil
+		}
+		return Transform(expr, nested)
+	}
+	list := func(exprs []Expression) []Expression {
+		if exprs == nil {
+			return nil
+		}
+		out := make([]Expression, len(exprs))
+		for i, e := range exprs {
+			out[i] = one(e)
+		}
+		return out
+	}
+
+	out := *q
+	if q.With != nil {
+		out.With = make([]CommonTableExpr, len(q.With))
+		for i, cte := range q.With {
+			out.With[i] = CommonTableExpr{Name: cte.Name, Query: TransformQuery(cte.Query, fn)}
+		}
+	}
+	out.DistinctOn = list(q.DistinctOn)
+	out.Projections = list(q.Projections)
+	pivot := func(c *PivotClause) *PivotClause {
+		if c == nil {
+			return nil
+		}
+		out := *c
+		out.Aggregates = list(c.Aggregates)
+		out.In = list(c.In)
+		return &out
+	}
+	unnest := func(u *UnnestClause) *UnnestClause {
+		if u == nil {
+			return nil
+		}
+		out := *u
+		out.Args = list(u.Args)
+		return &out
+	}
+	out.Subquery = TransformQuery(q.Subquery, fn)
+	out.Pivot = pivot(q.Pivot)
+	out.Unnest = unnest(q.Unnest)
+	if q.Joins != nil {
+		out.Joins = make([]JoinClause, len(q.Joins))
+		for i, j := range q.Joins {
+			j.Subquery = TransformQuery(j.Subquery, fn)
+			j.Pivot = pivot(j.Pivot)
+			j.Unnest = unnest(j.Unnest)
+			j.On = one(j.On)
+			out.Joins[i] = j
+		}
+	}
+	out.Where = one(q.Where)
+	out.GroupBy = list(q.GroupBy)
+	out.Having = one(q.Having)
+	out.Qualify = one(q.Qualify)
+	if q.SetOps != nil {
+		out.SetOps = make([]SetOperation, len(q.SetOps))
+		for i, op := range q.SetOps {
+			op.Query = TransformQuery(op.Query, fn)
+			out.SetOps[i] = op
+		}
+	}
+	if q.OrderBy != nil {
+		out.OrderBy = make([]OrderByItem, len(q.OrderBy))
+		for i, item := range q.OrderBy {
+			item.Expr = one(item.Expr)
+			out.OrderBy[i] = item
+		}
+	}
+	if q.Values != nil {
+		out.Values = make([][]Expression, len(q.Values))
+		for i, row := range q.Values {
+			out.Values[i] = list(row)
+		}
+	}
+	return &out
+}
+
+// Transform rebuilds expr bottom-up, replacing each node with fn's result. The
+// input is not modified. Subqueries are left alone.
+func Transform(expr Expression, fn func(Expression) Expression) Expression {
+	switch e := expr.(type) {
+	case *BinaryExpr:
+		expr = &BinaryExpr{
+			Left:  Transform(e.Left, fn),
+			Op:    e.Op,
+			Right: Transform(e.Right, fn),
+		}
+	case *FuncCall:
+		args := make([]Expression, len(e.Args))
+		for i, arg := range e.Args {
+			args[i] = Transform(arg, fn)
+		}
+		expr = &FuncCall{Name: e.Name, Args: args, Distinct: e.Distinct, Pos: e.Pos}
+	case *AliasExpr:
+		expr = &AliasExpr{Expr: Transform(e.Expr, fn), Alias: e.Alias}
+	case *InExpr:
+		values := make([]Expression, len(e.Values))
+		for i, v := range e.Values {
+			values[i] = Transform(v, fn)
+		}
+		if e.Values == nil {
+			values = nil
+		}
+		expr = &InExpr{Expr: Transform(e.Expr, fn), Subquery: e.Subquery, Values: values, Not: e.Not}
+	case *UnaryExpr:
+		expr = &UnaryExpr{Op: e.Op, Expr: Transform(e.Expr, fn)}
+	case *IsNullExpr:
+		expr = &IsNullExpr{Expr: Transform(e.Expr, fn), Not: e.Not}
+	case *BetweenExpr:
+		expr = &BetweenExpr{
+			Expr: Transform(e.Expr, fn),
+			Low:  Transform(e.Low, fn),
+			High: Transform(e.High, fn),
+			Not:  e.Not,
+		}
+	case *LikeExpr:
+		expr = &LikeExpr{Expr: Transform(e.Expr, fn), Pattern: Transform(e.Pattern, fn), Not: e.Not}
+	case *CastExpr:
+		expr = &CastExpr{Expr: Transform(e.Expr, fn), Type: e.Type}
+	case *FieldExpr:
+		expr = &FieldExpr{Expr: Transform(e.Expr, fn), Field: e.Field, Quoted: e.Quoted, Pos: e.Pos}
+	case *IndexExpr:
+		expr = &IndexExpr{Expr: Transform(e.Expr, fn), Index: Transform(e.Index, fn), Pos: e.Pos}
+	case *WindowExpr:
+		w := &WindowExpr{
+			Func:        Transform(e.Func, fn).(*FuncCall),
+			Frame:       e.Frame,
+			PartitionBy: make([]Expression, len(e.PartitionBy)),
+			OrderBy:     make([]OrderByItem, len(e.OrderBy)),
+		}
+		for i, k := range e.PartitionBy {
+			w.PartitionBy[i] = Transform(k, fn)
+		}
+		for i, item := range e.OrderBy {
+			item.Expr = Transform(item.Expr, fn)
+			w.OrderBy[i] = item
+		}
+		expr = w
+	}
+	return fn(expr)
+}
@@ -0,0 +1,124 @@
+package queryparser
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestWalk(t *testing.T) {
+	q := mustParse(t, "SELECT UPPER(Date), Close + 1 FROM prices WHERE Close IN (SELECT Low FROM lows WHERE Low > 0) AND NOT Volume IS NULL")
+
+	var columns []string
+	WalkQuery(q, func(expr Expression) {
+		Inspect(expr, func(e Expression) bool {
+			if col, ok := e.(*ColumnRef); ok {
+				columns = append(columns, col.Name)
+			}
+			return true
+		})
+	})
+	if got := fmt.Sprint(columns); got != "[Date Close Close Volume Low Low]" {
+		t.Errorf("unexpected columns %s", got)
+	}
+
+	// Returning false skips the children
+	var funcs int
+	Inspect(q.Projections[0], func(e Expression) bool {
+		if _, ok := e.(*FuncCall); ok {
+			funcs++
+			return false
+		}
+		if _, ok := e.(*ColumnRef); ok {
+			t.Errorf("expected the arguments of UPPER to be skipped")
+		}
+		return true
+	})
+	if funcs != 1 {
+		t.Errorf("expected one function call, got %d", funcs)
+	}
+
+	renamed := Transform(q.Where, func(e Expression) Expression {
+		if col, ok := e.(*ColumnRef); ok {
+			return &ColumnRef{Table: "p", Name: strings.ToLower(col.Name)}
+		}
+		return e
+	})
+	if got := formatExpr(renamed); !strings.HasPrefix(got, "((p.close IN (SELECT Low") || !strings.HasSuffix(got, "(NOT (p.volume IS NULL)))") {
+		t.Errorf("unexpected transformed expression %s", got)
+	}
+	if got := formatExpr(q.Where); !strings.HasPrefix(got, "((Close IN") {
+		t.Errorf("expected the original to be unchanged, got %s", got)
+	}
+
+	// TransformQuery reaches into the subqueries too
+	lowered := TransformQuery(q, func(e Expression) Expression {
+		if col, ok := e.(*ColumnRef); ok {
+			return &ColumnRef{Name: strings.ToLower(col.Name)}
+		}
+		return e
+	})
+	if got := lowered.String(); !strings.Contains(got, "(SELECT low FROM lows WHERE (low > 0))") || !strings.Contains(got, "UPPER(date)") {
+		t.Errorf("unexpected transformed query %s", got)
+	}
+	if got := q.String(); !strings.Contains(got, "UPPER(Date)") || !strings.Contains(got, "WHERE (Low > 0)") {
+		t.Errorf("expected the original query to be unchanged, got %s", got)
+	}
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	expr := &BinaryExpr{Left: &ColumnRef{Name: "a"}, Op: ">", Right: &Literal{Value: "1"}}
+	data, err := EncodeJSON(expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"left":{"name":"a","node":"ColumnRef"},"node":"BinaryExpr","op":">","right":{"node":"Literal","value":"1"}}`; string(data) != want {
+		t.Errorf("expected %s, got %s", want, data)
+	}
+	decoded, err := DecodeExpressionJSON(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := formatExpr(decoded); got != "(a > 1)" {
+		t.Errorf("unexpected decoded expression %s", got)
+	}
+
+	stmts, err := NewParser(`
+		WITH w AS (SELECT * EXCLUDE (Volume) FROM prices)
+		SELECT Date, SUM(Close) OVER (PARTITION BY Date ORDER BY Close DESC NULLS FIRST ROWS BETWEEN 2 PRECEDING AND UNBOUNDED FOLLOWING) AS s, CAST(Close AS INT)
+		FROM w JOIN (VALUES (1, 'a')) v(id, name) ON w.Close = v.id
+		WHERE Date BETWEEN DATE '2020-01-01' AND DATE '2021-01-01' AND EXISTS (SELECT 1 FROM t) AND Close IS NOT NULL
+		QUALIFY s > 1 UNION ALL SELECT Date, 1, 2 FROM prices ORDER BY 1;
+		MERGE INTO prices p USING src s ON p.Date = s.Date WHEN MATCHED THEN UPDATE SET Close = s.Close WHEN NOT MATCHED THEN INSERT VALUES (s.Date, TRUE, NULL);
+		COPY prices TO 'out.csv' (HEADER true);
+		CREATE OR REPLACE VIEW v AS SELECT 1 FROM prices;
+		DROP TABLE IF EXISTS old;
+		SHOW TABLES;
+		SET null_ordering = 'nulls_first'`).ParseScript()
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	for _, stmt := range stmts {
+		data, err := EncodeJSON(stmt)
+		if err != nil {
+			t.Fatalf("encode %s: %v", stmt, err)
+		}
+		decoded, err := DecodeStatementJSON(data)
+		if err != nil {
+			t.Fatalf("decode %s: %v", data, err)
+		}
+		if decoded.String() != stmt.String() {
+			t.Errorf("round trip changed %s into %s", stmt, decoded)
+		}
+		again, err := EncodeJSON(decoded)
+		if err != nil || string(again) != string(data) {
+			t.Errorf("re-encoding %s gave %s", data, again)
+		}
+	}
+
+	for _, bad := range []string{`{"node":"Nope"}`, `{"node":"ShowTablesStmt","nmae":"a"}`, `{"node":"ColumnRef","name":"a"}`} {
+		if _, err := DecodeStatementJSON([]byte(bad)); err == nil {
+			t.Errorf("expected %s to fail to decode as a statement", bad)
+		}
+	}
+}